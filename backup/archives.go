@@ -0,0 +1,434 @@
+package backup
+
+import (
+    "archive/tar"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/layout"
+)
+
+// TimestampFormat is the layout used in backup archive names
+const TimestampFormat = "2006-01-02_150405"
+
+// Archive describes a backup archive found on disk
+type Archive struct {
+    Site string
+    Type string // "file" or "database"
+    Path string
+    Time time.Time
+    Size int64
+}
+
+// appsDirName is the directory inside a site's backup directory holding the
+// backups of further applications served by the site
+const appsDirName = "apps"
+
+// AppKey returns the name under which an application of a multi-app site is
+// backed up. It is used like a site name and resolves to the directory
+// <site>/apps/<app>.
+func AppKey(site, app string) string {
+    return site + "/" + appsDirName + "/" + app
+}
+
+// SplitAppKey returns the site and application of a name created by AppKey.
+// For plain site names the application is empty.
+func SplitAppKey(key string) (string, string) {
+    parts := strings.SplitN(key, "/", 3)
+    if len(parts) == 3 && parts[1] == appsDirName {
+        return parts[0], parts[2]
+    }
+    return key, ""
+}
+
+// ReportsDirName is the directory of run reports in the local backup
+// directory by default; it holds no site
+const ReportsDirName = "reports"
+
+// ListArchives returns all backup archives found under baseDir, oldest first.
+// A site's directory is searched as deep as the layout places archives;
+// archives named as in the default layout are found anywhere in it, such as
+// dumps placed directly in the site directory by earlier remote backups.
+// Archives of applications of multi-app sites are reported under their AppKey.
+func ListArchives(baseDir string) ([]Archive, error) {
+    keys, err := siteKeys(baseDir)
+    if err != nil {
+        return nil, err
+    }
+    var archives []Archive
+    for _, key := range keys {
+        found, err := listSiteArchives(key, filepath.Join(baseDir, key))
+        if err != nil {
+            return nil, err
+        }
+        archives = append(archives, found...)
+    }
+
+    sort.Slice(archives, func(i, j int) bool {
+        return archives[i].Time.Before(archives[j].Time)
+    })
+    return archives, nil
+}
+
+// siteKeys returns the sites and applications with a directory below baseDir
+func siteKeys(baseDir string) ([]string, error) {
+    entries, err := os.ReadDir(baseDir)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    var keys []string
+    for _, entry := range entries {
+        if !entry.IsDir() || strings.HasPrefix(entry.Name(), "_") || entry.Name() == ReportsDirName {
+            continue
+        }
+        site := entry.Name()
+        keys = append(keys, site)
+
+        // Applications of multi-app sites have their own directories
+        apps, err := os.ReadDir(filepath.Join(baseDir, site, appsDirName))
+        if err != nil && !os.IsNotExist(err) {
+            return nil, err
+        }
+        for _, app := range apps {
+            if app.IsDir() {
+                keys = append(keys, AppKey(site, app.Name()))
+            }
+        }
+    }
+    return keys, nil
+}
+
+// ListChecksumManifests returns the checksum manifests below baseDir as
+// archives of the type "manifest", also those of directories whose
+// archives are all gone
+func ListChecksumManifests(baseDir string) ([]Archive, error) {
+    keys, err := siteKeys(baseDir)
+    if err != nil {
+        return nil, err
+    }
+    var manifests []Archive
+    for _, key := range keys {
+        siteDir := filepath.Join(baseDir, key)
+        err := filepath.WalkDir(siteDir, func(path string, d fs.DirEntry, err error) error {
+            if err != nil {
+                return err
+            }
+            if path == siteDir {
+                return nil
+            }
+            if d.IsDir() {
+                if strings.HasPrefix(d.Name(), ".") || IsSnapshot(path) || (d.Name() == appsDirName && filepath.Dir(path) == siteDir) {
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+            if d.Name() == ChecksumManifestName {
+                manifests = append(manifests, Archive{Site: key, Type: "manifest", Path: path})
+            }
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return manifests, nil
+}
+
+// listSiteArchives collects the archives of a single site from its
+// directory and the directories below it. The directories of the site's
+// applications, snapshots and hidden entries, such as snapshots being
+// built, are not searched. Split archives are listed with their path as if
+// they were whole.
+func listSiteArchives(site, siteDir string) ([]Archive, error) {
+    var archives []Archive
+    err := filepath.WalkDir(siteDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) && path == siteDir {
+                return filepath.SkipDir
+            }
+            return err
+        }
+        if path == siteDir {
+            return nil
+        }
+        if strings.HasPrefix(d.Name(), ".") || (d.IsDir() && d.Name() == appsDirName && filepath.Dir(path) == siteDir) {
+            if d.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if d.IsDir() && !IsSnapshot(path) {
+            return nil
+        }
+        // Split archives are found by the manifest of their parts
+        split := !d.IsDir() && strings.HasSuffix(path, PartsExt)
+        path = strings.TrimSuffix(path, PartsExt)
+        a, ok := parseArchive(path)
+        if ok {
+            info, err := d.Info()
+            if err != nil {
+                return nil
+            }
+            size := info.Size()
+            if split {
+                if size, err = archiveFileSize(path); err != nil {
+                    return nil
+                }
+            }
+            archives = append(archives, Archive{
+                Site: site,
+                Type: a.Type,
+                Path: path,
+                Time: a.Time,
+                Size: size,
+            })
+        }
+        if d.IsDir() {
+            return filepath.SkipDir
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return archives, nil
+}
+
+// siteArchivePaths returns the paths of a site's archives of a type
+func siteArchivePaths(site, siteDir, archiveType string) ([]string, error) {
+    archives, err := listSiteArchives(site, siteDir)
+    if err != nil {
+        return nil, err
+    }
+    var paths []string
+    for _, a := range archives {
+        if a.Type == archiveType {
+            paths = append(paths, a.Path)
+        }
+    }
+    return paths, nil
+}
+
+// archiveLayout places new archives and recognizes archives by their
+// paths. legacyLayout recognizes archives named as in the default layout
+// anywhere in a site's directory, so archives made before the layout was
+// changed stay known.
+var (
+    archiveLayout = layout.MustParse(layout.Default)
+    legacyLayout  = layout.MustParse(`{{.Site}}/{{.Type}}_{{.Timestamp}}{{.Incr}}.{{.Ext}}`)
+)
+
+// SetLayout sets the layout of the backup directory, see the layout package
+func SetLayout(l *layout.Layout) {
+    archiveLayout = l
+}
+
+// archivePath returns the path of a new archive of a site below baseDir.
+// timestamp is in TimestampFormat and ext the extension with its leading dot.
+func archivePath(baseDir, siteName, archiveType, timestamp string, incremental bool, ext string) string {
+    t, _ := time.ParseInLocation(TimestampFormat, timestamp, time.Local)
+    return filepath.Join(baseDir, filepath.FromSlash(archiveLayout.Path(siteName, archiveType, t, incremental, ext)))
+}
+
+// parseArchive recognizes an archive by its path, with the layout or by its
+// name as in the default layout, and checks its extension against its type
+func parseArchive(path string) (layout.Archive, bool) {
+    for _, l := range []*layout.Layout{archiveLayout, legacyLayout} {
+        a, ok := l.Match(path)
+        if !ok {
+            continue
+        }
+        for _, ext := range archiveExts[a.Type] {
+            if a.Ext == ext {
+                return a, true
+            }
+        }
+    }
+    return layout.Archive{}, false
+}
+
+// archiveSiteDir returns the directory of the site an archive belongs to
+func archiveSiteDir(path string) string {
+    a, ok := parseArchive(path)
+    if !ok {
+        return filepath.Dir(path)
+    }
+    return strings.TrimSuffix(path, string(filepath.Separator)+filepath.FromSlash(a.Rel))
+}
+
+// ParseArchivePath extracts the archive type and timestamp from the path of
+// an archive as placed by the layout, or from a name such as
+// files_2025-02-10_220130.tar.gz, files_2025-02-10_220130_incr.tar.zst or
+// db_2025-02-10_220130.sql.gz, in any compression format
+func ParseArchivePath(path string) (string, time.Time, bool) {
+    a, ok := parseArchive(path)
+    if !ok {
+        return "", time.Time{}, false
+    }
+    return a.Type, a.Time, true
+}
+
+// archiveReader reads the decompressed content of an archive
+type archiveReader struct {
+    io.ReadCloser
+    file io.Closer
+}
+
+// Close closes the archive file
+func (r *archiveReader) Close() error {
+    r.ReadCloser.Close()
+    if r.file == nil {
+        return nil
+    }
+    return r.file.Close()
+}
+
+// openArchive opens a compressed archive for reading, detecting its
+// compression format and decrypting it with keys if it is encrypted. keys may
+// be nil for unencrypted archives. Deduplicated archives are read from the
+// chunk store, snapshots as a tar stream of their directory and split
+// archives from their parts.
+func openArchive(path string, keys *encryption.Keyring) (*archiveReader, error) {
+    if IsSnapshot(path) {
+        r, err := openSnapshot(path)
+        if err != nil {
+            return nil, err
+        }
+        return &archiveReader{ReadCloser: r}, nil
+    }
+    if dedup.IsIndex(path) {
+        r, err := dedup.Open(path, keys)
+        if err != nil {
+            return nil, err
+        }
+        return &archiveReader{ReadCloser: r}, nil
+    }
+    file, err := openArchiveFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open archive: %v", err)
+    }
+    plain, err := encryption.NewReader(file, keys)
+    if err != nil {
+        file.Close()
+        return nil, fmt.Errorf("failed to decrypt %s: %v", filepath.Base(path), err)
+    }
+    r, err := newDecompressor(plain)
+    if err != nil {
+        file.Close()
+        return nil, fmt.Errorf("failed to create decompressor: %v", err)
+    }
+    return &archiveReader{ReadCloser: r, file: file}, nil
+}
+
+// dumpCompletionMarkers are the comments mysqldump and pg_dump write as the
+// last lines of a dump that ran to completion
+var dumpCompletionMarkers = []string{
+    "-- Dump completed",
+    "-- PostgreSQL database dump complete",
+}
+
+// dumpTailSize is how much of the end of a dump is searched for a marker
+const dumpTailSize = 4096
+
+// tailBuffer keeps the last bytes written to it
+type tailBuffer struct {
+    buf []byte
+}
+
+// Write appends p, dropping everything but the last dumpTailSize bytes
+func (t *tailBuffer) Write(p []byte) (int, error) {
+    t.buf = append(t.buf, p...)
+    if len(t.buf) > dumpTailSize {
+        t.buf = append(t.buf[:0], t.buf[len(t.buf)-dumpTailSize:]...)
+    }
+    return len(p), nil
+}
+
+// hasCompletionMarker reports whether the end of a dump is a completion
+// marker. Only blank lines, comment separators and the \unrestrict command of
+// newer pg_dump versions may follow it.
+func hasCompletionMarker(tail []byte) bool {
+    lines := strings.Split(string(tail), "\n")
+    for i := len(lines) - 1; i >= 0; i-- {
+        line := strings.TrimSpace(lines[i])
+        if line == "" || line == "--" || strings.HasPrefix(line, `\unrestrict`) {
+            continue
+        }
+        for _, marker := range dumpCompletionMarkers {
+            if strings.HasPrefix(line, marker) {
+                return true
+            }
+        }
+        return false
+    }
+    return false
+}
+
+// CheckArchive fully decodes an archive to make sure it is readable,
+// decrypting it with keys if it is encrypted.
+// File archives are additionally walked entry by entry, database dumps
+// must end with the completion marker of the dump tool and copies of SQLite
+// databases must be complete databases. Redis and MongoDB dumps and physical
+// database backups must be complete files of their formats.
+func CheckArchive(a Archive, keys *encryption.Keyring) error {
+    ar, err := openArchive(a.Path, keys)
+    if err != nil {
+        return err
+    }
+    defer ar.Close()
+
+    switch a.Type {
+    case config.DatastoreRedis:
+        return checkRedisDump(ar)
+    case config.DatastoreMongo:
+        return checkMongoDump(ar)
+    case BinlogArchiveType:
+        return checkBinlogArchive(ar)
+    case PhysicalArchiveType:
+        return checkPhysicalBackup(ar)
+    }
+    if a.Type != "file" && isSQLiteDump(a.Path) {
+        return checkSQLiteDump(ar)
+    }
+    if a.Type != "file" {
+        tail := &tailBuffer{}
+        if _, err := io.Copy(tail, ar); err != nil {
+            return fmt.Errorf("failed to decompress archive: %v", err)
+        }
+        if !hasCompletionMarker(tail.buf) {
+            return fmt.Errorf("dump is incomplete: completion marker not found at the end")
+        }
+        return nil
+    }
+
+    tr := tar.NewReader(ar)
+    for {
+        _, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("failed to read tar header: %v", err)
+        }
+        if _, err := io.Copy(io.Discard, tr); err != nil {
+            return fmt.Errorf("failed to read tar entry: %v", err)
+        }
+    }
+    // Drain the remaining compressed stream so trailing corruption is detected
+    if _, err := io.Copy(io.Discard, ar); err != nil {
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    return nil
+}
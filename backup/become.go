@@ -0,0 +1,78 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "laravel-backup-tool/config"
+)
+
+// becomePrefix returns the prefix running a program on the server with the
+// privileges of an escalation method, empty without one. askpass is the
+// program handing sudo its password, empty if sudo must not ask for one.
+func becomePrefix(b config.Become, askpass string) string {
+    user := b.User
+    if user == "" {
+        user = "root"
+    }
+    switch b.Method {
+    case config.BecomeSudo:
+        if askpass != "" {
+            return fmt.Sprintf("SUDO_ASKPASS=%s sudo -A -u %s --", shellQuote(askpass), shellQuote(user))
+        }
+        return fmt.Sprintf("sudo -n -u %s --", shellQuote(user))
+    case config.BecomeDoas:
+        return fmt.Sprintf("doas -n -u %s", shellQuote(user))
+    case config.BecomeHelper:
+        return shellQuote(b.Helper)
+    }
+    return ""
+}
+
+// become wraps a command to run with the configured privileges once they
+// are set up. Files the command writes into the run's private temporary
+// directory stay readable for the SSH user, who copies them.
+func (sb *SSHBackup) become(cmd string) string {
+    if !sb.escalated {
+        return cmd
+    }
+    return becomePrefix(sb.config.Become, sb.askpass) + " sh -c " + shellQuote("umask 022; "+cmd)
+}
+
+// setupBecome makes the commands run from now on gain the configured
+// privileges, writing the askpass program for a sudo password into the
+// run's temporary directory, and checks that they do
+func (sb *SSHBackup) setupBecome(ctx context.Context) error {
+    b := sb.config.Become
+    if b.Method == "" {
+        return nil
+    }
+    if b.Password != "" {
+        script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' %s\n", shellQuote(b.Password))
+        askpass, _, err := sb.writeRemoteSecret("askpass", []byte(script))
+        if err != nil {
+            return err
+        }
+        client, err := sb.sftpClient()
+        if err != nil {
+            return err
+        }
+        if err := client.Chmod(askpass, 0700); err != nil {
+            return fmt.Errorf("failed to make %s executable: %v", askpass, err)
+        }
+        sb.askpass = askpass
+    }
+
+    sb.escalated = true
+    output, err := sb.execute(ctx, "id -un", sb.commandTimeout)
+    if err != nil {
+        sb.escalated = false
+        hint := ""
+        if b.Method == config.BecomeSudo && b.Password == "" {
+            hint = ", set a become password if sudo asks for one"
+        }
+        return fmt.Errorf("failed to run commands with %s: %v, output: %s%s", b.Method, err, strings.TrimSpace(string(output)), hint)
+    }
+    sb.log.Info("Running remote commands with privileges", "method", b.Method, "user", strings.TrimSpace(string(output)))
+    return nil
+}
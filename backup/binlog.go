@@ -0,0 +1,617 @@
+package backup
+
+import (
+    "archive/tar"
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/encryption"
+)
+
+// BinlogArchiveType is the archive type of binary logs archived between
+// full dumps of a database
+const BinlogArchiveType = "binlog"
+
+// binlogExt is the extension of binlog archives before compression: a tar
+// of the raw binary log files following a metadata entry
+const binlogExt = ".binlog.tar"
+
+// binlogMetaName names the metadata entry of binlog archives, and
+// binlogStateName the file in a site's backup directory recording where
+// the next binlog archive starts
+const (
+    binlogMetaName  = "binlog.json"
+    binlogStateName = "binlog.json"
+)
+
+// binlogCoordinates finds the binary log position mysqldump --source-data=2
+// (or --master-data=2) writes as a comment at the start of a dump
+var binlogCoordinates = regexp.MustCompile(`_LOG_FILE='([^']+)',\s*\w+_LOG_POS=(\d+)`)
+
+// BinlogPosition is a position in the binary logs of a server
+type BinlogPosition struct {
+    File     string `json:"file"`
+    Position int64  `json:"position"`
+}
+
+// BinlogMeta describes the binary logs in a binlog archive. Start is where
+// replaying the first file begins, its position being that of the full dump
+// for the first archive after it and 0 for the others. Until is when the
+// last file was closed.
+type BinlogMeta struct {
+    Database string         `json:"database"`
+    Dump     string         `json:"dump"`
+    Start    BinlogPosition `json:"start"`
+    Files    []string       `json:"files"`
+    Until    time.Time      `json:"until"`
+}
+
+// binlogState is the chain of binlog archives a site's database backups
+// continue: the full dump it starts from, as its timestamp, and the
+// binary log the next archive starts with
+type binlogState struct {
+    Dump     string         `json:"dump"`
+    Database string         `json:"database"`
+    Next     BinlogPosition `json:"next"`
+}
+
+// BackupBinlogs backs up a site's MySQL or MariaDB database incrementally
+// and returns the path of the new dump or binlog archive. A full dump
+// recording its binary log position is made when there is none yet, it is
+// older than the manager's Binlogs.FullEvery or the binary logs following
+// it are no longer on the server. Otherwise the binary logs are flushed
+// and those written since the previous backup are archived.
+func (db *DBBackup) BackupBinlogs(ctx context.Context, siteName, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    var path string
+    err := db.manager.Retry.Do(ctx, slog.With("site", siteName), "binary log backup", func() error {
+        var err error
+        path, err = db.backupBinlogs(ctx, siteName, dbHost, dbPort, dbName, dbUser, dbPass)
+        return err
+    })
+    return path, err
+}
+
+// backupBinlogs makes one attempt of BackupBinlogs
+func (db *DBBackup) backupBinlogs(ctx context.Context, siteName, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    bm := db.manager
+    state, err := bm.loadBinlogState(siteName)
+    if err != nil {
+        return "", err
+    }
+    reason := ""
+    switch {
+    case state == nil:
+        reason = "no full dump yet"
+    case state.Database != dbName:
+        reason = "database changed"
+    default:
+        dumps, err := siteArchivePaths(siteName, bm.getSiteBackupDir(siteName), "database")
+        if err != nil {
+            return "", fmt.Errorf("failed to list backups: %v", err)
+        }
+        dumpTime, _ := time.ParseInLocation(TimestampFormat, state.Dump, time.Local)
+        found := false
+        for _, path := range dumps {
+            found = found || archiveTime(path).Equal(dumpTime)
+        }
+        if !found {
+            reason = "full dump removed"
+        } else if time.Since(dumpTime) >= bm.Binlogs.FullEvery {
+            reason = "full dump older than " + bm.Binlogs.FullEvery.String()
+        }
+    }
+    if reason != "" {
+        return db.backupBinlogBase(ctx, siteName, reason, dbHost, dbPort, dbName, dbUser, dbPass)
+    }
+
+    // Close the current binary log, so every file up to the new one is complete
+    output, err := mysqlQuery(ctx, dbHost, dbPort, dbUser, dbPass, "FLUSH BINARY LOGS; SHOW BINARY LOGS")
+    if err != nil {
+        return "", err
+    }
+    until := time.Now()
+    var logs []string
+    for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+        if fields := strings.Fields(line); len(fields) > 0 {
+            logs = append(logs, fields[0])
+        }
+    }
+    first := -1
+    for i, name := range logs {
+        if name == state.Next.File {
+            first = i
+        }
+    }
+    if first < 0 {
+        return db.backupBinlogBase(ctx, siteName, "binary log "+state.Next.File+" purged from the server", dbHost, dbPort, dbName, dbUser, dbPass)
+    }
+    files := logs[first : len(logs)-1]
+    if len(files) == 0 {
+        return "", fmt.Errorf("no closed binary log after %s", state.Next.File)
+    }
+
+    tempDir, err := NewTempDir(siteName)
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tempDir)
+    args := []string{"--read-from-remote-server", "--raw", "--result-file=" + tempDir + string(filepath.Separator)}
+    cmd, cleanup, err := mysqlCommand(ctx, bm.Binlogs.MySQLBinlog, dbHost, dbPort, dbUser, dbPass, append(args, files...)...)
+    if err != nil {
+        return "", err
+    }
+    defer cleanup()
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return "", contextError(ctx, fmt.Errorf("failed to run %s: %v, output: %s", bm.Binlogs.MySQLBinlog, err, bytes.TrimSpace(output)))
+    }
+
+    meta := BinlogMeta{Database: dbName, Dump: state.Dump, Start: state.Next, Files: files, Until: until}
+    path, err := bm.storeDumpOf(ctx, siteName, BinlogArchiveType, binlogExt, bm.Compression.For(siteName), func(w io.Writer) error {
+        return writeBinlogArchive(ctx, w, tempDir, meta)
+    })
+    if err != nil {
+        return "", err
+    }
+    state.Next = BinlogPosition{File: logs[len(logs)-1]}
+    if err := bm.saveBinlogState(siteName, state); err != nil {
+        return "", err
+    }
+    return path, nil
+}
+
+// backupBinlogBase makes the full dump binlog archives start from, with the
+// binary logs flushed and the position of the new one recorded in the dump
+func (db *DBBackup) backupBinlogBase(ctx context.Context, siteName, reason, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    bm := db.manager
+    slog.Info("Making full dump for binary log backups", "site", siteName, "reason", reason)
+
+    args := []string{"--single-transaction", "--flush-logs", sourceDataOption(ctx)}
+    args = append(args, mysqldumpArgs(bm.MySQLDump.For(siteName), dbName)...)
+    mysqldump, err := mysqlBinary("mysqldump")
+    if err != nil {
+        return "", err
+    }
+    cmd, cleanup, err := mysqlCommand(ctx, mysqldump, dbHost, dbPort, dbUser, dbPass, args...)
+    if err != nil {
+        return "", err
+    }
+    defer cleanup()
+    path, err := bm.writeDump(ctx, siteName, cmd, "mysqldump")
+    if err != nil {
+        return "", err
+    }
+
+    position, err := readDumpPosition(path, bm.Keyring)
+    if err != nil {
+        // The dump is fine on its own; the next backup tries again
+        slog.Warn("Binary log position not found in dump, is binary logging enabled?", "site", siteName, "path", path, "error", err)
+        return path, nil
+    }
+    _, t, _ := ParseArchivePath(path)
+    state := &binlogState{Dump: t.Format(TimestampFormat), Database: dbName, Next: position}
+    if err := bm.saveBinlogState(siteName, state); err != nil {
+        return "", err
+    }
+    return path, nil
+}
+
+// sourceDataOption returns the mysqldump option recording the binary log
+// position as a comment: --source-data=2 since MySQL 8.0.26, --master-data=2
+// for older versions and MariaDB
+func sourceDataOption(ctx context.Context) string {
+    mysqldump, err := mysqlBinary("mysqldump")
+    if err != nil {
+        return "--master-data=2"
+    }
+    help, _ := exec.CommandContext(ctx, mysqldump, "--help").Output()
+    if bytes.Contains(help, []byte("--source-data")) {
+        return "--source-data=2"
+    }
+    return "--master-data=2"
+}
+
+// readDumpPosition reads the binary log position recorded near the start of
+// a dump
+func readDumpPosition(path string, keys *encryption.Keyring) (BinlogPosition, error) {
+    ar, err := openArchive(path, keys)
+    if err != nil {
+        return BinlogPosition{}, err
+    }
+    defer ar.Close()
+    scanner := bufio.NewScanner(ar)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for lines := 0; lines < 200 && scanner.Scan(); lines++ {
+        if m := binlogCoordinates.FindStringSubmatch(scanner.Text()); m != nil {
+            pos, _ := strconv.ParseInt(m[2], 10, 64)
+            return BinlogPosition{File: m[1], Position: pos}, nil
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return BinlogPosition{}, fmt.Errorf("failed to read dump: %v", err)
+    }
+    return BinlogPosition{}, errors.New("no binary log coordinates in the dump")
+}
+
+// mysqlQuery runs SQL statements with the mysql client and returns their
+// tab-separated output without column names
+func mysqlQuery(ctx context.Context, dbHost, dbPort, dbUser, dbPass, query string) (string, error) {
+    mysql, err := mysqlBinary("mysql")
+    if err != nil {
+        return "", err
+    }
+    cmd, cleanup, err := mysqlCommand(ctx, mysql, dbHost, dbPort, dbUser, dbPass, "-N", "-B", "-e", query)
+    if err != nil {
+        return "", err
+    }
+    defer cleanup()
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    output, err := cmd.Output()
+    if err != nil {
+        return "", contextError(ctx, fmt.Errorf("failed to run mysql: %v, error output: %s", err, stderr.String()))
+    }
+    return string(output), nil
+}
+
+// writeBinlogArchive writes the tar of a binlog archive: the metadata,
+// then the binary log files from dir
+func writeBinlogArchive(ctx context.Context, w io.Writer, dir string, meta BinlogMeta) error {
+    data, err := json.MarshalIndent(meta, "", "  ")
+    if err != nil {
+        return err
+    }
+    tw := tar.NewWriter(w)
+    if err := tw.WriteHeader(&tar.Header{Name: binlogMetaName, Mode: 0644, Size: int64(len(data)), ModTime: meta.Until}); err != nil {
+        return fmt.Errorf("failed to write binlog archive: %v", err)
+    }
+    if _, err := tw.Write(data); err != nil {
+        return fmt.Errorf("failed to write binlog archive: %v", err)
+    }
+    for _, name := range meta.Files {
+        if err := addBinlogFile(ctx, tw, filepath.Join(dir, name)); err != nil {
+            return err
+        }
+    }
+    if err := tw.Close(); err != nil {
+        return fmt.Errorf("failed to write binlog archive: %v", err)
+    }
+    return nil
+}
+
+// addBinlogFile adds a binary log file to a binlog archive
+func addBinlogFile(ctx context.Context, tw *tar.Writer, path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open binary log: %v", err)
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to open binary log: %v", err)
+    }
+    if err := tw.WriteHeader(&tar.Header{Name: filepath.Base(path), Mode: 0640, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+        return fmt.Errorf("failed to write binlog archive: %v", err)
+    }
+    if _, err := io.Copy(tw, &contextReader{ctx: ctx, r: f}); err != nil {
+        return contextError(ctx, fmt.Errorf("failed to write binlog archive: %v", err))
+    }
+    return nil
+}
+
+// loadBinlogState reads where a site's binlog archives continue, nil if
+// the site has no full dump for them yet
+func (bm *BackupManager) loadBinlogState(siteName string) (*binlogState, error) {
+    data, err := os.ReadFile(filepath.Join(bm.getSiteBackupDir(siteName), binlogStateName))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read binary log state: %v", err)
+    }
+    var state binlogState
+    if err := json.Unmarshal(data, &state); err != nil {
+        return nil, fmt.Errorf("invalid binary log state of %s: %v", siteName, err)
+    }
+    return &state, nil
+}
+
+// saveBinlogState records where a site's binlog archives continue
+func (bm *BackupManager) saveBinlogState(siteName string, state *binlogState) error {
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return err
+    }
+    path := filepath.Join(bm.getSiteBackupDir(siteName), binlogStateName)
+    if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+        return fmt.Errorf("failed to write binary log state: %v", err)
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        return fmt.Errorf("failed to write binary log state: %v", err)
+    }
+    return nil
+}
+
+// readBinlogMeta reads the metadata of a binlog archive
+func readBinlogMeta(path string, keys *encryption.Keyring) (BinlogMeta, error) {
+    ar, err := openArchive(path, keys)
+    if err != nil {
+        return BinlogMeta{}, err
+    }
+    defer ar.Close()
+    return readBinlogMetaFrom(tar.NewReader(ar))
+}
+
+// readBinlogMetaFrom reads the metadata entry at the start of a binlog
+// archive
+func readBinlogMetaFrom(tr *tar.Reader) (BinlogMeta, error) {
+    var meta BinlogMeta
+    hdr, err := tr.Next()
+    if err != nil {
+        return meta, fmt.Errorf("failed to read tar header: %v", err)
+    }
+    if hdr.Name != binlogMetaName {
+        return meta, fmt.Errorf("not a binlog archive: %s instead of %s at the start", hdr.Name, binlogMetaName)
+    }
+    if err := json.NewDecoder(tr).Decode(&meta); err != nil {
+        return meta, fmt.Errorf("invalid binlog archive metadata: %v", err)
+    }
+    return meta, nil
+}
+
+// checkBinlogArchive checks that a decompressed binlog archive holds its
+// metadata and every binary log it lists, each starting with the binary
+// log magic number
+func checkBinlogArchive(r io.Reader) error {
+    tr := tar.NewReader(r)
+    meta, err := readBinlogMetaFrom(tr)
+    if err != nil {
+        return err
+    }
+    found := make(map[string]bool)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fmt.Errorf("failed to read tar header: %v", err)
+        }
+        magic := make([]byte, 4)
+        if _, err := io.ReadFull(tr, magic); err != nil || string(magic) != "\xfebin" {
+            return fmt.Errorf("%s is not a binary log", hdr.Name)
+        }
+        if _, err := io.Copy(io.Discard, tr); err != nil {
+            return fmt.Errorf("failed to read tar entry: %v", err)
+        }
+        found[hdr.Name] = true
+    }
+    for _, name := range meta.Files {
+        if !found[name] {
+            return fmt.Errorf("binary log %s is missing", name)
+        }
+    }
+    if _, err := io.Copy(io.Discard, r); err != nil {
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    return nil
+}
+
+// BinlogChain is what a point-in-time restore replays: a full dump and the
+// binlog archives following it up to the point in time, oldest first.
+// Until is when the last of them ends.
+type BinlogChain struct {
+    Dump     Archive
+    Binlogs  []string
+    Database string
+    Until    time.Time
+}
+
+// FindBinlogChain finds the newest full dump of a site's database with
+// binlog archives that was made at or before until, and the binlog
+// archives to replay on top of it to reach until. If a later dump made at
+// or before until is newer than the binary logs reach, that dump alone is
+// returned instead.
+func FindBinlogChain(baseDir, site string, until time.Time, keys *encryption.Keyring) (BinlogChain, error) {
+    archives, err := listSiteArchives(site, filepath.Join(baseDir, site))
+    if err != nil {
+        return BinlogChain{}, fmt.Errorf("failed to list backups: %v", err)
+    }
+    chains := make(map[string][]string)
+    metas := make(map[string]BinlogMeta)
+    for _, a := range archives {
+        if a.Type != BinlogArchiveType {
+            continue
+        }
+        meta, err := readBinlogMeta(a.Path, keys)
+        if err != nil {
+            return BinlogChain{}, fmt.Errorf("failed to read %s: %v", filepath.Base(a.Path), err)
+        }
+        metas[a.Path] = meta
+        chains[meta.Dump] = append(chains[meta.Dump], a.Path)
+    }
+
+    sort.Slice(archives, func(i, j int) bool {
+        return archives[i].Time.After(archives[j].Time)
+    })
+    var newest *Archive
+    for i, a := range archives {
+        if a.Type != "database" || a.Time.After(until) {
+            continue
+        }
+        if newest == nil {
+            newest = &archives[i]
+        }
+        stamp := a.Time.Format(TimestampFormat)
+        if len(chains[stamp]) == 0 {
+            continue
+        }
+        chain := BinlogChain{Dump: a, Until: a.Time}
+        binlogs := chains[stamp]
+        sort.Slice(binlogs, func(i, j int) bool {
+            return metas[binlogs[i]].Until.Before(metas[binlogs[j]].Until)
+        })
+        for _, path := range binlogs {
+            chain.Binlogs = append(chain.Binlogs, path)
+            chain.Database, chain.Until = metas[path].Database, metas[path].Until
+            if !chain.Until.Before(until) {
+                break
+            }
+        }
+        if newest.Time.After(chain.Until) {
+            break
+        }
+        return chain, nil
+    }
+    if newest == nil {
+        return BinlogChain{}, fmt.Errorf("no database backup of %s at or before %s", site, until.Format(time.DateTime))
+    }
+    return BinlogChain{Dump: *newest, Until: newest.Time}, nil
+}
+
+// ReplayBinlogs applies the binary logs of a chain's binlog archives to a
+// MySQL or MariaDB database up to until, after its dump was restored. The
+// events of the backed up database are replayed, renamed to dbName if that
+// differs. mysqlbinlog is the mysqlbinlog binary.
+func ReplayBinlogs(chain BinlogChain, until time.Time, mysqlbinlog, dbHost, dbPort, dbName, dbUser, dbPass string, keys *encryption.Keyring) error {
+    if len(chain.Binlogs) == 0 {
+        return nil
+    }
+    tempDir, err := NewTempDir(dbName)
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(tempDir)
+
+    var files []string
+    var start BinlogPosition
+    for i, path := range chain.Binlogs {
+        if _, err := VerifyChecksum(path); err != nil {
+            return fmt.Errorf("refusing to replay %s: %v", path, err)
+        }
+        meta, err := extractBinlogs(path, tempDir, keys)
+        if err != nil {
+            return err
+        }
+        if i == 0 {
+            start = meta.Start
+        }
+        for _, name := range meta.Files {
+            files = append(files, filepath.Join(tempDir, name))
+        }
+    }
+
+    args := []string{"--database=" + dbName, "--stop-datetime=" + until.Local().Format(time.DateTime)}
+    if start.Position > 0 {
+        args = append(args, "--start-position="+strconv.FormatInt(start.Position, 10))
+    }
+    if chain.Database != dbName {
+        args = append(args, "--rewrite-db="+chain.Database+"->"+dbName)
+    }
+    replay := exec.Command(mysqlbinlog, append(args, files...)...)
+    client, cleanup, err := databaseClient(DriverMySQL, dbHost, dbPort, dbName, dbUser, dbPass)
+    if err != nil {
+        return err
+    }
+    defer cleanup()
+    pipe, err := replay.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    client.Stdin = pipe
+    var replayErr, clientErr bytes.Buffer
+    replay.Stderr, client.Stderr = &replayErr, &clientErr
+    if err := replay.Start(); err != nil {
+        return fmt.Errorf("failed to run %s: %v", mysqlbinlog, err)
+    }
+    if err := client.Run(); err != nil {
+        replay.Process.Kill()
+        replay.Wait()
+        return fmt.Errorf("failed to run mysql: %v, error output: %s", err, clientErr.String())
+    }
+    if err := replay.Wait(); err != nil {
+        return fmt.Errorf("failed to run %s: %v, error output: %s", mysqlbinlog, err, replayErr.String())
+    }
+    return nil
+}
+
+// extractBinlogs extracts the binary logs of a binlog archive into dir and
+// returns its metadata
+func extractBinlogs(path, dir string, keys *encryption.Keyring) (BinlogMeta, error) {
+    ar, err := openArchive(path, keys)
+    if err != nil {
+        return BinlogMeta{}, err
+    }
+    defer ar.Close()
+    tr := tar.NewReader(ar)
+    meta, err := readBinlogMetaFrom(tr)
+    if err != nil {
+        return meta, err
+    }
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            return meta, nil
+        }
+        if err != nil {
+            return meta, fmt.Errorf("failed to read tar header: %v", err)
+        }
+        f, err := os.OpenFile(filepath.Join(dir, filepath.Base(hdr.Name)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+        if err != nil {
+            return meta, fmt.Errorf("failed to extract binary log: %v", err)
+        }
+        _, err = io.Copy(f, tr)
+        f.Close()
+        if err != nil {
+            return meta, fmt.Errorf("failed to extract binary log: %v", err)
+        }
+    }
+}
+
+// expiredBinlogs returns the binlog archives of a site made before the
+// oldest full dump rotation keeps, which no restore can start from
+func (bm *BackupManager) expiredBinlogs(siteName string, next bool) ([]string, error) {
+    binlogs, err := siteArchivePaths(siteName, bm.getSiteBackupDir(siteName), BinlogArchiveType)
+    if err != nil || len(binlogs) == 0 {
+        return nil, err
+    }
+    dumps, err := siteArchivePaths(siteName, bm.getSiteBackupDir(siteName), "database")
+    if err != nil {
+        return nil, err
+    }
+    dumps = append(dumps, bm.coldArchivePaths(siteName, "database")...)
+    expiredDumps, err := bm.expiredBackups(siteName, "database", next)
+    if err != nil {
+        return nil, err
+    }
+    expiring := make(map[string]bool)
+    for _, path := range expiredDumps {
+        expiring[path] = true
+    }
+    var oldest time.Time
+    for _, path := range dumps {
+        if t := archiveTime(path); !expiring[path] && (oldest.IsZero() || t.Before(oldest)) {
+            oldest = t
+        }
+    }
+
+    var expired []string
+    for _, path := range binlogs {
+        if oldest.IsZero() || archiveTime(path).Before(oldest) {
+            expired = append(expired, path)
+        }
+    }
+    return expired, nil
+}
@@ -0,0 +1,378 @@
+package backup
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/encryption"
+)
+
+// Types of the entries of file archives
+const (
+    EntryFile    = "file"
+    EntryDir     = "dir"
+    EntrySymlink = "symlink"
+)
+
+// listingVersion is the version of cached listings; listings of another
+// version are read from the archive again
+const listingVersion = 1
+
+// ListingEntry is a file, directory or symlink of a file archive
+type ListingEntry struct {
+    // Slash separated path relative to the document root
+    Path    string      `json:"path"`
+    Type    string      `json:"type"`
+    Size    int64       `json:"size"`
+    Mode    os.FileMode `json:"mode"`
+    ModTime time.Time   `json:"mtime"`
+    Link    string      `json:"link,omitempty"`
+    // Archive holding the entry, which for incremental archives may be one
+    // the archive builds on
+    Archive string `json:"archive"`
+}
+
+// archiveListing is the listing of one archive as cached in the catalog
+type archiveListing struct {
+    Version int            `json:"version"`
+    Entries []ListingEntry `json:"entries"`
+    // Paths of the site at the time of an incremental archive, from its
+    // manifest; the archive itself only holds those that changed
+    Tree []string `json:"tree,omitempty"`
+}
+
+// RestoredPath is a file or directory restored from a file archive
+type RestoredPath struct {
+    Archive string `json:"archive"`
+    Path    string `json:"path"`
+    Target  string `json:"target"`
+    // Where the existing file or directory was moved, if it was replaced
+    Previous string `json:"previous,omitempty"`
+    // Files, directories and symlinks extracted
+    Entries int `json:"entries"`
+}
+
+// entryPath returns the slash separated path of a tar entry relative to the
+// archive root, empty for the root itself
+func entryPath(name string) string {
+    return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// CleanArchivePath turns a path given by a user into the form of archive
+// entries, relative to the document root; empty for the root itself
+func CleanArchivePath(p string) (string, error) {
+    clean := path.Clean(strings.TrimPrefix(filepath.ToSlash(p), "/"))
+    if clean == ".." || strings.HasPrefix(clean, "../") {
+        return "", fmt.Errorf("%s is outside the document root", p)
+    }
+    if clean == "." {
+        return "", nil
+    }
+    return clean, nil
+}
+
+// ArchiveTree returns the files, directories and symlinks of a site as of a
+// file archive, sorted by path. For an incremental archive these are the
+// site's files at its time, each from the archive of the chain that holds
+// its latest version. Listings are cached in the catalog of baseDir, so only
+// the first look at an archive reads it.
+func ArchiveTree(baseDir, archivePath string, keys *encryption.Keyring) ([]ListingEntry, error) {
+    chain, err := archiveChain(archivePath)
+    if err != nil {
+        return nil, err
+    }
+    cat, err := catalog.Open(baseDir)
+    if err != nil {
+        return nil, err
+    }
+
+    latest := make(map[string]ListingEntry)
+    var tree []string
+    for _, archive := range chain {
+        listing, err := cachedListing(cat, archive, keys)
+        if err != nil {
+            return nil, err
+        }
+        for _, entry := range listing.Entries {
+            latest[entry.Path] = entry
+        }
+        tree = listing.Tree
+    }
+
+    var entries []ListingEntry
+    if len(chain) > 1 && tree != nil {
+        // Files deleted since the full archive are not in the manifest
+        for _, p := range tree {
+            if entry, ok := latest[p]; ok {
+                entries = append(entries, entry)
+            }
+        }
+    } else {
+        for _, entry := range latest {
+            entries = append(entries, entry)
+        }
+    }
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].Path < entries[j].Path
+    })
+    return entries, nil
+}
+
+// cachedListing returns the listing of an archive from the catalog, reading
+// the archive and caching its listing if there is none
+func cachedListing(cat *catalog.Catalog, archivePath string, keys *encryption.Keyring) (*archiveListing, error) {
+    if data, err := cat.Listing(archivePath); err != nil {
+        slog.Warn("Unable to read cached listing", "archive", filepath.Base(archivePath), "error", err)
+    } else if data != nil {
+        listing, err := decodeListing(data, keys)
+        if err == nil && listing.Version == listingVersion {
+            return listing, nil
+        }
+        slog.Warn("Reading archive again for a broken cached listing", "archive", filepath.Base(archivePath), "error", err)
+    }
+
+    slog.Info("Reading file listing of archive", "archive", filepath.Base(archivePath))
+    listing, err := readListing(archivePath, keys)
+    if err != nil {
+        return nil, err
+    }
+    data, err := encodeListing(listing, archivePath, keys)
+    if err == nil {
+        err = cat.SetListing(archivePath, data)
+    }
+    if err != nil {
+        slog.Warn("Unable to cache file listing", "archive", filepath.Base(archivePath), "error", err)
+    }
+    return listing, nil
+}
+
+// readListing lists the entries of an archive without extracting them
+func readListing(archivePath string, keys *encryption.Keyring) (*archiveListing, error) {
+    ar, err := openArchive(archivePath, keys)
+    if err != nil {
+        return nil, err
+    }
+    defer ar.Close()
+
+    listing := &archiveListing{Version: listingVersion, Entries: []ListingEntry{}}
+    name := filepath.Base(archivePath)
+    tr := tar.NewReader(ar)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read tar header: %v", err)
+        }
+        if header.Name == ManifestEntryName {
+            var m Manifest
+            if err := json.NewDecoder(tr).Decode(&m); err != nil {
+                return nil, fmt.Errorf("failed to parse manifest: %v", err)
+            }
+            listing.Tree = make([]string, 0, len(m.Files))
+            for p := range m.Files {
+                listing.Tree = append(listing.Tree, p)
+            }
+            sort.Strings(listing.Tree)
+            continue
+        }
+
+        entry := ListingEntry{
+            Path:    entryPath(header.Name),
+            Size:    header.Size,
+            Mode:    header.FileInfo().Mode(),
+            ModTime: header.ModTime,
+            Archive: name,
+        }
+        switch header.Typeflag {
+        case tar.TypeDir:
+            entry.Type, entry.Size = EntryDir, 0
+        case tar.TypeReg:
+            entry.Type = EntryFile
+        case tar.TypeSymlink:
+            entry.Type, entry.Link = EntrySymlink, header.Linkname
+        default:
+            continue
+        }
+        if entry.Path != "" {
+            listing.Entries = append(listing.Entries, entry)
+        }
+    }
+    return listing, nil
+}
+
+// encodeListing compresses a listing, and encrypts it like the archive, as
+// the names of files can be as confidential as their content
+func encodeListing(listing *archiveListing, archivePath string, keys *encryption.Keyring) ([]byte, error) {
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    if err := json.NewEncoder(zw).Encode(listing); err != nil {
+        return nil, fmt.Errorf("failed to encode listing: %v", err)
+    }
+    if err := zw.Close(); err != nil {
+        return nil, fmt.Errorf("failed to compress listing: %v", err)
+    }
+    if !archiveEncrypted(archivePath) {
+        return buf.Bytes(), nil
+    }
+    return encryption.Seal(buf.Bytes(), keys)
+}
+
+// decodeListing reads a listing written by encodeListing
+func decodeListing(data []byte, keys *encryption.Keyring) (*archiveListing, error) {
+    plain, err := encryption.Open(data, keys)
+    if err != nil {
+        return nil, err
+    }
+    zr, err := gzip.NewReader(bytes.NewReader(plain))
+    if err != nil {
+        return nil, err
+    }
+    var listing archiveListing
+    if err := json.NewDecoder(zr).Decode(&listing); err != nil {
+        return nil, err
+    }
+    return &listing, nil
+}
+
+// archiveEncrypted reports whether the content of an archive is encrypted
+func archiveEncrypted(archivePath string) bool {
+    switch {
+    case IsSnapshot(archivePath):
+        return false
+    case dedup.IsIndex(archivePath):
+        index, err := dedup.ReadIndex(archivePath)
+        return err == nil && index.KeyID != ""
+    }
+    encrypted, _ := archiveEncryptedFile(archivePath)
+    return encrypted
+}
+
+// RestorePath extracts a single file, symlink or directory with everything
+// below it from a file archive to the same path below target, e.g. the
+// site's document root. Every archive of the chain is verified first, like
+// by RestoreFiles, but only those holding the entries are extracted from,
+// each only until its last entry. An existing file or directory is only
+// replaced with force; it is then moved aside to
+// <path>.before-restore-<timestamp>.
+func RestorePath(baseDir, archivePath, rel, target string, force bool, keys *encryption.Keyring) (RestoredPath, error) {
+    result := RestoredPath{Archive: archivePath, Path: rel}
+    if rel == "" {
+        return result, fmt.Errorf("no path given, use restore for the whole site")
+    }
+    tree, err := ArchiveTree(baseDir, archivePath, keys)
+    if err != nil {
+        return result, err
+    }
+    wanted := make(map[string]map[string]bool)
+    for _, entry := range tree {
+        if entry.Path == rel || strings.HasPrefix(entry.Path, rel+"/") {
+            if wanted[entry.Archive] == nil {
+                wanted[entry.Archive] = make(map[string]bool)
+            }
+            wanted[entry.Archive][entry.Path] = true
+        }
+    }
+    if len(wanted) == 0 {
+        return result, fmt.Errorf("%s is not in %s", rel, filepath.Base(archivePath))
+    }
+
+    dest := filepath.Join(target, filepath.FromSlash(rel))
+    result.Target = dest
+    _, err = os.Lstat(dest)
+    exists := err == nil
+    if exists && !force {
+        return result, fmt.Errorf("%s exists, use --force to replace it", dest)
+    }
+
+    // Extract next to the destination first so a broken archive leaves it untouched
+    staging := dest + ".restore-new"
+    if err := os.RemoveAll(staging); err != nil {
+        return result, fmt.Errorf("failed to clean staging path: %v", err)
+    }
+    if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+        return result, fmt.Errorf("failed to create directory: %v", err)
+    }
+    chain, err := archiveChain(archivePath)
+    if err != nil {
+        return result, err
+    }
+    if err := verifyChain(chain); err != nil {
+        return result, err
+    }
+    for _, archive := range chain {
+        names := wanted[filepath.Base(archive)]
+        if len(names) == 0 {
+            continue
+        }
+        n, err := extractPaths(archive, staging, rel, names, keys)
+        if err != nil {
+            os.RemoveAll(staging)
+            return result, err
+        }
+        result.Entries += n
+    }
+
+    if exists {
+        result.Previous = fmt.Sprintf("%s.before-restore-%s", dest, time.Now().Format(TimestampFormat))
+        if err := os.Rename(dest, result.Previous); err != nil {
+            os.RemoveAll(staging)
+            return result, fmt.Errorf("failed to move %s aside: %v", dest, err)
+        }
+    }
+    if err := os.Rename(staging, dest); err != nil {
+        return result, fmt.Errorf("failed to move restored path into place: %v", err)
+    }
+    return result, nil
+}
+
+// extractPaths extracts the entries of an archive named in names, which
+// are rel or below it, to the same place below staging, which stands in for
+// rel. Reading stops once all of them are extracted.
+func extractPaths(archivePath, staging, rel string, names map[string]bool, keys *encryption.Keyring) (int, error) {
+    ar, err := openArchive(archivePath, keys)
+    if err != nil {
+        return 0, err
+    }
+    defer ar.Close()
+
+    extracted := 0
+    tr := tar.NewReader(ar)
+    for extracted < len(names) {
+        header, err := tr.Next()
+        if err == io.EOF {
+            return extracted, fmt.Errorf("%s ended before all of %s was extracted", filepath.Base(archivePath), rel)
+        }
+        if err != nil {
+            return extracted, fmt.Errorf("failed to read tar header: %v", err)
+        }
+        name := entryPath(header.Name)
+        if !names[name] {
+            continue
+        }
+        target := staging + filepath.FromSlash(strings.TrimPrefix(name, rel))
+        if target != staging {
+            if err := clearTarget(staging, target, header.Typeflag); err != nil {
+                return extracted, fmt.Errorf("archive entry %q: %v", header.Name, err)
+            }
+        }
+        if err := writeEntry(header, tr, target); err != nil {
+            return extracted, err
+        }
+        extracted++
+    }
+    return extracted, nil
+}
@@ -0,0 +1,359 @@
+package backup
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/filelock"
+)
+
+// UsageFileName is the name of the usage ledger inside a backup base directory
+const UsageFileName = "usage.json"
+
+// usageRetentionDays is how many days of usage are kept in the ledger
+const usageRetentionDays = 31
+
+// ByteSize is a number of bytes that is read from JSON and the environment
+// either as a plain number or as a string like "500M" or "20G"
+type ByteSize int64
+
+// ParseByteSize parses sizes with an optional K, M, G or T suffix (powers of 1024)
+func ParseByteSize(value string) (ByteSize, error) {
+    s := strings.ToUpper(strings.TrimSpace(value))
+    s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+    multiplier := int64(1)
+    if s != "" {
+        switch s[len(s)-1] {
+        case 'K':
+            multiplier = 1 << 10
+        case 'M':
+            multiplier = 1 << 20
+        case 'G':
+            multiplier = 1 << 30
+        case 'T':
+            multiplier = 1 << 40
+        }
+        if multiplier != 1 {
+            s = s[:len(s)-1]
+        }
+    }
+    n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("invalid size %q", value)
+    }
+    return ByteSize(n * float64(multiplier)), nil
+}
+
+// UnmarshalJSON accepts both numbers and size strings
+func (b *ByteSize) UnmarshalJSON(data []byte) error {
+    var n int64
+    if err := json.Unmarshal(data, &n); err == nil {
+        *b = ByteSize(n)
+        return nil
+    }
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("size must be a number of bytes or a string like \"20G\"")
+    }
+    parsed, err := ParseByteSize(s)
+    if err != nil {
+        return err
+    }
+    *b = parsed
+    return nil
+}
+
+// String formats the size for humans
+func (b ByteSize) String() string {
+    const unit = 1024
+    if b < unit {
+        return fmt.Sprintf("%dB", int64(b))
+    }
+    div, exp := int64(unit), 0
+    for n := int64(b) / unit; n >= unit; n /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "KMGT"[exp])
+}
+
+// Budget limits how much a single site may consume per day and how much
+// space its archives may take; zero means unlimited
+type Budget struct {
+    // Bytes pulled from a remote server
+    DailyTransfer ByteSize `json:"daily_transfer,omitempty"`
+    // Bytes read from the site's document root to build archives
+    DailyIO ByteSize `json:"daily_io,omitempty"`
+    // Total size of the site's archives in a backup directory
+    Quota ByteSize `json:"quota,omitempty"`
+    // Size of the files selected for a file archive above which the site's
+    // files are not backed up, unless allowed, or are backed up with a warning
+    MaxSize  ByteSize `json:"max_size,omitempty"`
+    WarnSize ByteSize `json:"warn_size,omitempty"`
+}
+
+// Budgets holds the default budget and per-site overrides
+type Budgets struct {
+    Default Budget            `json:"default"`
+    Sites   map[string]Budget `json:"sites"`
+}
+
+// LoadBudgets reads the budget file named by BUDGET_FILE. Defaults come from
+// SITE_DAILY_TRANSFER_LIMIT and SITE_DAILY_IO_LIMIT unless the file sets
+// them. The default quota and size limits are configured in backup.yaml.
+func LoadBudgets() (*Budgets, error) {
+    budgets := &Budgets{}
+    if path := os.Getenv("BUDGET_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read budget file: %v", err)
+        }
+        if err := json.Unmarshal(data, budgets); err != nil {
+            return nil, fmt.Errorf("unable to parse budget file %s: %v", path, err)
+        }
+    }
+
+    for key, field := range map[string]*ByteSize{
+        "SITE_DAILY_TRANSFER_LIMIT": &budgets.Default.DailyTransfer,
+        "SITE_DAILY_IO_LIMIT":       &budgets.Default.DailyIO,
+    } {
+        value := os.Getenv(key)
+        if value == "" || *field != 0 {
+            continue
+        }
+        size, err := ParseByteSize(value)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", key, err)
+        }
+        *field = size
+    }
+    return budgets, nil
+}
+
+// For returns the budget of a site, with per-site values overriding the default
+func (b *Budgets) For(site string) Budget {
+    budget := b.Default
+    if override, ok := b.Sites[site]; ok {
+        if override.DailyTransfer != 0 {
+            budget.DailyTransfer = override.DailyTransfer
+        }
+        if override.DailyIO != 0 {
+            budget.DailyIO = override.DailyIO
+        }
+        if override.Quota != 0 {
+            budget.Quota = override.Quota
+        }
+        if override.MaxSize != 0 {
+            budget.MaxSize = override.MaxSize
+        }
+        if override.WarnSize != 0 {
+            budget.WarnSize = override.WarnSize
+        }
+    }
+    return budget
+}
+
+// SiteUsage is what a site consumed on one day
+type SiteUsage struct {
+    Transferred ByteSize `json:"transferred"`
+    IO          ByteSize `json:"io"`
+    // Components that were skipped because a budget was exhausted
+    Partial []string `json:"partial,omitempty"`
+}
+
+// UsageLedger tracks daily per-site usage of a backup base directory. It is
+// safe for concurrent use; usage charged by other processes is read before
+// a change is written.
+type UsageLedger struct {
+    mu   sync.Mutex
+    path string
+    // Usage per day (YYYY-MM-DD) and site
+    Days map[string]map[string]*SiteUsage `json:"days"`
+}
+
+// OpenUsage loads the usage ledger of a backup base directory
+func OpenUsage(baseDir string) (*UsageLedger, error) {
+    ledger := &UsageLedger{
+        path: filepath.Join(baseDir, UsageFileName),
+        Days: make(map[string]map[string]*SiteUsage),
+    }
+    if err := ledger.loadLocked(); err != nil {
+        return nil, err
+    }
+    return ledger, nil
+}
+
+// loadLocked reads the ledger file; the caller must hold l.mu
+func (l *UsageLedger) loadLocked() error {
+    data, err := os.ReadFile(l.path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return fmt.Errorf("failed to read usage ledger: %v", err)
+    }
+    var file struct {
+        Days map[string]map[string]*SiteUsage `json:"days"`
+    }
+    if err := json.Unmarshal(data, &file); err != nil {
+        return fmt.Errorf("failed to parse usage ledger %s: %v", l.path, err)
+    }
+    if file.Days != nil {
+        l.Days = file.Days
+    }
+    return nil
+}
+
+// beginLocked takes the lock of the ledger file for a change and reloads the
+// ledger, so the usage charged by other processes is kept. The caller must
+// hold l.mu and call the returned function once the change is saved.
+func (l *UsageLedger) beginLocked() (func(), error) {
+    lock, err := filelock.Acquire(context.Background(), l.path+".lock", true, filelock.Forever)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock usage ledger: %v", err)
+    }
+    if err := l.loadLocked(); err != nil {
+        lock.Unlock()
+        return nil, err
+    }
+    return func() { lock.Unlock() }, nil
+}
+
+// Day returns the usage of all sites on a day
+func (l *UsageLedger) Day(day time.Time) map[string]SiteUsage {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    usage := make(map[string]SiteUsage)
+    for site, u := range l.Days[day.Format("2006-01-02")] {
+        usage[site] = *u
+    }
+    return usage
+}
+
+// Check returns an error if consuming the given amounts today would exceed
+// the site's budget
+func (l *UsageLedger) Check(site string, budget Budget, transfer, io ByteSize) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    used := l.todayLocked(site)
+    if budget.DailyTransfer != 0 && used.Transferred+transfer > budget.DailyTransfer {
+        return fmt.Errorf("daily transfer budget of %s exceeded (%s used, %s needed)",
+            budget.DailyTransfer, used.Transferred, transfer)
+    }
+    if budget.DailyIO != 0 && used.IO+io > budget.DailyIO {
+        return fmt.Errorf("daily IO budget of %s exceeded (%s used, %s needed)",
+            budget.DailyIO, used.IO, io)
+    }
+    return nil
+}
+
+// Charge adds consumed bytes to today's usage of a site
+func (l *UsageLedger) Charge(site string, transfer, io ByteSize) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    end, err := l.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    used := l.todayLocked(site)
+    used.Transferred += transfer
+    used.IO += io
+    return l.saveLocked()
+}
+
+// MarkPartial records that a component of a site was skipped today
+func (l *UsageLedger) MarkPartial(site, component string, reason error) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    end, err := l.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    used := l.todayLocked(site)
+    used.Partial = append(used.Partial, fmt.Sprintf("%s: %v", component, reason))
+    return l.saveLocked()
+}
+
+// todayLocked returns today's usage record of a site; the caller must hold l.mu
+func (l *UsageLedger) todayLocked(site string) *SiteUsage {
+    today := time.Now().Format("2006-01-02")
+    if l.Days[today] == nil {
+        l.Days[today] = make(map[string]*SiteUsage)
+    }
+    if l.Days[today][site] == nil {
+        l.Days[today][site] = &SiteUsage{}
+    }
+    return l.Days[today][site]
+}
+
+// saveLocked prunes old days and writes the ledger atomically; the caller must hold l.mu
+func (l *UsageLedger) saveLocked() error {
+    var days []string
+    for day := range l.Days {
+        days = append(days, day)
+    }
+    sort.Strings(days)
+    for len(days) > usageRetentionDays {
+        delete(l.Days, days[0])
+        days = days[1:]
+    }
+
+    data, err := json.MarshalIndent(l, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode usage ledger: %v", err)
+    }
+    tmp := l.path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fmt.Errorf("failed to write usage ledger: %v", err)
+    }
+    return os.Rename(tmp, l.path)
+}
+
+// DirSize returns the total size of regular files below dir, skipping
+// the excluded paths like the file archives do
+func DirSize(dir string, filter *config.FileFilter) (ByteSize, error) {
+    var total ByteSize
+    err := walkSelected(context.Background(), LocalTransport{}, dir, filter, func(rel string, info os.FileInfo) error {
+        if info.Mode().IsRegular() {
+            total += ByteSize(info.Size())
+        }
+        return nil
+    })
+    return total, err
+}
+
+// CheckBudget returns an error if a site may not consume the given amounts today
+func (bm *BackupManager) CheckBudget(site string, transfer, io ByteSize) error {
+    return bm.Usage.Check(site, bm.Budgets.For(site), transfer, io)
+}
+
+// SkipOverBudget reports and records a component skipped because of its budget,
+// so the site shows up as partially backed up
+func (bm *BackupManager) SkipOverBudget(site, component string, reason error) {
+    slog.Warn("Skipping backup over budget", "site", site, "component", component, "reason", reason)
+    if err := bm.Usage.MarkPartial(site, component, reason); err != nil {
+        slog.Warn("Failed to record partial backup", "site", site, "error", err)
+    }
+}
+
+// ChargeUsage adds consumed bytes to a site's usage of today
+func (bm *BackupManager) ChargeUsage(site string, transfer, io ByteSize) {
+    if err := bm.Usage.Charge(site, transfer, io); err != nil {
+        slog.Warn("Failed to record usage", "site", site, "error", err)
+    }
+}
@@ -0,0 +1,229 @@
+package backup
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// ChecksumSuffix is appended to an archive path to get its checksum file
+const ChecksumSuffix = ".sha256"
+
+// ChecksumManifestName is the file in every archive directory listing the
+// checksums of all archives in it, in the format understood by `sha256sum -c`
+const ChecksumManifestName = "SHA256SUMS"
+
+// manifestMu serializes manifest rewrites of concurrent backups
+var manifestMu sync.Mutex
+
+// FileChecksum computes the hex encoded SHA-256 of a file, or of the tar
+// stream of a snapshot
+func FileChecksum(path string) (string, error) {
+    if IsSnapshot(path) {
+        r, err := openSnapshot(path)
+        if err != nil {
+            return "", err
+        }
+        defer r.Close()
+        hash := sha256.New()
+        if _, err := io.Copy(hash, r); err != nil {
+            return "", err
+        }
+        return hex.EncodeToString(hash.Sum(nil)), nil
+    }
+    file, err := openArchiveFile(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, file); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// WriteChecksum records the SHA-256 of an archive next to it,
+// in the format understood by `sha256sum -c`, and signs it if a signing
+// key is configured
+func WriteChecksum(path string) (string, error) {
+    sum, err := FileChecksum(path)
+    if err != nil {
+        return "", fmt.Errorf("failed to compute checksum: %v", err)
+    }
+    if err := recordChecksum(path, sum); err != nil {
+        return "", err
+    }
+    return sum, nil
+}
+
+// recordChecksum records a known SHA-256 of an archive next to it like
+// WriteChecksum, without reading the archive again
+func recordChecksum(path, sum string) error {
+    line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+    if err := os.WriteFile(path+ChecksumSuffix, []byte(line), 0644); err != nil {
+        return fmt.Errorf("failed to write checksum file: %v", err)
+    }
+    if err := signFile(path + ChecksumSuffix); err != nil {
+        return err
+    }
+    return UpdateChecksumManifest(filepath.Dir(path))
+}
+
+// UpdateChecksumManifest rewrites the checksum manifest of an archive directory from
+// the checksum files in it, so removed archives drop out of it, and signs it
+func UpdateChecksumManifest(dir string) error {
+    manifestMu.Lock()
+    defer manifestMu.Unlock()
+
+    sumFiles, err := filepath.Glob(filepath.Join(dir, "*"+ChecksumSuffix))
+    if err != nil {
+        return err
+    }
+    sort.Strings(sumFiles)
+
+    var manifest strings.Builder
+    for _, sumFile := range sumFiles {
+        archive := strings.TrimSuffix(sumFile, ChecksumSuffix)
+        if !archiveExists(archive) {
+            continue
+        }
+        sum, err := ReadChecksum(archive)
+        if err != nil {
+            return fmt.Errorf("failed to read checksum of %s: %v", archive, err)
+        }
+        fmt.Fprintf(&manifest, "%s  %s\n", sum, filepath.Base(archive))
+    }
+
+    path := filepath.Join(dir, ChecksumManifestName)
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, []byte(manifest.String()), 0644); err != nil {
+        return fmt.Errorf("failed to write checksum manifest: %v", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return err
+    }
+    return signFile(path)
+}
+
+// VerifyChecksumManifest checks the signature of the checksum manifest of an
+// archive directory and, if it is signed, that every archive it lists still
+// exists with the same checksum, so archives deleted or replaced together
+// with their checksum files are detected. It returns whether the manifest
+// is signed.
+func VerifyChecksumManifest(dir string) (bool, error) {
+    path := filepath.Join(dir, ChecksumManifestName)
+    signed, err := VerifySignature(path)
+    if err != nil || !signed {
+        return signed, err
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return signed, err
+    }
+    for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) != 2 {
+            continue
+        }
+        archive := filepath.Join(dir, fields[1])
+        if !archiveExists(archive) {
+            return signed, fmt.Errorf("%s lists %s, which is missing", ChecksumManifestName, fields[1])
+        }
+        recorded, err := ReadChecksum(archive)
+        if err != nil {
+            return signed, err
+        }
+        if recorded != fields[0] {
+            return signed, fmt.Errorf("checksum of %s differs from %s", fields[1], ChecksumManifestName)
+        }
+    }
+    return signed, nil
+}
+
+// ReadChecksum returns the recorded checksum of an archive,
+// or an empty string if none has been recorded
+func ReadChecksum(path string) (string, error) {
+    data, err := os.ReadFile(path + ChecksumSuffix)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return "", nil
+        }
+        return "", err
+    }
+    fields := strings.Fields(string(data))
+    if len(fields) == 0 {
+        return "", fmt.Errorf("checksum file %s is empty", path+ChecksumSuffix)
+    }
+    return fields[0], nil
+}
+
+// VerifyChecksum checks the signature of the recorded checksum of an
+// archive, recomputes the checksum and compares it with the recorded one.
+// It returns false without error if nothing was recorded.
+func VerifyChecksum(path string) (bool, error) {
+    recorded, err := ReadChecksum(path)
+    if err != nil {
+        return false, err
+    }
+    if _, err := VerifySignature(path + ChecksumSuffix); err != nil {
+        return recorded != "", err
+    }
+    if recorded == "" {
+        return false, nil
+    }
+    actual, err := FileChecksum(path)
+    if err != nil {
+        return true, fmt.Errorf("failed to compute checksum: %v", err)
+    }
+    if actual != recorded {
+        return true, fmt.Errorf("checksum mismatch: recorded %s, actual %s", recorded, actual)
+    }
+    return true, nil
+}
+
+// FindMissingArchives returns archives that have a checksum file but no longer
+// exist, which means they were deleted outside of backup rotation
+func FindMissingArchives(baseDir string) ([]string, error) {
+    var missing []string
+    err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) && path == baseDir {
+                return filepath.SkipDir
+            }
+            return err
+        }
+        if path == baseDir {
+            return nil
+        }
+        name := d.Name()
+        if d.IsDir() {
+            topLevel := filepath.Dir(path) == baseDir
+            if strings.HasPrefix(name, ".") || IsSnapshot(path) ||
+                (topLevel && (strings.HasPrefix(name, "_") || name == ReportsDirName)) {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if !strings.HasSuffix(name, ChecksumSuffix) || strings.HasPrefix(name, ".") {
+            return nil
+        }
+        archive := strings.TrimSuffix(path, ChecksumSuffix)
+        if !archiveExists(archive) {
+            missing = append(missing, archive)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return missing, nil
+}
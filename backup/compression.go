@@ -0,0 +1,200 @@
+package backup
+
+import (
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "fmt"
+    "io"
+    "path/filepath"
+    "strings"
+    "github.com/klauspost/compress/zstd"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
+)
+
+// Magic numbers at the start of compressed streams
+var (
+    gzipMagic = []byte{0x1f, 0x8b}
+    zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionExt returns the file name extension of a compression format
+func compressionExt(format string) string {
+    switch format {
+    case config.CompressionZstd:
+        return ".zst"
+    case config.CompressionNone:
+        return ""
+    default:
+        return ".gz"
+    }
+}
+
+// fileArchiveExts and dumpExts are the extensions of file archives and
+// database dumps in every compression format, and of deduplicated archives
+// and snapshots. archiveExts holds them and those of the dumps of data
+// stores by archive type.
+var (
+    fileArchiveExts = []string{".tar.gz", ".tar.zst", ".tar", ".tar" + dedup.IndexExt, SnapshotExt}
+    dumpExts        = []string{".sql.gz", ".sql.zst", ".sql", ".sqlite.gz", ".sqlite.zst", ".sqlite"}
+    archiveExts     = map[string][]string{
+        "file":                fileArchiveExts,
+        "database":            dumpExts,
+        BinlogArchiveType:     {binlogExt + ".gz", binlogExt + ".zst", binlogExt},
+        PhysicalArchiveType:   {physicalExt + ".gz", physicalExt + ".zst", physicalExt},
+        config.DatastoreRedis: {redisDumpExt + ".gz", redisDumpExt + ".zst", redisDumpExt},
+        config.DatastoreMongo: {mongoDumpExt},
+    }
+)
+
+// Extensions of SQL dumps and SQLite database copies before compression
+const (
+    sqlDumpExt    = ".sql"
+    sqliteDumpExt = ".sqlite"
+)
+
+// dumpExt returns the extension of dumps of a database driver before
+// compression
+func dumpExt(driver string) string {
+    if driver == DriverSQLite {
+        return sqliteDumpExt
+    }
+    return sqlDumpExt
+}
+
+// isSQLiteDump reports whether an archive is a copy of an SQLite database
+func isSQLiteDump(path string) bool {
+    _, ok := trimArchiveExt(filepath.Base(path), []string{".sqlite.gz", ".sqlite.zst", ".sqlite"})
+    return ok
+}
+
+// trimArchiveExt removes the first of exts that name ends with
+func trimArchiveExt(name string, exts []string) (string, bool) {
+    for _, ext := range exts {
+        if strings.HasSuffix(name, ext) {
+            return strings.TrimSuffix(name, ext), true
+        }
+    }
+    return name, false
+}
+
+// newCompressor returns a writer compressing into w. Closing it flushes the
+// compressed stream but doesn't close w.
+func newCompressor(w io.Writer, c config.Compression) (io.WriteCloser, error) {
+    switch c.Format {
+    case config.CompressionZstd:
+        level := zstd.SpeedDefault
+        if c.Level > 0 {
+            level = zstd.EncoderLevelFromZstd(c.Level)
+        }
+        return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+    case config.CompressionNone:
+        return nopWriteCloser{w}, nil
+    default:
+        level := gzip.DefaultCompression
+        if c.Level > 0 {
+            level = c.Level
+        }
+        return gzip.NewWriterLevel(w, level)
+    }
+}
+
+// zstdReader makes a zstd decoder an io.ReadCloser
+type zstdReader struct {
+    *zstd.Decoder
+}
+
+// Close releases the decoder
+func (r zstdReader) Close() error {
+    r.Decoder.Close()
+    return nil
+}
+
+// newDecompressor returns a reader decompressing r. The format is detected
+// from the first bytes of the stream; anything that is neither gzip nor zstd
+// is read as it is.
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+    br := bufio.NewReader(r)
+    switch format, _ := detectCompression(br); format {
+    case config.CompressionGzip:
+        return gzip.NewReader(br)
+    case config.CompressionZstd:
+        d, err := zstd.NewReader(br)
+        if err != nil {
+            return nil, err
+        }
+        return zstdReader{d}, nil
+    default:
+        return io.NopCloser(br), nil
+    }
+}
+
+// detectCompression returns the compression format of the stream r is
+// positioned at, without consuming it
+func detectCompression(r *bufio.Reader) (string, error) {
+    header, err := r.Peek(len(zstdMagic))
+    if err != nil && err != io.EOF {
+        return "", err
+    }
+    switch {
+    case bytes.HasPrefix(header, gzipMagic):
+        return config.CompressionGzip, nil
+    case bytes.HasPrefix(header, zstdMagic):
+        return config.CompressionZstd, nil
+    default:
+        return config.CompressionNone, nil
+    }
+}
+
+// DetectCompression returns the compression format of an unencrypted file
+func DetectCompression(path string) (string, error) {
+    file, err := openArchiveFile(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    format, err := detectCompression(bufio.NewReader(file))
+    if err != nil {
+        return "", fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    return format, nil
+}
+
+// compressCommand returns the shell command compressing its standard input
+// to standard output on a remote server. gzip uses pigz where installed and
+// zstd all cores.
+func compressCommand(c config.Compression) string {
+    switch c.Format {
+    case config.CompressionZstd:
+        cmd := "zstd -q -T0"
+        if c.Level > 19 {
+            cmd += " --ultra"
+        }
+        if c.Level > 0 {
+            cmd += fmt.Sprintf(" -%d", c.Level)
+        }
+        return cmd
+    case config.CompressionNone:
+        return "cat"
+    default:
+        level := ""
+        if c.Level > 0 {
+            level = fmt.Sprintf(" -%d", c.Level)
+        }
+        return fmt.Sprintf("if command -v pigz >/dev/null 2>&1; then pigz%[1]s; else gzip%[1]s; fi", level)
+    }
+}
+
+// decompressCommand returns the shell command decompressing its standard
+// input to standard output on a remote server
+func decompressCommand(format string) string {
+    switch format {
+    case config.CompressionZstd:
+        return "zstd -dcq"
+    case config.CompressionNone:
+        return "cat"
+    default:
+        return "gzip -dc"
+    }
+}
@@ -0,0 +1,39 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "io"
+)
+
+// SiteContext limits ctx to the configured timeout of a site's files or
+// database backup. The cause of the cancellation names the exceeded timeout.
+func (bm *BackupManager) SiteContext(ctx context.Context, site string) (context.Context, context.CancelFunc) {
+    timeout := bm.Timeouts.SiteTimeout(site)
+    if timeout <= 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("site timeout of %s exceeded", timeout))
+}
+
+// contextError replaces an error caused by the cancellation of ctx, such as
+// a killed command, by the cause of the cancellation
+func contextError(ctx context.Context, err error) error {
+    if ctx.Err() == nil {
+        return err
+    }
+    return fmt.Errorf("cancelled: %v", context.Cause(ctx))
+}
+
+// contextReader stops reading once its context is cancelled
+type contextReader struct {
+    ctx context.Context
+    r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+    if err := cr.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return cr.r.Read(p)
+}
@@ -1,85 +1,394 @@
 package backup
 
 import (
+    "context"
     "fmt"
+    "log/slog"
     "os"
     "os/exec"
     "path/filepath"
+    "strings"
     "time"
     "bytes"
+    "io"
+    "laravel-backup-tool/config"
+)
+
+// Database drivers as named by DB_CONNECTION in a Laravel .env
+const (
+    DriverMySQL    = "mysql"
+    DriverMariaDB  = "mariadb"
+    DriverPostgres = "pgsql"
+    DriverSQLite   = "sqlite"
 )
 
 // DBBackup handles database backup operations
 type DBBackup struct {
-    manager *BackupManager
+    manager  *BackupManager
+    postgres *PostgresBackup
+    sqlite   *SQLiteBackup
 }
 
 // NewDBBackup creates a new database backup handler
 func NewDBBackup(manager *BackupManager) *DBBackup {
-    return &DBBackup{manager: manager}
+    return &DBBackup{manager: manager, postgres: NewPostgresBackup(manager), sqlite: NewSQLiteBackup(manager)}
 }
 
-// BackupDatabase performs a backup of the site's database
-func (db *DBBackup) BackupDatabase(siteName, dbHost, dbName, dbUser, dbPass string) error {
-    // Create database backup directory
-    dbBackupDir := db.manager.getDBBackupDir(siteName)
-    if err := os.MkdirAll(dbBackupDir, 0755); err != nil {
-        return fmt.Errorf("failed to create database backup directory: %v", err)
+// BackupDatabase performs a backup of the site's database with the dump tool
+// of its driver and returns the path of the dump. An empty driver means MySQL;
+// for SQLite dbName is the database file. Dumps failing with transient errors,
+// such as a server out of connections, are retried as the manager's retry
+// policy says. The dump tool is killed and the partial dump removed when ctx
+// is cancelled.
+func (db *DBBackup) BackupDatabase(ctx context.Context, siteName, dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    var path string
+    err := db.manager.Retry.Do(ctx, slog.With("site", siteName), "database dump", func() error {
+        var err error
+        path, err = db.backupDatabase(ctx, siteName, dbDriver, dbHost, dbPort, dbName, dbUser, dbPass)
+        return err
+    })
+    return path, err
+}
+
+// backupDatabase makes one attempt of BackupDatabase
+func (db *DBBackup) backupDatabase(ctx context.Context, siteName, dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        return db.backupMySQL(ctx, siteName, dbHost, dbPort, dbName, dbUser, dbPass)
+    case DriverPostgres:
+        return db.postgres.BackupDatabase(ctx, siteName, dbHost, dbPort, dbName, dbUser, dbPass)
+    case DriverSQLite:
+        return db.sqlite.BackupDatabase(ctx, siteName, dbName)
+    default:
+        return "", fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+}
+
+// backupMySQL dumps a MySQL or MariaDB database with mysqldump
+func (db *DBBackup) backupMySQL(ctx context.Context, siteName, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    mysqldump, err := mysqlBinary("mysqldump")
+    if err != nil {
+        return "", err
     }
+    cmd, cleanup, err := mysqlCommand(ctx, mysqldump, dbHost, dbPort, dbUser, dbPass, mysqldumpArgs(db.manager.MySQLDump.For(siteName), dbName)...)
+    if err != nil {
+        return "", err
+    }
+    defer cleanup()
+    return db.manager.writeDump(ctx, siteName, cmd, "mysqldump")
+}
 
-    // Generate backup filename with timestamp
-    timestamp := time.Now().Format("2006-01-02_150405")
-    backupFile := filepath.Join(dbBackupDir, fmt.Sprintf("db_%s.sql.gz", timestamp))
+// mysqlBinary looks up a MySQL client tool such as mysqldump on PATH, which
+// finds mysqldump.exe on Windows, and then where MySQL and MariaDB install
+// it on Windows without adding it to PATH
+func mysqlBinary(name string) (string, error) {
+    if path, err := exec.LookPath(name); err == nil {
+        return path, nil
+    }
+    dirs := mysqlInstallDirs()
+    for i := len(dirs) - 1; i >= 0; i-- {
+        if path, err := exec.LookPath(filepath.Join(dirs[i], name)); err == nil {
+            return path, nil
+        }
+    }
+    return "", fmt.Errorf("%s not found on PATH", name)
+}
 
-    // Create mysqldump command with error output capture
-    cmd := exec.Command("mysqldump",
-        "-h", dbHost,
-        "-u", dbUser,
-        fmt.Sprintf("-p%s", dbPass),
-        "--quick",
-        "--lock-tables=false",
-        dbName)
+// IsSocket reports whether the host of a database is the path of its Unix
+// socket, as read from DB_SOCKET
+func IsSocket(dbHost string) bool {
+    return strings.HasPrefix(dbHost, "/")
+}
 
+// mysqlConnectionArgs returns the options of a MySQL client connecting to
+// a server, or to its socket without a port
+func mysqlConnectionArgs(dbHost, dbPort string) []string {
+    if IsSocket(dbHost) {
+        return []string{"--socket=" + dbHost}
+    }
+    args := []string{"-h", dbHost}
+    if dbPort != "" {
+        args = append(args, "-P", dbPort)
+    }
+    return args
+}
+
+// mysqlCommand returns a local MySQL client command such as mysql or
+// mysqldump connected to a server, with args after the connection options.
+// The password is passed in a temporary option file, so it appears neither
+// in the process list nor in the environment of the command; cleanup
+// removes the file once the command finished.
+func mysqlCommand(ctx context.Context, tool, dbHost, dbPort, dbUser, dbPass string, args ...string) (*exec.Cmd, func(), error) {
+    f, err := os.CreateTemp("", "laravel-backup-*.cnf")
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to create MySQL option file: %v", err)
+    }
+    cleanup := func() { os.Remove(f.Name()) }
+    _, err = f.Write(credentialsFile(DriverMySQL, dbHost, dbPort, "", dbUser, dbPass))
+    if cerr := f.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        cleanup()
+        return nil, nil, fmt.Errorf("failed to write MySQL option file: %v", err)
+    }
+
+    // The option file must be the first option
+    all := append([]string{"--defaults-extra-file=" + f.Name()}, mysqlConnectionArgs(dbHost, dbPort)...)
+    all = append(all, "-u", dbUser)
+    return exec.CommandContext(ctx, tool, append(all, args...)...), cleanup, nil
+}
+
+// mysqldumpArgs returns the arguments of mysqldump following the connection
+// options: the dump options, the database and the tables to dump. Excluded
+// tables without a database are tables of the dumped database.
+func mysqldumpArgs(options config.MySQLDumpOptions, dbName string) []string {
+    args := []string{"--quick", "--lock-tables=false"}
+    if options.SingleTransaction != nil && *options.SingleTransaction {
+        args = append(args, "--single-transaction")
+    }
+    for _, flag := range []struct {
+        name    string
+        enabled *bool
+    }{
+        {"routines", options.Routines},
+        {"triggers", options.Triggers},
+        {"events", options.Events},
+    } {
+        if flag.enabled == nil {
+            continue
+        }
+        if *flag.enabled {
+            args = append(args, "--"+flag.name)
+        } else {
+            args = append(args, "--skip-"+flag.name)
+        }
+    }
+    if options.MaxAllowedPacket != "" {
+        args = append(args, "--max-allowed-packet="+options.MaxAllowedPacket)
+    }
+    for _, table := range options.ExcludeTables {
+        if !strings.Contains(table, ".") {
+            table = dbName + "." + table
+        }
+        args = append(args, "--ignore-table="+table)
+    }
+    args = append(args, dbName)
+    return append(args, options.Tables...)
+}
+
+// writeDump runs a dump command and stores its output as a new dump of the
+// site, see storeDump. tool names the command in error messages; cmd must be
+// bound to ctx.
+func (bm *BackupManager) writeDump(ctx context.Context, siteName string, cmd *exec.Cmd, tool string) (string, error) {
+    return bm.writeDumpOf(ctx, siteName, "database", sqlDumpExt, bm.Compression.For(siteName), cmd, tool)
+}
+
+// writeDumpOf runs a dump command and stores its output as a new dump of an
+// archive type, see storeDumpOf
+func (bm *BackupManager) writeDumpOf(ctx context.Context, siteName, archiveType, ext string, compression config.Compression, cmd *exec.Cmd, tool string) (string, error) {
+    return bm.storeDumpOf(ctx, siteName, archiveType, ext, compression, dumpWriter(ctx, cmd, tool))
+}
+
+// dumpWriter returns the function running a dump command with its output
+// going to the writer it is given, for storing the dump
+func dumpWriter(ctx context.Context, cmd *exec.Cmd, tool string) func(w io.Writer) error {
+    // Capture error output of the dump
     var stderr bytes.Buffer
     cmd.Stderr = &stderr
 
+    // On cancellation kill the dump's whole process group, so no child of
+    // a wrapper script keeps the output pipe open
+    killGroupOnCancel(cmd)
+
+    return func(w io.Writer) error {
+        cmd.Stdout = w
+        if err := cmd.Run(); err != nil {
+            // Include the tool's error output in the error message
+            return contextError(ctx, fmt.Errorf("failed to run %s: %v, error output: %s", tool, err, stderr.String()))
+        }
+        return nil
+    }
+}
+
+// storeDump compresses what write writes into a new database dump of the
+// site at the path of the layout, with ext and .gz (.zst, or none) as
+// extension, encrypted if enabled, and records the dump. ext is .sql for SQL
+// dumps.
+func (bm *BackupManager) storeDump(ctx context.Context, siteName, ext string, write func(w io.Writer) error) (string, error) {
+    return bm.storeDumpOf(ctx, siteName, "database", ext, bm.Compression.For(siteName), write)
+}
+
+// storeDumpOf stores a new dump of an archive type, "database" or a data
+// store, like storeDump, compressed as given
+func (bm *BackupManager) storeDumpOf(ctx context.Context, siteName, archiveType, ext string, compression config.Compression, write func(w io.Writer) error) (string, error) {
+    return bm.storeArchiveOf(ctx, siteName, archiveType, ext, compression, false, write)
+}
+
+// storeArchiveOf stores a new dump of an archive type like storeDumpOf,
+// at the path of an incremental archive with incremental
+func (bm *BackupManager) storeArchiveOf(ctx context.Context, siteName, archiveType, ext string, compression config.Compression, incremental bool, write func(w io.Writer) error) (string, error) {
+    if err := bm.CheckSpace(siteName, archiveType, bm.estimateDumpSize(siteName, archiveType)); err != nil {
+        return "", err
+    }
+
+    // Generate backup filename with timestamp. A dump of the same second,
+    // such as the safety dump taken before a restore, gets the next free
+    // second instead of replacing the existing dump.
+    started := time.Now()
+    var backupFile string
+    for stamp := started; ; stamp = stamp.Add(time.Second) {
+        timestamp := stamp.Format("2006-01-02_150405")
+        backupFile = archivePath(bm.BaseDir, siteName, archiveType, timestamp, incremental, ext+compressionExt(compression.Format))
+        if !dumpExists(filepath.Dir(backupFile), archiveType, stamp) {
+            break
+        }
+    }
+
+    // Create database backup directory
+    if err := os.MkdirAll(filepath.Dir(backupFile), 0755); err != nil {
+        return "", fmt.Errorf("failed to create database backup directory: %v", err)
+    }
+
     // Create the backup file
-    file, err := os.Create(backupFile)
+    file, err := os.OpenFile(backupFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
     if err != nil {
-        return fmt.Errorf("failed to create backup file: %v", err)
+        return "", fmt.Errorf("failed to create backup file: %v", err)
     }
     defer file.Close()
 
-    // Create gzip command to compress the output
-    gzip := exec.Command("gzip")
-    gzip.Stdin, err = cmd.StdoutPipe()
+    // Remove the partial dump if anything below fails
+    success := false
+    defer func() {
+        if !success {
+            os.Remove(backupFile)
+        }
+    }()
+
+    // Compress the output, encrypting the compressed stream if enabled
+    out, err := bm.encryptionWriter(file)
     if err != nil {
-        return fmt.Errorf("failed to create pipe: %v", err)
+        return "", err
+    }
+    zw, err := newCompressor(out, compression)
+    if err != nil {
+        return "", fmt.Errorf("failed to create compressor: %v", err)
     }
-    gzip.Stdout = file
 
-    // Start gzip
-    if err := gzip.Start(); err != nil {
-        return fmt.Errorf("failed to start gzip: %v", err)
+    // Run the dump
+    if err := write(zw); err != nil {
+        return "", err
     }
 
-    // Run mysqldump
-    if err := cmd.Run(); err != nil {
-        // Include MySQL error output in the error message
-        return fmt.Errorf("failed to run mysqldump: %v, MySQL error: %s", err, stderr.String())
+    if err := zw.Close(); err != nil {
+        return "", fmt.Errorf("failed to finish compression: %v", err)
+    }
+    if err := out.Close(); err != nil {
+        return "", fmt.Errorf("failed to finish encryption: %v", err)
     }
 
-    // Wait for gzip to finish
-    if err := gzip.Wait(); err != nil {
-        return fmt.Errorf("failed to finish gzip: %v", err)
+    // Record checksum and catalog entry so later checks can detect corruption
+    if err := bm.registerArchive(siteName, archiveType, backupFile, started); err != nil {
+        return "", err
     }
 
-    fmt.Printf("Created database backup for %s at %s\n", siteName, backupFile)
+    success = true
+    message := "Created database backup"
+    switch {
+    case archiveType == PhysicalArchiveType && incremental:
+        message = "Created incremental physical database backup"
+    case archiveType == PhysicalArchiveType:
+        message = "Created physical database backup"
+    case archiveType == "file":
+        message = "Created file backup"
+    case archiveType != "database":
+        message = "Created " + archiveType + " dump"
+    }
+    slog.Info(message, "site", siteName, "type", archiveType, "path", backupFile)
+    return backupFile, nil
+}
 
-    // Clean old backups
-    if err := db.manager.cleanOldBackups(siteName, true); err != nil {
-        return fmt.Errorf("failed to clean old backups: %v", err)
+// dumpCommand returns the shell command dumping a database to standard
+// output with the given mysqldump options, for running on a remote server
+// dumpExists reports whether a directory holds a dump of an archive type
+// taken in the same second as t
+func dumpExists(dir, archiveType string, t time.Time) bool {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return false
+    }
+    for _, entry := range entries {
+        a, ok := parseArchive(filepath.Join(dir, entry.Name()))
+        if ok && a.Type == archiveType && a.Time.Format(TimestampFormat) == t.Format(TimestampFormat) {
+            return true
+        }
     }
+    return false
+}
+
+// dumpCommand returns the shell command writing a dump of a database to
+// standard output, for running on a remote server. The password is read
+// from passFile, written by credentialsFile, so it appears neither in the
+// command line of the dump tool nor in that of the shell running it.
+func dumpCommand(dbDriver, dbHost, dbPort, dbName, dbUser, passFile string, options config.MySQLDumpOptions) (string, error) {
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        // The option file must be the first option
+        cmd := "mysqldump --defaults-extra-file=" + shellQuote(passFile)
+        for _, arg := range mysqlConnectionArgs(dbHost, dbPort) {
+            cmd += " " + shellQuote(arg)
+        }
+        cmd += " -u" + shellQuote(dbUser)
+        for _, arg := range mysqldumpArgs(options, dbName) {
+            cmd += " " + shellQuote(arg)
+        }
+        return cmd, nil
+    case DriverPostgres:
+        return fmt.Sprintf("PGPASSFILE=%s pg_dump -w -h %s -p %s -U %s %s %s",
+            shellQuote(passFile), shellQuote(dbHost), shellQuote(postgresPort(dbPort)),
+            shellQuote(dbUser), strings.Join(pgDumpOptions, " "), shellQuote(dbName)), nil
+    case DriverSQLite:
+        return sqliteRemoteCommand(dbName, `cat "$t"`, `.backup`), nil
+    default:
+        return "", fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+}
 
-    return nil
+// importCommand returns the shell command loading a dump from standard
+// input into a database, for running on a remote server. Like dumpCommand
+// it reads the password from passFile.
+func importCommand(dbDriver, dbHost, dbPort, dbName, dbUser, passFile string) (string, error) {
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        cmd := "mysql --defaults-extra-file=" + shellQuote(passFile)
+        for _, arg := range mysqlConnectionArgs(dbHost, dbPort) {
+            cmd += " " + shellQuote(arg)
+        }
+        return cmd + fmt.Sprintf(" -u%s %s", shellQuote(dbUser), shellQuote(dbName)), nil
+    case DriverPostgres:
+        return fmt.Sprintf("PGPASSFILE=%s psql -w -q -v ON_ERROR_STOP=1 -h %s -p %s -U %s -d %s",
+            shellQuote(passFile), shellQuote(dbHost), shellQuote(postgresPort(dbPort)),
+            shellQuote(dbUser), shellQuote(dbName)), nil
+    case DriverSQLite:
+        return sqliteRemoteCommand(dbName, `cat > "$t"`, `.restore`), nil
+    default:
+        return "", fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+}
+
+// credentialsFile returns the content of the file dumpCommand and
+// importCommand read a database password from: a MySQL option file or a
+// PostgreSQL password file. SQLite databases need none.
+func credentialsFile(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) []byte {
+    switch dbDriver {
+    case DriverPostgres:
+        escape := strings.NewReplacer(`\`, `\\`, ":", `\:`)
+        return []byte(fmt.Sprintf("%s:%s:%s:%s:%s\n", escape.Replace(dbHost), escape.Replace(postgresPort(dbPort)),
+            escape.Replace(dbName), escape.Replace(dbUser), escape.Replace(dbPass)))
+    case DriverSQLite:
+        return nil
+    default:
+        escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+        return []byte("[client]\npassword=\"" + escape.Replace(dbPass) + "\"\n")
+    }
 }
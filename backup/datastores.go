@@ -0,0 +1,151 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "laravel-backup-tool/config"
+    "gopkg.in/yaml.v3"
+)
+
+// Extensions of Redis dumps before compression and of MongoDB dumps, which
+// mongodump compresses itself
+const (
+    redisDumpExt = ".rdb"
+    mongoDumpExt = ".archive.gz"
+)
+
+// redisHeader starts every Redis database file
+const redisHeader = "REDIS"
+
+// redisEOF is the opcode ending a Redis database file, followed by its
+// 8-byte checksum
+const redisEOF = 0xFF
+
+// mongoArchiveMagic starts every archive written by mongodump --archive
+var mongoArchiveMagic = []byte{0x6d, 0xe2, 0x99, 0x81}
+
+// BackupRedis dumps the Redis server of a site with redis-cli --rdb, which
+// has the server write a snapshot and transfers it, and returns the path of
+// the compressed dump
+func (bm *BackupManager) BackupRedis(ctx context.Context, siteName string, s config.RedisSettings) (string, error) {
+    tempDir, err := NewTempDir(siteName)
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tempDir)
+    rdbPath := filepath.Join(tempDir, "dump.rdb")
+
+    args := []string{"-h", s.Host, "-p", s.Port}
+    if s.Username != "" {
+        args = append(args, "--user", s.Username)
+    }
+    if s.TLS {
+        args = append(args, "--tls")
+    }
+    args = append(args, "--rdb", rdbPath)
+    cmd := exec.CommandContext(ctx, "redis-cli", args...)
+    // The password is passed in the environment, so it doesn't show up in
+    // the process list
+    cmd.Env = os.Environ()
+    if s.Password != "" {
+        cmd.Env = append(cmd.Env, "REDISCLI_AUTH="+s.Password)
+    }
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return "", contextError(ctx, fmt.Errorf("failed to run redis-cli: %v, output: %s", err, bytes.TrimSpace(output)))
+    }
+
+    return bm.storeDumpOf(ctx, siteName, config.DatastoreRedis, redisDumpExt, bm.Compression.For(siteName), func(w io.Writer) error {
+        f, err := os.Open(rdbPath)
+        if err != nil {
+            return fmt.Errorf("failed to open Redis dump: %v", err)
+        }
+        defer f.Close()
+        if _, err := io.Copy(w, &contextReader{ctx: ctx, r: f}); err != nil {
+            return contextError(ctx, fmt.Errorf("failed to write Redis dump: %v", err))
+        }
+        return nil
+    })
+}
+
+// BackupMongo dumps the MongoDB database of a site, or all databases if
+// none is named, with mongodump --archive --gzip and returns the path of the
+// dump. The connection URI is passed in a configuration file, so its
+// password doesn't show up in the process list.
+func (bm *BackupManager) BackupMongo(ctx context.Context, siteName string, s config.MongoSettings) (string, error) {
+    tempDir, err := NewTempDir(siteName)
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tempDir)
+
+    options, err := yaml.Marshal(map[string]string{"uri": s.URI})
+    if err != nil {
+        return "", err
+    }
+    configPath := filepath.Join(tempDir, "mongodump.yaml")
+    if err := os.WriteFile(configPath, options, 0600); err != nil {
+        return "", fmt.Errorf("failed to write mongodump configuration: %v", err)
+    }
+
+    args := []string{"--config=" + configPath, "--archive", "--gzip", "--quiet"}
+    if s.Database != "" {
+        args = append(args, "--db="+s.Database)
+    }
+    cmd := exec.CommandContext(ctx, "mongodump", args...)
+    // mongodump compresses the archive, so it is stored as written
+    return bm.writeDumpOf(ctx, siteName, config.DatastoreMongo, mongoDumpExt, config.Compression{Format: config.CompressionNone}, cmd, "mongodump")
+}
+
+// checkRedisDump checks that a decompressed Redis dump starts with the
+// header of Redis database files and ends with their EOF opcode and checksum
+func checkRedisDump(r io.Reader) error {
+    header := make([]byte, len(redisHeader))
+    if _, err := io.ReadFull(r, header); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return errors.New("Redis dump is truncated")
+        }
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    if string(header) != redisHeader {
+        return errors.New("not a Redis database file")
+    }
+    tail := &tailBuffer{}
+    if _, err := io.Copy(tail, r); err != nil {
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    if len(tail.buf) < 9 || tail.buf[len(tail.buf)-9] != redisEOF {
+        return errors.New("Redis dump is incomplete: EOF marker not found at the end")
+    }
+    return nil
+}
+
+// checkMongoDump checks that a decompressed MongoDB dump is a mongodump
+// archive that ends with its terminator
+func checkMongoDump(r io.Reader) error {
+    header := make([]byte, len(mongoArchiveMagic))
+    if _, err := io.ReadFull(r, header); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return errors.New("MongoDB dump is truncated")
+        }
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    if !bytes.Equal(header, mongoArchiveMagic) {
+        return errors.New("not a mongodump archive")
+    }
+    tail := &tailBuffer{}
+    if _, err := io.Copy(tail, r); err != nil {
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    // The archive ends with a terminator of four 0xFF bytes
+    if len(tail.buf) < 4 || binary.LittleEndian.Uint32(tail.buf[len(tail.buf)-4:]) != 0xFFFFFFFF {
+        return errors.New("MongoDB dump is incomplete: terminator not found at the end")
+    }
+    return nil
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/encryption"
+)
+
+// dedupWriter starts a deduplicated archive with the given index in the chunk
+// store of the backup directory. Chunks are encrypted if encryption is enabled.
+func (bm *BackupManager) dedupWriter(indexPath string) (*dedup.Writer, error) {
+    if !bm.Encrypt {
+        return dedup.OpenStore(bm.BaseDir, nil).Create(indexPath), nil
+    }
+    if bm.Keyring == nil {
+        return nil, fmt.Errorf("encryption is enabled but no key is configured")
+    }
+    return dedup.OpenStore(bm.BaseDir, bm.Keyring).Create(indexPath), nil
+}
+
+// deduplicateArchive moves the content of a compressed file archive, such as
+// one copied from a remote server, into the chunk store and returns the path
+// of its index. The compressed archive is removed.
+func (bm *BackupManager) deduplicateArchive(path string) (string, error) {
+    name, ok := trimArchiveExt(filepath.Base(path), fileArchiveExts)
+    if !ok {
+        return "", fmt.Errorf("%s is not a file archive", path)
+    }
+    indexPath := filepath.Join(filepath.Dir(path), name+".tar"+dedup.IndexExt)
+
+    ar, err := openArchive(path, bm.Keyring)
+    if err != nil {
+        return "", err
+    }
+    defer ar.Close()
+    dw, err := bm.dedupWriter(indexPath)
+    if err != nil {
+        return "", err
+    }
+    if _, err := io.Copy(dw, ar); err != nil {
+        return "", fmt.Errorf("failed to deduplicate %s: %v", filepath.Base(path), err)
+    }
+    if err := dw.Close(); err != nil {
+        return "", fmt.Errorf("failed to deduplicate %s: %v", filepath.Base(path), err)
+    }
+    os.Remove(path)
+    return indexPath, nil
+}
+
+// NeedsReassembly reports whether a file archive is a deduplicated archive
+// or a snapshot, which are sent elsewhere as archives by ReassembleArchive
+func NeedsReassembly(path string) bool {
+    return dedup.IsIndex(path) || IsSnapshot(path)
+}
+
+// reassembledName returns the file name of the archive ReassembleArchive
+// writes for a deduplicated archive or a snapshot
+func reassembledName(indexPath string) string {
+    name := strings.TrimSuffix(filepath.Base(indexPath), dedup.IndexExt)
+    if IsSnapshot(indexPath) {
+        name = strings.TrimSuffix(filepath.Base(indexPath), SnapshotExt) + ".tar"
+    }
+    return name + compressionExt(config.CompressionZstd)
+}
+
+// ReassembleArchive writes the content of a deduplicated archive or a
+// snapshot to a compressed archive in dir, for places without the chunk
+// store, and returns its path. Chunks are decrypted with keys; with encrypt
+// the copy is encrypted to them.
+func ReassembleArchive(indexPath, dir string, keys *encryption.Keyring, encrypt bool) (string, error) {
+    compression := config.Compression{Format: config.CompressionZstd}
+    path := filepath.Join(dir, reassembledName(indexPath))
+
+    ar, err := openArchive(indexPath, keys)
+    if err != nil {
+        return "", err
+    }
+    defer ar.Close()
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+    if err != nil {
+        return "", fmt.Errorf("failed to create archive: %v", err)
+    }
+    defer file.Close()
+
+    var out io.WriteCloser = nopWriteCloser{file}
+    if encrypt {
+        if keys == nil {
+            return "", fmt.Errorf("encryption is enabled but no key is configured")
+        }
+        if out, err = encryption.NewWriter(file, keys); err != nil {
+            return "", err
+        }
+    }
+    zw, err := newCompressor(out, compression)
+    if err != nil {
+        return "", fmt.Errorf("failed to create compressor: %v", err)
+    }
+    if _, err := io.Copy(zw, ar); err != nil {
+        return "", fmt.Errorf("failed to reassemble %s: %v", filepath.Base(indexPath), err)
+    }
+    if err := zw.Close(); err != nil {
+        return "", fmt.Errorf("failed to finish compression: %v", err)
+    }
+    if err := out.Close(); err != nil {
+        return "", fmt.Errorf("failed to finish encryption: %v", err)
+    }
+    return path, file.Close()
+}
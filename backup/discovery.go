@@ -0,0 +1,264 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+    "laravel-backup-tool/config"
+)
+
+// listingMaxAge is how long a listing fetched ahead of a site's backup is
+// used; sites backed up later are listed again, so their manifest doesn't
+// miss changes made meanwhile
+const listingMaxAge = 10 * time.Minute
+
+// configFindCommand lists the Apache configuration files of a server
+const configFindCommand = `find /etc -type f -name "httpd*.conf" 2>/dev/null || find /etc/apache2 -type f -name "*.conf" 2>/dev/null`
+
+// discoveryDirsAwk prints the document roots (R) and alias directories (A)
+// of Apache configuration files, like gatherSiteInfo parses them
+const discoveryDirsAwk = `$1 == "DocumentRoot" && NF > 1 { v = $2; gsub(/^"|"$/, "", v); print "R " v }
+tolower($1) == "alias" && NF > 1 { v = (NF > 2 ? $3 : $2); gsub(/^["']|["']$/, "", v); print "A " v }`
+
+// remoteDiscovery is what the discovery script found on a server in one
+// execution
+type remoteDiscovery struct {
+    // Apache configuration files in the order they were found
+    configs []string
+    // Content of the configuration files and of the credential files found
+    files map[string]string
+    // Directories whose credential files were looked for
+    roots map[string]bool
+    // Laravel application root of each alias directory, empty if it is none
+    apps map[string]string
+}
+
+// prefetchedListing is the listing of a document root fetched ahead of the
+// site's backup
+type prefetchedListing struct {
+    data    []byte
+    fetched time.Time
+}
+
+// listingCache holds the listings fetched ahead of the sites' backups until
+// they are used
+type listingCache struct {
+    mu       sync.Mutex
+    listings map[string]prefetchedListing
+}
+
+// discoveryScript returns the shell script reading the Apache configuration
+// files, the credential files of every document root and the application
+// roots of aliases. Records are NUL separated: config <path> <content>,
+// app <dir> <root>, root <dir> and file <path> <content>.
+func discoveryScript() string {
+    var names []string
+    for _, p := range config.CredentialProviders() {
+        names = append(names, shellQuote(p.ConfigFile()))
+    }
+    return fmt.Sprintf(`{
+confs=$(%s)
+[ -n "$confs" ] || confs=$(ls -d /etc/apache2/apache2.conf /etc/apache2/httpd.conf /etc/httpd/conf/httpd.conf /etc/apache2/sites-enabled/*)
+IFS='
+'
+set -f
+for f in $confs; do
+    [ -f "$f" ] && [ -r "$f" ] || continue
+    printf 'config\0%%s\0' "$f"; tr -d '\000' < "$f"; printf '\0'
+done
+roots=
+for l in $(for f in $confs; do [ -f "$f" ] && cat "$f"; done | awk %s); do
+    d=${l#? }
+    case $l in
+    R*) roots="$roots
+$d" ;;
+    A*)
+        app=
+        for c in "$d" "$d/.."; do
+            if [ -f "$c/artisan" ]; then app=$(cd "$c" && pwd); break; fi
+        done
+        printf 'app\0%%s\0%%s\0' "$d" "$app"
+        [ -z "$app" ] || roots="$roots
+$app" ;;
+    esac
+done
+for d in $(printf '%%s\n' "$roots" | sort -u); do
+    printf 'root\0%%s\0' "$d"
+    for n in %s; do
+        [ -f "$d/$n" ] && [ -r "$d/$n" ] || continue
+        printf 'file\0%%s\0' "$d/$n"; tr -d '\000' < "$d/$n"; printf '\0'
+    done
+done
+} 2>/dev/null`, configFindCommand, shellQuote(discoveryDirsAwk), strings.Join(names, " "))
+}
+
+// discover runs the discovery script on the server
+func (sb *SSHBackup) discover(ctx context.Context) (*remoteDiscovery, error) {
+    var output bytes.Buffer
+    noCheck := func(int64) error { return nil }
+    if err := sb.stream(ctx, discoveryScript(), &output, "site discovery", noCheck); err != nil {
+        return nil, err
+    }
+    return parseDiscovery(output.String())
+}
+
+// parseDiscovery parses the output of the discovery script
+func parseDiscovery(output string) (*remoteDiscovery, error) {
+    d := &remoteDiscovery{files: make(map[string]string), roots: make(map[string]bool), apps: make(map[string]string)}
+    fields := strings.Split(output, "\x00")
+    // The output ends with a separator
+    if n := len(fields); n > 0 && fields[n-1] == "" {
+        fields = fields[:n-1]
+    }
+    for i := 0; i < len(fields); {
+        kind, args := fields[i], 2
+        switch kind {
+        case "root":
+            args = 1
+        case "config", "file", "app":
+        default:
+            return nil, fmt.Errorf("unexpected output of discovery script: %q", kind)
+        }
+        if i+args >= len(fields) {
+            return nil, fmt.Errorf("truncated output of discovery script")
+        }
+        switch kind {
+        case "config":
+            d.configs = append(d.configs, fields[i+1])
+            d.files[fields[i+1]] = fields[i+2]
+        case "file":
+            d.files[fields[i+1]] = fields[i+2]
+        case "app":
+            d.apps[fields[i+1]] = fields[i+2]
+        case "root":
+            d.roots[fields[i+1]] = true
+        }
+        i += args + 1
+    }
+    return d, nil
+}
+
+// credentials returns the database credentials of a site from the files
+// the script read. ok is false if the script didn't look for them.
+func (d *remoteDiscovery) credentials(site SiteInfo) (config.Credentials, bool) {
+    dir := site.DocumentRoot
+    if site.EnvFile != "" {
+        dir = path.Dir(site.EnvFile)
+    }
+    if !d.roots[dir] {
+        return config.Credentials{}, false
+    }
+    for _, file := range credentialFiles(site) {
+        if content, ok := d.files[file]; ok {
+            return parseCredentials(file, content), true
+        }
+    }
+    return config.Credentials{}, true
+}
+
+// siteCredentials reads the database credentials of a site found by
+// gatherSiteInfo, from the discovery if it has them
+func (sb *SSHBackup) siteCredentials(ctx context.Context, d *remoteDiscovery, site SiteInfo) (config.Credentials, error) {
+    if d != nil {
+        if creds, ok := d.credentials(site); ok {
+            return creds, nil
+        }
+    }
+    return sb.readRemoteCredentials(ctx, site)
+}
+
+// laravelApp returns the root of the Laravel application served from an
+// alias directory, from the discovery if it looked at the directory
+func (sb *SSHBackup) laravelApp(ctx context.Context, d *remoteDiscovery, dir string) string {
+    if d != nil {
+        if root, ok := d.apps[dir]; ok {
+            return root
+        }
+    }
+    return sb.findRemoteLaravelApp(ctx, dir)
+}
+
+// prefetchListings lists the document roots of the sites whose files are
+// checked for changes in this run with a single command, instead of one
+// per site. A root that can't be listed is left to the site's own scan.
+func (sb *SSHBackup) prefetchListings(ctx context.Context, sites []SiteInfo) {
+    var roots []string
+    seen := make(map[string]bool)
+    for _, site := range sites {
+        filesDone, _ := sb.componentsDone(site, filepath.Join(sb.manager.BaseDir, site.ServerName), nil)
+        if filesDone || seen[site.DocumentRoot] {
+            continue
+        }
+        seen[site.DocumentRoot] = true
+        roots = append(roots, site.DocumentRoot)
+    }
+    if len(roots) == 0 {
+        return
+    }
+
+    // Each listing is followed by an empty field and the exit status of find
+    var script strings.Builder
+    for _, root := range roots {
+        fmt.Fprintf(&script, `if cd %s 2>/dev/null; then printf 'listing\0%%s\0' %s; find . -mindepth 1 -printf '%%y %%s %%T@ %%m %%P\0'; printf '\0%%s\0' $?; fi; `,
+            shellQuote(root), shellQuote(root))
+    }
+    sb.log.Debug("Listing document roots", "sites", len(roots))
+    var output bytes.Buffer
+    noCheck := func(int64) error { return nil }
+    if err := sb.stream(ctx, script.String(), &output, "listing of document roots", noCheck); err != nil {
+        sb.log.Warn("Failed to list document roots at once, listing them per site", "error", err)
+        return
+    }
+
+    listings := make(map[string]prefetchedListing)
+    data := output.Bytes()
+    for len(data) > 0 {
+        fields := bytes.SplitN(data, []byte{0}, 3)
+        if len(fields) < 3 || string(fields[0]) != "listing" {
+            sb.log.Warn("Unexpected listing of document roots, listing them per site")
+            return
+        }
+        root := string(fields[1])
+        rest := fields[2]
+        // Entries are never empty, so the first empty field ends the listing
+        end := 0
+        if !bytes.HasPrefix(rest, []byte{0}) {
+            end = bytes.Index(rest, []byte{0, 0})
+            if end < 0 {
+                sb.log.Warn("Truncated listing of document roots, listing them per site")
+                return
+            }
+            end++
+        }
+        status, next, ok := bytes.Cut(rest[end+1:], []byte{0})
+        if !ok {
+            sb.log.Warn("Truncated listing of document roots, listing them per site")
+            return
+        }
+        if string(status) == "0" {
+            listings[root] = prefetchedListing{data: rest[:end], fetched: time.Now()}
+        }
+        data = next
+    }
+    sb.listings.mu.Lock()
+    sb.listings.listings = listings
+    sb.listings.mu.Unlock()
+}
+
+// takeListing returns the prefetched listing of a document root once, if
+// there is a recent one
+func (sb *SSHBackup) takeListing(root string) ([]byte, bool) {
+    sb.listings.mu.Lock()
+    defer sb.listings.mu.Unlock()
+    listing, ok := sb.listings.listings[root]
+    delete(sb.listings.listings, root)
+    if !ok || time.Since(listing.fetched) > listingMaxAge {
+        return nil, false
+    }
+    return listing.data, true
+}
@@ -0,0 +1,194 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os/exec"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+)
+
+// dockerDumpScript runs mysqldump, or mariadb-dump in newer MariaDB images,
+// inside a database container as the user of the container's environment,
+// or as root without one. The password stays in the container.
+const dockerDumpScript = `u=${MYSQL_USER:-$MARIADB_USER}
+if [ -n "$u" ]; then MYSQL_PWD=${MYSQL_PASSWORD:-$MARIADB_PASSWORD}; else u=root; MYSQL_PWD=${MYSQL_ROOT_PASSWORD:-$MARIADB_ROOT_PASSWORD}; fi
+export MYSQL_PWD
+d=$(command -v mysqldump || command -v mariadb-dump) || { echo "neither mysqldump nor mariadb-dump found in the container" >&2; exit 127; }
+exec "$d" -u "$u"`
+
+// dockerNameUnsafe matches the characters not allowed in container names
+var dockerNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// DockerSite is a site running in Docker containers on this machine, found
+// by the labels of its container
+type DockerSite struct {
+    Name      string `json:"name"`
+    Container string `json:"container"`
+    // Named volume holding the site's files, empty if it has none
+    Volume string `json:"volume,omitempty"`
+    // Container of the site's MySQL or MariaDB database, empty if it has
+    // none, and the database if not the one of the container's environment
+    DBContainer string `json:"db_container,omitempty"`
+    DBName      string `json:"db_name,omitempty"`
+}
+
+// dockerContainer is the part of the output of docker inspect describing
+// a site's container
+type dockerContainer struct {
+    Name   string `json:"Name"`
+    Config struct {
+        Labels map[string]string `json:"Labels"`
+        Env    []string          `json:"Env"`
+    } `json:"Config"`
+    Mounts []struct {
+        Type        string `json:"Type"`
+        Name        string `json:"Name"`
+        Destination string `json:"Destination"`
+    } `json:"Mounts"`
+}
+
+// dockerCommand returns the Docker client command with args, bound to ctx
+func (bm *BackupManager) dockerCommand(ctx context.Context, args ...string) *exec.Cmd {
+    argv := append(bm.Docker.CommandArgs(), args...)
+    return exec.CommandContext(ctx, argv[0], argv[1:]...)
+}
+
+// dockerOutput runs the Docker client and returns its output
+func (bm *BackupManager) dockerOutput(ctx context.Context, args ...string) ([]byte, error) {
+    cmd := bm.dockerCommand(ctx, args...)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    output, err := cmd.Output()
+    if err != nil {
+        return nil, contextError(ctx, fmt.Errorf("docker %s failed: %v, error output: %s", args[0], err, strings.TrimSpace(stderr.String())))
+    }
+    return output, nil
+}
+
+// DiscoverDockerSites returns the sites of the running containers labelled
+// backup.enabled=true, sorted by name. Containers whose labels don't make a
+// valid site are logged and left out.
+func (bm *BackupManager) DiscoverDockerSites(ctx context.Context) ([]DockerSite, error) {
+    output, err := bm.dockerOutput(ctx, "ps", "-q", "--filter", "label="+config.DockerLabelEnabled+"=true")
+    if err != nil {
+        return nil, err
+    }
+    ids := strings.Fields(string(output))
+    if len(ids) == 0 {
+        return nil, nil
+    }
+    if output, err = bm.dockerOutput(ctx, append([]string{"inspect"}, ids...)...); err != nil {
+        return nil, err
+    }
+    var containers []dockerContainer
+    if err := json.Unmarshal(output, &containers); err != nil {
+        return nil, fmt.Errorf("failed to parse docker inspect output: %v", err)
+    }
+
+    var sites []DockerSite
+    for _, c := range containers {
+        site, err := dockerSite(c)
+        if err != nil {
+            slog.Warn("Skipping container", "container", strings.TrimPrefix(c.Name, "/"), "error", err)
+            continue
+        }
+        sites = append(sites, site)
+    }
+    sort.Slice(sites, func(i, j int) bool {
+        return sites[i].Name < sites[j].Name
+    })
+    return sites, nil
+}
+
+// dockerSite derives the site of a container from its labels, mounts and
+// environment
+func dockerSite(c dockerContainer) (DockerSite, error) {
+    labels := c.Config.Labels
+    site := DockerSite{
+        Name:        labels[config.DockerLabelSite],
+        Container:   strings.TrimPrefix(c.Name, "/"),
+        Volume:      labels[config.DockerLabelVolume],
+        DBContainer: labels[config.DockerLabelDBContainer],
+        DBName:      labels[config.DockerLabelDBName],
+    }
+    if site.Name == "" {
+        site.Name = site.Container
+    }
+    if site.Name == "" || site.Name == "." || site.Name == ".." || strings.ContainsAny(site.Name, `/\`) {
+        return site, fmt.Errorf("invalid site name %q, set the %s label", site.Name, config.DockerLabelSite)
+    }
+
+    if site.Volume == "" {
+        var volumes []string
+        for _, m := range c.Mounts {
+            if m.Type == "volume" {
+                volumes = append(volumes, m.Name)
+            }
+        }
+        if len(volumes) > 1 {
+            return site, fmt.Errorf("container has %d named volumes, set the %s label to the one with the site's files",
+                len(volumes), config.DockerLabelVolume)
+        }
+        if len(volumes) == 1 {
+            site.Volume = volumes[0]
+        }
+    }
+    if site.DBContainer == "" {
+        for _, env := range c.Config.Env {
+            if strings.HasPrefix(env, "MYSQL_DATABASE=") || strings.HasPrefix(env, "MARIADB_DATABASE=") {
+                site.DBContainer = site.Container
+                break
+            }
+        }
+    }
+    if site.Volume == "" && site.DBContainer == "" {
+        return site, fmt.Errorf("container has neither a named volume nor a database")
+    }
+    return site, nil
+}
+
+// BackupDockerVolume archives a named volume holding the files of a Docker
+// site through a container of the helper image that mounts it read-only.
+// Excludes, change detection and incremental archives don't apply to
+// volumes; every backup is a full archive.
+func (bm *BackupManager) BackupDockerVolume(ctx context.Context, siteName, volume string) (string, error) {
+    // Killing the client leaves the container running, so a cancelled
+    // archive removes it by name
+    name := fmt.Sprintf("laravel-backup-%s-%d", dockerNameUnsafe.ReplaceAllString(siteName, "-"), time.Now().UnixNano())
+    cmd := bm.dockerCommand(ctx, "run", "--rm", "--name", name, "--network", "none", "-v", volume+":/data:ro",
+        bm.Docker.HelperImage, "tar", "-C", "/data", "-cf", "-", ".")
+    path, err := bm.storeArchiveOf(ctx, siteName, "file", ".tar", bm.Compression.For(siteName), false,
+        dumpWriter(ctx, cmd, "tar of volume "+volume))
+    if err != nil && ctx.Err() != nil {
+        bm.dockerCommand(context.Background(), "rm", "-f", name).Run()
+    }
+    return path, err
+}
+
+// BackupDockerDatabase dumps the database of a Docker site with mysqldump
+// run inside its database container, with the site's mysqldump options.
+// dbName is the database, MYSQL_DATABASE of the container if empty.
+func (bm *BackupManager) BackupDockerDatabase(ctx context.Context, siteName, container, dbName string) (string, error) {
+    if dbName == "" {
+        output, err := bm.dockerOutput(ctx, "exec", container, "sh", "-c", `printf %s "${MYSQL_DATABASE:-$MARIADB_DATABASE}"`)
+        if err != nil {
+            return "", err
+        }
+        if dbName = strings.TrimSpace(string(output)); dbName == "" {
+            return "", fmt.Errorf("container %s has no MYSQL_DATABASE, set the %s label", container, config.DockerLabelDBName)
+        }
+    }
+    script := dockerDumpScript
+    for _, arg := range mysqldumpArgs(bm.MySQLDump.For(siteName), dbName) {
+        script += " " + shellQuote(arg)
+    }
+    cmd := bm.dockerCommand(ctx, "exec", container, "sh", "-c", script)
+    return bm.writeDump(ctx, siteName, cmd, "mysqldump in container "+container)
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+)
+
+// Outcomes of checking the size of a site's files against its budget
+const (
+    SizeOK    = "ok"
+    SizeWarn  = "warn"
+    SizeOver  = "over"
+    SizeError = "error"
+)
+
+// SiteEstimate is the size of the files a file archive of a site would hold,
+// found by listing its document root without reading the files
+type SiteEstimate struct {
+    Site string `json:"site"`
+    // Backups the site belongs to, e.g. "local" or "remote/<server>"
+    Source       string   `json:"source"`
+    DocumentRoot string   `json:"document_root"`
+    Files        int      `json:"files"`
+    Size         ByteSize `json:"size"`
+    // Limits of the site's budget, zero if unset
+    MaxSize  ByteSize `json:"max_size,omitempty"`
+    WarnSize ByteSize `json:"warn_size,omitempty"`
+    // One of SizeOK, SizeWarn, SizeOver and SizeError
+    Status string `json:"status"`
+    Error  string `json:"error,omitempty"`
+}
+
+// treeSize returns the total size and number of the regular files of a scan
+func treeSize(files map[string]ManifestFile) (ByteSize, int) {
+    var size ByteSize
+    count := 0
+    for _, file := range files {
+        if file.Mode.IsRegular() {
+            size += ByteSize(file.Size)
+            count++
+        }
+    }
+    return size, count
+}
+
+// sizeStatus compares the size of a site's files with its budget
+func sizeStatus(budget Budget, size ByteSize) string {
+    switch {
+    case budget.MaxSize != 0 && size > budget.MaxSize:
+        return SizeOver
+    case budget.WarnSize != 0 && size > budget.WarnSize:
+        return SizeWarn
+    }
+    return SizeOK
+}
+
+// Estimate lists the files of a site's document root selected for its file
+// archive, on the machine of the transport, and compares their size with
+// the site's budget. Failures are reported in the estimate.
+func (bm *BackupManager) Estimate(ctx context.Context, t Transport, site, root string) SiteEstimate {
+    budget := bm.Budgets.For(site)
+    estimate := SiteEstimate{Site: site, DocumentRoot: root, MaxSize: budget.MaxSize, WarnSize: budget.WarnSize}
+    filter, err := bm.FileFilter(site)
+    if err == nil {
+        var files map[string]ManifestFile
+        if files, err = scanTree(ctx, t, root, filter); err == nil {
+            estimate.Size, estimate.Files = treeSize(files)
+        }
+    }
+    if err != nil {
+        estimate.Status, estimate.Error = SizeError, err.Error()
+        return estimate
+    }
+    estimate.Status = sizeStatus(budget, estimate.Size)
+    return estimate
+}
+
+// CheckSize returns an error if the files of a site are over its maximum
+// size and large sites are not allowed; over the warning size, or over the
+// maximum when allowed, the site is logged
+func (bm *BackupManager) CheckSize(site string, size ByteSize, files int) error {
+    budget := bm.Budgets.For(site)
+    switch sizeStatus(budget, size) {
+    case SizeOver:
+        if !bm.AllowLarge {
+            return fmt.Errorf("%s in %d files exceeds the maximum size of %s, back up with --allow-large to archive it anyway",
+                size, files, budget.MaxSize)
+        }
+        slog.Warn("Backing up files over the maximum size", "site", site, "size", size, "files", files, "max_size", budget.MaxSize)
+    case SizeWarn:
+        slog.Warn("Files of site are larger than expected", "site", site, "size", size, "files", files, "warn_size", budget.WarnSize)
+    }
+    return nil
+}
+
+// EstimateRemoteSites estimates the size of the file archives of the
+// server's sites selected by the configuration
+func (sb *SSHBackup) EstimateRemoteSites(ctx context.Context) ([]SiteEstimate, error) {
+    sites, err := sb.gatherSiteInfo(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to gather site information: %v", err)
+    }
+    sites = filterSites(sites, sb.config.Sites, sb.config.ExcludeSites)
+
+    var estimates []SiteEstimate
+    for _, site := range sites {
+        if ctx.Err() != nil {
+            return estimates, context.Cause(ctx)
+        }
+        sb.log.Debug("Estimating size of site", "site", site.ServerName)
+        estimates = append(estimates, sb.manager.Estimate(ctx, sb.transport, site.ServerName, site.DocumentRoot))
+    }
+    return estimates, nil
+}
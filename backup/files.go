@@ -1,280 +1,219 @@
 package backup
 
 import (
+    "context"
     "fmt"
+    "log/slog"
     "os"
     "path/filepath"
     "time"
     "io"
     "archive/tar"
-    "compress/gzip"
-    "strings"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
 )
 
 // FileBackup handles file backup operations
 type FileBackup struct {
-    manager *BackupManager
+    manager   *BackupManager
+    transport Transport
 }
 
-// NewFileBackup creates a new file backup handler
+// NewFileBackup creates a new file backup handler of local sites
 func NewFileBackup(manager *BackupManager) *FileBackup {
-    return &FileBackup{manager: manager}
+    return &FileBackup{manager: manager, transport: LocalTransport{}}
 }
 
-// compareWithLastBackup checks if files have changed since last backup
-func (fb *FileBackup) compareWithLastBackup(siteName, sourceDir string) (bool, error) {
-    // Get list of existing backups
-    backupDir := filepath.Join(fb.manager.BaseDir, siteName)
-    entries, err := os.ReadDir(backupDir)
+// BackupFiles creates a backup of the specified directory and returns the
+// path of the new archive, or an empty path if nothing changed since the last one.
+// Changes are detected with the manifest of the previous backup. In incremental
+// mode only changed files are archived, except for every FullEvery-th backup.
+// Files over the site's maximum size are not archived unless allowed.
+// A partial archive is removed when ctx is cancelled.
+func (fb *FileBackup) BackupFiles(ctx context.Context, siteName, sourceDir string) (string, error) {
+    // Create backup directory
+    backupDir := fb.manager.getSiteBackupDir(siteName)
+    if err := os.MkdirAll(backupDir, 0755); err != nil {
+        return "", fmt.Errorf("failed to create backup directory: %v", err)
+    }
+
+    previous, err := loadManifest(backupDir)
     if err != nil {
-        if os.IsNotExist(err) {
-            return true, nil // No previous backups, need to create first one
-        }
-        return false, fmt.Errorf("failed to read backup directory: %v", err)
+        return "", err
+    }
+    filter, err := fb.manager.FileFilter(siteName)
+    if err != nil {
+        return "", err
+    }
+    // Files written during the backup don't make a snapshot inconsistent
+    sourceDir, releaseSnapshot := fb.manager.openSourceSnapshot(ctx, siteName, sourceDir)
+    defer releaseSnapshot()
+    current, err := scanTree(ctx, fb.transport, sourceDir, filter)
+    if err != nil {
+        return "", err
     }
 
-    // Find latest backup
-    var latestBackup string
-    var latestTime time.Time
-    for _, entry := range entries {
-        if entry.IsDir() || !strings.HasPrefix(entry.Name(), "files_") {
-            continue
-        }
-        
-        // Parse timestamp from filename
-        timeStr := strings.TrimPrefix(strings.TrimSuffix(entry.Name(), ".tar.gz"), "files_")
-        backupTime, err := time.Parse("2006-01-02_150405", timeStr)
+    // Check if files have changed since last backup
+    var changed map[string]bool
+    if previous != nil {
+        var removed int
+        changed, removed, err = diffManifest(previous, current, sourceDir)
         if err != nil {
-            continue
+            return "", fmt.Errorf("failed to compare with last backup: %v", err)
         }
-
-        if latestBackup == "" || backupTime.After(latestTime) {
-            latestBackup = entry.Name()
-            latestTime = backupTime
+        if len(changed) == 0 && removed == 0 {
+            slog.Info("No changes detected, skipping backup", "site", siteName)
+            return "", nil
         }
     }
-
-    if latestBackup == "" {
-        return true, nil // No valid backups found
+    size, count := treeSize(current)
+    if err := fb.manager.CheckSize(siteName, size, count); err != nil {
+        return "", err
     }
 
-    // Create temporary directory for comparison inside backup directory
-    tempDir := filepath.Join(backupDir, fmt.Sprintf("temp_%d", time.Now().UnixNano()))
-    if err := os.MkdirAll(tempDir, 0755); err != nil {
-        return false, fmt.Errorf("failed to create temp directory: %v", err)
+    // Generate backup file name with timestamp
+    timestamp := time.Now().Format(TimestampFormat)
+    compression := fb.manager.Compression.For(siteName)
+    ext := ".tar" + compressionExt(compression.Format)
+    if fb.manager.Dedup {
+        ext = ".tar" + dedup.IndexExt
     }
-    defer os.RemoveAll(tempDir)
-
-    // Extract latest backup
-    latestBackupPath := filepath.Join(backupDir, latestBackup)
-    if err := fb.extractArchive(latestBackupPath, tempDir); err != nil {
-        return false, fmt.Errorf("failed to extract latest backup: %v", err)
+    manifest := &Manifest{Created: time.Now(), Files: current}
+    incremental := fb.manager.Incremental && previous != nil && previous.Chain+1 < fb.manager.FullEvery
+    backupFile := archivePath(fb.manager.BaseDir, siteName, "file", timestamp, incremental, ext)
+    // The manifest names the archive by its path below the site directory
+    if manifest.Archive, err = filepath.Rel(backupDir, backupFile); err != nil {
+        return "", err
+    }
+    if incremental {
+        manifest.Base = previous.Archive
+        manifest.Chain = previous.Chain + 1
+    } else {
+        changed = nil
+    }
+    if err := os.MkdirAll(filepath.Dir(backupFile), 0755); err != nil {
+        return "", fmt.Errorf("failed to create backup directory: %v", err)
     }
 
-    // Compare directories
-    changed := false
-    err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
-        }
-
-        // Skip node_modules
-        if info.IsDir() && info.Name() == "node_modules" {
-            return filepath.SkipDir
+    // The archive takes at most the size of the files it contains
+    var needed ByteSize
+    for path, file := range current {
+        if changed == nil || changed[path] {
+            needed += ByteSize(file.Size)
         }
+    }
+    if err := fb.manager.CheckSpace(siteName, "files", needed); err != nil {
+        return "", err
+    }
 
-        // Skip symlinks
-        if info.Mode()&os.ModeSymlink != 0 {
-            return nil
-        }
+    // Create archive
+    started := time.Now()
+    if err := fb.createArchive(ctx, sourceDir, backupFile, filter, compression, manifest, changed); err != nil {
+        os.Remove(backupFile)
+        return "", contextError(ctx, err)
+    }
 
-        // Get relative path
-        relPath, err := filepath.Rel(sourceDir, path)
-        if err != nil {
-            return err
-        }
+    // Record checksum and catalog entry so later checks can detect corruption
+    if err := fb.manager.registerArchive(siteName, "file", backupFile, started); err != nil {
+        return "", err
+    }
+    if err := manifest.save(backupDir); err != nil {
+        return "", err
+    }
 
-        // Skip root directory
-        if relPath == "." {
-            return nil
-        }
+    if incremental {
+        slog.Info("Created incremental backup", "site", siteName, "path", backupFile,
+            "changed", len(changed), "base", manifest.Base)
+    } else {
+        slog.Info("Created file backup", "site", siteName, "path", backupFile)
+    }
+    return backupFile, nil
+}
 
-        // Get corresponding file in backup
-        backupPath := filepath.Join(tempDir, relPath)
-        backupInfo, err := os.Lstat(backupPath)
+// createArchive creates a tar archive of the files of the source directory
+// selected by filter, compressed as configured or deduplicated, and records the checksum of every archived file in the
+// manifest. With only set, regular files not in it are left out and the
+// manifest is appended to the archive.
+func (fb *FileBackup) createArchive(ctx context.Context, sourceDir, targetFile string, filter *config.FileFilter, compression config.Compression, manifest *Manifest, only map[string]bool) error {
+    if fb.manager.Dedup {
+        dw, err := fb.manager.dedupWriter(targetFile)
         if err != nil {
-            if os.IsNotExist(err) {
-                changed = true // File doesn't exist in backup
-                return nil
-            }
             return err
         }
-
-        // Compare file types
-        if info.Mode()&os.ModeType != backupInfo.Mode()&os.ModeType {
-            changed = true
-            return nil
+        if err := fb.writeTar(ctx, dw, sourceDir, filter, manifest, only); err != nil {
+            return err
         }
-
-        // Compare modification times and sizes for regular files
-        if !info.IsDir() {
-            if info.ModTime().After(latestTime) || info.Size() != backupInfo.Size() {
-                changed = true
-                return nil
-            }
+        if err := dw.Close(); err != nil {
+            return fmt.Errorf("failed to finish archive: %v", err)
         }
-
+        slog.Debug("Stored deduplicated archive", "path", targetFile, "new_chunks", dw.NewChunks, "new_bytes", dw.NewBytes)
         return nil
-    })
-
-    if err != nil {
-        return false, fmt.Errorf("failed to compare directories: %v", err)
     }
 
-    return changed, nil
-}
-
-// extractArchive extracts a tar.gz archive to the specified directory
-func (fb *FileBackup) extractArchive(archivePath, destDir string) error {
-    file, err := os.Open(archivePath)
+    // Create target file
+    file, err := os.Create(targetFile)
     if err != nil {
-        return fmt.Errorf("failed to open archive: %v", err)
+        return fmt.Errorf("failed to create archive file: %v", err)
     }
     defer file.Close()
 
-    gzr, err := gzip.NewReader(file)
+    // Encrypt the compressed stream if enabled
+    ew, err := fb.manager.encryptionWriter(file)
     if err != nil {
-        return fmt.Errorf("failed to create gzip reader: %v", err)
-    }
-    defer gzr.Close()
-
-    tr := tar.NewReader(gzr)
-
-    for {
-        header, err := tr.Next()
-        if err == io.EOF {
-            break
-        }
-        if err != nil {
-            return fmt.Errorf("failed to read tar header: %v", err)
-        }
-
-        // Skip symlinks
-        if header.Typeflag == tar.TypeSymlink {
-            continue
-        }
-
-        target := filepath.Join(destDir, header.Name)
-
-        switch header.Typeflag {
-        case tar.TypeDir:
-            if err := os.MkdirAll(target, 0755); err != nil {
-                return fmt.Errorf("failed to create directory: %v", err)
-            }
-        case tar.TypeReg:
-            dir := filepath.Dir(target)
-            if err := os.MkdirAll(dir, 0755); err != nil {
-                return fmt.Errorf("failed to create directory: %v", err)
-            }
-            f, err := os.Create(target)
-            if err != nil {
-                return fmt.Errorf("failed to create file: %v", err)
-            }
-            if _, err := io.Copy(f, tr); err != nil {
-                f.Close()
-                return fmt.Errorf("failed to write file: %v", err)
-            }
-            f.Close()
-        }
+        return err
     }
 
-    return nil
-}
-
-// BackupFiles creates a backup of the specified directory
-func (fb *FileBackup) BackupFiles(siteName, sourceDir string) error {
-    // Check if files have changed since last backup
-    changed, err := fb.compareWithLastBackup(siteName, sourceDir)
+    // Create compressing writer
+    gw, err := newCompressor(ew, compression)
     if err != nil {
-        return fmt.Errorf("failed to compare with last backup: %v", err)
+        return fmt.Errorf("failed to create compressor: %v", err)
     }
+    defer gw.Close()
 
-    if !changed {
-        fmt.Printf("No changes detected for %s, skipping backup\n", siteName)
-        return nil
+    if err := fb.writeTar(ctx, gw, sourceDir, filter, manifest, only); err != nil {
+        return err
     }
-
-    // Create backup directory
-    backupDir := filepath.Join(fb.manager.BaseDir, siteName)
-    if err := os.MkdirAll(backupDir, 0755); err != nil {
-        return fmt.Errorf("failed to create backup directory: %v", err)
+    if err := gw.Close(); err != nil {
+        return fmt.Errorf("failed to finish archive: %v", err)
     }
-
-    // Generate backup file name with timestamp
-    timestamp := time.Now().Format("2006-01-02_150405")
-    backupFile := filepath.Join(backupDir, fmt.Sprintf("files_%s.tar.gz", timestamp))
-
-    // Create archive
-    if err := fb.createArchive(sourceDir, backupFile); err != nil {
-        return err
+    if err := ew.Close(); err != nil {
+        return fmt.Errorf("failed to finish archive: %v", err)
     }
-
-    fmt.Printf("Created backup for %s at %s\n", siteName, backupFile)
-
-    // Clean old backups
-    return fb.manager.cleanOldBackups(siteName, false)
+    return file.Close()
 }
 
-// createArchive creates a tar.gz archive of the source directory
-func (fb *FileBackup) createArchive(sourceDir, targetFile string) error {
-    // Create target file
-    file, err := os.Create(targetFile)
-    if err != nil {
-        return fmt.Errorf("failed to create archive file: %v", err)
-    }
-    defer file.Close()
-
-    // Create gzip writer
-    gw := gzip.NewWriter(file)
-    defer gw.Close()
-
+// writeTar writes the tar stream of the files of the source directory
+// selected by filter to w, see createArchive
+func (fb *FileBackup) writeTar(ctx context.Context, w io.Writer, sourceDir string, filter *config.FileFilter, manifest *Manifest, only map[string]bool) error {
     // Create tar writer
-    tw := tar.NewWriter(gw)
+    tw := tar.NewWriter(w)
     defer tw.Close()
 
-    // Walk through source directory
-    err = filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-        if err != nil {
-            return err
-        }
-
-        // Skip node_modules directory
-        if info.IsDir() && info.Name() == "node_modules" {
-            return filepath.SkipDir
-        }
-
-        // Skip symlinks
+    // Walk through the selected files of the source directory
+    err := walkSelected(ctx, fb.transport, sourceDir, filter, func(relPath string, info os.FileInfo) error {
+        // Symlinks are archived as links, followed ones as what they point to
+        var link string
         if info.Mode()&os.ModeSymlink != 0 {
-            return nil
+            var err error
+            if link, err = fb.transport.Readlink(ctx, sourcePath(sourceDir, relPath)); err != nil {
+                return fmt.Errorf("failed to read symlink: %v", err)
+            }
         }
 
-        // Get relative path
-        relPath, err := filepath.Rel(sourceDir, path)
+        // Create tar header
+        header, err := tar.FileInfoHeader(info, link)
         if err != nil {
-            return fmt.Errorf("failed to get relative path: %v", err)
+            return fmt.Errorf("failed to create tar header: %v", err)
         }
 
-        // Skip root directory
-        if relPath == "." {
+        // Unchanged files are already in the archives this one builds on
+        if only != nil && !info.IsDir() && !only[relPath] {
             return nil
         }
 
-        // Create tar header
-        header, err := tar.FileInfoHeader(info, "")
-        if err != nil {
-            return fmt.Errorf("failed to create tar header: %v", err)
-        }
-
         // Update header name to use relative path
         header.Name = relPath
 
@@ -283,21 +222,26 @@ func (fb *FileBackup) createArchive(sourceDir, targetFile string) error {
             return fmt.Errorf("failed to write tar header: %v", err)
         }
 
-        // If this is a directory, continue to next file
-        if info.IsDir() {
+        // Directories and links have no content
+        if !info.Mode().IsRegular() {
             return nil
         }
 
         // Open and copy file content
-        file, err := os.Open(path)
+        file, err := fb.transport.OpenRead(ctx, sourcePath(sourceDir, relPath))
         if err != nil {
             return fmt.Errorf("failed to open file: %v", err)
         }
         defer file.Close()
 
-        if _, err := io.Copy(tw, file); err != nil {
+        h := sha256.New()
+        if _, err := io.Copy(io.MultiWriter(tw, h), contextReader{ctx, file}); err != nil {
             return fmt.Errorf("failed to write file content: %v", err)
         }
+        if entry, ok := manifest.Files[relPath]; ok {
+            entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+            manifest.Files[relPath] = entry
+        }
 
         return nil
     })
@@ -306,5 +250,27 @@ func (fb *FileBackup) createArchive(sourceDir, targetFile string) error {
         return fmt.Errorf("failed to create backup archive: %v", err)
     }
 
+    if only != nil {
+        data, err := json.Marshal(manifest)
+        if err != nil {
+            return fmt.Errorf("failed to encode manifest: %v", err)
+        }
+        header := &tar.Header{
+            Name:    ManifestEntryName,
+            Mode:    0644,
+            Size:    int64(len(data)),
+            ModTime: manifest.Created,
+        }
+        if err := tw.WriteHeader(header); err != nil {
+            return fmt.Errorf("failed to write tar header: %v", err)
+        }
+        if _, err := tw.Write(data); err != nil {
+            return fmt.Errorf("failed to write manifest: %v", err)
+        }
+    }
+
+    if err := tw.Close(); err != nil {
+        return fmt.Errorf("failed to finish archive: %v", err)
+    }
     return nil
 }
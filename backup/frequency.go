@@ -0,0 +1,49 @@
+package backup
+
+import (
+    "time"
+)
+
+// maxDueSlack caps how much earlier than its interval a backup is due again
+const maxDueSlack = 30 * time.Minute
+
+// NextDue returns when the next archive of a type of a site is due: the
+// configured interval after the newest one in the catalog, less a tenth of
+// the interval but at most maxDueSlack, so a run starting a little earlier
+// than the previous one doesn't skip it. Binary logs and physical backups
+// count as database backups. Without an interval or an archive it is due at
+// once and the zero time is returned.
+func (bm *BackupManager) NextDue(siteName, archiveType string) time.Time {
+    interval := bm.Frequency.Interval(siteName, archiveType)
+    if interval <= 0 || bm.Catalog == nil {
+        return time.Time{}
+    }
+    types := []string{archiveType}
+    if archiveType == "database" {
+        types = append(types, BinlogArchiveType, PhysicalArchiveType)
+    }
+    var latest time.Time
+    for _, t := range types {
+        if entry, ok := bm.Catalog.Latest(siteName, t); ok && entry.Time.After(latest) {
+            latest = entry.Time
+        }
+    }
+    if latest.IsZero() {
+        return time.Time{}
+    }
+    slack := interval / 10
+    if slack > maxDueSlack {
+        slack = maxDueSlack
+    }
+    return latest.Add(interval - slack)
+}
+
+// Due reports whether an archive of a type of a site is due
+func (bm *BackupManager) Due(siteName, archiveType string) bool {
+    return !time.Now().Before(bm.NextDue(siteName, archiveType))
+}
+
+// Blackout returns the blackout window the backups of a site are in now
+func (bm *BackupManager) Blackout(siteName string) (string, bool) {
+    return bm.Frequency.Blackout(siteName, time.Now())
+}
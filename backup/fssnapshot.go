@@ -0,0 +1,297 @@
+package backup
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "laravel-backup-tool/config"
+)
+
+// btrfsSubvolumeIno is the inode number of the root directory of every
+// btrfs subvolume
+const btrfsSubvolumeIno = 256
+
+// fsSnapshotSeq numbers the snapshots of this process, so snapshots of
+// sites backed up in parallel get different names
+var fsSnapshotSeq int64
+
+// FSSnapshot is a read-only snapshot of the filesystem holding a directory,
+// taken so the directory can be archived in a consistent state
+type FSSnapshot struct {
+    // Path of the directory in the snapshot
+    Path string
+    // Kind of snapshot: lvm, btrfs or zfs
+    Kind string
+    // release removes the snapshot
+    release func() error
+}
+
+// mountInfo is a mount of /proc/self/mountinfo
+type mountInfo struct {
+    MountPoint string
+    FSType     string
+    Source     string
+}
+
+// OpenFSSnapshot takes an LVM, btrfs or ZFS snapshot of the filesystem
+// holding dir and returns where dir is found in it. It fails if the
+// filesystem can't be snapshotted, e.g. because it is ext4 on a plain
+// partition or the tools are missing; the caller then reads dir directly.
+// Release the snapshot when done.
+func OpenFSSnapshot(ctx context.Context, dir string, settings config.FSSnapshotConfig) (*FSSnapshot, error) {
+    resolved, err := filepath.EvalSymlinks(dir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to resolve %s: %v", dir, err)
+    }
+    mount, err := findMount(resolved)
+    if err != nil {
+        return nil, err
+    }
+    name := fmt.Sprintf("lbt-%d-%d", os.Getpid(), atomic.AddInt64(&fsSnapshotSeq, 1))
+
+    switch mount.FSType {
+    case "btrfs":
+        return btrfsSnapshot(ctx, resolved, mount, name)
+    case "zfs":
+        return zfsSnapshot(ctx, resolved, mount, name)
+    default:
+        if strings.HasPrefix(mount.Source, "/dev/mapper/") || isLVMDevice(ctx, mount.Source) {
+            return lvmSnapshot(ctx, resolved, mount, name, settings)
+        }
+    }
+    return nil, fmt.Errorf("%s is on %s (%s), which can't be snapshotted", dir, mount.Source, mount.FSType)
+}
+
+// Release removes the snapshot. It runs even if the backup was cancelled.
+func (s *FSSnapshot) Release() error {
+    if err := s.release(); err != nil {
+        return fmt.Errorf("failed to remove %s snapshot: %v", s.Kind, err)
+    }
+    return nil
+}
+
+// findMount returns the mount holding path, the one with the longest mount
+// point that contains it
+func findMount(path string) (mountInfo, error) {
+    f, err := os.Open("/proc/self/mountinfo")
+    if err != nil {
+        return mountInfo{}, fmt.Errorf("failed to read mounts: %v", err)
+    }
+    defer f.Close()
+
+    var found mountInfo
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        // ID parent major:minor root mount-point options [optional...] - type source super-options
+        fields := strings.Fields(scanner.Text())
+        sep := -1
+        for i, field := range fields {
+            if field == "-" {
+                sep = i
+                break
+            }
+        }
+        if sep < 5 || sep+2 >= len(fields) {
+            continue
+        }
+        mountPoint := unescapeMount(fields[4])
+        if !withinDir(path, mountPoint) || len(mountPoint) < len(found.MountPoint) {
+            continue
+        }
+        found = mountInfo{MountPoint: mountPoint, FSType: fields[sep+1], Source: unescapeMount(fields[sep+2])}
+    }
+    if err := scanner.Err(); err != nil {
+        return mountInfo{}, fmt.Errorf("failed to read mounts: %v", err)
+    }
+    if found.MountPoint == "" {
+        return mountInfo{}, fmt.Errorf("no mount found for %s", path)
+    }
+    return found, nil
+}
+
+// unescapeMount decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in mountinfo fields
+func unescapeMount(s string) string {
+    if !strings.Contains(s, `\`) {
+        return s
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i+3 < len(s) {
+            if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+                b.WriteByte(byte(c))
+                i += 3
+                continue
+            }
+        }
+        b.WriteByte(s[i])
+    }
+    return b.String()
+}
+
+// withinDir reports whether path is dir or below it
+func withinDir(path, dir string) bool {
+    return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// snapshotPath returns where path is found in a snapshot of the filesystem
+// or subvolume mounted at root, whose files are found at snapshotRoot
+func snapshotPath(path, root, snapshotRoot string) (string, error) {
+    rel, err := filepath.Rel(root, path)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(snapshotRoot, rel), nil
+}
+
+// runSnapshotCommand runs a snapshot tool and returns its output, with the
+// output in the error if it fails
+func runSnapshotCommand(ctx context.Context, name string, args ...string) (string, error) {
+    output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("%s %s failed: %v, output: %s", name, strings.Join(args, " "), err, bytes.TrimSpace(output))
+    }
+    return string(output), nil
+}
+
+// btrfsSnapshot takes a read-only snapshot of the subvolume holding path,
+// stored in that subvolume's root directory
+func btrfsSnapshot(ctx context.Context, path string, mount mountInfo, name string) (*FSSnapshot, error) {
+    // The subvolume is the nearest directory with the inode number of
+    // subvolume roots; nested subvolumes are not part of their parent's
+    // snapshots
+    subvolume := path
+    for {
+        info, err := os.Stat(subvolume)
+        if err != nil {
+            return nil, err
+        }
+        if ino, ok := inode(info); ok && ino == btrfsSubvolumeIno {
+            break
+        }
+        if subvolume == mount.MountPoint || subvolume == "/" {
+            break
+        }
+        subvolume = filepath.Dir(subvolume)
+    }
+
+    target := filepath.Join(subvolume, "."+name)
+    if _, err := runSnapshotCommand(ctx, "btrfs", "subvolume", "snapshot", "-r", subvolume, target); err != nil {
+        return nil, err
+    }
+    inSnapshot, err := snapshotPath(path, subvolume, target)
+    if err != nil {
+        return nil, err
+    }
+    return &FSSnapshot{Path: inSnapshot, Kind: "btrfs", release: func() error {
+        _, err := runSnapshotCommand(context.Background(), "btrfs", "subvolume", "delete", target)
+        return err
+    }}, nil
+}
+
+// zfsSnapshot takes a snapshot of the dataset holding path, read through
+// the dataset's .zfs/snapshot directory
+func zfsSnapshot(ctx context.Context, path string, mount mountInfo, name string) (*FSSnapshot, error) {
+    snapshot := mount.Source + "@" + name
+    if _, err := runSnapshotCommand(ctx, "zfs", "snapshot", snapshot); err != nil {
+        return nil, err
+    }
+    inSnapshot, err := snapshotPath(path, mount.MountPoint, filepath.Join(mount.MountPoint, ".zfs", "snapshot", name))
+    if err != nil {
+        return nil, err
+    }
+    return &FSSnapshot{Path: inSnapshot, Kind: "zfs", release: func() error {
+        _, err := runSnapshotCommand(context.Background(), "zfs", "destroy", snapshot)
+        return err
+    }}, nil
+}
+
+// isLVMDevice reports whether a device is a logical volume
+func isLVMDevice(ctx context.Context, device string) bool {
+    if !strings.HasPrefix(device, "/dev/") {
+        return false
+    }
+    _, err := runSnapshotCommand(ctx, "lvs", "--noheadings", device)
+    return err == nil
+}
+
+// lvmSnapshot creates a snapshot volume of the logical volume holding path
+// and mounts it read-only below the mount directory
+func lvmSnapshot(ctx context.Context, path string, mount mountInfo, name string, settings config.FSSnapshotConfig) (*FSSnapshot, error) {
+    output, err := runSnapshotCommand(ctx, "lvs", "--noheadings", "-o", "vg_name,lv_name", mount.Source)
+    if err != nil {
+        return nil, err
+    }
+    fields := strings.Fields(output)
+    if len(fields) != 2 {
+        return nil, fmt.Errorf("unexpected lvs output for %s: %q", mount.Source, output)
+    }
+    vg, lv := fields[0], fields[1]
+    volume := vg + "/" + lv + "-" + name
+
+    // LVM freezes the filesystem while the snapshot is taken
+    if _, err := runSnapshotCommand(ctx, "lvcreate", "--snapshot", "--name", lv+"-"+name, "--size", settings.LVMSize, vg+"/"+lv); err != nil {
+        return nil, err
+    }
+    removeVolume := func() error {
+        _, err := runSnapshotCommand(context.Background(), "lvremove", "--force", volume)
+        return err
+    }
+
+    mountDir := filepath.Join(settings.MountDir, lv+"-"+name)
+    inSnapshot, err := snapshotPath(path, mount.MountPoint, mountDir)
+    if err != nil {
+        removeVolume()
+        return nil, err
+    }
+    if err := os.MkdirAll(mountDir, 0700); err != nil {
+        removeVolume()
+        return nil, fmt.Errorf("failed to create snapshot mount point: %v", err)
+    }
+    // XFS refuses to mount a second filesystem with the same UUID
+    options := "ro"
+    if mount.FSType == "xfs" {
+        options += ",nouuid"
+    }
+    if _, err := runSnapshotCommand(ctx, "mount", "-t", mount.FSType, "-o", options, "/dev/"+volume, mountDir); err != nil {
+        os.Remove(mountDir)
+        removeVolume()
+        return nil, err
+    }
+    return &FSSnapshot{Path: inSnapshot, Kind: "lvm", release: func() error {
+        if _, err := runSnapshotCommand(context.Background(), "umount", mountDir); err != nil {
+            return err
+        }
+        os.Remove(mountDir)
+        return removeVolume()
+    }}, nil
+}
+
+// openSourceSnapshot returns the directory a site's files are archived
+// from: the document root in a filesystem snapshot if snapshots are enabled
+// for the site and one can be taken, the live document root otherwise. The
+// returned function removes the snapshot.
+func (bm *BackupManager) openSourceSnapshot(ctx context.Context, siteName, sourceDir string) (string, func()) {
+    if !bm.FSSnapshots.For(siteName) {
+        return sourceDir, func() {}
+    }
+    snapshot, err := OpenFSSnapshot(ctx, sourceDir, bm.FSSnapshots)
+    if err != nil {
+        slog.Warn("Filesystem snapshot failed, archiving the live files", "site", siteName, "error", err)
+        return sourceDir, func() {}
+    }
+    slog.Info("Archiving from filesystem snapshot", "site", siteName, "kind", snapshot.Kind, "path", snapshot.Path)
+    return snapshot.Path, func() {
+        if err := snapshot.Release(); err != nil {
+            slog.Warn("Failed to remove filesystem snapshot", "site", siteName, "error", err)
+        }
+    }
+}
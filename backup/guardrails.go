@@ -0,0 +1,75 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/catalog"
+)
+
+// loadPollInterval is how often the load of a busy server is checked again
+const loadPollInterval = 30 * time.Second
+
+// waitForLoad waits until the load average per CPU of the server is at most
+// MaxLoad, at most LoadWait, and returns a capacity error skipping the site
+// if it stays above. A load that can't be read doesn't hold up the site.
+func (sb *SSHBackup) waitForLoad(ctx context.Context, siteName string) error {
+    if sb.config.MaxLoad <= 0 {
+        return nil
+    }
+    deadline := time.Now().Add(sb.config.LoadWait)
+    for {
+        load, err := sb.remoteLoad(ctx)
+        if err != nil {
+            sb.log.Warn("Unable to check the load of the remote server", "site", siteName, "error", err)
+            return nil
+        }
+        if load <= sb.config.MaxLoad {
+            return nil
+        }
+        wait := time.Until(deadline)
+        if wait <= 0 {
+            return stepError(catalog.CategoryCapacity, fmt.Errorf("skipped, the load of the remote server stayed at %.2f per CPU, above max_load %g, for %s",
+                load, sb.config.MaxLoad, sb.config.LoadWait))
+        }
+        if wait > loadPollInterval {
+            wait = loadPollInterval
+        }
+        sb.log.Info("Remote server busy, deferring site", "site", siteName, "load_per_cpu", fmt.Sprintf("%.2f", load),
+            "max_load", sb.config.MaxLoad, "retry_in", wait.Round(time.Second))
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return contextError(ctx, nil)
+        case <-sb.config.Stop:
+            timer.Stop()
+            return stepError(catalog.CategoryCapacity, fmt.Errorf("skipped, the run was stopped while the remote server was busy"))
+        case <-timer.C:
+        }
+    }
+}
+
+// remoteLoad returns the 1-minute load average of the server divided by its
+// number of CPUs
+func (sb *SSHBackup) remoteLoad(ctx context.Context) (float64, error) {
+    output, err := sb.execute(ctx, "cat /proc/loadavg && getconf _NPROCESSORS_ONLN", sb.commandTimeout)
+    if err != nil {
+        return 0, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+    }
+    fields := strings.Fields(string(output))
+    if len(fields) < 6 {
+        return 0, fmt.Errorf("unexpected output %q", strings.TrimSpace(string(output)))
+    }
+    load, err := strconv.ParseFloat(fields[0], 64)
+    if err != nil {
+        return 0, fmt.Errorf("unexpected load average %q", fields[0])
+    }
+    cpus, err := strconv.Atoi(fields[len(fields)-1])
+    if err != nil || cpus < 1 {
+        return 0, fmt.Errorf("unexpected number of CPUs %q", fields[len(fields)-1])
+    }
+    return load / float64(cpus), nil
+}
@@ -0,0 +1,33 @@
+package backup
+
+import (
+    "context"
+    "log/slog"
+    "time"
+    "laravel-backup-tool/healthcheck"
+)
+
+// PingStart reports the start of a site's backup to its health check, if it
+// has one. A failed ping is logged and doesn't affect the backup.
+func (bm *BackupManager) PingStart(ctx context.Context, site string) {
+    url := bm.Healthchecks.For(site)
+    if url == "" {
+        return
+    }
+    if err := healthcheck.Ping(ctx, bm.Retry, url, healthcheck.Start, "Backup of "+site+" started\n"); err != nil {
+        slog.Warn("Health check ping failed", "site", site, "event", healthcheck.Start, "error", err)
+    }
+}
+
+// PingFinish reports the outcome of a site's backup that started at started
+// to its health check, if it has one, even when the run was cancelled
+func (bm *BackupManager) PingFinish(ctx context.Context, site string, started time.Time, failures []string) {
+    url := bm.Healthchecks.For(site)
+    if url == "" {
+        return
+    }
+    ctx = context.WithoutCancel(ctx)
+    if err := healthcheck.Finish(ctx, bm.Retry, url, "Backup of "+site, time.Since(started), failures); err != nil {
+        slog.Warn("Health check ping failed", "site", site, "error", err)
+    }
+}
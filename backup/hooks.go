@@ -0,0 +1,107 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/logging"
+)
+
+// HookEnv describes a backup to a hook command, which gets it as BACKUP_*
+// environment variables
+type HookEnv struct {
+    Event        string
+    Site         string
+    DocumentRoot string
+    // "local" or "remote", and the remote server's host
+    Source string
+    Server string
+    // Directory the site's backups are stored in
+    BackupDir string
+    // Archive and dump created by the backup, known to hooks after it
+    FilesArchive string
+    DatabaseDump string
+    // "success" or "failed" after the backup, with the first error
+    Status string
+    Error  string
+}
+
+// Environ returns the environment variables describing the backup
+func (e HookEnv) Environ() []string {
+    return []string{
+        "BACKUP_HOOK=" + e.Event,
+        "BACKUP_SITE=" + e.Site,
+        "BACKUP_DOCUMENT_ROOT=" + e.DocumentRoot,
+        "BACKUP_SOURCE=" + e.Source,
+        "BACKUP_SERVER=" + e.Server,
+        "BACKUP_DIR=" + e.BackupDir,
+        "BACKUP_FILES_ARCHIVE=" + e.FilesArchive,
+        "BACKUP_DB_DUMP=" + e.DatabaseDump,
+        "BACKUP_STATUS=" + e.Status,
+        "BACKUP_ERROR=" + logging.Redact(e.Error),
+    }
+}
+
+// RunHook runs a hook command with sh on this machine. Hooks of a site run
+// in the root of its Laravel application, or in its document root. The
+// command is killed when it runs longer than timeout.
+func RunHook(ctx context.Context, command string, env HookEnv, timeout time.Duration) error {
+    if command == "" {
+        return nil
+    }
+    // Run hooks have no site and run in the working directory
+    dir := env.DocumentRoot
+    if root, ok := config.FindLaravelApp(dir); ok && dir != "" {
+        dir = root
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    cmd := shellCommand(ctx, command)
+    cmd.Dir = dir
+    cmd.Env = append(os.Environ(), env.Environ()...)
+    // Background processes holding the output open don't keep the hook running
+    cmd.WaitDelay = 10 * time.Second
+
+    slog.Info("Running hook", "hook", env.Event, "site", env.Site)
+    output, err := cmd.CombinedOutput()
+    if ctx.Err() == context.DeadlineExceeded {
+        err = fmt.Errorf("timed out after %s and was killed", timeout)
+    }
+    return hookResult(env, output, err)
+}
+
+// runHook runs a hook command of a remote site on the remote server, in the
+// root of its Laravel application or in its document root
+func (sb *SSHBackup) runHook(ctx context.Context, command string, env HookEnv) error {
+    if command == "" {
+        return nil
+    }
+    var vars []string
+    for _, v := range env.Environ() {
+        name, value, _ := strings.Cut(v, "=")
+        vars = append(vars, name+"="+shellQuote(value))
+    }
+    cmd := fmt.Sprintf("cd %s && if [ ! -f artisan ] && [ -f ../artisan ]; then cd ..; fi && env %s sh -c %s",
+        shellQuote(env.DocumentRoot), strings.Join(vars, " "), shellQuote(command))
+
+    sb.log.Info("Running hook", "hook", env.Event, "site", env.Site)
+    output, err := sb.execute(ctx, cmd, sb.manager.Hooks.Timeout)
+    return hookResult(env, output, err)
+}
+
+// hookResult logs the output of a hook and describes its failure
+func hookResult(env HookEnv, output []byte, err error) error {
+    text := strings.TrimSpace(string(output))
+    if text != "" {
+        slog.Debug("Hook output", "hook", env.Event, "site", env.Site, "output", text)
+    }
+    if err != nil {
+        return fmt.Errorf("%s hook failed: %v, output: %s", env.Event, err, text)
+    }
+    return nil
+}
@@ -0,0 +1,130 @@
+package backup
+
+import (
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
+    "os"
+    "path/filepath"
+    "time"
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHostsPath returns the known_hosts file to use, ~/.ssh/known_hosts if
+// none is configured
+func KnownHostsPath(file string) (string, error) {
+    if file != "" {
+        return file, nil
+    }
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("unable to locate known_hosts, set SSH_KNOWN_HOSTS: %v", err)
+    }
+    return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// hostKeyCallback verifies server host keys against the known_hosts file of
+// the configuration. Without strict checking any host key is accepted.
+func hostKeyCallback(config *SSHConfig) (ssh.HostKeyCallback, error) {
+    if config.InsecureHostKey {
+        slog.Warn("Host key checking is disabled, the connection is not protected against interception", "host", config.Host)
+        return ssh.InsecureIgnoreHostKey(), nil
+    }
+
+    path, err := KnownHostsPath(config.KnownHostsFile)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+        return nil, fmt.Errorf("known_hosts file %s does not exist, record the server's host key with: laravel-backup-tool trust-host", path)
+    }
+    callback, err := knownhosts.New(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read known_hosts %s: %v", path, err)
+    }
+    return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+        err := callback(hostname, remote, key)
+        var keyErr *knownhosts.KeyError
+        if errors.As(err, &keyErr) {
+            if len(keyErr.Want) == 0 {
+                return fmt.Errorf("host key of %s is not in %s (%s %s), verify it and record it with: laravel-backup-tool trust-host",
+                    hostname, path, key.Type(), ssh.FingerprintSHA256(key))
+            }
+            return fmt.Errorf("HOST KEY MISMATCH for %s: server presented %s %s but %s:%d records a different key, someone may be intercepting the connection",
+                hostname, key.Type(), ssh.FingerprintSHA256(key), keyErr.Want[0].Filename, keyErr.Want[0].Line)
+        }
+        return err
+    }, nil
+}
+
+// FetchHostKey connects to a server just far enough to receive its host key
+func FetchHostKey(host, port string) (ssh.PublicKey, error) {
+    var hostKey ssh.PublicKey
+    errGotKey := errors.New("host key received")
+    client, err := ssh.Dial("tcp", net.JoinHostPort(host, port), &ssh.ClientConfig{
+        HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+            hostKey = key
+            return errGotKey
+        },
+        Timeout: 30 * time.Second,
+    })
+    if client != nil {
+        client.Close()
+    }
+    if hostKey == nil {
+        return nil, fmt.Errorf("unable to get host key of %s:%s: %v", host, port, err)
+    }
+    return hostKey, nil
+}
+
+// KnownHostKey checks a host key against a known_hosts file. It returns
+// false if the host is not in the file and an error if the file records a
+// different key.
+func KnownHostKey(path, host, port string, key ssh.PublicKey) (bool, error) {
+    if _, err := os.Stat(path); os.IsNotExist(err) {
+        return false, nil
+    }
+    callback, err := knownhosts.New(path)
+    if err != nil {
+        return false, fmt.Errorf("unable to read known_hosts %s: %v", path, err)
+    }
+    address := net.JoinHostPort(host, port)
+    // The remote address is only used for hashed entries of IP addresses
+    remote, _ := net.ResolveTCPAddr("tcp", address)
+    if remote == nil {
+        remote = &net.TCPAddr{}
+    }
+    err = callback(address, remote, key)
+    var keyErr *knownhosts.KeyError
+    switch {
+    case err == nil:
+        return true, nil
+    case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+        return false, nil
+    case errors.As(err, &keyErr):
+        return false, fmt.Errorf("%s:%d records a different key for %s, remove it first if the server's key was changed on purpose",
+            keyErr.Want[0].Filename, keyErr.Want[0].Line, address)
+    default:
+        return false, err
+    }
+}
+
+// TrustHostKey appends a host key to a known_hosts file, creating the file
+// if needed
+func TrustHostKey(path, host, port string, key ssh.PublicKey) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return fmt.Errorf("failed to create directory of %s: %v", path, err)
+    }
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", path, err)
+    }
+    line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, port))}, key)
+    if _, err := fmt.Fprintln(f, line); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to write %s: %v", path, err)
+    }
+    return f.Close()
+}
@@ -0,0 +1,53 @@
+package backup
+
+import (
+    "log/slog"
+    "os"
+    "time"
+)
+
+// locked reports whether an archive is still within the lock window of
+// immutable backups, so it may only be removed once deletion is unlocked
+func (bm *BackupManager) locked(path string) bool {
+    if bm.LockDays <= 0 || bm.Unlocked {
+        return false
+    }
+    return time.Now().Before(archiveTime(path).AddDate(0, 0, bm.LockDays))
+}
+
+// splitLocked separates the archives rotation would remove into those it
+// may remove and those still locked. The archives a locked incremental
+// archive builds on are locked with it.
+func (bm *BackupManager) splitLocked(paths []string) (removable, locked []string) {
+    sorted := append([]string(nil), paths...)
+    sortNewestFirst(sorted)
+    keep := make(map[string]bool)
+    for _, path := range sorted {
+        if bm.locked(path) {
+            keep[path] = true
+        }
+    }
+    keepChains(sorted, keep)
+    for _, path := range paths {
+        if keep[path] {
+            locked = append(locked, path)
+        } else {
+            removable = append(removable, path)
+        }
+    }
+    return removable, locked
+}
+
+// protectArchive makes the files of a new archive read-only while backups
+// are immutable. Snapshots are left as they are, their files are shared
+// with other snapshots.
+func (bm *BackupManager) protectArchive(path string) {
+    if bm.LockDays <= 0 || IsSnapshot(path) {
+        return
+    }
+    for _, file := range archiveFiles(path) {
+        if err := os.Chmod(file, 0444); err != nil {
+            slog.Warn("Failed to make archive read-only", "path", file, "error", err)
+        }
+    }
+}
@@ -0,0 +1,223 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "time"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/storage"
+)
+
+// ColdMove is the outcome of moving old archives to cold storage
+type ColdMove struct {
+    Moved int
+    Size  ByteSize
+    // Archives that could not be moved, with the reason
+    Failed []string
+}
+
+// MoveColdArchives moves the archives older than the lifecycle's number of
+// days to the cold storage. An archive is only moved once its checksum
+// verified; its catalog entry is kept and marked cold, and the local copy
+// is removed once the upload succeeded. Snapshots and deduplicated archives
+// share their data with newer ones, and binary logs are replayed from disk,
+// so they stay. An archive fetched back for a restore is not uploaded again.
+func (bm *BackupManager) MoveColdArchives(ctx context.Context) (*ColdMove, error) {
+    result := &ColdMove{}
+    if !bm.Lifecycle.Enabled() || bm.ColdStorage == nil {
+        return result, nil
+    }
+    archives, err := ListArchives(bm.BaseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list archives: %v", err)
+    }
+    cutoff := time.Now().AddDate(0, 0, -bm.Lifecycle.MoveAfterDays)
+    for _, a := range archives {
+        if err := ctx.Err(); err != nil {
+            return result, err
+        }
+        if !a.Time.Before(cutoff) || a.Type == BinlogArchiveType || NeedsReassembly(a.Path) {
+            continue
+        }
+        if err := bm.moveCold(a); err != nil {
+            slog.Warn("Failed to move archive to cold storage", "path", a.Path, "error", err)
+            result.Failed = append(result.Failed, fmt.Sprintf("%s: %v", a.Path, err))
+            continue
+        }
+        result.Moved++
+        result.Size += ByteSize(a.Size)
+    }
+    return result, nil
+}
+
+// moveCold uploads an archive to the cold storage in the lifecycle's storage
+// class, marks its catalog entry cold and removes the local copy
+func (bm *BackupManager) moveCold(a Archive) error {
+    entry, ok := bm.Catalog.Find(a.Path)
+    if !ok {
+        return fmt.Errorf("not in the catalog, run reconcile first")
+    }
+    if _, err := VerifyChecksum(a.Path); err != nil {
+        return err
+    }
+    key, err := bm.uploadKey(a.Path)
+    if err != nil {
+        return err
+    }
+    class := bm.Lifecycle.StorageClass
+    location := bm.ColdStorage.Location(key)
+    if entry.Location != location || entry.StorageClass != class {
+        metadata := map[string]string{"sha256": entry.Checksum}
+        signature, err := ChecksumSignature(entry.Checksum, filepath.Base(a.Path))
+        if err != nil {
+            return err
+        }
+        if signature != "" {
+            metadata["signature"] = signature
+        }
+        slog.Info("Moving archive to cold storage", "path", a.Path, "location", location, "storage_class", class)
+        if err := putArchive(bm.ColdStorage, key, a.Path, metadata); err != nil {
+            return err
+        }
+    }
+    if err := bm.Catalog.SetCold(a.Path, true, location, class); err != nil {
+        return err
+    }
+    if err := bm.removeArchiveFiles(a.Path); err != nil {
+        return err
+    }
+    pruneArchiveDirs(archiveSiteDir(a.Path), filepath.Dir(a.Path))
+    return nil
+}
+
+// FetchColdArchives fetches the archives a restore of a site's archive of a
+// type needs back from cold storage: the archive made at timestamp (in
+// TimestampFormat), or the newest for "latest", and for an incremental
+// archive those back to the full one it builds on. Fetched archives are
+// checked against their recorded checksums and returned; they stay in the
+// backup directory until the lifecycle moves them again.
+func (bm *BackupManager) FetchColdArchives(site, archiveType, timestamp string) ([]string, error) {
+    var entries []catalog.Entry
+    target := -1
+    for _, e := range bm.Catalog.Entries() {
+        if e.Site != site || e.Type != archiveType || e.Pushed {
+            continue
+        }
+        entries = append(entries, e)
+        if timestamp == "latest" || e.Time.Format(TimestampFormat) == timestamp {
+            target = len(entries) - 1
+        }
+    }
+    if target < 0 {
+        return nil, nil
+    }
+
+    var fetched []string
+    for i := target; i >= 0; i-- {
+        e := entries[i]
+        if e.Cold {
+            if err := bm.fetchCold(e); err != nil {
+                return fetched, err
+            }
+            fetched = append(fetched, e.Path)
+        }
+        if !IsIncremental(e.Path) {
+            break
+        }
+    }
+    return fetched, nil
+}
+
+// fetchCold downloads a cold archive to its path, verifies it and records
+// its checksum next to it again
+func (bm *BackupManager) fetchCold(e catalog.Entry) error {
+    fetcher, ok := bm.ColdStorage.(storage.Fetcher)
+    if !ok {
+        return fmt.Errorf("%s was moved to %s, but the lifecycle storage is not configured", e.Path, e.Location)
+    }
+    key, err := bm.uploadKey(e.Path)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(e.Path), 0755); err != nil {
+        return fmt.Errorf("failed to create backup directory: %v", err)
+    }
+    slog.Info("Fetching archive from cold storage", "path", e.Path, "location", e.Location)
+    // Parts of a split archive are fetched into place and removed again
+    // if the archive they make up doesn't match
+    partial := e.Path + ".fetch"
+    if e.Parts > 0 {
+        partial = e.Path
+    } else {
+        defer os.Remove(partial)
+    }
+    if err := getArchive(fetcher, key, partial, e.Parts); err != nil {
+        bm.removeFetchedParts(e)
+        return err
+    }
+    sum, err := FileChecksum(partial)
+    if err != nil {
+        bm.removeFetchedParts(e)
+        return fmt.Errorf("failed to compute checksum: %v", err)
+    }
+    if sum != e.Checksum {
+        bm.removeFetchedParts(e)
+        return fmt.Errorf("checksum mismatch of %s fetched from %s: recorded %s, actual %s", filepath.Base(e.Path), e.Location, e.Checksum, sum)
+    }
+    if partial != e.Path {
+        if err := os.Rename(partial, e.Path); err != nil {
+            return fmt.Errorf("failed to move fetched archive into place: %v", err)
+        }
+    }
+    if _, err := WriteChecksum(e.Path); err != nil {
+        return err
+    }
+    return bm.Catalog.SetCold(e.Path, false, e.Location, e.StorageClass)
+}
+
+// coldArchivePaths returns the archives of a type of a site that were moved
+// to cold storage
+func (bm *BackupManager) coldArchivePaths(siteName, archiveType string) []string {
+    var paths []string
+    for _, e := range bm.Catalog.Entries() {
+        if e.Cold && e.Site == siteName && e.Type == archiveType {
+            paths = append(paths, e.Path)
+        }
+    }
+    return paths
+}
+
+// removeColdArchive deletes an archive rotated out of cold storage from it
+// and from the catalog. Buckets leave deleting to their lifecycle rules, so
+// only the catalog entry is removed there.
+func (bm *BackupManager) removeColdArchive(path string) error {
+    if deleter, ok := bm.ColdStorage.(storage.Deleter); ok {
+        key, err := bm.uploadKey(path)
+        if err != nil {
+            return err
+        }
+        parts := 0
+        if entry, ok := bm.Catalog.Find(path); ok {
+            parts = entry.Parts
+        }
+        if err := deleteArchive(deleter, key, parts); err != nil {
+            return err
+        }
+    }
+    return bm.Catalog.Remove(path)
+}
+
+// removeFetchedParts removes the parts of a split cold archive whose fetch
+// failed
+func (bm *BackupManager) removeFetchedParts(e catalog.Entry) {
+    if e.Parts == 0 {
+        return
+    }
+    for n := 1; n <= e.Parts; n++ {
+        os.Remove(partPath(e.Path, n))
+    }
+    os.Remove(e.Path + PartsExt)
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "laravel-backup-tool/filelock"
+)
+
+// RunLockFileName is the file in a backup base directory locked while a run
+// writes to it
+const RunLockFileName = "run.lock"
+
+// LocksDirName is the directory in a backup base directory with the locks of
+// the sites
+const LocksDirName = "_locks"
+
+// sitesLockFileName is the lock in LocksDirName that runs of single sites
+// share and that commands needing the whole backup directory take exclusively
+const sitesLockFileName = "sites.lock"
+
+// RunLock is a lock preventing backup runs from overlapping
+type RunLock struct {
+    locks []*filelock.Lock
+}
+
+// LockRun takes the run lock of a backup directory without waiting. If
+// another process holds it, an error naming that process is returned. The
+// lock is released by Unlock or when the process exits, even if it crashes.
+func LockRun(baseDir string) (*RunLock, error) {
+    return WaitRun(context.Background(), baseDir, 0)
+}
+
+// WaitRun takes the run lock of a backup directory, waiting up to wait
+// (filelock.Forever to wait indefinitely) for a run holding it to finish
+func WaitRun(ctx context.Context, baseDir string, wait time.Duration) (*RunLock, error) {
+    if err := os.MkdirAll(baseDir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create backup directory: %v", err)
+    }
+    lock, err := acquire(ctx, filepath.Join(baseDir, RunLockFileName), true, wait, "the running backup")
+    if err != nil {
+        return nil, lockError("another backup run is in progress", err)
+    }
+    warnStale(lock, "run")
+    return &RunLock{locks: []*filelock.Lock{lock}}, nil
+}
+
+// LockAllSites takes the run lock and excludes runs of single sites as well,
+// for commands that must not run alongside any backup, like pruning chunks
+func LockAllSites(ctx context.Context, baseDir string, wait time.Duration) (*RunLock, error) {
+    l, err := WaitRun(ctx, baseDir, wait)
+    if err != nil {
+        return nil, err
+    }
+    dir, err := locksDir(baseDir)
+    if err != nil {
+        l.Unlock()
+        return nil, err
+    }
+    lock, err := acquire(ctx, filepath.Join(dir, sitesLockFileName), true, wait, "the running backups of single sites")
+    if err != nil {
+        l.Unlock()
+        return nil, lockError("a backup of single sites is in progress", err)
+    }
+    l.locks = append(l.locks, lock)
+    return l, nil
+}
+
+// LockSites takes the locks of sites for a run backing up only them. Such
+// runs don't take the run lock, so they can run alongside a full run or
+// each other as long as they back up different sites; the jobs of other
+// runs wait for the site locks (see LockSiteJob).
+func LockSites(ctx context.Context, baseDir string, sites []string, wait time.Duration) (*RunLock, error) {
+    dir, err := locksDir(baseDir)
+    if err != nil {
+        return nil, err
+    }
+    lock, err := acquire(ctx, filepath.Join(dir, sitesLockFileName), false, wait, "the running command")
+    if err != nil {
+        return nil, lockError("a command needing the whole backup directory is running", err)
+    }
+    l := &RunLock{locks: []*filelock.Lock{lock}}
+    for _, site := range sites {
+        lock, err := acquire(ctx, filepath.Join(dir, siteLockFileName(site)), true, wait, "the running backup of "+site)
+        if err != nil {
+            l.Unlock()
+            return nil, lockError("a backup of "+site+" is in progress", err)
+        }
+        warnStale(lock, "backup of "+site)
+        l.locks = append(l.locks, lock)
+    }
+    return l, nil
+}
+
+// LockSiteJob takes the lock of a site for a job of a run holding the run
+// lock, waiting while a run of the site holds it. Jobs of the same run share
+// the lock. Applications are locked with their site.
+func LockSiteJob(ctx context.Context, baseDir, site string) (*RunLock, error) {
+    parent, _ := SplitAppKey(site)
+    dir, err := locksDir(baseDir)
+    if err != nil {
+        return nil, err
+    }
+    lock, err := acquire(ctx, filepath.Join(dir, siteLockFileName(parent)), false, filelock.Forever, "the running backup of "+parent)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock %s: %v", parent, err)
+    }
+    return &RunLock{locks: []*filelock.Lock{lock}}, nil
+}
+
+// locksDir returns the locks directory of a backup directory, creating it
+// if needed
+func locksDir(baseDir string) (string, error) {
+    dir := filepath.Join(baseDir, LocksDirName)
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", fmt.Errorf("failed to create locks directory: %v", err)
+    }
+    return dir, nil
+}
+
+// acquire takes a lock, logging once if it waits for the holder
+func acquire(ctx context.Context, path string, exclusive bool, wait time.Duration, holder string) (*filelock.Lock, error) {
+    lock, err := filelock.Acquire(ctx, path, exclusive, 0)
+    if err == nil || wait == 0 || !errors.Is(err, filelock.ErrBusy) {
+        return lock, err
+    }
+    slog.Info("Waiting for "+holder+" to finish", "lock", path)
+    return filelock.Acquire(ctx, path, exclusive, wait)
+}
+
+// siteLockFileName returns the name of a site's lock file
+func siteLockFileName(site string) string {
+    return "site_" + strings.ReplaceAll(site, "/", "_") + ".lock"
+}
+
+// warnStale logs that the previous holder of a lock ended without releasing it
+func warnStale(lock *filelock.Lock, what string) {
+    if lock.Stale != 0 {
+        slog.Warn("Previous "+what+" ended without releasing its lock, it may have crashed", "pid", lock.Stale)
+    }
+}
+
+// lockError describes a failure to take a lock, naming the holder if the
+// lock is busy
+func lockError(busy string, err error) error {
+    var busyErr *filelock.BusyError
+    if errors.As(err, &busyErr) {
+        return fmt.Errorf("%s (%v)", busy, busyErr)
+    }
+    return err
+}
+
+// Unlock releases the locks
+func (l *RunLock) Unlock() error {
+    var err error
+    for i := len(l.locks) - 1; i >= 0; i-- {
+        if unlockErr := l.locks[i].Unlock(); err == nil {
+            err = unlockErr
+        }
+    }
+    return err
+}
@@ -2,12 +2,19 @@ package backup
 
 import (
     "fmt"
+    "io"
+    "log/slog"
     "os"
     "path/filepath"
     "sort"
     "strings"
     "strconv"
     "time"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/retry"
+    "laravel-backup-tool/storage"
 )
 
 const (
@@ -15,13 +22,80 @@ const (
     DefaultMaxFileBackups = 5
     // Default maximum number of database backups to keep per site
     DefaultMaxDBBackups   = 20
+    // Default number of file backups after which a full one is made again
+    DefaultFullEvery      = 7
 )
 
+// DefaultExcludes are left out of file archives unless configured otherwise
+var DefaultExcludes = []string{"node_modules"}
+
 // BackupManager handles backup operations and rotation
 type BackupManager struct {
     BaseDir string
     MaxFileBackups int
     MaxDBBackups int
+    // Patterns selecting the files of file archives, and those of single
+    // sites added to them, see config.FilePatterns
+    Files config.FilePatterns
+    SiteFiles config.SiteFilePatterns
+    // Whether file backups only archive what changed since the previous one
+    Incremental bool
+    // Whether file archives are stored as chunks in the directory's chunk store
+    Dedup bool
+    // Number of file backups after which a full one is made again
+    FullEvery int
+    Catalog *catalog.Catalog
+    Budgets *Budgets
+    // Whether the files of sites over their maximum size are backed up anyway
+    AllowLarge bool
+    Usage *UsageLedger
+    // Space left free on the backup volume besides new archives
+    MinFreeSpace ByteSize
+    // Size of the parts archives larger than it are split into, zero to
+    // keep every archive in one file
+    SplitSize ByteSize
+    // Days archives can't be removed for after they were made, zero if
+    // backups aren't immutable, and whether deletion was unlocked with the
+    // deletion key
+    LockDays int
+    Unlocked bool
+    // Optional off-server storage every new archive is copied to
+    Uploader storage.Uploader
+    // Grandfather-father-son retention replacing the maximum counts where set
+    Retention config.Retention
+    // When old archives are moved to ColdStorage, and in which storage class
+    Lifecycle config.LifecycleConfig
+    ColdStorage storage.Uploader
+    // How often the files and databases of sites are backed up, and when not
+    Frequency config.FrequencyConfig
+    // Time limits of the files and database backups of sites
+    Timeouts config.TimeoutsConfig
+    // Compression of new archives and dumps, by site
+    Compression config.CompressionConfig
+    // Commands run before and after the backups of sites
+    Hooks config.HooksConfig
+    // Health checks pinged at the start and end of the backups of sites
+    Healthchecks config.HealthchecksConfig
+    // Sites whose Redis and MongoDB data is dumped besides their database
+    Datastores config.DatastoresConfig
+    // SSH servers through which the databases of sites are reached
+    DBTunnels config.DBTunnelConfig
+    // Sites whose files are archived from a filesystem snapshot
+    FSSnapshots config.FSSnapshotConfig
+    // Discovery and backup of sites running in Docker containers
+    Docker config.DockerConfig
+    // Options of mysqldump, by site
+    MySQLDump config.MySQLDumpConfig
+    // Sites whose databases are backed up as full dumps and binary logs
+    Binlogs config.BinlogConfig
+    // Sites whose databases are backed up physically with mariabackup or
+    // xtrabackup
+    Physical config.PhysicalBackupConfig
+    // How dumps and uploads failing with transient errors are retried
+    Retry retry.Policy
+    // Keys for reading encrypted archives, and for encrypting new ones with Encrypt
+    Keyring *encryption.Keyring
+    Encrypt bool
 }
 
 // NewBackupManager creates a new backup manager instance
@@ -35,23 +109,49 @@ func NewBackupManager(baseDir string) (*BackupManager, error) {
     var maxFiles, maxDB int
     if strings.Contains(baseDir, "-ssh") {
         // Remote backup settings
-        maxFiles = getEnvInt("REMOTE_MAX_FILE_BACKUPS", DefaultMaxFileBackups)
-        maxDB = getEnvInt("REMOTE_MAX_DB_BACKUPS", DefaultMaxDBBackups)
+        maxFiles = GetEnvInt("REMOTE_MAX_FILE_BACKUPS", DefaultMaxFileBackups)
+        maxDB = GetEnvInt("REMOTE_MAX_DB_BACKUPS", DefaultMaxDBBackups)
     } else {
         // Local backup settings
-        maxFiles = getEnvInt("LOCAL_MAX_FILE_BACKUPS", DefaultMaxFileBackups)
-        maxDB = getEnvInt("LOCAL_MAX_DB_BACKUPS", DefaultMaxDBBackups)
+        maxFiles = GetEnvInt("LOCAL_MAX_FILE_BACKUPS", DefaultMaxFileBackups)
+        maxDB = GetEnvInt("LOCAL_MAX_DB_BACKUPS", DefaultMaxDBBackups)
+    }
+
+    // Open the index of existing backups
+    cat, err := catalog.Open(baseDir)
+    if err != nil {
+        return nil, err
+    }
+
+    // Per-site daily budgets and what has been consumed so far
+    budgets, err := LoadBudgets()
+    if err != nil {
+        return nil, err
+    }
+    usage, err := OpenUsage(baseDir)
+    if err != nil {
+        return nil, err
     }
 
     return &BackupManager{
         BaseDir: baseDir,
         MaxFileBackups: maxFiles,
         MaxDBBackups: maxDB,
+        Files: config.FilePatterns{Excludes: DefaultExcludes},
+        FullEvery: DefaultFullEvery,
+        Compression: config.CompressionConfig{
+            Compression: config.Compression{Format: config.CompressionGzip},
+        },
+        Hooks: config.HooksConfig{Timeout: config.DefaultHookTimeout},
+        Retry: retry.Default(),
+        Catalog: cat,
+        Budgets: budgets,
+        Usage: usage,
     }, nil
 }
 
-// getEnvInt gets an integer value from environment with default
-func getEnvInt(key string, defaultVal int) int {
+// GetEnvInt gets an integer value from environment with default
+func GetEnvInt(key string, defaultVal int) int {
     if val := os.Getenv(key); val != "" {
         if i, err := strconv.Atoi(val); err == nil {
             return i
@@ -60,6 +160,21 @@ func getEnvInt(key string, defaultVal int) int {
     return defaultVal
 }
 
+// GetEnvDuration gets a duration value such as "90s" or "2h" from environment with default
+func GetEnvDuration(key string, defaultVal time.Duration) time.Duration {
+    if val := os.Getenv(key); val != "" {
+        if d, err := time.ParseDuration(val); err == nil {
+            return d
+        }
+    }
+    return defaultVal
+}
+
+// FileFilter returns the filter selecting the files archived of a site
+func (bm *BackupManager) FileFilter(siteName string) (*config.FileFilter, error) {
+    return bm.Files.Merge(bm.SiteFiles.For(siteName)).Filter()
+}
+
 // getSiteBackupDir returns the backup directory path for a specific site
 func (bm *BackupManager) getSiteBackupDir(siteName string) string {
     return filepath.Join(bm.BaseDir, siteName)
@@ -102,50 +217,450 @@ func (bm *BackupManager) getLatestBackup(siteName string) (string, error) {
     return latestPath, nil
 }
 
-// cleanOldBackups removes old backups exceeding the maximum limit
-// Uses rotation strategy: keeps most recent backups and removes the oldest ones
-func (bm *BackupManager) cleanOldBackups(siteName string, isDatabase bool) error {
-    var pattern string
-    var maxBackups int
-    
+// CleanOldBackups removes old backups exceeding the maximum limit
+// Uses rotation strategy: keeps most recent backups and removes the oldest ones.
+// Sites and types with a retention policy keep the archives the policy selects.
+func (bm *BackupManager) CleanOldBackups(siteName string, isDatabase bool) error {
     if isDatabase {
-        pattern = "db_*.sql.gz"
-        maxBackups = bm.MaxDBBackups
-    } else {
-        pattern = "files_*.tar.gz"
-        maxBackups = bm.MaxFileBackups
+        return bm.CleanOldArchives(siteName, "database")
     }
+    return bm.CleanOldArchives(siteName, "file")
+}
 
-    // Get backup directory
-    backupDir := filepath.Join(bm.BaseDir, siteName)
-    if isDatabase {
-        backupDir = filepath.Join(backupDir, "database")
+// CleanOldArchives rotates the archives of one type of a site like
+// CleanOldBackups. Dumps of data stores are rotated like database dumps but
+// apart from them.
+func (bm *BackupManager) CleanOldArchives(siteName, archiveType string) error {
+    expired, err := bm.expiredBackups(siteName, archiveType, false)
+    if err != nil {
+        return err
+    }
+
+    for _, file := range expired {
+        if err := bm.removeExpired(file); err != nil {
+            return err
+        }
+    }
+    if policy := bm.Retention.Policy(siteName, archiveType); policy.Enabled() && len(expired) > 0 {
+        slog.Info("Removed archives outside retention", "site", siteName, "removed", len(expired),
+            "policy", policy.String())
+    }
+    // Binary logs go with the full dumps they follow, and physical
+    // backups are rotated with the database's dumps
+    if archiveType == "database" {
+        if err := bm.CleanOldArchives(siteName, BinlogArchiveType); err != nil {
+            return err
+        }
+        return bm.CleanOldArchives(siteName, PhysicalArchiveType)
+    }
+    return nil
+}
+
+// removeExpired removes an archive outside retention, from cold storage if
+// it was moved there, and its off-server copy
+func (bm *BackupManager) removeExpired(file string) error {
+    entry, ok := bm.Catalog.Find(file)
+    if ok && entry.Cold {
+        if err := bm.removeColdArchive(file); err != nil {
+            return fmt.Errorf("failed to remove old backup %s from %s: %v", file, entry.Location, err)
+        }
+    } else if err := bm.removeArchive(file); err != nil {
+        return fmt.Errorf("failed to remove old backup %s: %v", file, err)
+    }
+    bm.deleteUpload(file, entry.Parts)
+    return nil
+}
+
+// ExpiringArchives returns the archives of a site that rotation removes
+// after its next file and database backups and dumps of data stores,
+// binary logs and physical backups included, oldest first
+func (bm *BackupManager) ExpiringArchives(siteName string) ([]string, error) {
+    var expiring []string
+    for _, archiveType := range []string{"file", "database", BinlogArchiveType, PhysicalArchiveType, config.DatastoreRedis, config.DatastoreMongo} {
+        expired, err := bm.expiredBackups(siteName, archiveType, true)
+        if err != nil {
+            return nil, err
+        }
+        expiring = append(expiring, expired...)
+    }
+    sort.SliceStable(expiring, func(i, j int) bool {
+        return archiveTime(expiring[i]).Before(archiveTime(expiring[j]))
+    })
+    return expiring, nil
+}
+
+// expiredBackups returns the archives of a type of a site that rotation
+// removes. With next, a full backup made now is counted as the newest
+// archive, so the result is what its rotation will remove. Archives still
+// locked are kept.
+func (bm *BackupManager) expiredBackups(siteName, archiveType string, next bool) ([]string, error) {
+    expired, err := bm.retentionExpired(siteName, archiveType, next)
+    if err != nil {
+        return nil, err
+    }
+    removable, _ := bm.splitLocked(expired)
+    return removable, nil
+}
+
+// retentionExpired returns the archives of a type of a site outside its
+// retention, whether they are locked or not
+func (bm *BackupManager) retentionExpired(siteName, archiveType string, next bool) ([]string, error) {
+    if archiveType == BinlogArchiveType {
+        return bm.expiredBinlogs(siteName, next)
+    }
+    // Only file archives and physical backups have incremental chains
+    isDatabase := archiveType != "file" && archiveType != PhysicalArchiveType
+    nextExt, maxBackups := ".tar", bm.MaxFileBackups
+    switch archiveType {
+    case "database":
+        nextExt, maxBackups = sqlDumpExt, bm.MaxDBBackups
+    case PhysicalArchiveType:
+        nextExt, maxBackups = physicalExt, bm.MaxDBBackups
+    case config.DatastoreRedis:
+        nextExt, maxBackups = redisDumpExt, bm.MaxDBBackups
+    case config.DatastoreMongo:
+        nextExt, maxBackups = mongoDumpExt, bm.MaxDBBackups
     }
 
-    // List all backups
-    matches, err := filepath.Glob(filepath.Join(backupDir, pattern))
+    // List all backups, in any compression format but without their checksum files
+    matches, err := siteArchivePaths(siteName, bm.getSiteBackupDir(siteName), archiveType)
     if err != nil {
-        return fmt.Errorf("failed to list backups: %v", err)
+        return nil, fmt.Errorf("failed to list backups: %v", err)
+    }
+    matches = append(matches, bm.coldArchivePaths(siteName, archiveType)...)
+    pending := ""
+    if next {
+        pending = archivePath(bm.BaseDir, siteName, archiveType, time.Now().Format(TimestampFormat), false, nextExt)
+        matches = append(matches, pending)
+    }
+
+    var expired []string
+    if policy := bm.Retention.Policy(siteName, archiveType); policy.Enabled() {
+        sortNewestFirst(matches)
+        keep := selectRetained(matches, policy)
+        if !isDatabase {
+            keepChains(matches, keep)
+        }
+        for _, file := range matches {
+            if !keep[file] && file != pending {
+                expired = append(expired, file)
+            }
+        }
+        return expired, nil
     }
 
     // If we don't have more than max backups, no need to clean
     if len(matches) <= maxBackups {
-        return nil
+        return nil, nil
     }
 
-    // Sort backups by modification time (newest first)
+    // Sort backups by modification time (newest first); the pending backup
+    // doesn't exist yet and is the newest, cold ones are only in the catalog
+    modTime := func(path string) time.Time {
+        info, err := os.Stat(path)
+        if path == pending {
+            return time.Now()
+        } else if err != nil {
+            return archiveTime(path)
+        }
+        return info.ModTime()
+    }
     sort.Slice(matches, func(i, j int) bool {
-        iInfo, _ := os.Stat(matches[i])
-        jInfo, _ := os.Stat(matches[j])
-        return iInfo.ModTime().After(jInfo.ModTime())
+        return modTime(matches[i]).After(modTime(matches[j]))
     })
 
-    // Remove old backups
-    for _, file := range matches[maxBackups:] {
-        if err := os.Remove(file); err != nil {
-            return fmt.Errorf("failed to remove old backup %s: %v", file, err)
+    // An incremental archive can't be restored without the archives before it,
+    // so keep them back to the last full one
+    keep := maxBackups
+    for !isDatabase && keep < len(matches) && IsIncremental(matches[keep-1]) {
+        keep++
+    }
+    return matches[keep:], nil
+}
+
+// verifyArchive fully decodes a newly created archive, so a corrupted
+// transfer or an interrupted dump is reported when it happens rather than
+// during a restore
+func (bm *BackupManager) verifyArchive(siteName, archiveType, path string) error {
+    if err := CheckArchive(Archive{Site: siteName, Type: archiveType, Path: path}, bm.Keyring); err != nil {
+        return fmt.Errorf("archive %s failed verification: %v", filepath.Base(path), err)
+    }
+    return nil
+}
+
+// registerArchive records the checksum of a newly created archive next to it
+// and adds the archive to the catalog. started is when creating the archive
+// began, zero if unknown.
+func (bm *BackupManager) registerArchive(siteName, archiveType, path string, started time.Time) error {
+    return bm.registerArchiveSum(siteName, archiveType, path, "", started)
+}
+
+// registerArchiveSum is registerArchive for an archive whose checksum was
+// computed as it was written, empty if it wasn't
+func (bm *BackupManager) registerArchiveSum(siteName, archiveType, path, sum string, started time.Time) error {
+    var err error
+    if sum == "" {
+        sum, err = WriteChecksum(path)
+    } else {
+        err = recordChecksum(path, sum)
+    }
+    if err != nil {
+        return err
+    }
+
+    info, err := os.Stat(path)
+    if err != nil {
+        return fmt.Errorf("failed to stat archive: %v", err)
+    }
+    _, t, ok := ParseArchivePath(path)
+    if !ok {
+        t = info.ModTime()
+    }
+
+    // The checksum is that of the whole archive, also once it is split
+    parts, err := bm.splitLarge(path)
+    if err != nil {
+        return err
+    }
+    bm.protectArchive(path)
+
+    // A snapshot's size is that of its files, most of which are usually
+    // shared with the previous snapshot
+    size := info.Size()
+    if IsSnapshot(path) {
+        if total, err := DirSize(path, &config.FileFilter{}); err == nil {
+            size = int64(total)
         }
     }
 
+    entry := catalog.Entry{
+        Site:     siteName,
+        Type:     archiveType,
+        Path:     path,
+        Time:     t,
+        Size:     size,
+        Checksum: sum,
+        Parts:    parts,
+    }
+    if !started.IsZero() {
+        entry.Duration = time.Since(started).Round(time.Millisecond)
+    }
+    return bm.Catalog.Add(entry)
+}
+
+// nopWriteCloser is a writer whose Close does nothing
+type nopWriteCloser struct {
+    io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encryptionWriter wraps w so that what is written to it is encrypted when
+// encryption is enabled. Closing it finishes the encrypted stream but not w.
+func (bm *BackupManager) encryptionWriter(w io.Writer) (io.WriteCloser, error) {
+    if !bm.Encrypt {
+        return nopWriteCloser{w}, nil
+    }
+    if bm.Keyring == nil {
+        return nil, fmt.Errorf("encryption is enabled but no key is configured")
+    }
+    return encryption.NewWriter(w, bm.Keyring)
+}
+
+// encryptDownloaded encrypts an archive copied from a remote server in place
+// when encryption is enabled
+func (bm *BackupManager) encryptDownloaded(path string) error {
+    if !bm.Encrypt {
+        return nil
+    }
+    if bm.Keyring == nil {
+        return fmt.Errorf("encryption is enabled but no key is configured")
+    }
+    return encryption.EncryptFile(path, bm.Keyring)
+}
+
+// UploadArchive copies an archive to the configured off-server storage and
+// returns where it was stored. The key mirrors the archive's path below the
+// base directory; the checksum and its signature are attached as metadata.
+// A split archive is uploaded as its parts and their manifest.
+func (bm *BackupManager) UploadArchive(path string) (string, error) {
+    if bm.Uploader == nil {
+        return "", nil
+    }
+    key, err := bm.uploadKey(path)
+    if err != nil {
+        return "", err
+    }
+    sum, err := ReadChecksum(path)
+    if err != nil {
+        return "", err
+    }
+
+    upload := path
+    if NeedsReassembly(path) {
+        tempDir, err := NewTempDir("upload")
+        if err != nil {
+            return "", err
+        }
+        defer os.RemoveAll(tempDir)
+        if upload, err = ReassembleArchive(path, tempDir, bm.Keyring, bm.Encrypt); err != nil {
+            return "", err
+        }
+        if sum, err = FileChecksum(upload); err != nil {
+            return "", fmt.Errorf("failed to compute checksum: %v", err)
+        }
+    }
+    // Signed like the checksum file, whose name is that of the archive
+    metadata := map[string]string{"sha256": sum}
+    signature, err := ChecksumSignature(sum, filepath.Base(path))
+    if err != nil {
+        return "", err
+    }
+    if signature != "" {
+        metadata["signature"] = signature
+    }
+    slog.Info("Uploading archive", "path", path, "location", bm.Uploader.Location(key))
+    if err := putArchive(bm.Uploader, key, upload, metadata); err != nil {
+        return "", err
+    }
+    location := bm.Uploader.Location(key)
+    if err := bm.Catalog.SetLocation(path, location); err != nil {
+        slog.Warn("Failed to record archive location", "path", path, "error", err)
+    }
+    return location, nil
+}
+
+// uploadKey returns the key an archive is uploaded under, mirroring its path
+// below the base directory. The chunk store isn't uploaded, so deduplicated
+// archives are uploaded as complete archives, like snapshots.
+func (bm *BackupManager) uploadKey(path string) (string, error) {
+    rel, err := filepath.Rel(bm.BaseDir, path)
+    if err != nil || strings.HasPrefix(rel, "..") {
+        return "", fmt.Errorf("archive %s is outside of %s", path, bm.BaseDir)
+    }
+    if NeedsReassembly(path) {
+        rel = filepath.Join(filepath.Dir(rel), reassembledName(path))
+    }
+    return storage.ObjectKey(rel), nil
+}
+
+// deleteUpload removes the off-server copy of a rotated archive from the
+// storages that support deleting. A failure is logged; the local rotation
+// goes ahead regardless. parts is the number of parts of a split archive.
+func (bm *BackupManager) deleteUpload(path string, parts int) {
+    deleter, ok := bm.Uploader.(storage.Deleter)
+    if !ok {
+        return
+    }
+    key, err := bm.uploadKey(path)
+    if err == nil {
+        err = deleteArchive(deleter, key, parts)
+    }
+    if err != nil {
+        slog.Warn("Failed to remove off-server copy", "path", path, "error", err)
+    }
+}
+
+// States of the off-server copy of an archive reported by CheckOffsite
+const (
+    OffsitePresent       = "present"
+    OffsiteMissing       = "missing"
+    OffsiteNotConfigured = "not configured"
+)
+
+// CheckOffsite looks up the off-server copy of an archive without downloading
+// it: in cold storage for an archive moved there, on the push target for a
+// pushed one and on the configured storages otherwise. It is not configured
+// if no storage that can be asked holds the copy.
+func (bm *BackupManager) CheckOffsite(path string) (string, error) {
+    entry, _ := bm.Catalog.Find(path)
+    key, err := bm.uploadKey(path)
+    if err != nil {
+        return "", err
+    }
+    store := bm.Uploader
+    switch {
+    case entry.Cold:
+        store = bm.ColdStorage
+    case entry.Pushed:
+        // Pushed with rclone from the remote server; only checked if the
+        // push target is also a configured storage
+        store = storage.Locate(bm.Uploader, key, entry.Location)
+    }
+    stater, ok := store.(storage.Stater)
+    if !ok {
+        return OffsiteNotConfigured, nil
+    }
+    if entry.Parts > 0 {
+        // Uploaded as its parts and their manifest, which comes last
+        key += PartsExt
+    }
+    exists, err := stater.StatObject(key)
+    if err != nil {
+        return "", err
+    }
+    if !exists {
+        return OffsiteMissing, nil
+    }
+    return OffsitePresent, nil
+}
+
+// removeArchive deletes an archive together with its checksum file, its
+// signature and catalog entry
+func (bm *BackupManager) removeArchive(path string) error {
+    if err := bm.removeArchiveFiles(path); err != nil {
+        return err
+    }
+    if err := bm.Catalog.Remove(path); err != nil {
+        return err
+    }
+    pruneArchiveDirs(archiveSiteDir(path), filepath.Dir(path))
     return nil
 }
+
+// removeArchiveFiles deletes an archive with its checksum file and
+// signature, keeping its catalog entry
+func (bm *BackupManager) removeArchiveFiles(path string) error {
+    remove := os.Remove
+    if IsSnapshot(path) {
+        remove = os.RemoveAll
+    }
+    for _, file := range archiveFiles(path) {
+        // Read-only files of immutable backups can't be removed on Windows
+        if !IsSnapshot(path) {
+            os.Chmod(file, 0644)
+        }
+        if err := remove(file); err != nil {
+            return err
+        }
+    }
+    for _, suffix := range []string{ChecksumSuffix, ChecksumSuffix + SignatureSuffix} {
+        if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+    }
+    return UpdateChecksumManifest(filepath.Dir(path))
+}
+
+// pruneArchiveDirs removes dir and its parents below siteDir as long as they
+// hold nothing but a checksum manifest and its signature, such as the
+// per-day directories of a layout once rotation removed their last archive
+func pruneArchiveDirs(siteDir, dir string) {
+    for dir != siteDir && strings.HasPrefix(dir, siteDir+string(filepath.Separator)) {
+        entries, err := os.ReadDir(dir)
+        if err != nil {
+            return
+        }
+        for _, entry := range entries {
+            if entry.Name() != ChecksumManifestName && entry.Name() != ChecksumManifestName+SignatureSuffix {
+                return
+            }
+        }
+        os.Remove(filepath.Join(dir, ChecksumManifestName))
+        os.Remove(filepath.Join(dir, ChecksumManifestName+SignatureSuffix))
+        if err := os.Remove(dir); err != nil {
+            return
+        }
+        dir = filepath.Dir(dir)
+    }
+}
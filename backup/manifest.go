@@ -0,0 +1,314 @@
+package backup
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+)
+
+// ManifestFileName is the file in a site's backup directory describing the
+// files as they were at the site's latest file backup
+const ManifestFileName = "manifest.json"
+
+// ManifestEntryName is the entry of an incremental archive holding the
+// manifest of the backup, written after all files
+const ManifestEntryName = ".backup-manifest.json"
+
+// ExtraPathsDir is the top-level directory of file archives holding the
+// extra paths of a site under their absolute paths, e.g.
+// .backup-extra/var/www/shared/uploads
+const ExtraPathsDir = ".backup-extra"
+
+// ManifestFile describes one file or directory of a backed up tree
+type ManifestFile struct {
+    Size    int64       `json:"size"`
+    ModTime time.Time   `json:"mtime"`
+    Mode    os.FileMode `json:"mode"`
+    SHA256  string      `json:"sha256,omitempty"`
+    // Target of a symlink archived as a link
+    Link string `json:"link,omitempty"`
+    // Resolved path of a followed symlink, archived as what it points to,
+    // or of an extra path
+    Followed string `json:"followed,omitempty"`
+}
+
+// Manifest lists every file of a site at the time of a file backup, so the
+// next backup can archive only what changed
+type Manifest struct {
+    // Name of the archive created with this manifest
+    Archive string `json:"archive"`
+    // Archive the incremental archive builds on, empty for full archives
+    Base string `json:"base,omitempty"`
+    // Number of incremental archives since the last full one
+    Chain int `json:"chain"`
+    Created time.Time `json:"created"`
+    // Files and directories by slash separated path relative to the document root
+    Files map[string]ManifestFile `json:"files"`
+}
+
+// IsIncremental reports whether an archive path names an incremental file
+// archive or physical database backup
+func IsIncremental(path string) bool {
+    a, ok := parseArchive(path)
+    return ok && (a.Type == "file" || a.Type == PhysicalArchiveType) && a.Incremental
+}
+
+// loadManifest reads the manifest of a site's latest file backup. It returns
+// nil if there is none or if the archive it describes no longer exists.
+func loadManifest(siteDir string) (*Manifest, error) {
+    data, err := os.ReadFile(filepath.Join(siteDir, ManifestFileName))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("failed to read manifest: %v", err)
+    }
+    var m Manifest
+    if err := json.Unmarshal(data, &m); err != nil {
+        return nil, fmt.Errorf("failed to parse manifest: %v", err)
+    }
+    if !archiveExists(filepath.Join(siteDir, m.Archive)) {
+        return nil, nil
+    }
+    return &m, nil
+}
+
+// save writes the manifest to a site's backup directory atomically
+func (m *Manifest) save(siteDir string) error {
+    data, err := json.Marshal(m)
+    if err != nil {
+        return fmt.Errorf("failed to encode manifest: %v", err)
+    }
+    path := filepath.Join(siteDir, ManifestFileName)
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fmt.Errorf("failed to write manifest: %v", err)
+    }
+    return os.Rename(tmp, path)
+}
+
+// scanTree lists the files, directories and symlinks below sourceDir
+// selected by filter, on the machine of the transport. Special files are
+// skipped like in archives. Checksums are left empty. Symlinks pointing
+// outside sourceDir that are archived as links are logged, as what they
+// point to is missing from the archives.
+func scanTree(ctx context.Context, t Transport, sourceDir string, filter *config.FileFilter) (map[string]ManifestFile, error) {
+    files := make(map[string]ManifestFile)
+    walk := newSelectedWalk(ctx, t, filter, func(rel string, info os.FileInfo) error {
+        entry := ManifestFile{ModTime: info.ModTime(), Mode: info.Mode()}
+        if info.Mode().IsRegular() {
+            entry.Size = info.Size()
+        }
+        if followed, ok := info.(FollowedLink); ok {
+            entry.Followed = followed.Target
+        }
+        if info.Mode()&os.ModeSymlink != 0 {
+            link, err := t.Readlink(ctx, sourcePath(sourceDir, rel))
+            if err != nil {
+                return fmt.Errorf("failed to read symlink: %v", err)
+            }
+            entry.Link = link
+        }
+        files[rel] = entry
+        return nil
+    })
+    walk.warn = true
+    walk.kept = func(rel, target string, loop bool) {
+        if loop {
+            slog.Warn("Symlink points back into the archived tree, archiving only the link", "path", rel, "target", target)
+            return
+        }
+        slog.Warn("Symlink points outside the document root, archiving only the link",
+            "path", rel, "target", target, "hint", "add the directory to follow_symlinks to archive its content")
+    }
+    err := walk.run(sourceDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to scan %s: %v", sourceDir, err)
+    }
+    return files, nil
+}
+
+// diffManifest compares the current files of a site with the manifest of the
+// previous backup. Checksums of unchanged files are carried over into current.
+// A file whose size is unchanged but whose modification time differs is hashed
+// and only counts as changed if its content differs. Without sourceDir, for
+// trees that can't be read here, such a file counts as changed.
+// It returns the changed or new paths and the number of removed paths.
+func diffManifest(previous *Manifest, current map[string]ManifestFile, sourceDir string) (map[string]bool, int, error) {
+    changed := make(map[string]bool)
+    for rel, entry := range current {
+        old, ok := previous.Files[rel]
+        switch {
+        case !ok || old.Mode.IsDir() != entry.Mode.IsDir():
+            changed[rel] = true
+        case entry.Mode.IsDir():
+            if old.Mode != entry.Mode {
+                changed[rel] = true
+            }
+        case entry.Mode&os.ModeSymlink != 0:
+            if old.Mode != entry.Mode || old.Link != entry.Link {
+                changed[rel] = true
+            }
+        case old.Size != entry.Size || old.Mode != entry.Mode:
+            changed[rel] = true
+        case !old.ModTime.Equal(entry.ModTime) && sourceDir == "":
+            changed[rel] = true
+        case !old.ModTime.Equal(entry.ModTime):
+            sum, err := hashFile(filepath.FromSlash(sourcePath(sourceDir, rel)))
+            if err != nil {
+                return nil, 0, err
+            }
+            entry.SHA256 = sum
+            current[rel] = entry
+            if sum != old.SHA256 {
+                changed[rel] = true
+            }
+        default:
+            entry.SHA256 = old.SHA256
+            current[rel] = entry
+        }
+    }
+
+    removed := 0
+    for rel := range previous.Files {
+        if _, ok := current[rel]; !ok {
+            removed++
+        }
+    }
+    return changed, removed, nil
+}
+
+// sourcePath returns the path a file archived as rel is read from, in
+// sourceDir or for an extra path where it lives
+func sourcePath(sourceDir, rel string) string {
+    if within(rel, ExtraPathsDir) {
+        p := strings.TrimPrefix(rel, ExtraPathsDir)
+        // Extra paths of sites on Windows are archived without the colon
+        // of their drive, see extraName
+        if filepath.VolumeName(sourceDir) != "" && len(p) >= 2 && (len(p) == 2 || p[2] == '/') {
+            p = p[1:2] + ":" + p[2:]
+        }
+        return p
+    }
+    return path.Join(sourceDir, rel)
+}
+
+// extraName returns the name of an extra path in file archives, below
+// ExtraPathsDir. The colon of a Windows drive is left out, as it can't be
+// part of a file name there: C:/data is archived as .backup-extra/C/data.
+func extraName(p string) string {
+    if len(p) >= 2 && p[1] == ':' {
+        p = "/" + p[:1] + p[2:]
+    }
+    return ExtraPathsDir + p
+}
+
+// hashFile returns the hex encoded SHA-256 of a file's content
+func hashFile(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", fmt.Errorf("failed to open file: %v", err)
+    }
+    defer f.Close()
+
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", fmt.Errorf("failed to hash %s: %v", path, err)
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// archiveChain returns the archives needed to restore a file archive or
+// physical database backup, oldest first: the archive itself for a full one,
+// or the preceding full archive and every incremental archive of its type up
+// to and including it.
+func archiveChain(archivePath string) ([]string, error) {
+    if !IsIncremental(archivePath) {
+        return []string{archivePath}, nil
+    }
+    archiveType, _, _ := ParseArchivePath(archivePath)
+
+    all, err := listSiteArchives("", archiveSiteDir(archivePath))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read backup directory: %v", err)
+    }
+    var archives []Archive
+    for _, a := range all {
+        if a.Type == archiveType {
+            archives = append(archives, a)
+        }
+    }
+    sort.Slice(archives, func(i, j int) bool {
+        return archives[i].Time.Before(archives[j].Time)
+    })
+
+    var chain []string
+    found := false
+    for i := len(archives) - 1; i >= 0; i-- {
+        a := archives[i]
+        if !found {
+            found = a.Path == archivePath
+            if !found {
+                continue
+            }
+        }
+        chain = append([]string{a.Path}, chain...)
+        if !IsIncremental(a.Path) {
+            return chain, nil
+        }
+    }
+    if !found {
+        return nil, fmt.Errorf("archive %s not found", archivePath)
+    }
+    return nil, fmt.Errorf("no full backup found before incremental archive %s", filepath.Base(archivePath))
+}
+
+// removeUnlisted deletes everything below dir that is not in the manifest,
+// i.e. files that were removed from the site before the last archive of a chain.
+// Directories holding listed files are kept even if they aren't listed
+// themselves, which is the case for included files of excluded directories.
+func removeUnlisted(dir string, m *Manifest) error {
+    parents := make(map[string]bool)
+    for rel := range m.Files {
+        for p := path.Dir(rel); p != "."; p = path.Dir(p) {
+            parents[p] = true
+        }
+    }
+    var stale []string
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(dir, path)
+        if err != nil || rel == "." {
+            return err
+        }
+        if _, ok := m.Files[filepath.ToSlash(rel)]; !ok && !parents[filepath.ToSlash(rel)] {
+            stale = append(stale, path)
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to scan restored files: %v", err)
+    }
+    for _, path := range stale {
+        if err := os.RemoveAll(path); err != nil {
+            return fmt.Errorf("failed to remove %s: %v", path, err)
+        }
+    }
+    return nil
+}
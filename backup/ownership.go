@@ -0,0 +1,106 @@
+package backup
+
+import (
+    "archive/tar"
+    "fmt"
+    "os"
+    "os/user"
+    "sort"
+    "strconv"
+)
+
+// entryMode returns the mode an archive entry is restored with: its
+// permissions and the setuid, setgid and sticky bits
+func entryMode(header *tar.Header) os.FileMode {
+    return header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// CanPreserveOwnership reports whether restored files can be given the
+// owners recorded in their archive, which takes root
+func CanPreserveOwnership() error {
+    if os.Geteuid() != 0 {
+        return fmt.Errorf("preserving ownership needs root")
+    }
+    return nil
+}
+
+// ownership gives restored files the owners of their archive entries. Like
+// tar run as root, it maps user and group names to the IDs they have on this
+// server and falls back to the recorded IDs for names unknown here.
+type ownership struct {
+    users  map[string]int
+    groups map[string]int
+}
+
+// newOwnership returns an empty mapping of names to IDs
+func newOwnership() *ownership {
+    return &ownership{users: make(map[string]int), groups: make(map[string]int)}
+}
+
+// ids returns the user and group ID an entry is restored with
+func (o *ownership) ids(header *tar.Header) (int, int) {
+    uid, gid := header.Uid, header.Gid
+    if header.Uname != "" {
+        id, ok := o.users[header.Uname]
+        if !ok {
+            id = -1
+            if u, err := user.Lookup(header.Uname); err == nil {
+                id, _ = strconv.Atoi(u.Uid)
+            }
+            o.users[header.Uname] = id
+        }
+        if id >= 0 {
+            uid = id
+        }
+    }
+    if header.Gname != "" {
+        id, ok := o.groups[header.Gname]
+        if !ok {
+            id = -1
+            if g, err := user.LookupGroup(header.Gname); err == nil {
+                id, _ = strconv.Atoi(g.Gid)
+            }
+            o.groups[header.Gname] = id
+        }
+        if id >= 0 {
+            gid = id
+        }
+    }
+    return uid, gid
+}
+
+// chown gives target the owner of its archive entry. Changing the owner
+// clears the setuid and setgid bits of files, so their mode is set again.
+func (o *ownership) chown(header *tar.Header, target string) error {
+    uid, gid := o.ids(header)
+    if err := os.Lchown(target, uid, gid); err != nil {
+        return fmt.Errorf("failed to set owner of %s: %v", target, err)
+    }
+    if header.Typeflag == tar.TypeReg {
+        os.Chmod(target, entryMode(header))
+    }
+    return nil
+}
+
+// restoreDirAttributes sets the mode and modification time of the
+// directories of the archives extracted, once nothing is written into them
+// anymore. The deepest directories come first, so setting a time doesn't
+// change their parent's. Directories removed or replaced since are skipped,
+// so a symlink in their place is never followed.
+func restoreDirAttributes(dirs map[string]*tar.Header) {
+    paths := make([]string, 0, len(dirs))
+    for path := range dirs {
+        paths = append(paths, path)
+    }
+    sort.Slice(paths, func(i, j int) bool {
+        return len(paths[i]) > len(paths[j])
+    })
+    for _, path := range paths {
+        if info, err := os.Lstat(path); err != nil || !info.IsDir() {
+            continue
+        }
+        header := dirs[path]
+        os.Chmod(path, entryMode(header))
+        os.Chtimes(path, header.ModTime, header.ModTime)
+    }
+}
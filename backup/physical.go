@@ -0,0 +1,353 @@
+package backup
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "time"
+    "laravel-backup-tool/encryption"
+)
+
+// PhysicalArchiveType is the archive type of physical database backups made
+// with mariabackup or xtrabackup
+const PhysicalArchiveType = "physical"
+
+// physicalExt is the extension of physical backups before compression: the
+// xbstream the backup tool writes
+const physicalExt = ".xbstream"
+
+// physicalStateName names the file in a site's backup directory recording
+// what the next incremental physical backup builds on
+const physicalStateName = "physical.json"
+
+// xbstreamMagic starts every chunk of an xbstream
+const xbstreamMagic = "XBSTCK01"
+
+// physicalState is the chain of physical backups a site's next backup
+// continues: the full backup it starts from and the latest backup, as
+// their timestamps, and the log sequence number the latest backup reached
+type physicalState struct {
+    Binary   string `json:"binary"`
+    Database string `json:"database"`
+    Base     string `json:"base"`
+    Previous string `json:"previous"`
+    ToLSN    string `json:"to_lsn"`
+}
+
+// PhysicalBinary returns the mariabackup or xtrabackup binary to run: the
+// configured one, or else the first of them installed
+func PhysicalBinary(configured string) (string, error) {
+    if configured != "" {
+        return configured, nil
+    }
+    for _, name := range []string{"mariabackup", "xtrabackup"} {
+        if _, err := exec.LookPath(name); err == nil {
+            return name, nil
+        }
+    }
+    return "", errors.New("physical database backups need mariabackup or xtrabackup, neither is installed")
+}
+
+// BackupPhysical backs up a site's MySQL or MariaDB database physically with
+// mariabackup or xtrabackup and returns the path of the new backup. A full
+// backup is made when there is none yet, it is older than the manager's
+// Physical.FullEvery or a backup of the chain was removed. Otherwise only
+// the pages changed since the previous backup are backed up.
+func (db *DBBackup) BackupPhysical(ctx context.Context, siteName, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    var path string
+    err := db.manager.Retry.Do(ctx, slog.With("site", siteName), "physical database backup", func() error {
+        var err error
+        path, err = db.backupPhysical(ctx, siteName, dbHost, dbPort, dbName, dbUser, dbPass)
+        return err
+    })
+    return path, err
+}
+
+// backupPhysical makes one attempt of BackupPhysical
+func (db *DBBackup) backupPhysical(ctx context.Context, siteName, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    bm := db.manager
+    tool, err := PhysicalBinary(bm.Physical.Binary)
+    if err != nil {
+        return "", err
+    }
+    state, err := bm.loadPhysicalState(siteName)
+    if err != nil {
+        return "", err
+    }
+    reason := ""
+    switch {
+    case state == nil:
+        reason = "no full backup yet"
+    case state.Database != dbName:
+        reason = "database changed"
+    case state.Binary != tool:
+        reason = "backup tool changed"
+    default:
+        paths, err := siteArchivePaths(siteName, bm.getSiteBackupDir(siteName), PhysicalArchiveType)
+        if err != nil {
+            return "", fmt.Errorf("failed to list backups: %v", err)
+        }
+        stamps := make(map[string]bool)
+        for _, path := range paths {
+            stamps[archiveTime(path).Format(TimestampFormat)] = true
+        }
+        baseTime, _ := time.ParseInLocation(TimestampFormat, state.Base, time.Local)
+        if !stamps[state.Base] || !stamps[state.Previous] {
+            reason = "backup of the chain removed"
+        } else if time.Since(baseTime) >= bm.Physical.FullEvery {
+            reason = "full backup older than " + bm.Physical.FullEvery.String()
+        }
+    }
+    incremental := reason == ""
+    if !incremental {
+        slog.Info("Making full physical database backup", "site", siteName, "reason", reason)
+    }
+
+    tempDir, err := NewTempDir(siteName)
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tempDir)
+    optionsFile := filepath.Join(tempDir, "backup.cnf")
+    if err := os.WriteFile(optionsFile, physicalOptions(dbPass), 0600); err != nil {
+        return "", fmt.Errorf("failed to write credentials file: %v", err)
+    }
+    lsnDir := filepath.Join(tempDir, "lsn")
+
+    // The options file must come first; the checkpoints of the backup are
+    // written to lsnDir besides the stream
+    args := []string{"--defaults-extra-file=" + optionsFile, "--backup", "--stream=xbstream",
+        "--target-dir=" + filepath.Join(tempDir, "target"), "--extra-lsndir=" + lsnDir}
+    if IsSocket(dbHost) {
+        args = append(args, "--socket="+dbHost)
+    } else {
+        args = append(args, "--host="+dbHost)
+        if dbPort != "" {
+            args = append(args, "--port="+dbPort)
+        }
+    }
+    args = append(args, "--user="+dbUser, "--databases="+dbName)
+    if incremental {
+        args = append(args, "--incremental-lsn="+state.ToLSN)
+    }
+    cmd := exec.CommandContext(ctx, tool, args...)
+    path, err := bm.storeArchiveOf(ctx, siteName, PhysicalArchiveType, physicalExt, bm.Compression.For(siteName), incremental, dumpWriter(ctx, cmd, tool))
+    if err != nil {
+        return "", err
+    }
+
+    toLSN, err := readToLSN(filepath.Join(lsnDir, "xtrabackup_checkpoints"))
+    if err != nil {
+        // The backup is fine on its own, but nothing can build on it, so
+        // the next backup is a full one
+        slog.Warn("Log sequence number of physical backup not found, the next backup is full", "site", siteName, "path", path, "error", err)
+        if err := os.Remove(filepath.Join(bm.getSiteBackupDir(siteName), physicalStateName)); err != nil && !os.IsNotExist(err) {
+            return "", fmt.Errorf("failed to remove physical backup state: %v", err)
+        }
+        return path, nil
+    }
+    _, t, _ := ParseArchivePath(path)
+    stamp := t.Format(TimestampFormat)
+    next := &physicalState{Binary: tool, Database: dbName, Base: stamp, Previous: stamp, ToLSN: toLSN}
+    if incremental {
+        next.Base = state.Base
+    }
+    if err := bm.savePhysicalState(siteName, next); err != nil {
+        return "", err
+    }
+    return path, nil
+}
+
+// physicalOptions returns the options file passing the password to
+// mariabackup or xtrabackup, which read the client group and their own
+func physicalOptions(dbPass string) []byte {
+    escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+    password := "password=\"" + escape.Replace(dbPass) + "\"\n"
+    return []byte("[client]\n" + password + "[xtrabackup]\n" + password)
+}
+
+// readToLSN reads the log sequence number a backup reached from its
+// xtrabackup_checkpoints file
+func readToLSN(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", fmt.Errorf("failed to read checkpoints: %v", err)
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        name, value, ok := strings.Cut(scanner.Text(), "=")
+        if ok && strings.TrimSpace(name) == "to_lsn" && strings.TrimSpace(value) != "" {
+            return strings.TrimSpace(value), nil
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return "", fmt.Errorf("failed to read checkpoints: %v", err)
+    }
+    return "", fmt.Errorf("no to_lsn in %s", path)
+}
+
+// loadPhysicalState reads what a site's next physical backup builds on, nil
+// if the site has no full physical backup yet
+func (bm *BackupManager) loadPhysicalState(siteName string) (*physicalState, error) {
+    data, err := os.ReadFile(filepath.Join(bm.getSiteBackupDir(siteName), physicalStateName))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read physical backup state: %v", err)
+    }
+    var state physicalState
+    if err := json.Unmarshal(data, &state); err != nil {
+        return nil, fmt.Errorf("invalid physical backup state of %s: %v", siteName, err)
+    }
+    return &state, nil
+}
+
+// savePhysicalState records what a site's next physical backup builds on
+func (bm *BackupManager) savePhysicalState(siteName string, state *physicalState) error {
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return err
+    }
+    path := filepath.Join(bm.getSiteBackupDir(siteName), physicalStateName)
+    if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+        return fmt.Errorf("failed to write physical backup state: %v", err)
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        return fmt.Errorf("failed to write physical backup state: %v", err)
+    }
+    return nil
+}
+
+// checkPhysicalBackup checks that a decompressed physical backup is an
+// xbstream that ends with the chunk closing a file, so it wasn't cut off
+func checkPhysicalBackup(r io.Reader) error {
+    header := make([]byte, len(xbstreamMagic))
+    if _, err := io.ReadFull(r, header); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return errors.New("physical backup is truncated")
+        }
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    if string(header) != xbstreamMagic {
+        return errors.New("not an xbstream")
+    }
+    tail := &tailBuffer{buf: header}
+    if _, err := io.Copy(tail, r); err != nil {
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    // The closing chunk is the magic, a flags byte, the type E and the
+    // length of the file's path followed by the path
+    buf := tail.buf
+    i := bytes.LastIndex(buf, []byte(xbstreamMagic))
+    if i < 0 || len(buf) < i+14 || buf[i+9] != 'E' || i+14+int(binary.LittleEndian.Uint32(buf[i+10:i+14])) != len(buf) {
+        return errors.New("physical backup is incomplete: end of stream not found")
+    }
+    return nil
+}
+
+// PreparePhysical extracts a physical backup, and the full and incremental
+// backups it builds on, into target and prepares it with mariabackup or
+// xtrabackup (binary), applying the incremental backups in order and
+// exporting the tablespaces for importing. target must not exist or be
+// empty.
+func PreparePhysical(archivePath, target, binary string, keys *encryption.Keyring) error {
+    chain, err := archiveChain(archivePath)
+    if err != nil {
+        return err
+    }
+    for _, path := range chain {
+        if _, err := VerifyChecksum(path); err != nil {
+            return fmt.Errorf("refusing to prepare %s: %v", path, err)
+        }
+    }
+    if entries, err := os.ReadDir(target); err == nil && len(entries) > 0 {
+        return fmt.Errorf("%s is not empty", target)
+    }
+    if err := os.MkdirAll(target, 0750); err != nil {
+        return fmt.Errorf("failed to create %s: %v", target, err)
+    }
+
+    // mariabackup streams are extracted with mbstream, xtrabackup ones
+    // with xbstream
+    mariabackup := strings.Contains(filepath.Base(binary), "mariabackup")
+    extract := "xbstream"
+    if mariabackup {
+        extract = "mbstream"
+    }
+    if dir := filepath.Dir(binary); dir != "." {
+        extract = filepath.Join(dir, extract)
+    }
+
+    // Incremental backups are extracted next to target, on the same volume
+    incrDir, err := os.MkdirTemp(filepath.Dir(filepath.Clean(target)), ".physical-incremental-")
+    if err != nil {
+        return fmt.Errorf("failed to create directory for incremental backups: %v", err)
+    }
+    defer os.RemoveAll(incrDir)
+
+    for i, path := range chain {
+        dir := target
+        if i > 0 {
+            dir = filepath.Join(incrDir, fmt.Sprint(i))
+            if err := os.Mkdir(dir, 0750); err != nil {
+                return fmt.Errorf("failed to create directory for incremental backup: %v", err)
+            }
+        }
+        slog.Info("Extracting physical backup", "archive", path, "dir", dir)
+        if err := extractPhysical(path, dir, extract, keys); err != nil {
+            return err
+        }
+
+        // xtrabackup only rolls back uncommitted transactions in the final
+        // prepare, so every incremental backup can still be applied
+        args := []string{"--prepare", "--target-dir=" + target}
+        if !mariabackup {
+            args = append(args, "--apply-log-only")
+        }
+        if i > 0 {
+            args = append(args, "--incremental-dir="+dir)
+        }
+        slog.Info("Preparing physical backup", "archive", path)
+        if err := runPhysicalTool(binary, args...); err != nil {
+            return err
+        }
+    }
+    slog.Info("Exporting tablespaces", "dir", target)
+    return runPhysicalTool(binary, "--prepare", "--export", "--target-dir="+target)
+}
+
+// extractPhysical extracts the xbstream of a physical backup into dir with
+// mbstream or xbstream (extract)
+func extractPhysical(path, dir, extract string, keys *encryption.Keyring) error {
+    ar, err := openArchive(path, keys)
+    if err != nil {
+        return err
+    }
+    defer ar.Close()
+    cmd := exec.Command(extract, "-x", "-C", dir)
+    cmd.Stdin = ar
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to run %s: %v, output: %s", extract, err, bytes.TrimSpace(output))
+    }
+    return nil
+}
+
+// runPhysicalTool runs mariabackup or xtrabackup
+func runPhysicalTool(binary string, args ...string) error {
+    if output, err := exec.Command(binary, args...).CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to run %s: %v, output: %s", binary, err, bytes.TrimSpace(output))
+    }
+    return nil
+}
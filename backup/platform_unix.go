@@ -0,0 +1,49 @@
+//go:build !windows
+
+package backup
+
+import (
+    "context"
+    "os"
+    "os/exec"
+    "syscall"
+)
+
+// shellCommand returns a command running a shell command line with sh
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+    return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// mysqlInstallDirs are directories searched for MySQL client tools missing
+// on PATH; they are always on PATH on Unix
+func mysqlInstallDirs() []string {
+    return nil
+}
+
+// killGroupOnCancel makes the cancellation of a command kill its whole
+// process group, so no child of a wrapper script outlives it
+func killGroupOnCancel(cmd *exec.Cmd) {
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+}
+
+// FreeSpace returns the space available to unprivileged users on the volume
+// holding path
+func FreeSpace(path string) (ByteSize, error) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(path, &stat); err != nil {
+        return 0, err
+    }
+    return ByteSize(int64(stat.Bavail) * int64(stat.Bsize)), nil
+}
+
+// inode returns the inode number of a file
+func inode(info os.FileInfo) (uint64, bool) {
+    st, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return 0, false
+    }
+    return uint64(st.Ino), true
+}
@@ -0,0 +1,65 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "syscall"
+    "golang.org/x/sys/windows"
+)
+
+// shellCommand returns a command running a shell command line with cmd.exe.
+// The line is passed as it is, since cmd.exe doesn't parse quotes like
+// other programs.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+    shell := os.Getenv("COMSPEC")
+    if shell == "" {
+        shell = "cmd.exe"
+    }
+    cmd := exec.CommandContext(ctx, shell)
+    cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: fmt.Sprintf(`"%s" /S /C "%s"`, shell, command)}
+    return cmd
+}
+
+// mysqlInstallDirs are the directories MySQL and MariaDB install their
+// client tools in without adding them to PATH, newest versions last
+func mysqlInstallDirs() []string {
+    var dirs []string
+    for _, root := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)")} {
+        if root == "" {
+            continue
+        }
+        for _, pattern := range []string{`MySQL\MySQL Server *\bin`, `MariaDB *\bin`} {
+            matches, _ := filepath.Glob(filepath.Join(root, pattern))
+            sort.Strings(matches)
+            dirs = append(dirs, matches...)
+        }
+    }
+    return dirs
+}
+
+// killGroupOnCancel keeps the default cancellation, killing the command
+// itself; Windows has no process groups to kill
+func killGroupOnCancel(cmd *exec.Cmd) {}
+
+// FreeSpace returns the space available to the user on the volume holding
+// path
+func FreeSpace(path string) (ByteSize, error) {
+    name, err := windows.UTF16PtrFromString(path)
+    if err != nil {
+        return 0, err
+    }
+    var available uint64
+    if err := windows.GetDiskFreeSpaceEx(name, &available, nil, nil); err != nil {
+        return 0, err
+    }
+    return ByteSize(available), nil
+}
+
+// inode returns the inode number of a file, which Windows doesn't report
+func inode(info os.FileInfo) (uint64, bool) {
+    return 0, false
+}
@@ -0,0 +1,42 @@
+package backup
+
+import (
+    "context"
+    "os"
+    "os/exec"
+)
+
+// pgDumpOptions make plain SQL dumps that can be loaded into an existing
+// database, replacing its objects, without the original roles
+var pgDumpOptions = []string{"--no-owner", "--no-privileges", "--clean", "--if-exists"}
+
+// PostgresBackup handles PostgreSQL database backups
+type PostgresBackup struct {
+    manager *BackupManager
+}
+
+// NewPostgresBackup creates a new PostgreSQL backup handler
+func NewPostgresBackup(manager *BackupManager) *PostgresBackup {
+    return &PostgresBackup{manager: manager}
+}
+
+// BackupDatabase dumps the site's database with pg_dump and returns the path
+// of the dump. The password is passed in PGPASSWORD so it doesn't show up in
+// the process list.
+func (pb *PostgresBackup) BackupDatabase(ctx context.Context, siteName, dbHost, dbPort, dbName, dbUser, dbPass string) (string, error) {
+    args := []string{"-w", "-h", dbHost, "-p", postgresPort(dbPort), "-U", dbUser}
+    args = append(args, pgDumpOptions...)
+    args = append(args, dbName)
+
+    cmd := exec.CommandContext(ctx, "pg_dump", args...)
+    cmd.Env = append(os.Environ(), "PGPASSWORD="+dbPass)
+    return pb.manager.writeDump(ctx, siteName, cmd, "pg_dump")
+}
+
+// postgresPort returns the port of a PostgreSQL server, 5432 unless set
+func postgresPort(port string) string {
+    if port == "" {
+        return "5432"
+    }
+    return port
+}
@@ -0,0 +1,42 @@
+package backup
+
+import (
+    "fmt"
+    "strings"
+    "laravel-backup-tool/config"
+)
+
+// LowerPriority lowers the CPU and IO priority of the process as configured.
+// Archives are written by the process itself and the dump tools it starts
+// inherit its priority. The priority can't be raised again without
+// privileges, so it lasts until the process exits.
+func LowerPriority(priority config.PriorityConfig) error {
+    if priority.Nice == 0 && priority.IOClass == "" {
+        return nil
+    }
+    if err := setPriority(priority.Nice, priority.IOClass, priority.IOLevel); err != nil {
+        return fmt.Errorf("failed to lower priority: %v", err)
+    }
+    return nil
+}
+
+// priorityPrefix returns shell commands lowering the priority of the remote
+// shell running a command, and thereby of tar or the dump tool it starts.
+// Where renice or ionice are missing or not permitted, the command runs with
+// the priority it has.
+func priorityPrefix(priority config.PriorityConfig) string {
+    var prefix []string
+    if priority.Nice > 0 {
+        prefix = append(prefix, fmt.Sprintf("renice -n %d -p $$ >/dev/null 2>&1;", priority.Nice))
+    }
+    switch priority.IOClass {
+    case config.IOClassBestEffort:
+        prefix = append(prefix, fmt.Sprintf("ionice -c 2 -n %d -p $$ >/dev/null 2>&1;", priority.IOLevel))
+    case config.IOClassIdle:
+        prefix = append(prefix, "ionice -c 3 -p $$ >/dev/null 2>&1;")
+    }
+    if len(prefix) == 0 {
+        return ""
+    }
+    return strings.Join(prefix, " ") + " "
+}
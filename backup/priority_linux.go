@@ -0,0 +1,77 @@
+package backup
+
+import (
+    "fmt"
+    "os"
+    "strconv"
+    "syscall"
+    "laravel-backup-tool/config"
+)
+
+// Values of ioprio_set(2)
+const (
+    ioprioWhoProcess = 1
+    ioprioClassShift = 13
+    ioprioClassBE    = 2
+    ioprioClassIdle  = 3
+)
+
+// setPriority sets the niceness and IO priority of every thread of the
+// process. Linux keeps both per thread; threads and processes started later
+// inherit them from the thread starting them.
+func setPriority(nice int, ioClass string, ioLevel int) error {
+    ioprio := 0
+    switch ioClass {
+    case config.IOClassBestEffort:
+        ioprio = ioprioClassBE<<ioprioClassShift | ioLevel
+    case config.IOClassIdle:
+        ioprio = ioprioClassIdle << ioprioClassShift
+    }
+
+    // Threads may be started meanwhile, so repeat until all are done
+    done := make(map[int]bool)
+    for {
+        threads, err := threadIDs()
+        if err != nil {
+            return err
+        }
+        changed := false
+        for _, tid := range threads {
+            if done[tid] {
+                continue
+            }
+            // The raw getpriority returns 20 minus the niceness; a thread
+            // that is already nicer is left alone
+            if current, err := syscall.Getpriority(syscall.PRIO_PROCESS, tid); nice > 0 && (err != nil || 20-current < nice) {
+                if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil && err != syscall.ESRCH {
+                    return fmt.Errorf("setpriority: %v", err)
+                }
+            }
+            if ioprio != 0 {
+                _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio))
+                if errno != 0 && errno != syscall.ESRCH {
+                    return fmt.Errorf("ioprio_set: %v", errno)
+                }
+            }
+            done[tid], changed = true, true
+        }
+        if !changed {
+            return nil
+        }
+    }
+}
+
+// threadIDs returns the IDs of the threads of the process
+func threadIDs() ([]int, error) {
+    entries, err := os.ReadDir("/proc/self/task")
+    if err != nil {
+        return nil, fmt.Errorf("failed to list threads: %v", err)
+    }
+    var threads []int
+    for _, entry := range entries {
+        if tid, err := strconv.Atoi(entry.Name()); err == nil {
+            threads = append(threads, tid)
+        }
+    }
+    return threads, nil
+}
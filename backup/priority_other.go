@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package backup
+
+import (
+    "fmt"
+    "syscall"
+)
+
+// setPriority sets the niceness of the process. IO priorities are specific
+// to Linux.
+func setPriority(nice int, ioClass string, ioLevel int) error {
+    if ioClass != "" {
+        return fmt.Errorf("IO priorities are only supported on Linux")
+    }
+    if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+        return fmt.Errorf("setpriority: %v", err)
+    }
+    return nil
+}
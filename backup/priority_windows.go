@@ -0,0 +1,27 @@
+package backup
+
+import (
+    "fmt"
+    "golang.org/x/sys/windows"
+)
+
+// setPriority lowers the priority class of the process by niceness: idle
+// from 15, below normal from 1. IO priorities are specific to Linux.
+func setPriority(nice int, ioClass string, ioLevel int) error {
+    if ioClass != "" {
+        return fmt.Errorf("IO priorities are only supported on Linux")
+    }
+    class := uint32(windows.NORMAL_PRIORITY_CLASS)
+    switch {
+    case nice >= 15:
+        class = windows.IDLE_PRIORITY_CLASS
+    case nice > 0:
+        class = windows.BELOW_NORMAL_PRIORITY_CLASS
+    case nice < 0:
+        class = windows.ABOVE_NORMAL_PRIORITY_CLASS
+    }
+    if err := windows.SetPriorityClass(windows.CurrentProcess(), class); err != nil {
+        return fmt.Errorf("SetPriorityClass: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
+)
+
+// PruneResult is what pruning a backup directory removed, or would remove
+// in a dry run
+type PruneResult struct {
+    // Archives outside the retention of their site and type
+    Archives []string `json:"archives"`
+    // Archives outside retention kept because they are still locked
+    Locked []string `json:"locked"`
+    // Leftovers of interrupted downloads, snapshots and archive comparisons,
+    // and cached file listings of archives that are gone
+    Orphans []string `json:"orphans"`
+    // Local space of the archives and leftovers
+    Reclaimed ByteSize `json:"reclaimed_bytes"`
+}
+
+// pruneTypes are the archive types retention is applied to, in the order
+// rotation applies it: binary logs depend on the dumps they follow
+var pruneTypes = []string{"file", "database", BinlogArchiveType, PhysicalArchiveType, config.DatastoreRedis, config.DatastoreMongo}
+
+// Prune applies the retention of every site and archive type in the
+// manager's directory, like the rotation after a backup, and removes the
+// leftovers of interrupted backups. With dryRun nothing is removed and the
+// result is what would be. It must not run while backups write to the
+// directory.
+func (bm *BackupManager) Prune(dryRun bool) (PruneResult, error) {
+    result := PruneResult{Archives: []string{}, Locked: []string{}, Orphans: []string{}}
+    keys, err := siteKeys(bm.BaseDir)
+    if err != nil {
+        return result, err
+    }
+    for _, site := range keys {
+        for _, archiveType := range pruneTypes {
+            expired, err := bm.retentionExpired(site, archiveType, false)
+            if err != nil {
+                return result, fmt.Errorf("failed to apply retention to %s: %v", site, err)
+            }
+            expired, locked := bm.splitLocked(expired)
+            result.Locked = append(result.Locked, locked...)
+            for _, file := range expired {
+                size := diskSize(file)
+                if !dryRun {
+                    if err := bm.removeExpired(file); err != nil {
+                        return result, err
+                    }
+                }
+                result.Archives = append(result.Archives, file)
+                result.Reclaimed += size
+            }
+        }
+    }
+
+    orphans, err := findOrphans(bm.BaseDir)
+    if err != nil {
+        return result, err
+    }
+    listings, err := bm.Catalog.StaleListings()
+    if err != nil {
+        return result, err
+    }
+    orphans = append(orphans, listings...)
+    for _, path := range orphans {
+        size := diskSize(path)
+        if !dryRun {
+            if err := os.RemoveAll(path); err != nil {
+                return result, fmt.Errorf("failed to remove %s: %v", path, err)
+            }
+        }
+        result.Orphans = append(result.Orphans, path)
+        result.Reclaimed += size
+    }
+    return result, nil
+}
+
+// findOrphans returns the leftovers of interrupted work below baseDir:
+// partial downloads, hidden snapshots being built, the directories
+// archives are extracted into for comparisons and the parts of archives
+// whose split or join was interrupted. The chunk store cleans up
+// after itself when it is pruned.
+func findOrphans(baseDir string) ([]string, error) {
+    var orphans []string
+    err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if os.IsNotExist(err) && path == baseDir {
+                return filepath.SkipDir
+            }
+            return err
+        }
+        name := d.Name()
+        switch {
+        case path == baseDir:
+            return nil
+        case d.IsDir() && path == filepath.Join(baseDir, dedup.StoreDirName):
+            return filepath.SkipDir
+        case d.IsDir() && strings.HasPrefix(name, ".") && strings.HasSuffix(name, SnapshotExt+".partial"):
+        case d.IsDir() && strings.HasSuffix(name, ".tmp") && isArchiveName(strings.TrimSuffix(path, ".tmp")):
+        case !d.IsDir() && strings.HasSuffix(name, partialSuffix):
+        case !d.IsDir() && isOrphanPart(path):
+        case !d.IsDir() && strings.HasSuffix(name, PartsExt+".tmp"):
+        case !d.IsDir() && strings.HasSuffix(name, ".joining") && isArchiveName(strings.TrimSuffix(path, ".joining")):
+        default:
+            return nil
+        }
+        orphans = append(orphans, path)
+        if d.IsDir() {
+            return filepath.SkipDir
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, fmt.Errorf("failed to look for leftovers in %s: %v", baseDir, err)
+    }
+    return orphans, nil
+}
+
+// isArchiveName reports whether path names an archive
+func isArchiveName(path string) bool {
+    _, ok := parseArchive(path)
+    return ok
+}
+
+// diskSize returns the size of a file, the files below a directory or the
+// parts of a split archive, zero if it doesn't exist
+func diskSize(path string) ByteSize {
+    info, err := os.Lstat(path)
+    if err != nil {
+        size, _ := archiveFileSize(path)
+        return ByteSize(size)
+    }
+    if info.IsDir() {
+        size, _ := DirSize(path, &config.FileFilter{})
+        return size
+    }
+    return ByteSize(info.Size())
+}
@@ -0,0 +1,230 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+    "laravel-backup-tool/catalog"
+)
+
+// PushTarget is the storage remote servers upload their archives to in push
+// mode, as an rclone remote named push that is described by RCLONE_CONFIG_PUSH_*
+// environment variables on the server
+type PushTarget struct {
+    // rclone binary on the remote server
+    Rclone string
+    // Options of the remote by rclone's name, e.g. "type": "s3"
+    Options map[string]string
+    // Options rclone expects obscured, such as an SFTP password; the server
+    // obscures them with rclone obscure
+    Obscured map[string]bool
+    // Options whose value is a file, by their content; the files are written
+    // to the server for the run
+    Files map[string][]byte
+    // Path on the remote below which archives are stored, e.g. bucket/prefix
+    Root string
+    // Location of Root recorded in the catalog, e.g. s3://bucket/prefix
+    Location string
+}
+
+// provisionPush checks that the remote server can push archives and writes
+// the push target's credentials to its temporary directory. The returned
+// function removes them again.
+func (sb *SSHBackup) provisionPush(ctx context.Context) (func(), error) {
+    push := sb.config.Push
+    if !sb.remoteSHA256 {
+        return nil, fmt.Errorf("sha256sum is not available on the remote server")
+    }
+    if output, err := sb.execute(ctx, "command -v "+shellQuote(push.Rclone), sb.commandTimeout); err != nil {
+        return nil, fmt.Errorf("%s is not available on the remote server: %v %s", push.Rclone, err, strings.TrimSpace(string(output)))
+    }
+
+    var removes []func()
+    remove := func() {
+        for _, r := range removes {
+            r()
+        }
+    }
+    options := make(map[string]string)
+    for name, value := range push.Options {
+        options[name] = value
+    }
+    for name, content := range push.Files {
+        file, removeFile, err := sb.writeRemoteSecret("push-"+name, content)
+        if err != nil {
+            remove()
+            return nil, err
+        }
+        removes = append(removes, removeFile)
+        options[name] = file
+    }
+
+    names := make([]string, 0, len(options))
+    for name := range options {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var env strings.Builder
+    for _, name := range names {
+        variable := "RCLONE_CONFIG_PUSH_" + strings.ToUpper(name)
+        if push.Obscured[name] {
+            fmt.Fprintf(&env, "%s=$(printf '%%s' %s | %s obscure -) || exit 1\n", variable, shellQuote(options[name]), shellQuote(push.Rclone))
+        } else {
+            fmt.Fprintf(&env, "%s=%s\n", variable, shellQuote(options[name]))
+        }
+        fmt.Fprintf(&env, "export %s\n", variable)
+    }
+    envFile, removeEnv, err := sb.writeRemoteSecret("push-env", []byte(env.String()))
+    if err != nil {
+        remove()
+        return nil, err
+    }
+    removes = append(removes, removeEnv)
+    sb.pushEnv = envFile
+    return remove, nil
+}
+
+// pushArchive runs an archiving command on the remote server and uploads its
+// output from there to the push target, under the key the archive would be
+// uploaded with from archivePath. Only the size and checksum of the upload come
+// back; they are recorded in the catalog with the archive's location, and
+// pushed archives outside retention are deleted.
+func (sb *SSHBackup) pushArchive(ctx context.Context, siteName, archiveType, siteDir, cmd, archivePath string, started time.Time) (ByteSize, error) {
+    key, err := sb.manager.uploadKey(archivePath)
+    if err != nil {
+        return 0, err
+    }
+    push := sb.config.Push
+    dest := "push:" + path.Join(push.Root, key)
+    location := strings.TrimSuffix(push.Location, "/") + "/" + key
+    sb.log.Info("Pushing backup to off-server storage", "site", siteName, "type", archiveType, "location", location)
+
+    // The stream is counted and hashed through named pipes as it is uploaded.
+    // A failed command leaves a truncated upload, which is deleted.
+    p := fmt.Sprintf("%s/.push-%d", siteDir, atomic.AddInt64(&sb.commands, 1))
+    rclone := shellQuote(push.Rclone)
+    script := fmt.Sprintf(`. %[1]s || exit 1
+rm -f %[2]s.*; mkfifo %[2]s.sum %[2]s.count || exit 1
+sha256sum < %[2]s.sum > %[2]s.sha256 &
+wc -c < %[2]s.count > %[2]s.size &
+{ %[3]s; echo $? > %[2]s.status; } | tee %[2]s.sum %[2]s.count | %[4]s rcat %[5]s 2> %[2]s.log
+s=$?
+wait
+if [ "$s" -eq 0 ]; then s=$(cat %[2]s.status 2>/dev/null) || s=1; fi
+if [ "$s" -ne 0 ]; then cat %[2]s.log; %[4]s deletefile %[5]s >/dev/null 2>&1; exit "$s"; fi
+echo "pushed $(cat %[2]s.size) $(cut -d ' ' -f 1 %[2]s.sha256)"`, shellQuote(sb.pushEnv), shellQuote(p), cmd, rclone, shellQuote(dest))
+    output, err := sb.execute(ctx, priorityPrefix(sb.config.Priority)+script, sb.archiveTimeout)
+    if rmErr := sb.runCommand(context.Background(), fmt.Sprintf("rm -f %s.*", shellQuote(p))); rmErr != nil {
+        sb.log.Warn("Failed to remove temporary files of push", "path", p, "error", rmErr)
+    }
+    if err != nil {
+        return 0, fmt.Errorf("push failed: %v, output: %s", err, strings.TrimSpace(string(output)))
+    }
+    size, sum, err := parsePushOutput(output)
+    if err != nil {
+        return 0, err
+    }
+
+    _, t, ok := ParseArchivePath(archivePath)
+    if !ok {
+        t = started
+    }
+    entry := catalog.Entry{
+        Site:     siteName,
+        Type:     archiveType,
+        Path:     archivePath,
+        Time:     t,
+        Size:     int64(size),
+        Checksum: sum,
+        Duration: time.Since(started).Round(time.Millisecond),
+        Location: location,
+        Pushed:   true,
+    }
+    if err := sb.manager.Catalog.Add(entry); err != nil {
+        sb.log.Warn("Failed to record pushed archive", "location", location, "error", err)
+    }
+    sb.log.Info("Pushed backup", "site", siteName, "type", archiveType, "size", size, "sha256", sum)
+    sb.rotatePushed(ctx, siteName, archiveType)
+    return size, nil
+}
+
+// parsePushOutput reads the size and checksum from the last line of the
+// output of a push
+func parsePushOutput(output []byte) (ByteSize, string, error) {
+    lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+    fields := strings.Fields(lines[len(lines)-1])
+    if len(fields) != 3 || fields[0] != "pushed" || len(fields[2]) != 64 {
+        return 0, "", fmt.Errorf("unexpected output of push: %q", strings.TrimSpace(string(output)))
+    }
+    size, err := strconv.ParseInt(fields[1], 10, 64)
+    if err != nil {
+        return 0, "", fmt.Errorf("unexpected size of push: %q", fields[1])
+    }
+    return ByteSize(size), fields[2], nil
+}
+
+// pushedToday reports whether an archive of a type of a site was pushed today
+func (bm *BackupManager) pushedToday(siteName, archiveType string) bool {
+    today := time.Now().Format("2006-01-02")
+    for _, e := range bm.Catalog.Entries() {
+        if e.Pushed && e.Site == siteName && e.Type == archiveType && e.Time.Format("2006-01-02") == today {
+            return true
+        }
+    }
+    return false
+}
+
+// rotatePushed deletes the pushed archives of a type of a site that are
+// outside retention from the push target and the catalog. Failures are
+// logged; the archives are deleted by a later run.
+func (sb *SSHBackup) rotatePushed(ctx context.Context, siteName, archiveType string) {
+    byPath := make(map[string]catalog.Entry)
+    var paths []string
+    for _, e := range sb.manager.Catalog.Entries() {
+        if e.Pushed && e.Site == siteName && e.Type == archiveType {
+            byPath[e.Path] = e
+            paths = append(paths, e.Path)
+        }
+    }
+    sortNewestFirst(paths)
+    var expired []string
+    if policy := sb.manager.Retention.Policy(siteName, archiveType); policy.Enabled() {
+        keep := selectRetained(paths, policy)
+        for _, p := range paths {
+            if !keep[p] {
+                expired = append(expired, p)
+            }
+        }
+    } else {
+        maxBackups := sb.manager.MaxFileBackups
+        if archiveType != "file" {
+            maxBackups = sb.manager.MaxDBBackups
+        }
+        if len(paths) > maxBackups {
+            expired = paths[maxBackups:]
+        }
+    }
+
+    push := sb.config.Push
+    for _, p := range expired {
+        key, err := sb.manager.uploadKey(p)
+        if err != nil {
+            continue
+        }
+        dest := "push:" + path.Join(push.Root, key)
+        cmd := fmt.Sprintf(". %s && %s deletefile %s", shellQuote(sb.pushEnv), shellQuote(push.Rclone), shellQuote(dest))
+        if err := sb.runCommand(ctx, cmd); err != nil {
+            sb.log.Warn("Failed to delete pushed archive outside retention", "location", byPath[p].Location, "error", err)
+            continue
+        }
+        if err := sb.manager.Catalog.Remove(p); err != nil {
+            sb.log.Warn("Failed to remove catalog entry", "path", p, "error", err)
+        }
+        sb.log.Info("Deleted pushed archive outside retention", "site", siteName, "location", byPath[p].Location)
+    }
+}
@@ -0,0 +1,125 @@
+package backup
+
+import (
+    "fmt"
+    "time"
+    "laravel-backup-tool/catalog"
+)
+
+// Reconciliation lists discrepancies between the catalog and the archives on disk
+type Reconciliation struct {
+    // Archives on disk without a catalog entry
+    Untracked []Archive
+    // Catalog entries whose archive no longer exists
+    Missing []catalog.Entry
+    // Catalog entries of pushed or cold archives whose off-server copy no
+    // longer exists
+    MissingOffsite []catalog.Entry
+    // Archives whose size or checksum no longer matches what was recorded
+    Mismatched []string
+    // Whether untracked archives were added and missing entries removed
+    Repaired bool
+}
+
+// Clean reports whether catalog, disk and off-server storage agree
+func (r *Reconciliation) Clean() bool {
+    return len(r.Untracked) == 0 && len(r.Missing) == 0 && len(r.MissingOffsite) == 0 && len(r.Mismatched) == 0
+}
+
+// Reconcile compares the catalog against the archives on disk and pushed or
+// cold archives against their off-server storage. With repair, untracked
+// archives are added to the catalog and entries of missing archives are
+// removed. Mismatched archives and lost off-server copies are only reported,
+// never repaired.
+func (bm *BackupManager) Reconcile(repair bool) (*Reconciliation, error) {
+    archives, err := ListArchives(bm.BaseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list archives: %v", err)
+    }
+
+    result := &Reconciliation{Repaired: repair}
+    onDisk := make(map[string]bool)
+
+    for _, a := range archives {
+        onDisk[a.Path] = true
+
+        entry, ok := bm.Catalog.Find(a.Path)
+        if ok {
+            if entry.Size != a.Size {
+                result.Mismatched = append(result.Mismatched, fmt.Sprintf(
+                    "%s: size is %d bytes, catalog recorded %d", a.Path, a.Size, entry.Size))
+            }
+            continue
+        }
+
+        result.Untracked = append(result.Untracked, a)
+        if !repair {
+            continue
+        }
+
+        // Never overwrite a recorded checksum that no longer matches
+        if _, err := VerifyChecksum(a.Path); err != nil {
+            result.Mismatched = append(result.Mismatched, fmt.Sprintf("%s: %v", a.Path, err))
+            continue
+        }
+        if err := bm.registerArchive(a.Site, a.Type, a.Path, time.Time{}); err != nil {
+            return nil, fmt.Errorf("failed to catalog %s: %v", a.Path, err)
+        }
+    }
+
+    for _, entry := range bm.Catalog.Entries() {
+        if onDisk[entry.Path] {
+            continue
+        }
+        // Pushed and cold archives only exist off-server
+        if entry.Pushed || entry.Cold {
+            status, err := bm.CheckOffsite(entry.Path)
+            if err != nil {
+                return nil, fmt.Errorf("failed to look up off-server copy of %s: %v", entry.Path, err)
+            }
+            if status == OffsiteMissing {
+                result.MissingOffsite = append(result.MissingOffsite, entry)
+            }
+            continue
+        }
+        if archiveExists(entry.Path) {
+            // Exists, but outside the layout ListArchives knows about
+            continue
+        }
+        result.Missing = append(result.Missing, entry)
+        if repair {
+            if err := bm.Catalog.Remove(entry.Path); err != nil {
+                return nil, fmt.Errorf("failed to remove catalog entry of %s: %v", entry.Path, err)
+            }
+        }
+    }
+
+    return result, nil
+}
+
+// Summary renders the reconciliation for humans
+func (r *Reconciliation) Summary() string {
+    if r.Clean() {
+        return "Catalog matches the archives on disk\n"
+    }
+
+    untrackedAction, missingAction := "not in catalog", "catalog entry without archive"
+    if r.Repaired {
+        untrackedAction, missingAction = "added to catalog", "removed from catalog"
+    }
+
+    summary := ""
+    for _, a := range r.Untracked {
+        summary += fmt.Sprintf("Untracked archive %s: %s\n", a.Path, untrackedAction)
+    }
+    for _, entry := range r.Missing {
+        summary += fmt.Sprintf("Missing archive %s: %s\n", entry.Path, missingAction)
+    }
+    for _, entry := range r.MissingOffsite {
+        summary += fmt.Sprintf("Missing archive %s (offsite): not found at %s\n", entry.Path, entry.Location)
+    }
+    for _, m := range r.Mismatched {
+        summary += fmt.Sprintf("Mismatched archive %s\n", m)
+    }
+    return summary
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+    "fmt"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/encryption"
+)
+
+// RekeyResult describes what Rekey changed
+type RekeyResult struct {
+    Archives int
+    Rekeyed  int
+    Chunks   int
+}
+
+// Rekey wraps the keys of the encrypted archives and chunks of the backup
+// directory for the current key and recipients of the keyring, so archives
+// stay readable once retired keys are removed. Only headers are rewritten,
+// apart from archives of the first encryption format. Checksums and the
+// catalog are updated. It must not run while archives are written.
+func (bm *BackupManager) Rekey() (RekeyResult, error) {
+    var result RekeyResult
+    if bm.Keyring == nil || bm.Keyring.Key == nil {
+        return result, fmt.Errorf("no encryption key is configured")
+    }
+    chunks, err := dedup.RekeyChunks(bm.BaseDir, bm.Keyring)
+    result.Chunks = chunks
+    if err != nil {
+        return result, fmt.Errorf("failed to rekey chunks: %v", err)
+    }
+
+    archives, err := ListArchives(bm.BaseDir)
+    if err != nil {
+        return result, fmt.Errorf("failed to list archives: %v", err)
+    }
+    for _, a := range archives {
+        if IsSnapshot(a.Path) {
+            continue
+        }
+        result.Archives++
+        changed, err := bm.rekeyArchive(a.Path)
+        if err != nil {
+            return result, fmt.Errorf("failed to rekey %s: %v", a.Path, err)
+        }
+        if !changed {
+            continue
+        }
+        result.Rekeyed++
+        sum, err := WriteChecksum(a.Path)
+        if err != nil {
+            return result, err
+        }
+        size, err := archiveFileSize(a.Path)
+        if err != nil {
+            return result, err
+        }
+        if err := bm.Catalog.SetChecksum(a.Path, sum, size); err != nil {
+            return result, err
+        }
+    }
+    return result, nil
+}
+
+// rekeyArchive rekeys an archive unless it is current. Its checksum is
+// verified first, so a damaged archive doesn't get a new valid checksum. A
+// split archive is joined for rekeying and split again into parts of the
+// same size.
+func (bm *BackupManager) rekeyArchive(path string) (bool, error) {
+    if !dedup.IsIndex(path) {
+        f, err := openArchiveFile(path)
+        if err != nil {
+            return false, err
+        }
+        current, err := encryption.Current(f, bm.Keyring)
+        f.Close()
+        if err != nil || current {
+            return false, err
+        }
+    }
+    if _, err := VerifyChecksum(path); err != nil {
+        return false, err
+    }
+    if dedup.IsIndex(path) {
+        return dedup.RekeyIndex(path, bm.Keyring)
+    }
+    if IsSplit(path) {
+        m, err := readParts(path)
+        if err != nil {
+            return false, err
+        }
+        if err := joinArchive(path); err != nil {
+            return false, err
+        }
+        changed, err := encryption.Rekey(path, bm.Keyring)
+        parts, splitErr := splitArchive(path, ByteSize(m.PartSize))
+        if err == nil {
+            err = splitErr
+        }
+        if err == nil {
+            err = bm.Catalog.SetParts(path, parts)
+        }
+        return changed, err
+    }
+    return encryption.Rekey(path, bm.Keyring)
+}
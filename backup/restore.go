@@ -0,0 +1,479 @@
+package backup
+
+import (
+    "archive/tar"
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/encryption"
+)
+
+// FindArchive returns the archive of a site with the given type created at
+// timestamp (in TimestampFormat), or the latest one for "latest"
+func FindArchive(baseDir, site, archiveType, timestamp string) (Archive, error) {
+    archives, err := ListArchives(baseDir)
+    if err != nil {
+        return Archive{}, fmt.Errorf("failed to list archives: %v", err)
+    }
+
+    var found *Archive
+    for i, a := range archives {
+        if a.Site != site || a.Type != archiveType {
+            continue
+        }
+        if timestamp == "latest" || a.Time.Format(TimestampFormat) == timestamp {
+            // Archives are sorted oldest first, so later matches are newer
+            found = &archives[i]
+        }
+    }
+    if found == nil {
+        return Archive{}, fmt.Errorf("no %s backup of %s at %s in %s", archiveType, site, timestamp, baseDir)
+    }
+    return *found, nil
+}
+
+// RestoreFiles extracts a file archive into target. An incremental archive is
+// restored by extracting the full archive it builds on and every incremental
+// archive up to it in order. If target exists and is not empty it is only
+// replaced with force; the previous contents are then moved aside to
+// <target>.before-restore-<timestamp> and that path returned. Extra paths
+// outside the document root are not put back in place but extracted to
+// <target>.extra-paths-<timestamp> under their absolute paths, and that
+// path returned as well. Modes, including the setuid, setgid and sticky
+// bits, and modification times are restored; with preserveOwnership, which
+// takes root, the owners are too.
+func RestoreFiles(archivePath, target string, force, preserveOwnership bool, keys *encryption.Keyring) (string, string, error) {
+    var owners *ownership
+    if preserveOwnership {
+        if err := CanPreserveOwnership(); err != nil {
+            return "", "", err
+        }
+        owners = newOwnership()
+    }
+
+    chain, err := archiveChain(archivePath)
+    if err != nil {
+        return "", "", err
+    }
+    if err := verifyChain(chain); err != nil {
+        return "", "", err
+    }
+
+    entries, err := os.ReadDir(target)
+    live := err == nil && len(entries) > 0
+    if live && !force {
+        return "", "", fmt.Errorf("%s is not empty, use --force to replace it", target)
+    }
+
+    // Extract next to the target first so a broken archive leaves it untouched
+    staging := target + ".restore-new"
+    if err := os.RemoveAll(staging); err != nil {
+        return "", "", fmt.Errorf("failed to clean staging directory: %v", err)
+    }
+    var manifest *Manifest
+    dirs := make(map[string]*tar.Header)
+    for i, path := range chain {
+        if len(chain) > 1 {
+            slog.Info("Extracting archive", "archive", filepath.Base(path), "position", i+1, "chain", len(chain))
+        }
+        m, err := extractTree(path, staging, keys, dirs, owners)
+        if err != nil {
+            os.RemoveAll(staging)
+            return "", "", err
+        }
+        if i > 0 && (m == nil || m.Base != filepath.Base(chain[i-1])) {
+            os.RemoveAll(staging)
+            return "", "", fmt.Errorf("%s does not build on %s, the backup chain is broken",
+                filepath.Base(path), filepath.Base(chain[i-1]))
+        }
+        manifest = m
+    }
+    // Drop files deleted from the site between the full and the last archive
+    if manifest != nil {
+        if err := removeUnlisted(staging, manifest); err != nil {
+            os.RemoveAll(staging)
+            return "", "", err
+        }
+    }
+    restoreDirAttributes(dirs)
+
+    // Extra paths don't belong in the document root, where they may be served
+    stamp := time.Now().Format(TimestampFormat)
+    var extra string
+    if _, err := os.Lstat(filepath.Join(staging, ExtraPathsDir)); err == nil {
+        extra = fmt.Sprintf("%s.extra-paths-%s", target, stamp)
+        if err := os.Rename(filepath.Join(staging, ExtraPathsDir), extra); err != nil {
+            os.RemoveAll(staging)
+            return "", "", fmt.Errorf("failed to move extra paths out of %s: %v", staging, err)
+        }
+    }
+
+    var previous string
+    if _, err := os.Stat(target); err == nil {
+        previous = fmt.Sprintf("%s.before-restore-%s", target, stamp)
+        if err := os.Rename(target, previous); err != nil {
+            os.RemoveAll(staging)
+            return "", extra, fmt.Errorf("failed to move %s aside: %v", target, err)
+        }
+    }
+    if err := os.Rename(staging, target); err != nil {
+        return previous, extra, fmt.Errorf("failed to move restored files into place: %v", err)
+    }
+    return previous, extra, nil
+}
+
+// extractTree extracts a compressed tar archive into destDir keeping file modes,
+// modification times and symlinks, and the owners with owners if not nil.
+// Entries escaping destDir are rejected. The directories are added to dirs,
+// whose modes and times are set once the whole chain is extracted. The
+// manifest of an incremental archive is returned instead of extracted.
+func extractTree(archivePath, destDir string, keys *encryption.Keyring, dirs map[string]*tar.Header, owners *ownership) (*Manifest, error) {
+    ar, err := openArchive(archivePath, keys)
+    if err != nil {
+        return nil, err
+    }
+    defer ar.Close()
+
+    if err := os.MkdirAll(destDir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create directory: %v", err)
+    }
+
+    var manifest *Manifest
+    tr := tar.NewReader(ar)
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to read tar header: %v", err)
+        }
+        if header.Name == ManifestEntryName {
+            manifest = &Manifest{}
+            if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+                return nil, fmt.Errorf("failed to parse manifest: %v", err)
+            }
+            continue
+        }
+
+        target := filepath.Join(destDir, header.Name)
+        if target != destDir && !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+            return nil, fmt.Errorf("archive entry %q escapes the target directory", header.Name)
+        }
+        replacesDir := false
+        switch header.Typeflag {
+        case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+            if info, err := os.Lstat(target); err == nil && info.IsDir() {
+                replacesDir = header.Typeflag != tar.TypeDir
+            }
+            if err := clearTarget(destDir, target, header.Typeflag); err != nil {
+                return nil, fmt.Errorf("archive entry %q: %v", header.Name, err)
+            }
+        }
+
+        if err := writeEntry(header, tr, target); err != nil {
+            return nil, err
+        }
+        switch header.Typeflag {
+        case tar.TypeReg, tar.TypeSymlink:
+            // A directory replaced by a file or symlink gets no attributes,
+            // nor do the directories that were below it
+            delete(dirs, target)
+            if replacesDir {
+                for path := range dirs {
+                    if strings.HasPrefix(path, target+string(os.PathSeparator)) {
+                        delete(dirs, path)
+                    }
+                }
+            }
+        }
+        switch header.Typeflag {
+        case tar.TypeDir, tar.TypeReg, tar.TypeSymlink:
+            if owners != nil {
+                if err := owners.chown(header, target); err != nil {
+                    return nil, err
+                }
+            }
+        }
+        if header.Typeflag == tar.TypeDir {
+            dirs[target] = header
+        }
+    }
+    return manifest, nil
+}
+
+// verifyChain checks the checksum and its signature of every archive of a
+// chain before anything of it is restored
+func verifyChain(chain []string) error {
+    for _, path := range chain {
+        if _, err := VerifyChecksum(path); err != nil {
+            return fmt.Errorf("refusing to restore %s: %v", path, err)
+        }
+    }
+    return nil
+}
+
+// writeEntry creates the directory, file or symlink of an archive entry at
+// target, with the file's content read from r. Other types are skipped.
+func writeEntry(header *tar.Header, r io.Reader, target string) error {
+    mode := entryMode(header)
+    switch header.Typeflag {
+    case tar.TypeDir:
+        if err := os.MkdirAll(target, mode.Perm()|0700); err != nil {
+            return fmt.Errorf("failed to create directory: %v", err)
+        }
+    case tar.TypeReg:
+        if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+            return fmt.Errorf("failed to create directory: %v", err)
+        }
+        f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+        if err != nil {
+            return fmt.Errorf("failed to create file: %v", err)
+        }
+        if _, err := io.Copy(f, r); err != nil {
+            f.Close()
+            return fmt.Errorf("failed to write file: %v", err)
+        }
+        if err := f.Close(); err != nil {
+            return fmt.Errorf("failed to write file: %v", err)
+        }
+        // Files replaced by a later incremental archive keep their old mode
+        // otherwise, and the umask drops the setuid, setgid and sticky bits
+        os.Chmod(target, mode)
+        os.Chtimes(target, header.ModTime, header.ModTime)
+    case tar.TypeSymlink:
+        if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+            return fmt.Errorf("failed to create directory: %v", err)
+        }
+        if err := os.Symlink(header.Linkname, target); err != nil {
+            return fmt.Errorf("failed to create symlink: %v", err)
+        }
+    }
+    return nil
+}
+
+// clearTarget makes way for an archive entry of a type at target. What an
+// earlier archive of the chain left there is removed if it is a symlink or of
+// another type. An entry below a symlink is rejected, as it would be written
+// wherever the link points.
+func clearTarget(destDir, target string, typeflag byte) error {
+    rel, err := filepath.Rel(destDir, filepath.Dir(target))
+    if err != nil {
+        return err
+    }
+    dir := destDir
+    for _, name := range strings.Split(rel, string(os.PathSeparator)) {
+        if name == "." {
+            continue
+        }
+        dir = filepath.Join(dir, name)
+        if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+            return fmt.Errorf("lies below the symlink %s", dir)
+        }
+    }
+
+    info, err := os.Lstat(target)
+    if err != nil {
+        return nil
+    }
+    isDir := typeflag == tar.TypeDir
+    if info.Mode()&os.ModeSymlink != 0 || typeflag == tar.TypeSymlink || info.IsDir() != isDir {
+        if err := os.RemoveAll(target); err != nil {
+            return fmt.Errorf("failed to replace %s: %v", target, err)
+        }
+    }
+    return nil
+}
+
+// RestoreDatabase imports a compressed dump into a MySQL or PostgreSQL
+// database, or replaces an SQLite database with its copy, depending on the
+// driver. Encrypted dumps are decrypted with keys.
+func RestoreDatabase(dumpPath, dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string, keys *encryption.Keyring) error {
+    if _, err := VerifyChecksum(dumpPath); err != nil {
+        return fmt.Errorf("refusing to restore %s: %v", dumpPath, err)
+    }
+    if isSQLiteDump(dumpPath) != (dbDriver == DriverSQLite) {
+        return fmt.Errorf("%s can't be restored into a %s database", filepath.Base(dumpPath), driverName(dbDriver))
+    }
+
+    if dbDriver == DriverSQLite {
+        ar, err := openArchive(dumpPath, keys)
+        if err != nil {
+            return err
+        }
+        defer ar.Close()
+        return restoreSQLite(ar, dbName)
+    }
+
+    cmd, cleanup, err := databaseClient(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass)
+    if err != nil {
+        return err
+    }
+    defer cleanup()
+
+    ar, err := openArchive(dumpPath, keys)
+    if err != nil {
+        return err
+    }
+    defer ar.Close()
+    cmd.Stdin = ar
+
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("failed to run %s: %v, error output: %s", cmd.Args[0], err, stderr.String())
+    }
+    return nil
+}
+
+// CreateDatabase creates an empty database on the server of a site's
+// database. It fails if the database exists, so nothing is overwritten.
+func CreateDatabase(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) error {
+    var cmd *exec.Cmd
+    cleanup := func() {}
+    var err error
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        if cmd, cleanup, err = databaseClient(dbDriver, dbHost, dbPort, "", dbUser, dbPass,
+            "-e", "CREATE DATABASE `"+strings.ReplaceAll(dbName, "`", "``")+"`"); err != nil {
+            return err
+        }
+    case DriverPostgres:
+        // CREATE DATABASE needs a connection to another database
+        if cmd, cleanup, err = databaseClient(dbDriver, dbHost, dbPort, "postgres", dbUser, dbPass,
+            "-c", `CREATE DATABASE "`+strings.ReplaceAll(dbName, `"`, `""`)+`"`); err != nil {
+            return err
+        }
+    case DriverSQLite:
+        return createSQLiteDatabase(dbName)
+    default:
+        return fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+    defer cleanup()
+
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("failed to create database %s: %v, error output: %s", dbName, err, stderr.String())
+    }
+    return nil
+}
+
+// DropDatabase removes a database, if it exists, from the server of a
+// site's database, or the file of an SQLite database
+func DropDatabase(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) error {
+    var cmd *exec.Cmd
+    cleanup := func() {}
+    var err error
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        if cmd, cleanup, err = databaseClient(dbDriver, dbHost, dbPort, "", dbUser, dbPass,
+            "-e", "DROP DATABASE IF EXISTS `"+strings.ReplaceAll(dbName, "`", "``")+"`"); err != nil {
+            return err
+        }
+    case DriverPostgres:
+        if cmd, cleanup, err = databaseClient(dbDriver, dbHost, dbPort, "postgres", dbUser, dbPass,
+            "-c", `DROP DATABASE IF EXISTS "`+strings.ReplaceAll(dbName, `"`, `""`)+`"`); err != nil {
+            return err
+        }
+    case DriverSQLite:
+        if err := os.Remove(dbName); err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("failed to remove database %s: %v", dbName, err)
+        }
+        return nil
+    default:
+        return fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+    defer cleanup()
+
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("failed to drop database %s: %v, error output: %s", dbName, err, stderr.String())
+    }
+    return nil
+}
+
+// CountTables returns the number of tables in a database
+func CountTables(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) (int, error) {
+    var cmd *exec.Cmd
+    cleanup := func() {}
+    var err error
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        if cmd, cleanup, err = databaseClient(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass,
+            "-N", "-B", "-e", "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE()"); err != nil {
+            return 0, err
+        }
+    case DriverPostgres:
+        if cmd, cleanup, err = databaseClient(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass, "-t", "-A", "-c",
+            "SELECT count(*) FROM information_schema.tables WHERE table_schema NOT IN ('pg_catalog', 'information_schema')"); err != nil {
+            return 0, err
+        }
+    case DriverSQLite:
+        cmd = exec.Command("sqlite3", "-readonly", dbName, "SELECT count(*) FROM sqlite_master WHERE type = 'table';")
+    default:
+        return 0, fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+    defer cleanup()
+
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        return 0, fmt.Errorf("failed to count tables of %s: %v, error output: %s", dbName, err, stderr.String())
+    }
+    count, err := strconv.Atoi(strings.TrimSpace(string(out)))
+    if err != nil {
+        return 0, fmt.Errorf("unexpected table count of %s: %q", dbName, strings.TrimSpace(string(out)))
+    }
+    return count, nil
+}
+
+// driverName returns the name of a database driver for messages
+func driverName(dbDriver string) string {
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        return "MySQL"
+    case DriverPostgres:
+        return "PostgreSQL"
+    case DriverSQLite:
+        return "SQLite"
+    }
+    return dbDriver
+}
+
+// databaseClient returns the mysql or psql command connected to a database,
+// or for MySQL to none if dbName is empty, with the given options. cleanup
+// removes the option file of mysql once the command finished.
+func databaseClient(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string, options ...string) (*exec.Cmd, func(), error) {
+    switch dbDriver {
+    case "", DriverMySQL, DriverMariaDB:
+        // Options go before the database name
+        if dbName != "" {
+            options = append(options, dbName)
+        }
+        mysql, err := mysqlBinary("mysql")
+        if err != nil {
+            return nil, nil, err
+        }
+        return mysqlCommand(context.Background(), mysql, dbHost, dbPort, dbUser, dbPass, options...)
+    case DriverPostgres:
+        args := []string{"-w", "-q", "-v", "ON_ERROR_STOP=1",
+            "-h", dbHost, "-p", postgresPort(dbPort), "-U", dbUser, "-d", dbName}
+        cmd := exec.Command("psql", append(args, options...)...)
+        cmd.Env = append(os.Environ(), "PGPASSWORD="+dbPass)
+        return cmd, func() {}, nil
+    default:
+        return nil, nil, fmt.Errorf("unsupported database driver %q", dbDriver)
+    }
+}
@@ -0,0 +1,100 @@
+package backup
+
+import (
+    "fmt"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/encryption"
+)
+
+// RestoreTestPrefix starts the names of the databases restore tests import
+// dumps into. Such a database is replaced by every test of its site.
+const RestoreTestPrefix = "restoretest_"
+
+// maxDatabaseName is the longest database name both MySQL and PostgreSQL accept
+const maxDatabaseName = 63
+
+// nonNameChars matches what can't be part of an unquoted database name
+var nonNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// ScratchDatabase is a throwaway database a dump was restored into
+type ScratchDatabase struct {
+    Driver string
+    Host   string
+    Port   string
+    Name   string
+    User   string
+    pass   string
+}
+
+// RestoreTestDatabaseName returns the database a restore test of a site
+// imports the site's dump into, e.g. restoretest_shop_example_com
+func RestoreTestDatabaseName(site string) string {
+    name := RestoreTestPrefix + nonNameChars.ReplaceAllString(strings.ToLower(site), "_")
+    if len(name) > maxDatabaseName {
+        name = name[:maxDatabaseName]
+    }
+    return name
+}
+
+// RestoreScratchDatabase imports a dump into a throwaway database. The copy
+// of an SQLite database is restored into a file in dir; other dumps into
+// RestoreTestDatabaseName(site) on the server of the site's database, which
+// creds connect to, replacing what an earlier test left behind. Drop the
+// database when done.
+func RestoreScratchDatabase(dumpPath, site, dir string, creds config.Credentials, keys *encryption.Keyring) (*ScratchDatabase, error) {
+    db := &ScratchDatabase{Driver: creds.Driver, Host: creds.Host, Port: creds.Port, User: creds.User, pass: creds.Password}
+    if isSQLiteDump(dumpPath) {
+        db = &ScratchDatabase{Driver: DriverSQLite, Name: filepath.Join(dir, "database.sqlite")}
+    } else {
+        if !creds.HasDatabase() || creds.Driver == DriverSQLite {
+            return nil, fmt.Errorf("no database server configured for %s to restore %s on", site, filepath.Base(dumpPath))
+        }
+        db.Name = RestoreTestDatabaseName(site)
+        if db.Name == creds.Name {
+            return nil, fmt.Errorf("the database of %s is named %s, refusing to replace it", site, db.Name)
+        }
+        if err := db.Drop(); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := CreateDatabase(db.Driver, db.Host, db.Port, db.Name, db.User, db.pass); err != nil {
+        return nil, err
+    }
+    if err := RestoreDatabase(dumpPath, db.Driver, db.Host, db.Port, db.Name, db.User, db.pass, keys); err != nil {
+        db.Drop()
+        return nil, err
+    }
+    return db, nil
+}
+
+// Env returns the environment variables pointing a Laravel application at
+// the database
+func (db *ScratchDatabase) Env() []string {
+    connection := db.Driver
+    if connection == DriverMariaDB {
+        // Applications before Laravel 11 have no mariadb connection
+        connection = DriverMySQL
+    }
+    env := []string{"DB_CONNECTION=" + connection, "DB_DATABASE=" + db.Name, "DB_PASSWORD=" + db.pass}
+    // Left out when empty, so the application's defaults apply
+    for name, value := range map[string]string{"DB_HOST": db.Host, "DB_PORT": db.Port, "DB_USERNAME": db.User} {
+        if value != "" {
+            env = append(env, name+"="+value)
+        }
+    }
+    return env
+}
+
+// Tables returns the number of tables in the database
+func (db *ScratchDatabase) Tables() (int, error) {
+    return CountTables(db.Driver, db.Host, db.Port, db.Name, db.User, db.pass)
+}
+
+// Drop removes the database
+func (db *ScratchDatabase) Drop() error {
+    return DropDatabase(db.Driver, db.Host, db.Port, db.Name, db.User, db.pass)
+}
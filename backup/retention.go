@@ -0,0 +1,82 @@
+package backup
+
+import (
+    "fmt"
+    "os"
+    "sort"
+    "time"
+    "laravel-backup-tool/config"
+)
+
+// archiveTime returns when an archive was made, from its name or else from
+// its modification time
+func archiveTime(path string) time.Time {
+    if _, t, ok := ParseArchivePath(path); ok {
+        return t
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return time.Time{}
+    }
+    return info.ModTime()
+}
+
+// selectRetained returns the archives a retention policy keeps. paths must
+// be sorted newest first. For every period of the policy the newest archive
+// of each of the latest periods that have archives is kept; the newest
+// archive is always kept.
+func selectRetained(paths []string, policy config.RetentionPolicy) map[string]bool {
+    keep := make(map[string]bool)
+    if len(paths) > 0 {
+        keep[paths[0]] = true
+    }
+
+    periods := []struct {
+        count  int
+        bucket func(time.Time) string
+    }{
+        {policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+        {policy.Weekly, func(t time.Time) string {
+            year, week := t.ISOWeek()
+            return fmt.Sprintf("%d-W%02d", year, week)
+        }},
+        {policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+        {policy.Yearly, func(t time.Time) string { return t.Format("2006") }},
+    }
+    for _, period := range periods {
+        seen := make(map[string]bool)
+        for _, path := range paths {
+            if len(seen) >= period.count {
+                break
+            }
+            bucket := period.bucket(archiveTime(path))
+            if !seen[bucket] {
+                seen[bucket] = true
+                keep[path] = true
+            }
+        }
+    }
+    return keep
+}
+
+// keepChains extends a selection of archives of a type, sorted newest first,
+// with the archives kept incremental archives build on, back to the last
+// full one
+func keepChains(paths []string, keep map[string]bool) {
+    needed := false
+    for _, path := range paths {
+        if needed {
+            keep[path] = true
+        }
+        if keep[path] {
+            needed = IsIncremental(path)
+        }
+    }
+}
+
+// sortNewestFirst sorts archive paths by the time they were made
+func sortNewestFirst(paths []string) {
+    sort.SliceStable(paths, func(i, j int) bool {
+        return archiveTime(paths[i]).After(archiveTime(paths[j]))
+    })
+}
@@ -0,0 +1,152 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/retry"
+)
+
+// rsyncVanished is the exit code of rsync when files vanished during the
+// transfer, which happens on live sites and doesn't fail the snapshot
+const rsyncVanished = 24
+
+// rsyncReceived matches the received bytes in the output of rsync --stats
+var rsyncReceived = regexp.MustCompile(`Total bytes received: ([0-9,.]+)`)
+
+// checkRsync checks that rsync is installed on both ends if site files are
+// copied with rsync
+func (sb *SSHBackup) checkRsync() error {
+    if sb.config.Transport != config.TransportRsync {
+        return nil
+    }
+    if _, err := exec.LookPath("rsync"); err != nil {
+        return fmt.Errorf("the rsync transport needs rsync on this machine: %v", err)
+    }
+    if _, err := sb.execute(context.Background(), "command -v rsync", sb.commandTimeout); err != nil {
+        return fmt.Errorf("the rsync transport needs rsync on the remote server")
+    }
+    return nil
+}
+
+// rsyncShell returns the remote shell of rsync: the ssh client with the
+// configured key, port and host key checking. Authentication must not
+// prompt, so the key must not need a passphrase unless ssh-agent holds it.
+func (sb *SSHBackup) rsyncShell() (string, error) {
+    args := []string{"ssh", "-p", sb.config.Port, "-o", "BatchMode=yes"}
+    if sb.config.KeyPath != "" {
+        args = append(args, "-i", sb.config.KeyPath, "-o", "IdentitiesOnly=yes")
+    }
+    if sb.config.InsecureHostKey {
+        args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+    } else {
+        knownHosts, err := KnownHostsPath(sb.config.KnownHostsFile)
+        if err != nil {
+            return "", err
+        }
+        args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+knownHosts)
+    }
+    for i, arg := range args {
+        args[i] = shellQuote(arg)
+    }
+    return strings.Join(args, " "), nil
+}
+
+// rsyncSource returns the rsync source naming the content of a remote directory
+func (sb *SSHBackup) rsyncSource(dir string) string {
+    host := sb.config.Host
+    if strings.Contains(host, ":") {
+        host = "[" + host + "]"
+    }
+    return fmt.Sprintf("%s@%s:%s/", sb.config.User, host, strings.TrimSuffix(dir, "/"))
+}
+
+// syncSiteFiles copies a site's document root with rsync into a new
+// snapshot. Files unchanged since the latest snapshot are hard links to its
+// files and are not transferred again, so a snapshot only costs the space
+// and transfer of what changed. rsync copies the files named in the list
+// on the server that tar archives are built from.
+func (sb *SSHBackup) syncSiteFiles(ctx context.Context, site SiteInfo, listPath, localDir, timestamp string, sourceSize ByteSize) (bool, error) {
+    started := time.Now()
+    previous := latestSnapshot(localDir)
+    if previous != "" {
+        abs, err := filepath.Abs(previous)
+        if err != nil {
+            return false, err
+        }
+        previous = abs
+    }
+    // Next to a previous snapshot only changed files take space
+    needed := sourceSize
+    if previous != "" {
+        needed = 0
+    }
+    if err := sb.manager.CheckSpace(site.ServerName, "files", needed); err != nil {
+        return false, err
+    }
+    shell, err := sb.rsyncShell()
+    if err != nil {
+        return false, err
+    }
+
+    // Snapshots are built under a hidden name, so an interrupted one is
+    // neither listed nor taken as the base of the next
+    snapshot := archivePath(sb.manager.BaseDir, site.ServerName, "file", timestamp, false, SnapshotExt)
+    if err := os.MkdirAll(filepath.Dir(snapshot), 0755); err != nil {
+        return false, fmt.Errorf("failed to create local directory: %v", err)
+    }
+    partial := filepath.Join(filepath.Dir(snapshot), "."+filepath.Base(snapshot)+".partial")
+    stale, _ := filepath.Glob(filepath.Join(filepath.Dir(snapshot), ".*"+SnapshotExt+".partial"))
+    for _, path := range stale {
+        os.RemoveAll(path)
+    }
+
+    args := []string{"-a", "--numeric-ids", "--protect-args", "--stats",
+        "--from0", "--files-from=:" + listPath, "-e", shell}
+    if sb.escalated {
+        // rsync on the server reads the files with privileges
+        args = append(args, "--rsync-path="+becomePrefix(sb.config.Become, sb.askpass)+" rsync")
+    }
+    if previous != "" {
+        args = append(args, "--link-dest="+previous)
+    }
+    args = append(args, sb.rsyncSource(site.DocumentRoot), partial+"/")
+    cmd := exec.CommandContext(ctx, "rsync", args...)
+    var stdout, stderr bytes.Buffer
+    cmd.Stdout, cmd.Stderr = &stdout, &stderr
+    // On cancellation kill rsync together with its ssh client
+    killGroupOnCancel(cmd)
+
+    sb.log.Info("Synchronizing files with rsync", "site", site.ServerName, "base", filepath.Base(previous))
+    err = cmd.Run()
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) && exitErr.ExitCode() == rsyncVanished && ctx.Err() == nil {
+        sb.log.Warn("Files vanished during synchronization", "site", site.ServerName, "output", strings.TrimSpace(stderr.String()))
+    } else if err != nil {
+        os.RemoveAll(partial)
+        return false, contextError(ctx, fmt.Errorf("failed to run rsync: %v, error output: %s", err, strings.TrimSpace(stderr.String())))
+    }
+
+    var received ByteSize
+    if m := rsyncReceived.FindStringSubmatch(stdout.String()); m != nil {
+        n, _ := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(m[1]), 10, 64)
+        received = ByteSize(n)
+    }
+    sb.manager.ChargeUsage(site.ServerName, received, sourceSize)
+
+    if err := os.Rename(partial, snapshot); err != nil {
+        os.RemoveAll(partial)
+        return false, fmt.Errorf("failed to store snapshot: %v", err)
+    }
+    sb.log.Info("Created snapshot", "site", site.ServerName, "path", snapshot, "received", received)
+    return false, retry.Permanent(sb.storePulledArchive(site.ServerName, "file", snapshot, "", started))
+}
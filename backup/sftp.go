@@ -0,0 +1,486 @@
+package backup
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+    "time"
+    "laravel-backup-tool/catalog"
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+)
+
+const (
+    // DefaultTransferRetries is how often a failed transfer is attempted again
+    DefaultTransferRetries = 3
+    // transferRetryDelay is multiplied by the attempt number to get the backoff
+    transferRetryDelay = 5 * time.Second
+    // progressInterval is how often a running transfer reports its progress
+    progressInterval = 10 * time.Second
+    // partialSuffix marks files still being transferred
+    partialSuffix = ".part"
+    // keepaliveTimeout is how long a connection may take to answer a keepalive
+    keepaliveTimeout = 15 * time.Second
+    // DefaultKeepaliveInterval is how often a keepalive is sent over an idle
+    // or busy connection
+    DefaultKeepaliveInterval = 30 * time.Second
+    // DefaultKeepaliveCountMax is how many keepalives in a row may go
+    // unanswered before the connection is considered dead
+    DefaultKeepaliveCountMax = 3
+    // DefaultSiteResumes is how often a site is backed up again after the
+    // connection dropped during its backup
+    DefaultSiteResumes = 2
+)
+
+// conn returns the current SSH connection
+func (sb *SSHBackup) conn() *ssh.Client {
+    sb.clientMu.Lock()
+    defer sb.clientMu.Unlock()
+    return sb.client
+}
+
+// alive reports whether a connection answers a keepalive request in time
+func alive(client *ssh.Client) bool {
+    return answers(client, keepaliveTimeout)
+}
+
+// answers reports whether a connection answers a keepalive request within
+// timeout
+func answers(client *ssh.Client, timeout time.Duration) bool {
+    done := make(chan error, 1)
+    go func() {
+        _, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        return err == nil
+    case <-time.After(timeout):
+        return false
+    }
+}
+
+// reconnect replaces the SSH connection if it dropped, so a failed transfer
+// or site backup can be resumed. The pooled sessions of the old connection
+// are discarded and the pool is filled again over the new one; commands
+// running over the old connection have failed already.
+func (sb *SSHBackup) reconnect() error {
+    sb.clientMu.Lock()
+    defer sb.clientMu.Unlock()
+
+    if alive(sb.client) {
+        return nil
+    }
+    sb.log.Warn("SSH connection lost, reconnecting")
+    client, err := ssh.Dial("tcp", sb.addr, sb.clientConfig)
+    if err != nil {
+        return fmt.Errorf("failed to reconnect to SSH server: %v", err)
+    }
+    sb.client.Close()
+    sb.client = client
+    atomic.AddInt64(&sb.reconnects, 1)
+    for len(sb.sessionPool) > 0 {
+        (<-sb.sessionPool).Close()
+    }
+    sb.fillSessionPool(client)
+    sb.log.Info("Reconnected to SSH server")
+    return nil
+}
+
+// keepalive sends a keepalive over the connection every interval until the
+// handler is closed, each to be answered within the interval. After
+// countMax keepalives in a row went unanswered, the
+// connection is closed, so commands hanging on it fail right away instead of
+// when TCP gives up, and replaced; a failed reconnect is tried again at the
+// next interval.
+func (sb *SSHBackup) keepalive(interval time.Duration, countMax int) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    missed := 0
+    for {
+        select {
+        case <-sb.stopKeepalive:
+            return
+        case <-ticker.C:
+        }
+        client := sb.conn()
+        if missed < countMax {
+            if answers(client, interval) {
+                missed = 0
+                continue
+            }
+            missed++
+            sb.log.Debug("SSH keepalive not answered", "missed", missed, "max", countMax)
+            if missed < countMax {
+                continue
+            }
+            sb.log.Warn("SSH connection stopped answering keepalives, closing it", "missed", missed)
+            client.Close()
+        }
+        if err := sb.reconnect(); err != nil {
+            sb.log.Warn("Failed to reconnect, trying again", "in", interval.String(), "error", err)
+            continue
+        }
+        missed = 0
+    }
+}
+
+// sftpClient returns the SFTP client of the connection, opening it on first
+// use and again once the connection was replaced
+func (sb *SSHBackup) sftpClient() (*sftp.Client, error) {
+    sb.sftpMu.Lock()
+    defer sb.sftpMu.Unlock()
+
+    conn := sb.conn()
+    if sb.sftp != nil && sb.sftpConn != conn {
+        sb.sftp.Close()
+        sb.sftp = nil
+    }
+    if sb.sftp == nil {
+        client, err := sftp.NewClient(conn)
+        if err != nil {
+            return nil, fmt.Errorf("failed to start SFTP session: %v", err)
+        }
+        sb.sftp = client
+        sb.sftpConn = conn
+    }
+    return sb.sftp, nil
+}
+
+// resetSFTP closes the SFTP client after a failed transfer, so the next
+// attempt starts with a fresh session
+func (sb *SSHBackup) resetSFTP() {
+    sb.sftpMu.Lock()
+    defer sb.sftpMu.Unlock()
+
+    if sb.sftp != nil {
+        sb.sftp.Close()
+        sb.sftp = nil
+    }
+}
+
+// remoteChecksumCommands print the SHA-256 of a file as the first field of
+// their output, in the order they are looked for on the remote server
+var remoteChecksumCommands = []string{"sha256sum", "shasum -a 256", "sha256 -r", "openssl dgst -sha256 -r"}
+
+// copyFileFromRemote downloads a file from the remote server over SFTP. The
+// download is compared with the SHA-256 of the remote file if the server can
+// compute it, and with its size otherwise; a mismatch downloads it again.
+func (sb *SSHBackup) copyFileFromRemote(ctx context.Context, remotePath, localPath string) error {
+    var checksum string
+    err := sb.transfer(ctx, "download", remotePath, func() error {
+        if sb.checksumCommand != "" && checksum == "" {
+            sum, err := sb.remoteChecksum(ctx, remotePath)
+            if err != nil {
+                return err
+            }
+            checksum = sum
+        }
+        return sb.download(ctx, remotePath, localPath, checksum)
+    })
+    if err != nil {
+        os.Remove(localPath + partialSuffix)
+    }
+    return stepError(catalog.CategoryTransfer, err)
+}
+
+// copyFileToRemote uploads a local file to the remote server over SFTP
+func (sb *SSHBackup) copyFileToRemote(ctx context.Context, localPath, remotePath string) error {
+    err := sb.transfer(ctx, "upload", localPath, func() error {
+        return sb.upload(ctx, localPath, remotePath)
+    })
+    if err != nil {
+        if client, clientErr := sb.sftpClient(); clientErr == nil {
+            client.Remove(remotePath + partialSuffix)
+        }
+    }
+    return stepError(catalog.CategoryTransfer, err)
+}
+
+// writeRemoteSecret writes content to a new file in the run's temporary
+// directory that only the SSH user can read, and returns its path and a
+// function removing it. The directory and anything left in it are removed
+// when the connection is closed.
+func (sb *SSHBackup) writeRemoteSecret(name string, content []byte) (string, func(), error) {
+    if sb.tempDir == "" {
+        return "", nil, fmt.Errorf("no remote temporary directory for %s", name)
+    }
+    client, err := sb.sftpClient()
+    if err != nil {
+        return "", nil, err
+    }
+    remotePath := path.Join(sb.tempDir, fmt.Sprintf(".%s-%d", name, atomic.AddInt64(&sb.commands, 1)))
+    f, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+    if err != nil {
+        return "", nil, fmt.Errorf("failed to create %s: %v", remotePath, err)
+    }
+    remove := func() {
+        if err := sb.runCommand(context.Background(), "rm -f "+shellQuote(remotePath)); err != nil {
+            sb.log.Warn("Failed to remove remote file", "path", remotePath, "error", err)
+        }
+    }
+    // Restrict the file before anything secret is in it
+    if err := f.Chmod(0600); err != nil {
+        f.Close()
+        remove()
+        return "", nil, fmt.Errorf("failed to restrict %s: %v", remotePath, err)
+    }
+    _, err = f.Write(content)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        remove()
+        return "", nil, fmt.Errorf("failed to write %s: %v", remotePath, err)
+    }
+    return remotePath, remove, nil
+}
+
+// permanentError is a transfer error that retrying doesn't fix
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string {
+    return e.err.Error()
+}
+
+// openError describes a failure to open a file, marking missing files and
+// denied access as permanent
+func openError(what string, err error) error {
+    wrapped := fmt.Errorf("failed to open %s: %v", what, err)
+    if os.IsNotExist(err) || os.IsPermission(err) {
+        return permanentError{wrapped}
+    }
+    return wrapped
+}
+
+// transfer runs a transfer, retrying it with a linear backoff. Partially
+// transferred data is kept between attempts, so a retry resumes the transfer,
+// over a new connection if the connection dropped. A cancelled transfer is
+// not retried.
+func (sb *SSHBackup) transfer(ctx context.Context, direction, name string, attempt func() error) error {
+    var err error
+    for i := 1; i <= sb.transferRetries; i++ {
+        if i > 1 {
+            err = sb.reconnect()
+        }
+        if err == nil {
+            if err = attempt(); err == nil {
+                return nil
+            }
+        }
+        if _, permanent := err.(permanentError); permanent || ctx.Err() != nil {
+            break
+        }
+        sb.resetSFTP()
+        if i < sb.transferRetries {
+            sb.log.Warn("Transfer failed, retrying", "direction", direction, "file", name, "attempt", i, "attempts", sb.transferRetries, "error", err)
+            select {
+            case <-time.After(time.Duration(i) * transferRetryDelay):
+            case <-ctx.Done():
+            }
+        }
+    }
+    return fmt.Errorf("failed to %s %s: %v", direction, name, contextError(ctx, err))
+}
+
+// remoteChecksum returns the hex encoded SHA-256 of a remote file
+func (sb *SSHBackup) remoteChecksum(ctx context.Context, remotePath string) (string, error) {
+    output, err := sb.execute(ctx, fmt.Sprintf("%s %s", sb.checksumCommand, shellQuote(remotePath)), sb.archiveTimeout)
+    if err != nil {
+        return "", fmt.Errorf("failed to compute checksum of remote file: %v: %s", err, strings.TrimSpace(string(output)))
+    }
+    fields := strings.Fields(string(output))
+    if len(fields) == 0 || len(fields[0]) != 64 {
+        return "", fmt.Errorf("unexpected %s output %q", sb.checksumCommand, strings.TrimSpace(string(output)))
+    }
+    return strings.ToLower(fields[0]), nil
+}
+
+// download copies a remote file to <localPath>.part, continuing after the
+// data of an earlier attempt, and renames it once complete. A completed file
+// whose size differs from the remote file's, or that doesn't match checksum
+// if given, is discarded, so the next attempt starts over.
+func (sb *SSHBackup) download(ctx context.Context, remotePath, localPath, checksum string) error {
+    client, err := sb.sftpClient()
+    if err != nil {
+        return err
+    }
+    src, err := client.Open(remotePath)
+    if err != nil {
+        return openError("remote file", err)
+    }
+    defer src.Close()
+    info, err := src.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat remote file: %v", err)
+    }
+
+    partPath := localPath + partialSuffix
+    dst, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return openError("local file", err)
+    }
+    offset, err := resumeOffset(dst, info.Size())
+    if err == nil && offset > 0 {
+        _, err = src.Seek(offset, io.SeekStart)
+    }
+    if err == nil {
+        err = sb.copyWithProgress(ctx, dst, src, offset, info.Size(), path.Base(remotePath))
+    }
+    if cerr := dst.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    // A remote file still growing or a short read leave a truncated download
+    if partInfo, err := os.Stat(partPath); err != nil {
+        return fmt.Errorf("failed to stat downloaded file: %v", err)
+    } else if partInfo.Size() != info.Size() {
+        os.Remove(partPath)
+        return fmt.Errorf("size mismatch: downloaded %d bytes, remote file has %d", partInfo.Size(), info.Size())
+    }
+    if checksum != "" {
+        sum, err := FileChecksum(partPath)
+        if err != nil {
+            return fmt.Errorf("failed to compute checksum: %v", err)
+        }
+        if sum != checksum {
+            os.Remove(partPath)
+            return fmt.Errorf("checksum mismatch: downloaded %s, remote file %s", sum, checksum)
+        }
+    }
+    return os.Rename(partPath, localPath)
+}
+
+// upload copies a local file to <remotePath>.part, continuing after the data
+// of an earlier attempt, and renames it once complete
+func (sb *SSHBackup) upload(ctx context.Context, localPath, remotePath string) error {
+    client, err := sb.sftpClient()
+    if err != nil {
+        return err
+    }
+    src, err := os.Open(localPath)
+    if err != nil {
+        return openError("local file", err)
+    }
+    defer src.Close()
+    info, err := src.Stat()
+    if err != nil {
+        return err
+    }
+
+    partPath := remotePath + partialSuffix
+    dst, err := client.OpenFile(partPath, os.O_CREATE|os.O_WRONLY)
+    if err != nil {
+        return openError("remote file", err)
+    }
+    offset, err := resumeOffset(dst, info.Size())
+    if err == nil && offset > 0 {
+        _, err = src.Seek(offset, io.SeekStart)
+    }
+    if err == nil {
+        err = sb.copyWithProgress(ctx, dst, src, offset, info.Size(), filepath.Base(localPath))
+    }
+    if cerr := dst.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    if err := client.PosixRename(partPath, remotePath); err != nil {
+        return fmt.Errorf("failed to rename remote file: %v", err)
+    }
+    return nil
+}
+
+// resumeOffset positions a partially written file after the data of an
+// earlier attempt and returns that offset. Files that can't be continued are
+// truncated and written from the start.
+func resumeOffset(f interface {
+    io.Seeker
+    Truncate(int64) error
+}, total int64) (int64, error) {
+    offset, err := f.Seek(0, io.SeekEnd)
+    if err != nil {
+        return 0, err
+    }
+    if offset > total {
+        if err := f.Truncate(0); err != nil {
+            return 0, err
+        }
+        offset, err = f.Seek(0, io.SeekStart)
+    }
+    return offset, err
+}
+
+// progressWriter counts the bytes written through it
+type progressWriter struct {
+    w       io.Writer
+    written int64 // accessed atomically
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+    n, err := pw.w.Write(p)
+    atomic.AddInt64(&pw.written, int64(n))
+    return n, err
+}
+
+func (pw *progressWriter) Written() int64 {
+    return atomic.LoadInt64(&pw.written)
+}
+
+// copyWithProgress copies src to dst, reporting the progress periodically.
+// A transfer taking longer than the archive timeout is aborted, as is one
+// whose ctx is cancelled.
+func (sb *SSHBackup) copyWithProgress(ctx context.Context, dst io.WriteCloser, src io.ReadCloser, offset, total int64, name string) error {
+    pw := &progressWriter{w: dst, written: offset}
+    done := make(chan error, 1)
+    started := time.Now()
+    go func() {
+        _, err := io.Copy(pw, src)
+        done <- err
+    }()
+
+    ticker := time.NewTicker(progressInterval)
+    defer ticker.Stop()
+    timeout := time.NewTimer(sb.archiveTimeout)
+    defer timeout.Stop()
+    for {
+        select {
+        case err := <-done:
+            if err != nil {
+                return err
+            }
+            elapsed := time.Since(started)
+            sb.log.Info("Transferred", "file", name, "size", ByteSize(pw.Written()).String(), "elapsed", elapsed.Round(time.Second).String())
+            return nil
+        case <-ticker.C:
+            written := pw.Written()
+            percent := 100.0
+            if total > 0 {
+                percent = float64(written) * 100 / float64(total)
+            }
+            sb.log.Info("Transferring", "file", name, "percent", fmt.Sprintf("%.0f", percent), "written", ByteSize(written).String(), "total", ByteSize(total).String())
+        case <-timeout.C:
+            // Closing the connection's SFTP session makes the copy return
+            sb.resetSFTP()
+            <-done
+            return fmt.Errorf("transfer timed out after %s", sb.archiveTimeout)
+        case <-ctx.Done():
+            // Closing the files makes the copy return without disturbing
+            // the transfers of other sites over the same session
+            src.Close()
+            dst.Close()
+            <-done
+            return contextError(ctx, nil)
+        }
+    }
+}
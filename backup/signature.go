@@ -0,0 +1,186 @@
+package backup
+
+import (
+    "crypto/ed25519"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "fmt"
+    "os"
+    "sync"
+    "laravel-backup-tool/config"
+)
+
+// SignatureSuffix is appended to a checksum file or checksum manifest to get
+// its detached raw ed25519 signature
+const SignatureSuffix = ".sig"
+
+// The signing configuration of the process and the keys read for it
+var (
+    signingMu     sync.Mutex
+    signing       config.SigningConfig
+    signingLoaded bool
+    signingKey    ed25519.PrivateKey
+    verifyingKey  ed25519.PublicKey
+    signingErr    error
+)
+
+// SetSigning sets the keys checksum files are signed and verified with.
+// The keys are read when first needed.
+func SetSigning(c config.SigningConfig) {
+    signingMu.Lock()
+    defer signingMu.Unlock()
+    signing, signingLoaded = c, false
+}
+
+// signaturesRequired reports whether unsigned archives fail verification
+func signaturesRequired() bool {
+    signingMu.Lock()
+    defer signingMu.Unlock()
+    return signing.Required
+}
+
+// signingKeys returns the private key, nil if checksums aren't signed, and
+// the public key, nil if signatures aren't checked
+func signingKeys() (ed25519.PrivateKey, ed25519.PublicKey, error) {
+    signingMu.Lock()
+    defer signingMu.Unlock()
+    if !signingLoaded {
+        signingKey, verifyingKey, signingErr = nil, nil, nil
+        if signing.KeyFile != "" {
+            if signingKey, signingErr = LoadSigningKey(signing.KeyFile); signingErr == nil {
+                verifyingKey = signingKey.Public().(ed25519.PublicKey)
+            }
+        } else if signing.PublicKeyFile != "" {
+            verifyingKey, signingErr = LoadPublicKey(signing.PublicKeyFile)
+        }
+        signingLoaded = true
+    }
+    return signingKey, verifyingKey, signingErr
+}
+
+// LoadSigningKey reads an ed25519 private key in PKCS#8 PEM format,
+// as produced by `openssl genpkey -algorithm ed25519`
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+    block, err := readPEM(path)
+    if err != nil {
+        return nil, err
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("unable to parse signing key: %v", err)
+    }
+    edKey, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("signing key %s is not an ed25519 key", path)
+    }
+    return edKey, nil
+}
+
+// LoadPublicKey reads an ed25519 public key in PKIX PEM format, as produced
+// by `openssl pkey -pubout`
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+    block, err := readPEM(path)
+    if err != nil {
+        return nil, err
+    }
+    key, err := x509.ParsePKIXPublicKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("unable to parse public key: %v", err)
+    }
+    edKey, ok := key.(ed25519.PublicKey)
+    if !ok {
+        return nil, fmt.Errorf("public key %s is not an ed25519 key", path)
+    }
+    return edKey, nil
+}
+
+// readPEM reads the first PEM block of a key file
+func readPEM(path string) (*pem.Block, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read key: %v", err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("key %s is not PEM encoded", path)
+    }
+    return block, nil
+}
+
+// signFile writes the signature of a file next to it. Without a signing key
+// an earlier signature is removed, since it no longer matches.
+func signFile(path string) error {
+    key, _, err := signingKeys()
+    if err != nil {
+        return err
+    }
+    if key == nil {
+        if err := os.Remove(path + SignatureSuffix); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        return nil
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    if err := os.WriteFile(path+SignatureSuffix, ed25519.Sign(key, data), 0644); err != nil {
+        return fmt.Errorf("failed to write signature: %v", err)
+    }
+    return nil
+}
+
+// ChecksumSignature returns the base64 encoded signature of the checksum
+// file of an archive named name with the checksum sum, as uploaded with
+// copies of the archive, or an empty string if checksums aren't signed
+func ChecksumSignature(sum, name string) (string, error) {
+    key, _, err := signingKeys()
+    if err != nil || key == nil {
+        return "", err
+    }
+    line := fmt.Sprintf("%s  %s\n", sum, name)
+    return base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(line))), nil
+}
+
+// IsSigned reports whether the checksum file of an archive has a signature
+func IsSigned(path string) bool {
+    _, err := os.Stat(path + ChecksumSuffix + SignatureSuffix)
+    return err == nil
+}
+
+// VerifySignature checks the signature of a checksum file or checksum
+// manifest. It returns whether a signature was checked. A signed file that
+// is missing, or a missing signature when signatures are required, is an
+// error; signatures are only checked if a key is configured.
+func VerifySignature(path string) (bool, error) {
+    _, public, err := signingKeys()
+    if err != nil {
+        return false, err
+    }
+    data, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return false, err
+    }
+    exists := err == nil
+    signature, err := os.ReadFile(path + SignatureSuffix)
+    if err != nil {
+        if !os.IsNotExist(err) {
+            return false, err
+        }
+        if signaturesRequired() {
+            return false, fmt.Errorf("%s is not signed", path)
+        }
+        return false, nil
+    }
+    if !exists {
+        return false, fmt.Errorf("%s was removed although it is signed", path)
+    }
+    if public == nil {
+        return false, nil
+    }
+    if !ed25519.Verify(public, data, signature) {
+        return false, fmt.Errorf("signature mismatch: %s was altered or signed with another key", path)
+    }
+    return true, nil
+}
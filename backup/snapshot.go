@@ -0,0 +1,109 @@
+package backup
+
+import (
+    "archive/tar"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// SnapshotExt is the extension of snapshot directories. A snapshot is a copy
+// of a site's document root synchronized with rsync, whose unchanged files
+// are hard links to the files of the previous snapshot.
+const SnapshotExt = ".snapshot"
+
+// IsSnapshot reports whether path is a snapshot directory
+func IsSnapshot(path string) bool {
+    return strings.HasSuffix(path, SnapshotExt)
+}
+
+// openSnapshot returns a reader of a snapshot as a tar stream, so snapshots
+// are verified, restored and uploaded like file archives. The stream only
+// depends on the snapshot's content and metadata, so its checksum detects
+// changes to the snapshot.
+func openSnapshot(dir string) (io.ReadCloser, error) {
+    if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+        return nil, fmt.Errorf("failed to open snapshot %s: not a directory", dir)
+    }
+    pr, pw := io.Pipe()
+    go func() {
+        pw.CloseWithError(writeSnapshotTar(pw, dir))
+    }()
+    return pr, nil
+}
+
+// writeSnapshotTar writes the files, directories and symlinks of a snapshot
+// as a tar stream in walk order
+func writeSnapshotTar(w io.Writer, dir string) error {
+    tw := tar.NewWriter(w)
+    err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        relPath, err := filepath.Rel(dir, path)
+        if err != nil {
+            return fmt.Errorf("failed to get relative path: %v", err)
+        }
+        if relPath == "." {
+            return nil
+        }
+
+        var link string
+        if info.Mode()&os.ModeSymlink != 0 {
+            if link, err = os.Readlink(path); err != nil {
+                return fmt.Errorf("failed to read symlink: %v", err)
+            }
+        } else if !info.Mode().IsRegular() && !info.IsDir() {
+            return nil
+        }
+        header, err := tar.FileInfoHeader(info, link)
+        if err != nil {
+            return fmt.Errorf("failed to create tar header: %v", err)
+        }
+        // Times that change when files are linked into the next snapshot
+        header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+        header.Name = filepath.ToSlash(relPath)
+        if info.IsDir() {
+            header.Name += "/"
+        }
+        if err := tw.WriteHeader(header); err != nil {
+            return fmt.Errorf("failed to write tar header: %v", err)
+        }
+        if !info.Mode().IsRegular() {
+            return nil
+        }
+
+        file, err := os.Open(path)
+        if err != nil {
+            return fmt.Errorf("failed to open file: %v", err)
+        }
+        defer file.Close()
+        if _, err := io.Copy(tw, file); err != nil {
+            return fmt.Errorf("failed to read %s: %v", relPath, err)
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    return tw.Close()
+}
+
+// latestSnapshot returns the newest snapshot in a site's backup directory,
+// or an empty path if there is none
+func latestSnapshot(siteDir string) string {
+    archives, err := listSiteArchives("", siteDir)
+    if err != nil {
+        return ""
+    }
+    var latest Archive
+    for _, a := range archives {
+        if IsSnapshot(a.Path) && !a.Time.Before(latest.Time) {
+            latest = a
+        }
+    }
+    return latest.Path
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+    "fmt"
+    "log/slog"
+    "sort"
+)
+
+// siteArchives returns the archives of a site in the backup directory, oldest first
+func (bm *BackupManager) siteArchives(siteName string) ([]Archive, error) {
+    archives, err := ListArchives(bm.BaseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list archives: %v", err)
+    }
+    var own []Archive
+    for _, a := range archives {
+        if a.Site == siteName {
+            own = append(own, a)
+        }
+    }
+    return own, nil
+}
+
+// EstimateDumpSize estimates the size of a site's next dump from its latest
+// one, with a quarter added for growth. Without a previous dump it is zero.
+func (bm *BackupManager) EstimateDumpSize(siteName string) ByteSize {
+    return bm.estimateDumpSize(siteName, "database")
+}
+
+// estimateDumpSize estimates the size of a site's next dump of an archive
+// type like EstimateDumpSize
+func (bm *BackupManager) estimateDumpSize(siteName, archiveType string) ByteSize {
+    archives, err := bm.siteArchives(siteName)
+    if err != nil {
+        return 0
+    }
+    for i := len(archives) - 1; i >= 0; i-- {
+        if archives[i].Type == archiveType {
+            return ByteSize(archives[i].Size + archives[i].Size/4)
+        }
+    }
+    return 0
+}
+
+// CheckSpace makes room for a new archive of about needed bytes of a site
+// and checks that it fits, before the archive is created. Archives over the
+// site's quota are evicted oldest first. The backup volume must then have
+// needed bytes free besides MinFreeSpace, so a backup fails early instead
+// of filling the disk.
+func (bm *BackupManager) CheckSpace(siteName, component string, needed ByteSize) error {
+    if quota := bm.Budgets.For(siteName).Quota; quota != 0 {
+        if err := bm.enforceQuota(siteName, quota, needed); err != nil {
+            return err
+        }
+    }
+
+    free, err := FreeSpace(bm.BaseDir)
+    if err != nil {
+        slog.Warn("Unable to check free space", "site", siteName, "path", bm.BaseDir, "error", err)
+        return nil
+    }
+    if free < needed+bm.MinFreeSpace {
+        return fmt.Errorf("not enough space for the %s backup in %s: %s free, %s needed (%s estimated, %s kept free)",
+            component, bm.BaseDir, free, needed+bm.MinFreeSpace, needed, bm.MinFreeSpace)
+    }
+    return nil
+}
+
+// enforceQuota removes the oldest archives of a site until its archives and
+// a new one of needed bytes fit in quota. The newest archive of each type is
+// never removed, and a full archive only together with the incremental
+// archives building on it; archives that kept ones build on are kept, and
+// so are locked ones.
+func (bm *BackupManager) enforceQuota(siteName string, quota, needed ByteSize) error {
+    archives, err := bm.siteArchives(siteName)
+    if err != nil {
+        return err
+    }
+    var used ByteSize
+    var files, physical, dumps []string
+    sizes := make(map[string]ByteSize)
+    for _, a := range archives {
+        used += ByteSize(a.Size)
+        sizes[a.Path] = ByteSize(a.Size)
+        switch a.Type {
+        case "file":
+            files = append(files, a.Path)
+        case PhysicalArchiveType:
+            physical = append(physical, a.Path)
+        default:
+            dumps = append(dumps, a.Path)
+        }
+    }
+    if used+needed <= quota {
+        return nil
+    }
+
+    keep := make(map[string]bool)
+    for _, paths := range [][]string{files, physical, dumps} {
+        sortNewestFirst(paths)
+        if len(paths) > 0 {
+            keep[paths[0]] = true
+        }
+    }
+    for _, a := range archives {
+        if bm.locked(a.Path) {
+            keep[a.Path] = true
+        }
+    }
+    keepChains(files, keep)
+    keepChains(physical, keep)
+
+    // Archives removed together, the oldest first: a dump, or a full file
+    // archive or physical database backup and the incremental ones
+    // following it
+    var units [][]string
+    for _, paths := range [][]string{files, physical} {
+        first := len(units)
+        for i := len(paths) - 1; i >= 0; i-- {
+            if keep[paths[i]] {
+                continue
+            }
+            if IsIncremental(paths[i]) && len(units) > first {
+                units[len(units)-1] = append(units[len(units)-1], paths[i])
+            } else {
+                units = append(units, []string{paths[i]})
+            }
+        }
+    }
+    for _, path := range dumps {
+        if !keep[path] {
+            units = append(units, []string{path})
+        }
+    }
+    sort.SliceStable(units, func(i, j int) bool {
+        return archiveTime(units[i][0]).Before(archiveTime(units[j][0]))
+    })
+
+    for _, unit := range units {
+        if used+needed <= quota {
+            break
+        }
+        for _, path := range unit {
+            if err := bm.removeArchive(path); err != nil {
+                return fmt.Errorf("failed to remove %s to stay within the quota: %v", path, err)
+            }
+            used -= sizes[path]
+            slog.Info("Removed archive over quota", "site", siteName, "path", path, "size", sizes[path], "quota", quota)
+        }
+    }
+    if used+needed > quota {
+        return fmt.Errorf("quota of %s exceeded: the latest archives take %s, %s needed", quota, used, needed)
+    }
+    return nil
+}
@@ -0,0 +1,382 @@
+package backup
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "hash"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/storage"
+)
+
+// PartsExt is appended to the path of a split archive to get the path of
+// the manifest listing its parts
+const PartsExt = ".parts"
+
+// partPattern matches the names of the parts of split archives
+var partPattern = regexp.MustCompile(`\.part[0-9]{2,}$`)
+
+// partsManifest lists the parts of a split archive in order
+type partsManifest struct {
+    // Size of the whole archive and the size of every part but the last
+    Size     int64         `json:"size"`
+    PartSize int64         `json:"part_size"`
+    Parts    []archivePart `json:"parts"`
+}
+
+// archivePart is a part of a split archive, named relative to the archive's
+// directory
+type archivePart struct {
+    Name   string `json:"name"`
+    Size   int64  `json:"size"`
+    SHA256 string `json:"sha256"`
+}
+
+// partPath returns the path of the nth part of an archive, counting from 1,
+// e.g. files_<ts>.tar.gz.part01
+func partPath(path string, n int) string {
+    return fmt.Sprintf("%s.part%02d", path, n)
+}
+
+// IsSplit reports whether an archive is stored as parts
+func IsSplit(path string) bool {
+    _, err := os.Stat(path + PartsExt)
+    return err == nil
+}
+
+// readParts reads the manifest of a split archive
+func readParts(path string) (*partsManifest, error) {
+    data, err := os.ReadFile(path + PartsExt)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read parts of %s: %v", filepath.Base(path), err)
+    }
+    var m partsManifest
+    if err := json.Unmarshal(data, &m); err != nil {
+        return nil, fmt.Errorf("failed to parse parts of %s: %v", filepath.Base(path), err)
+    }
+    if len(m.Parts) == 0 {
+        return nil, fmt.Errorf("%s%s lists no parts", filepath.Base(path), PartsExt)
+    }
+    return &m, nil
+}
+
+// splitArchive replaces an archive by parts of at most partSize bytes and
+// the manifest listing them, and returns the number of parts. The archive
+// is only removed once all parts and the manifest are written.
+func splitArchive(path string, partSize ByteSize) (int, error) {
+    in, err := os.Open(path)
+    if err != nil {
+        return 0, fmt.Errorf("failed to open archive: %v", err)
+    }
+    defer in.Close()
+
+    m := partsManifest{PartSize: int64(partSize)}
+    var written []string
+    fail := func(err error) (int, error) {
+        for _, part := range written {
+            os.Remove(part)
+        }
+        return 0, err
+    }
+    for n := 1; ; n++ {
+        part := partPath(path, n)
+        out, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+        if err != nil {
+            return fail(fmt.Errorf("failed to create part: %v", err))
+        }
+        written = append(written, part)
+        h := sha256.New()
+        size, err := io.CopyN(io.MultiWriter(out, h), in, int64(partSize))
+        if closeErr := out.Close(); closeErr != nil && (err == nil || err == io.EOF) {
+            err = closeErr
+        }
+        if err != nil && err != io.EOF {
+            return fail(fmt.Errorf("failed to write part %s: %v", filepath.Base(part), err))
+        }
+        if size == 0 && n > 1 {
+            // The archive ended with the previous part
+            os.Remove(part)
+            break
+        }
+        m.Parts = append(m.Parts, archivePart{Name: filepath.Base(part), Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+        m.Size += size
+        if err == io.EOF {
+            break
+        }
+    }
+
+    data, err := json.MarshalIndent(m, "", "  ")
+    if err != nil {
+        return fail(fmt.Errorf("failed to encode parts: %v", err))
+    }
+    tmp := path + PartsExt + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fail(fmt.Errorf("failed to write parts: %v", err))
+    }
+    if err := os.Rename(tmp, path+PartsExt); err != nil {
+        os.Remove(tmp)
+        return fail(fmt.Errorf("failed to write parts: %v", err))
+    }
+    if err := os.Remove(path); err != nil {
+        return len(m.Parts), fmt.Errorf("failed to remove split archive: %v", err)
+    }
+    return len(m.Parts), nil
+}
+
+// joinArchive replaces the parts of a split archive and their manifest by
+// the whole archive, checking every part on the way
+func joinArchive(path string) error {
+    in, err := openArchiveFile(path)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    files := archiveFiles(path)
+
+    tmp := path + ".joining"
+    out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to create archive: %v", err)
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        os.Remove(tmp)
+        return err
+    }
+    if err := out.Close(); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("failed to write archive: %v", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("failed to write archive: %v", err)
+    }
+    for _, file := range files {
+        os.Remove(file)
+    }
+    return nil
+}
+
+// partsReader reads the parts of a split archive one after the other. A
+// part that is missing, truncated or differs from its checksum in the
+// manifest fails the read at its end.
+type partsReader struct {
+    dir   string
+    parts []archivePart
+    file  *os.File
+    hash  hash.Hash
+    read  int64
+}
+
+// Read reads from the current part, moving on to the next at its end
+func (r *partsReader) Read(p []byte) (int, error) {
+    for {
+        if r.file == nil {
+            if len(r.parts) == 0 {
+                return 0, io.EOF
+            }
+            file, err := os.Open(filepath.Join(r.dir, r.parts[0].Name))
+            if err != nil {
+                return 0, fmt.Errorf("failed to open part: %v", err)
+            }
+            r.file, r.hash, r.read = file, sha256.New(), 0
+        }
+        n, err := r.file.Read(p)
+        r.hash.Write(p[:n])
+        r.read += int64(n)
+        if err == io.EOF {
+            part := r.parts[0]
+            r.file.Close()
+            r.file = nil
+            r.parts = r.parts[1:]
+            if r.read != part.Size {
+                return n, fmt.Errorf("part %s has %d bytes instead of %d", part.Name, r.read, part.Size)
+            }
+            if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != part.SHA256 {
+                return n, fmt.Errorf("checksum mismatch of part %s", part.Name)
+            }
+            err = nil
+        }
+        if n > 0 || err != nil {
+            return n, err
+        }
+    }
+}
+
+// Close closes the current part
+func (r *partsReader) Close() error {
+    if r.file == nil {
+        return nil
+    }
+    return r.file.Close()
+}
+
+// openArchiveFile opens the file of an archive for reading as it was
+// written, reassembling the parts of a split archive
+func openArchiveFile(path string) (io.ReadCloser, error) {
+    if !IsSplit(path) {
+        return os.Open(path)
+    }
+    m, err := readParts(path)
+    if err != nil {
+        return nil, err
+    }
+    return &partsReader{dir: filepath.Dir(path), parts: m.Parts}, nil
+}
+
+// archiveExists reports whether an archive is on disk, whole or split
+func archiveExists(path string) bool {
+    if _, err := os.Stat(path); err == nil {
+        return true
+    }
+    return IsSplit(path)
+}
+
+// archiveFileSize returns the size of an archive on disk, for a split
+// archive the size of its parts together
+func archiveFileSize(path string) (int64, error) {
+    if IsSplit(path) {
+        m, err := readParts(path)
+        if err != nil {
+            return 0, err
+        }
+        return m.Size, nil
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return 0, err
+    }
+    return info.Size(), nil
+}
+
+// archiveFiles returns the files an archive is stored in: the archive
+// itself, or the parts of a split archive and their manifest
+func archiveFiles(path string) []string {
+    if !IsSplit(path) {
+        return []string{path}
+    }
+    var files []string
+    if m, err := readParts(path); err == nil {
+        for _, part := range m.Parts {
+            files = append(files, filepath.Join(filepath.Dir(path), part.Name))
+        }
+    } else {
+        parts, _ := filepath.Glob(path + ".part[0-9][0-9]*")
+        files = append(files, parts...)
+    }
+    return append(files, path+PartsExt)
+}
+
+// isOrphanPart reports whether a file is a part without the manifest of
+// its archive, left behind by an interrupted split
+func isOrphanPart(path string) bool {
+    loc := partPattern.FindStringIndex(path)
+    if loc == nil {
+        return false
+    }
+    archive := path[:loc[0]]
+    return isArchiveName(archive) && !IsSplit(archive)
+}
+
+// archiveEncryptedFile reports whether the content of an archive file, whole
+// or split, is encrypted; the header is in the first part
+func archiveEncryptedFile(path string) (bool, error) {
+    if IsSplit(path) {
+        return encryption.IsEncrypted(partPath(path, 1))
+    }
+    return encryption.IsEncrypted(path)
+}
+
+// splitLarge splits a new archive larger than the configured part size and
+// returns the number of its parts, zero if it is kept whole. Snapshots and
+// deduplicated archives are never split.
+func (bm *BackupManager) splitLarge(path string) (int, error) {
+    if bm.SplitSize <= 0 || IsSnapshot(path) || dedup.IsIndex(path) {
+        return 0, nil
+    }
+    info, err := os.Stat(path)
+    if err != nil || info.Size() <= int64(bm.SplitSize) {
+        return 0, nil
+    }
+    parts, err := splitArchive(path, bm.SplitSize)
+    if err != nil {
+        return 0, err
+    }
+    slog.Info("Split archive into parts", "path", path, "parts", parts, "part_size", bm.SplitSize)
+    return parts, nil
+}
+
+// putArchive uploads an archive under key with metadata. A split archive is
+// uploaded as its parts, each under key with the part's suffix and its own
+// checksum, followed by its manifest under key with PartsExt, which carries
+// the metadata of the whole archive.
+func putArchive(uploader storage.Uploader, key, path string, metadata map[string]string) error {
+    if !IsSplit(path) {
+        return uploader.PutObject(key, path, metadata)
+    }
+    m, err := readParts(path)
+    if err != nil {
+        return err
+    }
+    for _, part := range m.Parts {
+        suffix := strings.TrimPrefix(part.Name, filepath.Base(path))
+        if err := uploader.PutObject(key+suffix, filepath.Join(filepath.Dir(path), part.Name), map[string]string{"sha256": part.SHA256}); err != nil {
+            return err
+        }
+    }
+    return uploader.PutObject(key+PartsExt, path+PartsExt, metadata)
+}
+
+// deleteArchive deletes an archive uploaded by putArchive under key, with
+// the given number of parts if it was split
+func deleteArchive(deleter storage.Deleter, key string, parts int) error {
+    if parts == 0 {
+        return deleter.DeleteObject(key)
+    }
+    if err := deleter.DeleteObject(key + PartsExt); err != nil {
+        return err
+    }
+    for n := 1; n <= parts; n++ {
+        if err := deleter.DeleteObject(partPath(key, n)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// getArchive downloads an archive uploaded by putArchive under key to path,
+// with its parts and manifest if it was split. A split archive is checked
+// part by part while it is read.
+func getArchive(fetcher storage.Fetcher, key, path string, parts int) error {
+    if parts == 0 {
+        return fetcher.GetObject(key, path)
+    }
+    manifest := path + PartsExt + ".fetch"
+    defer os.Remove(manifest)
+    if err := fetcher.GetObject(key+PartsExt, manifest); err != nil {
+        return err
+    }
+    data, err := os.ReadFile(manifest)
+    if err != nil {
+        return err
+    }
+    var m partsManifest
+    if err := json.Unmarshal(data, &m); err != nil {
+        return fmt.Errorf("failed to parse parts of %s: %v", filepath.Base(path), err)
+    }
+    for _, part := range m.Parts {
+        suffix := strings.TrimPrefix(part.Name, filepath.Base(path))
+        if err := fetcher.GetObject(key+suffix, filepath.Join(filepath.Dir(path), part.Name)); err != nil {
+            return err
+        }
+    }
+    return os.Rename(manifest, path+PartsExt)
+}
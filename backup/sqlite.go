@@ -0,0 +1,183 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+)
+
+// sqliteHeader starts every SQLite database file
+const sqliteHeader = "SQLite format 3\x00"
+
+// sqliteBusyTimeout makes sqlite3 wait for locks held by the application
+// instead of failing right away, in milliseconds
+const sqliteBusyTimeout = "30000"
+
+// SQLiteBackup handles SQLite database backups
+type SQLiteBackup struct {
+    manager *BackupManager
+}
+
+// NewSQLiteBackup creates a new SQLite backup handler
+func NewSQLiteBackup(manager *BackupManager) *SQLiteBackup {
+    return &SQLiteBackup{manager: manager}
+}
+
+// BackupDatabase copies the site's SQLite database with the online backup
+// API of sqlite3 and returns the path of the copy. Unlike copying the file,
+// this gives a consistent database while the application writes to it.
+func (sb *SQLiteBackup) BackupDatabase(ctx context.Context, siteName, dbPath string) (string, error) {
+    if _, err := os.Stat(dbPath); err != nil {
+        return "", fmt.Errorf("failed to access SQLite database: %v", err)
+    }
+
+    tempDir, err := NewTempDir(siteName)
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(tempDir)
+    copyPath := filepath.Join(tempDir, "database.sqlite")
+
+    if err := runSQLite(ctx, dbPath, ".backup "+sqliteQuote(copyPath)); err != nil {
+        return "", err
+    }
+    if err := checkSQLiteIntegrity(ctx, copyPath); err != nil {
+        return "", err
+    }
+
+    return sb.manager.storeDump(ctx, siteName, sqliteDumpExt, func(w io.Writer) error {
+        f, err := os.Open(copyPath)
+        if err != nil {
+            return fmt.Errorf("failed to open database copy: %v", err)
+        }
+        defer f.Close()
+        if _, err := io.Copy(w, &contextReader{ctx: ctx, r: f}); err != nil {
+            return contextError(ctx, fmt.Errorf("failed to write database copy: %v", err))
+        }
+        return nil
+    })
+}
+
+// checkSQLiteIntegrity runs SQLite's integrity check on a database file
+func checkSQLiteIntegrity(ctx context.Context, path string) error {
+    cmd := exec.CommandContext(ctx, "sqlite3", "-readonly", path, "PRAGMA integrity_check;")
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    out, err := cmd.Output()
+    if err != nil {
+        return contextError(ctx, fmt.Errorf("failed to run sqlite3: %v, error output: %s", err, stderr.String()))
+    }
+    if result := strings.TrimSpace(string(out)); result != "ok" {
+        return fmt.Errorf("SQLite integrity check failed: %s", result)
+    }
+    return nil
+}
+
+// restoreSQLite replaces the contents of an SQLite database with a copy read
+// from r, using the online backup API so open connections see either the old
+// or the new database
+func restoreSQLite(r io.Reader, dbPath string) error {
+    tempDir, err := NewTempDir(filepath.Base(dbPath))
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(tempDir)
+    copyPath := filepath.Join(tempDir, "database.sqlite")
+
+    f, err := os.OpenFile(copyPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to create database copy: %v", err)
+    }
+    if _, err := io.Copy(f, r); err != nil {
+        f.Close()
+        return fmt.Errorf("failed to write database copy: %v", err)
+    }
+    if err := f.Close(); err != nil {
+        return fmt.Errorf("failed to write database copy: %v", err)
+    }
+    if err := checkSQLiteIntegrity(context.Background(), copyPath); err != nil {
+        return err
+    }
+    return runSQLite(context.Background(), dbPath, ".restore "+sqliteQuote(copyPath))
+}
+
+// createSQLiteDatabase creates an empty SQLite database file. It fails if the
+// file exists, so nothing is overwritten.
+func createSQLiteDatabase(dbPath string) error {
+    if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+        return fmt.Errorf("failed to create directory: %v", err)
+    }
+    f, err := os.OpenFile(dbPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to create database %s: %v", dbPath, err)
+    }
+    return f.Close()
+}
+
+// runSQLite runs a dot-command of sqlite3 on a database
+func runSQLite(ctx context.Context, dbPath, command string) error {
+    cmd := exec.CommandContext(ctx, "sqlite3", "-bail", "-cmd", ".timeout "+sqliteBusyTimeout, dbPath, command)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    cmd.Stdout = &stderr
+    if err := cmd.Run(); err != nil {
+        return contextError(ctx, fmt.Errorf("failed to run sqlite3: %v, error output: %s", err, stderr.String()))
+    }
+    return nil
+}
+
+// sqliteRemoteCommand returns a shell command running the .backup or .restore
+// dot-command of sqlite3 on a remote database through a temporary file, with
+// transfer copying the file to standard output or from standard input
+func sqliteRemoteCommand(dbPath, transfer, command string) string {
+    if command == ".backup" {
+        return fmt.Sprintf(`(t=$(mktemp) && sqlite3 -bail -cmd '.timeout %s' %s ".backup '$t'" && %s; s=$?; rm -f "$t"; exit $s)`,
+            sqliteBusyTimeout, shellQuote(dbPath), transfer)
+    }
+    return fmt.Sprintf(`(t=$(mktemp) && %s && sqlite3 -bail -cmd '.timeout %s' %s ".restore '$t'"; s=$?; rm -f "$t"; exit $s)`,
+        transfer, sqliteBusyTimeout, shellQuote(dbPath))
+}
+
+// sqliteQuote quotes an argument of a sqlite3 dot-command
+func sqliteQuote(s string) string {
+    return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// checkSQLiteDump checks that a decompressed copy of an SQLite database is
+// complete: it must start with the SQLite header and, unless the page count
+// in the header is out of date, be as large as the pages it declares
+func checkSQLiteDump(r io.Reader) error {
+    header := make([]byte, 100)
+    if _, err := io.ReadFull(r, header); err != nil {
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return errors.New("SQLite database copy is truncated")
+        }
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+    if string(header[:len(sqliteHeader)]) != sqliteHeader {
+        return errors.New("not an SQLite database")
+    }
+    rest, err := io.Copy(io.Discard, r)
+    if err != nil {
+        return fmt.Errorf("failed to decompress archive: %v", err)
+    }
+
+    pageSize := int64(binary.BigEndian.Uint16(header[16:18]))
+    if pageSize == 1 {
+        pageSize = 65536
+    }
+    changeCounter := binary.BigEndian.Uint32(header[24:28])
+    pageCount := int64(binary.BigEndian.Uint32(header[28:32]))
+    validFor := binary.BigEndian.Uint32(header[92:96])
+    if validFor == changeCounter && pageCount*pageSize != int64(len(header))+rest {
+        return fmt.Errorf("SQLite database copy is incomplete: %d bytes instead of %d", int64(len(header))+rest, pageCount*pageSize)
+    }
+    return nil
+}
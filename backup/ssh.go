@@ -1,15 +1,31 @@
 package backup
 
 import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
     "fmt"
     "os"
+    "path"
     "path/filepath"
     "strings"
+    "sync"
+    "sync/atomic"
+    "github.com/pkg/sftp"
     "golang.org/x/crypto/ssh"
+    "io"
     "io/ioutil"
+    "log/slog"
     "time"
     "os/exec"
+    "sort"
     "strconv"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/retry"
+    "laravel-backup-tool/secrets"
 )
 
 const maxConcurrentSessions = 5 // Maximum number of concurrent SSH sessions
@@ -21,110 +37,286 @@ type SSHConfig struct {
     Port     string
     KeyPath  string
     Password string
-}
-
-// RemoteSite represents a Laravel site on the remote server
-type RemoteSite struct {
-    ServerName   string
-    DocumentRoot string
-    EnvContent  string
+    // known_hosts file verifying the server's host key, ~/.ssh/known_hosts if empty
+    KnownHostsFile string
+    // Accept any host key instead of verifying it
+    InsecureHostKey bool
+    // Local directory for the backups pulled from the server
+    BackupDir string
+    // Closed to stop a run before the next site; nil if the run can't be stopped
+    Stop <-chan struct{}
+    // Number of sites backed up at the same time, one if zero
+    Workers int
+    // Stream archives and dumps to the local machine instead of writing
+    // them to temporary files on the server first
+    Streaming bool
+    // Back up the files and the database of a site at the same time, so
+    // one is archived on the server while the other is transferred, and
+    // stream both, so archiving, transfer and hashing overlap as well.
+    // Sites backing up both take two sessions.
+    Pipeline bool
+    // How site files are copied, config.TransportTar or config.TransportRsync
+    Transport string
+    // Storage the server uploads archives to itself, nil to copy them here
+    Push *PushTarget
+    // Patterns of the sites backed up, all sites if empty, and of sites left out
+    Sites        []string
+    ExcludeSites []string
+    // Component backed up, "file" or "database", both if empty
+    Only string
+    // Back up regardless of the frequency, blackout windows and backups
+    // made earlier the same day
+    Force bool
+    // Back up the files of sites over their maximum size
+    AllowLarge bool
+    // Priority of archive and dump commands on the server
+    Priority config.PriorityConfig
+    // How connecting and commands failing with transient errors are retried
+    Retry retry.Policy
+    // Discover the sites and list their document roots with one command
+    // each instead of several per site
+    BatchDiscovery bool
+    // Privilege escalation of the commands run on the server
+    Become config.Become
+    // Load average per CPU above which a site waits, at most LoadWait,
+    // before it is skipped; no limit if zero
+    MaxLoad  float64
+    LoadWait time.Duration
+    // Space left free on the server besides archives staged there, the
+    // manager's MinFreeSpace if zero
+    MinFree ByteSize
+    // Stream archives that don't fit on the server instead of skipping them
+    StreamWhenLow bool
 }
 
 // SSHBackup handles remote server backup operations
 type SSHBackup struct {
     config  *SSHConfig
-    client  *ssh.Client
+    client  *ssh.Client // replaced by reconnect, read with conn
+    clientMu sync.Mutex
+    addr    string
+    clientConfig *ssh.ClientConfig
+    sftp    *sftp.Client // opened on the first transfer
+    sftpConn *ssh.Client // connection sftp was opened over
+    sftpMu  sync.Mutex
     manager *BackupManager
+    transport Transport // runs commands and reads files on the server
+    log     *slog.Logger
     sessionPool      chan *ssh.Session
     maxSessions     int
+    siteSessions    chan struct{} // sessions taken by the sites being backed up
+    siteSessionsMu  sync.Mutex    // held while a site takes its sessions
+    tempDir         string // per-run temporary directory on the remote server
+    commandTimeout  time.Duration
+    archiveTimeout  time.Duration
+    outputLimit     int
+    transferRetries int
+    remoteTimeout   bool // remote server has coreutils timeout
+    remoteSHA256    bool // remote server has coreutils sha256sum
+    checksumCommand string // command printing the SHA-256 of remote files, empty if there is none
+    pushEnv         string // file on the remote server with the push target's credentials
+    escalated       bool   // commands run with the privileges of config.Become
+    askpass         string // program on the remote server handing sudo its password
+    commands        int64 // number of commands started, accessed atomically
+    reconnects      int64 // number of times the connection was replaced, accessed atomically
+    siteResumes     int   // how often a site is resumed after the connection dropped
+    stopKeepalive   chan struct{} // closed by Close to end the keepalives
+    listings        listingCache  // document roots listed ahead of the sites' backups
 }
 
 // NewSSHBackup creates a new SSH backup handler
 func NewSSHBackup(config *SSHConfig) (*SSHBackup, error) {
-    fmt.Println("Initializing SSH backup handler...")
-    var authMethods []ssh.AuthMethod
-
-    if config.KeyPath != "" {
-        fmt.Printf("Using SSH key: %s\n", config.KeyPath)
-        key, err := ioutil.ReadFile(config.KeyPath)
-        if err != nil {
-            return nil, fmt.Errorf("unable to read private key: %v", err)
-        }
-
-        signer, err := ssh.ParsePrivateKey(key)
-        if err != nil {
-            return nil, fmt.Errorf("unable to parse private key: %v", err)
-        }
-        authMethods = append(authMethods, ssh.PublicKeys(signer))
-    }
-
-    if config.Password != "" {
-        fmt.Println("Using password authentication")
-        authMethods = append(authMethods, ssh.Password(config.Password))
-    }
-
-    sshConfig := &ssh.ClientConfig{
-        User: config.User,
-        Auth: authMethods,
-        HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-        Timeout: 30 * time.Second,
+    logger := slog.Default().With("host", config.Host)
+    logger.Debug("Initializing SSH backup handler")
+    sshConfig, err := sshClientConfig(config, logger)
+    if err != nil {
+        return nil, err
     }
 
-    fmt.Printf("Connecting to SSH server %s:%s...\n", config.Host, config.Port)
-    client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", config.Host, config.Port), sshConfig)
+    logger.Info("Connecting to SSH server", "port", config.Port)
+    addr := fmt.Sprintf("%s:%s", config.Host, config.Port)
+    var client *ssh.Client
+    err = config.Retry.Do(context.Background(), logger, "connect", func() error {
+        var err error
+        client, err = ssh.Dial("tcp", addr, sshConfig)
+        return err
+    })
     if err != nil {
         return nil, fmt.Errorf("unable to connect to SSH server: %v", err)
     }
-    fmt.Println("Successfully connected to SSH server")
+    logger.Info("Connected to SSH server")
 
     // Initialize backup manager
-    fmt.Println("Initializing backup manager...")
-    manager, err := NewBackupManager("/laravel-backup-script-ssh")
+    logger.Debug("Initializing backup manager")
+    backupDir := config.BackupDir
+    if backupDir == "" {
+        backupDir = "/laravel-backup-script-ssh"
+    }
+    manager, err := NewBackupManager(backupDir)
     if err != nil {
         client.Close()
         return nil, fmt.Errorf("failed to initialize backup manager: %v", err)
     }
+    manager.AllowLarge = config.AllowLarge
 
     sb := &SSHBackup{
         config:  config,
         client:  client,
+        addr:    addr,
+        clientConfig: sshConfig,
         manager: manager,
+        log:     logger,
         sessionPool: make(chan *ssh.Session, 10), // Start with 10 sessions, will adjust dynamically
         maxSessions: 10,
+        commandTimeout: GetEnvDuration("SSH_COMMAND_TIMEOUT", DefaultCommandTimeout),
+        archiveTimeout: GetEnvDuration("SSH_ARCHIVE_TIMEOUT", DefaultArchiveTimeout),
+        outputLimit: GetEnvInt("SSH_OUTPUT_LIMIT", DefaultOutputLimit),
+        transferRetries: GetEnvInt("SSH_TRANSFER_RETRIES", DefaultTransferRetries),
+        siteResumes: GetEnvInt("SSH_SITE_RESUMES", DefaultSiteResumes),
+        stopKeepalive: make(chan struct{}),
+    }
+    if sb.transferRetries < 1 {
+        sb.transferRetries = 1
     }
+    if sb.siteResumes < 0 {
+        sb.siteResumes = 0
+    }
+    sb.transport = &SSHTransport{sb: sb}
 
     // Initialize remote environment and test session capacity
     if err := sb.initializeEnvironment(); err != nil {
         client.Close()
         return nil, fmt.Errorf("failed to initialize environment: %v", err)
     }
+    if err := sb.checkRsync(); err != nil {
+        client.Close()
+        return nil, err
+    }
+
+    // Long commands send no data for a while; keepalives keep the
+    // connection open through NAT and detect when it died
+    if interval := GetEnvDuration("SSH_KEEPALIVE_INTERVAL", DefaultKeepaliveInterval); interval > 0 {
+        countMax := GetEnvInt("SSH_KEEPALIVE_COUNT_MAX", DefaultKeepaliveCountMax)
+        if countMax < 1 {
+            countMax = 1
+        }
+        go sb.keepalive(interval, countMax)
+    }
 
     return sb, nil
 }
 
+// sshClientConfig builds the client settings of an SSH connection: key or
+// password authentication and host key verification
+func sshClientConfig(config *SSHConfig, logger *slog.Logger) (*ssh.ClientConfig, error) {
+    var authMethods []ssh.AuthMethod
+
+    if config.KeyPath != "" {
+        logger.Debug("Using SSH key", "key_path", config.KeyPath)
+        key, err := ioutil.ReadFile(config.KeyPath)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read private key: %v", err)
+        }
+
+        signer, err := ssh.ParsePrivateKey(key)
+        if _, encrypted := err.(*ssh.PassphraseMissingError); encrypted {
+            passphrase, lookupErr := secrets.Lookup("SSH_KEY_PASSPHRASE",
+                fmt.Sprintf("Passphrase for %s", config.KeyPath))
+            if lookupErr != nil {
+                return nil, lookupErr
+            }
+            if passphrase == "" {
+                return nil, fmt.Errorf("private key %s is encrypted and SSH_KEY_PASSPHRASE is not set", config.KeyPath)
+            }
+            signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+        }
+        if err != nil {
+            return nil, fmt.Errorf("unable to parse private key: %v", err)
+        }
+        authMethods = append(authMethods, ssh.PublicKeys(signer))
+    }
+
+    if config.Password != "" {
+        logger.Debug("Using password authentication")
+        authMethods = append(authMethods, ssh.Password(config.Password))
+    }
+
+    hostKeyCallback, err := hostKeyCallback(config)
+    if err != nil {
+        return nil, err
+    }
+    return &ssh.ClientConfig{
+        User: config.User,
+        Auth: authMethods,
+        HostKeyCallback: hostKeyCallback,
+        Timeout: 30 * time.Second,
+    }, nil
+}
+
+// Manager returns the backup manager of the local copies of remote backups
+func (sb *SSHBackup) Manager() *BackupManager {
+    return sb.manager
+}
+
+// Transport returns the transport running commands and reading files on the server
+func (sb *SSHBackup) Transport() Transport {
+    return sb.transport
+}
+
 // initializeEnvironment sets up the remote environment and tests session capacity
 func (sb *SSHBackup) initializeEnvironment() error {
-    fmt.Println("Initializing remote environment...")
-    
-    // Create backup directory
-    session, err := sb.client.NewSession()
+    sb.log.Debug("Initializing remote environment")
+    ctx := context.Background()
+
+    // Wrap remote commands with coreutils timeout when available
+    if _, err := sb.execute(ctx, "command -v timeout", sb.commandTimeout); err == nil {
+        sb.remoteTimeout = true
+    } else {
+        sb.log.Warn("timeout is not available on the remote server, relying on SSH signals to stop hung commands")
+    }
+    // Downloads are compared with the checksum of the remote file
+    for _, command := range remoteChecksumCommands {
+        if _, err := sb.execute(ctx, "command -v "+strings.Fields(command)[0], sb.commandTimeout); err == nil {
+            sb.checksumCommand = command
+            break
+        }
+    }
+    sb.remoteSHA256 = sb.checksumCommand == "sha256sum"
+    if sb.checksumCommand == "" {
+        sb.log.Warn("Neither sha256sum, shasum, sha256 nor openssl is available on the remote server, downloads are only compared with the size of the remote files")
+    }
+
+    // Each run works in its own directory so concurrent runs never touch each
+    // other's files; directories of crashed runs are removed after a day
+    root := remoteTempRoot()
+    cmd := fmt.Sprintf("mkdir -p %[1]s && find %[1]s -mindepth 1 -maxdepth 1 -name 'run-*' -mmin +%[2]d -exec rm -rf {} + 2>/dev/null; mktemp -d %[1]s/run-XXXXXXXX",
+        root, int(staleTempAge.Minutes()))
+    output, err := sb.execute(ctx, cmd, sb.commandTimeout)
     if err != nil {
-        return fmt.Errorf("failed to create session: %v", err)
+        return fmt.Errorf("failed to create backup directory: %v, output: %s", err, string(output))
+    }
+    lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+    sb.tempDir = strings.TrimSpace(lines[len(lines)-1])
+    if sb.tempDir == "" {
+        return fmt.Errorf("failed to create backup directory: mktemp returned no path")
     }
-    defer session.Close()
+    sb.log.Info("Using remote temporary directory", "dir", sb.tempDir)
 
-    if err := session.Run("mkdir -p ~/laravel-backup-temp"); err != nil {
-        return fmt.Errorf("failed to create backup directory: %v", err)
+    // The temporary directory belongs to the SSH user, so files are copied
+    // in and out of it over SFTP; everything else runs with privileges
+    if err := sb.setupBecome(ctx); err != nil {
+        sb.execute(ctx, "rm -rf "+shellQuote(sb.tempDir), sb.commandTimeout)
+        return err
     }
 
     // Test session capacity
-    fmt.Println("Testing SSH session capacity...")
+    sb.log.Debug("Testing SSH session capacity")
     var sessions []*ssh.Session
     for i := 0; i < 20; i++ { // Try up to 20 sessions
-        session, err := sb.client.NewSession()
+        session, err := sb.conn().NewSession()
         if err != nil {
             sb.maxSessions = len(sessions)
-            fmt.Printf("Maximum SSH sessions: %d\n", sb.maxSessions)
+            sb.log.Info("Found maximum SSH sessions", "sessions", sb.maxSessions)
             break
         }
         sessions = append(sessions, session)
@@ -137,15 +329,25 @@ func (sb *SSHBackup) initializeEnvironment() error {
 
     // Create session pool
     sb.sessionPool = make(chan *ssh.Session, sb.maxSessions)
-    for i := 0; i < sb.maxSessions; i++ {
-        session, err := sb.client.NewSession()
+    sb.fillSessionPool(sb.conn())
+
+    return nil
+}
+
+// fillSessionPool opens sessions over a connection until the pool is full
+func (sb *SSHBackup) fillSessionPool(client *ssh.Client) {
+    for len(sb.sessionPool) < cap(sb.sessionPool) {
+        session, err := client.NewSession()
         if err != nil {
-            continue
+            return
+        }
+        select {
+        case sb.sessionPool <- session:
+        default:
+            session.Close()
+            return
         }
-        sb.sessionPool <- session
     }
-
-    return nil
 }
 
 // getSession gets a session from the pool or creates a new one
@@ -155,7 +357,7 @@ func (sb *SSHBackup) getSession() (*ssh.Session, error) {
         return session, nil
     default:
         // If pool is empty, create new session
-        return sb.client.NewSession()
+        return sb.conn().NewSession()
     }
 }
 
@@ -174,15 +376,28 @@ func (sb *SSHBackup) releaseSession(session *ssh.Session) {
     }
 }
 
-// Close closes all sessions and connections
+// Close removes the run's remote temporary directory and closes all sessions and connections
 func (sb *SSHBackup) Close() error {
+    if sb.tempDir != "" {
+        if err := sb.runCommand(context.Background(), fmt.Sprintf("rm -rf %s", shellQuote(sb.tempDir))); err != nil {
+            sb.log.Warn("Failed to remove remote temporary directory", "dir", sb.tempDir, "error", err)
+        }
+    }
+
+    select {
+    case <-sb.stopKeepalive:
+    default:
+        close(sb.stopKeepalive)
+    }
+    sb.resetSFTP()
+
     // Close all sessions in pool
     for {
         select {
         case session := <-sb.sessionPool:
             session.Close()
         default:
-            return sb.client.Close()
+            return sb.conn().Close()
         }
     }
 }
@@ -191,30 +406,48 @@ func (sb *SSHBackup) Close() error {
 type SiteInfo struct {
     ServerName   string
     DocumentRoot string
+    EnvFile      string // .env of aliased applications, empty for sites
+    DBDriver    string
     DBHost      string
+    DBPort      string
     DBName      string
     DBUser      string
     DBPass      string
 }
 
+// hasDatabase reports whether a database is configured for the site
+func (s SiteInfo) hasDatabase() bool {
+    return s.DBName != "" && (s.DBUser != "" || s.DBDriver == DriverSQLite)
+}
+
 // gatherSiteInfo collects all site information in one session
-func (sb *SSHBackup) gatherSiteInfo() ([]SiteInfo, error) {
-    fmt.Println("Gathering site information...")
+func (sb *SSHBackup) gatherSiteInfo(ctx context.Context) ([]SiteInfo, error) {
+    sb.log.Info("Gathering site information")
+
+    // One script reads everything at once; without it every configuration
+    // and credential file takes a command of its own
+    var discovery *remoteDiscovery
+    if sb.config.BatchDiscovery {
+        d, err := sb.discover(ctx)
+        if err != nil {
+            sb.log.Warn("Failed to discover sites with a single command, reading files one by one", "error", err)
+        } else {
+            discovery = d
+        }
+    }
 
     // Try to find Apache config directory
-    fmt.Println("Looking for Apache configuration...")
-    session, err := sb.getSession()
-    if err != nil {
-        return nil, fmt.Errorf("failed to create session: %v", err)
-    }
-    findCmd := `find /etc -type f -name "httpd*.conf" 2>/dev/null || find /etc/apache2 -type f -name "*.conf" 2>/dev/null`
-    output, err := session.CombinedOutput(findCmd)
-    sb.releaseSession(session)
-    if err != nil {
-        fmt.Printf("Warning: failed to find Apache configs: %v\n", err)
+    sb.log.Debug("Looking for Apache configuration")
+    var configFiles []string
+    if discovery != nil {
+        configFiles = discovery.configs
+    } else {
+        output, err := sb.execute(ctx, configFindCommand, sb.commandTimeout)
+        if err != nil {
+            sb.log.Warn("Failed to find Apache configuration", "error", err)
+        }
+        configFiles = strings.Split(strings.TrimSpace(string(output)), "\n")
     }
-
-    configFiles := strings.Split(strings.TrimSpace(string(output)), "\n")
     if len(configFiles) == 0 {
         // Try common locations
         configFiles = []string{
@@ -236,22 +469,24 @@ func (sb *SSHBackup) gatherSiteInfo() ([]SiteInfo, error) {
     }
     configFiles = uniqueConfigs
 
-    fmt.Printf("Found config files: %v\n", configFiles)
+    sb.log.Debug("Found configuration files", "files", strings.Join(configFiles, ","))
 
     // Parse configurations
     sitesMap := make(map[string]SiteInfo)
     var currentSite SiteInfo
 
+    // Aliases may point to further Laravel applications of a site
+    type remoteAlias struct {
+        serverName, urlPath, dir string
+    }
+    var aliases []remoteAlias
+    var lastServerName, location string
+
     // Read each config file
     for _, configFile := range configFiles {
         if strings.Contains(configFile, "*") {
             // Handle wildcards
-            session, err := sb.getSession()
-            if err != nil {
-                continue
-            }
-            output, err := session.CombinedOutput(fmt.Sprintf("ls %s 2>/dev/null", configFile))
-            sb.releaseSession(session)
+            output, err := sb.execute(ctx, fmt.Sprintf("ls %s 2>/dev/null", shellGlob(configFile)), sb.commandTimeout)
             if err != nil {
                 continue
             }
@@ -266,15 +501,12 @@ func (sb *SSHBackup) gatherSiteInfo() ([]SiteInfo, error) {
         }
 
         // Read config file
-        session, err := sb.getSession()
-        if err != nil {
-            fmt.Printf("Warning: failed to create session for %s: %v\n", configFile, err)
-            continue
-        }
-        output, err := session.CombinedOutput(fmt.Sprintf("cat %s 2>/dev/null", configFile))
-        sb.releaseSession(session)
-        if err != nil {
-            fmt.Printf("Warning: failed to read config %s: %v\n", configFile, err)
+        var output []byte
+        var err error
+        if discovery != nil {
+            output = []byte(discovery.files[configFile])
+        } else if output, err = sb.execute(ctx, fmt.Sprintf("cat %s 2>/dev/null", shellQuote(configFile)), sb.commandTimeout); err != nil {
+            sb.log.Warn("Failed to read configuration", "file", configFile, "error", err)
             continue
         }
 
@@ -287,41 +519,27 @@ func (sb *SSHBackup) gatherSiteInfo() ([]SiteInfo, error) {
                 parts := strings.Fields(line)
                 if len(parts) >= 2 {
                     currentSite.ServerName = parts[1]
+                    lastServerName = parts[1]
                 }
+            } else if path, ok := config.ParseLocation(line); ok {
+                location = path
+            } else if urlPath, dir, ok := config.ParseAlias(line, location); ok && lastServerName != "" {
+                aliases = append(aliases, remoteAlias{lastServerName, urlPath, dir})
             } else if strings.HasPrefix(line, "DocumentRoot") {
                 parts := strings.Fields(line)
                 if len(parts) >= 2 {
                     currentSite.DocumentRoot = strings.Trim(parts[1], "\"")
                     if currentSite.ServerName != "" {
-                        // Try to read .env file
-                        envSession, err := sb.getSession()
-                        if err == nil {
-                            envCmd := fmt.Sprintf("cat %s/.env 2>/dev/null", currentSite.DocumentRoot)
-                            envOutput, err := envSession.CombinedOutput(envCmd)
-                            sb.releaseSession(envSession)
-                            if err == nil {
-                                // Parse .env file for database credentials
-                                envContent := string(envOutput)
-                                for _, line := range strings.Split(envContent, "\n") {
-                                    line = strings.TrimSpace(line)
-                                    if strings.HasPrefix(line, "DB_HOST=") {
-                                        currentSite.DBHost = strings.TrimPrefix(line, "DB_HOST=")
-                                    } else if strings.HasPrefix(line, "DB_DATABASE=") {
-                                        currentSite.DBName = strings.TrimPrefix(line, "DB_DATABASE=")
-                                    } else if strings.HasPrefix(line, "DB_USERNAME=") {
-                                        currentSite.DBUser = strings.TrimPrefix(line, "DB_USERNAME=")
-                                    } else if strings.HasPrefix(line, "DB_PASSWORD=") {
-                                        currentSite.DBPass = strings.TrimPrefix(line, "DB_PASSWORD=")
-                                    }
-                                }
-                            }
+                        // Read the database credentials from the application's configuration
+                        if creds, err := sb.siteCredentials(ctx, discovery, currentSite); err == nil {
+                            currentSite.setCredentials(creds)
                         }
 
                         // Only add site if it's not already in the map with the same DocumentRoot
                         key := fmt.Sprintf("%s:%s", currentSite.ServerName, currentSite.DocumentRoot)
                         if _, exists := sitesMap[key]; !exists {
                             sitesMap[key] = currentSite
-                            fmt.Printf("Found site: %s at %s\n", currentSite.ServerName, currentSite.DocumentRoot)
+                            sb.log.Info("Found site", "site", currentSite.ServerName, "document_root", currentSite.DocumentRoot)
                         }
                         currentSite = SiteInfo{} // Reset for next site
                     }
@@ -336,188 +554,681 @@ func (sb *SSHBackup) gatherSiteInfo() ([]SiteInfo, error) {
         sites = append(sites, site)
     }
 
-    fmt.Printf("Found %d unique sites\n", len(sites))
+    // Aliased Laravel applications are backed up as sub-components of their site
+    seenApps := make(map[string]bool)
+    for _, alias := range aliases {
+        root := sb.laravelApp(ctx, discovery, alias.dir)
+        if root == "" {
+            continue
+        }
+        isSiteRoot := false
+        for _, site := range sites {
+            if site.ServerName == alias.serverName &&
+                (root == site.DocumentRoot || root == filepath.Dir(site.DocumentRoot)) {
+                isSiteRoot = true
+            }
+        }
+        key := AppKey(alias.serverName, config.AppName(alias.urlPath))
+        if isSiteRoot || seenApps[key] {
+            continue
+        }
+        seenApps[key] = true
+
+        app := SiteInfo{ServerName: key, DocumentRoot: alias.dir, EnvFile: root + "/.env"}
+        if creds, err := sb.siteCredentials(ctx, discovery, app); err == nil {
+            app.setCredentials(creds)
+        }
+        sites = append(sites, app)
+        sb.log.Info("Found application", "site", key, "document_root", alias.dir)
+    }
+
+    sb.log.Info("Found sites", "count", len(sites))
     return sites, nil
 }
 
-// BackupRemoteSites performs backup of all sites on the remote server
-func (sb *SSHBackup) BackupRemoteSites() error {
+// dispatch hands a site to the next free worker. It returns false without
+// doing so if the run is stopped or ctx is cancelled before or while waiting.
+func (sb *SSHBackup) dispatch(ctx context.Context, queue chan<- SiteInfo, site SiteInfo) bool {
+    select {
+    case <-sb.config.Stop:
+        return false
+    case <-ctx.Done():
+        return false
+    default:
+    }
+    select {
+    case queue <- site:
+        return true
+    case <-sb.config.Stop:
+        return false
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// BackupRemoteSites performs backup of all sites on the remote server. When
+// ctx is cancelled, running commands are killed, the remaining sites are
+// skipped and the cause is returned.
+func (sb *SSHBackup) BackupRemoteSites(ctx context.Context) error {
     // Gather all site information first
-    sites, err := sb.gatherSiteInfo()
+    sites, err := sb.gatherSiteInfo(ctx)
     if err != nil {
         return fmt.Errorf("failed to gather site information: %v", err)
     }
 
-    // Clean existing files in temp directory
-    fmt.Println("Cleaning temporary directory...")
-    err = sb.runCommand("rm -rf ~/laravel-backup-temp/* && mkdir -p ~/laravel-backup-temp")
-    if err != nil {
-        return fmt.Errorf("failed to clean remote temp directory: %v", err)
+    found := len(sites)
+    sites = filterSites(sites, sb.config.Sites, sb.config.ExcludeSites)
+    if len(sites) < found {
+        sb.log.Info("Backing up selected sites", "selected", len(sites), "found", found)
+    }
+    // Sites in a blackout window are backed up by a later run
+    if !sb.config.Force {
+        var open []SiteInfo
+        for _, site := range sites {
+            if window, ok := sb.manager.Blackout(site.ServerName); ok {
+                sb.log.Info("Skipping site in blackout window", "site", site.ServerName, "window", window)
+                continue
+            }
+            open = append(open, site)
+        }
+        sites = open
+    }
+    if sb.config.BatchDiscovery && sb.config.Only != "database" {
+        sb.prefetchListings(ctx, sites)
+    }
+    runID := time.Now().Format("20060102-150405")
+
+    // The push target's credentials are only on the server during the run
+    if sb.config.Push != nil {
+        removeCredentials, err := sb.provisionPush(ctx)
+        if err != nil {
+            return fmt.Errorf("failed to prepare pushing archives: %v", err)
+        }
+        defer removeCredentials()
     }
 
-    // Backup each site sequentially
+    // Back up as many sites at a time as the server allows sessions, or
+    // fewer when the server's workers are limited. Pipelined sites wait for
+    // a second session.
+    workers := sb.maxSessions
+    if sb.config.Workers > 0 && sb.config.Workers < workers {
+        workers = sb.config.Workers
+    }
+    if workers < 1 {
+        workers = 1
+    }
+    sb.siteSessions = make(chan struct{}, max(sb.maxSessions, 1))
+    sb.log.Info("Backing up remote sites", "sites", len(sites), "workers", workers)
+
+    var (
+        mu      sync.Mutex
+        results = make(map[string][]catalog.RunStatus)
+        dispatched []string
+    )
+    queue := make(chan SiteInfo)
+    var wg sync.WaitGroup
+    for i := 0; i < workers; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for site := range queue {
+                statuses := sb.isolateSite(ctx, site, runID)
+                mu.Lock()
+                results[site.ServerName] = statuses
+                mu.Unlock()
+            }
+        }()
+    }
     for _, site := range sites {
-        fmt.Printf("Starting backup check for %s...\n", site.ServerName)
-        
-        // Create local backup directory
-        localDir := filepath.Join(sb.manager.BaseDir, site.ServerName)
-        if err := os.MkdirAll(localDir, 0755); err != nil {
-            fmt.Printf("Error creating local directory for %s: %v\n", site.ServerName, err)
-            continue
+        if !sb.dispatch(ctx, queue, site) {
+            if ctx.Err() == nil {
+                sb.log.Info("Stopping remote backups, the remaining sites are backed up by the next run")
+            }
+            break
         }
+        dispatched = append(dispatched, site.ServerName)
+    }
+    close(queue)
+    wg.Wait()
 
-        // Check if we have today's backup already
-        today := time.Now().Format("2006-01-02")
-        hasBackupToday := false
-        
-        // Check for existing backups
-        files, err := os.ReadDir(localDir)
-        if err == nil {
-            for _, file := range files {
-                if strings.Contains(file.Name(), today) {
-                    hasBackupToday = true
-                    break
-                }
+    sb.reportSiteResults(dispatched, results)
+    if ctx.Err() != nil {
+        return fmt.Errorf("remote backups cancelled after %d of %d sites: %v", len(dispatched), len(sites), context.Cause(ctx))
+    }
+    return nil
+}
+
+// isolateSite backs up a remote site, turning a panic into a failure of the
+// site so the other sites of the run are still backed up. The site's health
+// check learns about the start and the outcome.
+func (sb *SSHBackup) isolateSite(ctx context.Context, site SiteInfo, runID string) (statuses []catalog.RunStatus) {
+    started := time.Now()
+    sb.manager.PingStart(ctx, site.ServerName)
+    defer func() {
+        var failures []string
+        for _, status := range statuses {
+            if status.Failed() {
+                failures = append(failures, status.Component+": "+status.Error)
             }
         }
+        sb.manager.PingFinish(ctx, site.ServerName, started, failures)
+    }()
+    defer func() {
+        if r := recover(); r != nil {
+            err := fmt.Errorf("backup aborted: %v", r)
+            sb.log.Error("Site backup aborted", "site", site.ServerName, "error", err)
+            statuses = []catalog.RunStatus{componentStatus(runID, site.ServerName, "file", false, err)}
+            sb.recordRunStatuses(statuses)
+        }
+    }()
+    return sb.resumeSite(ctx, site, runID)
+}
 
-        if hasBackupToday {
-            fmt.Printf("Backup for %s already exists today, skipping...\n", site.ServerName)
-            continue
+// resumeSite backs up a remote site. If the SSH connection dropped during
+// the backup and a component failed, the site is backed up again over a new
+// connection, up to the configured number of resumes; components that
+// succeeded are not repeated. The statuses of the last attempt are returned
+// together with those of the components finished before.
+func (sb *SSHBackup) resumeSite(ctx context.Context, site SiteInfo, runID string) []catalog.RunStatus {
+    finished := make(map[string]catalog.RunStatus)
+    for attempt := 0; ; attempt++ {
+        reconnects := atomic.LoadInt64(&sb.reconnects)
+        statuses := sb.backupRemoteSite(ctx, site, runID, finished)
+        failed := false
+        for _, status := range statuses {
+            if status.Failed() {
+                failed = true
+            }
+        }
+        for component, status := range finished {
+            if !hasComponent(statuses, component) {
+                statuses = append(statuses, status)
+            }
+        }
+        sort.SliceStable(statuses, func(i, j int) bool {
+            return statuses[i].Component == "file" && statuses[j].Component != "file"
+        })
+        if !failed || attempt >= sb.siteResumes || ctx.Err() != nil || sb.stopped() {
+            return statuses
+        }
+        // Failures of a site over a working connection are not resumed
+        if atomic.LoadInt64(&sb.reconnects) == reconnects && alive(sb.conn()) {
+            return statuses
+        }
+        if err := sb.reconnect(); err != nil {
+            sb.log.Warn("Failed to reconnect, not resuming the site", "site", site.ServerName, "error", err)
+            return statuses
+        }
+        for _, status := range statuses {
+            if !status.Failed() {
+                finished[status.Component] = status
+            }
         }
+        sb.log.Warn("SSH connection dropped during the site's backup, resuming it",
+            "site", site.ServerName, "attempt", attempt+1, "resumes", sb.siteResumes)
+    }
+}
 
-        // Check for changes on remote server
-        fmt.Printf("Checking for changes in %s...\n", site.ServerName)
-        
-        // Get last modification time using find
-        cmd := fmt.Sprintf("find %s -type f -mtime -1 -not -path '*/\\.*' -not -path '*/node_modules/*' | wc -l", site.DocumentRoot)
-        session, err := sb.client.NewSession()
-        if err != nil {
-            fmt.Printf("Error creating session for %s: %v\n", site.ServerName, err)
-            continue
+// hasComponent reports whether statuses include one of a component
+func hasComponent(statuses []catalog.RunStatus, component string) bool {
+    for _, status := range statuses {
+        if status.Component == component {
+            return true
         }
-        
-        output, err := session.CombinedOutput(cmd)
-        session.Close()
-        
-        if err != nil {
-            fmt.Printf("Error checking for changes in %s: %v\n", site.ServerName, err)
+    }
+    return false
+}
+
+// stopped reports whether the run was asked to stop before the next site
+func (sb *SSHBackup) stopped() bool {
+    select {
+    case <-sb.config.Stop:
+        return true
+    default:
+        return false
+    }
+}
+
+// reportSiteResults logs the outcome of every component of the backed up
+// sites followed by a summary of the run
+func (sb *SSHBackup) reportSiteResults(sites []string, results map[string][]catalog.RunStatus) {
+    var failed, partial, unchanged, current []string
+    for _, site := range sites {
+        statuses := results[site]
+        if len(statuses) == 0 {
+            sb.log.Info("Already backed up today", "site", site)
+            current = append(current, site)
             continue
         }
 
-        changedFiles, err := strconv.Atoi(strings.TrimSpace(string(output)))
-        if err != nil {
-            fmt.Printf("Error parsing changed files count for %s: %v\n", site.ServerName, err)
-            continue
+        outcome, backedUp := catalog.StatusOK, false
+        for _, status := range statuses {
+            switch status.Status {
+            case catalog.StatusFailed:
+                sb.log.Warn("Backup failed", "site", site, "type", status.Component, "error", status.Error)
+                outcome = catalog.StatusFailed
+            case catalog.StatusSkipped:
+                sb.log.Warn("Backup skipped", "site", site, "type", status.Component, "reason", status.Error)
+                outcome = catalog.StatusFailed
+            case catalog.StatusPartial:
+                sb.log.Warn("Partial backup, over budget", "site", site, "type", status.Component)
+                if outcome != catalog.StatusFailed {
+                    outcome = catalog.StatusPartial
+                }
+            case catalog.StatusUnchanged:
+                sb.log.Info("No changes", "site", site, "type", status.Component)
+                if outcome == catalog.StatusOK {
+                    outcome = catalog.StatusUnchanged
+                }
+            default:
+                sb.log.Info("Successfully backed up", "site", site, "type", status.Component)
+                backedUp = true
+            }
+        }
+        // A site with unchanged files whose database was dumped was backed up
+        if outcome == catalog.StatusUnchanged && backedUp {
+            outcome = catalog.StatusOK
         }
+        switch outcome {
+        case catalog.StatusFailed:
+            failed = append(failed, site)
+        case catalog.StatusPartial:
+            partial = append(partial, site)
+        case catalog.StatusUnchanged:
+            unchanged = append(unchanged, site)
+        }
+    }
+
+    attrs := []any{"sites", len(sites), "failed", len(failed), "partial", len(partial),
+        "unchanged", len(unchanged), "already_backed_up", len(current)}
+    if len(failed) > 0 {
+        sb.log.Warn("Remote backups finished with failures", append(attrs, "failed_sites", strings.Join(failed, ","))...)
+        return
+    }
+    sb.log.Info("Remote backups finished", attrs...)
+}
+
+// filterSites returns the sites whose names match one of the include patterns,
+// or all sites without include patterns, leaving out those matching an
+// exclude pattern. Applications match the patterns of their site too.
+func filterSites(sites []SiteInfo, include, exclude []string) []SiteInfo {
+    matches := func(site SiteInfo, patterns []string) bool {
+        parent, _ := SplitAppKey(site.ServerName)
+        for _, pattern := range patterns {
+            for _, name := range []string{site.ServerName, parent} {
+                if ok, _ := filepath.Match(pattern, name); ok {
+                    return true
+                }
+            }
+        }
+        return false
+    }
 
-        if changedFiles == 0 {
-            fmt.Printf("No changes detected in %s, skipping...\n", site.ServerName)
+    var selected []SiteInfo
+    for _, site := range sites {
+        if len(include) > 0 && !matches(site, include) || matches(site, exclude) {
             continue
         }
+        selected = append(selected, site)
+    }
+    return selected
+}
 
-        fmt.Printf("Found %d changed files in %s, creating backup...\n", changedFiles, site.ServerName)
+// backupRemoteSite backs up the files and database of a remote site that
+// changed since its last backup, records the outcome in the catalog and
+// returns it. Nothing is returned for sites already backed up today, or
+// within the configured interval. Components in finished were backed up
+// earlier in the run and are left out.
+func (sb *SSHBackup) backupRemoteSite(ctx context.Context, site SiteInfo, runID string, finished map[string]catalog.RunStatus) []catalog.RunStatus {
+    log := sb.log.With("site", site.ServerName)
+    log.Info("Starting backup check")
+    
+    // Create local backup directory
+    localDir := filepath.Join(sb.manager.BaseDir, site.ServerName)
+    if err := os.MkdirAll(localDir, 0755); err != nil {
+        log.Error("Failed to create local directory", "error", err)
+        statuses := []catalog.RunStatus{componentStatus(runID, site.ServerName, "file", false, err)}
+        sb.recordRunStatuses(statuses)
+        return statuses
+    }
 
-        // Create site backup directory
-        siteDir := fmt.Sprintf("~/laravel-backup-temp/%s", site.ServerName)
-        err = sb.runCommand(fmt.Sprintf("mkdir -p %s", siteDir))
-        if err != nil {
-            fmt.Printf("Error creating directory for %s: %v\n", site.ServerName, err)
-            continue
+    hasFilesToday, hasDBToday := sb.componentsDone(site, localDir, finished)
+    hasDatabase := site.hasDatabase()
+
+    if hasFilesToday && (hasDBToday || !hasDatabase) {
+        log.Info("Backup already exists today, skipping")
+        return nil
+    }
+    // Only a site backing up both components at the same time takes two
+    // sessions, on a server that allows them
+    pipelined := sb.config.Pipeline && !hasFilesToday && !hasDBToday && hasDatabase && cap(sb.siteSessions) > 1
+    sessions := 1
+    if pipelined {
+        sessions = 2
+    }
+    defer sb.takeSessions(sessions)()
+
+    // Components handled in this run, recorded in the catalog at the end
+    var statuses []catalog.RunStatus
+    var firstErr error
+    var mu sync.Mutex
+    record := func(component string, started time.Time, partial bool, err error) {
+        status := componentStatus(runID, site.ServerName, component, partial, err)
+        status.Duration = time.Since(started)
+        mu.Lock()
+        defer mu.Unlock()
+        statuses = append(statuses, status)
+        if firstErr == nil {
+            firstErr = err
+        }
+    }
+    // Records the components still to do as failed, or as unchanged
+    // when err is nil, for sites that are not backed up further
+    pending := func(err error) []catalog.RunStatus {
+        for _, component := range []string{"file", "database"} {
+            if component == "file" && hasFilesToday || component == "database" && (hasDBToday || !hasDatabase) {
+                continue
+            }
+            status := componentStatus(runID, site.ServerName, component, false, err)
+            if err == nil {
+                status.Status = catalog.StatusUnchanged
+            }
+            statuses = append(statuses, status)
         }
+        sb.recordRunStatuses(statuses)
+        return statuses
+    }
 
-        // Backup files
-        fmt.Printf("Creating file backup for %s...\n", site.ServerName)
-        timestamp := time.Now().Format("2006-01-02_150405")
-        cmd = fmt.Sprintf("cd %s && tar --exclude='./node_modules' -czf %s/files.tar.gz .", 
-            site.DocumentRoot, siteDir)
-        err = sb.runCommand(cmd)
+    // A busy server gets time to calm down before its site is scanned
+    if err := sb.waitForLoad(ctx, site.ServerName); err != nil {
+        log.Warn("Skipping site", "error", err)
+        return pending(err)
+    }
+
+    // Check for changes on remote server by comparing the document root
+    // with the manifest of the last file backup. Runs of only the database
+    // dump it regardless of the files.
+    var current map[string]ManifestFile
+    var previous *Manifest
+    if sb.config.Only != "database" {
+        log.Debug("Checking for changes")
+        filter, err := sb.manager.FileFilter(site.ServerName)
         if err != nil {
-            fmt.Printf("Error backing up files for %s: %v\n", site.ServerName, err)
-            continue
+            return pending(err)
+        }
+        if current, err = scanTree(ctx, sb.transport, site.DocumentRoot, filter); err != nil {
+            log.Error("Failed to check for changes", "error", err)
+            return pending(stepError(catalog.CategoryDiscovery, fmt.Errorf("checking for changes: %v", err)))
         }
+        if previous, err = loadManifest(localDir); err != nil {
+            log.Warn("Failed to read manifest, backing up everything", "error", err)
+        }
+    }
+    if sb.config.Only == "database" {
+        log.Info("Backing up the database only")
+    } else if previous != nil {
+        changed, removed, _ := diffManifest(previous, current, "")
+        if len(changed) == 0 && removed == 0 {
+            if hasDBToday || !hasDatabase {
+                log.Info("No changes detected, skipping")
+                return pending(nil)
+            }
+            // Unchanged files don't make the database any less due
+            log.Info("No changes detected, backing up the database only")
+            unchanged := componentStatus(runID, site.ServerName, "file", false, nil)
+            unchanged.Status = catalog.StatusUnchanged
+            statuses = append(statuses, unchanged)
+            hasFilesToday = true
+        } else {
+            log.Info("Found changed files, creating backup", "changed", len(changed), "removed", removed)
+        }
+    } else {
+        log.Info("No manifest of a previous backup, creating backup")
+    }
 
-        // Copy files backup to local
-        fmt.Printf("Copying files backup for %s to local machine...\n", site.ServerName)
-        localBackupPath := filepath.Join(localDir, fmt.Sprintf("files_%s.tar.gz", timestamp))
-        err = sb.copyFileFromRemote(
-            fmt.Sprintf("%s/files.tar.gz", siteDir), 
-            localBackupPath,
-        )
+    // The site's hooks run on the server around the backup; a failing
+    // pre_backup hook skips it
+    hooks := sb.manager.Hooks.For(site.ServerName)
+    hookEnv := HookEnv{Site: site.ServerName, DocumentRoot: site.DocumentRoot,
+        Source: "remote", Server: sb.config.Host, BackupDir: localDir}
+    if err := sb.runSiteHook(ctx, hooks, config.HookPreBackup, hookEnv); err != nil {
+        sb.finishSiteHooks(ctx, hooks, hookEnv, err)
+        return pending(stepError(catalog.CategoryHook, err))
+    }
+
+    // Create site backup directory. Its name comes from the server's
+    // configuration and is quoted wherever it reaches the shell.
+    siteDir := fmt.Sprintf("%s/%s", sb.tempDir, site.ServerName)
+    err := sb.runCommand(ctx, fmt.Sprintf("mkdir -p %s", shellQuote(siteDir)))
+    if err != nil {
+        log.Error("Failed to create remote directory", "error", err)
+        err = fmt.Errorf("creating remote directory: %v", err)
+        sb.finishSiteHooks(ctx, hooks, hookEnv, err)
+        return pending(err)
+    }
+
+    // Backup files and database independently, a failure of one
+    // doesn't prevent the other
+    timestamp := time.Now().Format("2006-01-02_150405")
+    failed := false
+    fail := func() {
+        mu.Lock()
+        failed = true
+        mu.Unlock()
+    }
+    backupFiles := func() {
+        started := time.Now()
+        filesCtx, cancel := sb.manager.SiteContext(ctx, site.ServerName)
+        // A stream that doesn't match what the server sent is fetched again
+        var partial bool
+        err := sb.manager.Retry.Do(filesCtx, log, "file backup", func() error {
+            var err error
+            partial, err = sb.pullSiteFiles(filesCtx, site, siteDir, localDir, timestamp, current, pipelined)
+            return err
+        })
+        cancel()
         if err != nil {
-            fmt.Printf("Error copying files backup for %s: %v\n", site.ServerName, err)
-            continue
+            log.Error("File backup failed", "error", err)
+            fail()
+        } else if !partial {
+            // The next run compares the document root with the files as
+            // they were listed before this backup
+            if err := saveRemoteManifest(localDir, timestamp, current); err != nil {
+                log.Warn("Failed to save manifest", "error", err)
+            }
         }
+        record("file", started, partial, err)
+    }
 
-        // Try to read .env file
-        fmt.Printf("Reading .env for %s...\n", site.ServerName)
-        session, err = sb.client.NewSession()
+    backupDatabase := func() {
+        started := time.Now()
+        dbCtx, cancel := sb.manager.SiteContext(ctx, site.ServerName)
+        // Read the credentials again, they may have changed since the site was found
+        log.Debug("Reading database credentials")
+        creds, err := sb.readRemoteCredentials(dbCtx, site)
         if err != nil {
-            fmt.Printf("Error creating session for %s: %v\n", site.ServerName, err)
-            continue
+            log.Debug("Failed to read database credentials", "error", err)
         }
-        envOutput, _ := session.CombinedOutput(fmt.Sprintf("cat %s/.env", site.DocumentRoot))
-        session.Close()
-
-        // Parse .env file for database credentials and backup if available
-        if len(envOutput) > 0 {
-            envContent := string(envOutput)
-            var dbHost, dbName, dbUser, dbPass string
-            for _, line := range strings.Split(envContent, "\n") {
-                line = strings.TrimSpace(line)
-                if strings.HasPrefix(line, "DB_HOST=") {
-                    dbHost = strings.TrimPrefix(line, "DB_HOST=")
-                } else if strings.HasPrefix(line, "DB_DATABASE=") {
-                    dbName = strings.TrimPrefix(line, "DB_DATABASE=")
-                } else if strings.HasPrefix(line, "DB_USERNAME=") {
-                    dbUser = strings.TrimPrefix(line, "DB_USERNAME=")
-                } else if strings.HasPrefix(line, "DB_PASSWORD=") {
-                    dbPass = strings.TrimPrefix(line, "DB_PASSWORD=")
-                }
-            }
 
-            // Backup database if credentials found
-            if dbName != "" && dbUser != "" {
-                fmt.Printf("Creating database backup for %s...\n", site.ServerName)
-                cmd := fmt.Sprintf("mysqldump -h%s -u%s -p%s --quick --lock-tables=false %s | gzip > %s/db.sql.gz",
-                    dbHost, dbUser, dbPass, dbName, siteDir)
-                err = sb.runCommand(cmd)
-                if err != nil {
-                    fmt.Printf("Error backing up database for %s: %v\n", site.ServerName, err)
-                } else {
-                    // Only try to copy database backup if it was created successfully
-                    fmt.Printf("Copying database backup for %s to local machine...\n", site.ServerName)
-                    localDBPath := filepath.Join(localDir, fmt.Sprintf("db_%s.sql.gz", timestamp))
-                    err = sb.copyFileFromRemote(
-                        fmt.Sprintf("%s/db.sql.gz", siteDir),
-                        localDBPath,
-                    )
-                    if err != nil {
-                        fmt.Printf("Error copying database backup for %s: %v\n", site.ServerName, err)
-                    }
-                }
+        // Backup database if credentials found
+        if dbCtx.Err() != nil {
+            err := contextError(dbCtx, nil)
+            log.Error("Database backup failed", "error", err)
+            fail()
+            record("database", started, false, err)
+        } else if creds.HasDatabase() {
+            // A database server out of connections or restarting is given
+            // time to recover
+            var partial bool
+            err := sb.manager.Retry.Do(dbCtx, log, "database dump", func() error {
+                var err error
+                partial, err = sb.pullSiteDatabase(dbCtx, site, siteDir, localDir, timestamp,
+                    creds.Driver, creds.Host, creds.Port, creds.Name, creds.User, creds.Password, pipelined)
+                return err
+            })
+            if err != nil {
+                log.Error("Database backup failed", "error", err)
+                fail()
             }
+            record("database", started, partial, err)
+        } else if hasDatabase {
+            err := stepError(catalog.CategoryDiscovery, fmt.Errorf("database credentials are no longer available"))
+            log.Error("Database backup failed", "error", err)
+            fail()
+            record("database", started, false, err)
         }
+        cancel()
+    }
 
-        // Clean old backups
-        if err := sb.manager.cleanOldBackups(site.ServerName, false); err != nil {
-            fmt.Printf("Warning: failed to clean old file backups for %s: %v\n", site.ServerName, err)
+    // Pipelined, the dump is made while the file archive is transferred and
+    // verified, instead of after it
+    if pipelined && !hasFilesToday {
+        log.Debug("Backing up files and database in parallel")
+        var wg sync.WaitGroup
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            backupFiles()
+        }()
+        go func() {
+            defer wg.Done()
+            backupDatabase()
+        }()
+        wg.Wait()
+        // The file component is recorded first, whichever finished first
+        sort.SliceStable(statuses, func(i, j int) bool {
+            return statuses[i].Component == "file" && statuses[j].Component != "file"
+        })
+    } else {
+        if !hasFilesToday {
+            backupFiles()
         }
-        if err := sb.manager.cleanOldBackups(site.ServerName, true); err != nil {
-            fmt.Printf("Warning: failed to clean old database backups for %s: %v\n", site.ServerName, err)
+        if !hasDBToday {
+            backupDatabase()
         }
+    }
+    sb.finishSiteHooks(ctx, hooks, hookEnv, firstErr)
 
-        fmt.Printf("Successfully backed up %s\n", site.ServerName)
+    // Clean old backups
+    if err := sb.manager.CleanOldBackups(site.ServerName, false); err != nil {
+        log.Warn("Failed to clean old file backups", "error", err)
     }
+    if err := sb.manager.CleanOldBackups(site.ServerName, true); err != nil {
+        log.Warn("Failed to clean old database backups", "error", err)
+    }
+
+    // Remove the site's temporary files right away to free remote disk
+    // space, including partial archives of cancelled commands
+    if err := sb.runCommand(context.Background(), fmt.Sprintf("rm -rf %s", shellQuote(siteDir))); err != nil {
+        log.Warn("Failed to clean remote temporary directory", "error", err)
+    }
+
+    sb.recordRunStatuses(statuses)
+    if failed {
+        log.Warn("Backed up with errors")
+    } else {
+        log.Info("Finished site backup")
+    }
+    return statuses
+}
 
-    // Clean up temp directory
-    fmt.Println("Cleaning up temporary directory...")
-    err = sb.runCommand("rm -rf ~/laravel-backup-temp/*")
+// takeSessions waits until n of the server's sessions are free for a site
+// and returns a function giving them back. A site takes its sessions all at
+// once, so sites waiting for a second one can't hold each other up.
+func (sb *SSHBackup) takeSessions(n int) func() {
+    sb.siteSessionsMu.Lock()
+    for i := 0; i < n; i++ {
+        sb.siteSessions <- struct{}{}
+    }
+    sb.siteSessionsMu.Unlock()
+    return func() {
+        for i := 0; i < n; i++ {
+            <-sb.siteSessions
+        }
+    }
+}
+
+// componentsDone reports whether the files and the database of a site need
+// no backup in this run. Rerunning after a partial failure only repeats the
+// component that failed; finished holds the components done before the
+// connection dropped.
+func (sb *SSHBackup) componentsDone(site SiteInfo, localDir string, finished map[string]catalog.RunStatus) (bool, bool) {
+    today := time.Now().Format("2006-01-02")
+    hasFilesToday, hasDBToday := false, false
+    
+    // Check for existing backups
+    existing, err := listSiteArchives(site.ServerName, localDir)
+    if err == nil {
+        for _, a := range existing {
+            if a.Time.Format("2006-01-02") != today {
+                continue
+            }
+            if a.Type == "file" {
+                hasFilesToday = true
+            } else {
+                hasDBToday = true
+            }
+        }
+    }
+    // Pushed archives only exist in the catalog
+    if sb.config.Push != nil {
+        hasFilesToday = hasFilesToday || sb.manager.pushedToday(site.ServerName, "file")
+        hasDBToday = hasDBToday || sb.manager.pushedToday(site.ServerName, "database")
+    }
+    // A configured interval replaces the daily check of a component
+    for _, component := range []struct {
+        archiveType string
+        done        *bool
+    }{{"file", &hasFilesToday}, {"database", &hasDBToday}} {
+        switch {
+        case sb.config.Force:
+            *component.done = false
+        case sb.manager.Frequency.Interval(site.ServerName, component.archiveType) > 0:
+            *component.done = !sb.manager.Due(site.ServerName, component.archiveType)
+        }
+    }
+    // Components finished before the connection dropped are not repeated
+    if _, ok := finished["file"]; ok {
+        hasFilesToday = true
+    }
+    if _, ok := finished["database"]; ok {
+        hasDBToday = true
+    }
+    // A component left out of the run counts as done
+    switch sb.config.Only {
+    case "file":
+        hasDBToday = true
+    case "database":
+        hasFilesToday = true
+    }
+    return hasFilesToday, hasDBToday
+}
+
+// runSiteHook runs the hook of an event of a remote site, logging a failure
+func (sb *SSHBackup) runSiteHook(ctx context.Context, hooks config.HookCommands, event string, env HookEnv) error {
+    env.Event = event
+    err := sb.runHook(ctx, hooks.Command(event), env)
     if err != nil {
-        fmt.Printf("Warning: failed to clean remote temp directory: %v\n", err)
+        sb.log.Error("Hook failed", "site", env.Site, "hook", event, "error", err)
     }
+    return err
+}
 
-    return nil
+// finishSiteHooks runs the post_backup hook of a remote site and, if the
+// backup or that hook failed, the on_failure hook. They run even when the
+// run was cancelled, so a site isn't left in maintenance mode.
+func (sb *SSHBackup) finishSiteHooks(ctx context.Context, hooks config.HookCommands, env HookEnv, backupErr error) {
+    ctx = context.WithoutCancel(ctx)
+    env.Status = "success"
+    if backupErr != nil {
+        env.Status, env.Error = "failed", backupErr.Error()
+    }
+    if err := sb.runSiteHook(ctx, hooks, config.HookPostBackup, env); err != nil && backupErr == nil {
+        env.Status, env.Error = "failed", err.Error()
+    }
+    if env.Status == "failed" {
+        sb.runSiteHook(ctx, hooks, config.HookOnFailure, env)
+    }
 }
 
 // compareBackups compares two backup archives
@@ -562,164 +1273,564 @@ func compareBackups(newBackup, oldBackup string) (bool, error) {
     return false, err // Произошла ошибка
 }
 
-// runCommand runs a command on the remote server using a fresh session
-func (sb *SSHBackup) runCommand(cmd string) error {
-    session, err := sb.client.NewSession()
-    if err != nil {
-        return fmt.Errorf("failed to create session: %v", err)
-    }
-    defer session.Close()
+// runCommand runs a quick command on the remote server using a fresh session
+func (sb *SSHBackup) runCommand(ctx context.Context, cmd string) error {
+    return sb.runCommandWithTimeout(ctx, cmd, sb.commandTimeout)
+}
+
+// runArchiveCommand runs a long command such as tar or mysqldump on the
+// remote server, with the configured priority
+func (sb *SSHBackup) runArchiveCommand(ctx context.Context, cmd string) error {
+    return sb.runCommandWithTimeout(ctx, priorityPrefix(sb.config.Priority)+cmd, sb.archiveTimeout)
+}
 
-    output, err := session.CombinedOutput(cmd)
+// runCommandWithTimeout runs a command and includes its output in any error
+func (sb *SSHBackup) runCommandWithTimeout(ctx context.Context, cmd string, timeout time.Duration) error {
+    output, err := sb.execute(ctx, cmd, timeout)
     if err != nil {
         return fmt.Errorf("command failed: %v, output: %s", err, string(output))
     }
     return nil
 }
 
-// copyFileFromRemote copies a file from remote to local using scp
-func (sb *SSHBackup) copyFileFromRemote(remotePath, localPath string) error {
-    var cmd *exec.Cmd
+// saveRemoteManifest records the files of a remote site listed before its
+// file backup of timestamp as the manifest of that backup
+func saveRemoteManifest(localDir, timestamp string, files map[string]ManifestFile) error {
+    archives, err := listSiteArchives("", localDir)
+    if err != nil {
+        return err
+    }
+    for _, a := range archives {
+        if a.Type == "file" && a.Time.Format(TimestampFormat) == timestamp {
+            rel, err := filepath.Rel(localDir, a.Path)
+            if err != nil {
+                return err
+            }
+            m := &Manifest{Archive: rel, Created: time.Now(), Files: files}
+            return m.save(localDir)
+        }
+    }
+    return fmt.Errorf("no file archive of %s found", timestamp)
+}
 
-    if sb.config.Password != "" {
-        fmt.Printf("Using password authentication for SCP\n")
-        cmd = exec.Command("/usr/bin/sshpass", "-p", sb.config.Password, "scp", 
-            "-o", "StrictHostKeyChecking=no",
-            "-P", sb.config.Port,
-            fmt.Sprintf("%s@%s:%s", sb.config.User, sb.config.Host, remotePath),
-            localPath)
-    } else {
-        fmt.Printf("Using key authentication for SCP\n")
-        args := []string{
-            "-o", "StrictHostKeyChecking=no",
-            "-P", sb.config.Port,
+// readRemoteCredentials reads a site's database credentials on the remote
+// server. Aliased applications name their .env; for sites, the configuration
+// file of every known application type is looked for in the document root.
+func (sb *SSHBackup) readRemoteCredentials(ctx context.Context, site SiteInfo) (config.Credentials, error) {
+    for _, path := range credentialFiles(site) {
+        content, err := sb.transport.ReadFile(ctx, path)
+        if errors.Is(err, os.ErrNotExist) {
+            continue
         }
-        if sb.config.KeyPath != "" {
-            args = append(args, "-i", sb.config.KeyPath)
+        if err != nil {
+            return config.Credentials{}, err
         }
-        args = append(args, 
-            fmt.Sprintf("%s@%s:%s", sb.config.User, sb.config.Host, remotePath),
-            localPath)
-        cmd = exec.Command("scp", args...)
+        return parseCredentials(path, string(content)), nil
     }
+    return config.Credentials{}, nil
+}
 
-    fmt.Printf("Running SCP command: %v\n", cmd.Args)
-    output, err := cmd.CombinedOutput()
-    if err != nil {
-        return fmt.Errorf("scp failed: %v, output: %s", err, string(output))
+// credentialFiles returns the remote files a site's database credentials
+// are read from, in the order they are looked for
+func credentialFiles(site SiteInfo) []string {
+    if site.EnvFile != "" {
+        return []string{site.EnvFile}
     }
-    return nil
+    var files []string
+    for _, p := range config.CredentialProviders() {
+        files = append(files, site.DocumentRoot+"/"+p.ConfigFile())
+    }
+    return files
 }
 
-// backupRemoteFiles creates a backup of remote site files
-func (sb *SSHBackup) backupRemoteFiles(site RemoteSite) error {
-    timestamp := time.Now().Format("2006-01-02_150405")
-    
-    // Create remote temp directory structure similar to local
-    remoteBaseDir := "~/laravel-backup-temp"
-    remoteSiteDir := fmt.Sprintf("%s/%s", remoteBaseDir, site.ServerName)
-    remoteBackupPath := fmt.Sprintf("%s/files_%s.tar.gz", remoteSiteDir, timestamp)
-    
-    // Ensure remote directories exist
-    err := sb.runCommand(fmt.Sprintf("mkdir -p %s", remoteSiteDir))
+// parseCredentials extracts the database credentials from the content of a
+// remote application configuration file
+func parseCredentials(path, content string) config.Credentials {
+    p := config.ProviderForFile(path)
+    if p == nil {
+        return config.Credentials{}
+    }
+    return p.Parse(content).Resolve(path)
+}
+
+// setCredentials stores database credentials in the site information
+func (site *SiteInfo) setCredentials(c config.Credentials) {
+    site.DBDriver, site.DBHost, site.DBPort = c.Driver, c.Host, c.Port
+    site.DBName, site.DBUser, site.DBPass = c.Name, c.User, c.Password
+}
+
+// findRemoteLaravelApp returns the root of the Laravel application served
+// from a remote directory (the directory or its parent containing artisan),
+// or an empty string if it is not one
+func (sb *SSHBackup) findRemoteLaravelApp(ctx context.Context, dir string) string {
+    cmd := fmt.Sprintf("for d in %s %s/..; do if [ -f \"$d/artisan\" ]; then cd \"$d\" && pwd; break; fi; done",
+        shellQuote(dir), shellQuote(dir))
+    output, err := sb.transport.RunCommand(ctx, cmd)
     if err != nil {
-        return fmt.Errorf("failed to create remote directory: %v", err)
+        return ""
     }
+    return strings.TrimSpace(string(output))
+}
 
-    // Create tar.gz archive on remote server (same as local version)
-    cmd := fmt.Sprintf("cd %s && tar --exclude='./node_modules' -czf %s .", 
-        site.DocumentRoot, remoteBackupPath)
-    
-    err = sb.runCommand(cmd)
+// pullSiteFiles archives the files of a site's document root selected by
+// the scan on the remote server and copies the archive to the local
+// machine, or streams it there directly in streaming mode, or synchronizes
+// them into a snapshot with the rsync transport. The site's IO budget is checked before the archive is
+// built and its transfer budget before it is copied, or while it is
+// streamed; an exhausted budget skips the files and marks the site as partial.
+// Files over the site's maximum size are not backed up unless allowed.
+// Pipelined archives are always streamed.
+func (sb *SSHBackup) pullSiteFiles(ctx context.Context, site SiteInfo, siteDir, localDir, timestamp string, files map[string]ManifestFile, pipelined bool) (bool, error) {
+    // tar and rsync read the selected files from a list on the server, so
+    // the excludes apply exactly as for local sites
+    sourceSize, count := treeSize(files)
+    if err := sb.manager.CheckSize(site.ServerName, sourceSize, count); err != nil {
+        return false, err
+    }
+    paths := make([]string, 0, len(files))
+    for rel := range files {
+        paths = append(paths, rel)
+    }
+    sort.Strings(paths)
+    paths, tarOptions := sb.followedPaths(site.ServerName, files, paths)
+    listPath, removeList, err := sb.writeRemoteSecret("files.list", []byte(strings.Join(paths, "\x00")))
     if err != nil {
-        return fmt.Errorf("failed to create backup archive: %v", err)
+        return false, fmt.Errorf("failed to list files: %v", err)
+    }
+    defer removeList()
+    if err := sb.manager.CheckBudget(site.ServerName, 0, sourceSize); err != nil {
+        sb.manager.SkipOverBudget(site.ServerName, "files", err)
+        return true, nil
+    }
+    if sb.config.Transport == config.TransportRsync {
+        return sb.syncSiteFiles(ctx, site, listPath, localDir, timestamp, sourceSize)
+    }
+    stream, err := sb.checkSpace(ctx, site.ServerName, "files", siteDir, sourceSize, pipelined)
+    if err != nil {
+        return false, err
+    }
+
+    sb.log.Info("Creating file backup", "site", site.ServerName)
+    started := time.Now()
+    compression := sb.manager.Compression.For(site.ServerName)
+    ext := ".tar" + compressionExt(compression.Format)
+    localBackupPath := archivePath(sb.manager.BaseDir, site.ServerName, "file", timestamp, false, ext)
+    if err := os.MkdirAll(filepath.Dir(localBackupPath), 0755); err != nil {
+        return false, fmt.Errorf("failed to create local directory: %v", err)
+    }
+    // Without pipefail a failed tar would leave an empty but valid compressed stream
+    archive := fmt.Sprintf("set -o pipefail 2>/dev/null; cd %s && tar --null --no-recursion%s -cf - -T %s | %s",
+        shellQuote(site.DocumentRoot), tarOptions, shellQuote(listPath), compressCommand(compression))
+    if sb.config.Push != nil {
+        if _, err := sb.pushArchive(ctx, site.ServerName, "file", siteDir, archive, localBackupPath, started); err != nil {
+            return false, err
+        }
+        sb.manager.ChargeUsage(site.ServerName, 0, sourceSize)
+        return false, nil
+    }
+    if stream {
+        cmd := archive
+        archiveSize, sum, err := sb.streamToLocal(ctx, site.ServerName, cmd, localBackupPath)
+        if err != nil {
+            if _, over := err.(overBudgetError); over {
+                sb.manager.ChargeUsage(site.ServerName, archiveSize, sourceSize)
+                sb.manager.SkipOverBudget(site.ServerName, "files", err)
+                return true, nil
+            }
+            return false, err
+        }
+        sb.manager.ChargeUsage(site.ServerName, archiveSize, sourceSize)
+        // Failing to store the archive is no reason to archive again
+        return false, retry.Permanent(sb.storePulledArchive(site.ServerName, "file", localBackupPath, sum, started))
     }
 
-    // Prepare local directory
-    localBackupDir := filepath.Join(sb.manager.BaseDir, site.ServerName)
-    if err := os.MkdirAll(localBackupDir, 0755); err != nil {
-        return fmt.Errorf("failed to create local directory: %v", err)
+    remotePath := fmt.Sprintf("%s/files%s", siteDir, ext)
+    if err := sb.runArchiveCommand(ctx, fmt.Sprintf("%s > %s", archive, shellQuote(remotePath))); err != nil {
+        return false, err
     }
 
-    // Copy file from remote to local using scp
-    localBackupPath := filepath.Join(localBackupDir, fmt.Sprintf("files_%s.tar.gz", timestamp))
-    err = sb.copyFileFromRemote(remoteBackupPath, localBackupPath)
+    archiveSize, err := sb.remoteSize(ctx, fmt.Sprintf("stat -c %%s %s", shellQuote(remotePath)))
     if err != nil {
-        return fmt.Errorf("failed to copy backup file: %v", err)
+        return false, fmt.Errorf("failed to get archive size: %v", err)
+    }
+    if err := sb.manager.CheckBudget(site.ServerName, archiveSize, 0); err != nil {
+        sb.manager.ChargeUsage(site.ServerName, 0, sourceSize)
+        sb.manager.SkipOverBudget(site.ServerName, "files", err)
+        return true, nil
     }
 
-    // Clean up remote backup file
-    err = sb.runCommand(fmt.Sprintf("rm -f %s", remoteBackupPath))
-    if err != nil {
-        fmt.Printf("Warning: failed to remove remote backup file %s: %v\n", remoteBackupPath, err)
+    sb.log.Info("Copying file backup to local machine", "site", site.ServerName)
+    if err := sb.copyFileFromRemote(ctx, remotePath, localBackupPath); err != nil {
+        return false, err
     }
+    sb.manager.ChargeUsage(site.ServerName, archiveSize, sourceSize)
+    return false, retry.Permanent(sb.storePulledArchive(site.ServerName, "file", localBackupPath, "", started))
+}
 
-    return sb.manager.cleanOldBackups(site.ServerName, false)
+// followedPaths returns the paths tar reads the listed files from and the
+// tar options archiving them under their paths in the document root. Files
+// of followed symlinks and extra paths are read where they live and renamed
+// to their names in the archive; names are kept absolute until then, so a
+// renamed file can't match the target of another link. rsync copies
+// followed symlinks as links and skips extra paths.
+func (sb *SSHBackup) followedPaths(site string, files map[string]ManifestFile, paths []string) ([]string, string) {
+    var links []string
+    for rel, file := range files {
+        if file.Followed != "" {
+            links = append(links, rel)
+        }
+    }
+    if len(links) == 0 {
+        return paths, ""
+    }
+    if sb.config.Transport == config.TransportRsync {
+        extra, followed := false, false
+        for _, link := range links {
+            if within(link, ExtraPathsDir) {
+                extra = true
+            } else {
+                followed = true
+            }
+        }
+        if extra {
+            sb.log.Warn("The rsync transport doesn't copy extra paths, skipping them", "site", site)
+        }
+        if followed {
+            sb.log.Warn("The rsync transport doesn't follow symlinks, archiving them as links", "site", site)
+        }
+        kept := paths[:0]
+        for _, rel := range paths {
+            if link := followedLink(links, path.Dir(rel)); link == "" && !within(rel, ExtraPathsDir) {
+                kept = append(kept, rel)
+            }
+        }
+        return kept, ""
+    }
+
+    listed := make([]string, len(paths))
+    for i, rel := range paths {
+        listed[i] = rel
+        if link := followedLink(links, rel); link != "" {
+            listed[i] = files[link].Followed + strings.TrimPrefix(rel, link)
+        }
+    }
+    // Nested targets are renamed before the directories containing them
+    sort.Slice(links, func(i, j int) bool { return len(files[links[i]].Followed) > len(files[links[j]].Followed) })
+    options := " -P --hard-dereference"
+    for _, link := range links {
+        expr := fmt.Sprintf(`s|^%s\(/\|$\)|%s\1|rSH`, sedEscape(files[link].Followed, `\.[]*^$|`), sedEscape(link, `\&|`))
+        options += " --transform " + shellQuote(expr)
+    }
+    return listed, options
 }
 
-// backupRemoteDatabase creates a backup of remote site database
-func (sb *SSHBackup) backupRemoteDatabase(site RemoteSite, dbHost, dbName, dbUser, dbPass string) error {
-    timestamp := time.Now().Format("2006-01-02_150405")
-    
-    // Create remote temp directory structure similar to local
-    remoteBaseDir := "~/laravel-backup-temp"
-    remoteSiteDir := fmt.Sprintf("%s/%s/database", remoteBaseDir, site.ServerName)
-    remoteBackupPath := fmt.Sprintf("%s/db_%s.sql.gz", remoteSiteDir, timestamp)
-    
-    // Ensure remote directories exist
-    err := sb.runCommand(fmt.Sprintf("mkdir -p %s", remoteSiteDir))
+// followedLink returns the deepest followed symlink among links that rel is
+// or lies below, or an empty string
+func followedLink(links []string, rel string) string {
+    deepest := ""
+    for _, link := range links {
+        if within(rel, link) && len(link) > len(deepest) {
+            deepest = link
+        }
+    }
+    return deepest
+}
+
+// sedEscape escapes the special characters of a sed expression in s
+func sedEscape(s, special string) string {
+    var b strings.Builder
+    for _, c := range s {
+        if strings.ContainsRune(special, c) {
+            b.WriteByte('\\')
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// pullSiteDatabase dumps a site's database on the remote server and copies
+// the dump to the local machine, or streams it there directly in streaming
+// mode or when pipelined, unless the site's transfer budget is exhausted
+func (sb *SSHBackup) pullSiteDatabase(ctx context.Context, site SiteInfo, siteDir, localDir, timestamp, dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string, pipelined bool) (bool, error) {
+    stream, err := sb.checkSpace(ctx, site.ServerName, "database", siteDir, sb.manager.EstimateDumpSize(site.ServerName), pipelined)
     if err != nil {
-        return fmt.Errorf("failed to create remote directory: %v", err)
+        return false, err
     }
 
-    // Create database backup on remote server (same as local version)
-    cmd := fmt.Sprintf("mysqldump -h%s -u%s -p%s --quick --lock-tables=false %s | gzip > %s",
-        dbHost, dbUser, dbPass, dbName, remoteBackupPath)
-    
-    err = sb.runCommand(cmd)
+    sb.log.Info("Creating database backup", "site", site.ServerName)
+    started := time.Now()
+    passFile, removePassFile, err := sb.dbCredentialsFile(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass)
     if err != nil {
-        return fmt.Errorf("failed to create database backup: %v", err)
+        return false, err
+    }
+    defer removePassFile()
+    dump, err := dumpCommand(dbDriver, dbHost, dbPort, dbName, dbUser, passFile, sb.manager.MySQLDump.For(site.ServerName))
+    if err != nil {
+        return false, err
+    }
+    compression := sb.manager.Compression.For(site.ServerName)
+    ext := dumpExt(dbDriver) + compressionExt(compression.Format)
+    localDBPath := archivePath(sb.manager.BaseDir, site.ServerName, "database", timestamp, false, ext)
+    if err := os.MkdirAll(filepath.Dir(localDBPath), 0755); err != nil {
+        return false, fmt.Errorf("failed to create local directory: %v", err)
+    }
+    // Without pipefail a failed dump would leave an empty but valid compressed stream
+    cmd := fmt.Sprintf("set -o pipefail 2>/dev/null; %s | %s", dump, compressCommand(compression))
+    if sb.config.Push != nil {
+        _, err := sb.pushArchive(ctx, site.ServerName, "database", siteDir, cmd, localDBPath, started)
+        return false, err
+    }
+    if stream {
+        size, sum, err := sb.streamToLocal(ctx, site.ServerName, cmd, localDBPath)
+        if err != nil {
+            if _, over := err.(overBudgetError); over {
+                sb.manager.ChargeUsage(site.ServerName, size, 0)
+                sb.manager.SkipOverBudget(site.ServerName, "database", err)
+                return true, nil
+            }
+            return false, err
+        }
+        sb.manager.ChargeUsage(site.ServerName, size, 0)
+        // Failing to store the dump is no reason to dump again; uploads
+        // retry on their own
+        return false, retry.Permanent(sb.storePulledArchive(site.ServerName, "database", localDBPath, sum, started))
     }
 
-    // Prepare local directory
-    localBackupDir := filepath.Join(sb.manager.BaseDir, site.ServerName, "database")
-    if err := os.MkdirAll(localBackupDir, 0755); err != nil {
-        return fmt.Errorf("failed to create local directory: %v", err)
+    remoteDBPath := fmt.Sprintf("%s/db%s", siteDir, ext)
+    if err := sb.runArchiveCommand(ctx, fmt.Sprintf("%s > %s", cmd, shellQuote(remoteDBPath))); err != nil {
+        return false, err
     }
 
-    // Copy file from remote to local using scp
-    localBackupPath := filepath.Join(localBackupDir, fmt.Sprintf("db_%s.sql.gz", timestamp))
-    err = sb.copyFileFromRemote(remoteBackupPath, localBackupPath)
+    // Only try to copy database backup if it was created successfully
+    size, err := sb.remoteSize(ctx, fmt.Sprintf("stat -c %%s %s", shellQuote(remoteDBPath)))
     if err != nil {
-        return fmt.Errorf("failed to copy backup file: %v", err)
+        return false, fmt.Errorf("failed to get dump size: %v", err)
+    }
+    if err := sb.manager.CheckBudget(site.ServerName, size, 0); err != nil {
+        sb.manager.SkipOverBudget(site.ServerName, "database", err)
+        return true, nil
     }
 
-    // Clean up remote backup file
-    err = sb.runCommand(fmt.Sprintf("rm -f %s", remoteBackupPath))
-    if err != nil {
-        fmt.Printf("Warning: failed to remove remote backup file %s: %v\n", remoteBackupPath, err)
+    sb.log.Info("Copying database backup to local machine", "site", site.ServerName)
+    if err := sb.copyFileFromRemote(ctx, remoteDBPath, localDBPath); err != nil {
+        return false, err
     }
+    sb.manager.ChargeUsage(site.ServerName, size, 0)
+    return false, retry.Permanent(sb.storePulledArchive(site.ServerName, "database", localDBPath, "", started))
+}
 
-    return sb.manager.cleanOldBackups(site.ServerName, true)
+// dbCredentialsFile writes the password of a database to a file on the
+// server for dumpCommand and importCommand, and returns its path and a
+// function removing it
+func (sb *SSHBackup) dbCredentialsFile(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass string) (string, func(), error) {
+    content := credentialsFile(dbDriver, dbHost, dbPort, dbName, dbUser, dbPass)
+    if content == nil {
+        return "", func() {}, nil
+    }
+    return sb.writeRemoteSecret("db-credentials", content)
 }
 
-// backupSite backs up a single site
-func (sb *SSHBackup) backupSite(site SiteInfo) error {
-    // Convert SiteInfo to RemoteSite for compatibility with existing code
-    remoteSite := RemoteSite{
-        ServerName:   site.ServerName,
-        DocumentRoot: site.DocumentRoot,
+// checkSpace checks that an archive of about needed bytes fits into the
+// local backup directory and, unless streamed, into the remote temporary
+// directory of the site. It returns whether to stream the archive, always
+// in streaming mode or when pipelined, and with StreamWhenLow if it doesn't
+// fit on the server.
+func (sb *SSHBackup) checkSpace(ctx context.Context, siteName, component, siteDir string, needed ByteSize, pipelined bool) (bool, error) {
+    // Pushed archives are stored on neither
+    if sb.config.Push != nil {
+        return false, nil
     }
+    if err := sb.manager.CheckSpace(siteName, component, needed); err != nil {
+        return false, err
+    }
+    // Streamed archives write nothing to the server's disk. Sites that
+    // aren't pipelined, e.g. with only one component due, are staged there
+    // like without pipelining and need the space.
+    if sb.config.Streaming || pipelined {
+        sb.log.Debug("Streaming the backup, only the local space is checked", "site", siteName, "component", component)
+        return true, nil
+    }
+    minFree := sb.manager.MinFreeSpace
+    if sb.config.MinFree > 0 {
+        minFree = sb.config.MinFree
+    }
+    freeKB, err := sb.remoteSize(ctx, fmt.Sprintf("df -Pk %s | awk 'NR==2 {print $4}'", shellQuote(siteDir)))
+    if err != nil {
+        sb.log.Warn("Unable to check free space on remote server", "site", siteName, "path", siteDir, "error", err)
+        return false, nil
+    }
+    if free := freeKB * 1024; free < needed+minFree {
+        if sb.config.StreamWhenLow {
+            sb.log.Warn("Not enough space on the remote server, streaming the backup instead", "site", siteName,
+                "component", component, "free", free.String(), "needed", (needed + minFree).String())
+            return true, nil
+        }
+        return false, stepError(catalog.CategoryCapacity, fmt.Errorf("skipped the %s backup, not enough space in %s on the remote server: %s free, %s needed (%s estimated, %s kept free), consider streaming mode",
+            component, siteDir, free, needed+minFree, needed, minFree))
+    }
+    return false, nil
+}
 
-    if err := sb.backupRemoteFiles(remoteSite); err != nil {
-        return fmt.Errorf("failed to backup files: %v", err)
+// storePulledArchive encrypts, registers and verifies an archive copied from
+// the remote server and uploads it to the off-server storage. sum is the
+// checksum of the archive computed as it arrived, empty if it wasn't.
+func (sb *SSHBackup) storePulledArchive(siteName, archiveType, path, sum string, started time.Time) error {
+    // A file archive that can't be deduplicated is kept as it is. Snapshots
+    // share unchanged files with the previous snapshot instead.
+    if sb.manager.Dedup && archiveType == "file" && !IsSnapshot(path) {
+        if index, err := sb.manager.deduplicateArchive(path); err != nil {
+            sb.log.Warn("Failed to deduplicate archive, keeping it", "path", path, "error", err)
+        } else {
+            path, sum = index, ""
+        }
+    }
+    if err := sb.manager.encryptDownloaded(path); err != nil {
+        os.Remove(path)
+        return err
+    }
+    if sb.manager.Encrypt {
+        sum = ""
+    }
+    if err := sb.manager.registerArchiveSum(siteName, archiveType, path, sum, started); err != nil {
+        sb.log.Warn("Failed to record checksum", "path", path, "error", err)
+    }
+    // A corrupted archive is kept for inspection but never uploaded
+    if err := sb.manager.verifyArchive(siteName, archiveType, path); err != nil {
+        return err
+    }
+    // The local copy is kept if the upload fails
+    if _, err := sb.manager.UploadArchive(path); err != nil {
+        return fmt.Errorf("failed to upload %s: %v", path, err)
     }
+    return nil
+}
+
+// overBudgetError stops a stream that exceeded the site's transfer budget
+type overBudgetError struct {
+    err error
+}
 
-    if site.DBName != "" && site.DBUser != "" {
-        if err := sb.backupRemoteDatabase(remoteSite, site.DBHost, site.DBName, site.DBUser, site.DBPass); err != nil {
-            return fmt.Errorf("failed to backup database: %v", err)
+func (e overBudgetError) Error() string {
+    return e.err.Error()
+}
+
+// streamToLocal runs an archiving command whose output is the archive and
+// writes it to localPath as it arrives, without a temporary file on the
+// remote server. The size can't be checked against the site's transfer
+// budget up front, so the stream is stopped with an overBudgetError as soon
+// as it exceeds it. The archive is hashed as it arrives and, if the server
+// can compute checksums, compared with the checksum of what the server sent,
+// so neither copy is read again. It returns the number of bytes received and
+// their checksum; nothing is left at localPath on error.
+func (sb *SSHBackup) streamToLocal(ctx context.Context, siteName, cmd, localPath string) (ByteSize, string, error) {
+    partPath := localPath + partialSuffix
+    f, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+    if err != nil {
+        return 0, "", fmt.Errorf("failed to create local file: %v", err)
+    }
+    // The server hashes the stream through a named pipe as it is sent
+    var p string
+    if sb.checksumCommand != "" && sb.tempDir != "" {
+        p = fmt.Sprintf("%s/.stream-%d", sb.tempDir, atomic.AddInt64(&sb.commands, 1))
+        cmd = fmt.Sprintf(`rm -f %[1]s.*; mkfifo %[1]s.sum || exit 1
+%[2]s < %[1]s.sum > %[1]s.sha256 &
+{ %[3]s; echo $? > %[1]s.status; } | tee %[1]s.sum
+wait
+exit "$(cat %[1]s.status 2>/dev/null || echo 1)"`, p, sb.checksumCommand, cmd)
+    }
+    hash := sha256.New()
+    err = sb.stream(ctx, cmd, io.MultiWriter(f, hash), filepath.Base(localPath), func(written int64) error {
+        if err := sb.manager.CheckBudget(siteName, ByteSize(written), 0); err != nil {
+            return overBudgetError{err}
         }
+        return nil
+    })
+    var received int64
+    if info, statErr := f.Stat(); statErr == nil {
+        received = info.Size()
+    }
+    if cerr := f.Close(); err == nil {
+        err = cerr
     }
+    sum := hex.EncodeToString(hash.Sum(nil))
+    if p != "" {
+        if err == nil {
+            err = sb.compareStreamSum(ctx, p, sum)
+        }
+        if rmErr := sb.runCommand(context.Background(), fmt.Sprintf("rm -f %s.*", p)); rmErr != nil {
+            sb.log.Warn("Failed to remove temporary files of stream", "path", p, "error", rmErr)
+        }
+    }
+    if err == nil {
+        err = os.Rename(partPath, localPath)
+    }
+    if err != nil {
+        os.Remove(partPath)
+        return ByteSize(received), "", err
+    }
+    return ByteSize(received), sum, nil
+}
 
+// compareStreamSum compares the checksum of a received stream with the one
+// the server wrote next to the stream's named pipe
+func (sb *SSHBackup) compareStreamSum(ctx context.Context, p, sum string) error {
+    output, err := sb.execute(ctx, fmt.Sprintf("cat %s.sha256", p), sb.commandTimeout)
+    if err != nil {
+        return stepError(catalog.CategoryTransfer, fmt.Errorf("failed to read checksum of stream: %v: %s", err, strings.TrimSpace(string(output))))
+    }
+    fields := strings.Fields(string(output))
+    if len(fields) == 0 || len(fields[0]) != 64 {
+        return stepError(catalog.CategoryTransfer, fmt.Errorf("unexpected %s output %q", sb.checksumCommand, strings.TrimSpace(string(output))))
+    }
+    // Another attempt streams the archive again
+    if remote := strings.ToLower(fields[0]); remote != sum {
+        return retry.Transient(stepError(catalog.CategoryTransfer, fmt.Errorf("received stream doesn't match what the server sent: checksum %s, server sent %s", sum, remote)))
+    }
     return nil
 }
+
+// recordRunStatuses stores the outcome of a site's components in the catalog
+func (sb *SSHBackup) recordRunStatuses(statuses []catalog.RunStatus) {
+    if err := sb.manager.Catalog.RecordRuns(statuses); err != nil {
+        sb.log.Warn("Failed to record run status", "error", err)
+    }
+}
+
+// componentStatus builds the catalog status of a component from its outcome.
+// Errors not categorized on the way are those of archiving the files or
+// dumping the database.
+func componentStatus(runID, site, component string, partial bool, err error) catalog.RunStatus {
+    status := catalog.RunStatus{RunID: runID, Site: site, Component: component, Status: catalog.StatusOK, Time: time.Now()}
+    switch {
+    case err != nil:
+        status.Status, status.Error = catalog.StatusFailed, logging.Redact(err.Error())
+        status.Category = ErrorCategory(err)
+        // Sites spared by the guardrails were never attempted
+        if status.Category == catalog.CategoryCapacity {
+            status.Status = catalog.StatusSkipped
+        }
+        if status.Category == "" {
+            status.Category = catalog.CategoryDump
+            if component == "file" {
+                status.Category = catalog.CategoryArchive
+            }
+        }
+    case partial:
+        status.Status = catalog.StatusPartial
+    }
+    return status
+}
+
+
+// remoteSize runs a command printing a byte count and parses its output
+func (sb *SSHBackup) remoteSize(ctx context.Context, cmd string) (ByteSize, error) {
+    output, err := sb.execute(ctx, cmd, sb.commandTimeout)
+    if err != nil {
+        return 0, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+    }
+    size, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+    if err != nil {
+        return 0, fmt.Errorf("unexpected output %q", strings.TrimSpace(string(output)))
+    }
+    return ByteSize(size), nil
+}
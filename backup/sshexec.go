@@ -0,0 +1,258 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "golang.org/x/crypto/ssh"
+    "laravel-backup-tool/retry"
+)
+
+const (
+    // DefaultCommandTimeout limits quick remote commands such as cat, find or mkdir
+    DefaultCommandTimeout = 5 * time.Minute
+    // DefaultArchiveTimeout limits long running remote commands such as tar and mysqldump
+    DefaultArchiveTimeout = 6 * time.Hour
+    // DefaultOutputLimit caps the output collected from a single remote command
+    DefaultOutputLimit = 10 * 1024 * 1024
+    // remoteTimeoutGrace lets the local timeout fire before the remote one
+    remoteTimeoutGrace = 30 * time.Second
+    // killTimeout limits the command killing a remote process group
+    killTimeout = 30 * time.Second
+)
+
+// cappedBuffer collects command output up to a limit and signals when the
+// limit is exceeded; further output is discarded
+type cappedBuffer struct {
+    mu       sync.Mutex
+    buf      bytes.Buffer
+    limit    int
+    exceeded chan struct{}
+    once     sync.Once
+}
+
+// newCappedBuffer creates a buffer holding at most limit bytes
+func newCappedBuffer(limit int) *cappedBuffer {
+    return &cappedBuffer{limit: limit, exceeded: make(chan struct{})}
+}
+
+// Write stores as much of p as fits within the limit
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    room := b.limit - b.buf.Len()
+    if room < len(p) {
+        if room > 0 {
+            b.buf.Write(p[:room])
+        }
+        b.once.Do(func() { close(b.exceeded) })
+        return len(p), nil
+    }
+    b.buf.Write(p)
+    return len(p), nil
+}
+
+// Bytes returns a copy of the collected output
+func (b *cappedBuffer) Bytes() []byte {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// shellQuote quotes a string for safe use as a single POSIX shell word
+func shellQuote(s string) string {
+    return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellGlob quotes a path like shellQuote except for its * wildcards, which
+// the shell still expands
+func shellGlob(pattern string) string {
+    parts := strings.Split(pattern, "*")
+    for i, part := range parts {
+        parts[i] = shellQuote(part)
+    }
+    return strings.Join(parts, "*")
+}
+
+// execute runs a command on the remote server in a fresh session and returns
+// its combined output. The command is killed when ctx is cancelled, when it
+// runs longer than timeout or when it produces more output than the
+// configured limit. If the remote server has coreutils timeout, the command
+// is additionally wrapped with it so it dies even if the SSH server does not
+// deliver signals. Commands run with the configured privileges.
+func (sb *SSHBackup) execute(ctx context.Context, cmd string, timeout time.Duration) ([]byte, error) {
+    output := newCappedBuffer(sb.outputLimit)
+    session, pidFile, err := sb.startCommand(ctx, cmd, timeout, output, output)
+    if err != nil {
+        return nil, err
+    }
+    defer session.Close()
+
+    done := make(chan error, 1)
+    go func() {
+        done <- session.Wait()
+    }()
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    select {
+    case err := <-done:
+        return output.Bytes(), err
+    case <-output.exceeded:
+        sb.kill(session, pidFile)
+        return output.Bytes(), fmt.Errorf("output exceeded %d bytes, command killed", sb.outputLimit)
+    case <-timer.C:
+        sb.kill(session, pidFile)
+        return output.Bytes(), fmt.Errorf("command timed out after %s and was killed", timeout)
+    case <-ctx.Done():
+        sb.kill(session, pidFile)
+        return output.Bytes(), contextError(ctx, nil)
+    }
+}
+
+// stream runs a command on the remote server and writes its standard output
+// to w as it arrives, reporting the progress periodically. Standard error is
+// collected up to the output limit for the error message. check is called
+// with the bytes written so far at every progress report; an error from it
+// kills the command and is returned. Like execute, the command is killed when
+// ctx is cancelled or when it runs longer than the archive timeout.
+func (sb *SSHBackup) stream(ctx context.Context, cmd string, w io.Writer, name string, check func(int64) error) error {
+    stderr := newCappedBuffer(sb.outputLimit)
+    pw := &progressWriter{w: w}
+    session, pidFile, err := sb.startCommand(ctx, priorityPrefix(sb.config.Priority)+cmd, sb.archiveTimeout, pw, stderr)
+    if err != nil {
+        return err
+    }
+    defer session.Close()
+
+    done := make(chan error, 1)
+    started := time.Now()
+    go func() {
+        done <- session.Wait()
+    }()
+
+    ticker := time.NewTicker(progressInterval)
+    defer ticker.Stop()
+    timer := time.NewTimer(sb.archiveTimeout)
+    defer timer.Stop()
+
+    for {
+        select {
+        case err := <-done:
+            if err != nil {
+                return fmt.Errorf("command failed: %v, output: %s", err, stderr.Bytes())
+            }
+            sb.log.Info("Streamed", "file", name, "size", ByteSize(pw.Written()).String(),
+                "elapsed", time.Since(started).Round(time.Second).String())
+            return nil
+        case <-ticker.C:
+            written := pw.Written()
+            sb.log.Info("Streaming", "file", name, "written", ByteSize(written).String())
+            if err := check(written); err != nil {
+                sb.kill(session, pidFile)
+                <-done
+                return err
+            }
+        case <-timer.C:
+            sb.kill(session, pidFile)
+            <-done
+            return fmt.Errorf("command timed out after %s and was killed", sb.archiveTimeout)
+        case <-ctx.Done():
+            sb.kill(session, pidFile)
+            <-done
+            return contextError(ctx, nil)
+        }
+    }
+}
+
+// startCommand starts a command in a fresh session with the given output
+// writers. Once the run's temporary directory exists, the command records
+// its PID there, so its whole process group can be killed; the returned PID
+// file is empty before that.
+func (sb *SSHBackup) startCommand(ctx context.Context, cmd string, timeout time.Duration, stdout, stderr io.Writer) (*ssh.Session, string, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, "", contextError(ctx, err)
+    }
+    session, err := sb.newSession(ctx)
+    if err != nil {
+        return nil, "", err
+    }
+
+    pidFile := ""
+    if sb.tempDir != "" {
+        pidFile = fmt.Sprintf("%s/.pid-%d", sb.tempDir, atomic.AddInt64(&sb.commands, 1))
+        cmd = fmt.Sprintf("echo $$ > %s; %s", shellQuote(pidFile), cmd)
+    }
+    if sb.remoteTimeout {
+        seconds := int((timeout + remoteTimeoutGrace).Seconds())
+        cmd = fmt.Sprintf("timeout -s KILL %d sh -c %s", seconds, shellQuote(cmd))
+    }
+    cmd = sb.become(cmd)
+
+    session.Stdout = stdout
+    session.Stderr = stderr
+    if err := session.Start(cmd); err != nil {
+        session.Close()
+        return nil, "", fmt.Errorf("failed to start command: %v", err)
+    }
+    return session, pidFile, nil
+}
+
+// newSession opens a session on the connection. If that fails, e.g. because
+// the connection dropped, the connection is replaced and opening the session
+// is retried as the retry policy says.
+func (sb *SSHBackup) newSession(ctx context.Context) (*ssh.Session, error) {
+    var session *ssh.Session
+    attempted := false
+    err := sb.config.Retry.Do(ctx, sb.log, "open SSH session", func() error {
+        if attempted {
+            if err := sb.reconnect(); err != nil {
+                return err
+            }
+        }
+        attempted = true
+        var err error
+        if session, err = sb.conn().NewSession(); err != nil {
+            return retry.Transient(fmt.Errorf("failed to create session: %v", err))
+        }
+        return nil
+    })
+    return session, err
+}
+
+// kill asks the server to kill the remote process and tears down the
+// channel. Since SSH servers often don't deliver the signal, the process
+// group recorded in pidFile is also killed over a separate session.
+func (sb *SSHBackup) kill(session *ssh.Session, pidFile string) {
+    session.Signal(ssh.SIGKILL)
+    session.Close()
+    if pidFile == "" {
+        return
+    }
+
+    killer, err := sb.conn().NewSession()
+    if err != nil {
+        sb.log.Warn("Failed to kill remote command", "error", err)
+        return
+    }
+    defer killer.Close()
+    cmd := fmt.Sprintf("pid=$(cat %[1]s 2>/dev/null) && { pgid=$(ps -o pgid= -p $pid | tr -d ' '); "+
+        "kill -KILL -- -${pgid:-$pid} 2>/dev/null || { pkill -KILL -P $pid; kill -KILL $pid; }; }; rm -f %[1]s",
+        shellQuote(pidFile))
+    done := make(chan error, 1)
+    go func() {
+        done <- killer.Run(sb.become(cmd))
+    }()
+    select {
+    case <-done:
+    case <-time.After(killTimeout):
+        sb.log.Warn("Timed out killing remote command", "pid_file", pidFile)
+    }
+}
@@ -0,0 +1,320 @@
+package backup
+
+import (
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/encryption"
+)
+
+// StandbyStateFileName is the file in a backup base directory recording
+// which archives were last applied to the standby server
+const StandbyStateFileName = "standby.json"
+
+// StandbyApplied records the archives last applied to a standby site
+type StandbyApplied struct {
+    Files    string    `json:"files,omitempty"`
+    Database string    `json:"database,omitempty"`
+    Time     time.Time `json:"time"`
+}
+
+// StandbyResult is the outcome of syncing one site to the standby
+type StandbyResult struct {
+    Site     string
+    Files    string
+    Database string
+    Err      error
+}
+
+// SyncStandby applies the latest backups from source to the server sb is
+// connected to, which serves as a warm standby for the backed up server.
+// Sites are discovered from the standby's own Apache configuration; the
+// files of each site's latest file archive, together with the archives it
+// builds on, replace its document root (keeping the standby's .env or
+// wp-config.php) and its latest dump is imported into the database
+// configured there. Archives already applied are not applied again.
+// Sites not synced when ctx is cancelled are left as they are.
+func (sb *SSHBackup) SyncStandby(ctx context.Context, source *BackupManager) ([]StandbyResult, error) {
+    sites, err := sb.gatherSiteInfo(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("failed to gather standby site information: %v", err)
+    }
+    sort.Slice(sites, func(i, j int) bool {
+        return sites[i].ServerName < sites[j].ServerName
+    })
+
+    archives, err := ListArchives(source.BaseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list archives: %v", err)
+    }
+    // Archives are sorted oldest first, so the last one seen is the latest
+    latest := make(map[string]map[string]Archive)
+    for _, a := range archives {
+        if latest[a.Site] == nil {
+            latest[a.Site] = make(map[string]Archive)
+        }
+        latest[a.Site][a.Type] = a
+    }
+
+    statePath := filepath.Join(source.BaseDir, StandbyStateFileName)
+    state, err := loadStandbyState(statePath)
+    if err != nil {
+        return nil, err
+    }
+
+    var results []StandbyResult
+    for _, site := range sites {
+        if ctx.Err() != nil {
+            return results, contextError(ctx, nil)
+        }
+        siteArchives, ok := latest[site.ServerName]
+        if !ok {
+            slog.Info("No backups found, leaving standby copy untouched", "site", site.ServerName)
+            continue
+        }
+
+        result := StandbyResult{Site: site.ServerName, Files: "up to date", Database: "up to date"}
+        applied := state[site.ServerName]
+
+        if a, ok := siteArchives["file"]; !ok {
+            result.Files = "no backup"
+        } else if a.Path != applied.Files {
+            if err := sb.applyStandbyFiles(ctx, site, a, source.Keyring); err != nil {
+                result.Files, result.Err = "failed", fmt.Errorf("files: %v", err)
+            } else {
+                result.Files, applied.Files = filepath.Base(a.Path), a.Path
+            }
+        }
+
+        if a, ok := siteArchives["database"]; !ok {
+            result.Database = "no backup"
+        } else if !site.hasDatabase() {
+            result.Database = "no database configured on standby"
+        } else if result.Err != nil {
+            // Don't pair a new database with old files
+            result.Database = "skipped"
+        } else if a.Path != applied.Database {
+            if err := sb.applyStandbyDatabase(ctx, site, a, source.Keyring); err != nil {
+                result.Database, result.Err = "failed", fmt.Errorf("database: %v", err)
+            } else {
+                result.Database, applied.Database = filepath.Base(a.Path), a.Path
+            }
+        }
+
+        applied.Time = time.Now()
+        state[site.ServerName] = applied
+        if err := saveStandbyState(statePath, state); err != nil {
+            return results, err
+        }
+        results = append(results, result)
+    }
+
+    return results, nil
+}
+
+// uploadStandbyArchive verifies an archive and copies it into the site's
+// temporary directory on the standby. Encrypted archives are decrypted
+// locally first, as the standby doesn't have the key. It returns the remote
+// path and the archive's compression format.
+func (sb *SSHBackup) uploadStandbyArchive(ctx context.Context, site SiteInfo, a Archive, name string, keys *encryption.Keyring) (string, string, error) {
+    if _, err := VerifyChecksum(a.Path); err != nil {
+        return "", "", fmt.Errorf("refusing to apply %s: %v", a.Path, err)
+    }
+
+    localPath := a.Path
+    if IsIncremental(a.Path) {
+        // The standby gets the files the archive's chain restores as one
+        // archive, so files deleted along the chain are gone there too
+        tempDir, err := NewTempDir(site.ServerName)
+        if err != nil {
+            return "", "", err
+        }
+        defer os.RemoveAll(tempDir)
+        if localPath, err = rebuildChain(a.Path, tempDir, keys); err != nil {
+            return "", "", err
+        }
+    } else if NeedsReassembly(a.Path) || IsSplit(a.Path) {
+        // The standby gets the archive reassembled from the chunk store,
+        // the snapshot or the parts
+        tempDir, err := NewTempDir(site.ServerName)
+        if err != nil {
+            return "", "", err
+        }
+        defer os.RemoveAll(tempDir)
+        if localPath, err = ReassembleArchive(a.Path, tempDir, keys, false); err != nil {
+            return "", "", err
+        }
+    } else if encrypted, err := encryption.IsEncrypted(a.Path); err != nil {
+        return "", "", fmt.Errorf("failed to read %s: %v", a.Path, err)
+    } else if encrypted {
+        tempDir, err := NewTempDir(site.ServerName)
+        if err != nil {
+            return "", "", err
+        }
+        defer os.RemoveAll(tempDir)
+        localPath = filepath.Join(tempDir, name)
+        if err := decryptFile(a.Path, localPath, keys); err != nil {
+            return "", "", err
+        }
+    }
+    format, err := DetectCompression(localPath)
+    if err != nil {
+        return "", "", err
+    }
+
+    siteDir := fmt.Sprintf("%s/%s", sb.tempDir, site.ServerName)
+    // Created over SFTP, as the SSH user uploads into it
+    client, err := sb.sftpClient()
+    if err != nil {
+        return "", "", err
+    }
+    if err := client.MkdirAll(siteDir); err != nil {
+        return "", "", fmt.Errorf("failed to create remote directory: %v", err)
+    }
+    remotePath := siteDir + "/" + name + compressionExt(format)
+    slog.Info("Uploading to standby", "path", a.Path)
+    if err := sb.copyFileToRemote(ctx, localPath, remotePath); err != nil {
+        return "", "", err
+    }
+    return remotePath, format, nil
+}
+
+// applyStandbyFiles replaces the standby's document root with the contents of
+// a file archive. The archive is unpacked next to the document root and
+// swapped in only when complete; the standby's own configuration is kept.
+func (sb *SSHBackup) applyStandbyFiles(ctx context.Context, site SiteInfo, a Archive, keys *encryption.Keyring) error {
+    remotePath, format, err := sb.uploadStandbyArchive(ctx, site, a, "files.tar", keys)
+    if err != nil {
+        return err
+    }
+    defer sb.runCommand(context.Background(), fmt.Sprintf("rm -f %s", shellQuote(remotePath)))
+
+    root := shellQuote(site.DocumentRoot)
+    next := shellQuote(site.DocumentRoot + ".standby-new")
+    prev := shellQuote(site.DocumentRoot + ".standby-old")
+    // The standby keeps its own application configuration, e.g. .env or wp-config.php
+    var keep []string
+    for _, p := range config.CredentialProviders() {
+        keep = append(keep, shellQuote(p.ConfigFile()))
+    }
+    slog.Info("Applying archive on standby", "archive", filepath.Base(a.Path), "path", site.DocumentRoot)
+    // Extra paths of the site are left out, they don't belong in the document root
+    cmd := fmt.Sprintf("set -e; set -o pipefail 2>/dev/null; rm -rf %[2]s %[3]s; mkdir -p %[2]s; %[6]s < %[4]s | tar -xf - --exclude=%[7]s -C %[2]s; "+
+        "for f in %[5]s; do if [ -f %[1]s/\"$f\" ]; then cp -p %[1]s/\"$f\" %[2]s/\"$f\"; fi; done; "+
+        "if [ -d %[1]s ]; then mv %[1]s %[3]s; fi; mv %[2]s %[1]s; rm -rf %[3]s",
+        root, next, prev, shellQuote(remotePath), strings.Join(keep, " "), decompressCommand(format), ExtraPathsDir)
+    return sb.runArchiveCommand(ctx, cmd)
+}
+
+// applyStandbyDatabase imports a dump into the standby site's database
+func (sb *SSHBackup) applyStandbyDatabase(ctx context.Context, site SiteInfo, a Archive, keys *encryption.Keyring) error {
+    if isSQLiteDump(a.Path) != (site.DBDriver == DriverSQLite) {
+        return fmt.Errorf("%s can't be imported into a %s database", filepath.Base(a.Path), driverName(site.DBDriver))
+    }
+    remotePath, format, err := sb.uploadStandbyArchive(ctx, site, a, "db"+dumpExt(site.DBDriver), keys)
+    if err != nil {
+        return err
+    }
+    defer sb.runCommand(context.Background(), fmt.Sprintf("rm -f %s", shellQuote(remotePath)))
+
+    passFile, removePassFile, err := sb.dbCredentialsFile(site.DBDriver, site.DBHost, site.DBPort, site.DBName, site.DBUser, site.DBPass)
+    if err != nil {
+        return err
+    }
+    defer removePassFile()
+    load, err := importCommand(site.DBDriver, site.DBHost, site.DBPort, site.DBName, site.DBUser, passFile)
+    if err != nil {
+        return err
+    }
+    slog.Info("Importing dump on standby", "archive", filepath.Base(a.Path), "database", site.DBName)
+    cmd := fmt.Sprintf("set -o pipefail 2>/dev/null; %s < %s | %s", decompressCommand(format), shellQuote(remotePath), load)
+    return sb.runArchiveCommand(ctx, cmd)
+}
+
+// rebuildChain restores an incremental file archive and the archives it
+// builds on into dir, each verified on the way, and archives the restored
+// files as a single gzip compressed tar archive in dir, whose path it returns
+func rebuildChain(archivePath, dir string, keys *encryption.Keyring) (string, error) {
+    filesDir := filepath.Join(dir, "files")
+    if _, _, err := RestoreFiles(archivePath, filesDir, false, false, keys); err != nil {
+        return "", err
+    }
+    path := filepath.Join(dir, "files.tar.gz")
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+    if err != nil {
+        return "", fmt.Errorf("failed to create archive of %s: %v", filepath.Base(archivePath), err)
+    }
+    gw := gzip.NewWriter(f)
+    err = writeSnapshotTar(gw, filesDir)
+    if closeErr := gw.Close(); err == nil {
+        err = closeErr
+    }
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return "", fmt.Errorf("failed to archive the files of %s: %v", filepath.Base(archivePath), err)
+    }
+    return path, nil
+}
+
+// decryptFile writes the decrypted content of an encrypted archive to dest
+func decryptFile(src, dest string, keys *encryption.Keyring) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return fmt.Errorf("failed to open archive: %v", err)
+    }
+    defer in.Close()
+
+    plain, err := encryption.NewReader(in, keys)
+    if err != nil {
+        return fmt.Errorf("failed to decrypt %s: %v", filepath.Base(src), err)
+    }
+    out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to create decrypted copy: %v", err)
+    }
+    if _, err := io.Copy(out, plain); err != nil {
+        out.Close()
+        return fmt.Errorf("failed to decrypt %s: %v", filepath.Base(src), err)
+    }
+    return out.Close()
+}
+
+// loadStandbyState reads which archives were applied to the standby
+func loadStandbyState(path string) (map[string]StandbyApplied, error) {
+    state := make(map[string]StandbyApplied)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return state, nil
+        }
+        return nil, fmt.Errorf("failed to read standby state: %v", err)
+    }
+    if err := json.Unmarshal(data, &state); err != nil {
+        return nil, fmt.Errorf("failed to parse standby state %s: %v", path, err)
+    }
+    return state, nil
+}
+
+// saveStandbyState writes the standby state atomically
+func saveStandbyState(path string, state map[string]StandbyApplied) error {
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode standby state: %v", err)
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fmt.Errorf("failed to write standby state: %v", err)
+    }
+    return os.Rename(tmp, path)
+}
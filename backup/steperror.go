@@ -0,0 +1,42 @@
+package backup
+
+import (
+    "errors"
+)
+
+// StepError is an error of a step of a site's backup, categorized by the
+// step, e.g. catalog.CategoryTransfer for a failed download, so failures can
+// be told apart without parsing their messages
+type StepError struct {
+    Category string
+    Err      error
+}
+
+// Error returns the message of the underlying error
+func (e *StepError) Error() string {
+    return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *StepError) Unwrap() error {
+    return e.Err
+}
+
+// stepError categorizes err, keeping the category of an error categorized
+// before; a nil error stays nil
+func stepError(category string, err error) error {
+    if err == nil || ErrorCategory(err) != "" {
+        return err
+    }
+    return &StepError{Category: category, Err: err}
+}
+
+// ErrorCategory returns the category of an error, empty if it wasn't
+// categorized
+func ErrorCategory(err error) string {
+    var step *StepError
+    if errors.As(err, &step) {
+        return step.Category
+    }
+    return ""
+}
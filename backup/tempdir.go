@@ -0,0 +1,94 @@
+package backup
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+const (
+    // tempPrefix marks temporary directories created by this tool
+    tempPrefix = "laravel-backup-"
+    // staleTempAge is the age after which leftover temporary directories
+    // of crashed runs are removed
+    staleTempAge = 24 * time.Hour
+    // defaultRemoteTempRoot holds per-run temporary directories on remote servers
+    defaultRemoteTempRoot = "~/laravel-backup-temp"
+)
+
+// TempRoot returns the directory under which local temporary files are created.
+// BACKUP_TMPDIR takes precedence over TMPDIR so temporary data can be placed
+// on a volume with enough space.
+func TempRoot() string {
+    if dir := os.Getenv("BACKUP_TMPDIR"); dir != "" {
+        return dir
+    }
+    return os.TempDir()
+}
+
+// NewTempDir creates a unique temporary directory for work on a site.
+// The caller is responsible for removing it.
+func NewTempDir(siteName string) (string, error) {
+    root := TempRoot()
+    if err := os.MkdirAll(root, 0755); err != nil {
+        return "", fmt.Errorf("failed to create temp root %s: %v", root, err)
+    }
+    dir, err := os.MkdirTemp(root, tempPrefix+sanitizeTempName(siteName)+"-")
+    if err != nil {
+        return "", fmt.Errorf("failed to create temp directory: %v", err)
+    }
+    return dir, nil
+}
+
+// StaleTempDirs returns the temporary directories of this tool older than
+// a day, left behind by crashed runs
+func StaleTempDirs() ([]string, error) {
+    matches, err := filepath.Glob(filepath.Join(TempRoot(), tempPrefix+"*"))
+    if err != nil {
+        return nil, err
+    }
+    var stale []string
+    for _, dir := range matches {
+        info, err := os.Stat(dir)
+        if err != nil || !info.IsDir() || time.Since(info.ModTime()) < staleTempAge {
+            continue
+        }
+        stale = append(stale, dir)
+    }
+    return stale, nil
+}
+
+// CleanStaleTempDirs removes temporary directories left behind by crashed runs
+func CleanStaleTempDirs() error {
+    stale, err := StaleTempDirs()
+    if err != nil {
+        return err
+    }
+    for _, dir := range stale {
+        if err := os.RemoveAll(dir); err != nil {
+            return fmt.Errorf("failed to remove stale temp directory %s: %v", dir, err)
+        }
+    }
+    return nil
+}
+
+// remoteTempRoot returns the directory on remote servers under which each run
+// creates its own temporary directory
+func remoteTempRoot() string {
+    if dir := os.Getenv("REMOTE_TMPDIR"); dir != "" {
+        return dir
+    }
+    return defaultRemoteTempRoot
+}
+
+// sanitizeTempName makes a site name safe for use in a directory name
+func sanitizeTempName(name string) string {
+    return strings.Map(func(r rune) rune {
+        if r == '/' || r == os.PathSeparator || r == ' ' {
+            return '_'
+        }
+        return r
+    }, name)
+}
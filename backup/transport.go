@@ -0,0 +1,493 @@
+package backup
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/config"
+)
+
+// Transport runs commands and reads files on the machine a site lives on,
+// so the same backup logic serves local sites and sites on remote servers
+type Transport interface {
+    // RunCommand runs a shell command and returns its combined output
+    RunCommand(ctx context.Context, cmd string) ([]byte, error)
+    // ReadFile returns the content of a file
+    ReadFile(ctx context.Context, path string) ([]byte, error)
+    // WalkDir calls fn for every file and directory below root, parents
+    // before their content; fn returning filepath.SkipDir for a directory
+    // skips its content
+    WalkDir(ctx context.Context, root string, fn WalkFunc) error
+    // OpenRead opens a file for reading
+    OpenRead(ctx context.Context, path string) (io.ReadCloser, error)
+    // Readlink returns the target of a symlink as stored in the link
+    Readlink(ctx context.Context, path string) (string, error)
+    // Resolve returns the absolute path of an existing file with all
+    // symlinks resolved, and the information about the file it names
+    Resolve(ctx context.Context, path string) (string, os.FileInfo, error)
+}
+
+// WalkFunc is called by WalkDir with the slash separated path of an entry
+// relative to the root of the walk. Symlinks are not followed.
+type WalkFunc func(rel string, info os.FileInfo) error
+
+// LocalTransport runs commands and reads files on this machine
+type LocalTransport struct{}
+
+// RunCommand runs a command with sh, or cmd.exe on Windows
+func (LocalTransport) RunCommand(ctx context.Context, cmd string) ([]byte, error) {
+    return shellCommand(ctx, cmd).CombinedOutput()
+}
+
+// ReadFile returns the content of a local file
+func (LocalTransport) ReadFile(ctx context.Context, path string) ([]byte, error) {
+    return os.ReadFile(path)
+}
+
+// WalkDir walks a local directory
+func (LocalTransport) WalkDir(ctx context.Context, root string, fn WalkFunc) error {
+    return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(root, path)
+        if err != nil {
+            return err
+        }
+        if rel == "." {
+            return nil
+        }
+        return fn(filepath.ToSlash(rel), info)
+    })
+}
+
+// OpenRead opens a local file
+func (LocalTransport) OpenRead(ctx context.Context, path string) (io.ReadCloser, error) {
+    return os.Open(path)
+}
+
+// Readlink returns the target of a local symlink
+func (LocalTransport) Readlink(ctx context.Context, path string) (string, error) {
+    return os.Readlink(path)
+}
+
+// Resolve resolves the symlinks of a local path. The path is returned with
+// slashes, like those of remote servers, which Windows accepts as well.
+func (LocalTransport) Resolve(ctx context.Context, path string) (string, os.FileInfo, error) {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        return "", nil, err
+    }
+    resolved, err := filepath.EvalSymlinks(abs)
+    if err != nil {
+        return "", nil, err
+    }
+    info, err := os.Stat(resolved)
+    if err != nil {
+        return "", nil, err
+    }
+    return filepath.ToSlash(resolved), info, nil
+}
+
+// SSHTransport runs commands and reads files on a remote server over the
+// connection of an SSH backup
+type SSHTransport struct {
+    sb *SSHBackup
+}
+
+// RunCommand runs a quick command on the server
+func (t *SSHTransport) RunCommand(ctx context.Context, cmd string) ([]byte, error) {
+    return t.sb.execute(ctx, cmd, t.sb.commandTimeout)
+}
+
+// ReadFile returns the content of a file on the server
+func (t *SSHTransport) ReadFile(ctx context.Context, path string) ([]byte, error) {
+    f, err := t.OpenRead(ctx, path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return io.ReadAll(contextReader{ctx, f})
+}
+
+// WalkDir lists a directory on the server with find. The listing can be
+// long, so it is streamed like an archive rather than collected within the
+// output limit of quick commands. A document root listed ahead of the
+// site's backup isn't listed again.
+func (t *SSHTransport) WalkDir(ctx context.Context, root string, fn WalkFunc) error {
+    var listing bytes.Buffer
+    if data, ok := t.sb.takeListing(root); ok {
+        listing.Write(data)
+    } else {
+        // Type, size, modification time, permissions and path of every entry,
+        // NUL terminated as paths may contain newlines
+        cmd := fmt.Sprintf(`cd %s && find . -mindepth 1 -printf '%%y %%s %%T@ %%m %%P\0'`, shellQuote(root))
+        noCheck := func(int64) error { return nil }
+        if err := t.sb.stream(ctx, cmd, &listing, "listing of "+root, noCheck); err != nil {
+            return err
+        }
+    }
+
+    // find lists a directory before its content, so the content of a
+    // skipped directory directly follows it
+    skipped := ""
+    for _, line := range strings.Split(listing.String(), "\x00") {
+        if line == "" {
+            continue
+        }
+        rel, info, err := parseListing(line)
+        if err != nil {
+            return err
+        }
+        if skipped != "" && strings.HasPrefix(rel, skipped) {
+            continue
+        }
+        skipped = ""
+        if err := fn(rel, info); err == filepath.SkipDir && info.IsDir() {
+            skipped = rel + "/"
+        } else if err != nil && err != filepath.SkipDir {
+            return err
+        }
+    }
+    return nil
+}
+
+// OpenRead opens a file on the server over SFTP. With privileges the file
+// is read with cat instead, within the output limit of quick commands.
+func (t *SSHTransport) OpenRead(ctx context.Context, path string) (io.ReadCloser, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+    if t.sb.escalated {
+        output, err := t.RunCommand(ctx, "cat -- "+shellQuote(path))
+        if err != nil {
+            return nil, fmt.Errorf("failed to read %s: %v, output: %s", path, err, strings.TrimSpace(string(output)))
+        }
+        return io.NopCloser(bytes.NewReader(output)), nil
+    }
+    client, err := t.sb.sftpClient()
+    if err != nil {
+        return nil, err
+    }
+    return client.Open(path)
+}
+
+// Readlink returns the target of a symlink on the server
+func (t *SSHTransport) Readlink(ctx context.Context, path string) (string, error) {
+    if err := ctx.Err(); err != nil {
+        return "", err
+    }
+    if t.sb.escalated {
+        output, err := t.RunCommand(ctx, "readlink -- "+shellQuote(path))
+        if err != nil {
+            return "", fmt.Errorf("failed to read link %s: %v", path, err)
+        }
+        return strings.TrimSuffix(string(output), "\n"), nil
+    }
+    client, err := t.sb.sftpClient()
+    if err != nil {
+        return "", err
+    }
+    return client.ReadLink(path)
+}
+
+// Resolve resolves the symlinks of a path on the server with readlink
+func (t *SSHTransport) Resolve(ctx context.Context, path string) (string, os.FileInfo, error) {
+    output, err := t.RunCommand(ctx, "readlink -e -- "+shellQuote(path))
+    if err != nil {
+        return "", nil, fmt.Errorf("failed to resolve %s: %v", path, err)
+    }
+    resolved := strings.TrimSuffix(string(output), "\n")
+    if t.sb.escalated {
+        output, err := t.RunCommand(ctx, `find `+shellQuote(resolved)+` -maxdepth 0 -printf '%y %s %T@ %m %p'`)
+        if err != nil {
+            return "", nil, fmt.Errorf("failed to stat %s: %v", resolved, err)
+        }
+        _, info, err := parseListing(string(output))
+        return resolved, info, err
+    }
+    client, err := t.sb.sftpClient()
+    if err != nil {
+        return "", nil, err
+    }
+    info, err := client.Stat(resolved)
+    if err != nil {
+        return "", nil, err
+    }
+    return resolved, info, nil
+}
+
+// parseListing parses an entry of the listing of SSHTransport.WalkDir
+func parseListing(line string) (string, os.FileInfo, error) {
+    fields := strings.SplitN(line, " ", 5)
+    if len(fields) != 5 {
+        return "", nil, fmt.Errorf("unexpected output of find: %q", line)
+    }
+    size, err := strconv.ParseInt(fields[1], 10, 64)
+    if err != nil {
+        return "", nil, fmt.Errorf("unexpected size in output of find: %q", line)
+    }
+    sec, frac, _ := strings.Cut(fields[2], ".")
+    secs, err := strconv.ParseInt(sec, 10, 64)
+    if err != nil {
+        return "", nil, fmt.Errorf("unexpected modification time in output of find: %q", line)
+    }
+    nsecs, _ := strconv.ParseInt((frac + "000000000")[:9], 10, 64)
+    perm, err := strconv.ParseUint(fields[3], 8, 32)
+    if err != nil {
+        return "", nil, fmt.Errorf("unexpected permissions in output of find: %q", line)
+    }
+
+    mode := os.FileMode(perm)
+    switch fields[0] {
+    case "f":
+    case "d":
+        mode |= os.ModeDir
+    case "l":
+        mode |= os.ModeSymlink
+    default:
+        mode |= os.ModeIrregular
+    }
+    rel := fields[4]
+    return rel, listedFile{name: path.Base(rel), size: size, mode: mode, modTime: time.Unix(secs, nsecs)}, nil
+}
+
+// listedFile is the information about a remote file listed by find
+type listedFile struct {
+    name    string
+    size    int64
+    mode    os.FileMode
+    modTime time.Time
+}
+
+func (f listedFile) Name() string       { return f.name }
+func (f listedFile) Size() int64        { return f.size }
+func (f listedFile) Mode() os.FileMode  { return f.mode }
+func (f listedFile) ModTime() time.Time { return f.modTime }
+func (f listedFile) IsDir() bool        { return f.mode.IsDir() }
+func (f listedFile) Sys() interface{}   { return nil }
+
+// walkSelected walks the files, directories and symlinks below root that
+// filter selects. Excluded directories are skipped unless include patterns
+// could bring back files below them. Special files are skipped. A symlink
+// pointing into a directory the filter follows symlinks into is walked as the
+// file or directory it points to, passed to fn as a FollowedLink. The
+// filter's extra paths are walked after root, named below ExtraPathsDir and
+// passed to fn as FollowedLinks as well.
+func walkSelected(ctx context.Context, t Transport, root string, filter *config.FileFilter, fn WalkFunc) error {
+    return newSelectedWalk(ctx, t, filter, fn).run(root)
+}
+
+// FollowedLink is the information about the file or directory a followed
+// symlink points to
+type FollowedLink struct {
+    os.FileInfo
+    // Resolved path of the file or directory
+    Target string
+}
+
+// selectedWalk is the state of walkSelected
+type selectedWalk struct {
+    ctx    context.Context
+    t      Transport
+    filter *config.FileFilter
+    fn     WalkFunc
+    // root is the resolved root of the walk, follow the resolved
+    // directories symlinks are followed into, extra the resolved extra paths
+    root   string
+    follow []string
+    extra  []string
+    // active holds the followed directories being walked, so a symlink
+    // pointing to one of them or above doesn't loop
+    active map[string]bool
+    // kept is called for a symlink pointing outside the root that is
+    // archived as a link, if set; loop tells a link that would be a cycle
+    kept func(rel, target string, loop bool)
+    // warn logs skipped extra paths and entries, so the walk of the scan
+    // reports them once per backup
+    warn bool
+}
+
+// newSelectedWalk prepares a walk of the selected files
+func newSelectedWalk(ctx context.Context, t Transport, filter *config.FileFilter, fn WalkFunc) *selectedWalk {
+    return &selectedWalk{ctx: ctx, t: t, filter: filter, fn: fn, active: make(map[string]bool)}
+}
+
+// run walks root and the extra paths
+func (w *selectedWalk) run(root string) error {
+    extra := w.filter.ExtraPaths()
+    if follow := w.filter.FollowSymlinks(); len(follow) > 0 || len(extra) > 0 || w.kept != nil {
+        resolved, _, err := w.t.Resolve(w.ctx, root)
+        if err != nil {
+            return err
+        }
+        w.root = resolved
+        for _, dir := range follow {
+            if !path.IsAbs(dir) && filepath.VolumeName(dir) == "" {
+                dir = path.Join(root, dir)
+            }
+            // Directories that don't exist, e.g. on sites without shared
+            // uploads, have nothing to follow
+            if resolved, _, err := w.t.Resolve(w.ctx, dir); err == nil {
+                w.follow = append(w.follow, resolved)
+            }
+        }
+    }
+    // Extra paths are resolved first, so symlinks pointing into them are
+    // kept as links
+    var extraPaths []string
+    var extraInfos []os.FileInfo
+    for _, p := range extra {
+        // Paths that don't exist, e.g. on servers without the shared
+        // directory, are skipped
+        resolved, info, err := w.t.Resolve(w.ctx, p)
+        if err != nil {
+            if w.warn {
+                slog.Warn("Extra path not found, skipping it", "path", p, "error", err)
+            }
+            continue
+        }
+        w.extra = append(w.extra, resolved)
+        extraPaths, extraInfos = append(extraPaths, p), append(extraInfos, info)
+    }
+    if err := w.walk(root, ""); err != nil {
+        return err
+    }
+    for i, p := range extraPaths {
+        if err := w.walkExtra(p, w.extra[i], extraInfos[i]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// walkExtra walks an extra path, a file or directory outside the root
+// resolved to resolved
+func (w *selectedWalk) walkExtra(p, resolved string, info os.FileInfo) error {
+    name := extraName(p)
+    if w.filter.Excluded(name, info.IsDir()) || !info.IsDir() && !info.Mode().IsRegular() {
+        return nil
+    }
+    err := w.fn(name, FollowedLink{info, resolved})
+    if err == filepath.SkipDir {
+        return nil
+    }
+    if err != nil || !info.IsDir() {
+        return err
+    }
+    w.active[resolved] = true
+    defer delete(w.active, resolved)
+    return w.walk(resolved, name)
+}
+
+// walk walks dir, whose entries are named with prefix
+func (w *selectedWalk) walk(dir, prefix string) error {
+    return w.t.WalkDir(w.ctx, dir, func(rel string, info os.FileInfo) error {
+        name := path.Join(prefix, rel)
+        if name == ExtraPathsDir {
+            if w.warn {
+                slog.Warn("Skipping a file named like the directory of extra paths in archives", "path", path.Join(dir, rel))
+            }
+            return filepath.SkipDir
+        }
+        if w.filter.Excluded(name, info.IsDir()) {
+            if info.IsDir() && w.filter.Prunes() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if info.Mode()&os.ModeSymlink != 0 {
+            return w.link(path.Join(dir, rel), name, info)
+        }
+        if !info.IsDir() && !info.Mode().IsRegular() {
+            return nil
+        }
+        return w.fn(name, info)
+    })
+}
+
+// link passes a symlink to fn, or the file or directory it points to if
+// that lies in a directory symlinks are followed into. Targets in the root
+// or an extra path are archived anyway, so links to them are always kept.
+func (w *selectedWalk) link(linkPath, name string, info os.FileInfo) error {
+    if w.root == "" {
+        return w.fn(name, info)
+    }
+    target, targetInfo, err := w.t.Resolve(w.ctx, linkPath)
+    if err != nil || within(target, w.root) || w.inExtra(target) {
+        // A dangling link is restored as it was
+        return w.fn(name, info)
+    }
+    if loop := w.loops(target); loop || !w.follows(target) {
+        if w.kept != nil {
+            w.kept(name, target, loop)
+        }
+        return w.fn(name, info)
+    }
+    switch {
+    case targetInfo.IsDir():
+        err := w.fn(name, FollowedLink{targetInfo, target})
+        if err == filepath.SkipDir {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        w.active[target] = true
+        defer delete(w.active, target)
+        return w.walk(target, name)
+    case targetInfo.Mode().IsRegular():
+        return w.fn(name, FollowedLink{targetInfo, target})
+    }
+    return nil
+}
+
+// inExtra reports whether target lies in an extra path
+func (w *selectedWalk) inExtra(target string) bool {
+    for _, dir := range w.extra {
+        if within(target, dir) {
+            return true
+        }
+    }
+    return false
+}
+
+// follows reports whether symlinks pointing to target are followed
+func (w *selectedWalk) follows(target string) bool {
+    for _, dir := range w.follow {
+        if within(target, dir) {
+            return true
+        }
+    }
+    return false
+}
+
+// loops reports whether following a symlink to target would walk the root
+// or a followed directory being walked again
+func (w *selectedWalk) loops(target string) bool {
+    if within(w.root, target) {
+        return true
+    }
+    for dir := range w.active {
+        if within(dir, target) {
+            return true
+        }
+    }
+    return false
+}
+
+// within reports whether a slash separated path is dir or below it
+func within(p, dir string) bool {
+    return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
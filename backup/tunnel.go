@@ -0,0 +1,139 @@
+package backup
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "path"
+    "sync"
+    "golang.org/x/crypto/ssh"
+)
+
+// DBTunnel forwards a port on 127.0.0.1 over SSH to a database server that
+// is only reachable from the SSH server, like ssh -L
+type DBTunnel struct {
+    client   *ssh.Client
+    listener net.Listener
+    network  string // tcp, or unix for a socket
+    target   string
+    log      *slog.Logger
+    wg       sync.WaitGroup
+}
+
+// OpenDBTunnel connects to the SSH server of config and forwards a local
+// port to the database at host and port as seen from that server, or to the
+// Unix socket host names there. An empty port is the default port of the
+// driver. Close the tunnel after the dump.
+func OpenDBTunnel(ctx context.Context, config *SSHConfig, driver, host, port string) (*DBTunnel, error) {
+    if driver == DriverPostgres {
+        port = postgresPort(port)
+    } else if port == "" {
+        port = "3306"
+    }
+    logger := slog.Default().With("tunnel", config.Host)
+    sshConfig, err := sshClientConfig(config, logger)
+    if err != nil {
+        return nil, err
+    }
+
+    addr := net.JoinHostPort(config.Host, config.Port)
+    var client *ssh.Client
+    err = config.Retry.Do(ctx, logger, "connect", func() error {
+        dialer := net.Dialer{Timeout: sshConfig.Timeout}
+        conn, err := dialer.DialContext(ctx, "tcp", addr)
+        if err != nil {
+            return err
+        }
+        c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+        if err != nil {
+            conn.Close()
+            return err
+        }
+        client = ssh.NewClient(c, chans, reqs)
+        return nil
+    })
+    if err != nil {
+        return nil, contextError(ctx, fmt.Errorf("unable to connect to tunnel server %s: %v", config.Host, err))
+    }
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        client.Close()
+        return nil, fmt.Errorf("failed to open tunnel port: %v", err)
+    }
+    t := &DBTunnel{client: client, listener: listener, network: "tcp", target: net.JoinHostPort(host, port), log: logger}
+    if IsSocket(host) {
+        t.network, t.target = "unix", host
+        if driver == DriverPostgres {
+            // PostgreSQL names the directory of its socket
+            t.target = path.Join(host, ".s.PGSQL."+port)
+        }
+    }
+    t.wg.Add(1)
+    go t.serve()
+    logger.Debug("Opened database tunnel", "local", listener.Addr().String(), "target", t.target)
+    return t, nil
+}
+
+// Host returns the host the dump connects to instead of the database's
+func (t *DBTunnel) Host() string {
+    return "127.0.0.1"
+}
+
+// Port returns the local port forwarded to the database
+func (t *DBTunnel) Port() string {
+    return fmt.Sprint(t.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Close stops forwarding and disconnects from the SSH server
+func (t *DBTunnel) Close() error {
+    t.listener.Close()
+    err := t.client.Close()
+    t.wg.Wait()
+    return err
+}
+
+// serve forwards every connection to the local port until the tunnel is
+// closed
+func (t *DBTunnel) serve() {
+    defer t.wg.Done()
+    for {
+        local, err := t.listener.Accept()
+        if err != nil {
+            if !errors.Is(err, net.ErrClosed) {
+                t.log.Warn("Database tunnel stopped", "error", err)
+            }
+            return
+        }
+        remote, err := t.client.Dial(t.network, t.target)
+        if err != nil {
+            t.log.Warn("Tunnel server can't reach the database", "target", t.target, "error", err)
+            local.Close()
+            continue
+        }
+        t.wg.Add(1)
+        go func() {
+            defer t.wg.Done()
+            forward(local, remote)
+        }()
+    }
+}
+
+// forward copies between two connections until either side closes, then
+// closes both
+func forward(a, b net.Conn) {
+    done := make(chan struct{}, 2)
+    copyConn := func(dst, src net.Conn) {
+        io.Copy(dst, src)
+        done <- struct{}{}
+    }
+    go copyConn(a, b)
+    go copyConn(b, a)
+    <-done
+    a.Close()
+    b.Close()
+    <-done
+}
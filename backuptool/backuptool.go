@@ -0,0 +1,646 @@
+// Package backuptool performs backup runs like the command line tool, so
+// other Go programs can embed them. A Runner performs a run with a
+// configuration; a Tool gives access to the backup directories, secrets and
+// services of a configuration for anything beyond runs.
+package backuptool
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "runtime"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/layout"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/queue"
+    "laravel-backup-tool/report"
+    "laravel-backup-tool/storage"
+)
+
+const (
+    // Directory inside the backup base directory holding job queues
+    queueDirName = "_queue"
+    // Directory inside the queue directory holding the queues of runs of single sites or components
+    siteQueuesDirName = "sites"
+)
+
+// Report is the outcome of a backup run
+type Report = report.RunReport
+
+// Scope selects what a backup run backs up. The zero value selects a full
+// run.
+type Scope struct {
+    // Sites limits the run to these sites and their applications. They are
+    // local sites unless Source is remote.
+    Sites []string
+    // Only limits the run to the file ("file") or database ("database")
+    // backups of the sites
+    Only string
+    // Source limits the run to "local" or "remote" sites; empty means both,
+    // or only local sites if Sites are given
+    Source string
+    // Force backs up regardless of the configured frequency and blackout
+    // windows
+    Force bool
+    // AllowLarge backs up the files of sites over their maximum size
+    AllowLarge bool
+    // Resume continues the last run of the scope where it failed, without
+    // repeating its completed archives, dumps and uploads
+    Resume bool
+}
+
+// Full reports whether the scope selects a full run
+func (s Scope) Full() bool {
+    return len(s.Sites) == 0 && s.Only == "" && s.Source == ""
+}
+
+// Validate checks the values of the scope
+func (s Scope) Validate() error {
+    switch s.Only {
+    case "", "file", "database":
+    default:
+        return fmt.Errorf("unknown component %q, use file or database", s.Only)
+    }
+    switch s.Source {
+    case "", "local", "remote":
+    default:
+        return fmt.Errorf("unknown source %q, use local or remote", s.Source)
+    }
+    if s.Resume && s.Force {
+        return fmt.Errorf("a resumed run can't be forced, it keeps the settings of the run it continues")
+    }
+    return nil
+}
+
+// local reports whether the scope includes local sites
+func (s Scope) local() bool {
+    return s.Source != "remote"
+}
+
+// remote reports whether the scope includes remote sites
+func (s Scope) remote() bool {
+    return s.Source == "remote" || s.Source == "" && len(s.Sites) == 0
+}
+
+// Runner performs backup runs. The zero value performs full runs.
+type Runner struct {
+    // Sites limits runs to these local sites and their applications
+    Sites []string
+    // Only and Source limit runs further, see Scope
+    Only   string
+    Source string
+    // Force ignores the configured frequency and blackout windows
+    Force bool
+    // AllowLarge backs up sites over their maximum size
+    AllowLarge bool
+    // Wait is how long a run waits for another one holding its lock,
+    // filelock.Forever to wait indefinitely
+    Wait time.Duration
+    // Output receives the tables printed during runs; nil discards them
+    Output io.Writer
+    // Stop is closed to make runs start no further jobs; see Tool.Stop
+    Stop <-chan struct{}
+}
+
+// Run performs a backup run with cfg, which must be validated, e.g. by
+// config.LoadConfig. Failed sites fail the report rather than the run; an error
+// is returned if the run couldn't start or was cancelled through ctx.
+func (r Runner) Run(ctx context.Context, cfg *config.Config) (*Report, error) {
+    t := New(cfg)
+    t.Output, t.Stop = r.Output, r.Stop
+    return t.Backup(ctx, Scope{Sites: r.Sites, Only: r.Only, Source: r.Source, Force: r.Force, AllowLarge: r.AllowLarge}, r.Wait)
+}
+
+// Tool performs runs and other operations with one configuration. Secrets
+// that are looked up in the keyring or prompted for, like the encryption
+// key, are looked up once per Tool.
+type Tool struct {
+    cfg *config.Config
+    // Output receives the tables printed during runs; nil discards them
+    Output io.Writer
+    // Stop is closed to make runs start no further jobs or sites. An
+    // interrupted local run is resumed by the next run.
+    Stop <-chan struct{}
+
+    priorityOnce sync.Once
+    keyringOnce  sync.Once
+    keyring      *encryption.Keyring
+    keyringErr   error
+    uploaderOnce sync.Once
+    uploader     storage.Uploader
+    uploaderErr  error
+    // Storage the lifecycle rules move old archives to
+    coldUploader storage.Uploader
+    // Errors of site overrides already logged, by site
+    overrideErrors sync.Map
+    // Whether locked archives may be removed, see Unlock
+    unlocked bool
+}
+
+// New returns a Tool for a validated configuration. The configuration's
+// layout and signing keys become those of the backup directories of the
+// process.
+func New(cfg *config.Config) *Tool {
+    backup.SetLayout(layout.MustParse(cfg.Layout))
+    backup.SetSigning(cfg.Signing)
+    return &Tool{cfg: cfg}
+}
+
+// out returns where tables are printed
+func (t *Tool) out() io.Writer {
+    if t.Output == nil {
+        return io.Discard
+    }
+    return t.Output
+}
+
+// stopping reports whether runs were asked to stop
+func (t *Tool) stopping() bool {
+    select {
+    case <-t.Stop:
+        return true
+    default:
+        return false
+    }
+}
+
+// onStop calls stop once runs are asked to stop, until the returned release
+// function is called
+func (t *Tool) onStop(stop func()) func() {
+    done := make(chan struct{})
+    go func() {
+        select {
+        case <-t.Stop:
+            stop()
+        case <-done:
+        }
+    }()
+    return func() { close(done) }
+}
+
+// lowerPriority lowers the priority of the process as configured, once
+func (t *Tool) lowerPriority() {
+    t.priorityOnce.Do(func() {
+        if err := backup.LowerPriority(t.cfg.Priority); err != nil {
+            slog.Warn("Backing up with the normal priority", "error", err)
+        }
+    })
+}
+
+// runContext returns the context of a backup run, which is also cancelled
+// when the run exceeds the configured run timeout
+func (t *Tool) runContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    if t.cfg.Timeouts.Run > 0 {
+        return context.WithTimeoutCause(ctx, t.cfg.Timeouts.Run, fmt.Errorf("run timeout of %s exceeded", t.cfg.Timeouts.Run))
+    }
+    return context.WithCancel(ctx)
+}
+
+// runCancelled returns why a run's context was cancelled, or nil
+func runCancelled(ctx context.Context) error {
+    if ctx.Err() == nil {
+        return nil
+    }
+    return fmt.Errorf("backup run cancelled: %v", context.Cause(ctx))
+}
+
+// Backup performs a backup run of scope and returns its report. A full run
+// is surrounded by the run hooks: local and remote backups, the standby sync
+// and the evaluation of recovery objectives. It holds the run lock, so runs
+// started from cron and by the daemon never overlap. Other runs back up only
+// what scope selects, without run hooks, standby sync and recovery
+// objectives. Runs of local sites hold the locks of those sites rather than
+// the run lock, so they can proceed while a full run or a backup of other
+// sites is active. A run holding a lock is waited for up to wait. Every run
+// that started writes its summary to the reports directory, and its log
+// and outcome to the run history.
+func (t *Tool) Backup(ctx context.Context, scope Scope, wait time.Duration) (r *Report, err error) {
+    if err := scope.Validate(); err != nil {
+        return nil, err
+    }
+    if scope.Source == "remote" && !t.cfg.Remote.Enabled {
+        return nil, fmt.Errorf("remote backups are not enabled")
+    }
+    var lock *backup.RunLock
+    if len(scope.Sites) > 0 && !scope.remote() {
+        lock, err = backup.LockSites(ctx, t.cfg.Local.BackupDir, scope.Sites, wait)
+    } else {
+        lock, err = backup.WaitRun(ctx, t.cfg.Local.BackupDir, wait)
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer lock.Unlock()
+    defer t.WriteMetricsTextfile()
+    t.lowerPriority()
+    runID, endRun := logging.StartRun()
+    defer endRun()
+    started := time.Now()
+    runDir, closeRunLog := t.openRunLog(runID, started)
+    defer closeRunLog()
+    ctx, cancel := t.runContext(ctx)
+    defer cancel()
+
+    if !scope.Full() {
+        var failures []string
+        err = t.backupScope(ctx, scope, &failures)
+        var reportErr error
+        if r, reportErr = t.runReport(started, failures); reportErr != nil {
+            slog.Error("Failed to build the run report", "error", reportErr)
+        }
+        t.notifySizeAnomalies(r)
+        t.notifySiteOwners(r)
+        t.saveRunSummary(runID, started, runDir, r, err)
+        return r, err
+    }
+
+    // Run hooks and the run's health check surround the whole run; the
+    // failures of its steps are passed to them at the end
+    var failures []string
+    t.startRunPing(ctx)
+    defer func() {
+        t.finishRunHooks(started, failures)
+        t.finishRunPing(started, failures, err)
+        r = t.sendRunReport(started, failures)
+        t.notifySizeAnomalies(r)
+        t.notifySiteOwners(r)
+        t.saveRunSummary(runID, started, runDir, r, err)
+    }()
+    return nil, t.backupAll(ctx, scope, &failures)
+}
+
+// backupAll performs the steps of a full run of scope, adding the failures
+// of steps that don't end the run to failures
+func (t *Tool) backupAll(ctx context.Context, scope Scope, failures *[]string) error {
+    if err := t.startRunHooks(ctx); err != nil {
+        *failures = append(*failures, err.Error())
+        return err
+    }
+
+    // First, perform local backups
+    slog.Info("Starting local backups")
+    if err := t.performLocalBackups(ctx, scope); err != nil {
+        slog.Error("Local backups failed", "error", err)
+        *failures = append(*failures, fmt.Sprintf("local backups: %v", err))
+    }
+    if t.stopping() {
+        return nil
+    }
+    if err := runCancelled(ctx); err != nil {
+        return err
+    }
+
+    // Then, if enabled, perform remote backups
+    if t.cfg.Remote.Enabled {
+        slog.Info("Starting remote backups")
+        if err := t.performRemoteBackups(ctx, scope); err != nil {
+            slog.Error("Remote backups failed", "error", err)
+            *failures = append(*failures, fmt.Sprintf("remote backups: %v", err))
+        }
+        if t.stopping() {
+            return nil
+        }
+        if err := runCancelled(ctx); err != nil {
+            return err
+        }
+    }
+
+    // Move archives past the lifecycle's age to cold storage
+    if t.cfg.Lifecycle.Enabled() {
+        slog.Info("Moving old archives to cold storage")
+        if err := t.MoveColdArchives(ctx); err != nil {
+            slog.Error("Moving archives to cold storage failed", "error", err)
+            *failures = append(*failures, fmt.Sprintf("lifecycle: %v", err))
+        }
+        if err := runCancelled(ctx); err != nil {
+            return err
+        }
+    }
+
+    // Keep the warm standby in sync with the newest backups
+    if t.cfg.Standby.Enabled {
+        slog.Info("Syncing standby server")
+        if err := t.SyncStandby(ctx, t.cfg.Standby.Source); err != nil {
+            slog.Error("Standby sync failed", "error", err)
+            *failures = append(*failures, fmt.Sprintf("standby sync: %v", err))
+        }
+        if err := runCancelled(ctx); err != nil {
+            return err
+        }
+    }
+
+    // Finally, evaluate recovery objectives against the resulting backups
+    results, err := t.EvaluateCompliance()
+    if err != nil {
+        slog.Error("Failed to evaluate recovery objectives", "error", err)
+        return nil
+    }
+    fmt.Fprintln(t.out(), "\nRecovery Objectives:")
+    fmt.Fprintln(t.out(), "-------------------")
+    fmt.Fprint(t.out(), report.FormatCompliance(results))
+    return nil
+}
+
+// backupScope performs the local and remote backups of a run that isn't a
+// full run, adding their failures to failures, and returns the first
+func (t *Tool) backupScope(ctx context.Context, scope Scope, failures *[]string) error {
+    var firstErr error
+    fail := func(err error) {
+        *failures = append(*failures, err.Error())
+        if firstErr == nil {
+            firstErr = err
+        }
+    }
+
+    if scope.local() {
+        slog.Info("Starting local backup", "sites", strings.Join(scope.Sites, ","), "only", scope.Only)
+        if err := t.performLocalBackups(ctx, scope); err != nil {
+            if scope.remote() {
+                err = fmt.Errorf("local backups: %v", err)
+            }
+            fail(err)
+        }
+        if t.stopping() {
+            return firstErr
+        }
+        if err := runCancelled(ctx); err != nil {
+            return err
+        }
+    }
+
+    if scope.remote() && t.cfg.Remote.Enabled {
+        slog.Info("Starting remote backups", "sites", strings.Join(scope.Sites, ","), "only", scope.Only)
+        if err := t.performRemoteBackups(ctx, scope); err != nil {
+            if scope.local() {
+                err = fmt.Errorf("remote backups: %v", err)
+            }
+            fail(err)
+        }
+    }
+    return firstErr
+}
+
+// performLocalBackups backs up the local sites, or only the sites of scope
+// and their applications, and only its component if any. The caller must
+// hold the run lock, or the locks of the given sites. A cancelled run is
+// resumed by the next one, a failed one by the next one with Resume; runs of single sites or components have a queue
+// of their own, resumed by the next run of the same scope.
+func (t *Tool) performLocalBackups(ctx context.Context, scope Scope) error {
+    sites, only := scope.Sites, scope.Only
+    // Initialize backup manager with the script-specific backup directory
+    backupManager, err := t.OpenManager(t.cfg.Local.BackupDir)
+    if err != nil {
+        return fmt.Errorf("error initializing backup manager: %v", err)
+    }
+    backupManager.AllowLarge = scope.AllowLarge
+
+    // Remove temporary directories left behind by crashed runs
+    if err := backup.CleanStaleTempDirs(); err != nil {
+        slog.Warn("Failed to clean stale temporary directories", "error", err)
+    }
+
+    // Open the persisted job queue; an interrupted run is resumed where it
+    // stopped, and with Resume a failed one where it failed
+    dir := t.queueDir(sites, only)
+    var resumed *queue.Queue
+    if scope.Resume {
+        if resumed, err = queue.ResumeLast(dir); err != nil {
+            return fmt.Errorf("error resuming the last run: %v", err)
+        }
+        if resumed != nil {
+            slog.Info("Resuming failed run", "queue_run", resumed.RunID)
+        }
+    }
+    q, err := queue.Open(dir)
+    if err != nil {
+        return fmt.Errorf("error opening job queue: %v", err)
+    }
+    if q.Empty() && scope.Resume {
+        slog.Info("Nothing to resume, the last run of local sites had no failures")
+        return nil
+    }
+    if q.Empty() {
+        webServer, configPath, err := t.DetectWebServer()
+        if err != nil && t.cfg.Docker.Enabled {
+            slog.Info("No web server found, backing up Docker sites only", "error", err)
+            webServer, configPath = noWebServer, ""
+        } else if err != nil {
+            return err
+        }
+        params := map[string]string{"server": webServer, "config": configPath}
+        if len(sites) > 0 {
+            params["sites"] = strings.Join(sites, ",")
+        }
+        if only != "" {
+            params["only"] = only
+        }
+        if scope.Force {
+            params["force"] = "true"
+        }
+        if _, err := q.Enqueue(queue.KindDiscover, "", params); err != nil {
+            return fmt.Errorf("error enqueuing discovery: %v", err)
+        }
+    } else if resumed == nil {
+        slog.Info("Resuming interrupted run", "queue_run", q.RunID)
+    }
+
+    // Run discovery, archives, dumps, verification and rotation as jobs
+    jobs := newLocalJobs(backupManager)
+    jobs.sitesLocked = len(sites) > 0
+    q.LimitSites(t.cfg.Local.ParallelSites)
+    release := t.onStop(q.Stop)
+    err = q.Run(ctx, jobs.handlers(), backup.GetEnvInt("QUEUE_WORKERS", runtime.NumCPU()))
+    release()
+    if err == queue.ErrStopped && ctx.Err() != nil {
+        printJobResults(q.Snapshot())
+        return fmt.Errorf("cancelled, the run is resumed by the next run: %v", context.Cause(ctx))
+    }
+    if err == queue.ErrStopped {
+        slog.Info("Stopped run after the running jobs, it is resumed by the next run", "queue_run", q.RunID)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error running job queue: %v", err)
+    }
+
+    // Log the backup results
+    printJobResults(q.Snapshot())
+    recordRunStatuses(backupManager, q)
+
+    if err := q.Finish(); err != nil {
+        return fmt.Errorf("error finishing job queue: %v", err)
+    }
+
+    // Bring the catalog back in line with what is actually on disk
+    return t.reconcileStorage(backupManager, true)
+}
+
+// queueDir returns the directory of the job queue of a run of the given
+// sites and component, or of a full run if there are neither
+func (t *Tool) queueDir(sites []string, only string) string {
+    dir := filepath.Join(t.cfg.Local.BackupDir, queueDirName)
+    if len(sites) == 0 && only == "" {
+        return dir
+    }
+    sorted := append([]string(nil), sites...)
+    sort.Strings(sorted)
+    name := strings.Join(sorted, "+")
+    if name == "" {
+        name = "all"
+    }
+    if only != "" {
+        name += "@" + only
+    }
+    return filepath.Join(dir, siteQueuesDirName, name)
+}
+
+// Retry re-runs a failed job of a local backup run, together with the jobs
+// skipped because of it, and returns whether it succeeded. It returns false
+// without running anything if the job already completed. The caller must
+// hold the run lock.
+func (t *Tool) Retry(ctx context.Context, jobID string) (bool, error) {
+    q, err := t.openRunOf(jobID)
+    if err != nil {
+        return false, err
+    }
+
+    retried, err := q.Retry(jobID)
+    if err != nil || !retried {
+        return false, err
+    }
+
+    backupManager, err := t.OpenManager(t.cfg.Local.BackupDir)
+    if err != nil {
+        return false, fmt.Errorf("error initializing backup manager: %v", err)
+    }
+
+    slog.Info("Retrying job", "job", jobID, "queue_run", q.RunID)
+    t.lowerPriority()
+    ctx, cancel := t.runContext(ctx)
+    defer cancel()
+    if err := q.Run(ctx, newLocalJobs(backupManager).handlers(), 1); err != nil {
+        if cancelled := runCancelled(ctx); cancelled != nil {
+            return false, cancelled
+        }
+        return false, err
+    }
+    printJobResults(q.Snapshot())
+    recordRunStatuses(backupManager, q)
+
+    if job := q.Job(jobID); job == nil || job.State != queue.StateDone {
+        return false, fmt.Errorf("job %s failed again", jobID)
+    }
+    return true, nil
+}
+
+// openRunOf loads the run containing a job from the queue of full runs or
+// one of the queues of runs of single sites
+func (t *Tool) openRunOf(jobID string) (*queue.Queue, error) {
+    dir := filepath.Join(t.cfg.Local.BackupDir, queueDirName)
+    q, err := queue.OpenRun(dir, jobID)
+    if err == nil {
+        return q, nil
+    }
+    siteQueues, _ := filepath.Glob(filepath.Join(dir, siteQueuesDirName, "*"))
+    for _, siteQueue := range siteQueues {
+        if siteRun, siteErr := queue.OpenRun(siteQueue, jobID); siteErr == nil {
+            return siteRun, nil
+        }
+    }
+    return nil, err
+}
+
+// DetectWebServer determines which web server serves the local sites and
+// returns it with the location of its configuration. The configured web
+// server or control panel is used if set; otherwise Apache if its
+// configuration exists, then Nginx, then OpenLiteSpeed, then IIS.
+func (t *Tool) DetectWebServer() (string, string, error) {
+    ws := t.cfg.WebServer
+    switch ws.Type {
+    case config.WebServerApache:
+        return config.WebServerApache, ws.ApacheConfig, nil
+    case config.WebServerNginx:
+        return config.WebServerNginx, ws.NginxConfigDir, nil
+    case config.WebServerLiteSpeed:
+        return config.WebServerLiteSpeed, ws.LiteSpeedConfigDir, nil
+    case config.WebServerIIS:
+        return config.WebServerIIS, ws.IISAppCmd, nil
+    case config.WebServerPlesk:
+        return config.WebServerPlesk, ws.PleskBin, nil
+    case config.WebServerCPanel:
+        return config.WebServerCPanel, ws.CPanelUserdata, nil
+    }
+
+    if _, err := os.Stat(ws.ApacheConfig); err == nil {
+        return config.WebServerApache, ws.ApacheConfig, nil
+    }
+    if _, err := os.Stat(ws.NginxConfigDir); err == nil {
+        return config.WebServerNginx, ws.NginxConfigDir, nil
+    }
+    if _, err := os.Stat(filepath.Join(ws.LiteSpeedConfigDir, "httpd_config.conf")); err == nil {
+        return config.WebServerLiteSpeed, ws.LiteSpeedConfigDir, nil
+    }
+    if _, err := os.Stat(ws.IISAppCmd); err == nil {
+        return config.WebServerIIS, ws.IISAppCmd, nil
+    }
+    return "", "", fmt.Errorf("no web server configuration found at %s, %s, %s or %s", ws.ApacheConfig, ws.NginxConfigDir, ws.LiteSpeedConfigDir, ws.IISAppCmd)
+}
+
+// SiteLocation looks up the document root and .env location of a site or
+// application in the web server configuration. It returns empty strings for
+// sites not served by this server.
+func (t *Tool) SiteLocation(site string) (string, string) {
+    webServer, configPath, err := t.DetectWebServer()
+    if err != nil {
+        return "", ""
+    }
+    vhosts, err := config.ParseVhosts(webServer, configPath)
+    if err != nil {
+        return "", ""
+    }
+    siteName, appName := backup.SplitAppKey(site)
+    for _, vhost := range vhosts {
+        if vhost.ServerName != siteName {
+            continue
+        }
+        if appName == "" {
+            return vhost.DocumentRoot, vhost.DocumentRoot
+        }
+        for _, app := range DiscoverApps(vhost) {
+            if app.Name == appName {
+                return app.DocumentRoot, app.EnvFile
+            }
+        }
+    }
+    return "", ""
+}
+
+// SiteRoots returns the document roots of the sites and applications served
+// by this server
+func (t *Tool) SiteRoots() []string {
+    webServer, configPath, err := t.DetectWebServer()
+    if err != nil {
+        return nil
+    }
+    vhosts, err := config.ParseVhosts(webServer, configPath)
+    if err != nil {
+        return nil
+    }
+    var roots []string
+    for _, vhost := range vhosts {
+        roots = append(roots, vhost.DocumentRoot)
+        for _, app := range DiscoverApps(vhost) {
+            roots = append(roots, app.DocumentRoot)
+        }
+    }
+    return roots
+}
@@ -0,0 +1,117 @@
+package backuptool
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+)
+
+// Estimate lists the document roots of the sites of scope without archiving
+// them and returns the size of the files their archives would hold,
+// compared with the sites' maximum and warning sizes. Only Sites and Source
+// of scope are used.
+func (t *Tool) Estimate(ctx context.Context, scope Scope) ([]backup.SiteEstimate, error) {
+    if err := scope.Validate(); err != nil {
+        return nil, err
+    }
+    var estimates []backup.SiteEstimate
+    if scope.local() {
+        local, err := t.estimateLocal(ctx, scope.Sites)
+        if err != nil {
+            return nil, err
+        }
+        estimates = append(estimates, local...)
+    }
+    if scope.remote() && t.cfg.Remote.Enabled {
+        remote, err := t.estimateRemote(ctx, scope)
+        if err != nil {
+            return estimates, err
+        }
+        estimates = append(estimates, remote...)
+    }
+    return estimates, nil
+}
+
+// estimateLocal estimates the local sites and their applications, or only
+// the given sites
+func (t *Tool) estimateLocal(ctx context.Context, sites []string) ([]backup.SiteEstimate, error) {
+    manager, err := t.OpenManager(t.cfg.Local.BackupDir)
+    if err != nil {
+        return nil, fmt.Errorf("error initializing backup manager: %v", err)
+    }
+    webServer, configPath, err := t.DetectWebServer()
+    if err != nil {
+        return nil, err
+    }
+    vhosts, err := config.ParseVhosts(webServer, configPath)
+    if err != nil {
+        return nil, fmt.Errorf("error parsing %s config: %v", webServer, err)
+    }
+    sort.Slice(vhosts, func(i, j int) bool {
+        return vhosts[i].ServerName < vhosts[j].ServerName
+    })
+    if len(sites) > 0 {
+        if vhosts, err = selectVhosts(vhosts, sites); err != nil {
+            return nil, err
+        }
+    }
+
+    var estimates []backup.SiteEstimate
+    for _, vhost := range vhosts {
+        if ctx.Err() != nil {
+            return nil, context.Cause(ctx)
+        }
+        estimate := manager.Estimate(ctx, backup.LocalTransport{}, vhost.ServerName, vhost.DocumentRoot)
+        estimate.Source = "local"
+        estimates = append(estimates, estimate)
+        for _, app := range DiscoverApps(vhost) {
+            estimate := manager.Estimate(ctx, backup.LocalTransport{}, backup.AppKey(vhost.ServerName, app.Name), app.DocumentRoot)
+            estimate.Source = "local"
+            estimates = append(estimates, estimate)
+        }
+    }
+    return estimates, nil
+}
+
+// estimateRemote estimates the sites of the remote servers of scope, one
+// server after the other
+func (t *Tool) estimateRemote(ctx context.Context, scope Scope) ([]backup.SiteEstimate, error) {
+    targets, sshConfigs, err := t.remoteSSHConfigs(scope)
+    if err != nil {
+        return nil, err
+    }
+    var estimates []backup.SiteEstimate
+    for i, target := range targets {
+        server, err := t.estimateRemoteServer(ctx, sshConfigs[i])
+        if err != nil {
+            if target.name != "" {
+                err = fmt.Errorf("remote server %s: %v", target.name, err)
+            }
+            return estimates, err
+        }
+        source := "remote"
+        if target.name != "" {
+            source += "/" + target.name
+        }
+        for _, estimate := range server {
+            estimate.Source = source
+            estimates = append(estimates, estimate)
+        }
+    }
+    return estimates, nil
+}
+
+// estimateRemoteServer estimates the sites of one remote server
+func (t *Tool) estimateRemoteServer(ctx context.Context, sshConfig *backup.SSHConfig) ([]backup.SiteEstimate, error) {
+    sshBackup, err := backup.NewSSHBackup(sshConfig)
+    if err != nil {
+        return nil, fmt.Errorf("failed to initialize SSH backup: %v", err)
+    }
+    defer sshBackup.Close()
+    if err := t.configureManager(sshBackup.Manager()); err != nil {
+        return nil, err
+    }
+    return sshBackup.EstimateRemoteSites(ctx)
+}
@@ -0,0 +1,67 @@
+package backuptool
+
+import (
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "time"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/report"
+)
+
+// openRunLog starts writing the log of a run to its directory below the
+// local backup directory. The returned function closes the log and rotates
+// the run directories. Without kept runs, or if the log can't be created,
+// the directory is empty and the run goes on without a log on disk.
+func (t *Tool) openRunLog(runID string, started time.Time) (string, func()) {
+    keep := t.cfg.Logging.KeepRuns
+    if keep == 0 {
+        return "", func() {}
+    }
+    dir := report.RunDir(t.cfg.Local.BackupDir, started, runID)
+    if err := os.MkdirAll(dir, 0750); err != nil {
+        slog.Warn("Failed to create the run log directory", "error", err)
+        return "", func() {}
+    }
+    runLog, err := logging.OpenRunLog(filepath.Join(dir, logging.RunLogName))
+    if err != nil {
+        slog.Warn("Failed to open the run log", "error", err)
+        return "", func() {}
+    }
+    return dir, func() {
+        runLog.Close()
+        if err := report.RotateRuns(t.cfg.Local.BackupDir, keep); err != nil {
+            slog.Warn("Failed to rotate the run logs", "error", err)
+        }
+    }
+}
+
+// recordOutcome writes the summary of a run to its directory and records
+// the run's outcome in the catalog of the local backups
+func (t *Tool) recordOutcome(runDir string, summary report.RunSummary) error {
+    if runDir != "" {
+        if _, err := report.SaveRunSummary(runDir, summary); err != nil {
+            return err
+        }
+    }
+    cat, err := catalog.Open(t.cfg.Local.BackupDir)
+    if err != nil {
+        return err
+    }
+    if err := cat.RecordOutcome(catalog.RunOutcome{
+        RunID:       summary.RunID,
+        Started:     summary.Started,
+        Finished:    summary.Finished,
+        Status:      summary.Status,
+        ExitCode:    summary.ExitCode,
+        Error:       summary.Error,
+        FailedSites: summary.FailedSites,
+        TotalSites:  summary.TotalSites,
+        Dir:         runDir,
+    }); err != nil {
+        return fmt.Errorf("failed to record the run outcome: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,109 @@
+package backuptool
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "slices"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/healthcheck"
+)
+
+// runHookEnv describes a backup run to the run hooks
+func (t *Tool) runHookEnv(event string) backup.HookEnv {
+    return backup.HookEnv{Event: event, Source: "local", BackupDir: t.cfg.Local.BackupDir}
+}
+
+// startRunHooks runs the pre_backup run hook; a failure cancels the run
+func (t *Tool) startRunHooks(ctx context.Context) error {
+    return backup.RunHook(ctx, t.cfg.Hooks.Run.PreBackup, t.runHookEnv(config.HookPreBackup), t.cfg.Hooks.Timeout)
+}
+
+// finishRunHooks runs the post_backup run hook and, if a step of the run,
+// the backup of a site since started or that hook failed, the on_failure
+// hook. They run even when the run was cancelled.
+func (t *Tool) finishRunHooks(started time.Time, failures []string) {
+    hooks := t.cfg.Hooks.Run
+    if hooks.PostBackup == "" && hooks.OnFailure == "" {
+        return
+    }
+    failures = append(failures, t.failedSince(started)...)
+    status, message := "success", ""
+    if len(failures) > 0 {
+        status, message = "failed", strings.Join(failures, "; ")
+    }
+
+    env := t.runHookEnv(config.HookPostBackup)
+    env.Status, env.Error = status, message
+    if err := backup.RunHook(context.Background(), hooks.PostBackup, env, t.cfg.Hooks.Timeout); err != nil {
+        slog.Error("Hook failed", "hook", env.Event, "error", err)
+        if status == "success" {
+            status, message = "failed", err.Error()
+        }
+    }
+    if status != "failed" {
+        return
+    }
+    env = t.runHookEnv(config.HookOnFailure)
+    env.Status, env.Error = status, message
+    if err := backup.RunHook(context.Background(), hooks.OnFailure, env, t.cfg.Hooks.Timeout); err != nil {
+        slog.Error("Hook failed", "hook", env.Event, "error", err)
+    }
+}
+
+// startRunPing pings the start of a full run to the run's health check
+func (t *Tool) startRunPing(ctx context.Context) {
+    if t.cfg.Healthchecks.Run == "" {
+        return
+    }
+    if err := healthcheck.Ping(ctx, t.cfg.Retry.Policy(), t.cfg.Healthchecks.Run, healthcheck.Start, "Backup run started\n"); err != nil {
+        slog.Warn("Health check ping failed", "event", healthcheck.Start, "error", err)
+    }
+}
+
+// finishRunPing pings the outcome of a full run to the run's health check:
+// the failures of its steps, the site components that failed since it
+// started and the error that ended it
+func (t *Tool) finishRunPing(started time.Time, failures []string, runErr error) {
+    if t.cfg.Healthchecks.Run == "" {
+        return
+    }
+    failures = append(failures, t.failedSince(started)...)
+    if runErr != nil && !slices.Contains(failures, runErr.Error()) {
+        failures = append(failures, runErr.Error())
+    }
+    if err := healthcheck.Finish(context.Background(), t.cfg.Retry.Policy(), t.cfg.Healthchecks.Run, "Backup run", time.Since(started), failures); err != nil {
+        slog.Warn("Health check ping failed", "error", err)
+    }
+}
+
+// failedSince returns the site components whose backup failed since a time,
+// as recorded in the catalogs of the local and remote backups
+func (t *Tool) failedSince(since time.Time) []string {
+    var failed []string
+    for _, source := range t.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); err != nil {
+            continue
+        }
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            failed = append(failed, fmt.Sprintf("%s: %v", source.Name, err))
+            continue
+        }
+        for site, components := range cat.LatestRuns() {
+            for component, status := range components {
+                if status.Failed() && !status.Time.Before(since) {
+                    failed = append(failed, fmt.Sprintf("%s %s: %s", site, component, status.Error))
+                }
+            }
+        }
+    }
+    sort.Strings(failed)
+    return failed
+}
@@ -0,0 +1,24 @@
+package backuptool
+
+import (
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "fmt"
+    "strings"
+)
+
+// Unlock lets the managers opened from now on remove archives within the
+// lock window of immutable backups, if key is the configured deletion key
+func (t *Tool) Unlock(key string) error {
+    want, err := hex.DecodeString(strings.ToLower(t.cfg.Immutability.DeletionKeySHA256))
+    if err != nil || len(want) == 0 {
+        return fmt.Errorf("no deletion key is configured, set immutability deletion_key_sha256")
+    }
+    sum := sha256.Sum256([]byte(key))
+    if subtle.ConstantTimeCompare(sum[:], want) != 1 {
+        return fmt.Errorf("wrong deletion key")
+    }
+    t.unlocked = true
+    return nil
+}
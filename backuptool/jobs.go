@@ -0,0 +1,830 @@
+package backuptool
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/models"
+    "laravel-backup-tool/queue"
+)
+
+// localJobs executes the jobs of a local backup run
+type localJobs struct {
+    manager    *backup.BackupManager
+    fileBackup *backup.FileBackup
+    dbBackup   *backup.DBBackup
+    // The run holds the locks of its sites, so its jobs don't take them
+    sitesLocked bool
+}
+
+// newLocalJobs creates the job handlers for backups of sites on this machine
+func newLocalJobs(manager *backup.BackupManager) *localJobs {
+    return &localJobs{
+        manager:    manager,
+        fileBackup: backup.NewFileBackup(manager),
+        dbBackup:   backup.NewDBBackup(manager),
+    }
+}
+
+// handlers maps job kinds to their implementation
+func (lj *localJobs) handlers() map[string]queue.Handler {
+    return map[string]queue.Handler{
+        queue.KindDiscover: lj.discover,
+        queue.KindArchive:  lj.siteLocked(lj.archive),
+        queue.KindDump:     lj.siteLocked(lj.dump),
+        queue.KindVerify:   lj.siteLocked(lj.verify),
+        queue.KindUpload:   lj.siteLocked(lj.upload),
+        queue.KindPrune:    lj.siteLocked(lj.prune),
+        queue.KindHook:     lj.siteLocked(lj.hook),
+    }
+}
+
+// siteLocked makes a handler hold the lock of the job's site, so it waits
+// while a backup of only that site runs
+func (lj *localJobs) siteLocked(handler queue.Handler) queue.Handler {
+    if lj.sitesLocked {
+        return handler
+    }
+    return func(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+        lock, err := backup.LockSiteJob(ctx, lj.manager.BaseDir, job.Site)
+        if err != nil {
+            return nil, err
+        }
+        defer lock.Unlock()
+        return handler(ctx, q, job)
+    }
+}
+
+// discover parses the web server configuration and enqueues the jobs of
+// every site, and of the sites running in Docker containers if enabled.
+// Sites that already have jobs (from before an interruption) are not enqueued twice.
+func (lj *localJobs) discover(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    // Runs queued before Nginx support always used Apache
+    webServer := job.Params["server"]
+    if webServer == "" {
+        webServer = config.WebServerApache
+    }
+
+    // Parse the web server configuration to get site information; machines
+    // running only Docker sites have none
+    var vhosts []config.Vhost
+    if webServer != noWebServer {
+        var err error
+        if vhosts, err = config.ParseVhosts(webServer, job.Params["config"]); err != nil {
+            return nil, fmt.Errorf("error parsing %s config: %v", webServer, err)
+        }
+    }
+    sort.Slice(vhosts, func(i, j int) bool {
+        return vhosts[i].ServerName < vhosts[j].ServerName
+    })
+    var dockerSites []backup.DockerSite
+    if lj.manager.Docker.Enabled {
+        var err error
+        if dockerSites, err = lj.manager.DiscoverDockerSites(ctx); err != nil {
+            return nil, err
+        }
+    }
+
+    // Scheduled runs of single sites only back up those sites
+    if only := job.Params["sites"]; only != "" {
+        var names []string
+        dockerSites, names = selectDockerSites(dockerSites, strings.Split(only, ","))
+        var err error
+        if vhosts, err = selectVhosts(vhosts, names); err != nil {
+            return nil, err
+        }
+    }
+    // Runs of one component, "file" or "database", leave out the other;
+    // its first job tells whether a site was enqueued before an interruption
+    only := job.Params["only"]
+    force := job.Params["force"] == "true"
+    firstKind := queue.KindArchive
+    if only == "database" {
+        firstKind = queue.KindDump
+    }
+
+    for _, vhost := range vhosts {
+        if lj.inBlackout(vhost.ServerName, force) {
+            continue
+        }
+        site := models.Site{
+            ServerName:   vhost.ServerName,
+            DocumentRoot: vhost.DocumentRoot,
+            Apps:         DiscoverApps(vhost),
+        }
+
+        // Read the database credentials from the application's configuration
+        creds, kind, err := config.FindCredentials(site.DocumentRoot)
+        if err != nil {
+            slog.Warn("Failed to read database credentials", "site", site.ServerName, "error", err)
+        }
+        site.Framework = kind
+        site.DatabaseHost, site.DatabaseName, site.DatabaseUser, site.DatabasePass,
+            site.DatabaseDriver, site.DatabasePort = creds.Host, creds.Name, creds.User, creds.Password,
+            creds.Driver, creds.Port
+        printSite(site)
+
+        if !q.HasJob(firstKind, site.ServerName) {
+            // Credentials are not stored in the queue; the dump job reads them again
+            params := map[string]string{"document_root": site.DocumentRoot}
+            hasDatabase := creds.Complete()
+            if err := lj.enqueueSiteJobs(q, site.ServerName, params, hasDatabase, only, force); err != nil {
+                return nil, err
+            }
+        }
+
+        // Every application is backed up like a site of its own below the site's directory
+        for _, app := range site.Apps {
+            key := backup.AppKey(site.ServerName, app.Name)
+            if q.HasJob(firstKind, key) || lj.inBlackout(key, force) {
+                continue
+            }
+            params := map[string]string{"document_root": app.DocumentRoot, "env_file": app.EnvFile}
+            hasDatabase := config.Credentials{Driver: app.DatabaseDriver, Host: app.DatabaseHost, Name: app.DatabaseName,
+                User: app.DatabaseUser, Password: app.DatabasePass}.Complete()
+            if err := lj.enqueueSiteJobs(q, key, params, hasDatabase, only, force); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    for _, site := range dockerSites {
+        if lj.inBlackout(site.Name, force) {
+            continue
+        }
+        slog.Info("Found Docker site", "site", site.Name, "container", site.Container,
+            "volume", site.Volume, "db_container", site.DBContainer)
+        // Sites without a volume only have a dump
+        siteOnly, siteFirst := only, firstKind
+        if site.Volume == "" {
+            if only == "file" {
+                continue
+            }
+            siteOnly, siteFirst = "database", queue.KindDump
+        }
+        if q.HasJob(siteFirst, site.Name) {
+            continue
+        }
+        params := map[string]string{"docker_volume": site.Volume, "docker_db": site.DBContainer, "docker_db_name": site.DBName}
+        if err := lj.enqueueSiteJobs(q, site.Name, params, site.DBContainer != "", siteOnly, force); err != nil {
+            return nil, err
+        }
+    }
+
+    return map[string]string{"sites": strconv.Itoa(len(vhosts) + len(dockerSites))}, nil
+}
+
+// noWebServer is the web server of runs on machines with only Docker sites
+const noWebServer = "none"
+
+// selectDockerSites returns the Docker sites among the named sites, and the
+// names of the others
+func selectDockerSites(sites []backup.DockerSite, names []string) ([]backup.DockerSite, []string) {
+    var selected []backup.DockerSite
+    var rest []string
+    for _, name := range names {
+        found := false
+        for _, site := range sites {
+            if site.Name == name {
+                selected = append(selected, site)
+                found = true
+                break
+            }
+        }
+        if !found {
+            rest = append(rest, name)
+        }
+    }
+    return selected, rest
+}
+
+// selectVhosts returns the virtual hosts of the named sites
+func selectVhosts(vhosts []config.Vhost, names []string) ([]config.Vhost, error) {
+    var selected []config.Vhost
+    for _, name := range names {
+        found := false
+        for _, vhost := range vhosts {
+            if vhost.ServerName == name {
+                selected = append(selected, vhost)
+                found = true
+                break
+            }
+        }
+        if !found {
+            return nil, fmt.Errorf("site %s not found in the web server configuration", name)
+        }
+    }
+    return selected, nil
+}
+
+// DiscoverApps finds the Laravel applications aliased into a virtual host.
+// Aliases that don't point to a Laravel application, e.g. asset directories,
+// are ignored, as are aliases of the site's own application.
+func DiscoverApps(vhost config.Vhost) []models.App {
+    siteRoot, _ := config.FindLaravelApp(vhost.DocumentRoot)
+
+    var paths []string
+    for urlPath := range vhost.Aliases {
+        paths = append(paths, urlPath)
+    }
+    sort.Strings(paths)
+
+    var apps []models.App
+    for _, urlPath := range paths {
+        dir := vhost.Aliases[urlPath]
+        root, ok := config.FindLaravelApp(dir)
+        if !ok || root == siteRoot {
+            continue
+        }
+        app := models.App{
+            Name:         config.AppName(urlPath),
+            Path:         urlPath,
+            DocumentRoot: dir,
+            EnvFile:      filepath.Join(root, ".env"),
+        }
+        creds, _, _ := config.FindCredentials(app.EnvFile)
+        app.DatabaseHost, app.DatabaseName, app.DatabaseUser, app.DatabasePass,
+            app.DatabaseDriver, app.DatabasePort = creds.Host, creds.Name, creds.User, creds.Password,
+            creds.Driver, creds.Port
+        apps = append(apps, app)
+    }
+    return apps
+}
+
+// enqueueSiteJobs enqueues the file backup of a site or application and,
+// if it has database credentials, its database dump, or only the component
+// only if not empty, and only what is due unless force is set. Dumps of the
+// Redis and MongoDB data the site opted in to go with the database dump.
+// The site's hooks surround them: pre_backup runs first and a failure skips
+// the backup, post_backup follows the archive and dump, not their upload, so
+// the site is back to normal as early as possible, and on_failure comes
+// last. Hook jobs also ping the site's health check, at pre_backup and once
+// everything else finished.
+func (lj *localJobs) enqueueSiteJobs(q *queue.Queue, site string, params map[string]string, hasDatabase bool, only string, force bool) error {
+    withFiles := only != "database" && lj.due(site, "file", force)
+    withDatabase := hasDatabase && only != "file" && lj.due(site, "database", force)
+    var stores []string
+    if only != "file" {
+        for _, store := range lj.manager.Datastores.For(site).Enabled() {
+            if lj.due(site, store, force) {
+                stores = append(stores, store)
+            }
+        }
+    }
+    if !withFiles && !withDatabase && len(stores) == 0 {
+        if only == "database" && !hasDatabase {
+            slog.Info("No database to back up", "site", site)
+        }
+        return nil
+    }
+
+    hooks := lj.manager.Hooks.For(site)
+    ping := lj.manager.Healthchecks.For(site) != ""
+    var before []string
+    if hooks.PreBackup != "" || ping {
+        pre, err := q.Enqueue(queue.KindHook, site, hookParams(params, config.HookPreBackup))
+        if err != nil {
+            return err
+        }
+        before = []string{pre.ID}
+    }
+
+    var created, finished []string
+    if withFiles {
+        create, last, err := lj.enqueueArtifactJobs(q, queue.KindArchive, site, "file", params, before)
+        if err != nil {
+            return err
+        }
+        created, finished = append(created, create), append(finished, last)
+    }
+
+    // Dump the database only if credentials are available
+    if withDatabase {
+        create, last, err := lj.enqueueArtifactJobs(q, queue.KindDump, site, "database", params, before)
+        if err != nil {
+            return err
+        }
+        created, finished = append(created, create), append(finished, last)
+    }
+    for _, store := range stores {
+        create, last, err := lj.enqueueArtifactJobs(q, queue.KindDump, site, store, datastoreParams(params, store), before)
+        if err != nil {
+            return err
+        }
+        created, finished = append(created, create), append(finished, last)
+    }
+
+    if hooks.PostBackup != "" {
+        post, err := q.EnqueueAlways(queue.KindHook, site, hookParams(params, config.HookPostBackup),
+            append(append([]string(nil), before...), created...)...)
+        if err != nil {
+            return err
+        }
+        finished = append(finished, post.ID)
+    }
+    if hooks.OnFailure != "" || ping {
+        _, err := q.EnqueueAlways(queue.KindHook, site, hookParams(params, config.HookOnFailure),
+            append(append([]string(nil), before...), finished...)...)
+        return err
+    }
+    return nil
+}
+
+// due reports whether an archive of a type of a site is due, logging when
+// it isn't
+func (lj *localJobs) due(site, archiveType string, force bool) bool {
+    if force || lj.manager.Due(site, archiveType) {
+        return true
+    }
+    slog.Info("Not due yet, skipping", "site", site, "type", archiveType,
+        "due", lj.manager.NextDue(site, archiveType).Format(time.RFC3339))
+    return false
+}
+
+// inBlackout reports whether a site is in a blackout window, logging when
+// it is, unless force is set
+func (lj *localJobs) inBlackout(site string, force bool) bool {
+    if force {
+        return false
+    }
+    window, ok := lj.manager.Blackout(site)
+    if ok {
+        slog.Info("Skipping site in blackout window", "site", site, "window", window)
+    }
+    return ok
+}
+
+// hookParams returns the parameters of a hook job of a site
+func hookParams(params map[string]string, event string) map[string]string {
+    hookParams := map[string]string{"event": event}
+    for key, value := range params {
+        hookParams[key] = value
+    }
+    return hookParams
+}
+
+// datastoreParams returns the parameters of the dump job of a data store of
+// a site
+func datastoreParams(params map[string]string, store string) map[string]string {
+    storeParams := map[string]string{"datastore": store}
+    for key, value := range params {
+        storeParams[key] = value
+    }
+    return storeParams
+}
+
+// enqueueArtifactJobs enqueues the job creating an artifact followed by its
+// verification, its upload if off-server storage is configured, and the
+// rotation of older artifacts of the same type. Rotation waits for the
+// upload, so local copies are kept while uploads fail. It returns the IDs
+// of the creating job and of the last job.
+func (lj *localJobs) enqueueArtifactJobs(q *queue.Queue, kind, site, artifactType string, params map[string]string, dependsOn []string) (string, string, error) {
+    create, err := q.Enqueue(kind, site, params, dependsOn...)
+    if err != nil {
+        return "", "", err
+    }
+    last, err := q.Enqueue(queue.KindVerify, site, map[string]string{"type": artifactType}, create.ID)
+    if err != nil {
+        return "", "", err
+    }
+    if lj.manager.Uploader != nil {
+        if last, err = q.Enqueue(queue.KindUpload, site, map[string]string{"type": artifactType}, last.ID); err != nil {
+            return "", "", err
+        }
+    }
+    prune, err := q.Enqueue(queue.KindPrune, site, map[string]string{"type": artifactType}, last.ID)
+    if err != nil {
+        return "", "", err
+    }
+    return create.ID, prune.ID, nil
+}
+
+// printSite logs information about a found site
+func printSite(site models.Site) {
+    attrs := []any{"site", site.ServerName, "document_root", site.DocumentRoot}
+    if site.Framework != "" {
+        attrs = append(attrs, "framework", site.Framework)
+    }
+
+    // Log database information only if available
+    // The password is never logged
+    if site.DatabaseHost != "" || site.DatabaseName != "" || site.DatabaseUser != "" || site.DatabasePass != "" {
+        attrs = append(attrs, "db_driver", site.DatabaseDriver, "db_host", site.DatabaseHost,
+            "db_name", site.DatabaseName, "db_user", site.DatabaseUser)
+    } else {
+        attrs = append(attrs, "database", "none")
+    }
+    slog.Info("Found site", attrs...)
+    for _, app := range site.Apps {
+        attrs := []any{"site", site.ServerName, "app", app.Name, "path", app.Path, "document_root", app.DocumentRoot}
+        if app.DatabaseName != "" {
+            attrs = append(attrs, "db_name", app.DatabaseName, "db_host", app.DatabaseHost)
+        }
+        slog.Info("Found application", attrs...)
+    }
+}
+
+// archive creates the file archive of a site, or of the volume of a
+// Docker site
+func (lj *localJobs) archive(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    if volume := job.Params["docker_volume"]; volume != "" {
+        ctx, cancel := lj.manager.SiteContext(ctx, job.Site)
+        defer cancel()
+        path, err := lj.manager.BackupDockerVolume(ctx, job.Site, volume)
+        if err != nil {
+            return nil, err
+        }
+        return map[string]string{"artifact": path}, nil
+    }
+    // Archiving reads the whole document root, which counts against the IO budget
+    filter, err := lj.manager.FileFilter(job.Site)
+    if err != nil {
+        return nil, err
+    }
+    sourceSize, err := backup.DirSize(job.Params["document_root"], filter)
+    if err != nil {
+        return nil, fmt.Errorf("error measuring document root: %v", err)
+    }
+    if err := lj.manager.CheckBudget(job.Site, 0, sourceSize); err != nil {
+        lj.manager.SkipOverBudget(job.Site, "files", err)
+        return map[string]string{"over_budget": err.Error()}, nil
+    }
+
+    ctx, cancel := lj.manager.SiteContext(ctx, job.Site)
+    defer cancel()
+    path, err := lj.fileBackup.BackupFiles(ctx, job.Site, job.Params["document_root"])
+    if err != nil {
+        return nil, err
+    }
+    lj.manager.ChargeUsage(job.Site, 0, sourceSize)
+    return map[string]string{"artifact": path}, nil
+}
+
+// dump creates the database dump of a site using the credentials from its
+// .env, wp-config.php or other configuration file, through the site's SSH
+// tunnel if it has one, or backs it up physically or archives its binary
+// logs if that is configured for it, or creates the dump of a data
+// store named by the datastore parameter using the settings from its .env.
+// Docker sites are dumped inside their database container.
+func (lj *localJobs) dump(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    if container := job.Params["docker_db"]; container != "" && job.Params["datastore"] == "" {
+        ctx, cancel := lj.manager.SiteContext(ctx, job.Site)
+        defer cancel()
+        path, err := lj.manager.BackupDockerDatabase(ctx, job.Site, container, job.Params["docker_db_name"])
+        if err != nil {
+            return nil, err
+        }
+        return map[string]string{"artifact": path}, nil
+    }
+    // Applications of multi-app sites name their .env explicitly
+    envSource := job.Params["env_file"]
+    if envSource == "" {
+        envSource = job.Params["document_root"]
+    }
+    if store := job.Params["datastore"]; store != "" {
+        return lj.dumpDatastore(ctx, job.Site, store, envSource)
+    }
+    creds, _, err := config.FindCredentials(envSource)
+    if err != nil {
+        return nil, fmt.Errorf("error reading database credentials: %v", err)
+    }
+    if creds.Name == "" {
+        return nil, fmt.Errorf("database credentials are no longer available")
+    }
+
+    mysql := creds.Driver == "" || creds.Driver == backup.DriverMySQL || creds.Driver == backup.DriverMariaDB
+    physical := mysql && lj.manager.Physical.For(job.Site) == config.DBBackupPhysical
+    ctx, cancel := lj.manager.SiteContext(ctx, job.Site)
+    defer cancel()
+    host, port := creds.Host, creds.Port
+    if target, ok := lj.manager.DBTunnels.For(job.Site); ok && creds.Driver != backup.DriverSQLite {
+        if physical {
+            return nil, fmt.Errorf("physical database backups need the database server on this machine, not behind a tunnel")
+        }
+        tunnelConfig, err := newSSHConfig(target.SSHTarget, "DB_TUNNEL", lj.manager.Retry)
+        if err != nil {
+            return nil, err
+        }
+        tunnel, err := backup.OpenDBTunnel(ctx, tunnelConfig, creds.Driver, host, port)
+        if err != nil {
+            return nil, err
+        }
+        defer tunnel.Close()
+        host, port = tunnel.Host(), tunnel.Port()
+    }
+    var path string
+    switch {
+    case physical:
+        path, err = lj.dbBackup.BackupPhysical(ctx, job.Site, host, port, creds.Name, creds.User, creds.Password)
+    case mysql && lj.manager.Binlogs.For(job.Site):
+        path, err = lj.dbBackup.BackupBinlogs(ctx, job.Site, host, port, creds.Name, creds.User, creds.Password)
+    default:
+        path, err = lj.dbBackup.BackupDatabase(ctx, job.Site, creds.Driver, host, port, creds.Name, creds.User, creds.Password)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return map[string]string{"artifact": path}, nil
+}
+
+// dumpDatastore dumps the Redis or MongoDB data of a site
+func (lj *localJobs) dumpDatastore(ctx context.Context, site, store, envSource string) (map[string]string, error) {
+    redis, mongo, ok, err := config.FindDatastoreSettings(envSource)
+    if err != nil {
+        return nil, fmt.Errorf("error reading %s settings: %v", store, err)
+    }
+    if !ok {
+        return nil, fmt.Errorf("no .env with %s settings found", store)
+    }
+
+    ctx, cancel := lj.manager.SiteContext(ctx, site)
+    defer cancel()
+    var path string
+    switch store {
+    case config.DatastoreRedis:
+        path, err = lj.manager.BackupRedis(ctx, site, redis)
+    case config.DatastoreMongo:
+        path, err = lj.manager.BackupMongo(ctx, site, mongo)
+    default:
+        return nil, fmt.Errorf("unknown data store %q", store)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return map[string]string{"artifact": path}, nil
+}
+
+// verify checks that the artifact created by the dependency is readable
+// and matches its recorded checksum
+func (lj *localJobs) verify(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    path := q.DependencyResult(job, "artifact")
+    if path == "" {
+        // Nothing was created because nothing changed
+        return nil, nil
+    }
+
+    // A database backup may have archived binary logs or made a physical
+    // backup instead of a dump
+    archiveType := job.Params["type"]
+    if t, _, ok := backup.ParseArchivePath(path); ok {
+        archiveType = t
+    }
+    if err := backup.CheckArchive(backup.Archive{Site: job.Site, Type: archiveType, Path: path}, lj.manager.Keyring); err != nil {
+        return nil, err
+    }
+    if _, err := backup.VerifyChecksum(path); err != nil {
+        return nil, err
+    }
+    return map[string]string{"artifact": path}, nil
+}
+
+// upload copies the verified artifact to the off-server storage
+func (lj *localJobs) upload(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    path := q.DependencyResult(job, "artifact")
+    if path == "" {
+        return nil, nil
+    }
+    location, err := lj.manager.UploadArchive(path)
+    if err != nil {
+        return nil, err
+    }
+    return map[string]string{"artifact": path, "location": location}, nil
+}
+
+// prune removes backups exceeding the retention limit
+func (lj *localJobs) prune(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    return nil, lj.manager.CleanOldArchives(job.Site, job.Params["type"])
+}
+
+// hook runs a hook command of a site. Hooks after the backup learn its
+// outcome from the site's finished jobs; on_failure only runs if one of
+// them failed. The first attempt of pre_backup pings the start to the site's
+// health check and on_failure, which runs last, the outcome.
+func (lj *localJobs) hook(ctx context.Context, q *queue.Queue, job *queue.Job) (map[string]string, error) {
+    event := job.Params["event"]
+    if event == config.HookPreBackup && job.Attempts <= 1 {
+        lj.manager.PingStart(ctx, job.Site)
+    }
+    env := backup.HookEnv{
+        Event:        event,
+        Site:         job.Site,
+        DocumentRoot: job.Params["document_root"],
+        Source:       "local",
+        BackupDir:    filepath.Join(lj.manager.BaseDir, job.Site),
+    }
+    if event != config.HookPreBackup {
+        env.Status = "success"
+        started := time.Now()
+        var failures []string
+        for _, other := range q.Snapshot() {
+            if other.Site != job.Site || other.ID == job.ID {
+                continue
+            }
+            if !other.StartedAt.IsZero() && other.StartedAt.Before(started) {
+                started = other.StartedAt
+            }
+            if other.State == queue.StateFailed {
+                failures = append(failures, other.Kind+": "+other.Error)
+            }
+            switch {
+            case other.Kind == queue.KindArchive:
+                env.FilesArchive = other.Result["artifact"]
+            case other.Kind == queue.KindDump && other.Params["datastore"] == "":
+                env.DatabaseDump = other.Result["artifact"]
+            }
+            if other.State == queue.StateFailed && env.Error == "" {
+                env.Status, env.Error = "failed", other.Error
+            }
+        }
+        if event == config.HookOnFailure {
+            lj.manager.PingFinish(ctx, job.Site, started, failures)
+            if env.Status != "failed" {
+                return nil, nil
+            }
+        }
+    }
+
+    command := lj.manager.Hooks.For(job.Site).Command(event)
+    if err := backup.RunHook(ctx, command, env, lj.manager.Hooks.Timeout); err != nil {
+        return nil, err
+    }
+    return map[string]string{"status": env.Status}, nil
+}
+
+// printJobResults logs the outcome of a run. Failed jobs are logged with
+// their ID so they can be inspected and retried.
+func printJobResults(jobs []queue.Job) {
+    for _, job := range jobs {
+        switch job.State {
+        case queue.StateDone:
+            switch job.Kind {
+            case queue.KindArchive:
+                if reason := job.Result["over_budget"]; reason != "" {
+                    slog.Warn("Partial backup, files skipped", "site", job.Site, "type", "file", "reason", reason)
+                } else if job.Result["artifact"] == "" {
+                    slog.Info("No changes", "site", job.Site, "type", "file")
+                } else {
+                    slog.Info("Successfully backed up", "site", job.Site, "type", "file")
+                }
+            case queue.KindDump:
+                slog.Info("Successfully backed up", "site", job.Site, "type", componentOf(job))
+            case queue.KindUpload:
+                if location := job.Result["location"]; location != "" {
+                    slog.Info("Uploaded", "site", job.Site, "type", job.Params["type"], "location", location)
+                }
+            }
+        case queue.StateFailed:
+            slog.Warn("Job failed", "job", job.ID, "kind", job.Kind, "site", job.Site,
+                "attempts", job.Attempts, "error", job.Error)
+        case queue.StateSkipped:
+            slog.Warn("Job skipped", "job", job.ID, "kind", job.Kind, "site", job.Site, "error", job.Error)
+        }
+    }
+}
+
+// componentOf returns the backup component ("file", "database", "redis" or
+// "mongo") a job belongs to, or an empty string for jobs not tied to one
+func componentOf(job queue.Job) string {
+    switch job.Kind {
+    case queue.KindArchive:
+        return "file"
+    case queue.KindDump:
+        if store := job.Params["datastore"]; store != "" {
+            return store
+        }
+        return "database"
+    }
+    return job.Params["type"]
+}
+
+// statusRank orders component statuses from best to worst
+var statusRank = map[string]int{
+    catalog.StatusOK:        0,
+    catalog.StatusUnchanged: 1,
+    catalog.StatusPartial:   2,
+    catalog.StatusSkipped:   3,
+    catalog.StatusFailed:    4,
+}
+
+// jobCategory returns the category of the errors of a job, by the step of
+// the backup it is. Verifications belong to creating the archive or dump.
+func jobCategory(job queue.Job) string {
+    switch job.Kind {
+    case queue.KindDiscover:
+        return catalog.CategoryDiscovery
+    case queue.KindArchive:
+        return catalog.CategoryArchive
+    case queue.KindDump:
+        return catalog.CategoryDump
+    case queue.KindUpload:
+        return catalog.CategoryTransfer
+    case queue.KindPrune:
+        return catalog.CategoryRetention
+    case queue.KindHook:
+        return catalog.CategoryHook
+    case queue.KindVerify:
+        if job.Params["type"] == "file" {
+            return catalog.CategoryArchive
+        }
+        return catalog.CategoryDump
+    }
+    return ""
+}
+
+// failureCategory returns the category of a failed job, or of a skipped
+// job the category of the failed job it waited for
+func failureCategory(job queue.Job, byID map[string]queue.Job) string {
+    seen := make(map[string]bool)
+    for job.State == queue.StateSkipped && !seen[job.ID] {
+        seen[job.ID] = true
+        for _, id := range job.DependsOn {
+            if dep, ok := byID[id]; ok && (dep.State == queue.StateFailed || dep.State == queue.StateSkipped) {
+                job = dep
+                break
+            }
+        }
+    }
+    return jobCategory(job)
+}
+
+// componentStatuses derives the outcome of every site's file and database
+// backup from the jobs of a run. A component takes the worst status of the
+// jobs in its chain, so a failed verification marks it as failed. Its
+// duration is the time the jobs of the chain took together.
+func componentStatuses(runID string, jobs []queue.Job) []catalog.RunStatus {
+    byID := make(map[string]queue.Job, len(jobs))
+    for _, job := range jobs {
+        byID[job.ID] = job
+    }
+    byKey := make(map[string]*catalog.RunStatus)
+    durations := make(map[string]time.Duration)
+    var keys []string
+
+    for _, job := range jobs {
+        component := componentOf(job)
+        if component == "" {
+            continue
+        }
+
+        status := catalog.RunStatus{RunID: runID, Site: job.Site, Component: component, Time: time.Now()}
+        switch job.State {
+        case queue.StateFailed:
+            status.Status, status.Error, status.JobID = catalog.StatusFailed, logging.Redact(job.Error), job.ID
+            status.Category = failureCategory(job, byID)
+        case queue.StateSkipped:
+            status.Status, status.Error, status.JobID = catalog.StatusSkipped, logging.Redact(job.Error), job.ID
+            status.Category = failureCategory(job, byID)
+        case queue.StateDone:
+            switch {
+            case job.Result["over_budget"] != "":
+                status.Status, status.Error = catalog.StatusPartial, job.Result["over_budget"]
+            case (job.Kind == queue.KindArchive || job.Kind == queue.KindDump) && job.Result["artifact"] == "":
+                status.Status = catalog.StatusUnchanged
+            default:
+                status.Status = catalog.StatusOK
+            }
+        default:
+            // Unfinished jobs are recorded once the run completes
+            continue
+        }
+
+        key := job.Site + "/" + component
+        if !job.StartedAt.IsZero() {
+            durations[key] += job.UpdatedAt.Sub(job.StartedAt)
+        }
+        current, ok := byKey[key]
+        if !ok {
+            keys = append(keys, key)
+            byKey[key] = &status
+            continue
+        }
+        if statusRank[status.Status] > statusRank[current.Status] {
+            *current = status
+        }
+    }
+
+    sort.Strings(keys)
+    statuses := make([]catalog.RunStatus, 0, len(keys))
+    for _, key := range keys {
+        status := *byKey[key]
+        status.Duration = durations[key]
+        statuses = append(statuses, status)
+    }
+    return statuses
+}
+
+// recordRunStatuses stores the per-component outcome of a run in the catalog
+func recordRunStatuses(manager *backup.BackupManager, q *queue.Queue) {
+    if err := manager.Catalog.RecordRuns(componentStatuses(q.RunID, q.Snapshot())); err != nil {
+        slog.Warn("Failed to record run status", "error", err)
+    }
+}
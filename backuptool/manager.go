@@ -0,0 +1,519 @@
+package backuptool
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/secrets"
+    "laravel-backup-tool/storage"
+)
+
+// OpenManager opens the backup manager of a backup directory and applies
+// the configuration to it
+func (t *Tool) OpenManager(baseDir string) (*backup.BackupManager, error) {
+    manager, err := backup.NewBackupManager(baseDir)
+    if err != nil {
+        return nil, err
+    }
+    if err := t.configureManager(manager); err != nil {
+        return nil, err
+    }
+    return manager, nil
+}
+
+// configureManager applies the retention and excludes of the local storage or
+// of a remote server, depending on the manager's directory, the settings of
+// site owners to the local storage, compression,
+// incremental backups, encryption and the off-server storage
+func (t *Tool) configureManager(manager *backup.BackupManager) error {
+    storage, excludes := t.cfg.Local.Storage, t.cfg.Excludes
+    siteFiles, mysqlDump := t.cfg.SiteFiles, t.cfg.MySQLDump
+    local := true
+    for _, target := range t.remoteTargets() {
+        if manager.BaseDir == target.baseDir {
+            storage, excludes = target.storage, target.excludes
+            local = false
+        }
+    }
+    // Owners' settings only come from the document roots of local sites
+    if local && t.cfg.SiteOverrides.Enabled {
+        merged := t.siteConfig()
+        storage, siteFiles, mysqlDump = merged.Local.Storage, merged.SiteFiles, merged.MySQLDump
+    }
+    manager.MaxFileBackups = storage.MaxFileBackups
+    manager.MaxDBBackups = storage.MaxDBBackups
+    manager.Retention = storage.Retention
+    manager.Timeouts = t.cfg.Timeouts
+    manager.Files = config.FilePatterns{Excludes: excludes, Includes: t.cfg.Includes, FollowSymlinks: t.cfg.FollowSymlinks}
+    manager.SiteFiles = siteFiles
+    manager.Compression = t.cfg.Compression
+    manager.Hooks = t.cfg.Hooks
+    manager.Healthchecks = t.cfg.Healthchecks
+    manager.Datastores = t.cfg.Datastores
+    manager.DBTunnels = t.cfg.DBTunnels
+    manager.FSSnapshots = t.cfg.FSSnapshots
+    manager.MySQLDump = mysqlDump
+    manager.Binlogs = t.cfg.Binlogs
+    manager.Frequency = t.cfg.Frequency
+    manager.Physical = t.cfg.Physical
+    manager.Retry = t.cfg.Retry.Policy()
+    manager.Incremental = t.cfg.Incremental.Enabled
+    manager.FullEvery = t.cfg.Incremental.FullEvery
+    manager.Dedup = t.cfg.Dedup.Enabled
+    if t.cfg.Disk.MinFree != "" {
+        minFree, err := backup.ParseByteSize(t.cfg.Disk.MinFree)
+        if err != nil {
+            return fmt.Errorf("disk min_free: %v", err)
+        }
+        manager.MinFreeSpace = minFree
+    }
+    // Defaults in the budget file still take precedence, as before these
+    // were configurable here
+    for _, limit := range []struct {
+        name, value string
+        field       *backup.ByteSize
+    }{
+        {"disk quota", t.cfg.Disk.Quota, &manager.Budgets.Default.Quota},
+        {"size_limits max_size", t.cfg.SizeLimits.MaxSize, &manager.Budgets.Default.MaxSize},
+        {"size_limits warn_size", t.cfg.SizeLimits.WarnSize, &manager.Budgets.Default.WarnSize},
+    } {
+        if limit.value == "" || *limit.field != 0 {
+            continue
+        }
+        size, err := backup.ParseByteSize(limit.value)
+        if err != nil {
+            return fmt.Errorf("%s: %v", limit.name, err)
+        }
+        *limit.field = size
+    }
+    if t.cfg.Split.Size != "" {
+        splitSize, err := backup.ParseByteSize(t.cfg.Split.Size)
+        if err != nil {
+            return fmt.Errorf("split size: %v", err)
+        }
+        manager.SplitSize = splitSize
+    }
+    manager.LockDays = t.cfg.Immutability.Days
+    manager.Docker = t.cfg.Docker
+    manager.Unlocked = t.unlocked
+
+    keys, err := t.Keyring()
+    if err != nil {
+        return err
+    }
+    manager.Keyring = keys
+    manager.Encrypt = t.cfg.Encryption.Enabled
+
+    uploader, err := t.offsiteUploader()
+    if err != nil {
+        return err
+    }
+    manager.Uploader = uploader
+    manager.Lifecycle = t.cfg.Lifecycle
+    if manager.ColdStorage, err = t.coldStorage(); err != nil {
+        return err
+    }
+    return nil
+}
+
+// StorageOf returns the storage settings of a backup directory
+func (t *Tool) StorageOf(baseDir string) config.Storage {
+    for _, target := range t.remoteTargets() {
+        if target.baseDir == baseDir {
+            return target.storage
+        }
+    }
+    return t.cfg.Local.Storage
+}
+
+// Keyring returns the configured archive encryption keys, or nil if none
+// are configured. The key is read from the key file, or from ENCRYPTION_KEY;
+// with encryption enabled the keyring is consulted and the user prompted too.
+func (t *Tool) Keyring() (*encryption.Keyring, error) {
+    t.keyringOnce.Do(func() {
+        t.keyring, t.keyringErr = t.loadKeyring()
+    })
+    return t.keyring, t.keyringErr
+}
+
+func (t *Tool) loadKeyring() (*encryption.Keyring, error) {
+    enc := t.cfg.Encryption
+    keys := &encryption.Keyring{}
+    if enc.KeyFile != "" {
+        key, err := encryption.LoadKeyFile(enc.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        keys.Key = key
+    } else {
+        value := os.Getenv("ENCRYPTION_KEY")
+        if value == "" && enc.Enabled {
+            var err error
+            if value, err = secrets.Lookup("ENCRYPTION_KEY", "Archive encryption key"); err != nil {
+                return nil, err
+            }
+        }
+        if value != "" {
+            key, err := encryption.ParseKey(value)
+            if err != nil {
+                return nil, err
+            }
+            keys.Key = key
+        } else if enc.Enabled {
+            return nil, fmt.Errorf("encryption is enabled but no key is configured, set ENCRYPTION_KEY_FILE or ENCRYPTION_KEY")
+        }
+    }
+    for _, recipient := range enc.Recipients {
+        r, err := encryption.ParseRecipient(recipient)
+        if err != nil {
+            return nil, err
+        }
+        keys.Recipients = append(keys.Recipients, r)
+    }
+    for _, path := range enc.PreviousKeyFiles {
+        key, err := encryption.LoadKeyFile(path)
+        if err != nil {
+            return nil, err
+        }
+        keys.Previous = append(keys.Previous, key)
+    }
+    for _, path := range enc.IdentityFiles {
+        identities, err := encryption.LoadIdentityFile(path)
+        if err != nil {
+            return nil, err
+        }
+        keys.Identities = append(keys.Identities, identities...)
+    }
+    if keys.Key == nil && len(keys.Previous) == 0 && len(keys.Identities) == 0 {
+        return nil, nil
+    }
+    return keys, nil
+}
+
+// offsiteUploader returns the uploader of the configured S3 bucket, GCS
+// bucket, Azure container, FTP server, WebDAV server, B2 bucket and rclone
+// remote, or nil if none is configured. A missing
+// secret is looked up in the keyring or prompted for once. The storage the
+// lifecycle rules move old archives to is set up at the same time.
+func (t *Tool) offsiteUploader() (storage.Uploader, error) {
+    t.uploaderOnce.Do(func() {
+        var uploaders []storage.Uploader
+        // add builds a configured storage and adds it to the uploaders; the
+        // lifecycle storage is built again with its storage class
+        add := func(name string, build func(class string) (storage.Uploader, error)) error {
+            uploader, err := build("")
+            if err != nil {
+                return err
+            }
+            uploaders = append(uploaders, uploader)
+            if lifecycle := t.cfg.Lifecycle; lifecycle.Enabled() && lifecycle.Storage == name {
+                t.coldUploader = uploader
+                if lifecycle.StorageClass != "" {
+                    t.coldUploader, err = build(lifecycle.StorageClass)
+                }
+            }
+            return err
+        }
+        if s3 := t.cfg.S3; s3.Bucket != "" {
+            if s3.SecretAccessKey == "" {
+                s3.SecretAccessKey, t.uploaderErr = secrets.Lookup("S3_SECRET_ACCESS_KEY",
+                    fmt.Sprintf("Secret access key for %s", s3.AccessKeyID))
+                if t.uploaderErr != nil {
+                    return
+                }
+            }
+            t.uploaderErr = add(config.LifecycleS3, func(class string) (storage.Uploader, error) {
+                return storage.NewS3Storage(storage.S3Config{
+                    Endpoint:     s3.Endpoint,
+                    Bucket:       s3.Bucket,
+                    Region:       s3.Region,
+                    AccessKey:    s3.AccessKeyID,
+                    SecretKey:    s3.SecretAccessKey,
+                    PathStyle:    s3.PathStyle,
+                    Prefix:       s3.Prefix,
+                    PartSize:     int64(s3.PartSizeMB) << 20,
+                    StorageClass: class,
+                    LockMode:     t.cfg.Immutability.Mode,
+                    LockDays:     t.cfg.Immutability.Days,
+                    Retry:        t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if gcs := t.cfg.GCS; gcs.Bucket != "" {
+            t.uploaderErr = add(config.LifecycleGCS, func(class string) (storage.Uploader, error) {
+                return storage.NewGCSStorage(storage.GCSConfig{
+                    Bucket:          gcs.Bucket,
+                    Prefix:          gcs.Prefix,
+                    CredentialsFile: gcs.CredentialsFile,
+                    ChunkSize:       int64(gcs.ChunkSizeMB) << 20,
+                    Endpoint:        gcs.Endpoint,
+                    StorageClass:    class,
+                    Retry:           t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if azure := t.cfg.Azure; azure.Account != "" {
+            // A service principal's secret may be kept in the keyring
+            if azure.TenantID != "" && azure.ClientSecret == "" {
+                azure.ClientSecret, t.uploaderErr = secrets.Lookup("AZURE_CLIENT_SECRET",
+                    fmt.Sprintf("Client secret of %s", azure.ClientID))
+                if t.uploaderErr != nil {
+                    return
+                }
+            }
+            t.uploaderErr = add(config.LifecycleAzure, func(class string) (storage.Uploader, error) {
+                return storage.NewAzureStorage(storage.AzureConfig{
+                    Account:      azure.Account,
+                    Container:    azure.Container,
+                    Prefix:       azure.Prefix,
+                    TenantID:     azure.TenantID,
+                    ClientID:     azure.ClientID,
+                    ClientSecret: azure.ClientSecret,
+                    BlockSize:    int64(azure.BlockSizeMB) << 20,
+                    Endpoint:     azure.Endpoint,
+                    AccessTier:   class,
+                    Retry:        t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if ftp := t.cfg.FTP; ftp.Host != "" {
+            if ftp.Password == "" {
+                ftp.Password, t.uploaderErr = secrets.Lookup("FTP_PASSWORD",
+                    fmt.Sprintf("FTP password for %s@%s", ftp.Username, ftp.Host))
+                if t.uploaderErr != nil {
+                    return
+                }
+            }
+            t.uploaderErr = add(config.LifecycleFTP, func(class string) (storage.Uploader, error) {
+                return storage.NewFTPStorage(storage.FTPConfig{
+                    Host:        ftp.Host,
+                    Port:        ftp.Port,
+                    Username:    ftp.Username,
+                    Password:    ftp.Password,
+                    TLS:         ftp.TLS != config.FTPNone,
+                    ImplicitTLS: ftp.TLS == config.FTPImplicitTLS,
+                    Dir:         ftp.Dir,
+                    Retry:       t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if webdav := t.cfg.WebDAV; webdav.URL != "" {
+            if webdav.Username != "" && webdav.Password == "" {
+                webdav.Password, t.uploaderErr = secrets.Lookup("WEBDAV_PASSWORD",
+                    fmt.Sprintf("WebDAV password for %s", webdav.Username))
+                if t.uploaderErr != nil {
+                    return
+                }
+            }
+            t.uploaderErr = add(config.LifecycleWebDAV, func(class string) (storage.Uploader, error) {
+                return storage.NewWebDAVStorage(storage.WebDAVConfig{
+                    URL:      webdav.URL,
+                    Username: webdav.Username,
+                    Password: webdav.Password,
+                    Retry:    t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if b2 := t.cfg.B2; b2.Bucket != "" {
+            if b2.ApplicationKey == "" {
+                b2.ApplicationKey, t.uploaderErr = secrets.Lookup("B2_APPLICATION_KEY",
+                    fmt.Sprintf("Application key for %s", b2.KeyID))
+                if t.uploaderErr != nil {
+                    return
+                }
+            }
+            t.uploaderErr = add(config.LifecycleB2, func(class string) (storage.Uploader, error) {
+                return storage.NewB2Storage(storage.B2Config{
+                    Bucket:         b2.Bucket,
+                    Prefix:         b2.Prefix,
+                    KeyID:          b2.KeyID,
+                    ApplicationKey: b2.ApplicationKey,
+                    PartSize:       int64(b2.PartSizeMB) << 20,
+                    LockMode:       t.cfg.Immutability.Mode,
+                    LockDays:       t.cfg.Immutability.Days,
+                    Retry:          t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if rclone := t.cfg.Rclone; rclone.Remote != "" {
+            t.uploaderErr = add(config.LifecycleRclone, func(class string) (storage.Uploader, error) {
+                return storage.NewRcloneStorage(storage.RcloneConfig{
+                    Remote:     rclone.Remote,
+                    Binary:     rclone.Binary,
+                    ConfigFile: rclone.ConfigFile,
+                    Flags:      rclone.Flags,
+                    Retry:      t.cfg.Retry.Policy(),
+                })
+            })
+            if t.uploaderErr != nil {
+                return
+            }
+        }
+        if len(uploaders) > 0 {
+            t.uploader = storage.Multi(uploaders...)
+        }
+    })
+    return t.uploader, t.uploaderErr
+}
+
+// coldStorage returns the storage the lifecycle rules move old archives
+// to, or nil if they are disabled
+func (t *Tool) coldStorage() (storage.Uploader, error) {
+    if _, err := t.offsiteUploader(); err != nil {
+        return nil, err
+    }
+    return t.coldUploader, nil
+}
+
+// MoveColdArchives moves the archives of every backup directory that are
+// older than the lifecycle's number of days to the cold storage and prints
+// what was moved. Archives that failed to move are retried by the next run.
+func (t *Tool) MoveColdArchives(ctx context.Context) error {
+    if !t.cfg.Lifecycle.Enabled() {
+        return nil
+    }
+    var failed int
+    for _, source := range t.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        manager, err := t.OpenManager(source.BaseDir)
+        if err != nil {
+            return err
+        }
+        result, err := manager.MoveColdArchives(ctx)
+        if err != nil {
+            return fmt.Errorf("error moving archives of %s to cold storage: %v", source.BaseDir, err)
+        }
+        if result.Moved > 0 {
+            slog.Info("Moved archives to cold storage", "source", source.Name, "archives", result.Moved, "size", result.Size)
+        }
+        failed += len(result.Failed)
+    }
+    if failed > 0 {
+        return fmt.Errorf("%d archives could not be moved to cold storage", failed)
+    }
+    return nil
+}
+
+// PruneReport is what pruning a backup directory removed, or would remove
+type PruneReport struct {
+    Source  string `json:"source"`
+    BaseDir string `json:"base_dir"`
+    // Expired archives and leftovers, see backup.PruneResult
+    Archives  []string        `json:"archives"`
+    Locked    []string        `json:"locked"`
+    Orphans   []string        `json:"orphans"`
+    Reclaimed backup.ByteSize `json:"reclaimed_bytes"`
+    // Chunks of deduplicated archives no archive refers to anymore
+    dedup.PruneResult
+}
+
+// Prune applies the retention policies to every backup directory, removes
+// the leftovers of interrupted backups and the chunks no archive refers to
+// anymore, and the stale temporary directories of the local source. With
+// dryRun nothing is removed and the reports show what would be. The caller
+// holds the locks of all sites.
+func (t *Tool) Prune(dryRun bool) ([]PruneReport, error) {
+    reports := []PruneReport{}
+    for i, source := range t.ReportSources() {
+        report := PruneReport{Source: source.Name, BaseDir: source.BaseDir, Archives: []string{}, Locked: []string{}, Orphans: []string{}}
+        if _, err := os.Stat(source.BaseDir); err == nil {
+            manager, err := t.OpenManager(source.BaseDir)
+            if err != nil {
+                return nil, err
+            }
+            result, err := manager.Prune(dryRun)
+            if err != nil {
+                return nil, fmt.Errorf("failed to prune %s: %v", source.BaseDir, err)
+            }
+            report.Archives, report.Locked, report.Orphans, report.Reclaimed = result.Archives, result.Locked, result.Orphans, result.Reclaimed
+        }
+
+        // Archives a dry run found expired must not keep their chunks
+        expired := make(map[string]bool)
+        for _, archive := range report.Archives {
+            expired[archive] = true
+        }
+        skip := func(path string) bool {
+            return backup.IsSnapshot(path) || expired[path]
+        }
+        chunks, err := dedup.Prune(source.BaseDir, skip, dryRun)
+        if err != nil {
+            return nil, fmt.Errorf("failed to prune %s: %v", source.BaseDir, err)
+        }
+        report.PruneResult = chunks
+        report.Reclaimed += backup.ByteSize(chunks.RemovedBytes)
+
+        // Temporary directories are local, whichever source they were for
+        if i == 0 {
+            stale, err := backup.StaleTempDirs()
+            if err != nil {
+                return nil, err
+            }
+            for _, dir := range stale {
+                size, _ := backup.DirSize(dir, &config.FileFilter{})
+                if !dryRun {
+                    if err := os.RemoveAll(dir); err != nil {
+                        return nil, fmt.Errorf("failed to remove stale temp directory %s: %v", dir, err)
+                    }
+                }
+                report.Orphans = append(report.Orphans, dir)
+                report.Reclaimed += size
+            }
+        }
+        reports = append(reports, report)
+    }
+    return reports, nil
+}
+
+// FetchColdArchives fetches the archives a restore of a site's archive of a
+// type from a backup directory needs back from cold storage, see
+// backup.BackupManager.FetchColdArchives
+func (t *Tool) FetchColdArchives(baseDir, site, archiveType, timestamp string) error {
+    manager, err := t.OpenManager(baseDir)
+    if err != nil {
+        return err
+    }
+    fetched, err := manager.FetchColdArchives(site, archiveType, timestamp)
+    if len(fetched) > 0 {
+        slog.Info("Fetched archives from cold storage", "site", site, "type", archiveType, "archives", len(fetched))
+    }
+    return err
+}
+
+// reconcileStorage compares the catalog of a backup directory with the
+// archives on disk and prints the discrepancies found
+func (t *Tool) reconcileStorage(manager *backup.BackupManager, repair bool) error {
+    result, err := manager.Reconcile(repair)
+    if err != nil {
+        return fmt.Errorf("error reconciling %s: %v", manager.BaseDir, err)
+    }
+    fmt.Fprintf(t.out(), "\nStorage Reconciliation (%s):\n", manager.BaseDir)
+    fmt.Fprintln(t.out(), "-------------------")
+    fmt.Fprint(t.out(), result.Summary())
+    return nil
+}
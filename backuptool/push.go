@@ -0,0 +1,86 @@
+package backuptool
+
+import (
+    "fmt"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/secrets"
+)
+
+// pushTarget returns the storage remote servers push their archives to, or
+// nil if they don't. server names one of several remote servers, whose
+// archives are kept apart below its name. A missing secret is looked up in
+// the keyring or prompted for.
+func (t *Tool) pushTarget(server string) (*backup.PushTarget, error) {
+    push := t.cfg.Remote.Push
+    if !push.Enabled {
+        return nil, nil
+    }
+    target := &backup.PushTarget{Rclone: push.Rclone, Options: map[string]string{}}
+    switch push.Target {
+    case config.PushS3:
+        s3 := t.cfg.S3
+        target.Options["type"] = "s3"
+        target.Options["provider"] = "AWS"
+        if s3.Endpoint != "" {
+            target.Options["provider"] = "Other"
+            target.Options["endpoint"] = s3.Endpoint
+        }
+        target.Options["region"] = s3.Region
+        target.Options["force_path_style"] = strconv.FormatBool(s3.PathStyle)
+        if s3.AccessKeyID == "" {
+            // The server's own credentials, e.g. of its instance profile
+            target.Options["env_auth"] = "true"
+        } else {
+            if s3.SecretAccessKey == "" {
+                secret, err := secrets.Lookup("S3_SECRET_ACCESS_KEY", fmt.Sprintf("Secret access key for %s", s3.AccessKeyID))
+                if err != nil {
+                    return nil, err
+                }
+                s3.SecretAccessKey = secret
+            }
+            target.Options["access_key_id"] = s3.AccessKeyID
+            target.Options["secret_access_key"] = s3.SecretAccessKey
+        }
+        target.Root = path.Join(s3.Bucket, strings.Trim(s3.Prefix, "/"))
+        target.Location = "s3://" + target.Root
+    case config.PushSFTP:
+        sftp := push.SFTP
+        target.Options["type"] = "sftp"
+        target.Options["host"] = sftp.Host
+        target.Options["user"] = sftp.User
+        host := sftp.Host
+        if sftp.Port != "" {
+            target.Options["port"] = sftp.Port
+            host += ":" + sftp.Port
+        }
+        if sftp.KeyFile != "" {
+            key, err := os.ReadFile(sftp.KeyFile)
+            if err != nil {
+                return nil, fmt.Errorf("failed to read push sftp key file: %v", err)
+            }
+            target.Files = map[string][]byte{"key_file": key}
+        } else {
+            if sftp.Password == "" {
+                password, err := secrets.Lookup("PUSH_SFTP_PASSWORD", fmt.Sprintf("SFTP password for %s@%s", sftp.User, sftp.Host))
+                if err != nil {
+                    return nil, err
+                }
+                sftp.Password = password
+            }
+            target.Options["pass"] = sftp.Password
+            target.Obscured = map[string]bool{"pass": true}
+        }
+        target.Root = strings.Trim(sftp.Dir, "/")
+        target.Location = fmt.Sprintf("sftp://%s@%s/%s", sftp.User, host, target.Root)
+    }
+    if server != "" {
+        target.Root = path.Join(target.Root, server)
+        target.Location = strings.TrimSuffix(target.Location, "/") + "/" + server
+    }
+    return target, nil
+}
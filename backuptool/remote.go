@@ -0,0 +1,348 @@
+package backuptool
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "path/filepath"
+    "strings"
+    "sync"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/retry"
+    "laravel-backup-tool/secrets"
+)
+
+// sshConfigFor builds the connection settings of a configured SSH target.
+// prefix names its environment variables (SSH or STANDBY); a missing
+// password is looked up in the keyring under <prefix>_PASSWORD or prompted for.
+// A sudo password is looked up under <prefix>_BECOME_PASSWORD, but not
+// prompted for, as sudo may not need one.
+func (t *Tool) sshConfigFor(target config.SSHTarget, prefix string) (*backup.SSHConfig, error) {
+    return newSSHConfig(target, prefix, t.cfg.Retry.Policy())
+}
+
+// newSSHConfig is sshConfigFor with the retry policy of connecting
+func newSSHConfig(target config.SSHTarget, prefix string, policy retry.Policy) (*backup.SSHConfig, error) {
+    sshConfig := &backup.SSHConfig{
+        Host:            target.Host,
+        User:            target.User,
+        Port:            target.Port,
+        KeyPath:         target.KeyPath,
+        Password:        target.Password,
+        KnownHostsFile:  target.KnownHosts,
+        InsecureHostKey: !target.StrictHostKey,
+        Become:          target.Become,
+        Retry:           policy,
+    }
+    if sshConfig.Port == "" {
+        sshConfig.Port = "22"
+    }
+
+    // Fall back to the keyring or an interactive prompt instead of
+    // requiring the password in plain text
+    if sshConfig.KeyPath == "" && sshConfig.Password == "" && sshConfig.Host != "" {
+        password, err := secrets.Lookup(prefix+"_PASSWORD",
+            fmt.Sprintf("SSH password for %s@%s", sshConfig.User, sshConfig.Host))
+        if err != nil {
+            return nil, err
+        }
+        sshConfig.Password = password
+    }
+    if sshConfig.Become.Method == config.BecomeSudo && sshConfig.Become.Password == "" {
+        sshConfig.Become.Password = secrets.Get(prefix + "_BECOME_PASSWORD")
+    }
+
+    // Validate SSH configuration
+    if sshConfig.Host == "" || sshConfig.User == "" || 
+       (sshConfig.KeyPath == "" && sshConfig.Password == "") {
+        return nil, fmt.Errorf("incomplete SSH configuration (%s_HOST, %s_USER and a key or password are required)", prefix, prefix)
+    }
+    return sshConfig, nil
+}
+
+// remoteTarget is a remote server backed up in a run with its settings
+type remoteTarget struct {
+    // Name of one of several servers, empty for the single server of remote.ssh
+    name string
+    ssh  config.SSHTarget
+    // Prefix of the environment variables and keyring entries of its secrets
+    prefix       string
+    baseDir      string
+    storage      config.Storage
+    excludes     []string
+    workers      int
+    sites        []string
+    excludeSites []string
+}
+
+// remoteTargets returns the configured remote servers: the servers list, or
+// the single server of remote.ssh
+func (t *Tool) remoteTargets() []remoteTarget {
+    if len(t.cfg.Remote.Servers) == 0 {
+        return []remoteTarget{{
+            ssh:      t.cfg.Remote.SSH,
+            prefix:   "SSH",
+            baseDir:  t.cfg.Remote.BackupDir,
+            storage:  t.cfg.Remote.Storage,
+            excludes: t.cfg.Excludes,
+            workers:  t.cfg.Remote.Workers,
+        }}
+    }
+
+    var targets []remoteTarget
+    for _, server := range t.cfg.Remote.Servers {
+        target := remoteTarget{
+            name:         server.Name,
+            ssh:          server.SSH,
+            prefix:       "SSH_" + envName(server.Name),
+            baseDir:      filepath.Join(t.cfg.Remote.BackupDir, server.Name),
+            storage:      t.cfg.Remote.Storage,
+            excludes:     t.cfg.Excludes,
+            workers:      server.Workers,
+            sites:        server.Sites,
+            excludeSites: server.ExcludeSites,
+        }
+        target.storage.BackupDir = target.baseDir
+        if server.MaxFileBackups > 0 {
+            target.storage.MaxFileBackups = server.MaxFileBackups
+        }
+        if server.MaxDBBackups > 0 {
+            target.storage.MaxDBBackups = server.MaxDBBackups
+        }
+        if len(server.Excludes) > 0 {
+            target.excludes = server.Excludes
+        }
+        targets = append(targets, target)
+    }
+    return targets
+}
+
+// selectSites returns the names matching one of the include patterns, or all
+// names without include patterns, leaving out those matching an exclude
+// pattern
+func selectSites(names, include, exclude []string) []string {
+    matches := func(name string, patterns []string) bool {
+        for _, pattern := range patterns {
+            if ok, _ := filepath.Match(pattern, name); ok {
+                return true
+            }
+        }
+        return false
+    }
+
+    var selected []string
+    for _, name := range names {
+        if len(include) > 0 && !matches(name, include) || matches(name, exclude) {
+            continue
+        }
+        selected = append(selected, name)
+    }
+    return selected
+}
+
+// envName turns a server name into a part of an environment variable name
+func envName(name string) string {
+    return strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z':
+            return r - 'a' + 'A'
+        case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+            return r
+        default:
+            return '_'
+        }
+    }, name)
+}
+
+// RemoteBackupDir returns the directory of the backups pulled from a remote
+// server. server names one of several configured servers and must be empty
+// for the single server of remote.ssh.
+func (t *Tool) RemoteBackupDir(server string) (string, error) {
+    if len(t.cfg.Remote.Servers) == 0 {
+        if server != "" {
+            return "", fmt.Errorf("remote server %q is not configured, there is a single remote server", server)
+        }
+        return t.cfg.Remote.BackupDir, nil
+    }
+    if server == "" {
+        return "", fmt.Errorf("several remote servers are configured, name one of: %s", strings.Join(t.cfg.RemoteServerNames(), ", "))
+    }
+    if _, ok := t.cfg.RemoteServer(server); !ok {
+        return "", fmt.Errorf("unknown remote server %q, configured are: %s", server, strings.Join(t.cfg.RemoteServerNames(), ", "))
+    }
+    return filepath.Join(t.cfg.Remote.BackupDir, server), nil
+}
+
+// performRemoteBackups backs up the remote servers, or the sites and
+// component scope selects. Several servers are backed up at the same time,
+// at most remote.parallel_servers, each over its own connection. Servers
+// without selected sites are not connected to.
+func (t *Tool) performRemoteBackups(ctx context.Context, scope Scope) error {
+    targets, sshConfigs, err := t.remoteSSHConfigs(scope)
+    if err != nil {
+        return err
+    }
+    if len(targets) == 1 && targets[0].name == "" {
+        return t.backupRemoteServer(ctx, sshConfigs[0])
+    }
+
+    parallel := make(chan struct{}, t.cfg.Remote.ParallelServers)
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var failed []string
+    for i, target := range targets {
+        if t.stopping() || ctx.Err() != nil {
+            break
+        }
+        parallel <- struct{}{}
+        wg.Add(1)
+        go func(name string, sshConfig *backup.SSHConfig) {
+            defer wg.Done()
+            defer func() { <-parallel }()
+            slog.Info("Starting backups of remote server", "server", name)
+            if err := t.backupRemoteServer(ctx, sshConfig); err != nil {
+                slog.Error("Backups of remote server failed", "server", name, "error", err)
+                mu.Lock()
+                failed = append(failed, name)
+                mu.Unlock()
+            }
+        }(target.name, sshConfigs[i])
+    }
+    wg.Wait()
+
+    if len(failed) > 0 {
+        return fmt.Errorf("%d of %d remote servers failed: %s", len(failed), len(targets), strings.Join(failed, ", "))
+    }
+    return nil
+}
+
+// remoteSSHConfigs returns the remote servers with sites in scope and the
+// settings of the connections to them for a run of scope
+func (t *Tool) remoteSSHConfigs(scope Scope) ([]remoteTarget, []*backup.SSHConfig, error) {
+    var targets []remoteTarget
+    for _, target := range t.remoteTargets() {
+        if len(scope.Sites) > 0 {
+            if target.sites = selectSites(scope.Sites, target.sites, target.excludeSites); len(target.sites) == 0 {
+                continue
+            }
+        }
+        targets = append(targets, target)
+    }
+    if len(targets) == 0 {
+        return nil, nil, fmt.Errorf("sites %s are not backed up from any remote server", strings.Join(scope.Sites, ", "))
+    }
+
+    // Secrets may be prompted for, so connection settings are resolved first
+    sshConfigs := make([]*backup.SSHConfig, len(targets))
+    for i, target := range targets {
+        sshConfig, err := t.sshConfigFor(target.ssh, target.prefix)
+        if err != nil {
+            if target.name == "" {
+                return nil, nil, err
+            }
+            return nil, nil, fmt.Errorf("remote server %s: %v", target.name, err)
+        }
+        sshConfig.BackupDir = target.baseDir
+        sshConfig.Stop = t.Stop
+        sshConfig.Workers = target.workers
+        sshConfig.Streaming = t.cfg.Remote.Streaming
+        sshConfig.Pipeline = t.cfg.Remote.Pipeline
+        sshConfig.BatchDiscovery = t.cfg.Remote.BatchDiscovery
+        sshConfig.Transport = t.cfg.Remote.Transport
+        sshConfig.Sites = target.sites
+        sshConfig.ExcludeSites = target.excludeSites
+        sshConfig.Only = scope.Only
+        sshConfig.Force = scope.Force
+        sshConfig.AllowLarge = scope.AllowLarge
+        sshConfig.Priority = t.cfg.Priority
+        sshConfig.MaxLoad = t.cfg.Remote.Guardrails.MaxLoad
+        sshConfig.LoadWait = t.cfg.Remote.Guardrails.LoadWait
+        sshConfig.StreamWhenLow = t.cfg.Remote.Guardrails.StreamWhenLow
+        if t.cfg.Remote.Guardrails.MinFree != "" {
+            if sshConfig.MinFree, err = backup.ParseByteSize(t.cfg.Remote.Guardrails.MinFree); err != nil {
+                return nil, nil, fmt.Errorf("remote guardrails min_free: %v", err)
+            }
+        }
+        if sshConfig.Push, err = t.pushTarget(target.name); err != nil {
+            return nil, nil, err
+        }
+        sshConfigs[i] = sshConfig
+    }
+    return targets, sshConfigs, nil
+}
+
+// backupRemoteServer backs up the sites of one remote server
+func (t *Tool) backupRemoteServer(ctx context.Context, sshConfig *backup.SSHConfig) error {
+    sshBackup, err := backup.NewSSHBackup(sshConfig)
+    if err != nil {
+        return fmt.Errorf("failed to initialize SSH backup: %v", err)
+    }
+    defer sshBackup.Close()
+    if err := t.configureManager(sshBackup.Manager()); err != nil {
+        return err
+    }
+
+    // Perform remote backups
+    if err := sshBackup.BackupRemoteSites(ctx); err != nil {
+        return fmt.Errorf("failed to perform remote backups: %v", err)
+    }
+
+    return t.reconcileStorage(sshBackup.Manager(), true)
+}
+
+// SyncStandby connects to the configured standby server and applies the latest backups of the given source to it
+func (t *Tool) SyncStandby(ctx context.Context, source string) error {
+    remoteDir, err := t.RemoteBackupDir(t.cfg.Standby.Server)
+    if err != nil {
+        if source != "local" {
+            return fmt.Errorf("standby: %v", err)
+        }
+        remoteDir = t.cfg.Remote.BackupDir
+    }
+    var baseDir string
+    switch source {
+    case "", "remote":
+        baseDir = remoteDir
+    case "local":
+        baseDir = t.cfg.Local.BackupDir
+    default:
+        return fmt.Errorf("unknown standby source %q, use remote or local", source)
+    }
+
+    sshConfig, err := t.sshConfigFor(t.cfg.Standby.SSH, "STANDBY")
+    if err != nil {
+        return err
+    }
+    sshConfig.BackupDir = remoteDir
+    manager, err := t.OpenManager(baseDir)
+    if err != nil {
+        return fmt.Errorf("error initializing backup manager: %v", err)
+    }
+
+    standby, err := backup.NewSSHBackup(sshConfig)
+    if err != nil {
+        return fmt.Errorf("failed to connect to standby: %v", err)
+    }
+    defer standby.Close()
+
+    results, err := standby.SyncStandby(ctx, manager)
+    if err != nil {
+        return err
+    }
+
+    failed := 0
+    for _, r := range results {
+        attrs := []any{"site", r.Site, "files", r.Files, "database", r.Database, "source", baseDir, "standby", sshConfig.Host}
+        if r.Err != nil {
+            slog.Error("Standby sync failed", append(attrs, "error", r.Err)...)
+            failed++
+            continue
+        }
+        slog.Info("Synced standby", attrs...)
+    }
+    if failed > 0 {
+        return fmt.Errorf("%d of %d sites failed to sync to the standby", failed, len(results))
+    }
+    return nil
+}
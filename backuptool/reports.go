@@ -0,0 +1,297 @@
+package backuptool
+
+import (
+    "encoding/json"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/report"
+    "laravel-backup-tool/secrets"
+)
+
+// ReportSources returns the backup directories covered by reports. With
+// several remote servers every server is a source of its own.
+func (t *Tool) ReportSources() []report.Source {
+    sources := []report.Source{{Name: "local", BaseDir: t.cfg.Local.BackupDir}}
+    for _, target := range t.remoteTargets() {
+        name := "remote"
+        if target.name != "" {
+            name += "/" + target.name
+        }
+        sources = append(sources, report.Source{Name: name, BaseDir: target.baseDir})
+    }
+    return sources
+}
+
+// TouchCheckSources returns the report sources, each looking up the
+// off-server copies of its archives if off-server storage is configured
+func (t *Tool) TouchCheckSources() ([]report.Source, error) {
+    sources := t.ReportSources()
+    uploader, err := t.offsiteUploader()
+    if err != nil {
+        return nil, err
+    }
+    if uploader == nil {
+        return sources, nil
+    }
+    for i, source := range sources {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        manager, err := t.OpenManager(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+        sources[i].Offsite = manager
+    }
+    return sources, nil
+}
+
+// EvaluateCompliance loads the configured policies and evaluates all sites
+func (t *Tool) EvaluateCompliance() ([]report.SiteCompliance, error) {
+    policies, err := report.LoadPolicies(os.Getenv("POLICY_FILE"))
+    if err != nil {
+        return nil, err
+    }
+    return report.EvaluateCompliance(t.ReportSources(), policies, time.Now())
+}
+
+// WriteMetricsTextfile rewrites the configured metrics textfile after a run.
+// The file is replaced atomically, so the collector never reads a partial file.
+func (t *Tool) WriteMetricsTextfile() {
+    path := t.cfg.Metrics.Textfile
+    if path == "" {
+        return
+    }
+    tmp := path + ".tmp"
+    f, err := os.Create(tmp)
+    if err == nil {
+        err = report.WriteMetrics(f, t.ReportSources())
+        if cerr := f.Close(); err == nil {
+            err = cerr
+        }
+    }
+    if err == nil {
+        err = os.Rename(tmp, path)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        slog.Warn("Failed to write metrics", "path", path, "error", err)
+    }
+}
+
+// runReport builds the report of a run started at started, comparing it
+// with the previous report in the reports directory and the sizes of the
+// run's archives with their history
+func (t *Tool) runReport(started time.Time, failures []string) (*Report, error) {
+    previous, err := report.LatestRunReport(t.reportsDir())
+    if err != nil {
+        slog.Warn("Failed to read the previous run report", "error", err)
+    }
+
+    var sources []report.RunSource
+    for _, source := range t.ReportSources() {
+        // The manager applies the source's rotation settings; it is only
+        // opened for sources that exist
+        var manager *backup.BackupManager
+        baseDir := source.BaseDir
+        sources = append(sources, report.RunSource{Source: source, Expiring: func(site string) ([]string, error) {
+            if manager == nil {
+                var err error
+                if manager, err = t.OpenManager(baseDir); err != nil {
+                    return nil, err
+                }
+            }
+            return manager.ExpiringArchives(site)
+        }})
+    }
+    r, err := report.BuildRunReport(started, failures, sources, previous)
+    if err != nil {
+        return nil, err
+    }
+    r.Anomalies = t.sizeAnomalies(started)
+    return r, nil
+}
+
+// sizeAnomalies finds the archives of the run started at started whose
+// size differs sharply from the usual, and logs them
+func (t *Tool) sizeAnomalies(started time.Time) []report.SizeAnomaly {
+    var anomalies []report.SizeAnomaly
+    for _, source := range t.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); err != nil {
+            continue
+        }
+        found, err := report.DetectSizeAnomalies(source, started, t.cfg.SizeAnomalies)
+        if err != nil {
+            slog.Warn("Failed to check archive sizes", "source", source.Name, "error", err)
+            continue
+        }
+        anomalies = append(anomalies, found...)
+    }
+    for _, a := range anomalies {
+        slog.Warn("Archive size "+a.Kind+" sharply", "site", a.Site, "source", a.Source, "type", a.Type,
+            "size", backup.ByteSize(a.Size), "usual", backup.ByteSize(a.Usual), "path", a.Archive)
+    }
+    return anomalies
+}
+
+// notifySizeAnomalies emails the size anomalies of a run as a warning if
+// SMTP is configured. Failures are logged.
+func (t *Tool) notifySizeAnomalies(r *Report) {
+    if r == nil || len(r.Anomalies) == 0 || t.cfg.Report.SMTP.Host == "" {
+        return
+    }
+    smtpConfig, err := t.smtpConfig()
+    if err != nil {
+        slog.Error("Failed to send the size anomalies", "error", err)
+        return
+    }
+    if err := report.SendSizeAnomalies(smtpConfig, r.Host, r.Anomalies, time.Now()); err != nil {
+        slog.Error("Failed to send the size anomalies", "error", err)
+        return
+    }
+    slog.Info("Sent size anomalies", "anomalies", len(r.Anomalies), "to", strings.Join(smtpConfig.To, ", "))
+}
+
+// reportsDir returns the directory the run reports are saved in
+func (t *Tool) reportsDir() string {
+    if t.cfg.Report.Dir != "" {
+        return t.cfg.Report.Dir
+    }
+    return filepath.Join(t.cfg.Local.BackupDir, backup.ReportsDirName)
+}
+
+// sendRunReport writes the report of a run to the reports directory, emails
+// it if SMTP is configured and returns it. Failures are logged, they don't
+// fail the run.
+func (t *Tool) sendRunReport(started time.Time, failures []string) *Report {
+    r, err := t.runReport(started, failures)
+    if err != nil {
+        slog.Error("Failed to build the run report", "error", err)
+        return nil
+    }
+    path, err := report.SaveRunReport(t.reportsDir(), r)
+    if err != nil {
+        slog.Error("Failed to save the run report", "error", err)
+    } else {
+        slog.Info("Saved run report", "path", path, "status", r.Status)
+    }
+
+    if t.cfg.Report.SMTP.Host == "" {
+        return r
+    }
+    smtpConfig, err := t.smtpConfig()
+    if err != nil {
+        slog.Error("Failed to send the run report", "error", err)
+        return r
+    }
+    if err := report.SendRunReport(smtpConfig, r); err != nil {
+        slog.Error("Failed to send the run report", "error", err)
+        return r
+    }
+    slog.Info("Sent run report", "to", strings.Join(smtpConfig.To, ", "))
+    return r
+}
+
+// saveRunSummary writes the summary of a run to the reports directory, for
+// wrapper scripts and monitoring, and to the run's log directory, and
+// records the run in the history. Failures are logged, they don't fail the
+// run.
+func (t *Tool) saveRunSummary(runID string, started time.Time, runDir string, r *Report, err error) {
+    summary := report.Summarize(runID, r, err)
+    if summary.Started.IsZero() {
+        summary.Started = started
+    }
+    if historyErr := t.recordOutcome(runDir, summary); historyErr != nil {
+        slog.Error("Failed to record the run in the history", "error", historyErr)
+    }
+    path, saveErr := report.SaveRunSummary(t.reportsDir(), summary)
+    if saveErr != nil {
+        slog.Error("Failed to save the run summary", "error", saveErr)
+        return
+    }
+    slog.Info("Saved run summary", "path", path, "status", summary.Status, "failed_sites", summary.FailedSites, "sites", summary.TotalSites)
+}
+
+// smtpConfig returns the mail server settings with the password looked up
+// in the keyring if it isn't configured
+func (t *Tool) smtpConfig() (config.SMTPConfig, error) {
+    smtpConfig := t.cfg.Report.SMTP
+    if smtpConfig.Username != "" && smtpConfig.Password == "" {
+        var err error
+        if smtpConfig.Password, err = secrets.Lookup("SMTP_PASSWORD",
+            fmt.Sprintf("SMTP password for %s", smtpConfig.Username)); err != nil {
+            return smtpConfig, err
+        }
+    }
+    return smtpConfig, nil
+}
+
+// staleStateFile records the sites stale sites were last notified of, in
+// the local backup directory
+const staleStateFile = "stale.json"
+
+// EvaluateFreshness compares the last successful backup of every site
+// against its freshness SLA
+func (t *Tool) EvaluateFreshness() ([]report.SiteFreshness, error) {
+    return report.EvaluateFreshness(t.ReportSources(), t.cfg.Freshness.For, time.Now())
+}
+
+// NotifyStaleSites emails the stale sites if any of them became stale since
+// the last notice, so a scheduled check doesn't repeat the same alert. Sites
+// that are fresh again are forgotten and notified again when they go stale.
+// It reports whether a notice was sent.
+func (t *Tool) NotifyStaleSites(results []report.SiteFreshness) (bool, error) {
+    if t.cfg.Report.SMTP.Host == "" {
+        return false, fmt.Errorf("no smtp server configured to notify")
+    }
+    path := filepath.Join(t.cfg.Local.BackupDir, staleStateFile)
+    notified := make(map[string]time.Time)
+    if data, err := os.ReadFile(path); err == nil {
+        if err := json.Unmarshal(data, &notified); err != nil {
+            return false, fmt.Errorf("failed to read %s: %v", path, err)
+        }
+    } else if !os.IsNotExist(err) {
+        return false, fmt.Errorf("failed to read %s: %v", path, err)
+    }
+
+    var stale []report.SiteFreshness
+    current := make(map[string]time.Time)
+    isNew := false
+    for _, r := range results {
+        if r.Fresh() {
+            continue
+        }
+        stale = append(stale, r)
+        key := r.Source + ":" + r.Site
+        if at, ok := notified[key]; ok {
+            current[key] = at
+        } else {
+            current[key] = time.Now()
+            isNew = true
+        }
+    }
+    if isNew {
+        smtpConfig, err := t.smtpConfig()
+        if err != nil {
+            return false, err
+        }
+        if err := report.SendStaleSites(smtpConfig, stale, time.Now()); err != nil {
+            return false, err
+        }
+    }
+
+    data, err := json.MarshalIndent(current, "", "  ")
+    if err != nil {
+        return isNew, err
+    }
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        return isNew, fmt.Errorf("failed to write %s: %v", path, err)
+    }
+    return isNew, nil
+}
@@ -0,0 +1,281 @@
+package backuptool
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/filelock"
+    "laravel-backup-tool/report"
+)
+
+// artisanTimeout limits how long a restored application may take to boot
+const artisanTimeout = 2 * time.Minute
+
+// Outcomes of the checks of a restore test
+const (
+    CheckPassed  = "passed"
+    CheckFailed  = "failed"
+    CheckSkipped = "skipped"
+)
+
+// RestoreCheck is a sanity check of a restored backup
+type RestoreCheck struct {
+    Name   string `json:"name"`
+    Status string `json:"status"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// RestoreTestResult is the outcome of the restore test of a site
+type RestoreTestResult struct {
+    Site     string         `json:"site"`
+    Files    string         `json:"files,omitempty"`
+    Database string         `json:"database,omitempty"`
+    Checks   []RestoreCheck `json:"checks"`
+    Duration time.Duration  `json:"duration_ns"`
+}
+
+// Failed reports whether a check of the test failed
+func (r RestoreTestResult) Failed() bool {
+    return r.Error() != ""
+}
+
+// Error describes the failed checks, empty if none failed
+func (r RestoreTestResult) Error() string {
+    var failed []string
+    for _, check := range r.Checks {
+        if check.Status == CheckFailed {
+            failed = append(failed, check.Name+": "+check.Detail)
+        }
+    }
+    return strings.Join(failed, "; ")
+}
+
+// check records the outcome of a check
+func (r *RestoreTestResult) check(name, status, detail string) {
+    r.Checks = append(r.Checks, RestoreCheck{Name: name, Status: status, Detail: detail})
+}
+
+// TestRestores restores the latest backups of the sites in the local backup
+// directory, or of the named sites and their applications, into a scratch
+// directory and a throwaway database, checks them and removes them again.
+// The outcome of every site is recorded for compliance and attestation
+// reports.
+func (t *Tool) TestRestores(ctx context.Context, names []string) ([]RestoreTestResult, error) {
+    baseDir := t.cfg.Local.BackupDir
+    archives, err := backup.ListArchives(baseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list archives: %v", err)
+    }
+    seen := make(map[string]bool)
+    var sites []string
+    for _, a := range archives {
+        if (a.Type != "file" && a.Type != "database") || seen[a.Site] || !selectedSite(a.Site, names) {
+            continue
+        }
+        seen[a.Site] = true
+        sites = append(sites, a.Site)
+    }
+    if len(sites) == 0 {
+        return nil, fmt.Errorf("no backups to test in %s", baseDir)
+    }
+    sort.Strings(sites)
+
+    var results []RestoreTestResult
+    for _, site := range sites {
+        if err := ctx.Err(); err != nil {
+            return results, err
+        }
+        result, err := t.testRestore(ctx, baseDir, site)
+        if err != nil {
+            return results, err
+        }
+        test := report.RestoreTest{Site: site, Time: time.Now(), Duration: result.Duration, OK: !result.Failed(), Error: result.Error()}
+        if err := report.RecordRestoreTest(baseDir, test); err != nil {
+            slog.Warn("Failed to record restore test", "site", site, "error", err)
+        }
+        results = append(results, result)
+    }
+    return results, nil
+}
+
+// selectedSite reports whether a site or application is one of names or an
+// application of one of them; all are selected if there are no names
+func selectedSite(site string, names []string) bool {
+    if len(names) == 0 {
+        return true
+    }
+    parent, _ := backup.SplitAppKey(site)
+    for _, name := range names {
+        if site == name || parent == name {
+            return true
+        }
+    }
+    return false
+}
+
+// testRestore tests the latest backups of one site. Failed checks are part
+// of the result; an error is only returned if the test couldn't run.
+func (t *Tool) testRestore(ctx context.Context, baseDir, site string) (RestoreTestResult, error) {
+    started := time.Now()
+    result := RestoreTestResult{Site: site}
+
+    // Backups of the site wait, so rotation can't remove the archives
+    parent, _ := backup.SplitAppKey(site)
+    lock, err := backup.LockSites(ctx, baseDir, []string{parent}, filelock.Forever)
+    if err != nil {
+        return result, err
+    }
+    defer lock.Unlock()
+
+    scratch, err := backup.NewTempDir(site)
+    if err != nil {
+        return result, err
+    }
+    defer os.RemoveAll(scratch)
+    keys, err := t.Keyring()
+    if err != nil {
+        return result, err
+    }
+    slog.Info("Testing restore", "site", site, "scratch", scratch)
+
+    // Files are extracted into a directory of the scratch directory, which
+    // RestoreFiles creates
+    filesDir := filepath.Join(scratch, "files")
+    if archive, err := backup.FindArchive(baseDir, site, "file", "latest"); err != nil {
+        result.check("files", CheckSkipped, "no file backup")
+        filesDir = ""
+    } else if _, _, err := backup.RestoreFiles(archive.Path, filesDir, false, false, keys); err != nil {
+        result.Files = archive.Path
+        result.check("files", CheckFailed, err.Error())
+        filesDir = ""
+    } else {
+        result.Files = archive.Path
+        count, err := countFiles(filesDir)
+        switch {
+        case err != nil:
+            result.check("files", CheckFailed, err.Error())
+        case count == 0:
+            result.check("files", CheckFailed, "the archive holds no files")
+        default:
+            result.check("files", CheckPassed, fmt.Sprintf("%d files restored", count))
+        }
+    }
+
+    var db *backup.ScratchDatabase
+    if dump, err := backup.FindArchive(baseDir, site, "database", "latest"); err != nil {
+        result.check("database", CheckSkipped, "no database backup")
+    } else {
+        result.Database = dump.Path
+        var creds config.Credentials
+        if _, envFile := t.SiteLocation(site); envFile != "" {
+            if creds, _, err = config.FindCredentials(envFile); err != nil {
+                slog.Warn("Failed to read database credentials", "site", site, "error", err)
+            }
+        }
+        db, err = backup.RestoreScratchDatabase(dump.Path, site, scratch, creds, keys)
+        if err != nil {
+            result.check("database", CheckFailed, err.Error())
+        } else {
+            defer func() {
+                if err := db.Drop(); err != nil {
+                    slog.Warn("Failed to drop restore test database", "site", site, "db_name", db.Name, "error", err)
+                }
+            }()
+            tables, err := db.Tables()
+            switch {
+            case err != nil:
+                result.check("database", CheckFailed, err.Error())
+            case tables == 0:
+                result.check("database", CheckFailed, fmt.Sprintf("%s has no tables after the import", db.Name))
+            default:
+                result.check("database", CheckPassed, fmt.Sprintf("%d tables restored into %s", tables, db.Name))
+            }
+        }
+    }
+
+    if filesDir != "" {
+        status, detail := t.checkArtisan(ctx, filesDir, db)
+        result.check("artisan", status, detail)
+    }
+    result.Duration = time.Since(started)
+    return result, nil
+}
+
+// countFiles counts the regular files below a directory
+func countFiles(dir string) (int, error) {
+    count := 0
+    err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.Type().IsRegular() {
+            count++
+        }
+        return nil
+    })
+    return count, err
+}
+
+// checkArtisan boots the restored Laravel application with artisan. It
+// points the application at the scratch database and at drivers that keep
+// cache, sessions and queued jobs in memory, so nothing it does at boot
+// reaches the live services. It gets none of the tool's environment, which
+// holds credentials and passphrases. Without a scratch database the
+// application would use the live one from the restored .env, so it isn't
+// started. Applications whose archive lacks artisan or the Composer
+// dependencies, e.g. because vendor/ is excluded, are skipped as well.
+func (t *Tool) checkArtisan(ctx context.Context, dir string, db *backup.ScratchDatabase) (string, string) {
+    if db == nil {
+        return CheckSkipped, "no scratch database to boot the application against"
+    }
+    if _, err := os.Stat(filepath.Join(dir, "artisan")); err != nil {
+        return CheckSkipped, "no artisan in the file backup"
+    }
+    if _, err := os.Stat(filepath.Join(dir, "vendor", "autoload.php")); err != nil {
+        return CheckSkipped, "vendor/ is not in the file backup"
+    }
+    php, err := exec.LookPath(t.cfg.RestoreTests.PHP)
+    if err != nil {
+        return CheckSkipped, fmt.Sprintf("%s not found", t.cfg.RestoreTests.PHP)
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, artisanTimeout)
+    defer cancel()
+    cmd := exec.CommandContext(ctx, php, "artisan", "--version", "--no-interaction")
+    cmd.Dir = dir
+    // Laravel prefers the environment to the restored .env
+    cmd.Env = append([]string{
+        "PATH=" + os.Getenv("PATH"),
+        "HOME=" + filepath.Dir(dir),
+        "APP_ENV=testing",
+        "CACHE_DRIVER=array",
+        "CACHE_STORE=array",
+        "SESSION_DRIVER=array",
+        "QUEUE_CONNECTION=sync",
+        "BROADCAST_DRIVER=null",
+        "BROADCAST_CONNECTION=null",
+        "MAIL_MAILER=array",
+    }, db.Env()...)
+    var output bytes.Buffer
+    cmd.Stdout = &output
+    cmd.Stderr = &output
+    if err := cmd.Run(); err != nil {
+        return CheckFailed, fmt.Sprintf("failed to boot: %v, output: %s", err, lastOutputLine(output.String()))
+    }
+    return CheckPassed, strings.TrimSpace(output.String())
+}
+
+// lastOutputLine returns the last non-empty line of a command's output
+func lastOutputLine(output string) string {
+    lines := strings.Split(strings.TrimSpace(output), "\n")
+    return strings.TrimSpace(lines[len(lines)-1])
+}
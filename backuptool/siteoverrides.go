@@ -0,0 +1,92 @@
+package backuptool
+
+import (
+    "fmt"
+    "log/slog"
+    "strings"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/report"
+)
+
+// SiteOverrides reads the settings site owners put in the document roots of
+// the local sites, if enabled. A site whose file is invalid is logged and
+// keeps the administrator's settings.
+func (t *Tool) SiteOverrides() map[string]*config.SiteOverride {
+    overrides := make(map[string]*config.SiteOverride)
+    if !t.cfg.SiteOverrides.Enabled {
+        return overrides
+    }
+    webServer, configPath, err := t.DetectWebServer()
+    if err != nil {
+        slog.Warn("Failed to read site overrides", "error", err)
+        return overrides
+    }
+    vhosts, err := config.ParseVhosts(webServer, configPath)
+    if err != nil {
+        slog.Warn("Failed to read site overrides", "error", fmt.Errorf("error parsing %s config: %v", webServer, err))
+        return overrides
+    }
+    for _, vhost := range vhosts {
+        override, err := config.LoadSiteOverride(vhost.DocumentRoot, t.cfg.SiteOverrides.File)
+        if err != nil {
+            // Overrides are read several times per run; an invalid file is
+            // logged once until its error changes
+            if previous, ok := t.overrideErrors.Swap(vhost.ServerName, err.Error()); !ok || previous != err.Error() {
+                slog.Warn("Ignoring site override", "site", vhost.ServerName, "error", err)
+            }
+            continue
+        }
+        t.overrideErrors.Delete(vhost.ServerName)
+        if override != nil {
+            overrides[vhost.ServerName] = override
+        }
+    }
+    return overrides
+}
+
+// siteConfig returns the configuration with the settings of site owners
+// merged in
+func (t *Tool) siteConfig() *config.Config {
+    if !t.cfg.SiteOverrides.Enabled {
+        return t.cfg
+    }
+    return t.cfg.WithSiteOverrides(t.SiteOverrides())
+}
+
+// SiteSchedules returns the schedules of single local sites, those of site
+// owners included
+func (t *Tool) SiteSchedules() map[string]string {
+    return t.siteConfig().SiteSchedules
+}
+
+// notifySiteOwners emails the owners who asked for it the part of a run
+// report covering their site. Owners are only notified of sites backed up
+// in the run, and of failures unless they want every report.
+func (t *Tool) notifySiteOwners(r *Report) {
+    if r == nil || t.cfg.Report.SMTP.Host == "" || !t.cfg.SiteOverrides.Enabled {
+        return
+    }
+    for site, override := range t.siteConfig().SiteNotify {
+        part := r.ForSite("local", site)
+        ran := false
+        for _, s := range part.Sites {
+            if s.Status != report.StatusNotRun {
+                ran = true
+            }
+        }
+        if !ran || (!part.Failed() && override.NotifyOn != config.NotifyAlways) {
+            continue
+        }
+        smtpConfig, err := t.smtpConfig()
+        if err != nil {
+            slog.Error("Failed to send the site report", "site", site, "error", err)
+            return
+        }
+        smtpConfig.To = override.Notify
+        if err := report.SendRunReport(smtpConfig, part); err != nil {
+            slog.Error("Failed to send the site report", "site", site, "error", err)
+            continue
+        }
+        slog.Info("Sent site report", "site", site, "to", strings.Join(override.Notify, ", "))
+    }
+}
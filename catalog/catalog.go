@@ -0,0 +1,550 @@
+package catalog
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "sync"
+    "time"
+    "laravel-backup-tool/filelock"
+)
+
+// FileName is the name of the catalog file inside a backup base directory
+const FileName = "catalog.json"
+
+// Entry records a single backup archive
+type Entry struct {
+    Site       string    `json:"site"`
+    Type       string    `json:"type"`
+    Path       string    `json:"path"`
+    Time       time.Time `json:"time"`
+    Size       int64     `json:"size"`
+    Checksum   string    `json:"checksum"`
+    RecordedAt time.Time `json:"recorded_at"`
+    // Time it took to create the archive, including the copy from a remote server
+    Duration   time.Duration `json:"duration,omitempty"`
+    // Location of the off-server copy, empty if there is none
+    Location   string        `json:"location,omitempty"`
+    // Uploaded by the remote server itself, without a local copy
+    Pushed     bool          `json:"pushed,omitempty"`
+    // Moved to the lifecycle storage at Location, without a local copy
+    Cold       bool          `json:"cold,omitempty"`
+    // Storage class the archive was moved to, e.g. GLACIER
+    StorageClass string      `json:"storage_class,omitempty"`
+    // File in ListingsDirName with the cached file listing of the archive
+    Listing      string      `json:"listing,omitempty"`
+    // Number of parts the archive is split into, zero if it is one file
+    Parts        int         `json:"parts,omitempty"`
+}
+
+// Component status values recorded per run
+const (
+    StatusOK        = "ok"
+    StatusUnchanged = "unchanged"
+    StatusPartial   = "partial"
+    StatusFailed    = "failed"
+    StatusSkipped   = "skipped"
+)
+
+// Categories of the errors of failed components, naming the step of the
+// backup that failed
+const (
+    CategoryDiscovery = "discovery"
+    CategoryArchive   = "archive"
+    CategoryDump      = "dump"
+    CategoryTransfer  = "transfer"
+    CategoryRetention = "retention"
+    CategoryHook      = "hook"
+    // The remote server was too busy or short of disk space
+    CategoryCapacity  = "capacity"
+)
+
+// maxRunsPerComponent is how many run statuses are kept per site and component
+const maxRunsPerComponent = 30
+
+// maxOutcomes is how many run outcomes are kept
+const maxOutcomes = 100
+
+// maxSizesPerType is how many archive sizes are kept per site and archive type
+const maxSizesPerType = 30
+
+// SizeSample records the size of an archive when it was added. Samples
+// outlive their archives' rotation, so new archives are compared with a
+// longer history than the archives kept.
+type SizeSample struct {
+    Site string    `json:"site"`
+    Type string    `json:"type"`
+    Path string    `json:"path"`
+    Time time.Time `json:"time"`
+    Size int64     `json:"size"`
+}
+
+// RunStatus records the outcome of one component (file or database) of a
+// site in one run, so a failed dump doesn't make the file backup look failed
+type RunStatus struct {
+    RunID     string        `json:"run_id"`
+    Site      string        `json:"site"`
+    Component string        `json:"component"`
+    Status    string        `json:"status"`
+    Error     string        `json:"error,omitempty"`
+    // Step that failed, one of the Category constants, for failed and
+    // skipped components
+    Category  string        `json:"category,omitempty"`
+    JobID     string        `json:"job_id,omitempty"`
+    Time      time.Time     `json:"time"`
+    // Time spent backing up the component
+    Duration  time.Duration `json:"duration,omitempty"`
+}
+
+// Failed reports whether the component did not produce a backup
+func (r RunStatus) Failed() bool {
+    return r.Status == StatusFailed || r.Status == StatusSkipped
+}
+
+// RunOutcome records how a whole backup run ended and where its log is
+type RunOutcome struct {
+    RunID       string    `json:"run_id"`
+    Started     time.Time `json:"started"`
+    Finished    time.Time `json:"finished"`
+    Status      string    `json:"status"`
+    ExitCode    int       `json:"exit_code"`
+    Error       string    `json:"error,omitempty"`
+    FailedSites int       `json:"failed_sites"`
+    TotalSites  int       `json:"total_sites"`
+    // Directory of the run's log and summary, removed by their rotation
+    Dir string `json:"dir,omitempty"`
+}
+
+// RunTotal counts the runs of a site's component that ended with a status.
+// Unlike the run statuses, totals are never pruned.
+type RunTotal struct {
+    Site      string `json:"site"`
+    Component string `json:"component"`
+    Status    string `json:"status"`
+    Count     int64  `json:"count"`
+}
+
+// catalogFile is the on-disk representation of a catalog
+type catalogFile struct {
+    Entries []Entry     `json:"entries"`
+    Runs    []RunStatus `json:"runs,omitempty"`
+    Totals  []RunTotal  `json:"totals,omitempty"`
+    Sizes   []SizeSample `json:"sizes,omitempty"`
+    Outcomes []RunOutcome `json:"outcomes,omitempty"`
+}
+
+// Catalog is an index of all backups in a base directory. It is safe for
+// concurrent use; changes made by other processes are read before a change
+// is written, so runs of different sites don't overwrite each other's.
+type Catalog struct {
+    mu      sync.Mutex
+    path    string
+    entries []Entry
+    runs    []RunStatus
+    totals  []RunTotal
+    sizes   []SizeSample
+    outcomes []RunOutcome
+}
+
+// Open loads the catalog of a backup base directory, starting an empty one
+// if none exists yet
+func Open(baseDir string) (*Catalog, error) {
+    c := &Catalog{path: filepath.Join(baseDir, FileName)}
+    if err := c.loadLocked(); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// loadLocked reads the catalog file; the caller must hold c.mu
+func (c *Catalog) loadLocked() error {
+    data, err := os.ReadFile(c.path)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        return fmt.Errorf("failed to read catalog: %v", err)
+    }
+
+    var file catalogFile
+    if err := json.Unmarshal(data, &file); err != nil {
+        return fmt.Errorf("failed to parse catalog %s: %v", c.path, err)
+    }
+    c.entries = file.Entries
+    c.runs = file.Runs
+    c.totals = file.Totals
+    c.sizes = file.Sizes
+    c.outcomes = file.Outcomes
+    return nil
+}
+
+// beginLocked takes the lock of the catalog file for a change and reloads
+// the catalog, so the changes of other processes are kept. The caller must
+// hold c.mu and call the returned function once the change is saved.
+func (c *Catalog) beginLocked() (func(), error) {
+    lock, err := filelock.Acquire(context.Background(), c.path+".lock", true, filelock.Forever)
+    if err != nil {
+        return nil, fmt.Errorf("failed to lock catalog: %v", err)
+    }
+    if err := c.loadLocked(); err != nil {
+        lock.Unlock()
+        return nil, err
+    }
+    return func() { lock.Unlock() }, nil
+}
+
+// Add records an archive, replacing any entry with the same path. The size
+// of a new archive is added to the size history of its site and type.
+func (c *Catalog) Add(entry Entry) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    if entry.RecordedAt.IsZero() {
+        entry.RecordedAt = time.Now()
+    }
+    for i := range c.entries {
+        if c.entries[i].Path == entry.Path {
+            if entry.Listing == "" {
+                entry.Listing = c.entries[i].Listing
+            }
+            c.entries[i] = entry
+            return c.saveLocked()
+        }
+    }
+    c.entries = append(c.entries, entry)
+    c.addSizeLocked(SizeSample{Site: entry.Site, Type: entry.Type, Path: entry.Path, Time: entry.Time, Size: entry.Size})
+    return c.saveLocked()
+}
+
+// addSizeLocked adds a sample to the size history, keeping only the most
+// recent samples of every site and type; the caller must hold c.mu
+func (c *Catalog) addSizeLocked(sample SizeSample) {
+    c.sizes = append(c.sizes, sample)
+    sort.SliceStable(c.sizes, func(i, j int) bool {
+        return c.sizes[i].Time.Before(c.sizes[j].Time)
+    })
+    kept := make(map[string]int)
+    var pruned []SizeSample
+    for i := len(c.sizes) - 1; i >= 0; i-- {
+        key := c.sizes[i].Site + "/" + c.sizes[i].Type
+        if kept[key] < maxSizesPerType {
+            kept[key]++
+            pruned = append([]SizeSample{c.sizes[i]}, pruned...)
+        }
+    }
+    c.sizes = pruned
+}
+
+// Sizes returns a copy of the size history of all sites, oldest first
+func (c *Catalog) Sizes() []SizeSample {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    sizes := make([]SizeSample, len(c.sizes))
+    copy(sizes, c.sizes)
+    return sizes
+}
+
+// Remove deletes the entry of an archive and its cached listing; unknown
+// paths are ignored
+func (c *Catalog) Remove(path string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for i := range c.entries {
+        if c.entries[i].Path == path {
+            c.removeListing(c.entries[i])
+            c.entries = append(c.entries[:i], c.entries[i+1:]...)
+            return c.saveLocked()
+        }
+    }
+    return nil
+}
+
+// Entries returns a copy of all entries, oldest first
+func (c *Catalog) Entries() []Entry {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entries := make([]Entry, len(c.entries))
+    copy(entries, c.entries)
+    sort.Slice(entries, func(i, j int) bool {
+        return entries[i].Time.Before(entries[j].Time)
+    })
+    return entries
+}
+
+// SetLocation records where the off-server copy of an archive is stored;
+// unknown paths are ignored
+func (c *Catalog) SetLocation(path, location string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for i := range c.entries {
+        if c.entries[i].Path == path {
+            c.entries[i].Location = location
+            return c.saveLocked()
+        }
+    }
+    return nil
+}
+
+// SetCold records that an archive was moved to cold storage at location in
+// a storage class, or fetched back from it; unknown paths are ignored
+func (c *Catalog) SetCold(path string, cold bool, location, storageClass string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for i := range c.entries {
+        if c.entries[i].Path == path {
+            c.entries[i].Cold = cold
+            c.entries[i].Location = location
+            c.entries[i].StorageClass = storageClass
+            return c.saveLocked()
+        }
+    }
+    return nil
+}
+
+// SetChecksum records the new checksum and size of an archive that was
+// rewritten, such as by rekeying; unknown paths are ignored
+func (c *Catalog) SetChecksum(path, checksum string, size int64) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for i := range c.entries {
+        if c.entries[i].Path == path {
+            c.entries[i].Checksum = checksum
+            c.entries[i].Size = size
+            return c.saveLocked()
+        }
+    }
+    return nil
+}
+
+// SetParts records the number of parts an archive is split into
+func (c *Catalog) SetParts(path string, parts int) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for i := range c.entries {
+        if c.entries[i].Path == path {
+            c.entries[i].Parts = parts
+            return c.saveLocked()
+        }
+    }
+    return nil
+}
+
+// Latest returns the newest entry of a site's archives of a type
+func (c *Catalog) Latest(site, archiveType string) (Entry, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var latest Entry
+    found := false
+    for _, entry := range c.entries {
+        if entry.Site == site && entry.Type == archiveType && (!found || entry.Time.After(latest.Time)) {
+            latest, found = entry, true
+        }
+    }
+    return latest, found
+}
+
+// Find returns the entry of an archive
+func (c *Catalog) Find(path string) (Entry, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for _, entry := range c.entries {
+        if entry.Path == path {
+            return entry, true
+        }
+    }
+    return Entry{}, false
+}
+
+// RecordRuns stores component statuses, replacing earlier statuses of the
+// same run, site and component (e.g. after a retry). Only the most recent
+// runs of every site and component are kept. The totals count every status
+// that is new or differs from the one it replaces.
+func (c *Catalog) RecordRuns(statuses []RunStatus) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for _, status := range statuses {
+        if status.Time.IsZero() {
+            status.Time = time.Now()
+        }
+        replaced := false
+        for i := range c.runs {
+            r := c.runs[i]
+            if r.RunID == status.RunID && r.Site == status.Site && r.Component == status.Component {
+                if r.Status != status.Status {
+                    c.countLocked(status)
+                }
+                c.runs[i] = status
+                replaced = true
+                break
+            }
+        }
+        if !replaced {
+            c.runs = append(c.runs, status)
+            c.countLocked(status)
+        }
+    }
+
+    sort.SliceStable(c.runs, func(i, j int) bool {
+        return c.runs[i].Time.Before(c.runs[j].Time)
+    })
+    kept := make(map[string]int)
+    var pruned []RunStatus
+    for i := len(c.runs) - 1; i >= 0; i-- {
+        key := c.runs[i].Site + "/" + c.runs[i].Component
+        if kept[key] < maxRunsPerComponent {
+            kept[key]++
+            pruned = append([]RunStatus{c.runs[i]}, pruned...)
+        }
+    }
+    c.runs = pruned
+    return c.saveLocked()
+}
+
+// Runs returns a copy of the recorded run statuses of a site, or of all
+// sites if site is empty, oldest first
+func (c *Catalog) Runs(site string) []RunStatus {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var runs []RunStatus
+    for _, r := range c.runs {
+        if site == "" || r.Site == site {
+            runs = append(runs, r)
+        }
+    }
+    sort.SliceStable(runs, func(i, j int) bool {
+        return runs[i].Time.Before(runs[j].Time)
+    })
+    return runs
+}
+
+// LatestRuns returns the most recent status of every site and component,
+// keyed by site and then component
+func (c *Catalog) LatestRuns() map[string]map[string]RunStatus {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    latest := make(map[string]map[string]RunStatus)
+    for _, r := range c.runs {
+        if latest[r.Site] == nil {
+            latest[r.Site] = make(map[string]RunStatus)
+        }
+        if prev, ok := latest[r.Site][r.Component]; !ok || !r.Time.Before(prev.Time) {
+            latest[r.Site][r.Component] = r
+        }
+    }
+    return latest
+}
+
+// RecordOutcome stores how a run ended. Only the most recent outcomes are kept.
+func (c *Catalog) RecordOutcome(outcome RunOutcome) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    c.outcomes = append(c.outcomes, outcome)
+    sort.SliceStable(c.outcomes, func(i, j int) bool {
+        return c.outcomes[i].Started.Before(c.outcomes[j].Started)
+    })
+    if len(c.outcomes) > maxOutcomes {
+        c.outcomes = c.outcomes[len(c.outcomes)-maxOutcomes:]
+    }
+    return c.saveLocked()
+}
+
+// Outcomes returns a copy of the recorded run outcomes, oldest first
+func (c *Catalog) Outcomes() []RunOutcome {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    outcomes := make([]RunOutcome, len(c.outcomes))
+    copy(outcomes, c.outcomes)
+    return outcomes
+}
+
+// countLocked adds a status to the totals; the caller must hold c.mu
+func (c *Catalog) countLocked(status RunStatus) {
+    for i := range c.totals {
+        t := &c.totals[i]
+        if t.Site == status.Site && t.Component == status.Component && t.Status == status.Status {
+            t.Count++
+            return
+        }
+    }
+    c.totals = append(c.totals, RunTotal{Site: status.Site, Component: status.Component, Status: status.Status, Count: 1})
+}
+
+// Totals returns a copy of the run totals
+func (c *Catalog) Totals() []RunTotal {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    totals := make([]RunTotal, len(c.totals))
+    copy(totals, c.totals)
+    return totals
+}
+
+// saveLocked writes the catalog atomically; the caller must hold c.mu
+func (c *Catalog) saveLocked() error {
+    data, err := json.MarshalIndent(catalogFile{Entries: c.entries, Runs: c.runs, Totals: c.totals, Sizes: c.sizes, Outcomes: c.outcomes}, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode catalog: %v", err)
+    }
+    tmp := c.path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fmt.Errorf("failed to write catalog: %v", err)
+    }
+    return os.Rename(tmp, c.path)
+}
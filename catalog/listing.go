@@ -0,0 +1,106 @@
+package catalog
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+)
+
+// ListingsDirName is the directory of a base directory holding the cached
+// file listings of its archives
+const ListingsDirName = "_listings"
+
+// listingExt is the extension of listing files
+const listingExt = ".listing"
+
+// listingsDir returns the directory of the catalog's listing files
+func (c *Catalog) listingsDir() string {
+    return filepath.Join(filepath.Dir(c.path), ListingsDirName)
+}
+
+// Listing returns the cached file listing of an archive, nil if there is
+// none or the archive is unknown
+func (c *Catalog) Listing(path string) ([]byte, error) {
+    entry, ok := c.Find(path)
+    if !ok || entry.Listing == "" {
+        return nil, nil
+    }
+    data, err := os.ReadFile(filepath.Join(c.listingsDir(), entry.Listing))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read listing of %s: %v", filepath.Base(path), err)
+    }
+    return data, nil
+}
+
+// SetListing caches the file listing of an archive. The listing is stored
+// in a file of its own, so the catalog stays small; unknown paths are
+// ignored.
+func (c *Catalog) SetListing(path string, data []byte) error {
+    if _, ok := c.Find(path); !ok {
+        return nil
+    }
+    sum := sha256.Sum256([]byte(path))
+    name := hex.EncodeToString(sum[:12]) + listingExt
+    if err := os.MkdirAll(c.listingsDir(), 0700); err != nil {
+        return fmt.Errorf("failed to create listings directory: %v", err)
+    }
+    file := filepath.Join(c.listingsDir(), name)
+    if err := os.WriteFile(file+".tmp", data, 0600); err != nil {
+        return fmt.Errorf("failed to write listing: %v", err)
+    }
+    if err := os.Rename(file+".tmp", file); err != nil {
+        return fmt.Errorf("failed to write listing: %v", err)
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    end, err := c.beginLocked()
+    if err != nil {
+        return err
+    }
+    defer end()
+
+    for i := range c.entries {
+        if c.entries[i].Path == path {
+            c.entries[i].Listing = name
+            return c.saveLocked()
+        }
+    }
+    // The archive was removed meanwhile
+    return os.Remove(file)
+}
+
+// removeListing deletes the listing file of an entry; the caller must hold c.mu
+func (c *Catalog) removeListing(entry Entry) {
+    if entry.Listing != "" {
+        os.Remove(filepath.Join(c.listingsDir(), entry.Listing))
+    }
+}
+
+// StaleListings returns the listing files no archive of the catalog refers
+// to, such as those of archives removed by hand
+func (c *Catalog) StaleListings() ([]string, error) {
+    files, err := os.ReadDir(c.listingsDir())
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read listings directory: %v", err)
+    }
+    used := make(map[string]bool)
+    for _, entry := range c.Entries() {
+        used[entry.Listing] = true
+    }
+    var stale []string
+    for _, file := range files {
+        if !used[file.Name()] {
+            stale = append(stale, filepath.Join(c.listingsDir(), file.Name()))
+        }
+    }
+    return stale, nil
+}
@@ -0,0 +1,2272 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log/slog"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "text/tabwriter"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/backuptool"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/filelock"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/report"
+    "laravel-backup-tool/secrets"
+    "golang.org/x/crypto/ssh"
+    "gopkg.in/yaml.v3"
+)
+
+// usage lists the commands; "<command> -h" describes the options of one
+const usage = `Usage: laravel-backup-tool [--profile NAME] [command] [options]
+
+Without a command a full backup run is performed. --profile selects a
+profile, a configuration with backup directories of its own.
+
+Backups:
+  backup [SITE...] [--site SITE] [--only files|db] [--local|--remote] [--force] [--allow-large] [--resume] [--wait[=DURATION]] [--json]
+  estimate [SITE...] [--local|--remote] [--json]   size of the files each site's archive would hold
+  retry <job-id> | retry <site> file|database
+  standby [--source remote|local]
+  daemon                      run the configured schedules
+  serve                       serve the REST API and dashboard
+
+Archives:
+  list [--site PATTERN] [--type file|database] [--source NAME] [--json]
+  show <site>
+  latest <site> [--type file|database] [--path|--json]
+  verify [--site SITE] [--latest] [--json]
+  touch-check [--json]
+  test-restore [SITE...] [--json]
+  reconcile [--dry-run]
+  prune [--dry-run] [--unlock] [--json]
+  lifecycle                   move archives past the lifecycle's age to cold storage
+  restore <site> <timestamp|latest> [--target DIR] [--db|--db-only] [--force] [--preserve-ownership] [--json]
+  browse <site> <timestamp|latest> [PATH] [--recursive] [--json]
+  restore-file <site> <timestamp|latest> <path> [--target DIR] [--force] [--json]
+  restore-db <site> <timestamp|latest> --yes [--into DATABASE] [--env FILE]
+  restore-db <site> --until TIME --yes [--into DATABASE] [--env FILE]
+  prepare-physical <site> <timestamp|latest> --target DIR
+
+Reports:
+  status [--json] [--notify]
+  compliance [--json]
+  metrics
+  history [--limit N] [--json]
+  log <run-id|latest> [--level LEVEL] [--json]
+  attest [--month YYYY-MM] [--format json|pdf|both] [--out DIR]
+
+Setup:
+  init [--config FILE] [--systemd-dir DIR]   write backup.yaml and systemd units interactively
+  config show [--show-secrets] | config validate [--json] | config schedule
+  config render <server> [--show-secrets]
+  profiles [--json]           list the profiles and their backup directories
+  credentials store|forget <NAME>
+  encryption keygen [--age] | encryption status
+  rekey
+  trust-host [--yes] [remote|standby|<server>|<site>]
+  help
+`
+
+// runCommand executes an auxiliary command given on the command line
+func runCommand(name string, args []string) error {
+    switch name {
+    case "help", "-h", "--help":
+        fmt.Print(usage)
+        return nil
+    case "attest":
+        return runAttest(args)
+    case "status":
+        return runStatus(args)
+    case "compliance":
+        return runCompliance(args)
+    case "touch-check":
+        return runTouchCheck(args)
+    case "test-restore":
+        return runTestRestore(args)
+    case "estimate":
+        return runEstimate(args)
+    case "verify":
+        return runVerify(args)
+    case "metrics":
+        return runMetrics()
+    case "retry":
+        return runRetry(args)
+    case "reconcile":
+        return runReconcile(args)
+    case "list":
+        return runList(args)
+    case "show":
+        return runShow(args)
+    case "latest":
+        return runLatest(args)
+    case "history":
+        return runHistory(args)
+    case "log":
+        return runLog(args)
+    case "profiles":
+        return runProfiles(args)
+    case "config":
+        return runConfig(args)
+    case "credentials":
+        return runCredentials(args)
+    case "standby":
+        return runStandby(args)
+    case "restore":
+        return runRestore(args)
+    case "restore-db":
+        return runRestoreDB(args)
+    case "browse":
+        return runBrowse(args)
+    case "restore-file":
+        return runRestoreFile(args)
+    case "prepare-physical":
+        return runPreparePhysical(args)
+    case "prune":
+        return runPrune(args)
+    case "lifecycle":
+        return runLifecycle(args)
+    case "encryption":
+        return runEncryption(args)
+    case "rekey":
+        return runRekey(args)
+    case "trust-host":
+        return runTrustHost(args)
+    case "backup":
+        return runBackupCommand(args)
+    case "--daemon", "daemon":
+        return runDaemon()
+    case "serve":
+        return runServe(args)
+    default:
+        return fmt.Errorf("unknown command %q, see %s help", name, filepath.Base(os.Args[0]))
+    }
+}
+
+// runAttest generates a signed monthly attestation report for auditors
+func runAttest(args []string) error {
+    fs := flag.NewFlagSet("attest", flag.ExitOnError)
+    lastMonth := time.Now().AddDate(0, -1, 0)
+    month := fs.String("month", lastMonth.Format("2006-01"), "month to attest (YYYY-MM)")
+    format := fs.String("format", "both", "output format: json, pdf or both")
+    outDir := fs.String("out", ".", "directory for the generated report")
+    fs.Parse(args)
+
+    periodStart, err := time.ParseInLocation("2006-01", *month, time.Local)
+    if err != nil {
+        return fmt.Errorf("invalid month %q: %v", *month, err)
+    }
+
+    keyPath := os.Getenv("ATTESTATION_KEY_PATH")
+    if keyPath == "" {
+        return fmt.Errorf("ATTESTATION_KEY_PATH is not set, attestations must be signed")
+    }
+    key, err := backup.LoadSigningKey(keyPath)
+    if err != nil {
+        return err
+    }
+
+    sources := tool.ReportSources()
+    archiveKeys, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+    for i := range sources {
+        sources[i].Keys = archiveKeys
+    }
+
+    slog.Info("Building attestation", "month", *month)
+    att, err := report.BuildAttestation(sources, periodStart)
+    if err != nil {
+        return err
+    }
+
+    if err := os.MkdirAll(*outDir, 0755); err != nil {
+        return fmt.Errorf("failed to create output directory: %v", err)
+    }
+
+    var written []string
+    base := filepath.Join(*outDir, fmt.Sprintf("attestation_%s", att.Period))
+    if *format == "json" || *format == "both" {
+        if err := att.WriteJSON(base + ".json"); err != nil {
+            return err
+        }
+        written = append(written, base+".json")
+    }
+    if *format == "pdf" || *format == "both" {
+        if err := att.WritePDF(base + ".pdf"); err != nil {
+            return err
+        }
+        written = append(written, base+".pdf")
+    }
+    if len(written) == 0 {
+        return fmt.Errorf("unknown format %q", *format)
+    }
+
+    for _, path := range written {
+        if err := report.SignFile(path, key); err != nil {
+            return err
+        }
+        slog.Info("Wrote attestation", "path", path, "signature", path+".sig")
+    }
+
+    pubPath := filepath.Join(*outDir, "attestation.pub.pem")
+    if err := report.WritePublicKey(pubPath, key); err != nil {
+        return err
+    }
+    slog.Info("Wrote public key for verification", "path", pubPath)
+    return nil
+}
+
+// runCompliance evaluates all sites against their RPO/RTO policies and
+// fails when any site is in violation, so it can be used from monitoring
+func runCompliance(args []string) error {
+    fs := flag.NewFlagSet("compliance", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print results as JSON")
+    fs.Parse(args)
+
+    results, err := tool.EvaluateCompliance()
+    if err != nil {
+        return err
+    }
+
+    if *asJSON {
+        data, err := json.MarshalIndent(results, "", "  ")
+        if err != nil {
+            return fmt.Errorf("failed to encode results: %v", err)
+        }
+        fmt.Println(string(data))
+    } else {
+        fmt.Print(report.FormatCompliance(results))
+    }
+
+    for _, r := range results {
+        if !r.Compliant() {
+            return fmt.Errorf("recovery objectives violated")
+        }
+    }
+    return nil
+}
+
+// runStatus reports the sites whose last successful backup is older than
+// their freshness SLA and exits non-zero if there are any. With --notify
+// newly stale sites are also emailed.
+func runStatus(args []string) error {
+    fs := flag.NewFlagSet("status", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print results as JSON")
+    notify := fs.Bool("notify", false, "email sites that became stale since the last notice")
+    fs.Parse(args)
+
+    results, err := tool.EvaluateFreshness()
+    if err != nil {
+        return err
+    }
+
+    if *asJSON {
+        data, err := json.MarshalIndent(results, "", "  ")
+        if err != nil {
+            return fmt.Errorf("failed to encode results: %v", err)
+        }
+        fmt.Println(string(data))
+    } else {
+        fmt.Print(report.FormatFreshness(results, time.Now()))
+    }
+
+    if *notify {
+        sent, err := tool.NotifyStaleSites(results)
+        if err != nil {
+            return err
+        }
+        if sent {
+            slog.Info("Notified of stale sites", "to", strings.Join(cfg.Report.SMTP.To, ", "))
+        }
+    }
+
+    stale := 0
+    for _, r := range results {
+        if !r.Fresh() {
+            stale++
+        }
+    }
+    if stale > 0 {
+        return fmt.Errorf("%d of %d sites are stale", stale, len(results))
+    }
+    return nil
+}
+
+// runMetrics prints the backup metrics in the Prometheus text format
+func runMetrics() error {
+    return report.WriteMetrics(os.Stdout, tool.ReportSources())
+}
+
+// runVerify fully verifies the backup archives and reports corrupted ones
+func runVerify(args []string) error {
+    fs := flag.NewFlagSet("verify", flag.ExitOnError)
+    site := fs.String("site", "", "only verify archives of this site")
+    latest := fs.Bool("latest", false, "only verify the latest file and database archive of every site")
+    asJSON := fs.Bool("json", false, "print results as JSON")
+    fs.Parse(args)
+
+    results, err := report.Verify(tool.ReportSources(), *site, *latest)
+    if err != nil {
+        return err
+    }
+
+    failed := 0
+    for _, r := range results {
+        if r.Failed() {
+            failed++
+        }
+    }
+
+    if *asJSON {
+        data, err := json.MarshalIndent(results, "", "  ")
+        if err != nil {
+            return fmt.Errorf("failed to encode results: %v", err)
+        }
+        fmt.Println(string(data))
+    } else {
+        for _, r := range results {
+            checksum := "checksum ok"
+            if !r.Checksum {
+                checksum = "no checksum recorded"
+            } else if r.Signed {
+                checksum += ", signature ok"
+            }
+            if r.Failed() {
+                checksum = r.Error
+            }
+            fmt.Printf("%-10s %s (%s, %s): %s\n", r.Status, r.Site, r.Source, r.Type, r.Archive)
+            fmt.Printf("           %s\n", checksum)
+        }
+        fmt.Printf("%d of %d archives are corrupted\n", failed, len(results))
+    }
+
+    if failed > 0 {
+        return fmt.Errorf("verification found %d corrupted archives", failed)
+    }
+    return nil
+}
+
+// runTouchCheck performs the light verification meant to run between backups
+func runTouchCheck(args []string) error {
+    fs := flag.NewFlagSet("touch-check", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print results as JSON")
+    fs.Parse(args)
+
+    sources, err := tool.TouchCheckSources()
+    if err != nil {
+        return err
+    }
+    results, err := report.TouchCheck(sources)
+    if err != nil {
+        return err
+    }
+
+    failed := 0
+    for _, r := range results {
+        if r.Failed() {
+            failed++
+        }
+    }
+
+    if *asJSON {
+        data, err := json.MarshalIndent(results, "", "  ")
+        if err != nil {
+            return fmt.Errorf("failed to encode results: %v", err)
+        }
+        fmt.Println(string(data))
+    } else {
+        for _, r := range results {
+            fmt.Printf("%-10s %s (%s, %s): %s\n", r.Status, r.Site, r.Source, r.Type, r.Archive)
+            fmt.Printf("           off-server copy: %s\n", r.Offsite)
+            if r.Error != "" {
+                fmt.Printf("           %s\n", r.Error)
+            }
+        }
+        fmt.Printf("%d of %d archives need attention\n", failed, len(results))
+    }
+
+    if failed > 0 {
+        return fmt.Errorf("touch check found %d problems", failed)
+    }
+    return nil
+}
+
+// runTestRestore restores the latest backups of all or the given local
+// sites into a scratch directory and a throwaway database and checks them
+func runTestRestore(args []string) error {
+    fs := flag.NewFlagSet("test-restore", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print results as JSON")
+
+    // Flags may be given before or after the sites
+    var sites []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        sites = append(sites, args[0])
+        args = args[1:]
+    }
+
+    ctx, cancel := runContext()
+    defer cancel()
+    results, err := tool.TestRestores(ctx, sites)
+    if err != nil {
+        return err
+    }
+
+    failed := 0
+    for _, r := range results {
+        if r.Failed() {
+            failed++
+        }
+    }
+
+    if *asJSON {
+        if err := printJSON(results); err != nil {
+            return err
+        }
+    } else {
+        for _, r := range results {
+            status := "ok"
+            if r.Failed() {
+                status = "failed"
+            }
+            fmt.Printf("%-10s %s (%s)\n", status, r.Site, roundDuration(r.Duration))
+            for _, check := range r.Checks {
+                fmt.Printf("           %-8s %-8s %s\n", check.Name, check.Status, check.Detail)
+            }
+        }
+        fmt.Printf("%d of %d sites failed the restore test\n", failed, len(results))
+    }
+
+    if failed > 0 {
+        return fmt.Errorf("restore test failed for %d sites", failed)
+    }
+    return nil
+}
+
+// runEstimate lists the document roots of the sites given as arguments, or
+// of all sites, only local or remote ones with --local or --remote, and
+// prints the size and number of the files their archives would hold. Sites
+// over their maximum size fail the command.
+func runEstimate(args []string) error {
+    fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+    local := fs.Bool("local", false, "estimate only local sites")
+    remote := fs.Bool("remote", false, "estimate only sites of the remote servers")
+    asJSON := fs.Bool("json", false, "print the estimates as JSON")
+
+    // Flags may be given before or after the sites
+    var sites []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        sites = append(sites, args[0])
+        args = args[1:]
+    }
+
+    scope := backuptool.Scope{Sites: sites}
+    switch {
+    case *local && *remote:
+        return fmt.Errorf("--local and --remote can't be combined, leave both out for all sites")
+    case *local:
+        scope.Source = "local"
+    case *remote:
+        scope.Source = "remote"
+    }
+
+    ctx, cancel := runContext()
+    defer cancel()
+    estimates, err := tool.Estimate(ctx, scope)
+    if err != nil && len(estimates) == 0 {
+        return err
+    }
+
+    over, failed := 0, 0
+    for _, e := range estimates {
+        switch e.Status {
+        case backup.SizeOver:
+            over++
+        case backup.SizeError:
+            failed++
+        }
+    }
+    if *asJSON {
+        if estimates == nil {
+            estimates = []backup.SiteEstimate{}
+        }
+        if jsonErr := printJSON(estimates); jsonErr != nil {
+            return jsonErr
+        }
+    } else {
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "SOURCE\tSITE\tFILES\tSIZE\tLIMIT\tSTATUS")
+        var files int
+        var total backup.ByteSize
+        for _, e := range estimates {
+            limit := "-"
+            switch {
+            case e.MaxSize != 0:
+                limit = e.MaxSize.String()
+            case e.WarnSize != 0:
+                limit = "warn " + e.WarnSize.String()
+            }
+            status := e.Status
+            if e.Error != "" {
+                status += ": " + e.Error
+            }
+            fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", e.Source, e.Site, e.Files, e.Size, limit, status)
+            files += e.Files
+            total += e.Size
+        }
+        if err := w.Flush(); err != nil {
+            return err
+        }
+        fmt.Printf("%d sites, %d files, %s\n", len(estimates), files, total)
+    }
+
+    switch {
+    case err != nil:
+        return err
+    case failed > 0:
+        return fmt.Errorf("unable to estimate %d sites", failed)
+    case over > 0:
+        return fmt.Errorf("%d sites exceed their maximum size, back them up with --allow-large", over)
+    }
+    return nil
+}
+
+// waitFlag is the --wait option: without a value it waits until the lock is
+// free, with a duration at most that long
+type waitFlag time.Duration
+
+func (w *waitFlag) String() string {
+    if time.Duration(*w) == filelock.Forever {
+        return "forever"
+    }
+    return time.Duration(*w).String()
+}
+
+func (w *waitFlag) Set(value string) error {
+    if value == "true" {
+        *w = waitFlag(filelock.Forever)
+        return nil
+    }
+    if value == "false" {
+        *w = 0
+        return nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil || d < 0 {
+        return fmt.Errorf("invalid duration %q", value)
+    }
+    *w = waitFlag(d)
+    return nil
+}
+
+func (w *waitFlag) IsBoolFlag() bool {
+    return true
+}
+
+// listFlag is an option that may be given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+    return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+    *l = append(*l, value)
+    return nil
+}
+
+// backupComponents maps the values of --only to backup components
+var backupComponents = map[string]string{"files": "file", "db": "database"}
+
+// runBackupCommand performs a full run, or backs up the sites given as
+// arguments or with --site, only their files or databases with --only, and
+// only local or remote sites with --local or --remote. --force backs up what
+// isn't due or is in a blackout window, --allow-large the files of sites over
+// their maximum size, and --resume continues the last run where it failed.
+// With --wait it waits for a run holding the lock to finish instead of
+// failing. --json prints the run report.
+func runBackupCommand(args []string) error {
+    fs := flag.NewFlagSet("backup", flag.ExitOnError)
+    var wait waitFlag
+    var sites listFlag
+    fs.Var(&wait, "wait", "wait for a running backup to finish, optionally at most this long (e.g. 30m)")
+    fs.Var(&sites, "site", "back up only this site and its applications, may be given several times")
+    only := fs.String("only", "", "back up only the files or the database: files or db")
+    local := fs.Bool("local", false, "back up only local sites")
+    remote := fs.Bool("remote", false, "back up only sites of the remote servers")
+    asJSON := fs.Bool("json", false, "print the run report as JSON")
+    force := fs.Bool("force", false, "back up even what isn't due or is in a blackout window")
+    allowLarge := fs.Bool("allow-large", false, "back up the files of sites even over their maximum size")
+    resume := fs.Bool("resume", false, "continue the last run where it failed instead of starting over")
+
+    // Flags may be given before or after the sites
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        sites = append(sites, args[0])
+        args = args[1:]
+    }
+
+    scope := backuptool.Scope{Sites: sites, Force: *force, AllowLarge: *allowLarge, Resume: *resume}
+    if *only != "" {
+        component, ok := backupComponents[*only]
+        if !ok {
+            return fmt.Errorf("unknown component %q, use files or db", *only)
+        }
+        scope.Only = component
+    }
+    switch {
+    case *local && *remote:
+        return fmt.Errorf("--local and --remote can't be combined, leave both out for all sites")
+    case *local:
+        scope.Source = "local"
+    case *remote:
+        scope.Source = "remote"
+    }
+
+    if !*asJSON {
+        return runBackup(scope, time.Duration(wait))
+    }
+    // Tables printed during the run would mix with the report
+    tool.Output = os.Stderr
+    r, err := tool.Backup(abort, scope, time.Duration(wait))
+    if r != nil {
+        if jsonErr := printJSON(r); jsonErr != nil && err == nil {
+            err = jsonErr
+        }
+    }
+    return runOutcome(r, err)
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v any) error {
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode results: %v", err)
+    }
+    fmt.Println(string(data))
+    return nil
+}
+
+// runRetry re-runs a failed job of a local backup run, together with the
+// jobs that were skipped because of it. The job is given by its ID or as a
+// site and component, which retries the component's last failed run while
+// leaving the site's other component alone.
+func runRetry(args []string) error {
+    var jobID string
+    switch len(args) {
+    case 1:
+        jobID = args[0]
+    case 2:
+        site, component := args[0], args[1]
+        if component != "file" && component != "database" {
+            return fmt.Errorf("component must be file or database, got %q", component)
+        }
+        var err error
+        if jobID, err = failedJobOf(site, component); err != nil || jobID == "" {
+            return err
+        }
+    default:
+        return fmt.Errorf("usage: retry <job-id> | retry <site> file|database")
+    }
+
+    lock, err := backup.LockRun(cfg.Local.BackupDir)
+    if err != nil {
+        return err
+    }
+    defer lock.Unlock()
+    defer tool.WriteMetricsTextfile()
+    _, endRun := logging.StartRun()
+    defer endRun()
+
+    retried, err := tool.Retry(abort, jobID)
+    if err == nil && !retried {
+        slog.Info("Job already completed, nothing to do", "job", jobID)
+    }
+    return err
+}
+
+// failedJobOf looks up the job that made the last run of a site's component
+// fail. It returns an empty ID if the component did not fail.
+func failedJobOf(site, component string) (string, error) {
+    cat, err := catalog.Open(cfg.Local.BackupDir)
+    if err != nil {
+        return "", err
+    }
+    status, ok := cat.LatestRuns()[site][component]
+    if !ok {
+        return "", fmt.Errorf("no %s backup of %s has been recorded", component, site)
+    }
+    if !status.Failed() {
+        slog.Info("Last backup did not fail, nothing to do", "site", site, "type", component,
+            "catalog_run", status.RunID, "status", status.Status)
+        return "", nil
+    }
+    if status.JobID == "" {
+        return "", fmt.Errorf("run %s of %s has no job to retry", status.RunID, site)
+    }
+    return status.JobID, nil
+}
+
+// runReconcile compares the catalogs with the archives on disk and optionally
+// repairs the catalogs
+func runReconcile(args []string) error {
+    fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+    dryRun := fs.Bool("dry-run", false, "only report discrepancies")
+    fs.Parse(args)
+
+    clean := true
+    for _, source := range tool.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        manager, err := tool.OpenManager(source.BaseDir)
+        if err != nil {
+            return err
+        }
+        result, err := manager.Reconcile(!*dryRun)
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%s (%s):\n%s", source.BaseDir, source.Name, result.Summary())
+        if len(result.Mismatched) > 0 || len(result.MissingOffsite) > 0 || (*dryRun && !result.Clean()) {
+            clean = false
+        }
+    }
+
+    if !clean {
+        return fmt.Errorf("storage and catalog disagree")
+    }
+    return nil
+}
+
+// catalogEntry is an archive recorded in the catalog of a backup directory
+type catalogEntry struct {
+    Source string `json:"source"`
+    catalog.Entry
+}
+
+// catalogEntries returns the cataloged archives of every backup directory,
+// oldest first. match selects the entries returned.
+func catalogEntries(match func(catalog.Entry) bool) ([]catalogEntry, error) {
+    var entries []catalogEntry
+    for _, source := range tool.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+        for _, entry := range cat.Entries() {
+            if match(entry) {
+                entries = append(entries, catalogEntry{Source: source.Name, Entry: entry})
+            }
+        }
+    }
+    sort.SliceStable(entries, func(i, j int) bool {
+        return entries[i].Time.Before(entries[j].Time)
+    })
+    return entries, nil
+}
+
+// printEntries prints cataloged archives as a table or as JSON
+func printEntries(entries []catalogEntry, asJSON bool) error {
+    if asJSON {
+        if entries == nil {
+            entries = []catalogEntry{}
+        }
+        data, err := json.MarshalIndent(entries, "", "  ")
+        if err != nil {
+            return fmt.Errorf("failed to encode catalog entries: %v", err)
+        }
+        fmt.Println(string(data))
+        return nil
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "SOURCE\tSITE\tTYPE\tTIME\tSIZE\tDURATION\tPATH\tOFF-SERVER COPY")
+    for _, e := range entries {
+        duration, location := "-", "-"
+        if e.Duration > 0 {
+            duration = roundDuration(e.Duration).String()
+        }
+        if e.Location != "" {
+            location = e.Location
+        }
+        if e.Cold {
+            location += " (cold)"
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Source, e.Site, e.Type,
+            e.Time.Format("2006-01-02 15:04:05"), backup.ByteSize(e.Size), duration, e.Path, location)
+    }
+    return w.Flush()
+}
+
+// roundDuration rounds a duration for display, keeping milliseconds of
+// durations under a second
+func roundDuration(d time.Duration) time.Duration {
+    if d < time.Second {
+        return d.Round(time.Millisecond)
+    }
+    return d.Round(time.Second)
+}
+
+// validArchiveType checks the value of a --type flag
+func validArchiveType(archiveType string) error {
+    switch archiveType {
+    case "", "file", "database":
+        return nil
+    }
+    return fmt.Errorf("unknown type %q, use file or database", archiveType)
+}
+
+// runList prints the cataloged archives of all backup directories
+func runList(args []string) error {
+    fs := flag.NewFlagSet("list", flag.ExitOnError)
+    site := fs.String("site", "", "only sites matching this pattern, e.g. 'shop.*'")
+    archiveType := fs.String("type", "", "only archives of this type: file or database")
+    source := fs.String("source", "", "only archives of this source, e.g. local or remote")
+    asJSON := fs.Bool("json", false, "print the archives as JSON")
+    fs.Parse(args)
+
+    if err := validArchiveType(*archiveType); err != nil {
+        return err
+    }
+    if *site != "" {
+        if _, err := filepath.Match(*site, ""); err != nil {
+            return fmt.Errorf("invalid site pattern %q: %v", *site, err)
+        }
+    }
+
+    entries, err := catalogEntries(func(e catalog.Entry) bool {
+        if *site != "" {
+            if ok, _ := filepath.Match(*site, e.Site); !ok {
+                return false
+            }
+        }
+        return *archiveType == "" || e.Type == *archiveType
+    })
+    if err != nil {
+        return err
+    }
+    if *source != "" {
+        var selected []catalogEntry
+        for _, e := range entries {
+            if e.Source == *source || strings.HasPrefix(e.Source, *source+"/") {
+                selected = append(selected, e)
+            }
+        }
+        entries = selected
+    }
+    return printEntries(entries, *asJSON)
+}
+
+// runShow prints everything recorded about a site: its archives with
+// checksums and the outcome of its latest runs
+func runShow(args []string) error {
+    fs := flag.NewFlagSet("show", flag.ExitOnError)
+    fs.Parse(args)
+    if fs.NArg() != 1 {
+        return fmt.Errorf("usage: show <site>")
+    }
+    site := fs.Arg(0)
+
+    found := false
+    for _, source := range tool.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            return err
+        }
+        var entries []catalog.Entry
+        for _, entry := range cat.Entries() {
+            if entry.Site == site {
+                entries = append(entries, entry)
+            }
+        }
+        runs := cat.LatestRuns()[site]
+        if len(entries) == 0 && len(runs) == 0 {
+            continue
+        }
+        found = true
+
+        fmt.Printf("%s (%s, %s)\n", site, source.Name, source.BaseDir)
+        var total int64
+        for _, e := range entries {
+            total += e.Size
+        }
+        fmt.Printf("  Archives: %d, %s\n", len(entries), backup.ByteSize(total))
+        for _, e := range entries {
+            fmt.Printf("  %s  %-8s  %10s  %s\n", e.Time.Format("2006-01-02 15:04:05"), e.Type, backup.ByteSize(e.Size), e.Path)
+            details := "    sha256 " + e.Checksum
+            if e.Duration > 0 {
+                details += ", took " + roundDuration(e.Duration).String()
+            }
+            if e.Pushed {
+                details += ", pushed by the server to " + e.Location
+            } else if e.Cold {
+                details += ", moved to cold storage at " + e.Location
+                if e.StorageClass != "" {
+                    details += " (" + e.StorageClass + ")"
+                }
+            } else if e.Location != "" {
+                details += ", copy at " + e.Location
+            }
+            fmt.Println(details)
+        }
+        for _, component := range []string{"file", "database"} {
+            r, ok := runs[component]
+            if !ok {
+                continue
+            }
+            fmt.Printf("  Last %s run: %s at %s (run %s)", component, r.Status, r.Time.Format("2006-01-02 15:04:05"), r.RunID)
+            if r.Error != "" {
+                fmt.Printf(": %s", r.Error)
+            }
+            fmt.Println()
+        }
+    }
+    if !found {
+        return fmt.Errorf("no backups of %s in the catalog", site)
+    }
+    return nil
+}
+
+// runLatest prints the newest archives of a site. With --path only their
+// paths are printed, for use in scripts.
+func runLatest(args []string) error {
+    fs := flag.NewFlagSet("latest", flag.ExitOnError)
+    archiveType := fs.String("type", "", "only archives of this type: file or database")
+    pathOnly := fs.Bool("path", false, "print only the paths of the archives")
+    asJSON := fs.Bool("json", false, "print the archives as JSON")
+
+    // Flags may be given before or after the site
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) != 1 {
+        return fmt.Errorf("usage: latest <site> [--type file|database] [--path|--json]")
+    }
+    site := positional[0]
+    if err := validArchiveType(*archiveType); err != nil {
+        return err
+    }
+
+    var entries []catalogEntry
+    for _, source := range tool.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            return err
+        }
+        for _, t := range []string{"file", "database"} {
+            if *archiveType != "" && t != *archiveType {
+                continue
+            }
+            if entry, ok := cat.Latest(site, t); ok {
+                entries = append(entries, catalogEntry{Source: source.Name, Entry: entry})
+            }
+        }
+    }
+    if len(entries) == 0 {
+        return fmt.Errorf("no backups of %s in the catalog", site)
+    }
+
+    if *pathOnly {
+        for _, e := range entries {
+            fmt.Println(e.Path)
+        }
+        return nil
+    }
+    return printEntries(entries, *asJSON)
+}
+
+// runHistory prints the outcomes of the recent backup runs, newest first
+func runHistory(args []string) error {
+    fs := flag.NewFlagSet("history", flag.ExitOnError)
+    limit := fs.Int("limit", 20, "print at most this many runs, 0 for all")
+    asJSON := fs.Bool("json", false, "print the runs as JSON")
+    fs.Parse(args)
+
+    cat, err := catalog.Open(cfg.Local.BackupDir)
+    if err != nil {
+        return err
+    }
+    outcomes := cat.Outcomes()
+    sort.SliceStable(outcomes, func(i, j int) bool {
+        return outcomes[i].Started.After(outcomes[j].Started)
+    })
+    if *limit > 0 && len(outcomes) > *limit {
+        outcomes = outcomes[:*limit]
+    }
+    if *asJSON {
+        return printJSON(outcomes)
+    }
+    if len(outcomes) == 0 {
+        fmt.Println("No runs recorded")
+        return nil
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "RUN\tSTARTED\tDURATION\tSTATUS\tFAILED SITES\tLOG\tERROR")
+    for _, o := range outcomes {
+        logState := "-"
+        if o.Dir != "" {
+            logState = "rotated"
+            if _, err := os.Stat(o.Dir); err == nil {
+                logState = "yes"
+            }
+        }
+        errText := o.Error
+        if errText == "" {
+            errText = "-"
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\t%s\n", o.RunID, o.Started.Local().Format("2006-01-02 15:04:05"),
+            roundDuration(o.Finished.Sub(o.Started)), o.Status, o.FailedSites, o.TotalSites, logState, errText)
+    }
+    return w.Flush()
+}
+
+// runLog prints the log of a backup run kept in the run history
+func runLog(args []string) error {
+    fs := flag.NewFlagSet("log", flag.ExitOnError)
+    level := fs.String("level", "debug", "only records of at least this level: debug, info, warn or error")
+    raw := fs.Bool("json", false, "print the records as they are stored, as JSON lines")
+
+    // Flags may be given before or after the run
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) != 1 {
+        return fmt.Errorf("usage: log <run-id|latest> [--level LEVEL] [--json]")
+    }
+    var minLevel slog.Level
+    if err := minLevel.UnmarshalText([]byte(*level)); err != nil {
+        return fmt.Errorf("unknown log level %q, use debug, info, warn or error", *level)
+    }
+    dir, err := report.FindRunDir(cfg.Local.BackupDir, positional[0])
+    if err != nil {
+        return err
+    }
+    return report.PrintRunLog(os.Stdout, dir, minLevel, *raw)
+}
+
+// runConfig handles configuration subcommands
+func runConfig(args []string) error {
+    if len(args) == 0 {
+        return fmt.Errorf("usage: config show [--show-secrets] | config validate [--json] | config schedule | config render <server> [--show-secrets]")
+    }
+    switch args[0] {
+    case "show":
+        return runConfigShow(args[1:])
+    case "validate":
+        return runConfigValidate(args[1:], nil)
+    case "schedule":
+        return runConfigSchedule()
+    case "render":
+        return runConfigRender(args[1:])
+    default:
+        return fmt.Errorf("unknown config command %q", args[0])
+    }
+}
+
+// runConfigShow prints the effective configuration of this machine after
+// environment overrides have been applied. Passwords and keys are masked
+// unless --show-secrets is given.
+func runConfigShow(args []string) error {
+    fs := flag.NewFlagSet("config show", flag.ExitOnError)
+    showSecrets := fs.Bool("show-secrets", false, "print passwords and keys instead of masking them")
+    fs.Parse(args)
+
+    shown := cfg.Redacted()
+    if *showSecrets {
+        shown = cfg
+    }
+    data, err := yaml.Marshal(shown)
+    if err != nil {
+        return fmt.Errorf("failed to encode configuration: %v", err)
+    }
+    if cfg.Profile != "" && cfg.Path != "" {
+        fmt.Printf("# profile %s of %s with environment overrides\n", cfg.Profile, cfg.Path)
+    } else if cfg.Path != "" {
+        fmt.Printf("# %s with environment overrides\n", cfg.Path)
+    } else {
+        fmt.Println("# defaults with environment overrides, no backup.yaml found")
+    }
+    fmt.Print(string(data))
+    return nil
+}
+
+// configCheck is the outcome of validating the configuration
+type configCheck struct {
+    Valid bool   `json:"valid"`
+    Path  string `json:"path,omitempty"`
+    Error string `json:"error,omitempty"`
+    // Problems that don't make the configuration invalid but will likely
+    // make backups fail or behave unexpectedly
+    Warnings []string `json:"warnings,omitempty"`
+}
+
+// runConfigValidate checks the configuration and the files it refers to.
+// loadErr is the error of loading the configuration, which leaves cfg nil;
+// anything else is reported as a warning.
+func runConfigValidate(args []string, loadErr error) error {
+    fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print the result as JSON")
+    fs.Parse(args)
+
+    check := configCheck{Valid: loadErr == nil, Path: config.ConfigFile()}
+    // A profile file replaces backup.yaml
+    if profile := os.Getenv(config.ProfileEnv); profile != "" {
+        if path := config.ProfileFile(profile); path != "" {
+            if _, err := os.Stat(path); err == nil {
+                check.Path = path
+            }
+        }
+    }
+    if loadErr != nil {
+        check.Error = loadErr.Error()
+    }
+    if check.Path != "" {
+        unknown, err := config.UnknownSettings(check.Path)
+        if err != nil && loadErr == nil {
+            check.Warnings = append(check.Warnings, err.Error())
+        }
+        for _, setting := range unknown {
+            check.Warnings = append(check.Warnings, fmt.Sprintf("%s: %s", check.Path, setting))
+        }
+    }
+    if loadErr == nil {
+        check.Warnings = append(check.Warnings, configFileWarnings()...)
+    }
+
+    if *asJSON {
+        if err := printJSON(check); err != nil {
+            return err
+        }
+    } else {
+        for _, warning := range check.Warnings {
+            fmt.Printf("warning: %s\n", warning)
+        }
+        if check.Valid {
+            path := check.Path
+            if path == "" {
+                path = "defaults"
+            }
+            fmt.Printf("configuration is valid (%s with environment overrides)\n", path)
+        }
+    }
+    return loadErr
+}
+
+// configFileWarnings returns problems with the files and directories the
+// configuration refers to
+func configFileWarnings() []string {
+    var warnings []string
+    missing := func(what, path string) {
+        if path == "" {
+            return
+        }
+        if _, err := os.Stat(path); err != nil {
+            warnings = append(warnings, fmt.Sprintf("%s %s: %v", what, path, err))
+        }
+    }
+
+    if _, _, err := tool.DetectWebServer(); err != nil {
+        warnings = append(warnings, fmt.Sprintf("local backups will fail: %v", err))
+    }
+    if cfg.Remote.Enabled {
+        missing("SSH key", cfg.Remote.SSH.KeyPath)
+        for _, server := range cfg.Remote.Servers {
+            missing("SSH key of "+server.Name, server.SSH.KeyPath)
+        }
+    }
+    for site, tunnel := range cfg.DBTunnels.Sites {
+        missing("SSH key of the database tunnel of "+site, tunnel.KeyPath)
+    }
+    if cfg.Rclone.Remote != "" {
+        missing("rclone configuration", cfg.Rclone.ConfigFile)
+        if _, err := exec.LookPath(cfg.Rclone.Binary); err != nil {
+            warnings = append(warnings, fmt.Sprintf("uploads to %s will fail: %v", cfg.Rclone.Remote, err))
+        }
+    }
+    // Sites backed up less often than their SLA would always be reported stale
+    stale := func(site string) {
+        frequency := cfg.Frequency.For(site)
+        interval := frequency.File
+        if frequency.Database > interval {
+            interval = frequency.Database
+        }
+        if sla := cfg.Freshness.For(site); interval > sla {
+            name := "frequency"
+            if site != "" {
+                name += " of " + site
+            }
+            warnings = append(warnings, fmt.Sprintf("%s: an interval of %s exceeds the freshness sla of %s, so status will report stale backups", name, interval, sla))
+        }
+    }
+    stale("")
+    for site := range cfg.Frequency.Sites {
+        stale(site)
+    }
+    if cfg.Encryption.Enabled {
+        missing("encryption key", cfg.Encryption.KeyFile)
+    }
+    for _, path := range cfg.Encryption.PreviousKeyFiles {
+        missing("previous encryption key", path)
+    }
+    for _, path := range cfg.Encryption.IdentityFiles {
+        missing("age identity", path)
+    }
+    return warnings
+}
+
+// runConfigSchedule prints crontab entries for the configured schedules
+func runConfigSchedule() error {
+    siteSchedules := tool.SiteSchedules()
+    if len(cfg.Schedules) == 0 && len(siteSchedules) == 0 {
+        return fmt.Errorf("no schedules configured in backup.yaml")
+    }
+    binary, err := os.Executable()
+    if err != nil {
+        return fmt.Errorf("failed to locate executable: %v", err)
+    }
+
+    var names []string
+    for name := range cfg.Schedules {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    if cfg.Profile != "" {
+        binary += " --profile " + cfg.Profile
+    }
+    for _, name := range names {
+        command := binary
+        if name != "backup" {
+            command += " " + name
+        }
+        fmt.Printf("%s %s\n", cfg.Schedules[name], command)
+    }
+
+    var sites []string
+    for site := range siteSchedules {
+        sites = append(sites, site)
+    }
+    sort.Strings(sites)
+    for _, site := range sites {
+        fmt.Printf("%s %s backup %s\n", siteSchedules[site], binary, site)
+    }
+    return nil
+}
+
+// profileInfo describes a profile for the profiles command
+type profileInfo struct {
+    Name      string `json:"name"`
+    Path      string `json:"path,omitempty"`
+    LocalDir  string `json:"local_backup_dir,omitempty"`
+    RemoteDir string `json:"remote_backup_dir,omitempty"`
+    Selected  bool   `json:"selected"`
+    Error     string `json:"error,omitempty"`
+}
+
+// runProfiles lists the default configuration and the profiles with their
+// backup directories, and warns about directories profiles share
+func runProfiles(args []string) error {
+    fs := flag.NewFlagSet("profiles", flag.ExitOnError)
+    asJSON := fs.Bool("json", false, "print the profiles as JSON")
+    fs.Parse(args)
+
+    names, err := config.ProfileNames()
+    if err != nil {
+        return err
+    }
+    var profiles []profileInfo
+    owners := map[string]string{}
+    var warnings []string
+    for _, name := range append([]string{""}, names...) {
+        info := profileInfo{Name: name, Selected: name == cfg.Profile}
+        if name == "" {
+            info.Name = "(default)"
+        }
+        c, err := config.LoadProfile(name)
+        if err != nil {
+            info.Error = err.Error()
+            profiles = append(profiles, info)
+            continue
+        }
+        info.Path, info.LocalDir, info.RemoteDir = c.Path, c.Local.BackupDir, c.Remote.BackupDir
+        for _, dir := range []string{info.LocalDir, info.RemoteDir} {
+            if owner, ok := owners[dir]; ok && owner != info.Name {
+                warnings = append(warnings, fmt.Sprintf("%s and %s share the backup directory %s", owner, info.Name, dir))
+            }
+            owners[dir] = info.Name
+        }
+        profiles = append(profiles, info)
+    }
+    if *asJSON {
+        return printJSON(profiles)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "PROFILE\tFILE\tLOCAL BACKUP DIR\tREMOTE BACKUP DIR")
+    for _, p := range profiles {
+        name := p.Name
+        if p.Selected {
+            name += " *"
+        }
+        if p.Error != "" {
+            fmt.Fprintf(w, "%s\terror: %s\t\t\n", name, p.Error)
+            continue
+        }
+        path := p.Path
+        if path == "" {
+            path = "-"
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, path, p.LocalDir, p.RemoteDir)
+    }
+    if err := w.Flush(); err != nil {
+        return err
+    }
+    for _, warning := range warnings {
+        fmt.Printf("warning: %s\n", warning)
+    }
+    return nil
+}
+
+// runConfigRender prints the effective configuration of a fleet server after
+// templates and overrides have been applied. The SSH password is masked
+// unless --show-secrets is given.
+func runConfigRender(args []string) error {
+    fs := flag.NewFlagSet("config render", flag.ExitOnError)
+    showSecrets := fs.Bool("show-secrets", false, "print the SSH password instead of masking it")
+
+    // The flag may be given before or after the server
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    args = positional
+
+    fleetPath := os.Getenv("FLEET_FILE")
+    if fleetPath == "" {
+        return fmt.Errorf("FLEET_FILE is not set")
+    }
+    fleet, err := config.LoadFleet(fleetPath)
+    if err != nil {
+        return err
+    }
+
+    if len(args) != 1 {
+        return fmt.Errorf("usage: config render <server> [--show-secrets] (servers: %s)", strings.Join(fleet.ServerNames(), ", "))
+    }
+
+    effective, err := fleet.Render(args[0])
+    if err != nil {
+        return err
+    }
+    shown := effective.Redacted()
+    if *showSecrets {
+        shown = effective
+    }
+    data, err := json.MarshalIndent(shown, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode configuration: %v", err)
+    }
+    fmt.Println(string(data))
+    return nil
+}
+
+// runCredentials stores secrets in or removes them from the OS keyring, so
+// they don't have to be kept in plain text in .env on shared admin hosts
+func runCredentials(args []string) error {
+    if len(args) != 2 || (args[0] != "store" && args[0] != "forget") {
+        return fmt.Errorf("usage: credentials store|forget <NAME> (e.g. SSH_PASSWORD, SSH_KEY_PASSPHRASE)")
+    }
+    name := args[1]
+
+    if args[0] == "forget" {
+        if err := secrets.Forget(name); err != nil {
+            return err
+        }
+        fmt.Printf("Removed %s from the OS keyring\n", name)
+        return nil
+    }
+
+    if !secrets.Interactive() {
+        return fmt.Errorf("credentials store must be run from a terminal")
+    }
+    value, err := secrets.Prompt(fmt.Sprintf("Value for %s", name))
+    if err != nil {
+        return err
+    }
+    if value == "" {
+        return fmt.Errorf("no value entered")
+    }
+    if err := secrets.Store(name, value); err != nil {
+        return err
+    }
+    fmt.Printf("Stored %s in the OS keyring\n", name)
+    return nil
+}
+
+// runEncryption handles the archive encryption subcommands
+func runEncryption(args []string) error {
+    usage := fmt.Errorf("usage: encryption keygen [--age] | encryption status")
+    if len(args) == 0 {
+        return usage
+    }
+    switch {
+    case args[0] == "keygen" && len(args) == 1:
+        key, err := encryption.GenerateKey()
+        if err != nil {
+            return err
+        }
+        fmt.Println(key.String())
+        return nil
+    case args[0] == "keygen" && len(args) == 2 && args[1] == "--age":
+        identity, err := encryption.GenerateIdentity()
+        if err != nil {
+            return err
+        }
+        fmt.Printf("# created: %s\n", time.Now().Format(time.RFC3339))
+        fmt.Printf("# public key: %s\n", identity.Recipient())
+        fmt.Println(identity)
+        return nil
+    case args[0] != "status" || len(args) != 1:
+        return usage
+    }
+
+    keys, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+    switch {
+    case keys == nil || keys.Key == nil:
+        fmt.Println("No encryption key configured, new archives are not encrypted")
+        if keys == nil {
+            return nil
+        }
+    case cfg.Encryption.Enabled:
+        fmt.Printf("New archives are encrypted with key %s\n", keys.Key.ID())
+        for _, r := range keys.Recipients {
+            fmt.Printf("New archives are encrypted to recipient %s (%s)\n", r, r.ID())
+        }
+    default:
+        fmt.Printf("Key %s is configured for reading encrypted archives, but encryption of new archives is disabled\n", keys.Key.ID())
+    }
+    for _, key := range keys.Previous {
+        fmt.Printf("Previous key %s is configured for reading older archives\n", key.ID())
+    }
+    for _, identity := range keys.Identities {
+        fmt.Printf("Identity of %s (%s) is configured for reading archives\n", identity.Recipient(), identity.Recipient().ID())
+    }
+    return nil
+}
+
+// runRekey wraps the keys of all encrypted archives for the current key and
+// recipients, so previous keys can be retired without re-encrypting archives
+func runRekey(args []string) error {
+    if len(args) > 0 {
+        return fmt.Errorf("usage: rekey")
+    }
+    keys, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+    if keys == nil || keys.Key == nil {
+        return fmt.Errorf("no encryption key is configured, set ENCRYPTION_KEY_FILE or ENCRYPTION_KEY")
+    }
+    lock, err := backup.LockAllSites(abort, cfg.Local.BackupDir, 0)
+    if err != nil {
+        return err
+    }
+    defer lock.Unlock()
+
+    for _, source := range tool.ReportSources() {
+        manager, err := tool.OpenManager(source.BaseDir)
+        if err != nil {
+            return err
+        }
+        result, err := manager.Rekey()
+        if err != nil {
+            return fmt.Errorf("failed to rekey %s: %v", source.BaseDir, err)
+        }
+        slog.Info("Rekeyed archives", "source", source.Name, "archives", result.Archives,
+            "rekeyed", result.Rekeyed, "chunks", result.Chunks)
+    }
+    return nil
+}
+
+// runTrustHost records the host key of the remote, a named remote or the
+// standby server in its known_hosts file. The fingerprint is shown for confirmation when run on a
+// terminal; --yes records it without asking.
+func runTrustHost(args []string) error {
+    fs := flag.NewFlagSet("trust-host", flag.ExitOnError)
+    yes := fs.Bool("yes", false, "record the host key without asking")
+    fs.Parse(args)
+
+    name, target := "remote", cfg.Remote.SSH
+    switch fs.Arg(0) {
+    case "", "remote":
+    case "standby":
+        name, target = "standby", cfg.Standby.SSH
+    default:
+        if server, ok := cfg.RemoteServer(fs.Arg(0)); ok {
+            name, target = "remote server "+server.Name, server.SSH
+        } else if tunnel, ok := cfg.DBTunnels.For(fs.Arg(0)); ok {
+            name, target = "database tunnel of "+fs.Arg(0), tunnel.SSHTarget
+        } else {
+            return fmt.Errorf("usage: trust-host [--yes] [remote|standby|<server>|<site>]")
+        }
+    }
+    if fs.Arg(0) == "" && len(cfg.Remote.Servers) > 0 {
+        return fmt.Errorf("several remote servers are configured, name one of: %s", strings.Join(cfg.RemoteServerNames(), ", "))
+    }
+    if target.Host == "" {
+        return fmt.Errorf("no %s server configured", name)
+    }
+    port := target.Port
+    if port == "" {
+        port = "22"
+    }
+
+    path, err := backup.KnownHostsPath(target.KnownHosts)
+    if err != nil {
+        return err
+    }
+    key, err := backup.FetchHostKey(target.Host, port)
+    if err != nil {
+        return err
+    }
+    fingerprint := fmt.Sprintf("%s %s", key.Type(), ssh.FingerprintSHA256(key))
+
+    known, err := backup.KnownHostKey(path, target.Host, port, key)
+    if err != nil {
+        return err
+    }
+    if known {
+        fmt.Printf("Host key of %s (%s) is already trusted in %s\n", target.Host, fingerprint, path)
+        return nil
+    }
+
+    fmt.Printf("Host key of %s:%s is %s\n", target.Host, port, fingerprint)
+    if !*yes && secrets.Interactive() && !secrets.Confirm("Trust this host key?") {
+        return fmt.Errorf("host key not trusted")
+    }
+    if err := backup.TrustHostKey(path, target.Host, port, key); err != nil {
+        return err
+    }
+    fmt.Printf("Recorded host key of %s in %s\n", target.Host, path)
+    return nil
+}
+
+// runStandby applies the latest backups to the warm standby server
+func runStandby(args []string) error {
+    fs := flag.NewFlagSet("standby", flag.ExitOnError)
+    source := fs.String("source", cfg.Standby.Source, "backups to apply: remote or local")
+    fs.Parse(args)
+
+    lock, err := backup.LockRun(cfg.Local.BackupDir)
+    if err != nil {
+        return err
+    }
+    defer lock.Unlock()
+    _, endRun := logging.StartRun()
+    defer endRun()
+    ctx, cancel := runContext()
+    defer cancel()
+    return tool.SyncStandby(ctx, *source)
+}
+
+// runPrune applies the retention policies of all sites and removes the
+// leftovers of interrupted backups, stale temporary directories and the
+// chunks of deduplicated archives no archive refers to anymore, in every
+// backup directory. It holds the run lock, so no backup writes meanwhile,
+// not even one of single sites. --dry-run lists what would be removed.
+// --unlock also removes archives within the lock window of immutable
+// backups, given the deletion key in DELETION_KEY or on the terminal.
+func runPrune(args []string) error {
+    fs := flag.NewFlagSet("prune", flag.ExitOnError)
+    dryRun := fs.Bool("dry-run", false, "only list what would be removed")
+    unlock := fs.Bool("unlock", false, "remove locked archives too, asking for the deletion key")
+    asJSON := fs.Bool("json", false, "print the results as JSON")
+    fs.Parse(args)
+    if fs.NArg() > 0 {
+        return fmt.Errorf("usage: prune [--dry-run] [--unlock] [--json]")
+    }
+    if *unlock {
+        // The deletion key is never stored in the keyring, which an
+        // attacker on the server could read
+        key := os.Getenv("DELETION_KEY")
+        if key == "" {
+            if !secrets.Interactive() {
+                return fmt.Errorf("set DELETION_KEY or run prune --unlock on a terminal")
+            }
+            var err error
+            if key, err = secrets.Prompt("Deletion key"); err != nil {
+                return err
+            }
+        }
+        if err := tool.Unlock(key); err != nil {
+            return err
+        }
+    }
+    lock, err := backup.LockAllSites(abort, cfg.Local.BackupDir, 0)
+    if err != nil {
+        return err
+    }
+    defer lock.Unlock()
+
+    reports, err := tool.Prune(*dryRun)
+    if err != nil {
+        return err
+    }
+    message := "Pruned backups"
+    if *dryRun {
+        message = "Prune would remove"
+    }
+    for _, report := range reports {
+        slog.Info(message, "source", report.Source, "archives", len(report.Archives),
+            "locked", len(report.Locked), "leftovers", len(report.Orphans), "chunks", report.Removed, "reclaimed", report.Reclaimed,
+            "kept_chunks", report.Kept, "chunk_size", backup.ByteSize(report.KeptBytes))
+    }
+    if *asJSON {
+        return printJSON(reports)
+    }
+    if *dryRun {
+        for _, report := range reports {
+            fmt.Printf("%s (%s): %s would be reclaimed\n", report.BaseDir, report.Source, report.Reclaimed)
+            for _, path := range append(report.Archives, report.Orphans...) {
+                fmt.Printf("  %s\n", path)
+            }
+            if report.Removed > 0 {
+                fmt.Printf("  %d unreferenced chunks\n", report.Removed)
+            }
+            for _, path := range report.Locked {
+                fmt.Printf("  %s (locked, kept)\n", path)
+            }
+        }
+    }
+    return nil
+}
+
+// runLifecycle moves the archives past the lifecycle's age to cold storage
+// outside a backup run
+func runLifecycle(args []string) error {
+    fs := flag.NewFlagSet("lifecycle", flag.ExitOnError)
+    fs.Parse(args)
+    if fs.NArg() > 0 {
+        return fmt.Errorf("usage: lifecycle")
+    }
+    if !cfg.Lifecycle.Enabled() {
+        return fmt.Errorf("lifecycle rules are not configured, set lifecycle move_after_days and storage")
+    }
+    lock, err := backup.LockAllSites(abort, cfg.Local.BackupDir, 0)
+    if err != nil {
+        return err
+    }
+    defer lock.Unlock()
+    return tool.MoveColdArchives(abort)
+}
+
+// restoreResult is what the restore command put back in place
+type restoreResult struct {
+    Site string `json:"site"`
+    // File archive extracted into Target, with the previous contents moved to Previous
+    Files    string `json:"files,omitempty"`
+    Target   string `json:"target,omitempty"`
+    Previous string `json:"previous,omitempty"`
+    // Extra paths of the site, below their absolute paths
+    Extra string `json:"extra,omitempty"`
+    // Dump imported into the database DBName
+    Database string `json:"database,omitempty"`
+    DBName   string `json:"db_name,omitempty"`
+}
+
+// runRestore puts the files and optionally the database of a backup back in
+// place. A site's document root or database is only overwritten with --force.
+// --preserve-ownership gives the files their recorded owners, as root.
+func runRestore(args []string) error {
+    fs := flag.NewFlagSet("restore", flag.ExitOnError)
+    target := fs.String("target", "", "directory to extract the files into instead of the document root")
+    withDB := fs.Bool("db", false, "also import the database dump into the database from the site's .env or wp-config.php")
+    dbOnly := fs.Bool("db-only", false, "only import the database dump")
+    force := fs.Bool("force", false, "replace existing files and database contents")
+    preserveOwnership := fs.Bool("preserve-ownership", false, "give restored files the owners recorded in the archive, needs root")
+    source := fs.String("source", "local", "backups to restore from: local or remote")
+    server := fs.String("server", "", "remote server the backups were pulled from, if several are configured")
+    asJSON := fs.Bool("json", false, "print what was restored as JSON")
+
+    // Flags may be given before or after the site and timestamp
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) != 2 {
+        return fmt.Errorf("usage: restore <site> <timestamp|latest> [--target DIR] [--db|--db-only] [--force] [--preserve-ownership] [--source local|remote] [--server NAME] [--json]")
+    }
+    if *preserveOwnership && !*dbOnly {
+        if err := backup.CanPreserveOwnership(); err != nil {
+            return fmt.Errorf("--preserve-ownership: %v, run the restore as root", err)
+        }
+    }
+    site, timestamp := positional[0], positional[1]
+    result := restoreResult{Site: site}
+
+    var baseDir string
+    var err error
+    switch *source {
+    case "local":
+        baseDir = cfg.Local.BackupDir
+    case "remote":
+        if baseDir, err = tool.RemoteBackupDir(*server); err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("unknown source %q, use local or remote", *source)
+    }
+
+    documentRoot, envFile := tool.SiteLocation(site)
+    if *target == "" {
+        if *source == "remote" || documentRoot == "" {
+            return fmt.Errorf("%s is not a site of this server, use --target", site)
+        }
+        *target = documentRoot
+    } else {
+        // An alternate target has its own .env, if any
+        envFile = *target
+    }
+
+    key, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+
+    if !*dbOnly {
+        if err := tool.FetchColdArchives(baseDir, site, "file", timestamp); err != nil {
+            return err
+        }
+        archive, err := backup.FindArchive(baseDir, site, "file", timestamp)
+        if err != nil {
+            return err
+        }
+        slog.Info("Restoring files", "archive", archive.Path, "target", *target)
+        previous, extra, err := backup.RestoreFiles(archive.Path, *target, *force, *preserveOwnership, key)
+        if err != nil {
+            return err
+        }
+        if previous != "" {
+            slog.Info("Moved previous contents aside", "target", *target, "moved_to", previous)
+        }
+        if extra != "" {
+            slog.Info("Extracted extra paths, copy them back into place where needed", "path", extra)
+        }
+        result.Files, result.Target, result.Previous, result.Extra = archive.Path, *target, previous, extra
+    }
+
+    if !*withDB && !*dbOnly {
+        slog.Info("Restore completed", "site", site)
+        if *asJSON {
+            return printJSON(result)
+        }
+        return nil
+    }
+    if err := tool.FetchColdArchives(baseDir, site, "database", timestamp); err != nil {
+        return err
+    }
+    dump, err := backup.FindArchive(baseDir, site, "database", timestamp)
+    if err != nil {
+        return err
+    }
+    if !*force {
+        return fmt.Errorf("importing %s replaces the contents of the live database, use --force", dump.Path)
+    }
+    creds, _, err := config.FindCredentials(envFile)
+    if err != nil {
+        return err
+    }
+    if !creds.HasDatabase() {
+        return fmt.Errorf("no database configured for %s", envFile)
+    }
+    slog.Info("Importing database dump", "archive", dump.Path, "db_name", creds.Name, "db_host", creds.Host)
+    if err := backup.RestoreDatabase(dump.Path, creds.Driver, creds.Host, creds.Port, creds.Name, creds.User, creds.Password, key); err != nil {
+        return err
+    }
+    result.Database, result.DBName = dump.Path, creds.Name
+    slog.Info("Restore completed", "site", site)
+    if *asJSON {
+        return printJSON(result)
+    }
+    return nil
+}
+
+// sourceBackupDir returns the backup directory of --source and --server
+func sourceBackupDir(source, server string) (string, error) {
+    switch source {
+    case "local":
+        return cfg.Local.BackupDir, nil
+    case "remote":
+        return tool.RemoteBackupDir(server)
+    }
+    return "", fmt.Errorf("unknown source %q, use local or remote", source)
+}
+
+// runBrowse lists the files of a site as of a file backup, the entries of
+// a directory or with --recursive everything below it
+func runBrowse(args []string) error {
+    fs := flag.NewFlagSet("browse", flag.ExitOnError)
+    recursive := fs.Bool("recursive", false, "list everything below the directory")
+    source := fs.String("source", "local", "backups to browse: local or remote")
+    server := fs.String("server", "", "remote server the backups were pulled from, if several are configured")
+    asJSON := fs.Bool("json", false, "print the entries as JSON")
+
+    // Flags may be given before or after the site, timestamp and path
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) < 2 || len(positional) > 3 {
+        return fmt.Errorf("usage: browse <site> <timestamp|latest> [PATH] [--recursive] [--source local|remote] [--server NAME] [--json]")
+    }
+    site, timestamp := positional[0], positional[1]
+    dir := ""
+    if len(positional) == 3 {
+        var err error
+        if dir, err = backup.CleanArchivePath(positional[2]); err != nil {
+            return err
+        }
+    }
+
+    baseDir, err := sourceBackupDir(*source, *server)
+    if err != nil {
+        return err
+    }
+    key, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+    if err := tool.FetchColdArchives(baseDir, site, "file", timestamp); err != nil {
+        return err
+    }
+    archive, err := backup.FindArchive(baseDir, site, "file", timestamp)
+    if err != nil {
+        return err
+    }
+    tree, err := backup.ArchiveTree(baseDir, archive.Path, key)
+    if err != nil {
+        return err
+    }
+
+    entries := []backup.ListingEntry{}
+    found := dir == ""
+    for _, e := range tree {
+        switch {
+        case e.Path == dir:
+            found = true
+            if e.Type != backup.EntryDir {
+                entries = append(entries, e)
+            }
+        case dir != "" && !strings.HasPrefix(e.Path, dir+"/"):
+        case *recursive || !strings.Contains(strings.TrimPrefix(e.Path[len(dir):], "/"), "/"):
+            entries = append(entries, e)
+        }
+    }
+    if !found {
+        return fmt.Errorf("%s is not in %s", dir, filepath.Base(archive.Path))
+    }
+    if *asJSON {
+        return printJSON(entries)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "MODE\tSIZE\tMODIFIED\tPATH")
+    for _, e := range entries {
+        size, name := backup.ByteSize(e.Size).String(), e.Path
+        switch e.Type {
+        case backup.EntryDir:
+            size, name = "-", name+"/"
+        case backup.EntrySymlink:
+            size, name = "-", name+" -> "+e.Link
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Mode, size, e.ModTime.Local().Format("2006-01-02 15:04"), name)
+    }
+    return w.Flush()
+}
+
+// runRestoreFile puts a single file or directory of a file backup back in
+// place, or below --target. An existing one is only replaced with --force.
+func runRestoreFile(args []string) error {
+    fs := flag.NewFlagSet("restore-file", flag.ExitOnError)
+    target := fs.String("target", "", "directory to restore below instead of the document root, keeping the path")
+    force := fs.Bool("force", false, "replace an existing file or directory")
+    source := fs.String("source", "local", "backups to restore from: local or remote")
+    server := fs.String("server", "", "remote server the backups were pulled from, if several are configured")
+    asJSON := fs.Bool("json", false, "print what was restored as JSON")
+
+    // Flags may be given before or after the site, timestamp and path
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) != 3 {
+        return fmt.Errorf("usage: restore-file <site> <timestamp|latest> <path> [--target DIR] [--force] [--source local|remote] [--server NAME] [--json]")
+    }
+    site, timestamp := positional[0], positional[1]
+    rel, err := backup.CleanArchivePath(positional[2])
+    if err != nil {
+        return err
+    }
+    if rel == "" {
+        return fmt.Errorf("restore-file needs a path below the document root, use restore for the whole site")
+    }
+
+    baseDir, err := sourceBackupDir(*source, *server)
+    if err != nil {
+        return err
+    }
+    if *target == "" {
+        // Extra paths belong outside the document root
+        if rel == backup.ExtraPathsDir || strings.HasPrefix(rel, backup.ExtraPathsDir+"/") {
+            return fmt.Errorf("%s is an extra path, use --target and copy it into place", rel)
+        }
+        documentRoot, _ := tool.SiteLocation(site)
+        if *source == "remote" || documentRoot == "" {
+            return fmt.Errorf("%s is not a site of this server, use --target", site)
+        }
+        *target = documentRoot
+    }
+
+    key, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+    if err := tool.FetchColdArchives(baseDir, site, "file", timestamp); err != nil {
+        return err
+    }
+    archive, err := backup.FindArchive(baseDir, site, "file", timestamp)
+    if err != nil {
+        return err
+    }
+    slog.Info("Restoring path", "archive", archive.Path, "path", rel, "target", *target)
+    restored, err := backup.RestorePath(baseDir, archive.Path, rel, *target, *force, key)
+    if err != nil {
+        return err
+    }
+    if restored.Previous != "" {
+        slog.Info("Moved previous version aside", "path", restored.Target, "moved_to", restored.Previous)
+    }
+    slog.Info("Restore completed", "site", site, "path", restored.Target, "entries", restored.Entries)
+    if *asJSON {
+        return printJSON(restored)
+    }
+    return nil
+}
+
+// intoDatabaseName matches names accepted for restoring into another database
+var intoDatabaseName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// parsePointInTime parses the time of restore-db --until: now, a local date
+// and time like 2025-02-10 14:30[:05], a backup timestamp or RFC 3339
+func parsePointInTime(value string) (time.Time, error) {
+    if value == "now" {
+        return time.Now(), nil
+    }
+    for _, layout := range []string{time.DateTime, "2006-01-02 15:04", backup.TimestampFormat} {
+        if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+            return t, nil
+        }
+    }
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    return time.Time{}, fmt.Errorf("invalid time %q, use e.g. \"2025-02-10 14:30\" or now", value)
+}
+
+// runRestoreDB imports a database dump into the site's database. The live
+// database is dumped first, so the restore can be undone, and is only
+// replaced with --yes. --into restores into a new database instead, leaving
+// the live one untouched. --until restores the database as it was at a
+// point in time, from a full dump and the binary logs archived after it.
+func runRestoreDB(args []string) error {
+    fs := flag.NewFlagSet("restore-db", flag.ExitOnError)
+    yes := fs.Bool("yes", false, "replace the contents of the database")
+    into := fs.String("into", "", "create this database, for SQLite this file, and restore into it instead, e.g. to inspect the dump")
+    envFile := fs.String("env", "", ".env or wp-config.php with the database credentials, for sites not served here")
+    source := fs.String("source", "local", "backups to restore from: local or remote")
+    server := fs.String("server", "", "remote server the backups were pulled from, if several are configured")
+    untilFlag := fs.String("until", "", `point in time to restore to from binary logs, e.g. "2025-02-10 14:30" or now`)
+
+    // Flags may be given before or after the site and timestamp
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) != 2 && (*untilFlag == "" || len(positional) != 1) {
+        return fmt.Errorf("usage: restore-db <site> <timestamp|latest>|--until TIME --yes [--into DATABASE] [--env FILE] [--source local|remote] [--server NAME]")
+    }
+    site := positional[0]
+    var until time.Time
+    if *untilFlag != "" {
+        if len(positional) != 1 {
+            return fmt.Errorf("--until replaces the timestamp")
+        }
+        t, err := parsePointInTime(*untilFlag)
+        if err != nil {
+            return err
+        }
+        until = t
+    }
+
+    var baseDir string
+    var err error
+    switch *source {
+    case "local":
+        baseDir = cfg.Local.BackupDir
+    case "remote":
+        if baseDir, err = tool.RemoteBackupDir(*server); err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("unknown source %q, use local or remote", *source)
+    }
+
+    if *envFile == "" {
+        if _, *envFile = tool.SiteLocation(site); *envFile == "" {
+            return fmt.Errorf("%s is not a site of this server, use --env", site)
+        }
+    }
+    creds, _, err := config.FindCredentials(*envFile)
+    if err != nil {
+        return err
+    }
+    if !creds.HasDatabase() {
+        return fmt.Errorf("no database configured for %s", *envFile)
+    }
+    if *into != "" && creds.Driver == backup.DriverSQLite {
+        // SQLite databases are restored into another file, by default next
+        // to the live one
+        if !filepath.IsAbs(*into) {
+            *into = filepath.Join(filepath.Dir(creds.Name), *into)
+        }
+        if *into == creds.Name {
+            return fmt.Errorf("--into must name another file than %s", creds.Name)
+        }
+    } else if *into != "" && (!intoDatabaseName.MatchString(*into) || *into == creds.Name) {
+        return fmt.Errorf("--into must name another database than %s, with letters, digits and underscores", creds.Name)
+    }
+
+    key, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+
+    var dump backup.Archive
+    var chain backup.BinlogChain
+    if until.IsZero() {
+        if err := tool.FetchColdArchives(baseDir, site, "database", positional[1]); err != nil {
+            return err
+        }
+        if dump, err = backup.FindArchive(baseDir, site, "database", positional[1]); err != nil {
+            return err
+        }
+    } else {
+        if creds.Driver != "" && creds.Driver != backup.DriverMySQL && creds.Driver != backup.DriverMariaDB {
+            return fmt.Errorf("--until needs binary logs, which only MySQL and MariaDB databases have")
+        }
+        if chain, err = backup.FindBinlogChain(baseDir, site, until, key); err != nil {
+            return err
+        }
+        dump = chain.Dump
+        if chain.Until.Before(until) && *untilFlag != "now" {
+            slog.Warn("Backups end before the requested time, restoring up to their end", "site", site,
+                "until", until.Format(time.DateTime), "backups_until", chain.Until.Format(time.DateTime))
+        }
+    }
+    if _, err := backup.VerifyChecksum(dump.Path); err != nil {
+        return fmt.Errorf("refusing to restore %s: %v", dump.Path, err)
+    }
+    target := creds.Name
+    if *into != "" {
+        target = *into
+    }
+    if !*yes {
+        where := " on " + creds.Host
+        if creds.Driver == backup.DriverSQLite {
+            where = ""
+        }
+        if *into != "" {
+            return fmt.Errorf("restoring %s creates database %s%s, use --yes", dump.Path, target, where)
+        }
+        return fmt.Errorf("restoring %s replaces the contents of database %s%s, use --yes", dump.Path, target, where)
+    }
+
+    if *into != "" {
+        slog.Info("Creating database", "db_name", target, "db_host", creds.Host)
+        if err := backup.CreateDatabase(creds.Driver, creds.Host, creds.Port, target, creds.User, creds.Password); err != nil {
+            return err
+        }
+    } else {
+        // Dump the live database first, so the restore can be undone
+        manager, err := tool.OpenManager(cfg.Local.BackupDir)
+        if err != nil {
+            return fmt.Errorf("error initializing backup manager: %v", err)
+        }
+        ctx, cancel := runContext()
+        defer cancel()
+        slog.Info("Creating safety dump of the live database", "site", site, "db_name", creds.Name)
+        safety, err := backup.NewDBBackup(manager).BackupDatabase(ctx, site, creds.Driver, creds.Host, creds.Port, creds.Name, creds.User, creds.Password)
+        if err != nil {
+            return fmt.Errorf("not restoring, the safety dump failed: %v", err)
+        }
+        slog.Info("Created safety dump, restore it to undo the restore", "path", safety)
+    }
+
+    slog.Info("Importing database dump", "archive", dump.Path, "db_name", target, "db_host", creds.Host)
+    if err := backup.RestoreDatabase(dump.Path, creds.Driver, creds.Host, creds.Port, target, creds.User, creds.Password, key); err != nil {
+        return err
+    }
+    if len(chain.Binlogs) > 0 {
+        slog.Info("Replaying binary logs", "archives", len(chain.Binlogs), "until", until.Format(time.DateTime), "db_name", target)
+        if err := backup.ReplayBinlogs(chain, until, cfg.Binlogs.MySQLBinlog, creds.Host, creds.Port, target, creds.User, creds.Password, key); err != nil {
+            return err
+        }
+    }
+    slog.Info("Database restore completed", "site", site, "db_name", target)
+    return nil
+}
+
+// runPreparePhysical extracts a physical database backup with the backups it
+// builds on and prepares it with mariabackup or xtrabackup, for copying back
+// or importing its tablespaces
+func runPreparePhysical(args []string) error {
+    fs := flag.NewFlagSet("prepare-physical", flag.ExitOnError)
+    target := fs.String("target", "", "empty directory to prepare the backup in")
+    source := fs.String("source", "local", "backups to prepare from: local or remote")
+    server := fs.String("server", "", "remote server the backups were pulled from, if several are configured")
+
+    // Flags may be given before or after the site and timestamp
+    var positional []string
+    for {
+        fs.Parse(args)
+        args = fs.Args()
+        if len(args) == 0 {
+            break
+        }
+        positional = append(positional, args[0])
+        args = args[1:]
+    }
+    if len(positional) != 2 || *target == "" {
+        return fmt.Errorf("usage: prepare-physical <site> <timestamp|latest> --target DIR [--source local|remote] [--server NAME]")
+    }
+    site := positional[0]
+
+    var baseDir string
+    var err error
+    switch *source {
+    case "local":
+        baseDir = cfg.Local.BackupDir
+    case "remote":
+        if baseDir, err = tool.RemoteBackupDir(*server); err != nil {
+            return err
+        }
+    default:
+        return fmt.Errorf("unknown source %q, use local or remote", *source)
+    }
+    if err := tool.FetchColdArchives(baseDir, site, backup.PhysicalArchiveType, positional[1]); err != nil {
+        return err
+    }
+    archive, err := backup.FindArchive(baseDir, site, backup.PhysicalArchiveType, positional[1])
+    if err != nil {
+        return err
+    }
+    binary, err := backup.PhysicalBinary(cfg.Physical.Binary)
+    if err != nil {
+        return err
+    }
+    key, err := tool.Keyring()
+    if err != nil {
+        return err
+    }
+    if err := backup.PreparePhysical(archive.Path, *target, binary, key); err != nil {
+        return err
+    }
+    slog.Info("Physical backup prepared", "site", site, "archive", archive.Path, "dir", *target)
+    fmt.Printf("Prepared %s in %s.\n", filepath.Base(archive.Path), *target)
+    fmt.Printf("Import its tables with ALTER TABLE ... DISCARD TABLESPACE, copying the .ibd and .cfg files\n")
+    fmt.Printf("and ALTER TABLE ... IMPORT TABLESPACE, or copy it into an empty data directory with\n")
+    fmt.Printf("%s --copy-back --target-dir=%s while the server is stopped.\n", binary, *target)
+    return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+    "fmt"
+)
+
+// Defaults of size anomaly detection
+const (
+    DefaultAnomalyShrinkPercent = 80
+    DefaultAnomalyGrowthFactor  = 10
+    DefaultAnomalyHistory       = 5
+    DefaultAnomalyMinSize       = "1M"
+)
+
+// SizeAnomalyConfig flags new archives whose size differs sharply from the
+// previous archives of the same site and type: a dump that shrank by most
+// of its size is likely broken, and a file archive that grew tenfold likely
+// holds logs or caches that should be excluded. Anomalies are listed in the
+// run report and emailed as a warning if an SMTP host is set.
+type SizeAnomalyConfig struct {
+    Enabled bool `yaml:"enabled"`
+    // Shrinking by at least this percentage of the usual size is an anomaly
+    ShrinkPercent int `yaml:"shrink_percent"`
+    // Growing to at least this many times the usual size is an anomaly
+    GrowthFactor int `yaml:"growth_factor"`
+    // Number of previous archives whose median is the usual size
+    History int `yaml:"history"`
+    // Archives smaller than this, and smaller than usual, are not compared
+    MinSize string `yaml:"min_size"`
+}
+
+// validate checks the thresholds
+func (a SizeAnomalyConfig) validate() error {
+    if a.ShrinkPercent < 1 || a.ShrinkPercent > 99 {
+        return fmt.Errorf("size_anomalies shrink_percent must be between 1 and 99")
+    }
+    if a.GrowthFactor < 2 {
+        return fmt.Errorf("size_anomalies growth_factor must be at least 2")
+    }
+    if a.History < 1 {
+        return fmt.Errorf("size_anomalies history must be at least 1")
+    }
+    if a.MinSize != "" && !sizePattern.MatchString(a.MinSize) {
+        return fmt.Errorf("size_anomalies min_size must be a size such as 1M, got %q", a.MinSize)
+    }
+    return nil
+}
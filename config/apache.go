@@ -3,30 +3,59 @@ package config
 import (
     "bufio"
     "os"
+    "path/filepath"
     "strings"
     "regexp"
 )
 
+// Vhost holds the parts of an Apache virtual host relevant for backups
+type Vhost struct {
+    ServerName   string
+    DocumentRoot string
+    // Directories mapped into the site by Alias directives, by URL path
+    Aliases map[string]string
+}
+
+var (
+    serverNameRegex   = regexp.MustCompile(`(?i)^\s*ServerName\s+(.+)`)
+    documentRootRegex = regexp.MustCompile(`(?i)^\s*DocumentRoot\s+(.+)`)
+    aliasRegex        = regexp.MustCompile(`(?i)^\s*Alias\s+(\S+)(?:\s+(\S+))?`)
+    locationRegex     = regexp.MustCompile(`(?i)^\s*<Location\s+"?([^">]+)"?\s*>`)
+    locationEndRegex  = regexp.MustCompile(`(?i)^\s*</Location>`)
+)
+
 // ParseApacheConfig reads the Apache configuration file and extracts ServerName and DocumentRoot
 func ParseApacheConfig(configPath string) (map[string]string, error) {
+    vhosts, err := ParseApacheVhosts(configPath)
+    if err != nil {
+        return nil, err
+    }
+
+    sites := make(map[string]string)
+    for _, vhost := range vhosts {
+        sites[vhost.ServerName] = vhost.DocumentRoot
+    }
+    return sites, nil
+}
+
+// ParseApacheVhosts reads the Apache configuration file and extracts every
+// ServerName with its DocumentRoot and the directories aliased into it
+func ParseApacheVhosts(configPath string) ([]Vhost, error) {
     file, err := os.Open(configPath)
     if err != nil {
         return nil, err
     }
     defer file.Close()
 
-    sites := make(map[string]string)
+    byName := make(map[string]*Vhost)
+    var names []string
     scanner := bufio.NewScanner(file)
-    
-    var currentServerName string
-    
-    // Compile regular expressions
-    serverNameRegex := regexp.MustCompile(`(?i)^\s*ServerName\s+(.+)`)
-    documentRootRegex := regexp.MustCompile(`(?i)^\s*DocumentRoot\s+(.+)`)
+
+    var currentServerName, currentLocation string
 
     for scanner.Scan() {
         line := strings.TrimSpace(scanner.Text())
-        
+
         // Skip comments and empty lines
         if strings.HasPrefix(line, "#") || line == "" {
             continue
@@ -38,14 +67,30 @@ func ParseApacheConfig(configPath string) (map[string]string, error) {
             continue
         }
 
-        // Check for DocumentRoot if we have a ServerName
-        if currentServerName != "" {
-            if matches := documentRootRegex.FindStringSubmatch(line); len(matches) > 1 {
-                documentRoot := strings.TrimSpace(matches[1])
-                // Remove quotes if present
-                documentRoot = strings.Trim(documentRoot, `"'`)
-                sites[currentServerName] = documentRoot
-            }
+        // Everything below belongs to the last ServerName seen
+        if currentServerName == "" {
+            continue
+        }
+        vhost := byName[currentServerName]
+        if vhost == nil {
+            vhost = &Vhost{ServerName: currentServerName, Aliases: make(map[string]string)}
+            byName[currentServerName] = vhost
+            names = append(names, currentServerName)
+        }
+
+        if matches := documentRootRegex.FindStringSubmatch(line); len(matches) > 1 {
+            // Remove quotes if present
+            vhost.DocumentRoot = strings.Trim(strings.TrimSpace(matches[1]), `"'`)
+            continue
+        }
+
+        if location, ok := ParseLocation(line); ok {
+            currentLocation = location
+            continue
+        }
+
+        if urlPath, dir, ok := ParseAlias(line, currentLocation); ok {
+            vhost.Aliases[urlPath] = dir
         }
     }
 
@@ -53,5 +98,65 @@ func ParseApacheConfig(configPath string) (map[string]string, error) {
         return nil, err
     }
 
-    return sites, nil
+    // ServerNames without a DocumentRoot are not sites
+    var vhosts []Vhost
+    for _, name := range names {
+        if byName[name].DocumentRoot != "" {
+            vhosts = append(vhosts, *byName[name])
+        }
+    }
+    return vhosts, nil
+}
+
+// ParseLocation recognizes the start and end of a <Location> block. It
+// returns the URL path of a starting block and an empty path for its end.
+func ParseLocation(line string) (string, bool) {
+    if matches := locationRegex.FindStringSubmatch(line); len(matches) > 1 {
+        return strings.TrimSpace(matches[1]), true
+    }
+    if locationEndRegex.MatchString(line) {
+        return "", true
+    }
+    return "", false
+}
+
+// ParseAlias recognizes "Alias /url /path" and, inside a <Location /url>
+// block, the one-argument form "Alias /path". It returns the URL path and
+// the aliased directory.
+func ParseAlias(line, location string) (string, string, bool) {
+    matches := aliasRegex.FindStringSubmatch(line)
+    if len(matches) < 2 {
+        return "", "", false
+    }
+    first, second := strings.Trim(matches[1], `"'`), strings.Trim(matches[2], `"'`)
+    if second != "" {
+        return first, second, true
+    }
+    if location != "" {
+        return location, first, true
+    }
+    return "", "", false
+}
+
+// AppName turns the URL path of an application into a name usable as a
+// directory, e.g. "/admin/panel" becomes "admin-panel"
+func AppName(urlPath string) string {
+    name := strings.Trim(urlPath, "/")
+    name = strings.ReplaceAll(name, "/", "-")
+    if name == "" {
+        return "root"
+    }
+    return name
+}
+
+// FindLaravelApp returns the root of the Laravel application served from dir:
+// dir itself or, for a public directory, its parent. Only directories that
+// contain an artisan file count, so aliased asset directories are ignored.
+func FindLaravelApp(dir string) (string, bool) {
+    for _, candidate := range []string{dir, filepath.Dir(filepath.Clean(dir))} {
+        if _, err := os.Stat(filepath.Join(candidate, "artisan")); err == nil {
+            return candidate, true
+        }
+    }
+    return "", false
 }
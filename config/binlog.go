@@ -0,0 +1,51 @@
+package config
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Defaults of binlog backups
+const (
+    DefaultBinlogFullEvery   = 7 * 24 * time.Hour
+    DefaultMySQLBinlogBinary = "mysqlbinlog"
+)
+
+// BinlogConfig controls incremental MySQL and MariaDB backups of local
+// sites: a full dump every FullEvery and, in the database backups between,
+// only the binary logs written since the previous one. Restores replay the
+// binary logs on top of the dump up to a point in time.
+type BinlogConfig struct {
+    Enabled bool `yaml:"enabled"`
+    // Sites that differ from Enabled
+    Sites map[string]bool `yaml:"sites,omitempty"`
+    // Age of the last full dump from which the next database backup is a
+    // full dump again
+    FullEvery time.Duration `yaml:"full_every"`
+    // mysqlbinlog binary fetching binary logs from the server
+    MySQLBinlog string `yaml:"mysqlbinlog"`
+}
+
+// For reports whether the database of a site is backed up incrementally.
+// An application of a multi-app site (site/apps/name) without a setting of
+// its own follows the site's.
+func (b BinlogConfig) For(site string) bool {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if enabled, ok := b.Sites[name]; ok {
+            return enabled
+        }
+    }
+    return b.Enabled
+}
+
+// validate checks the interval of full dumps and the mysqlbinlog binary
+func (b BinlogConfig) validate() error {
+    if b.FullEvery <= 0 {
+        return fmt.Errorf("binlogs full_every must be positive")
+    }
+    if b.MySQLBinlog == "" {
+        return fmt.Errorf("binlogs mysqlbinlog must not be empty")
+    }
+    return nil
+}
@@ -0,0 +1,1801 @@
+package config
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "gopkg.in/yaml.v3"
+    "laravel-backup-tool/encryption"
+    "laravel-backup-tool/layout"
+    "laravel-backup-tool/retry"
+    "laravel-backup-tool/scheduler"
+)
+
+// ConfigSearchPaths are the locations of backup.yaml tried when BACKUP_CONFIG is not set
+var ConfigSearchPaths = []string{
+    "backup.yaml",
+    "/etc/laravel-backup-tool/backup.yaml",
+}
+
+// Config is the configuration of the backup tool. Every value can be set in
+// backup.yaml and overridden by an environment variable.
+type Config struct {
+    // File the configuration was read from, empty if none was found
+    Path string `yaml:"-"`
+    // Profile the configuration is for, empty for the default configuration
+    Profile string `yaml:"-"`
+    // Named configurations overriding the settings of this file, selected
+    // with --profile
+    Profiles map[string]yaml.Node `yaml:"profiles,omitempty"`
+
+    Local         LocalStorage      `yaml:"local"`
+    // Template of archive paths below the backup directories, see the layout package
+    Layout        string            `yaml:"layout"`
+    Remote        RemoteStorage     `yaml:"remote"`
+    WebServer     WebServerConfig   `yaml:"web_server"`
+    Standby       StandbyConfig     `yaml:"standby"`
+    S3            S3Settings        `yaml:"s3"`
+    GCS           GCSSettings       `yaml:"gcs"`
+    Azure         AzureSettings     `yaml:"azure"`
+    FTP           FTPSettings       `yaml:"ftp"`
+    WebDAV        WebDAVSettings    `yaml:"webdav"`
+    B2            B2Settings        `yaml:"b2"`
+    Rclone        RcloneSettings    `yaml:"rclone"`
+    Incremental   IncrementalConfig `yaml:"incremental"`
+    Dedup         DedupConfig       `yaml:"dedup"`
+    Encryption    EncryptionConfig  `yaml:"encryption"`
+    Metrics       MetricsConfig     `yaml:"metrics"`
+    API           APIConfig         `yaml:"api"`
+    Logging       LoggingConfig     `yaml:"logging"`
+    Timeouts      TimeoutsConfig    `yaml:"timeouts"`
+    Retry         RetryConfig       `yaml:"retry"`
+    Priority      PriorityConfig    `yaml:"priority"`
+    Compression   CompressionConfig `yaml:"compression"`
+    Hooks         HooksConfig       `yaml:"hooks"`
+    Healthchecks  HealthchecksConfig `yaml:"healthchecks"`
+    Freshness     FreshnessConfig   `yaml:"freshness"`
+    MySQLDump     MySQLDumpConfig   `yaml:"mysqldump"`
+    Datastores    DatastoresConfig  `yaml:"datastores"`
+    DBTunnels     DBTunnelConfig    `yaml:"db_tunnels"`
+    FSSnapshots   FSSnapshotConfig  `yaml:"fs_snapshots"`
+    Docker        DockerConfig      `yaml:"docker"`
+    Binlogs       BinlogConfig      `yaml:"binlogs"`
+    Physical      PhysicalBackupConfig `yaml:"physical_backups"`
+    SiteOverrides SiteOverridesConfig `yaml:"site_overrides"`
+    RestoreTests  RestoreTestConfig `yaml:"restore_tests"`
+    Signing       SigningConfig     `yaml:"signing"`
+    Disk          DiskConfig        `yaml:"disk"`
+    SizeLimits    SizeLimitsConfig  `yaml:"size_limits"`
+    Split         SplitConfig       `yaml:"split"`
+    Immutability  ImmutabilityConfig `yaml:"immutability"`
+    Report        ReportConfig      `yaml:"report"`
+    SizeAnomalies SizeAnomalyConfig `yaml:"size_anomalies"`
+    Lifecycle     LifecycleConfig   `yaml:"lifecycle"`
+    Frequency     FrequencyConfig   `yaml:"frequency"`
+    // Patterns of files and directories left out of file archives
+    Excludes      []string          `yaml:"excludes"`
+    // Patterns of files archived even if an exclude matches them
+    Includes      []string          `yaml:"includes"`
+    // Directories symlinks are followed into, e.g. ../storage/app/public
+    FollowSymlinks []string         `yaml:"follow_symlinks"`
+    // Patterns by site, added to the global ones
+    SiteFiles     SiteFilePatterns  `yaml:"site_files"`
+    // Cron expressions by command, "backup" being a full backup run
+    Schedules     map[string]string `yaml:"schedules"`
+    // Cron expressions by local site, backing up single sites on their own schedule
+    SiteSchedules map[string]string `yaml:"site_schedules"`
+    // Notification settings of site owners, set by WithSiteOverrides
+    SiteNotify    map[string]SiteOverride `yaml:"-"`
+}
+
+// Storage describes a backup directory and how many archives it keeps per site
+type Storage struct {
+    BackupDir      string `yaml:"backup_dir"`
+    MaxFileBackups int    `yaml:"max_file_backups"`
+    MaxDBBackups   int    `yaml:"max_db_backups"`
+    // Retention policies replacing the maximum counts where they are set
+    Retention      Retention `yaml:"retention,omitempty"`
+}
+
+// RetentionPolicy is a grandfather-father-son retention policy. The newest
+// archive of each of the latest Daily days, Weekly weeks, Monthly months and
+// Yearly years that have archives is kept.
+type RetentionPolicy struct {
+    Daily   int `yaml:"daily,omitempty"`
+    Weekly  int `yaml:"weekly,omitempty"`
+    Monthly int `yaml:"monthly,omitempty"`
+    Yearly  int `yaml:"yearly,omitempty"`
+}
+
+// Enabled reports whether the policy keeps anything, i.e. whether it is set
+func (p RetentionPolicy) Enabled() bool {
+    return p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+func (p RetentionPolicy) String() string {
+    var parts []string
+    for _, period := range []struct {
+        count int
+        name  string
+    }{{p.Daily, "daily"}, {p.Weekly, "weekly"}, {p.Monthly, "monthly"}, {p.Yearly, "yearly"}} {
+        if period.count > 0 {
+            parts = append(parts, fmt.Sprintf("%d %s", period.count, period.name))
+        }
+    }
+    return strings.Join(parts, ", ")
+}
+
+// Retention holds the retention policies of file and database archives and
+// per-site policies overriding them. Archives without a policy are rotated
+// by the maximum counts.
+type Retention struct {
+    File     RetentionPolicy          `yaml:"file,omitempty"`
+    Database RetentionPolicy          `yaml:"database,omitempty"`
+    Sites    map[string]SiteRetention `yaml:"sites,omitempty"`
+}
+
+// SiteRetention holds the retention policies of one site
+type SiteRetention struct {
+    File     RetentionPolicy `yaml:"file,omitempty"`
+    Database RetentionPolicy `yaml:"database,omitempty"`
+}
+
+// Policy returns the retention policy of a site's archives of a type. An
+// application of a multi-app site (site/apps/name) without a policy of its
+// own uses the site's. Dumps of data stores use the database policy. The
+// policy is not enabled if none is configured.
+func (r Retention) Policy(site, archiveType string) RetentionPolicy {
+    pick := func(file, database RetentionPolicy) RetentionPolicy {
+        if archiveType != "file" {
+            return database
+        }
+        return file
+    }
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if s, ok := r.Sites[name]; ok {
+            if policy := pick(s.File, s.Database); policy.Enabled() {
+                return policy
+            }
+        }
+    }
+    return pick(r.File, r.Database)
+}
+
+// validate rejects negative counts
+func (r Retention) validate() error {
+    policies := map[string]RetentionPolicy{"file": r.File, "database": r.Database}
+    for site, s := range r.Sites {
+        policies[site+" file"] = s.File
+        policies[site+" database"] = s.Database
+    }
+    for name, p := range policies {
+        if p.Daily < 0 || p.Weekly < 0 || p.Monthly < 0 || p.Yearly < 0 {
+            return fmt.Errorf("retention of %s must not be negative", name)
+        }
+    }
+    return nil
+}
+
+// LocalStorage is the backup directory of the local sites
+type LocalStorage struct {
+    Storage `yaml:",inline"`
+    // Number of sites backed up at the same time, unlimited if 0
+    ParallelSites int `yaml:"parallel_sites"`
+}
+
+// RemoteStorage describes the backups pulled from a remote server
+type RemoteStorage struct {
+    Storage `yaml:",inline"`
+    Enabled bool      `yaml:"enabled"`
+    SSH     SSHTarget `yaml:"ssh"`
+    // Servers backed up instead of ssh, each into a subdirectory named after it
+    Servers []RemoteServer `yaml:"servers,omitempty"`
+    // Number of servers backed up at the same time
+    ParallelServers int `yaml:"parallel_servers"`
+    // Number of sites of the ssh server backed up at the same time, as many
+    // as the server allows SSH sessions if 0
+    Workers int `yaml:"workers"`
+    // Stream archives and dumps over the SSH session into the local files
+    // instead of writing them to the server's disk and copying them
+    Streaming bool `yaml:"streaming"`
+    // Back up the files and the database of a site at the same time
+    Pipeline bool `yaml:"pipeline"`
+    // Discover the sites of a server and list their document roots with a
+    // single command each, instead of several commands per site
+    BatchDiscovery bool `yaml:"batch_discovery"`
+    // How site files are copied: tar archives, or rsync into snapshots
+    Transport string `yaml:"transport"`
+    // Upload archives from the servers straight to off-server storage
+    Push PushConfig `yaml:"push"`
+    // Limits protecting the servers from their backups
+    Guardrails GuardrailsConfig `yaml:"guardrails"`
+}
+
+// Transports of the files of remote sites
+const (
+    TransportTar   = "tar"
+    TransportRsync = "rsync"
+)
+
+// RemoteServer is one of several remote servers. Its backups are kept in
+// <remote backup_dir>/<name>.
+type RemoteServer struct {
+    Name string    `yaml:"name"`
+    SSH  SSHTarget `yaml:"ssh"`
+    // Retention overriding the remote storage's, if set
+    MaxFileBackups int `yaml:"max_file_backups,omitempty"`
+    MaxDBBackups   int `yaml:"max_db_backups,omitempty"`
+    // Number of the server's sites backed up at the same time, as many as
+    // the server allows SSH sessions if 0
+    Workers int `yaml:"workers"`
+    // Patterns of the sites backed up, all sites if empty, and of sites left out
+    Sites        []string `yaml:"sites,omitempty"`
+    ExcludeSites []string `yaml:"exclude_sites,omitempty"`
+    // Patterns of files left out of archives, replacing the global excludes
+    Excludes []string `yaml:"excludes,omitempty"`
+}
+
+// UnmarshalYAML fills in the defaults of settings a server doesn't set
+func (s *RemoteServer) UnmarshalYAML(node *yaml.Node) error {
+    type plain RemoteServer
+    server := plain{SSH: SSHTarget{Port: "22", StrictHostKey: true}}
+    if err := node.Decode(&server); err != nil {
+        return err
+    }
+    *s = RemoteServer(server)
+    return nil
+}
+
+// SSHTarget holds the connection settings of a server reached over SSH
+type SSHTarget struct {
+    Host          string `yaml:"host,omitempty"`
+    User          string `yaml:"user,omitempty"`
+    Port          string `yaml:"port,omitempty"`
+    KeyPath       string `yaml:"key_path,omitempty"`
+    Password      string `yaml:"password,omitempty"`
+    // known_hosts file the server's host key is verified against,
+    // ~/.ssh/known_hosts if empty
+    KnownHosts    string `yaml:"known_hosts,omitempty"`
+    // Refuse servers whose host key is not in known_hosts
+    StrictHostKey bool   `yaml:"strict_host_key"`
+    // Privilege escalation of the commands run on the server, for users
+    // that can't read the sites and the web server configuration themselves
+    Become Become `yaml:"become,omitempty"`
+}
+
+// Methods of privilege escalation on remote servers
+const (
+    BecomeSudo   = "sudo"
+    BecomeDoas   = "doas"
+    BecomeHelper = "helper"
+)
+
+// Become describes how commands on a remote server gain privileges: with
+// sudo, doas or a setuid helper program that runs its arguments as a
+// command. Commands run as the SSH user if Method is empty.
+type Become struct {
+    Method string `yaml:"method,omitempty"`
+    // User commands run as with sudo and doas, root if empty
+    User string `yaml:"user,omitempty"`
+    // Path of the helper program on the server
+    Helper string `yaml:"helper,omitempty"`
+    // sudo password, handed to sudo by an askpass program; doas and the
+    // helper must not ask for one
+    Password string `yaml:"password,omitempty"`
+}
+
+// validate checks the method and the settings it needs
+func (b Become) validate() error {
+    switch b.Method {
+    case "":
+        return nil
+    case BecomeSudo:
+    case BecomeDoas, BecomeHelper:
+        if b.Password != "" {
+            return fmt.Errorf("become password only works with sudo, %s must not ask for one", b.Method)
+        }
+    default:
+        return fmt.Errorf("unknown become method %q, use sudo, doas or helper", b.Method)
+    }
+    if b.Method == BecomeHelper && b.Helper == "" {
+        return fmt.Errorf("become method helper needs the path of the helper")
+    }
+    if b.Method != BecomeHelper && b.Helper != "" {
+        return fmt.Errorf("become helper is only used with method helper")
+    }
+    return nil
+}
+
+// WebServerConfig tells where the local sites are configured
+type WebServerConfig struct {
+    // apache, nginx, litespeed or iis, detected from the existing
+    // configuration if empty, or plesk or cpanel to ask the control panel
+    // for the sites
+    Type               string `yaml:"type"`
+    ApacheConfig       string `yaml:"apache_config"`
+    NginxConfigDir     string `yaml:"nginx_config_dir"`
+    // OpenLiteSpeed's conf directory with httpd_config.conf
+    LiteSpeedConfigDir string `yaml:"litespeed_config_dir"`
+    PleskBin           string `yaml:"plesk_bin"`
+    CPanelUserdata     string `yaml:"cpanel_userdata"`
+    // IIS's appcmd.exe, which lists its sites
+    IISAppCmd          string `yaml:"iis_appcmd"`
+}
+
+// StandbyConfig describes the warm standby server
+type StandbyConfig struct {
+    Enabled bool      `yaml:"enabled"`
+    Source  string    `yaml:"source"`
+    // Remote server whose backups are applied when several are configured
+    Server  string    `yaml:"server,omitempty"`
+    SSH     SSHTarget `yaml:"ssh"`
+}
+
+// S3Settings describes the S3-compatible bucket archives are uploaded to.
+// Uploads are enabled when a bucket is set.
+type S3Settings struct {
+    Endpoint        string `yaml:"endpoint,omitempty"`
+    Bucket          string `yaml:"bucket,omitempty"`
+    Region          string `yaml:"region,omitempty"`
+    AccessKeyID     string `yaml:"access_key_id,omitempty"`
+    SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+    PathStyle       bool   `yaml:"path_style"`
+    Prefix          string `yaml:"prefix,omitempty"`
+    PartSizeMB      int    `yaml:"part_size_mb"`
+}
+
+// GCSSettings describes the Google Cloud Storage bucket archives are
+// uploaded to. Uploads are enabled when a bucket is set. Without a
+// credentials file the service account of the instance is used.
+type GCSSettings struct {
+    Bucket          string `yaml:"bucket,omitempty"`
+    Prefix          string `yaml:"prefix,omitempty"`
+    CredentialsFile string `yaml:"credentials_file,omitempty"`
+    ChunkSizeMB     int    `yaml:"chunk_size_mb"`
+    Endpoint        string `yaml:"endpoint,omitempty"`
+}
+
+// AzureSettings describes the Azure Blob Storage container archives are
+// uploaded to. Uploads are enabled when an account and container are set.
+// Without a client secret the managed identity of the machine is used.
+type AzureSettings struct {
+    Account      string `yaml:"account,omitempty"`
+    Container    string `yaml:"container,omitempty"`
+    Prefix       string `yaml:"prefix,omitempty"`
+    TenantID     string `yaml:"tenant_id,omitempty"`
+    ClientID     string `yaml:"client_id,omitempty"`
+    ClientSecret string `yaml:"client_secret,omitempty"`
+    BlockSizeMB  int    `yaml:"block_size_mb"`
+    Endpoint     string `yaml:"endpoint,omitempty"`
+}
+
+// FTP connection security: AUTH TLS on a plain connection, TLS from the
+// start (usually port 990), or none
+const (
+    FTPExplicitTLS = "explicit"
+    FTPImplicitTLS = "implicit"
+    FTPNone        = "none"
+)
+
+// FTPSettings describes the FTP server archives are uploaded to, e.g. a
+// Hetzner Storage Box. Uploads are enabled when a host is set. The password
+// is better kept in the keyring as FTP_PASSWORD.
+type FTPSettings struct {
+    Host     string `yaml:"host,omitempty"`
+    Port     string `yaml:"port,omitempty"`
+    Username string `yaml:"username,omitempty"`
+    Password string `yaml:"password,omitempty"`
+    TLS      string `yaml:"tls"`
+    Dir      string `yaml:"dir,omitempty"`
+}
+
+// WebDAVSettings describes the WebDAV collection archives are uploaded to.
+// Uploads are enabled when a URL is set. The password is better kept in the
+// keyring as WEBDAV_PASSWORD.
+type WebDAVSettings struct {
+    URL      string `yaml:"url,omitempty"`
+    Username string `yaml:"username,omitempty"`
+    Password string `yaml:"password,omitempty"`
+}
+
+// B2Settings describes the Backblaze B2 bucket archives are uploaded to with
+// B2's native API. Uploads are enabled when a bucket is set. The application
+// key is better kept in the keyring as B2_APPLICATION_KEY.
+type B2Settings struct {
+    Bucket         string `yaml:"bucket,omitempty"`
+    Prefix         string `yaml:"prefix,omitempty"`
+    KeyID          string `yaml:"key_id,omitempty"`
+    ApplicationKey string `yaml:"application_key,omitempty"`
+    PartSizeMB     int    `yaml:"part_size_mb"`
+}
+
+// RcloneSettings describes the rclone remote archives are uploaded to by
+// running rclone, for storages the tool has no backend of its own for.
+// Uploads are enabled when a remote is set.
+type RcloneSettings struct {
+    // Remote and path, e.g. "gdrive:backups/web01"
+    Remote     string   `yaml:"remote,omitempty"`
+    Binary     string   `yaml:"binary,omitempty"`
+    ConfigFile string   `yaml:"config_file,omitempty"`
+    Flags      []string `yaml:"flags,omitempty"`
+}
+
+// IncrementalConfig controls incremental file backups. When enabled, a file
+// backup only archives what changed since the previous one, and every
+// FullEvery-th backup is a full one again.
+type IncrementalConfig struct {
+    Enabled   bool `yaml:"enabled"`
+    FullEvery int  `yaml:"full_every"`
+}
+
+// DedupConfig controls deduplicated file archives. When enabled, the tar
+// stream of a file backup is split into content-defined chunks, and every
+// chunk is stored once in the chunk store of the backup directory.
+type DedupConfig struct {
+    Enabled bool `yaml:"enabled"`
+}
+
+// DiskConfig controls the free space checks before archives are created.
+// MinFree is the space left free on the backup volume and on remote servers
+// besides the estimated size of the archive, e.g. "5G". Quota is the space
+// the archives of a site may take in a backup directory, e.g. "50G"; the
+// budget file may set it per site.
+type DiskConfig struct {
+    MinFree string `yaml:"min_free,omitempty"`
+    Quota   string `yaml:"quota,omitempty"`
+}
+
+// sizePattern matches sizes such as 512M, 5G or 1.5TiB
+var sizePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?\s*([KMGTkmgt][Ii]?)?[Bb]?$`)
+
+// validate checks that MinFree and Quota are sizes
+func (d DiskConfig) validate() error {
+    if d.MinFree != "" && !sizePattern.MatchString(d.MinFree) {
+        return fmt.Errorf("disk min_free must be a size such as 5G, got %q", d.MinFree)
+    }
+    if d.Quota != "" && !sizePattern.MatchString(d.Quota) {
+        return fmt.Errorf("disk quota must be a size such as 50G, got %q", d.Quota)
+    }
+    return nil
+}
+
+// SizeLimitsConfig limits the size of the files selected for a site's file
+// backup, e.g. "20G". Above MaxSize the file backup is refused unless
+// allowed, above WarnSize it is made with a warning. The budget file may set
+// them per site.
+type SizeLimitsConfig struct {
+    MaxSize  string `yaml:"max_size,omitempty"`
+    WarnSize string `yaml:"warn_size,omitempty"`
+}
+
+// validate checks that the limits are sizes and that WarnSize isn't above MaxSize
+func (s SizeLimitsConfig) validate() error {
+    if s.MaxSize != "" && !sizePattern.MatchString(s.MaxSize) {
+        return fmt.Errorf("size_limits max_size must be a size such as 20G, got %q", s.MaxSize)
+    }
+    if s.WarnSize != "" && !sizePattern.MatchString(s.WarnSize) {
+        return fmt.Errorf("size_limits warn_size must be a size such as 5G, got %q", s.WarnSize)
+    }
+    if s.MaxSize != "" && s.WarnSize != "" && sizeBytes(s.WarnSize) > sizeBytes(s.MaxSize) {
+        return fmt.Errorf("size_limits warn_size %s must not be above max_size %s", s.WarnSize, s.MaxSize)
+    }
+    return nil
+}
+
+// sizeBytes returns the number of bytes of a size matching sizePattern
+func sizeBytes(size string) float64 {
+    s := strings.TrimRight(strings.ToUpper(strings.TrimSpace(size)), "BI")
+    multiplier := 1.0
+    if s != "" {
+        if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+            multiplier = float64(int64(1) << (10 * (i + 1)))
+            s = s[:len(s)-1]
+        }
+    }
+    n, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+    return n * multiplier
+}
+
+// GuardrailsConfig keeps backups from overloading remote servers or filling
+// their disks. A site waits while the server's load average per CPU is above
+// MaxLoad, at most LoadWait, and is skipped if it doesn't drop. Archives are
+// staged on the server only with MinFree, or disk min_free if empty, left
+// free besides them; StreamWhenLow streams those that don't fit instead of
+// skipping them.
+type GuardrailsConfig struct {
+    MinFree       string        `yaml:"min_free,omitempty"`
+    MaxLoad       float64       `yaml:"max_load"`
+    LoadWait      time.Duration `yaml:"load_wait"`
+    StreamWhenLow bool          `yaml:"stream_when_low"`
+}
+
+// validate checks the thresholds
+func (g GuardrailsConfig) validate() error {
+    if g.MinFree != "" && !sizePattern.MatchString(g.MinFree) {
+        return fmt.Errorf("remote guardrails min_free must be a size such as 10G, got %q", g.MinFree)
+    }
+    if g.MaxLoad < 0 {
+        return fmt.Errorf("remote guardrails max_load must not be negative")
+    }
+    if g.LoadWait < 0 {
+        return fmt.Errorf("remote guardrails load_wait must not be negative")
+    }
+    return nil
+}
+
+// SplitConfig controls the splitting of archives into parts for backup
+// volumes and storages that don't take large files, such as FAT-formatted
+// disks. Archives larger than Size, e.g. "3900M", are stored as parts of at
+// most that size; empty means archives are never split.
+type SplitConfig struct {
+    Size string `yaml:"size,omitempty"`
+}
+
+// validate checks that Size is a size
+func (s SplitConfig) validate() error {
+    if s.Size != "" && !sizePattern.MatchString(s.Size) {
+        return fmt.Errorf("split size must be a size such as 3900M, got %q", s.Size)
+    }
+    return nil
+}
+
+// Modes of the object locks of immutable uploads
+const (
+    LockGovernance = "governance"
+    LockCompliance = "compliance"
+)
+
+// ImmutabilityConfig protects archives for Days days after they are made
+// from being deleted or overwritten, e.g. by an attacker holding the
+// credentials of the backups. Uploads to S3 and B2 get object locks in Mode;
+// in governance mode accounts with the bypass permission can still delete
+// them, in compliance mode nobody can. Local archives are made read-only,
+// and rotation and pruning keep them until the lock ends unless the
+// deletion key, whose SHA-256 is DeletionKeySHA256, is given.
+type ImmutabilityConfig struct {
+    Days              int    `yaml:"days"`
+    Mode              string `yaml:"mode"`
+    DeletionKeySHA256 string `yaml:"deletion_key_sha256,omitempty"`
+}
+
+// Enabled reports whether archives are locked
+func (i ImmutabilityConfig) Enabled() bool {
+    return i.Days > 0
+}
+
+// validate checks the lock period, the mode and the key's hash
+func (i ImmutabilityConfig) validate() error {
+    if i.Days < 0 {
+        return fmt.Errorf("immutability days must not be negative")
+    }
+    if i.Mode != LockGovernance && i.Mode != LockCompliance {
+        return fmt.Errorf("immutability mode must be governance or compliance, got %q", i.Mode)
+    }
+    if i.DeletionKeySHA256 != "" && !sha256Pattern.MatchString(i.DeletionKeySHA256) {
+        return fmt.Errorf("immutability deletion_key_sha256 must be a hex encoded SHA-256, as printed by: printf %%s KEY | sha256sum")
+    }
+    return nil
+}
+
+// sha256Pattern matches a hex encoded SHA-256
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// ReportConfig controls the report of every backup run. It is written as
+// JSON to dir, the reports directory of the local backups if empty, and
+// emailed as HTML if an SMTP host is set.
+type ReportConfig struct {
+    Dir  string     `yaml:"dir,omitempty"`
+    SMTP SMTPConfig `yaml:"smtp"`
+}
+
+// SMTP connection security: STARTTLS on a plain connection, TLS from the
+// start (usually port 465), or none for relays on the same machine
+const (
+    SMTPStartTLS = "starttls"
+    SMTPTLS      = "tls"
+    SMTPNone     = "none"
+)
+
+// SMTPConfig describes the mail server reports are sent through and their
+// recipients. The password is better kept in the keyring as SMTP_PASSWORD.
+type SMTPConfig struct {
+    Host     string   `yaml:"host,omitempty"`
+    Port     string   `yaml:"port,omitempty"`
+    Username string   `yaml:"username,omitempty"`
+    Password string   `yaml:"password,omitempty"`
+    Security string   `yaml:"security,omitempty"`
+    From     string   `yaml:"from,omitempty"`
+    To       []string `yaml:"to,omitempty"`
+}
+
+// validate checks that a configured mail server has a sender, recipients
+// and a known security mode
+func (s SMTPConfig) validate() error {
+    if s.Host == "" {
+        return nil
+    }
+    switch s.Security {
+    case SMTPStartTLS, SMTPTLS, SMTPNone:
+    default:
+        return fmt.Errorf("unknown smtp security %q, use starttls, tls or none", s.Security)
+    }
+    if s.From == "" || len(s.To) == 0 {
+        return fmt.Errorf("report smtp needs a from address and at least one recipient")
+    }
+    return nil
+}
+
+// EncryptionConfig controls client-side encryption of new archives. The key
+// is read from key_file, or from ENCRYPTION_KEY or the OS keyring. New
+// archives are also encrypted to the age recipients, so their identities can
+// decrypt them. Previous keys and identity files only decrypt archives.
+type EncryptionConfig struct {
+    Enabled          bool     `yaml:"enabled"`
+    KeyFile          string   `yaml:"key_file,omitempty"`
+    Recipients       []string `yaml:"recipients,omitempty"`
+    PreviousKeyFiles []string `yaml:"previous_key_files,omitempty"`
+    IdentityFiles    []string `yaml:"identity_files,omitempty"`
+}
+
+// HealthchecksConfig holds the URLs of health checks pinged healthchecks.io
+// style: <url>/start when a backup starts, <url> when it succeeded and
+// <url>/fail when it failed, with its duration and failures as the body. Run
+// is pinged by full backup runs, Sites by the backups of single sites and
+// applications (site/apps/name).
+type HealthchecksConfig struct {
+    Run   string            `yaml:"run,omitempty"`
+    Sites map[string]string `yaml:"sites,omitempty"`
+}
+
+// For returns the URL of a site's health check, empty if it has none
+func (h HealthchecksConfig) For(site string) string {
+    return h.Sites[site]
+}
+
+// validate checks that the URLs are http or https URLs
+func (h HealthchecksConfig) validate() error {
+    urls := map[string]string{"run": h.Run}
+    for site, u := range h.Sites {
+        urls["site "+site] = u
+    }
+    for name, u := range urls {
+        if u == "" {
+            continue
+        }
+        parsed, err := url.Parse(u)
+        if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+            return fmt.Errorf("healthchecks %s: invalid URL %q", name, u)
+        }
+    }
+    return nil
+}
+
+// DefaultFreshnessSLA is how old the newest successful backup of a site may
+// get unless configured: a daily backup with two hours to spare
+const DefaultFreshnessSLA = 26 * time.Hour
+
+// FreshnessConfig sets how long ago a site may last have been backed up
+// successfully before status reports it as stale. Sites overrides SLA for
+// single sites.
+type FreshnessConfig struct {
+    SLA   time.Duration            `yaml:"sla"`
+    Sites map[string]time.Duration `yaml:"sites,omitempty"`
+}
+
+// For returns the SLA of a site. An application of a multi-app site
+// (site/apps/name) without an SLA of its own uses the site's.
+func (f FreshnessConfig) For(site string) time.Duration {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if sla, ok := f.Sites[name]; ok {
+            return sla
+        }
+    }
+    return f.SLA
+}
+
+// validate checks that the SLAs are positive
+func (f FreshnessConfig) validate() error {
+    if f.SLA <= 0 {
+        return fmt.Errorf("freshness sla must be positive")
+    }
+    for site, sla := range f.Sites {
+        if sla <= 0 {
+            return fmt.Errorf("freshness sla of %s must be positive", site)
+        }
+    }
+    return nil
+}
+
+// MetricsConfig controls where Prometheus metrics are published. The daemon
+// serves /metrics on listen; textfile is rewritten after every run for the
+// node_exporter textfile collector.
+type MetricsConfig struct {
+    Listen   string `yaml:"listen,omitempty"`
+    Textfile string `yaml:"textfile,omitempty"`
+}
+
+// LoggingConfig controls the log output: its format, text or json, and the
+// lowest level logged, debug, info, warn or error. KeepRuns is how many
+// backup runs keep their log and outcome in the local backup directory,
+// 0 for none.
+type LoggingConfig struct {
+    Format   string `yaml:"format"`
+    Level    string `yaml:"level"`
+    KeepRuns int    `yaml:"keep_runs"`
+}
+
+// APIConfig configures the REST API served by the serve command. Every
+// request must carry the token as a bearer token.
+type APIConfig struct {
+    Listen string `yaml:"listen"`
+    Token  string `yaml:"token,omitempty"`
+}
+
+// TimeoutsConfig limits how long backups may take. A run exceeding Run is
+// cancelled as a whole; the files or database of a site taking longer than
+// its site timeout are cancelled and the site is reported as failed. Zero
+// means no limit.
+type TimeoutsConfig struct {
+    Run   time.Duration            `yaml:"run"`
+    Site  time.Duration            `yaml:"site"`
+    Sites map[string]time.Duration `yaml:"sites,omitempty"`
+}
+
+// SiteTimeout returns the time limit of backing up a site's files or
+// database. An application of a multi-app site (site/apps/name) without a
+// timeout of its own uses the site's.
+func (t TimeoutsConfig) SiteTimeout(site string) time.Duration {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if timeout, ok := t.Sites[name]; ok {
+            return timeout
+        }
+    }
+    return t.Site
+}
+
+// RetryConfig is how database dumps, remote commands and uploads failing
+// with transient errors, such as a database server out of connections or an
+// unreachable SSH server, are attempted again
+type RetryConfig struct {
+    Attempts   int           `yaml:"attempts"`
+    Backoff    time.Duration `yaml:"backoff"`
+    MaxBackoff time.Duration `yaml:"max_backoff"`
+    // Further parts of error messages marking an error as transient
+    Errors     []string      `yaml:"errors,omitempty"`
+    // How long after a failed scheduled backup the daemon resumes it where
+    // it failed, until it succeeds or is due again; 0 disables
+    ResumeAfter time.Duration `yaml:"resume_after"`
+}
+
+// Policy returns the retry policy of the configuration
+func (r RetryConfig) Policy() retry.Policy {
+    return retry.Policy{Attempts: r.Attempts, Backoff: r.Backoff, MaxBackoff: r.MaxBackoff, Messages: r.Errors}
+}
+
+// IO scheduling classes of backups with a lowered priority
+const (
+    IOClassBestEffort = "best-effort"
+    IOClassIdle       = "idle"
+)
+
+// PriorityConfig lowers the CPU and IO priority of backups, so they don't
+// slow down the sites they back up. It applies to the backup process, the
+// dump tools it runs and the archive and dump commands on remote servers.
+type PriorityConfig struct {
+    // Niceness from 1 to 19, 0 keeps the priority
+    Nice int `yaml:"nice"`
+    // IO scheduling class, empty keeps it
+    IOClass string `yaml:"io_class"`
+    // Level within the best-effort class from 0 (highest) to 7
+    IOLevel int `yaml:"io_level"`
+}
+
+// validate checks the values of the priority settings
+func (p PriorityConfig) validate() error {
+    if p.Nice < 0 || p.Nice > 19 {
+        return fmt.Errorf("priority nice must be between 0 and 19")
+    }
+    switch p.IOClass {
+    case "", IOClassBestEffort, IOClassIdle:
+    default:
+        return fmt.Errorf("unknown priority io_class %q, use %s or %s", p.IOClass, IOClassBestEffort, IOClassIdle)
+    }
+    if p.IOLevel < 0 || p.IOLevel > 7 {
+        return fmt.Errorf("priority io_level must be between 0 and 7")
+    }
+    return nil
+}
+
+// Compression formats of archives and dumps
+const (
+    CompressionGzip = "gzip"
+    CompressionZstd = "zstd"
+    CompressionNone = "none"
+)
+
+// Compression sets how new archives and dumps are compressed: the format,
+// gzip, zstd or none, and its level, 0 for the format's default
+type Compression struct {
+    Format string `yaml:"format,omitempty"`
+    Level  int    `yaml:"level,omitempty"`
+}
+
+// validate checks the format and the level's range
+func (c Compression) validate() error {
+    var max int
+    switch c.Format {
+    case CompressionGzip:
+        max = 9
+    case CompressionZstd:
+        max = 22
+    case CompressionNone:
+        max = 0
+    default:
+        return fmt.Errorf("unknown compression format %q, use gzip, zstd or none", c.Format)
+    }
+    if c.Level < 0 || c.Level > max {
+        return fmt.Errorf("%s compression level must be between 0 and %d", c.Format, max)
+    }
+    return nil
+}
+
+// CompressionConfig is the compression of new archives, optionally by site
+type CompressionConfig struct {
+    Compression `yaml:",inline"`
+    Sites map[string]Compression `yaml:"sites,omitempty"`
+}
+
+// For returns the compression of a site. A site without a format of its own
+// uses the global format, an application of a multi-app site (site/apps/name)
+// without settings of its own uses the site's.
+func (c CompressionConfig) For(site string) Compression {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if s, ok := c.Sites[name]; ok {
+            if s.Format == "" {
+                s.Format = c.Format
+            }
+            return s
+        }
+    }
+    return c.Compression
+}
+
+// DefaultConfig returns the configuration used when nothing is configured
+func DefaultConfig() *Config {
+    return &Config{
+        Local: LocalStorage{
+            Storage: Storage{
+                BackupDir:      "/laravel-backup-script",
+                MaxFileBackups: 5,
+                MaxDBBackups:   20,
+            },
+        },
+        Remote: RemoteStorage{
+            Storage: Storage{
+                BackupDir:      "/laravel-backup-script-ssh",
+                MaxFileBackups: 5,
+                MaxDBBackups:   20,
+            },
+            SSH:             SSHTarget{Port: "22", StrictHostKey: true},
+            ParallelServers: 2,
+            BatchDiscovery:  true,
+            Transport:       TransportTar,
+            Push:            PushConfig{Target: PushS3, Rclone: DefaultPushRclone},
+            Guardrails:      GuardrailsConfig{LoadWait: 15 * time.Minute},
+        },
+        WebServer: WebServerConfig{
+            ApacheConfig:       "/etc/apache2/conf/httpd.conf",
+            NginxConfigDir:     "/etc/nginx",
+            LiteSpeedConfigDir: "/usr/local/lsws/conf",
+            PleskBin:           "/usr/sbin/plesk",
+            CPanelUserdata:     "/var/cpanel/userdata",
+            IISAppCmd:          `C:\Windows\System32\inetsrv\appcmd.exe`,
+        },
+        Standby: StandbyConfig{
+            Source: "remote",
+            SSH:    SSHTarget{Port: "22", StrictHostKey: true},
+        },
+        Immutability: ImmutabilityConfig{Mode: LockGovernance},
+        S3: S3Settings{
+            Region:     "us-east-1",
+            PartSizeMB: 64,
+        },
+        GCS: GCSSettings{
+            ChunkSizeMB: 16,
+        },
+        Azure: AzureSettings{
+            BlockSizeMB: 16,
+        },
+        FTP: FTPSettings{
+            TLS: FTPExplicitTLS,
+        },
+        B2: B2Settings{
+            PartSizeMB: 100,
+        },
+        Rclone: RcloneSettings{
+            Binary: "rclone",
+        },
+        Incremental: IncrementalConfig{
+            FullEvery: 7,
+        },
+        API: APIConfig{
+            Listen: "127.0.0.1:8089",
+        },
+        Logging: LoggingConfig{
+            Format:   "text",
+            Level:    "info",
+            KeepRuns: 30,
+        },
+        Compression: CompressionConfig{
+            Compression: Compression{Format: CompressionGzip},
+        },
+        Hooks: HooksConfig{
+            Timeout: DefaultHookTimeout,
+        },
+        Freshness: FreshnessConfig{SLA: DefaultFreshnessSLA},
+        FSSnapshots: FSSnapshotConfig{
+            LVMSize:  DefaultFSSnapshotLVMSize,
+            MountDir: DefaultFSSnapshotMountDir,
+        },
+        Docker: DockerConfig{
+            Command:     DefaultDockerCommand,
+            HelperImage: DefaultDockerHelperImage,
+        },
+        SizeAnomalies: SizeAnomalyConfig{
+            Enabled:       true,
+            ShrinkPercent: DefaultAnomalyShrinkPercent,
+            GrowthFactor:  DefaultAnomalyGrowthFactor,
+            History:       DefaultAnomalyHistory,
+            MinSize:       DefaultAnomalyMinSize,
+        },
+        Binlogs: BinlogConfig{
+            FullEvery:   DefaultBinlogFullEvery,
+            MySQLBinlog: DefaultMySQLBinlogBinary,
+        },
+        Physical: PhysicalBackupConfig{
+            Method:    DBBackupLogical,
+            FullEvery: DefaultPhysicalFullEvery,
+        },
+        SiteOverrides: SiteOverridesConfig{File: DefaultSiteOverridesFile},
+        RestoreTests:  RestoreTestConfig{PHP: DefaultRestoreTestPHP},
+        Priority: PriorityConfig{IOLevel: 7},
+        Retry: RetryConfig{
+            Attempts:   retry.DefaultAttempts,
+            Backoff:    retry.DefaultBackoff,
+            MaxBackoff: retry.DefaultMaxBackoff,
+        },
+        Report: ReportConfig{
+            SMTP: SMTPConfig{Port: "587", Security: SMTPStartTLS},
+        },
+        Excludes: []string{"node_modules"},
+        Layout:   layout.Default,
+    }
+}
+
+// LoadConfig reads the configuration from the file named by BACKUP_CONFIG or
+// the first existing file of ConfigSearchPaths, on top of the defaults, and
+// then applies the environment variables. A missing file is not an error.
+// The profile named by BACKUP_PROFILE is selected, if set.
+func LoadConfig() (*Config, error) {
+    return LoadProfile(os.Getenv(ProfileEnv))
+}
+
+// LoadProfile is LoadConfig for the named profile, or for the default
+// configuration if name is empty
+func LoadProfile(name string) (*Config, error) {
+    cfg := DefaultConfig()
+
+    if path := ConfigFile(); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read configuration file: %v", err)
+        }
+        if err := yaml.Unmarshal(data, cfg); err != nil {
+            return nil, fmt.Errorf("unable to parse configuration file %s: %v", path, err)
+        }
+        cfg.Path = path
+    }
+    var own profileDirs
+    if name != "" {
+        var err error
+        if own, err = cfg.selectProfile(name); err != nil {
+            return nil, err
+        }
+    }
+    cfg.Profiles = nil
+
+    if err := cfg.applyEnv(); err != nil {
+        return nil, err
+    }
+    if name != "" {
+        cfg.isolateProfile(own)
+    }
+    if err := cfg.validate(); err != nil {
+        return nil, fmt.Errorf("invalid configuration: %v", err)
+    }
+    return cfg, nil
+}
+
+// ConfigFile returns the configuration file LoadConfig reads: the file named
+// by BACKUP_CONFIG or the first existing file of ConfigSearchPaths, empty if
+// there is none
+func ConfigFile() string {
+    if path := os.Getenv("BACKUP_CONFIG"); path != "" {
+        return path
+    }
+    for _, candidate := range ConfigSearchPaths {
+        if _, err := os.Stat(candidate); err == nil {
+            return candidate
+        }
+    }
+    return ""
+}
+
+// UnknownSettings returns the keys of a configuration file that are no
+// settings, e.g. misspelled ones, which LoadConfig ignores
+func UnknownSettings(path string) ([]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read configuration file: %v", err)
+    }
+    cfg := DefaultConfig()
+    unknown, err := unknownFields(data, cfg)
+    if err != nil {
+        return nil, fmt.Errorf("unable to parse configuration file %s: %v", path, err)
+    }
+    // The settings of profile sections are only decoded when selected
+    var names []string
+    for name := range cfg.Profiles {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        section := cfg.Profiles[name]
+        sectionData, err := yaml.Marshal(&section)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read profile %s: %v", name, err)
+        }
+        fields, err := unknownFields(sectionData, DefaultConfig())
+        if err != nil {
+            return nil, fmt.Errorf("unable to parse profile %s in %s: %v", name, path, err)
+        }
+        for _, field := range fields {
+            unknown = append(unknown, "profiles."+name+": "+lineRegex.ReplaceAllString(field, ""))
+        }
+    }
+    return unknown, nil
+}
+
+// lineRegex matches the line number yaml puts in front of its errors
+var lineRegex = regexp.MustCompile(`^line \d+: `)
+
+// unknownFields decodes YAML into cfg and returns the errors about keys cfg
+// has no field for
+func unknownFields(data []byte, cfg *Config) ([]string, error) {
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    decoder.KnownFields(true)
+    err := decoder.Decode(cfg)
+    if err == nil || err == io.EOF {
+        return nil, nil
+    }
+    typeErr, ok := err.(*yaml.TypeError)
+    if !ok {
+        return nil, err
+    }
+    return typeErr.Errors, nil
+}
+
+// Validate checks a configuration that was not read by LoadConfig, such as
+// the one init writes
+func (c *Config) Validate() error {
+    return c.validate()
+}
+
+// applyEnv overrides settings with the environment variables that are set
+func (c *Config) applyEnv() error {
+    envString(&c.Local.BackupDir, "BACKUP_DIR")
+    envString(&c.Remote.BackupDir, "REMOTE_BACKUP_DIR")
+    envString(&c.Layout, "BACKUP_LAYOUT")
+    envString(&c.Healthchecks.Run, "HEALTHCHECK_URL")
+    c.Datastores.optIn(DatastoreRedis, os.Getenv("BACKUP_REDIS_SITES"))
+    c.Datastores.optIn(DatastoreMongo, os.Getenv("BACKUP_MONGO_SITES"))
+    envString(&c.WebServer.Type, "WEB_SERVER")
+    envString(&c.WebServer.ApacheConfig, "APACHE_CONFIG")
+    envString(&c.WebServer.NginxConfigDir, "NGINX_CONFIG_DIR")
+    envString(&c.WebServer.LiteSpeedConfigDir, "LITESPEED_CONFIG_DIR")
+    envString(&c.WebServer.PleskBin, "PLESK_BIN")
+    envString(&c.WebServer.CPanelUserdata, "CPANEL_USERDATA_DIR")
+    envString(&c.WebServer.IISAppCmd, "IIS_APPCMD")
+    envString(&c.Standby.Source, "STANDBY_SOURCE")
+    envString(&c.Standby.Server, "STANDBY_SERVER")
+    envTarget(&c.Remote.SSH, "SSH")
+    envTarget(&c.Standby.SSH, "STANDBY")
+    envString(&c.S3.Endpoint, "S3_ENDPOINT")
+    envString(&c.S3.Bucket, "S3_BUCKET")
+    envString(&c.S3.Region, "S3_REGION")
+    envString(&c.S3.AccessKeyID, "S3_ACCESS_KEY_ID")
+    envString(&c.S3.SecretAccessKey, "S3_SECRET_ACCESS_KEY")
+    envString(&c.S3.Prefix, "S3_PREFIX")
+    envString(&c.GCS.Bucket, "GCS_BUCKET")
+    envString(&c.GCS.Prefix, "GCS_PREFIX")
+    envString(&c.GCS.CredentialsFile, "GOOGLE_APPLICATION_CREDENTIALS")
+    envString(&c.GCS.CredentialsFile, "GCS_CREDENTIALS_FILE")
+    envString(&c.GCS.Endpoint, "GCS_ENDPOINT")
+    envString(&c.Azure.Account, "AZURE_STORAGE_ACCOUNT")
+    envString(&c.Azure.Container, "AZURE_CONTAINER")
+    envString(&c.Azure.Prefix, "AZURE_PREFIX")
+    envString(&c.Azure.TenantID, "AZURE_TENANT_ID")
+    envString(&c.Azure.ClientID, "AZURE_CLIENT_ID")
+    envString(&c.Azure.ClientSecret, "AZURE_CLIENT_SECRET")
+    envString(&c.Azure.Endpoint, "AZURE_ENDPOINT")
+    envString(&c.FTP.Host, "FTP_HOST")
+    envString(&c.FTP.Port, "FTP_PORT")
+    envString(&c.FTP.Username, "FTP_USER")
+    envString(&c.FTP.Password, "FTP_PASSWORD")
+    envString(&c.FTP.TLS, "FTP_TLS")
+    envString(&c.FTP.Dir, "FTP_DIR")
+    envString(&c.WebDAV.URL, "WEBDAV_URL")
+    envString(&c.WebDAV.Username, "WEBDAV_USER")
+    envString(&c.WebDAV.Password, "WEBDAV_PASSWORD")
+    envString(&c.B2.Bucket, "B2_BUCKET")
+    envString(&c.B2.Prefix, "B2_PREFIX")
+    envString(&c.B2.KeyID, "B2_KEY_ID")
+    envString(&c.B2.ApplicationKey, "B2_APPLICATION_KEY")
+    envString(&c.FSSnapshots.LVMSize, "FS_SNAPSHOT_LVM_SIZE")
+    envString(&c.FSSnapshots.MountDir, "FS_SNAPSHOT_MOUNT_DIR")
+    envString(&c.Docker.Command, "DOCKER_COMMAND")
+    envString(&c.Docker.HelperImage, "DOCKER_HELPER_IMAGE")
+    envString(&c.Binlogs.MySQLBinlog, "MYSQLBINLOG")
+    envString(&c.Physical.Method, "DB_BACKUP_METHOD")
+    envString(&c.Physical.Binary, "PHYSICAL_BACKUP_BINARY")
+    envString(&c.SiteOverrides.File, "SITE_OVERRIDES_FILE")
+    envString(&c.RestoreTests.PHP, "RESTORE_TEST_PHP")
+    envString(&c.Signing.KeyFile, "SIGNING_KEY_FILE")
+    envString(&c.Signing.PublicKeyFile, "SIGNING_PUBLIC_KEY_FILE")
+    envString(&c.Rclone.Remote, "RCLONE_REMOTE")
+    envString(&c.Rclone.Binary, "RCLONE_BINARY")
+    envString(&c.Rclone.ConfigFile, "RCLONE_CONFIG")
+    envString(&c.Encryption.KeyFile, "ENCRYPTION_KEY_FILE")
+    envString(&c.Metrics.Listen, "METRICS_LISTEN")
+    envString(&c.Metrics.Textfile, "METRICS_TEXTFILE")
+    envString(&c.API.Listen, "API_LISTEN")
+    envString(&c.API.Token, "API_TOKEN")
+    envString(&c.Compression.Format, "COMPRESSION_FORMAT")
+    envString(&c.Hooks.Site.PreBackup, "PRE_BACKUP_HOOK")
+    envString(&c.Hooks.Site.PostBackup, "POST_BACKUP_HOOK")
+    envString(&c.Hooks.Site.OnFailure, "ON_FAILURE_HOOK")
+    envString(&c.MySQLDump.MaxAllowedPacket, "MYSQLDUMP_MAX_ALLOWED_PACKET")
+    envString(&c.Disk.MinFree, "DISK_MIN_FREE")
+    envString(&c.Disk.Quota, "SITE_QUOTA")
+    envString(&c.SizeLimits.MaxSize, "SITE_MAX_SIZE")
+    envString(&c.SizeLimits.WarnSize, "SITE_WARN_SIZE")
+    envString(&c.Split.Size, "SPLIT_SIZE")
+    envString(&c.Immutability.Mode, "IMMUTABLE_MODE")
+    envString(&c.Immutability.DeletionKeySHA256, "DELETION_KEY_SHA256")
+    envString(&c.SizeAnomalies.MinSize, "SIZE_ANOMALY_MIN_SIZE")
+    envString(&c.Lifecycle.Storage, "LIFECYCLE_STORAGE")
+    envString(&c.Lifecycle.StorageClass, "LIFECYCLE_STORAGE_CLASS")
+    envString(&c.Remote.Transport, "REMOTE_TRANSPORT")
+    envString(&c.Remote.Guardrails.MinFree, "REMOTE_MIN_FREE")
+    if err := envFloat(&c.Remote.Guardrails.MaxLoad, "REMOTE_MAX_LOAD"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Remote.Guardrails.LoadWait, "REMOTE_LOAD_WAIT"); err != nil {
+        return err
+    }
+    envString(&c.Remote.Push.Target, "REMOTE_PUSH_TARGET")
+    envString(&c.Remote.Push.Rclone, "REMOTE_PUSH_RCLONE")
+    envString(&c.Remote.Push.SFTP.Host, "PUSH_SFTP_HOST")
+    envString(&c.Remote.Push.SFTP.Port, "PUSH_SFTP_PORT")
+    envString(&c.Remote.Push.SFTP.User, "PUSH_SFTP_USER")
+    envString(&c.Remote.Push.SFTP.Password, "PUSH_SFTP_PASSWORD")
+    envString(&c.Remote.Push.SFTP.KeyFile, "PUSH_SFTP_KEY_FILE")
+    envString(&c.Remote.Push.SFTP.Dir, "PUSH_SFTP_DIR")
+    envString(&c.Priority.IOClass, "BACKUP_IO_CLASS")
+    envString(&c.Report.Dir, "REPORT_DIR")
+    envString(&c.Report.SMTP.Host, "SMTP_HOST")
+    envString(&c.Report.SMTP.Port, "SMTP_PORT")
+    envString(&c.Report.SMTP.Username, "SMTP_USERNAME")
+    envString(&c.Report.SMTP.Password, "SMTP_PASSWORD")
+    envString(&c.Report.SMTP.Security, "SMTP_SECURITY")
+    envString(&c.Report.SMTP.From, "SMTP_FROM")
+    envString(&c.Logging.Format, "LOG_FORMAT")
+    envString(&c.Logging.Level, "LOG_LEVEL")
+    if debug, _ := strconv.ParseBool(os.Getenv("DEBUG")); debug {
+        c.Logging.Level = "debug"
+    }
+    if err := envDuration(&c.Timeouts.Run, "RUN_TIMEOUT"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Timeouts.Site, "SITE_TIMEOUT"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Freshness.SLA, "FRESHNESS_SLA"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Hooks.Timeout, "HOOK_TIMEOUT"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Retry.Backoff, "RETRY_BACKOFF"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Retry.MaxBackoff, "RETRY_MAX_BACKOFF"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Retry.ResumeAfter, "RESUME_AFTER"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Binlogs.FullEvery, "BINLOG_FULL_EVERY"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Physical.FullEvery, "PHYSICAL_FULL_EVERY"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Frequency.File, "FILE_BACKUP_INTERVAL"); err != nil {
+        return err
+    }
+    if err := envDuration(&c.Frequency.Database, "DB_BACKUP_INTERVAL"); err != nil {
+        return err
+    }
+
+    for key, target := range map[string]*[]string{
+        "BACKUP_EXCLUDES":               &c.Excludes,
+        "BACKUP_INCLUDES":               &c.Includes,
+        "FOLLOW_SYMLINKS":               &c.FollowSymlinks,
+        "MYSQLDUMP_EXCLUDE_TABLES":      &c.MySQLDump.ExcludeTables,
+        "SMTP_TO":                       &c.Report.SMTP.To,
+        "ENCRYPTION_RECIPIENTS":         &c.Encryption.Recipients,
+        "ENCRYPTION_PREVIOUS_KEY_FILES": &c.Encryption.PreviousKeyFiles,
+        "ENCRYPTION_IDENTITY_FILES":     &c.Encryption.IdentityFiles,
+        "RETRY_ERRORS":                  &c.Retry.Errors,
+        "BACKUP_BLACKOUTS":              &c.Frequency.Blackouts,
+    } {
+        if val := os.Getenv(key); val != "" {
+            *target = nil
+            for _, pattern := range strings.Split(val, ",") {
+                if pattern = strings.TrimSpace(pattern); pattern != "" {
+                    *target = append(*target, pattern)
+                }
+            }
+        }
+    }
+
+    for key, target := range map[string]*int{
+        "LOCAL_MAX_FILE_BACKUPS":  &c.Local.MaxFileBackups,
+        "LOCAL_MAX_DB_BACKUPS":    &c.Local.MaxDBBackups,
+        "REMOTE_MAX_FILE_BACKUPS": &c.Remote.MaxFileBackups,
+        "REMOTE_MAX_DB_BACKUPS":   &c.Remote.MaxDBBackups,
+        "S3_PART_SIZE_MB":         &c.S3.PartSizeMB,
+        "GCS_CHUNK_SIZE_MB":       &c.GCS.ChunkSizeMB,
+        "AZURE_BLOCK_SIZE_MB":     &c.Azure.BlockSizeMB,
+        "B2_PART_SIZE_MB":         &c.B2.PartSizeMB,
+        "INCREMENTAL_FULL_EVERY":  &c.Incremental.FullEvery,
+        "REMOTE_PARALLEL_SERVERS": &c.Remote.ParallelServers,
+        "REMOTE_WORKERS":          &c.Remote.Workers,
+        "COMPRESSION_LEVEL":       &c.Compression.Level,
+        "RETRY_ATTEMPTS":          &c.Retry.Attempts,
+        "MAX_PARALLEL_SITES":      &c.Local.ParallelSites,
+        "BACKUP_NICE":             &c.Priority.Nice,
+        "BACKUP_IO_LEVEL":         &c.Priority.IOLevel,
+        "SIZE_ANOMALY_SHRINK_PERCENT": &c.SizeAnomalies.ShrinkPercent,
+        "SIZE_ANOMALY_GROWTH_FACTOR":  &c.SizeAnomalies.GrowthFactor,
+        "LIFECYCLE_MOVE_AFTER_DAYS":   &c.Lifecycle.MoveAfterDays,
+        "IMMUTABLE_DAYS":              &c.Immutability.Days,
+        "LOG_KEEP_RUNS":               &c.Logging.KeepRuns,
+    } {
+        if err := envInt(target, key); err != nil {
+            return err
+        }
+    }
+    for key, target := range map[string]*bool{
+        "REMOTE_BACKUP_ENABLED":   &c.Remote.Enabled,
+        "STANDBY_ENABLED":         &c.Standby.Enabled,
+        "S3_PATH_STYLE":           &c.S3.PathStyle,
+        "INCREMENTAL_BACKUPS":     &c.Incremental.Enabled,
+        "DEDUP_ENABLED":           &c.Dedup.Enabled,
+        "ENCRYPTION_ENABLED":      &c.Encryption.Enabled,
+        "SSH_STRICT_HOST_KEY":     &c.Remote.SSH.StrictHostKey,
+        "STANDBY_STRICT_HOST_KEY": &c.Standby.SSH.StrictHostKey,
+        "REMOTE_STREAMING":        &c.Remote.Streaming,
+        "REMOTE_STREAM_WHEN_LOW":  &c.Remote.Guardrails.StreamWhenLow,
+        "REMOTE_PIPELINE":         &c.Remote.Pipeline,
+        "REMOTE_BATCH_DISCOVERY":  &c.Remote.BatchDiscovery,
+        "REMOTE_PUSH":             &c.Remote.Push.Enabled,
+        "FS_SNAPSHOTS":            &c.FSSnapshots.Enabled,
+        "DOCKER_SITES":            &c.Docker.Enabled,
+        "BINLOG_BACKUPS":          &c.Binlogs.Enabled,
+        "SITE_OVERRIDES":          &c.SiteOverrides.Enabled,
+        "SIGNING_REQUIRED":        &c.Signing.Required,
+        "SIZE_ANOMALIES":          &c.SizeAnomalies.Enabled,
+    } {
+        if err := envBool(target, key); err != nil {
+            return err
+        }
+    }
+    for key, target := range map[string]**bool{
+        "MYSQLDUMP_ROUTINES":           &c.MySQLDump.Routines,
+        "MYSQLDUMP_TRIGGERS":           &c.MySQLDump.Triggers,
+        "MYSQLDUMP_EVENTS":             &c.MySQLDump.Events,
+        "MYSQLDUMP_SINGLE_TRANSACTION": &c.MySQLDump.SingleTransaction,
+    } {
+        if os.Getenv(key) == "" {
+            continue
+        }
+        var b bool
+        if err := envBool(&b, key); err != nil {
+            return err
+        }
+        *target = &b
+    }
+    return nil
+}
+
+// validate checks values that would otherwise only fail in the middle of a run
+func (c *Config) validate() error {
+    switch c.WebServer.Type {
+    case "", WebServerApache, WebServerNginx, WebServerLiteSpeed, WebServerIIS, WebServerPlesk, WebServerCPanel:
+    default:
+        return fmt.Errorf("unknown web server %q, use apache, nginx, litespeed, iis, plesk or cpanel", c.WebServer.Type)
+    }
+    switch c.Standby.Source {
+    case "remote", "local":
+    default:
+        return fmt.Errorf("unknown standby source %q, use remote or local", c.Standby.Source)
+    }
+    if c.Local.BackupDir == "" || c.Remote.BackupDir == "" {
+        return fmt.Errorf("backup directories must not be empty")
+    }
+    if c.Local.BackupDir == c.Remote.BackupDir {
+        return fmt.Errorf("local and remote backups must use different directories")
+    }
+    l, err := layout.Parse(c.Layout)
+    if err != nil {
+        return err
+    }
+    if c.Incremental.Enabled && !l.Incremental() {
+        return fmt.Errorf("layout %q gives incremental archives the paths of full ones, use {{.Incr}} or disable incremental backups", c.Layout)
+    }
+    if c.Physical.uses() && !l.Incremental() {
+        return fmt.Errorf("layout %q gives incremental archives the paths of full ones, use {{.Incr}} or back up databases logically", c.Layout)
+    }
+    for _, s := range []Storage{c.Local.Storage, c.Remote.Storage} {
+        if s.MaxFileBackups < 1 || s.MaxDBBackups < 1 {
+            return fmt.Errorf("%s must keep at least one file and one database backup", s.BackupDir)
+        }
+        if err := s.Retention.validate(); err != nil {
+            return fmt.Errorf("%s: %v", s.BackupDir, err)
+        }
+    }
+    if err := c.validateServers(); err != nil {
+        return err
+    }
+    switch c.Logging.Format {
+    case "text", "json":
+    default:
+        return fmt.Errorf("unknown log format %q, use text or json", c.Logging.Format)
+    }
+    switch strings.ToLower(c.Logging.Level) {
+    case "debug", "info", "warn", "error":
+    default:
+        return fmt.Errorf("unknown log level %q, use debug, info, warn or error", c.Logging.Level)
+    }
+    if c.Logging.KeepRuns < 0 {
+        return fmt.Errorf("logging keep_runs must not be negative")
+    }
+    if c.Incremental.FullEvery < 1 {
+        return fmt.Errorf("incremental full_every must be at least 1")
+    }
+    if c.Timeouts.Run < 0 || c.Timeouts.Site < 0 {
+        return fmt.Errorf("timeouts must not be negative")
+    }
+    for site, timeout := range c.Timeouts.Sites {
+        if timeout < 0 {
+            return fmt.Errorf("timeout of site %s must not be negative", site)
+        }
+    }
+    if err := c.Retry.Policy().Validate(); err != nil {
+        return err
+    }
+    if c.Retry.ResumeAfter < 0 {
+        return fmt.Errorf("retry resume_after must not be negative")
+    }
+    if c.Local.ParallelSites < 0 {
+        return fmt.Errorf("local parallel_sites must not be negative")
+    }
+    if err := c.Priority.validate(); err != nil {
+        return err
+    }
+    if err := c.Compression.validate(); err != nil {
+        return err
+    }
+    for site := range c.Compression.Sites {
+        if err := c.Compression.For(site).validate(); err != nil {
+            return fmt.Errorf("compression of site %s: %v", site, err)
+        }
+    }
+    if err := c.Hooks.validate(); err != nil {
+        return err
+    }
+    if err := c.Healthchecks.validate(); err != nil {
+        return err
+    }
+    if err := c.Freshness.validate(); err != nil {
+        return err
+    }
+    if err := c.DBTunnels.validate(); err != nil {
+        return err
+    }
+    if err := c.FSSnapshots.validate(); err != nil {
+        return err
+    }
+    if err := c.Docker.validate(); err != nil {
+        return err
+    }
+    if err := c.Remote.Push.validate(c); err != nil {
+        return err
+    }
+    if err := c.Binlogs.validate(); err != nil {
+        return err
+    }
+    if err := c.Physical.validate(); err != nil {
+        return err
+    }
+    if err := c.SiteOverrides.validate(); err != nil {
+        return err
+    }
+    if err := c.RestoreTests.validate(); err != nil {
+        return err
+    }
+    if err := c.Signing.validate(); err != nil {
+        return err
+    }
+    if err := c.Disk.validate(); err != nil {
+        return err
+    }
+    if err := c.SizeLimits.validate(); err != nil {
+        return err
+    }
+    if err := c.Remote.Guardrails.validate(); err != nil {
+        return err
+    }
+    if err := c.Split.validate(); err != nil {
+        return err
+    }
+    if err := c.Immutability.validate(); err != nil {
+        return err
+    }
+    if err := c.SizeAnomalies.validate(); err != nil {
+        return err
+    }
+    if err := c.Lifecycle.validate(c); err != nil {
+        return err
+    }
+    if err := c.Frequency.validate(); err != nil {
+        return err
+    }
+    if err := c.Report.SMTP.validate(); err != nil {
+        return err
+    }
+    if err := c.MySQLDump.validate(); err != nil {
+        return err
+    }
+    for _, recipient := range c.Encryption.Recipients {
+        if _, err := encryption.ParseRecipient(recipient); err != nil {
+            return fmt.Errorf("encryption recipients: %v", err)
+        }
+    }
+    if err := (FilePatterns{Excludes: c.Excludes, Includes: c.Includes, FollowSymlinks: c.FollowSymlinks}).validate(); err != nil {
+        return err
+    }
+    for site, patterns := range c.SiteFiles {
+        if err := patterns.validate(); err != nil {
+            return fmt.Errorf("site_files of %s: %v", site, err)
+        }
+    }
+    if c.S3.Bucket != "" && c.S3.PartSizeMB < 5 {
+        return fmt.Errorf("S3 part size must be at least 5 MB")
+    }
+    if c.GCS.Bucket != "" && c.GCS.ChunkSizeMB < 1 {
+        return fmt.Errorf("GCS chunk size must be at least 1 MB")
+    }
+    if (c.Azure.Account != "") != (c.Azure.Container != "") {
+        return fmt.Errorf("Azure storage needs both an account and a container")
+    }
+    if c.Azure.Account != "" && (c.Azure.BlockSizeMB < 1 || c.Azure.BlockSizeMB > 4000) {
+        return fmt.Errorf("Azure block size must be between 1 and 4000 MB")
+    }
+    if c.FTP.Host != "" {
+        switch c.FTP.TLS {
+        case FTPExplicitTLS, FTPImplicitTLS, FTPNone:
+        default:
+            return fmt.Errorf("unknown ftp tls %q, use explicit, implicit or none", c.FTP.TLS)
+        }
+        if c.FTP.Username == "" {
+            return fmt.Errorf("FTP storage needs a username")
+        }
+    }
+    if c.WebDAV.URL != "" {
+        if u, err := url.Parse(c.WebDAV.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("invalid webdav url %q, use https://host/path", c.WebDAV.URL)
+        }
+    }
+    if c.B2.Bucket != "" {
+        if c.B2.KeyID == "" {
+            return fmt.Errorf("B2 storage needs a key ID")
+        }
+        if c.B2.PartSizeMB < 5 {
+            return fmt.Errorf("B2 part size must be at least 5 MB")
+        }
+    }
+    if c.Rclone.Remote != "" && !strings.Contains(c.Rclone.Remote, ":") {
+        return fmt.Errorf("invalid rclone remote %q, use name:path", c.Rclone.Remote)
+    }
+    for name, expr := range c.Schedules {
+        if err := validateSchedule(expr); err != nil {
+            return fmt.Errorf("schedule %s: %v", name, err)
+        }
+    }
+    for site, expr := range c.SiteSchedules {
+        if err := validateSchedule(expr); err != nil {
+            return fmt.Errorf("site schedule %s: %v", site, err)
+        }
+    }
+    return nil
+}
+
+// validateServers checks the remote servers and the standby's choice of them
+func (c *Config) validateServers() error {
+    if c.Remote.Workers < 0 {
+        return fmt.Errorf("remote workers must not be negative")
+    }
+    if err := c.validateTransport(); err != nil {
+        return err
+    }
+    if err := c.Remote.SSH.Become.validate(); err != nil {
+        return fmt.Errorf("remote ssh: %v", err)
+    }
+    if err := c.Standby.SSH.Become.validate(); err != nil {
+        return fmt.Errorf("standby ssh: %v", err)
+    }
+    if len(c.Remote.Servers) == 0 {
+        if c.Standby.Server != "" {
+            return fmt.Errorf("standby server %q is set but no remote servers are configured", c.Standby.Server)
+        }
+        return nil
+    }
+    if c.Remote.SSH.Host != "" {
+        return fmt.Errorf("remote ssh and remote servers can't be used together, move the ssh settings into servers")
+    }
+    if c.Remote.ParallelServers < 1 {
+        return fmt.Errorf("remote parallel_servers must be at least 1")
+    }
+    seen := make(map[string]bool)
+    for _, server := range c.Remote.Servers {
+        if server.Name == "" || server.Name == "." || server.Name == ".." || strings.ContainsAny(server.Name, "/\\") {
+            return fmt.Errorf("remote server name %q is not usable as a directory name", server.Name)
+        }
+        if seen[server.Name] {
+            return fmt.Errorf("remote server %s is configured twice", server.Name)
+        }
+        seen[server.Name] = true
+        if server.SSH.Host == "" || server.SSH.User == "" {
+            return fmt.Errorf("remote server %s needs a host and a user", server.Name)
+        }
+        if server.Workers < 0 {
+            return fmt.Errorf("remote server %s: workers must not be negative", server.Name)
+        }
+        if err := server.SSH.Become.validate(); err != nil {
+            return fmt.Errorf("remote server %s: %v", server.Name, err)
+        }
+        if server.MaxFileBackups < 0 || server.MaxDBBackups < 0 {
+            return fmt.Errorf("remote server %s must keep at least one file and one database backup", server.Name)
+        }
+        for _, pattern := range append(append([]string{}, server.Sites...), server.ExcludeSites...) {
+            if _, err := filepath.Match(pattern, ""); err != nil {
+                return fmt.Errorf("remote server %s: invalid site pattern %q", server.Name, pattern)
+            }
+        }
+        if err := (FilePatterns{Excludes: server.Excludes}).validate(); err != nil {
+            return fmt.Errorf("remote server %s: %v", server.Name, err)
+        }
+    }
+    if c.Standby.Enabled && c.Standby.Source == "remote" && !seen[c.Standby.Server] {
+        return fmt.Errorf("standby server must name one of the remote servers (%s) as its source", strings.Join(c.RemoteServerNames(), ", "))
+    }
+    return nil
+}
+
+// validateTransport checks the transport of remote files. rsync runs the ssh
+// client, which needs a key, and keeps snapshots as plain files.
+func (c *Config) validateTransport() error {
+    switch c.Remote.Transport {
+    case "", TransportTar:
+        return nil
+    case TransportRsync:
+    default:
+        return fmt.Errorf("unknown remote transport %q, use tar or rsync", c.Remote.Transport)
+    }
+    if !c.Remote.Enabled {
+        return nil
+    }
+    if c.Encryption.Enabled {
+        return fmt.Errorf("remote transport rsync keeps unencrypted snapshots and can't be used with encryption")
+    }
+    if c.Remote.SSH.Host != "" && c.Remote.SSH.KeyPath == "" {
+        return fmt.Errorf("remote transport rsync needs an SSH key, set remote ssh key_path")
+    }
+    for _, server := range c.Remote.Servers {
+        if server.SSH.KeyPath == "" {
+            return fmt.Errorf("remote transport rsync needs an SSH key, set key_path of remote server %s", server.Name)
+        }
+    }
+    return nil
+}
+
+// RemoteServerNames returns the names of the configured remote servers
+func (c *Config) RemoteServerNames() []string {
+    var names []string
+    for _, server := range c.Remote.Servers {
+        names = append(names, server.Name)
+    }
+    return names
+}
+
+// RemoteServer returns the remote server with the given name
+func (c *Config) RemoteServer(name string) (RemoteServer, bool) {
+    for _, server := range c.Remote.Servers {
+        if server.Name == name {
+            return server, true
+        }
+    }
+    return RemoteServer{}, false
+}
+
+// validateSchedule checks that a cron expression parses and ever matches
+func validateSchedule(expr string) error {
+    schedule, err := scheduler.Parse(expr)
+    if err != nil {
+        return err
+    }
+    if schedule.Next(time.Now()).IsZero() {
+        return fmt.Errorf("%q never matches", expr)
+    }
+    return nil
+}
+
+// Redacted returns a copy of the configuration with passwords masked
+func (c *Config) Redacted() *Config {
+    redacted := *c
+    redactTarget(&redacted.Remote.SSH)
+    redactTarget(&redacted.Standby.SSH)
+    redacted.Remote.Servers = append([]RemoteServer(nil), c.Remote.Servers...)
+    for i := range redacted.Remote.Servers {
+        redactTarget(&redacted.Remote.Servers[i].SSH)
+    }
+    if len(c.DBTunnels.Sites) > 0 {
+        redacted.DBTunnels.Sites = make(map[string]DBTunnel, len(c.DBTunnels.Sites))
+        for site, t := range c.DBTunnels.Sites {
+            if t.Password != "" {
+                t.Password = "********"
+            }
+            redacted.DBTunnels.Sites[site] = t
+        }
+    }
+    if redacted.S3.SecretAccessKey != "" {
+        redacted.S3.SecretAccessKey = "********"
+    }
+    if redacted.Azure.ClientSecret != "" {
+        redacted.Azure.ClientSecret = "********"
+    }
+    if redacted.FTP.Password != "" {
+        redacted.FTP.Password = "********"
+    }
+    if redacted.Remote.Push.SFTP.Password != "" {
+        redacted.Remote.Push.SFTP.Password = "********"
+    }
+    if redacted.WebDAV.Password != "" {
+        redacted.WebDAV.Password = "********"
+    }
+    if redacted.B2.ApplicationKey != "" {
+        redacted.B2.ApplicationKey = "********"
+    }
+    if redacted.API.Token != "" {
+        redacted.API.Token = "********"
+    }
+    if redacted.Report.SMTP.Password != "" {
+        redacted.Report.SMTP.Password = "********"
+    }
+    return &redacted
+}
+
+// redactTarget masks the passwords of an SSH target
+func redactTarget(target *SSHTarget) {
+    if target.Password != "" {
+        target.Password = "********"
+    }
+    if target.Become.Password != "" {
+        target.Become.Password = "********"
+    }
+}
+
+// envTarget overrides SSH settings with <prefix>_HOST, _USER, _PORT, _KEY_PATH,
+// _PASSWORD, _KNOWN_HOSTS, _BECOME, _BECOME_USER, _BECOME_HELPER and
+// _BECOME_PASSWORD
+func envTarget(target *SSHTarget, prefix string) {
+    envString(&target.Host, prefix+"_HOST")
+    envString(&target.User, prefix+"_USER")
+    envString(&target.Port, prefix+"_PORT")
+    envString(&target.KeyPath, prefix+"_KEY_PATH")
+    envString(&target.Password, prefix+"_PASSWORD")
+    envString(&target.KnownHosts, prefix+"_KNOWN_HOSTS")
+    envString(&target.Become.Method, prefix+"_BECOME")
+    envString(&target.Become.User, prefix+"_BECOME_USER")
+    envString(&target.Become.Helper, prefix+"_BECOME_HELPER")
+    envString(&target.Become.Password, prefix+"_BECOME_PASSWORD")
+}
+
+func envString(target *string, key string) {
+    if val := os.Getenv(key); val != "" {
+        *target = val
+    }
+}
+
+func envInt(target *int, key string) error {
+    val := os.Getenv(key)
+    if val == "" {
+        return nil
+    }
+    i, err := strconv.Atoi(val)
+    if err != nil {
+        return fmt.Errorf("%s must be a number, got %q", key, val)
+    }
+    *target = i
+    return nil
+}
+
+func envFloat(target *float64, key string) error {
+    val := os.Getenv(key)
+    if val == "" {
+        return nil
+    }
+    f, err := strconv.ParseFloat(val, 64)
+    if err != nil {
+        return fmt.Errorf("%s must be a number, got %q", key, val)
+    }
+    *target = f
+    return nil
+}
+
+func envDuration(target *time.Duration, key string) error {
+    val := os.Getenv(key)
+    if val == "" {
+        return nil
+    }
+    d, err := time.ParseDuration(val)
+    if err != nil {
+        return fmt.Errorf("%s must be a duration such as 90m or 6h, got %q", key, val)
+    }
+    *target = d
+    return nil
+}
+
+func envBool(target *bool, key string) error {
+    val := os.Getenv(key)
+    if val == "" {
+        return nil
+    }
+    b, err := strconv.ParseBool(val)
+    if err != nil {
+        return fmt.Errorf("%s must be true or false, got %q", key, val)
+    }
+    *target = b
+    return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "gopkg.in/yaml.v3"
+)
+
+// cpanelMain is the part of a cPanel account's main userdata file listing
+// its domains. Addon domains map to the subdomain they are configured as.
+type cpanelMain struct {
+    MainDomain   string            `yaml:"main_domain"`
+    SubDomains   []string          `yaml:"sub_domains"`
+    AddonDomains map[string]string `yaml:"addon_domains"`
+}
+
+// cpanelDomain is the part of a domain's userdata file naming its document root
+type cpanelDomain struct {
+    DocumentRoot string `yaml:"documentroot"`
+}
+
+// ParseCPanelVhosts lists the sites of a cPanel server from its userdata
+// directory (usually /var/cpanel/userdata), which has a directory per
+// account. The main domain, subdomains and addon domains of every account
+// are sites; addon domains are named after themselves rather than the
+// subdomain they are configured as. Parked domains share the main domain's
+// document root and are left out.
+func ParseCPanelVhosts(userdataDir string) ([]Vhost, error) {
+    accounts, err := os.ReadDir(userdataDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read cPanel userdata: %v", err)
+    }
+
+    var vhosts []Vhost
+    for _, account := range accounts {
+        if !account.IsDir() {
+            continue
+        }
+        dir := filepath.Join(userdataDir, account.Name())
+        var main cpanelMain
+        if err := readYAML(filepath.Join(dir, "main"), &main); err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return nil, err
+        }
+        if main.MainDomain == "" {
+            continue
+        }
+
+        addonOf := make(map[string]string)
+        for addon, sub := range main.AddonDomains {
+            addonOf[sub] = addon
+        }
+        for _, name := range append([]string{main.MainDomain}, main.SubDomains...) {
+            var domain cpanelDomain
+            if err := readYAML(filepath.Join(dir, name), &domain); err != nil {
+                if os.IsNotExist(err) {
+                    continue
+                }
+                return nil, err
+            }
+            if domain.DocumentRoot == "" {
+                continue
+            }
+            serverName := name
+            if addon, ok := addonOf[name]; ok {
+                serverName = addon
+            }
+            vhosts = append(vhosts, Vhost{ServerName: serverName, DocumentRoot: domain.DocumentRoot})
+        }
+    }
+    sort.Slice(vhosts, func(i, j int) bool {
+        return vhosts[i].ServerName < vhosts[j].ServerName
+    })
+    return vhosts, nil
+}
+
+// readYAML decodes a YAML file into v
+func readYAML(path string, v interface{}) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    if err := yaml.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+    return nil
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// sqliteDriver is the driver of SQLite databases, which are files named by
+// DB_DATABASE rather than databases on a server
+const sqliteDriver = "sqlite"
+
+// sqliteDefaultFile is where Laravel keeps an SQLite database unless
+// DB_DATABASE names another file
+const sqliteDefaultFile = "database/database.sqlite"
+
+// Credentials are the database connection details of a web application
+type Credentials struct {
+    // Database driver, "mysql" unless the application says otherwise
+    Driver   string
+    // Host of the database server, or the path of its Unix socket
+    Host     string
+    // Port, empty for the driver's default
+    Port     string
+    // Name of the database, for SQLite the absolute path of its file
+    Name     string
+    User     string
+    Password string
+}
+
+// Complete reports whether enough details were found to dump the database
+func (c Credentials) Complete() bool {
+    if c.Driver == sqliteDriver {
+        return c.Name != ""
+    }
+    return c.Host != "" && c.Name != "" && c.User != "" && c.Password != ""
+}
+
+// HasDatabase reports whether a database is configured: a database and a
+// user, or the file of an SQLite database
+func (c Credentials) HasDatabase() bool {
+    return c.Name != "" && (c.User != "" || c.Driver == sqliteDriver)
+}
+
+// Resolve makes the file of an SQLite database absolute, relative to the
+// directory of the configuration file at configPath, which is the root of a
+// Laravel application. An in-memory database has nothing to back up and is
+// dropped. Other credentials are returned unchanged.
+func (c Credentials) Resolve(configPath string) Credentials {
+    if c.Driver != sqliteDriver {
+        return c
+    }
+    if c.Name == ":memory:" {
+        c.Name = ""
+        return c
+    }
+    if c.Name == "" {
+        c.Name = sqliteDefaultFile
+    }
+    if !filepath.IsAbs(c.Name) {
+        c.Name = filepath.Join(filepath.Dir(configPath), c.Name)
+    }
+    return c
+}
+
+// CredentialProvider extracts database credentials from the configuration
+// file of one kind of PHP application
+type CredentialProvider interface {
+    // Name identifies the application type, e.g. "laravel"
+    Name() string
+    // ConfigFile is the name of the application's configuration file
+    ConfigFile() string
+    // Parse extracts the credentials from the content of the configuration file
+    Parse(content string) Credentials
+}
+
+// credentialProviders are tried in order in every searched directory
+var credentialProviders = []CredentialProvider{LaravelProvider{}, WordPressProvider{}}
+
+// RegisterCredentialProvider adds a provider, tried after the ones already registered
+func RegisterCredentialProvider(p CredentialProvider) {
+    credentialProviders = append(credentialProviders, p)
+}
+
+// CredentialProviders returns the registered providers in the order they are tried
+func CredentialProviders() []CredentialProvider {
+    return credentialProviders
+}
+
+// ProviderForFile returns the provider reading configuration files of the
+// given name, or nil if there is none
+func ProviderForFile(path string) CredentialProvider {
+    for _, p := range credentialProviders {
+        if filepath.Base(path) == p.ConfigFile() {
+            return p
+        }
+    }
+    return nil
+}
+
+// FindCredentials reads the database credentials of the application at
+// path, which is either a document root or a configuration file. The
+// directories around a document root are searched nearest first, trying
+// every provider in each. Empty credentials and an empty provider name are
+// returned if no configuration file is found.
+func FindCredentials(path string) (Credentials, string, error) {
+    if p := ProviderForFile(path); p != nil {
+        if _, err := os.Stat(path); err == nil {
+            return readCredentials(path, p)
+        }
+    }
+
+    dirs, err := configDirs(path)
+    if err != nil {
+        return Credentials{}, "", err
+    }
+    for _, dir := range dirs {
+        for _, p := range credentialProviders {
+            configPath := filepath.Join(dir, p.ConfigFile())
+            if _, err := os.Stat(configPath); err == nil {
+                return readCredentials(configPath, p)
+            }
+        }
+    }
+    return Credentials{}, "", nil
+}
+
+// readCredentials parses a configuration file with its provider
+func readCredentials(path string, p CredentialProvider) (Credentials, string, error) {
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return Credentials{}, "", fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    return p.Parse(string(content)).Resolve(path), p.Name(), nil
+}
+
+// LaravelProvider reads the DB_* variables of a Laravel .env
+type LaravelProvider struct{}
+
+// Name returns "laravel"
+func (LaravelProvider) Name() string { return "laravel" }
+
+// ConfigFile returns ".env"
+func (LaravelProvider) ConfigFile() string { return ".env" }
+
+// Parse extracts the credentials, driver (DB_CONNECTION) and port from a
+// .env. Like Laravel, MySQL and MariaDB connect over DB_SOCKET if it is
+// set, ignoring DB_HOST and DB_PORT.
+func (LaravelProvider) Parse(content string) Credentials {
+    c := Credentials{
+        Driver:   extractEnvValue(content, "DB_CONNECTION"),
+        Host:     extractEnvValue(content, "DB_HOST"),
+        Port:     extractEnvValue(content, "DB_PORT"),
+        Name:     extractEnvValue(content, "DB_DATABASE"),
+        User:     extractEnvValue(content, "DB_USERNAME"),
+        Password: extractEnvValue(content, "DB_PASSWORD"),
+    }
+    if c.Driver == "" {
+        c.Driver = "mysql"
+    }
+    if socket := extractEnvValue(content, "DB_SOCKET"); socket != "" && (c.Driver == "mysql" || c.Driver == "mariadb") {
+        c.Host, c.Port = socket, ""
+    }
+    return c
+}
+
+// WordPressProvider reads the DB_* constants defined in wp-config.php
+type WordPressProvider struct{}
+
+// Name returns "wordpress"
+func (WordPressProvider) Name() string { return "wordpress" }
+
+// ConfigFile returns "wp-config.php"
+func (WordPressProvider) ConfigFile() string { return "wp-config.php" }
+
+// Parse extracts the credentials from wp-config.php. DB_HOST may carry a
+// port ("db:3307") or the path of a socket ("localhost:/run/mysqld.sock"),
+// which then becomes the host.
+func (WordPressProvider) Parse(content string) Credentials {
+    c := Credentials{
+        Driver:   "mysql",
+        Host:     extractPHPDefine(content, "DB_HOST"),
+        Name:     extractPHPDefine(content, "DB_NAME"),
+        User:     extractPHPDefine(content, "DB_USER"),
+        Password: extractPHPDefine(content, "DB_PASSWORD"),
+    }
+    if i := strings.Index(c.Host, ":/"); i >= 0 {
+        c.Host = c.Host[i+1:]
+    } else if host, port, err := net.SplitHostPort(c.Host); err == nil {
+        c.Host, c.Port = host, port
+    }
+    return c
+}
+
+// extractPHPDefine returns the string value of define('KEY', 'value') in
+// PHP source, ignoring lines commented out with // or #
+func extractPHPDefine(content, key string) string {
+    re := regexp.MustCompile(`(?m)^\s*define\(\s*['"]` + key + `['"]\s*,\s*(?:'((?:[^'\\]|\\.)*)'|"((?:[^"\\]|\\.)*)")\s*\)`)
+    match := re.FindStringSubmatch(content)
+    if match == nil {
+        return ""
+    }
+    value := match[1] + match[2]
+    return strings.NewReplacer(`\'`, `'`, `\"`, `"`, `\\`, `\`).Replace(value)
+}
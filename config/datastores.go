@@ -0,0 +1,190 @@
+package config
+
+import (
+    "fmt"
+    "net"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Datastores backed up besides a site's database
+const (
+    DatastoreRedis = "redis"
+    DatastoreMongo = "mongo"
+)
+
+// Datastores are the opt-in flags of a site's further data stores
+type Datastores struct {
+    Redis bool `yaml:"redis,omitempty"`
+    Mongo bool `yaml:"mongo,omitempty"`
+}
+
+// Enabled returns the data stores that are backed up, in a fixed order
+func (d Datastores) Enabled() []string {
+    var stores []string
+    if d.Redis {
+        stores = append(stores, DatastoreRedis)
+    }
+    if d.Mongo {
+        stores = append(stores, DatastoreMongo)
+    }
+    return stores
+}
+
+// DatastoresConfig selects the sites whose Redis and MongoDB data is dumped
+// with redis-cli --rdb and mongodump besides their database. Nothing is
+// dumped unless a site opts in.
+type DatastoresConfig struct {
+    Sites map[string]Datastores `yaml:"sites,omitempty"`
+}
+
+// For returns the data stores of a site. An application of a multi-app site
+// (site/apps/name) without settings of its own uses the site's.
+func (d DatastoresConfig) For(site string) Datastores {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if s, ok := d.Sites[name]; ok {
+            return s
+        }
+    }
+    return Datastores{}
+}
+
+// optIn enables a data store for comma-separated sites
+func (d *DatastoresConfig) optIn(store, sites string) {
+    for _, site := range strings.Split(sites, ",") {
+        if site = strings.TrimSpace(site); site == "" {
+            continue
+        }
+        if d.Sites == nil {
+            d.Sites = make(map[string]Datastores)
+        }
+        s := d.Sites[site]
+        switch store {
+        case DatastoreRedis:
+            s.Redis = true
+        case DatastoreMongo:
+            s.Mongo = true
+        }
+        d.Sites[site] = s
+    }
+}
+
+// RedisSettings are the connection details of a Laravel application's Redis
+// server, from REDIS_URL or REDIS_HOST, REDIS_PORT, REDIS_USERNAME,
+// REDIS_PASSWORD and REDIS_SCHEME, with Laravel's defaults
+type RedisSettings struct {
+    Host     string
+    Port     string
+    Username string
+    Password string
+    TLS      bool
+}
+
+// MongoSettings are the connection details of a Laravel application's
+// MongoDB server, from MONGO_URI (or MONGO_DSN) or MONGO_HOST, MONGO_PORT,
+// MONGO_USERNAME, MONGO_PASSWORD and MONGO_AUTH_DATABASE, and the database
+// dumped, MONGO_DATABASE, all databases if empty
+type MongoSettings struct {
+    URI      string
+    Database string
+}
+
+// FindDatastoreSettings reads the Redis and MongoDB settings of the Laravel
+// application at path, a document root or its .env, searched like
+// FindCredentials. ok is false if there is no .env.
+func FindDatastoreSettings(path string) (redis RedisSettings, mongo MongoSettings, ok bool, err error) {
+    envPath := ""
+    if filepath.Base(path) == ".env" {
+        envPath = path
+    } else {
+        dirs, err := configDirs(path)
+        if err != nil {
+            return redis, mongo, false, err
+        }
+        for _, dir := range dirs {
+            if _, err := os.Stat(filepath.Join(dir, ".env")); err == nil {
+                envPath = filepath.Join(dir, ".env")
+                break
+            }
+        }
+    }
+    if envPath == "" {
+        return redis, mongo, false, nil
+    }
+    content, err := os.ReadFile(envPath)
+    if err != nil {
+        return redis, mongo, false, fmt.Errorf("failed to read %s: %v", envPath, err)
+    }
+    redis, err = parseRedisSettings(string(content))
+    if err != nil {
+        return redis, mongo, false, err
+    }
+    return redis, parseMongoSettings(string(content)), true, nil
+}
+
+// parseRedisSettings extracts the REDIS_* settings of a .env
+func parseRedisSettings(content string) (RedisSettings, error) {
+    s := RedisSettings{
+        Host:     extractEnvValue(content, "REDIS_HOST"),
+        Port:     extractEnvValue(content, "REDIS_PORT"),
+        Username: extractEnvValue(content, "REDIS_USERNAME"),
+        Password: extractEnvValue(content, "REDIS_PASSWORD"),
+        TLS:      extractEnvValue(content, "REDIS_SCHEME") == "tls",
+    }
+    if raw := extractEnvValue(content, "REDIS_URL"); raw != "" {
+        u, err := url.Parse(raw)
+        if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+            return s, fmt.Errorf("invalid REDIS_URL")
+        }
+        s.TLS = u.Scheme == "rediss"
+        s.Host, s.Port = u.Hostname(), u.Port()
+        if u.User != nil {
+            s.Username = u.User.Username()
+            s.Password, _ = u.User.Password()
+        }
+    }
+    // Laravel sets a password of "null" to none
+    if s.Password == "null" {
+        s.Password = ""
+    }
+    if s.Host == "" {
+        s.Host = "127.0.0.1"
+    }
+    if s.Port == "" {
+        s.Port = "6379"
+    }
+    return s, nil
+}
+
+// parseMongoSettings extracts the MONGO_* settings of a .env, building the
+// connection URI from the host and credentials if none is given
+func parseMongoSettings(content string) MongoSettings {
+    s := MongoSettings{
+        URI:      extractEnvValue(content, "MONGO_URI"),
+        Database: extractEnvValue(content, "MONGO_DATABASE"),
+    }
+    if s.URI == "" {
+        s.URI = extractEnvValue(content, "MONGO_DSN")
+    }
+    if s.URI != "" {
+        return s
+    }
+    host, port := extractEnvValue(content, "MONGO_HOST"), extractEnvValue(content, "MONGO_PORT")
+    if host == "" {
+        host = "127.0.0.1"
+    }
+    if port == "" {
+        port = "27017"
+    }
+    u := url.URL{Scheme: "mongodb", Host: net.JoinHostPort(host, port), Path: "/"}
+    if user := extractEnvValue(content, "MONGO_USERNAME"); user != "" {
+        u.User = url.UserPassword(user, extractEnvValue(content, "MONGO_PASSWORD"))
+    }
+    if authDB := extractEnvValue(content, "MONGO_AUTH_DATABASE"); authDB != "" {
+        u.RawQuery = url.Values{"authSource": {authDB}}.Encode()
+    }
+    s.URI = u.String()
+    return s
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+    "fmt"
+    "strings"
+    "gopkg.in/yaml.v3"
+)
+
+// DBTunnel is the SSH server a site's database is reached through when it
+// is not reachable from this machine, typically the site's web server. The
+// dump connects to DB_HOST and DB_PORT as seen from that server.
+type DBTunnel struct {
+    SSHTarget `yaml:",inline"`
+}
+
+// UnmarshalYAML fills in the defaults of settings a tunnel doesn't set
+func (t *DBTunnel) UnmarshalYAML(node *yaml.Node) error {
+    type plain DBTunnel
+    tunnel := plain{SSHTarget: SSHTarget{Port: "22", StrictHostKey: true}}
+    if err := node.Decode(&tunnel); err != nil {
+        return err
+    }
+    *t = DBTunnel(tunnel)
+    return nil
+}
+
+// DBTunnelConfig holds the tunnels of the sites whose databases are dumped
+// through SSH local port forwarding
+type DBTunnelConfig struct {
+    Sites map[string]DBTunnel `yaml:"sites,omitempty"`
+}
+
+// For returns the tunnel of a site. An application of a multi-app site
+// (site/apps/name) without a tunnel of its own uses the site's. ok is false
+// if the database is reached directly.
+func (d DBTunnelConfig) For(site string) (DBTunnel, bool) {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if t, ok := d.Sites[name]; ok {
+            return t, true
+        }
+    }
+    return DBTunnel{}, false
+}
+
+// validate checks that every tunnel names its server and user
+func (d DBTunnelConfig) validate() error {
+    for site, t := range d.Sites {
+        if t.Host == "" || t.User == "" {
+            return fmt.Errorf("db_tunnels: tunnel of %s needs host and user", site)
+        }
+    }
+    return nil
+}
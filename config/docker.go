@@ -0,0 +1,60 @@
+package config
+
+import (
+    "fmt"
+    "strings"
+)
+
+// Defaults of Docker-hosted sites
+const (
+    DefaultDockerCommand     = "docker"
+    DefaultDockerHelperImage = "alpine:3"
+)
+
+// Labels of the containers of Docker-hosted sites
+const (
+    // Containers labelled true are backed up as sites
+    DockerLabelEnabled = "backup.enabled"
+    // Name of the site, the container's name if not set
+    DockerLabelSite = "backup.site"
+    // Named volume holding the site's files, the container's only named
+    // volume if not set
+    DockerLabelVolume = "backup.volume"
+    // Container running the site's MySQL or MariaDB database, the
+    // container itself if not set and it has MYSQL_DATABASE in its
+    // environment
+    DockerLabelDBContainer = "backup.db.container"
+    // Database to dump, MYSQL_DATABASE of the database container if not set
+    DockerLabelDBName = "backup.db.name"
+)
+
+// DockerConfig controls the discovery of sites running in Docker containers
+// on this machine. Their named volumes are archived through a container of
+// HelperImage and their databases dumped with mysqldump inside the database
+// container.
+type DockerConfig struct {
+    Enabled bool `yaml:"enabled"`
+    // Docker client, e.g. podman or "sudo docker"
+    Command     string `yaml:"command"`
+    HelperImage string `yaml:"helper_image"`
+}
+
+// CommandArgs returns the Docker client command split into its program and
+// arguments
+func (d DockerConfig) CommandArgs() []string {
+    return strings.Fields(d.Command)
+}
+
+// validate checks the client command and the helper image
+func (d DockerConfig) validate() error {
+    if !d.Enabled {
+        return nil
+    }
+    if len(d.CommandArgs()) == 0 {
+        return fmt.Errorf("docker command must not be empty")
+    }
+    if strings.TrimSpace(d.HelperImage) == "" {
+        return fmt.Errorf("docker helper_image must not be empty")
+    }
+    return nil
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+// ServerSettings holds the settings of one backed up server.
+// Empty values inherit from the templates the server is based on.
+type ServerSettings struct {
+    Host           string   `json:"host,omitempty"`
+    User           string   `json:"user,omitempty"`
+    Port           string   `json:"port,omitempty"`
+    KeyPath        string   `json:"key_path,omitempty"`
+    Password       string   `json:"password,omitempty"`
+    BackupDir      string   `json:"backup_dir,omitempty"`
+    MaxFileBackups int      `json:"max_file_backups,omitempty"`
+    MaxDBBackups   int      `json:"max_db_backups,omitempty"`
+    Excludes       []string `json:"excludes,omitempty"`
+}
+
+// SiteSettings holds per-site overrides
+type SiteSettings struct {
+    MaxFileBackups int      `json:"max_file_backups,omitempty"`
+    MaxDBBackups   int      `json:"max_db_backups,omitempty"`
+    Excludes       []string `json:"excludes,omitempty"`
+    Includes       []string `json:"includes,omitempty"`
+    Disabled       bool     `json:"disabled,omitempty"`
+}
+
+// FleetTemplate is a reusable set of defaults, e.g. per datacenter or panel type.
+// Templates may extend other templates; later ones override earlier ones.
+type FleetTemplate struct {
+    Extends      []string                `json:"extends,omitempty"`
+    Settings     ServerSettings          `json:"settings"`
+    SiteDefaults SiteSettings            `json:"site_defaults"`
+    Sites        map[string]SiteSettings `json:"sites,omitempty"`
+}
+
+// FleetServer describes one server built from templates plus its own overrides
+type FleetServer struct {
+    Templates    []string                `json:"templates,omitempty"`
+    Settings     ServerSettings          `json:"settings"`
+    SiteDefaults SiteSettings            `json:"site_defaults"`
+    Sites        map[string]SiteSettings `json:"sites,omitempty"`
+}
+
+// Fleet is the configuration of all servers managed from one controller
+type Fleet struct {
+    Templates map[string]FleetTemplate `json:"templates"`
+    Servers   map[string]FleetServer   `json:"servers"`
+}
+
+// EffectiveServer is the fully resolved configuration of a server
+type EffectiveServer struct {
+    Name         string                  `json:"name"`
+    Settings     ServerSettings          `json:"settings"`
+    SiteDefaults SiteSettings            `json:"site_defaults"`
+    Sites        map[string]SiteSettings `json:"sites"`
+}
+
+// LoadFleet reads a fleet definition file
+func LoadFleet(path string) (*Fleet, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read fleet file: %v", err)
+    }
+    fleet := &Fleet{}
+    if err := json.Unmarshal(data, fleet); err != nil {
+        return nil, fmt.Errorf("unable to parse fleet file %s: %v", path, err)
+    }
+    return fleet, nil
+}
+
+// ServerNames returns the names of all servers in the fleet, sorted
+func (f *Fleet) ServerNames() []string {
+    var names []string
+    for name := range f.Servers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Render resolves the effective configuration of a server: its templates are
+// applied in order (each after the templates it extends), then the server's
+// own settings, and finally site-level overrides on top of the site defaults
+func (f *Fleet) Render(serverName string) (*EffectiveServer, error) {
+    server, ok := f.Servers[serverName]
+    if !ok {
+        return nil, fmt.Errorf("server %q is not defined in the fleet", serverName)
+    }
+
+    effective := &EffectiveServer{
+        Name:  serverName,
+        Sites: make(map[string]SiteSettings),
+    }
+    siteOverrides := make(map[string]SiteSettings)
+
+    applied := make(map[string]bool)
+    var apply func(name string, chain []string) error
+    apply = func(name string, chain []string) error {
+        for _, seen := range chain {
+            if seen == name {
+                return fmt.Errorf("template cycle: %s -> %s", strings.Join(chain, " -> "), name)
+            }
+        }
+        if applied[name] {
+            return nil
+        }
+        tmpl, ok := f.Templates[name]
+        if !ok {
+            return fmt.Errorf("template %q is not defined", name)
+        }
+        for _, parent := range tmpl.Extends {
+            if err := apply(parent, append(chain, name)); err != nil {
+                return err
+            }
+        }
+        mergeServerSettings(&effective.Settings, tmpl.Settings)
+        mergeSiteSettings(&effective.SiteDefaults, tmpl.SiteDefaults)
+        mergeSiteMap(siteOverrides, tmpl.Sites)
+        applied[name] = true
+        return nil
+    }
+
+    for _, name := range server.Templates {
+        if err := apply(name, nil); err != nil {
+            return nil, err
+        }
+    }
+    mergeServerSettings(&effective.Settings, server.Settings)
+    mergeSiteSettings(&effective.SiteDefaults, server.SiteDefaults)
+    mergeSiteMap(siteOverrides, server.Sites)
+
+    if effective.Settings.Port == "" {
+        effective.Settings.Port = "22"
+    }
+
+    for site, override := range siteOverrides {
+        resolved := effective.SiteDefaults
+        mergeSiteSettings(&resolved, override)
+        effective.Sites[site] = resolved
+    }
+
+    return effective, nil
+}
+
+// Site returns the effective settings of a site on the server, falling back
+// to the site defaults for sites without overrides
+func (e *EffectiveServer) Site(name string) SiteSettings {
+    if site, ok := e.Sites[name]; ok {
+        return site
+    }
+    return e.SiteDefaults
+}
+
+// Redacted returns a copy with secrets masked, suitable for display
+func (e *EffectiveServer) Redacted() *EffectiveServer {
+    copied := *e
+    if copied.Settings.Password != "" {
+        copied.Settings.Password = "********"
+    }
+    return &copied
+}
+
+// mergeServerSettings copies all non-empty values of src over dst
+func mergeServerSettings(dst *ServerSettings, src ServerSettings) {
+    if src.Host != "" {
+        dst.Host = src.Host
+    }
+    if src.User != "" {
+        dst.User = src.User
+    }
+    if src.Port != "" {
+        dst.Port = src.Port
+    }
+    if src.KeyPath != "" {
+        dst.KeyPath = src.KeyPath
+    }
+    if src.Password != "" {
+        dst.Password = src.Password
+    }
+    if src.BackupDir != "" {
+        dst.BackupDir = src.BackupDir
+    }
+    if src.MaxFileBackups != 0 {
+        dst.MaxFileBackups = src.MaxFileBackups
+    }
+    if src.MaxDBBackups != 0 {
+        dst.MaxDBBackups = src.MaxDBBackups
+    }
+    if src.Excludes != nil {
+        dst.Excludes = src.Excludes
+    }
+}
+
+// mergeSiteSettings copies all non-empty values of src over dst
+func mergeSiteSettings(dst *SiteSettings, src SiteSettings) {
+    if src.MaxFileBackups != 0 {
+        dst.MaxFileBackups = src.MaxFileBackups
+    }
+    if src.MaxDBBackups != 0 {
+        dst.MaxDBBackups = src.MaxDBBackups
+    }
+    if src.Excludes != nil {
+        dst.Excludes = src.Excludes
+    }
+    if src.Includes != nil {
+        dst.Includes = src.Includes
+    }
+    if src.Disabled {
+        dst.Disabled = true
+    }
+}
+
+// mergeSiteMap merges per-site overrides of src into dst
+func mergeSiteMap(dst, src map[string]SiteSettings) {
+    for site, settings := range src {
+        merged := dst[site]
+        mergeSiteSettings(&merged, settings)
+        dst[site] = merged
+    }
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// FrequencyConfig sets how often the files and the database of sites are
+// backed up and when no backup may start. Runs, whether started by the
+// daemon or from cron, skip what isn't due; the run schedule should be at
+// least as frequent as the shortest interval.
+type FrequencyConfig struct {
+    // Minimum time between two file backups of a site; 0 backs up in every run
+    File time.Duration `yaml:"file"`
+    // Minimum time between two database dumps of a site, which the Redis and
+    // MongoDB dumps follow; 0 dumps in every run
+    Database time.Duration `yaml:"database"`
+    // Windows in which no backup of any site starts, e.g. "Mon-Fri 08:00-18:00"
+    Blackouts []string `yaml:"blackouts,omitempty"`
+    // Intervals of single sites and blackout windows added to the above
+    Sites map[string]SiteFrequency `yaml:"sites,omitempty"`
+}
+
+// SiteFrequency overrides the intervals of a site and adds blackout windows
+type SiteFrequency struct {
+    File      time.Duration `yaml:"file,omitempty"`
+    Database  time.Duration `yaml:"database,omitempty"`
+    Blackouts []string      `yaml:"blackouts,omitempty"`
+}
+
+// For returns the intervals and blackout windows of a site. An application
+// of a multi-app site without settings of its own uses the site's.
+func (f FrequencyConfig) For(site string) SiteFrequency {
+    settings := SiteFrequency{File: f.File, Database: f.Database, Blackouts: f.Blackouts}
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if s, ok := f.Sites[name]; ok {
+            if s.File > 0 {
+                settings.File = s.File
+            }
+            if s.Database > 0 {
+                settings.Database = s.Database
+            }
+            settings.Blackouts = append(append([]string(nil), f.Blackouts...), s.Blackouts...)
+            break
+        }
+    }
+    return settings
+}
+
+// Interval returns the minimum time between two archives of a type of a
+// site: file archives use the file interval, dumps of any kind the
+// database interval
+func (f FrequencyConfig) Interval(site, archiveType string) time.Duration {
+    settings := f.For(site)
+    if archiveType == "file" {
+        return settings.File
+    }
+    return settings.Database
+}
+
+// Blackout returns the blackout window of a site that t falls in
+func (f FrequencyConfig) Blackout(site string, t time.Time) (string, bool) {
+    for _, window := range f.For(site).Blackouts {
+        w, err := parseBlackout(window)
+        if err == nil && w.contains(t) {
+            return window, true
+        }
+    }
+    return "", false
+}
+
+// validate checks the intervals and blackout windows
+func (f FrequencyConfig) validate() error {
+    check := func(what string, s SiteFrequency) error {
+        if s.File < 0 || s.Database < 0 {
+            return fmt.Errorf("frequency%s intervals must not be negative", what)
+        }
+        for _, window := range s.Blackouts {
+            if _, err := parseBlackout(window); err != nil {
+                return fmt.Errorf("frequency%s blackout %q: %v", what, window, err)
+            }
+        }
+        return nil
+    }
+    if err := check("", SiteFrequency{File: f.File, Database: f.Database, Blackouts: f.Blackouts}); err != nil {
+        return err
+    }
+    for site, s := range f.Sites {
+        if err := check(" of "+site, s); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// weekdays are the names of the days of blackout windows, indexed by
+// time.Weekday
+var weekdays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// blackoutWindow is a parsed blackout window: the minutes of the day it
+// starts and ends at on the days it starts on. A window ending before it
+// starts lasts into the next day.
+type blackoutWindow struct {
+    days       [7]bool
+    start, end int
+}
+
+// parseBlackout parses a window such as "08:00-18:00", "Mon-Fri 08:00-18:00"
+// or "Sat,Sun 22:00-06:00"
+func parseBlackout(window string) (blackoutWindow, error) {
+    var w blackoutWindow
+    fields := strings.Fields(window)
+    switch len(fields) {
+    case 1:
+        for day := range w.days {
+            w.days[day] = true
+        }
+    case 2:
+        for _, days := range strings.Split(fields[0], ",") {
+            first, last, isRange := strings.Cut(days, "-")
+            from, ok := weekday(first)
+            to := from
+            if isRange {
+                var lastOK bool
+                to, lastOK = weekday(last)
+                ok = ok && lastOK
+            }
+            if !ok {
+                return w, fmt.Errorf("unknown days %q, use e.g. Mon-Fri or Sat,Sun", days)
+            }
+            for day := from; ; day = (day + 1) % 7 {
+                w.days[day] = true
+                if day == to {
+                    break
+                }
+            }
+        }
+    default:
+        return w, fmt.Errorf("use [DAYS] HH:MM-HH:MM")
+    }
+
+    start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+    if !ok {
+        return w, fmt.Errorf("use [DAYS] HH:MM-HH:MM")
+    }
+    var err error
+    if w.start, err = minuteOfDay(start); err != nil {
+        return w, err
+    }
+    if w.end, err = minuteOfDay(end); err != nil {
+        return w, err
+    }
+    if w.start == w.end {
+        return w, fmt.Errorf("window is empty")
+    }
+    return w, nil
+}
+
+// weekday returns the index of a day name, in full or its first three letters
+func weekday(name string) (int, bool) {
+    name = strings.ToLower(name)
+    for i, day := range weekdays {
+        if name == day || name == day[:3] {
+            return i, true
+        }
+    }
+    return 0, false
+}
+
+// minuteOfDay parses HH:MM, where 24:00 is the end of the day
+func minuteOfDay(clock string) (int, error) {
+    t, err := time.Parse("15:04", clock)
+    if err == nil {
+        return t.Hour()*60 + t.Minute(), nil
+    }
+    if clock == "24:00" {
+        return 24 * 60, nil
+    }
+    return 0, fmt.Errorf("invalid time %q, use HH:MM", clock)
+}
+
+// contains reports whether t falls in the window, in t's time zone
+func (w blackoutWindow) contains(t time.Time) bool {
+    minute := t.Hour()*60 + t.Minute()
+    day := int(t.Weekday())
+    if w.start < w.end {
+        return w.days[day] && minute >= w.start && minute < w.end
+    }
+    // The window started the day before or lasts into the next day
+    return w.days[day] && minute >= w.start || w.days[(day+6)%7] && minute < w.end
+}
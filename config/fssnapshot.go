@@ -0,0 +1,54 @@
+package config
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// Defaults of filesystem snapshots
+const (
+    DefaultFSSnapshotLVMSize  = "1G"
+    DefaultFSSnapshotMountDir = "/run/laravel-backup-tool/snapshots"
+)
+
+// FSSnapshotConfig controls whether file archives are read from an LVM,
+// btrfs or ZFS snapshot of the document root's filesystem, so files the
+// application writes while the archive is created don't make it
+// inconsistent. Sites on other filesystems are archived directly.
+type FSSnapshotConfig struct {
+    Enabled bool `yaml:"enabled"`
+    // Sites that differ from Enabled
+    Sites map[string]bool `yaml:"sites,omitempty"`
+    // Space reserved for changes made while an LVM snapshot exists, as
+    // lvcreate --size takes it
+    LVMSize string `yaml:"lvm_size"`
+    // Directory LVM snapshots are mounted below
+    MountDir string `yaml:"mount_dir"`
+}
+
+// lvmSizePattern matches the sizes lvcreate accepts, like 512M or 2G
+var lvmSizePattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[bBsSkKmMgGtTpPeE]?$`)
+
+// For reports whether the files of a site are archived from a snapshot. An
+// application of a multi-app site (site/apps/name) without a setting of its
+// own follows the site's.
+func (f FSSnapshotConfig) For(site string) bool {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if enabled, ok := f.Sites[name]; ok {
+            return enabled
+        }
+    }
+    return f.Enabled
+}
+
+// validate checks the LVM snapshot size and mount directory
+func (f FSSnapshotConfig) validate() error {
+    if !lvmSizePattern.MatchString(f.LVMSize) {
+        return fmt.Errorf("invalid fs_snapshots lvm_size %q, use e.g. 512M or 2G", f.LVMSize)
+    }
+    if !strings.HasPrefix(f.MountDir, "/") {
+        return fmt.Errorf("fs_snapshots mount_dir must be an absolute path")
+    }
+    return nil
+}
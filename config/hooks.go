@@ -0,0 +1,86 @@
+package config
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Hook events
+const (
+    HookPreBackup  = "pre_backup"
+    HookPostBackup = "post_backup"
+    HookOnFailure  = "on_failure"
+)
+
+// DefaultHookTimeout is how long a hook command may run unless configured
+const DefaultHookTimeout = 5 * time.Minute
+
+// HookCommands are the shell commands run at the events of a backup, empty
+// for none. pre_backup runs before anything is backed up and a failure skips
+// the backup; post_backup runs afterwards whatever the outcome; on_failure
+// runs last if anything failed.
+type HookCommands struct {
+    PreBackup  string `yaml:"pre_backup,omitempty"`
+    PostBackup string `yaml:"post_backup,omitempty"`
+    OnFailure  string `yaml:"on_failure,omitempty"`
+}
+
+// Command returns the command of an event
+func (h HookCommands) Command(event string) string {
+    switch event {
+    case HookPreBackup:
+        return h.PreBackup
+    case HookPostBackup:
+        return h.PostBackup
+    case HookOnFailure:
+        return h.OnFailure
+    }
+    return ""
+}
+
+// Empty reports whether no command is set
+func (h HookCommands) Empty() bool {
+    return h.PreBackup == "" && h.PostBackup == "" && h.OnFailure == ""
+}
+
+// HooksConfig holds the hook commands. Run hooks run on this machine at the
+// start and end of a backup run. Site hooks run for every site backed up,
+// on this machine for local sites and over SSH for remote ones; Sites
+// replaces them event by event for single sites. A hook running longer than
+// Timeout is killed and counts as failed.
+type HooksConfig struct {
+    Run     HookCommands            `yaml:"run"`
+    Site    HookCommands            `yaml:"site"`
+    Sites   map[string]HookCommands `yaml:"sites,omitempty"`
+    Timeout time.Duration           `yaml:"timeout"`
+}
+
+// For returns the hook commands of a site. An application of a multi-app
+// site (site/apps/name) without hooks of its own uses the site's.
+func (h HooksConfig) For(site string) HookCommands {
+    commands := h.Site
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if s, ok := h.Sites[name]; ok {
+            if s.PreBackup != "" {
+                commands.PreBackup = s.PreBackup
+            }
+            if s.PostBackup != "" {
+                commands.PostBackup = s.PostBackup
+            }
+            if s.OnFailure != "" {
+                commands.OnFailure = s.OnFailure
+            }
+            break
+        }
+    }
+    return commands
+}
+
+// validate checks the timeout
+func (h HooksConfig) validate() error {
+    if h.Timeout <= 0 {
+        return fmt.Errorf("hooks timeout must be positive")
+    }
+    return nil
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+    "encoding/xml"
+    "fmt"
+    "os"
+    "os/exec"
+    "path"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// iisEnvRegex matches the %VARIABLE% references of IIS physical paths
+var iisEnvRegex = regexp.MustCompile(`%([^%]+)%`)
+
+// iisSites is the output of appcmd list site /config /xml
+type iisSites struct {
+    Sites []struct {
+        Name   string `xml:"SITE.NAME,attr"`
+        Config struct {
+            Bindings []struct {
+                Protocol    string `xml:"protocol,attr"`
+                Information string `xml:"bindingInformation,attr"`
+            } `xml:"bindings>binding"`
+            Applications []struct {
+                Path        string `xml:"path,attr"`
+                Directories []struct {
+                    Path         string `xml:"path,attr"`
+                    PhysicalPath string `xml:"physicalPath,attr"`
+                } `xml:"virtualDirectory"`
+            } `xml:"application"`
+        } `xml:"site"`
+    } `xml:"SITE"`
+}
+
+// ParseIISVhosts lists the sites of IIS with appcmd list site, appcmd being
+// the path of appcmd.exe. A site is named after the host name of its first
+// HTTP or HTTPS binding with one, or after the site if no binding has a host
+// name. Its document root is the physical path of its root application;
+// further applications become its aliases, like Apache's Alias directives.
+func ParseIISVhosts(appcmd string) ([]Vhost, error) {
+    output, err := exec.Command(appcmd, "list", "site", "/config", "/xml").Output()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list IIS sites: %v", commandError(err))
+    }
+    return parseIISSites(output)
+}
+
+// parseIISSites reads the sites of the XML output of appcmd
+func parseIISSites(output []byte) ([]Vhost, error) {
+    var sites iisSites
+    if err := xml.Unmarshal(output, &sites); err != nil {
+        return nil, fmt.Errorf("failed to read the IIS sites: %v", err)
+    }
+    var vhosts []Vhost
+    for _, site := range sites.Sites {
+        vhost := Vhost{ServerName: site.Name, Aliases: make(map[string]string)}
+        for _, binding := range site.Config.Bindings {
+            // Bindings are address:port:host
+            parts := strings.SplitN(binding.Information, ":", 3)
+            if (binding.Protocol == "http" || binding.Protocol == "https") && len(parts) == 3 && parts[2] != "" {
+                vhost.ServerName = parts[2]
+                break
+            }
+        }
+        for _, app := range site.Config.Applications {
+            for _, dir := range app.Directories {
+                if dir.Path != "/" || dir.PhysicalPath == "" {
+                    continue
+                }
+                physical := iisPath(dir.PhysicalPath)
+                if app.Path == "/" {
+                    vhost.DocumentRoot = physical
+                } else {
+                    vhost.Aliases[path.Clean(app.Path)] = physical
+                }
+            }
+        }
+        if vhost.DocumentRoot != "" {
+            vhosts = append(vhosts, vhost)
+        }
+    }
+    sort.Slice(vhosts, func(i, j int) bool {
+        return vhosts[i].ServerName < vhosts[j].ServerName
+    })
+    return vhosts, nil
+}
+
+// iisPath expands the environment variables of an IIS physical path, such
+// as %SystemDrive%, and returns it with slashes
+func iisPath(p string) string {
+    p = iisEnvRegex.ReplaceAllStringFunc(p, func(ref string) string {
+        if value, ok := os.LookupEnv(strings.Trim(ref, "%")); ok {
+            return value
+        }
+        return ref
+    })
+    return filepath.ToSlash(filepath.Clean(p))
+}
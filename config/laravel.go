@@ -7,74 +7,43 @@ import (
     "strings"
 )
 
-// findEnvFile searches for .env file in the given directory and its parent directories
-func findEnvFile(startPath string) (string, error) {
+// configDirs lists the directories searched for an application's
+// configuration file, e.g. .env, nearest first: the given directory, its
+// parent directories and the usual application subdirectories
+func configDirs(startPath string) ([]string, error) {
     // Convert potential relative path to absolute
     absPath, err := filepath.Abs(startPath)
     if err != nil {
-        return "", err
+        return nil, err
     }
 
-    // List of possible .env locations relative to the document root
+    // List of possible locations relative to the document root
     possibleLocations := []string{
-        ".env",                    // в той же директории
-        "../.env",                 // на уровень выше
-        "../../.env",              // на два уровня выше
-        "../../../.env",           // на три уровня выше
-        "public/.env",             // в public директории
-        "public_html/.env",        // в public_html директории
-        "html/.env",              // в html директории
-        "app/.env",               // в app директории
-        "laravel/.env",           // в laravel директории
+        ".",                       // в той же директории
+        "..",                      // на уровень выше
+        "../..",                   // на два уровня выше
+        "../../..",                // на три уровня выше
+        "public",                  // в public директории
+        "public_html",             // в public_html директории
+        "html",                    // в html директории
+        "app",                     // в app директории
+        "laravel",                 // в laravel директории
     }
 
-    // First check if the path is a file (might be direct path to .env)
-    if strings.HasSuffix(absPath, ".env") {
-        if _, err := os.Stat(absPath); err == nil {
-            return absPath, nil
-        }
+    var dirs []string
+    // The document root itself comes first
+    if info, err := os.Stat(absPath); err == nil && info.IsDir() {
+        dirs = append(dirs, absPath)
     }
 
-    // If it's a directory, check all possible locations
     baseDir := absPath
     if !strings.HasSuffix(baseDir, "/") {
         baseDir = filepath.Dir(baseDir)
     }
-
     for _, loc := range possibleLocations {
-        envPath := filepath.Join(baseDir, loc)
-        if _, err := os.Stat(envPath); err == nil {
-            return envPath, nil
-        }
-    }
-
-    return "", os.ErrNotExist
-}
-
-// ParseLaravelEnv reads the Laravel .env file and extracts database credentials
-func ParseLaravelEnv(documentRoot string) (string, string, string, string, error) {
-    // Find .env file
-    envPath, err := findEnvFile(documentRoot)
-    if err != nil {
-        // Return empty strings without error if file not found
-        return "", "", "", "", nil
-    }
-
-    content, err := os.ReadFile(envPath)
-    if err != nil {
-        // Return empty strings without error if can't read file
-        return "", "", "", "", nil
+        dirs = append(dirs, filepath.Join(baseDir, loc))
     }
-
-    envContent := string(content)
-
-    // Extract values with proper quote handling
-    dbHost := extractEnvValue(envContent, "DB_HOST")
-    dbName := extractEnvValue(envContent, "DB_DATABASE")
-    dbUser := extractEnvValue(envContent, "DB_USERNAME")
-    dbPass := extractEnvValue(envContent, "DB_PASSWORD")
-
-    return dbHost, dbName, dbUser, dbPass, nil
+    return dirs, nil
 }
 
 func extractEnvValue(content, key string) string {
@@ -0,0 +1,81 @@
+package config
+
+import (
+    "fmt"
+)
+
+// Storages archives can be moved to by the lifecycle rules
+const (
+    LifecycleS3     = "s3"
+    LifecycleGCS    = "gcs"
+    LifecycleAzure  = "azure"
+    LifecycleFTP    = "ftp"
+    LifecycleWebDAV = "webdav"
+    LifecycleB2     = "b2"
+    LifecycleRclone = "rclone"
+)
+
+// lifecycleClasses lists the storage classes of the storages that have them
+var lifecycleClasses = map[string][]string{
+    LifecycleS3:    {"STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING", "GLACIER_IR", "GLACIER", "DEEP_ARCHIVE"},
+    LifecycleGCS:   {"NEARLINE", "COLDLINE", "ARCHIVE"},
+    LifecycleAzure: {"Cool", "Cold", "Archive"},
+}
+
+// LifecycleConfig moves archives older than a number of days from the
+// backup directories to one of the configured off-server storages,
+// optionally in a colder storage class. The catalog keeps their entries, so
+// they are still listed, rotated and fetched back for a restore.
+type LifecycleConfig struct {
+    // Archives are moved once they are this many days old; 0 disables moving
+    MoveAfterDays int `yaml:"move_after_days"`
+    // s3, gcs, azure, ftp, webdav, b2 or rclone, which must be configured
+    Storage string `yaml:"storage"`
+    // Storage class of moved archives, e.g. GLACIER or DEEP_ARCHIVE on S3,
+    // ARCHIVE on GCS or Archive on Azure; the storage's default if not set
+    StorageClass string `yaml:"storage_class,omitempty"`
+}
+
+// Enabled reports whether old archives are moved
+func (l LifecycleConfig) Enabled() bool {
+    return l.MoveAfterDays > 0
+}
+
+// validate checks that the storage is configured and supports the class
+func (l LifecycleConfig) validate(c *Config) error {
+    if l.MoveAfterDays < 0 {
+        return fmt.Errorf("lifecycle move_after_days must not be negative")
+    }
+    if !l.Enabled() {
+        return nil
+    }
+    configured := map[string]bool{
+        LifecycleS3:     c.S3.Bucket != "",
+        LifecycleGCS:    c.GCS.Bucket != "",
+        LifecycleAzure:  c.Azure.Account != "",
+        LifecycleFTP:    c.FTP.Host != "",
+        LifecycleWebDAV: c.WebDAV.URL != "",
+        LifecycleB2:     c.B2.Bucket != "",
+        LifecycleRclone: c.Rclone.Remote != "",
+    }
+    ok, known := configured[l.Storage]
+    if !known {
+        return fmt.Errorf("unknown lifecycle storage %q, use s3, gcs, azure, ftp, webdav, b2 or rclone", l.Storage)
+    }
+    if !ok {
+        return fmt.Errorf("lifecycle storage %s is not configured", l.Storage)
+    }
+    if l.StorageClass == "" {
+        return nil
+    }
+    classes, ok := lifecycleClasses[l.Storage]
+    if !ok {
+        return fmt.Errorf("lifecycle storage %s has no storage classes", l.Storage)
+    }
+    for _, class := range classes {
+        if class == l.StorageClass {
+            return nil
+        }
+    }
+    return fmt.Errorf("unknown lifecycle storage_class %q for %s, use one of %v", l.StorageClass, l.Storage, classes)
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// litespeedNode is a line of a LiteSpeed configuration file, "key value",
+// with the lines of its block if it opens one
+type litespeedNode struct {
+    Key      string
+    Value    string
+    Children []*litespeedNode
+}
+
+// child returns the value of the first line with the given key in the block
+func (n *litespeedNode) child(key string) string {
+    for _, c := range n.Children {
+        if strings.EqualFold(c.Key, key) {
+            return c.Value
+        }
+    }
+    return ""
+}
+
+// ParseLiteSpeedVhosts reads the virtual hosts of OpenLiteSpeed, as used by
+// CyberPanel, from httpd_config.conf in configDir (usually
+// /usr/local/lsws/conf). Every virtualhost block names its vhRoot and the
+// file with the rest of its configuration, on CyberPanel
+// vhosts/<name>/vhost.conf, whose vhDomain becomes the ServerName, docRoot the
+// DocumentRoot and static contexts the aliases. The variables $SERVER_ROOT,
+// $VH_ROOT and $VH_NAME are resolved.
+func ParseLiteSpeedVhosts(configDir string) ([]Vhost, error) {
+    serverRoot := filepath.Dir(filepath.Clean(configDir))
+    main, err := parseLiteSpeedFile(filepath.Join(configDir, "httpd_config.conf"))
+    if err != nil {
+        return nil, err
+    }
+
+    var vhosts []Vhost
+    for _, block := range main.Children {
+        if !strings.EqualFold(block.Key, "virtualhost") || block.Value == "" {
+            continue
+        }
+        name := block.Value
+        // Relative paths are relative to the vhost's root, which is
+        // relative to the server root
+        expand := func(value, relativeTo string) string {
+            if value == "" || (relativeTo == "" && (strings.Contains(value, "$VH_ROOT") || !filepath.IsAbs(value))) {
+                return ""
+            }
+            value = strings.NewReplacer("$SERVER_ROOT", serverRoot, "$VH_NAME", name, "$VH_ROOT", relativeTo).Replace(value)
+            if !filepath.IsAbs(value) {
+                value = filepath.Join(relativeTo, value)
+            }
+            return filepath.Clean(value)
+        }
+        vhRoot := expand(block.child("vhRoot"), serverRoot)
+
+        // The configuration may also be inline in the virtualhost block
+        config := block
+        if file := block.child("configFile"); file != "" {
+            if config, err = parseLiteSpeedFile(expand(file, serverRoot)); err != nil {
+                return nil, err
+            }
+        }
+        docRoot := expand(config.child("docRoot"), vhRoot)
+        if !filepath.IsAbs(docRoot) {
+            continue
+        }
+        serverName := strings.NewReplacer("$VH_NAME", name).Replace(config.child("vhDomain"))
+        if serverName == "" || serverName == "*" {
+            serverName = name
+        }
+        vhost := Vhost{ServerName: serverName, DocumentRoot: docRoot, Aliases: make(map[string]string)}
+        for _, c := range config.Children {
+            // Only static contexts map a URL path to a directory
+            location := c.child("location")
+            urlPath := strings.TrimSuffix(c.Value, "/")
+            if !strings.EqualFold(c.Key, "context") || location == "" || urlPath == "" ||
+                (c.child("type") != "" && !strings.EqualFold(c.child("type"), "null")) {
+                continue
+            }
+            vhost.Aliases[urlPath] = expand(location, vhRoot)
+        }
+        vhosts = append(vhosts, vhost)
+    }
+    if len(vhosts) == 0 {
+        return nil, fmt.Errorf("no virtual hosts with a docRoot found in %s", configDir)
+    }
+    return vhosts, nil
+}
+
+// parseLiteSpeedFile reads a LiteSpeed configuration file into a tree of
+// lines. Lines ending in "{" open a block that "}" closes; the values of
+// rewrite rules and other "<<<END" blocks are skipped.
+func parseLiteSpeedFile(path string) (*litespeedNode, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read LiteSpeed configuration: %v", err)
+    }
+    defer f.Close()
+
+    root := &litespeedNode{}
+    stack := []*litespeedNode{root}
+    heredoc := ""
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if heredoc != "" {
+            if line == heredoc {
+                heredoc = ""
+            }
+            continue
+        }
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        if line == "}" {
+            if len(stack) > 1 {
+                stack = stack[:len(stack)-1]
+            }
+            continue
+        }
+
+        opens := strings.HasSuffix(line, "{")
+        line = strings.TrimSpace(strings.TrimSuffix(line, "{"))
+        parent := stack[len(stack)-1]
+        if line == "" {
+            // A brace on a line of its own opens the block of the line before
+            if opens && len(parent.Children) > 0 {
+                stack = append(stack, parent.Children[len(parent.Children)-1])
+            }
+            continue
+        }
+        key := strings.Fields(line)[0]
+        value := strings.TrimSpace(line[len(key):])
+        if i := strings.Index(value, "<<<"); i >= 0 {
+            heredoc = strings.TrimSpace(value[i+3:])
+            value = strings.TrimSpace(value[:i])
+        }
+        node := &litespeedNode{Key: key, Value: value}
+        parent.Children = append(parent.Children, node)
+        if opens {
+            stack = append(stack, node)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read LiteSpeed configuration: %v", err)
+    }
+    return root, nil
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+)
+
+// packetSize matches sizes as mysqldump takes them, e.g. 1073741824 or 512M
+var packetSize = regexp.MustCompile(`^[0-9]+[KMGkmg]?$`)
+
+// MySQLDumpOptions are options of mysqldump for MySQL and MariaDB databases.
+// Options left unset keep mysqldump's defaults.
+type MySQLDumpOptions struct {
+    // Tables dumped, all if empty
+    Tables            []string `yaml:"tables,omitempty"`
+    // Tables left out, e.g. sessions or telescope_entries
+    ExcludeTables     []string `yaml:"exclude_tables,omitempty"`
+    Routines          *bool    `yaml:"routines,omitempty"`
+    Triggers          *bool    `yaml:"triggers,omitempty"`
+    Events            *bool    `yaml:"events,omitempty"`
+    // Dump InnoDB tables consistently without locking them
+    SingleTransaction *bool    `yaml:"single_transaction,omitempty"`
+    MaxAllowedPacket  string   `yaml:"max_allowed_packet,omitempty"`
+}
+
+// validate checks table names and the packet size
+func (o MySQLDumpOptions) validate() error {
+    for _, table := range append(append([]string{}, o.Tables...), o.ExcludeTables...) {
+        if table == "" || strings.HasPrefix(table, "-") {
+            return fmt.Errorf("invalid table name %q", table)
+        }
+    }
+    if o.MaxAllowedPacket != "" && !packetSize.MatchString(o.MaxAllowedPacket) {
+        return fmt.Errorf("max_allowed_packet must be a size such as 64M, got %q", o.MaxAllowedPacket)
+    }
+    return nil
+}
+
+// MySQLDumpConfig holds the mysqldump options, optionally by site
+type MySQLDumpConfig struct {
+    MySQLDumpOptions `yaml:",inline"`
+    Sites map[string]MySQLDumpOptions `yaml:"sites,omitempty"`
+}
+
+// For returns the mysqldump options of a site. A site's settings replace the
+// global ones where they are set, except excluded tables, which are added to
+// the global ones. An application of a multi-app site (site/apps/name)
+// without settings of its own uses the site's.
+func (m MySQLDumpConfig) For(site string) MySQLDumpOptions {
+    options := m.MySQLDumpOptions
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        s, ok := m.Sites[name]
+        if !ok {
+            continue
+        }
+        if len(s.Tables) > 0 {
+            options.Tables = s.Tables
+        }
+        options.ExcludeTables = append(append([]string{}, options.ExcludeTables...), s.ExcludeTables...)
+        for _, o := range []struct{ site, target **bool }{
+            {&s.Routines, &options.Routines},
+            {&s.Triggers, &options.Triggers},
+            {&s.Events, &options.Events},
+            {&s.SingleTransaction, &options.SingleTransaction},
+        } {
+            if *o.site != nil {
+                *o.target = *o.site
+            }
+        }
+        if s.MaxAllowedPacket != "" {
+            options.MaxAllowedPacket = s.MaxAllowedPacket
+        }
+        break
+    }
+    return options
+}
+
+// validate checks the global and the sites' options
+func (m MySQLDumpConfig) validate() error {
+    if err := m.MySQLDumpOptions.validate(); err != nil {
+        return fmt.Errorf("mysqldump: %v", err)
+    }
+    for site, options := range m.Sites {
+        if err := options.validate(); err != nil {
+            return fmt.Errorf("mysqldump of site %s: %v", site, err)
+        }
+    }
+    return nil
+}
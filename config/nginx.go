@@ -0,0 +1,251 @@
+package config
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Maximum depth of nested include directives, to stop include loops
+const nginxMaxIncludeDepth = 10
+
+// ParseNginxConfig reads the Nginx configuration below configDir and extracts server_name and root
+func ParseNginxConfig(configDir string) (map[string]string, error) {
+    vhosts, err := ParseNginxVhosts(configDir)
+    if err != nil {
+        return nil, err
+    }
+
+    sites := make(map[string]string)
+    for _, vhost := range vhosts {
+        sites[vhost.ServerName] = vhost.DocumentRoot
+    }
+    return sites, nil
+}
+
+// ParseNginxVhosts reads the server blocks of the files in sites-enabled and
+// conf.d below configDir (usually /etc/nginx). The first name of each
+// server_name becomes the ServerName, the server's root its DocumentRoot and
+// "location /url { alias /path; }" blocks its aliases. Server blocks with the
+// same name, e.g. for HTTP and HTTPS, are merged.
+func ParseNginxVhosts(configDir string) ([]Vhost, error) {
+    var files []string
+    for _, pattern := range []string{"sites-enabled/*", "conf.d/*.conf"} {
+        matches, err := filepath.Glob(filepath.Join(configDir, pattern))
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, matches...)
+    }
+    if len(files) == 0 {
+        return nil, fmt.Errorf("no server configuration found in %s/sites-enabled or %s/conf.d", configDir, configDir)
+    }
+
+    byName := make(map[string]*Vhost)
+    var names []string
+    for _, file := range files {
+        if info, err := os.Stat(file); err != nil || info.IsDir() {
+            continue
+        }
+        tokens, err := nginxTokens(file, configDir, 0)
+        if err != nil {
+            return nil, err
+        }
+        for _, vhost := range parseNginxServers(tokens) {
+            existing := byName[vhost.ServerName]
+            if existing == nil {
+                v := vhost
+                byName[vhost.ServerName] = &v
+                names = append(names, vhost.ServerName)
+                continue
+            }
+            if existing.DocumentRoot == "" {
+                existing.DocumentRoot = vhost.DocumentRoot
+            }
+            for urlPath, dir := range vhost.Aliases {
+                existing.Aliases[urlPath] = dir
+            }
+        }
+    }
+
+    // Servers without a root are proxies or redirects, not sites
+    var vhosts []Vhost
+    for _, name := range names {
+        if byName[name].DocumentRoot != "" {
+            vhosts = append(vhosts, *byName[name])
+        }
+    }
+    return vhosts, nil
+}
+
+// parseNginxServers walks the tokens of a configuration and collects the
+// server blocks in it
+func parseNginxServers(tokens []string) []Vhost {
+    var vhosts []Vhost
+    var blocks []string     // names of the enclosing blocks
+    var current *Vhost      // server block being parsed
+    var location string     // URL path of the enclosing location block
+    var statement []string
+
+    for _, token := range tokens {
+        switch token {
+        case "{":
+            name := ""
+            if len(statement) > 0 {
+                name = statement[0]
+            }
+            if name == "server" && current == nil {
+                current = &Vhost{Aliases: make(map[string]string)}
+            }
+            if name == "location" && current != nil && len(statement) > 1 {
+                // Only plain prefix locations map to a directory
+                location = statement[len(statement)-1]
+                if len(statement) > 2 && statement[1] != "^~" {
+                    location = ""
+                }
+            }
+            blocks = append(blocks, name)
+            statement = nil
+        case "}":
+            if len(blocks) == 0 {
+                continue
+            }
+            name := blocks[len(blocks)-1]
+            blocks = blocks[:len(blocks)-1]
+            switch {
+            case name == "location":
+                location = ""
+            case name == "server" && current != nil && !inBlock(blocks, "server"):
+                if current.ServerName != "" {
+                    vhosts = append(vhosts, *current)
+                }
+                current = nil
+            }
+            statement = nil
+        case ";":
+            if current != nil && len(statement) > 1 {
+                applyNginxDirective(current, blocks, location, statement)
+            }
+            statement = nil
+        default:
+            statement = append(statement, token)
+        }
+    }
+    return vhosts
+}
+
+// applyNginxDirective records the directives of a server block relevant for backups
+func applyNginxDirective(vhost *Vhost, blocks []string, location string, statement []string) {
+    inServer := len(blocks) > 0 && blocks[len(blocks)-1] == "server"
+    switch statement[0] {
+    case "server_name":
+        if !inServer || vhost.ServerName != "" {
+            return
+        }
+        for _, name := range statement[1:] {
+            // "_" is the catch-all server, not a site
+            if name != "_" {
+                vhost.ServerName = name
+                return
+            }
+        }
+    case "root":
+        if inServer {
+            vhost.DocumentRoot = statement[1]
+        } else if location != "" && location != "/" {
+            // A location with its own root serves <root><location>
+            vhost.Aliases[location] = filepath.Join(statement[1], location)
+        }
+    case "alias":
+        if location != "" {
+            vhost.Aliases[location] = statement[1]
+        }
+    }
+}
+
+// inBlock reports whether one of the enclosing blocks has the given name
+func inBlock(blocks []string, name string) bool {
+    for _, b := range blocks {
+        if b == name {
+            return true
+        }
+    }
+    return false
+}
+
+// nginxTokens splits a configuration file into words, quoted strings and the
+// characters ';', '{' and '}', with comments removed and include directives
+// replaced by the tokens of the included files. Relative include paths are
+// resolved against configDir, like Nginx resolves them against its prefix.
+func nginxTokens(path, configDir string, depth int) ([]string, error) {
+    if depth > nginxMaxIncludeDepth {
+        return nil, fmt.Errorf("includes nested too deeply at %s", path)
+    }
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var tokens []string
+    var word strings.Builder
+    flush := func() {
+        if word.Len() > 0 {
+            tokens = append(tokens, word.String())
+            word.Reset()
+        }
+    }
+
+    text := string(content)
+    for i := 0; i < len(text); i++ {
+        c := text[i]
+        switch {
+        case c == '#' && word.Len() == 0:
+            for i < len(text) && text[i] != '\n' {
+                i++
+            }
+        case c == '"' || c == '\'':
+            end := strings.IndexByte(text[i+1:], c)
+            if end < 0 {
+                return nil, fmt.Errorf("unterminated quote in %s", path)
+            }
+            word.WriteString(text[i+1 : i+1+end])
+            i += end + 1
+        case c == ';' || c == '{' || c == '}':
+            flush()
+            tokens = append(tokens, string(c))
+        case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+            flush()
+        default:
+            word.WriteByte(c)
+        }
+    }
+    flush()
+
+    // Replace "include <pattern> ;" by the tokens of the matching files
+    var expanded []string
+    for i := 0; i < len(tokens); i++ {
+        if tokens[i] != "include" || i+2 >= len(tokens) || tokens[i+2] != ";" ||
+            (i > 0 && tokens[i-1] != ";" && tokens[i-1] != "{" && tokens[i-1] != "}") {
+            expanded = append(expanded, tokens[i])
+            continue
+        }
+        pattern := tokens[i+1]
+        if !filepath.IsAbs(pattern) {
+            pattern = filepath.Join(configDir, pattern)
+        }
+        matches, err := filepath.Glob(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("invalid include %q in %s: %v", tokens[i+1], path, err)
+        }
+        for _, match := range matches {
+            included, err := nginxTokens(match, configDir, depth+1)
+            if err != nil {
+                return nil, err
+            }
+            expanded = append(expanded, included...)
+        }
+        i += 2
+    }
+    return expanded, nil
+}
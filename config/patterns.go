@@ -0,0 +1,241 @@
+package config
+
+import (
+    "fmt"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// FilePatterns select the files of a document root that are archived, in
+// the style of .gitignore:
+//   - A pattern without a slash, e.g. "*.cache", matches a name anywhere.
+//   - A pattern with a slash, e.g. "storage/logs/*", matches a path relative
+//     to the document root; a leading slash only anchors the pattern.
+//   - A trailing slash, e.g. "vendor/", only matches directories.
+//   - "*" and "?" don't match "/", "**" matches any number of directories.
+//   - A matching directory matches everything below it.
+//   - An exclude starting with "!" is an include.
+// Includes win over excludes, so a file can be kept from an excluded directory.
+// Symlinks are archived as links. A link pointing into one of the
+// FollowSymlinks directories, absolute or relative to the document root, is
+// archived as the file or directory it points to instead.
+// ExtraPaths are absolute paths outside the document root archived with it,
+// such as shared uploads or supervisor configuration.
+type FilePatterns struct {
+    Excludes       []string `yaml:"excludes,omitempty"`
+    Includes       []string `yaml:"includes,omitempty"`
+    FollowSymlinks []string `yaml:"follow_symlinks,omitempty"`
+    ExtraPaths     []string `yaml:"extra_paths,omitempty"`
+}
+
+// SiteFilePatterns holds the patterns of single sites, added to the global ones
+type SiteFilePatterns map[string]FilePatterns
+
+// For returns the patterns of a site. An application of a multi-app site
+// (site/apps/name) without patterns of its own uses the site's.
+func (s SiteFilePatterns) For(site string) FilePatterns {
+    if p, ok := s[site]; ok {
+        return p
+    }
+    return s[strings.SplitN(site, "/", 2)[0]]
+}
+
+// Merge returns the patterns of p followed by those of other
+func (p FilePatterns) Merge(other FilePatterns) FilePatterns {
+    return FilePatterns{
+        Excludes:       append(append([]string(nil), p.Excludes...), other.Excludes...),
+        Includes:       append(append([]string(nil), p.Includes...), other.Includes...),
+        FollowSymlinks: append(append([]string(nil), p.FollowSymlinks...), other.FollowSymlinks...),
+        ExtraPaths:     append(append([]string(nil), p.ExtraPaths...), other.ExtraPaths...),
+    }
+}
+
+// filePattern is a compiled pattern. Paths are matched as "./<relative path>".
+type filePattern struct {
+    // self matches the path itself, below matches paths inside a matching directory
+    self    string
+    below   string
+    dirOnly bool
+}
+
+// compilePattern translates a .gitignore style pattern into regular expressions
+func compilePattern(pattern string) (filePattern, error) {
+    p := strings.TrimSpace(pattern)
+    dirOnly := strings.HasSuffix(p, "/")
+    anchored := strings.Contains(strings.TrimSuffix(p, "/"), "/")
+    p = strings.Trim(p, "/")
+    if p == "" {
+        return filePattern{}, fmt.Errorf("empty pattern %q", pattern)
+    }
+
+    var body strings.Builder
+    for _, segment := range strings.Split(p, "/") {
+        if segment == "**" {
+            body.WriteString("(/[^/]+)*")
+            continue
+        }
+        re, err := globSegment(segment)
+        if err != nil {
+            return filePattern{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+        }
+        body.WriteString("/" + re)
+    }
+
+    prefix := `^.*`
+    if anchored {
+        prefix = `^\.`
+    }
+    fp := filePattern{
+        self:    prefix + body.String() + "$",
+        below:   prefix + body.String() + "/.+$",
+        dirOnly: dirOnly,
+    }
+    if _, err := regexp.Compile(fp.self); err != nil {
+        return filePattern{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+    }
+    return fp, nil
+}
+
+// globSegment translates a glob matching a single name into a regular
+// expression understood by both Go and POSIX extended regular expressions
+func globSegment(glob string) (string, error) {
+    var re strings.Builder
+    for i := 0; i < len(glob); i++ {
+        c := glob[i]
+        switch c {
+        case '*':
+            re.WriteString("[^/]*")
+        case '?':
+            re.WriteString("[^/]")
+        case '[':
+            end := strings.IndexByte(glob[i+1:], ']')
+            if end < 0 {
+                return "", fmt.Errorf("unterminated character class")
+            }
+            class := glob[i+1 : i+1+end]
+            if strings.HasPrefix(class, "!") {
+                class = "^" + class[1:]
+            }
+            re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+            i += end + 1
+        case '\\':
+            if i+1 < len(glob) {
+                i++
+                re.WriteString(regexp.QuoteMeta(string(glob[i])))
+            }
+        default:
+            re.WriteString(regexp.QuoteMeta(string(c)))
+        }
+    }
+    return re.String(), nil
+}
+
+// FileFilter decides which files of a document root are archived
+type FileFilter struct {
+    excludes []filePattern
+    includes []filePattern
+    // compiled expressions by source, shared by the patterns
+    matchers map[string]*regexp.Regexp
+    follow   []string
+    extra    []string
+}
+
+// Filter compiles the patterns
+func (p FilePatterns) Filter() (*FileFilter, error) {
+    f := &FileFilter{matchers: make(map[string]*regexp.Regexp)}
+    for _, dir := range p.FollowSymlinks {
+        if strings.TrimSpace(dir) == "" {
+            return nil, fmt.Errorf("empty follow_symlinks directory")
+        }
+        f.follow = append(f.follow, strings.TrimSpace(dir))
+    }
+    for _, extra := range p.ExtraPaths {
+        // Paths on Windows keep their drive, with slashes
+        dir := path.Clean(filepath.ToSlash(strings.TrimSpace(extra)))
+        root := filepath.VolumeName(dir) + "/"
+        if !strings.HasPrefix(dir, root) || dir == root {
+            return nil, fmt.Errorf("extra path %q is not an absolute path below %s", extra, root)
+        }
+        for _, other := range f.extra {
+            if other == dir || strings.HasPrefix(dir, other+"/") || strings.HasPrefix(other, dir+"/") {
+                return nil, fmt.Errorf("extra paths %s and %s overlap", other, dir)
+            }
+        }
+        f.extra = append(f.extra, dir)
+    }
+    add := func(list *[]filePattern, pattern string) error {
+        fp, err := compilePattern(pattern)
+        if err != nil {
+            return err
+        }
+        for _, expr := range []string{fp.self, fp.below} {
+            if f.matchers[expr] == nil {
+                f.matchers[expr] = regexp.MustCompile(expr)
+            }
+        }
+        *list = append(*list, fp)
+        return nil
+    }
+    for _, pattern := range p.Excludes {
+        var err error
+        if strings.HasPrefix(pattern, "!") {
+            err = add(&f.includes, pattern[1:])
+        } else {
+            err = add(&f.excludes, pattern)
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+    for _, pattern := range p.Includes {
+        if err := add(&f.includes, pattern); err != nil {
+            return nil, err
+        }
+    }
+    return f, nil
+}
+
+// validate reports the first invalid pattern
+func (p FilePatterns) validate() error {
+    _, err := p.Filter()
+    return err
+}
+
+// matches reports whether a path or a directory above it matches any pattern
+func (f *FileFilter) matches(patterns []filePattern, path string, isDir bool) bool {
+    for _, fp := range patterns {
+        if f.matchers[fp.below].MatchString(path) {
+            return true
+        }
+        if (!fp.dirOnly || isDir) && f.matchers[fp.self].MatchString(path) {
+            return true
+        }
+    }
+    return false
+}
+
+// Excluded reports whether a path relative to the document root is left out
+func (f *FileFilter) Excluded(rel string, isDir bool) bool {
+    path := "./" + strings.TrimPrefix(strings.ReplaceAll(rel, `\`, "/"), "./")
+    return f.matches(f.excludes, path, isDir) && !f.matches(f.includes, path, isDir)
+}
+
+// FollowSymlinks returns the directories symlinks pointing into are followed,
+// absolute or relative to the document root
+func (f *FileFilter) FollowSymlinks() []string {
+    return f.follow
+}
+
+// ExtraPaths returns the absolute paths outside the document root that are
+// archived with it
+func (f *FileFilter) ExtraPaths() []string {
+    return f.extra
+}
+
+// Prunes reports whether excluded directories can be skipped entirely,
+// which is the case unless includes could bring back files below them
+func (f *FileFilter) Prunes() bool {
+    return len(f.includes) == 0
+}
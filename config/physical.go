@@ -0,0 +1,87 @@
+package config
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Methods of backing up MySQL and MariaDB databases
+const (
+    DBBackupLogical  = "logical"
+    DBBackupPhysical = "physical"
+)
+
+// DefaultPhysicalFullEvery is the age of the last full physical backup from
+// which the next one is full again
+const DefaultPhysicalFullEvery = 7 * 24 * time.Hour
+
+// PhysicalBackupConfig selects how the MySQL and MariaDB databases of local
+// sites are backed up: logical dumps with mysqldump, or physical backups of
+// the InnoDB data files with mariabackup or xtrabackup, a full backup every
+// FullEvery and incremental ones in between. Physical backups need the
+// database server to run on this machine.
+type PhysicalBackupConfig struct {
+    // Method of every site, logical or physical
+    Method string `yaml:"db_backup_method"`
+    // Sites whose method differs
+    Sites map[string]PhysicalSiteConfig `yaml:"sites,omitempty"`
+    // mariabackup or xtrabackup binary, the first of them installed if empty
+    Binary string `yaml:"binary,omitempty"`
+    // Age of the last full backup from which the next one is full again
+    FullEvery time.Duration `yaml:"full_every"`
+}
+
+// PhysicalSiteConfig is the database backup method of one site
+type PhysicalSiteConfig struct {
+    Method string `yaml:"db_backup_method"`
+}
+
+// For returns the database backup method of a site. An application of a
+// multi-app site (site/apps/name) without a setting of its own follows the
+// site's.
+func (p PhysicalBackupConfig) For(site string) string {
+    for _, name := range []string{site, strings.SplitN(site, "/", 2)[0]} {
+        if s, ok := p.Sites[name]; ok && s.Method != "" {
+            return s.Method
+        }
+    }
+    return p.Method
+}
+
+// validate checks the methods, the binary and the interval of full backups
+func (p PhysicalBackupConfig) validate() error {
+    methods := []string{p.Method}
+    for site, s := range p.Sites {
+        if s.Method == "" {
+            return fmt.Errorf("physical_backups site %s needs db_backup_method", site)
+        }
+        methods = append(methods, s.Method)
+    }
+    for _, method := range methods {
+        if method != DBBackupLogical && method != DBBackupPhysical {
+            return fmt.Errorf("unknown db_backup_method %q, use logical or physical", method)
+        }
+    }
+    if name := filepath.Base(p.Binary); p.Binary != "" && !strings.Contains(name, "mariabackup") && !strings.Contains(name, "xtrabackup") {
+        return fmt.Errorf("physical_backups binary must be mariabackup or xtrabackup, got %q", p.Binary)
+    }
+    if p.FullEvery <= 0 {
+        return fmt.Errorf("physical_backups full_every must be positive")
+    }
+    return nil
+}
+
+// uses reports whether any site is backed up physically
+func (p PhysicalBackupConfig) uses() bool {
+    if p.Method == DBBackupPhysical {
+        return true
+    }
+    for _, s := range p.Sites {
+        if s.Method == DBBackupPhysical {
+            return true
+        }
+    }
+    return false
+}
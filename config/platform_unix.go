@@ -0,0 +1,21 @@
+//go:build !windows
+
+package config
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "syscall"
+)
+
+// openNoFollow opens a file for reading unless it is a symlink. A named
+// pipe is opened without waiting for a writer, so the caller's check of the
+// opened file can refuse it.
+func openNoFollow(path string) (*os.File, error) {
+    f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+    if errors.Is(err, syscall.ELOOP) {
+        return nil, fmt.Errorf("%s is a symlink", path)
+    }
+    return f, err
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+    "fmt"
+    "os"
+)
+
+// openNoFollow opens a file for reading unless it is a symlink. Windows has
+// no O_NOFOLLOW, so the path is checked first and the opened file must be
+// the one that was checked.
+func openNoFollow(path string) (*os.File, error) {
+    info, err := os.Lstat(path)
+    if err != nil {
+        return nil, err
+    }
+    if info.Mode()&os.ModeSymlink != 0 {
+        return nil, fmt.Errorf("%s is a symlink", path)
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    opened, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, err
+    }
+    if !os.SameFile(info, opened) {
+        f.Close()
+        return nil, fmt.Errorf("%s was replaced while it was opened", path)
+    }
+    return f, nil
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "os/exec"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// pleskSitesQuery selects the domains with hosting and their document roots
+// from Plesk's psa database
+const pleskSitesQuery = "SELECT d.name, h.www_root FROM domains d JOIN hosting h ON h.dom_id = d.id WHERE d.htype = 'vrt_hst' ORDER BY d.name"
+
+// pleskWWWRootRegex matches the document root in the output of plesk bin site --info
+var pleskWWWRootRegex = regexp.MustCompile(`(?im)^\s*WWW-Root:\s*(\S.*?)\s*$`)
+
+// ParsePleskVhosts lists the sites of a Plesk server with the plesk command
+// at pleskBin. The domains with hosting and their document roots are read
+// from the psa database through plesk db. If that fails, e.g. on versions
+// with another schema, every site of plesk bin site --list is looked up
+// with plesk bin site --info.
+func ParsePleskVhosts(pleskBin string) ([]Vhost, error) {
+    output, err := exec.Command(pleskBin, "db", "-B", "-N", "-e", pleskSitesQuery).Output()
+    if err == nil {
+        return parsePleskSites(output), nil
+    }
+    queryErr := commandError(err)
+
+    output, err = exec.Command(pleskBin, "bin", "site", "--list").Output()
+    if err != nil {
+        return nil, fmt.Errorf("failed to list Plesk sites: psa database: %v, plesk bin site: %v", queryErr, commandError(err))
+    }
+    var vhosts []Vhost
+    for _, name := range strings.Fields(string(output)) {
+        info, err := exec.Command(pleskBin, "bin", "site", "--info", name).Output()
+        if err != nil {
+            return nil, fmt.Errorf("failed to read Plesk site %s: %v", name, commandError(err))
+        }
+        // Sites without hosting, such as forwarding, have no document root
+        if m := pleskWWWRootRegex.FindSubmatch(info); m != nil {
+            vhosts = append(vhosts, Vhost{ServerName: name, DocumentRoot: string(m[1])})
+        }
+    }
+    return vhosts, nil
+}
+
+// parsePleskSites reads the tab-separated domains and document roots of
+// the psa query
+func parsePleskSites(output []byte) []Vhost {
+    var vhosts []Vhost
+    scanner := bufio.NewScanner(bytes.NewReader(output))
+    for scanner.Scan() {
+        fields := strings.Split(scanner.Text(), "\t")
+        if len(fields) != 2 || fields[0] == "" || fields[1] == "" || fields[1] == "NULL" {
+            continue
+        }
+        vhosts = append(vhosts, Vhost{ServerName: fields[0], DocumentRoot: fields[1]})
+    }
+    sort.Slice(vhosts, func(i, j int) bool {
+        return vhosts[i].ServerName < vhosts[j].ServerName
+    })
+    return vhosts
+}
+
+// commandError adds the error output of a failed command to its error
+func commandError(err error) error {
+    if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+        return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+    }
+    return err
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "gopkg.in/yaml.v3"
+)
+
+// ProfileEnv names the profile LoadConfig selects; --profile sets it
+const ProfileEnv = "BACKUP_PROFILE"
+
+// ProfilesDirName is the directory next to backup.yaml holding a
+// configuration file per profile
+const ProfilesDirName = "profiles"
+
+// profileNameRegex matches profile names, which become part of paths
+var profileNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// profileDirs are the backup directories a profile sets itself
+type profileDirs struct {
+    Local struct {
+        BackupDir string `yaml:"backup_dir"`
+    } `yaml:"local"`
+    Remote struct {
+        BackupDir string `yaml:"backup_dir"`
+    } `yaml:"remote"`
+}
+
+// ValidateProfileName checks that a profile name can be used in paths
+func ValidateProfileName(name string) error {
+    if !profileNameRegex.MatchString(name) {
+        return fmt.Errorf("invalid profile name %q, use letters, digits, - and _", name)
+    }
+    return nil
+}
+
+// ProfileFile returns the file of a profile, profiles/<name>.yaml next to
+// the configuration file. Without a configuration file the directories of
+// ConfigSearchPaths are tried. Empty if there is no such file.
+func ProfileFile(name string) string {
+    if base := ConfigFile(); base != "" {
+        return filepath.Join(filepath.Dir(base), ProfilesDirName, name+".yaml")
+    }
+    for _, candidate := range ConfigSearchPaths {
+        path := filepath.Join(filepath.Dir(candidate), ProfilesDirName, name+".yaml")
+        if _, err := os.Stat(path); err == nil {
+            return path
+        }
+    }
+    return ""
+}
+
+// ProfileNames returns the names of the profiles in the configuration file
+// and in the profiles directory next to it, sorted
+func ProfileNames() ([]string, error) {
+    seen := map[string]bool{}
+    dirs := []string{}
+    if base := ConfigFile(); base != "" {
+        data, err := os.ReadFile(base)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read configuration file: %v", err)
+        }
+        var file struct {
+            Profiles map[string]yaml.Node `yaml:"profiles"`
+        }
+        if err := yaml.Unmarshal(data, &file); err != nil {
+            return nil, fmt.Errorf("unable to parse configuration file %s: %v", base, err)
+        }
+        for name := range file.Profiles {
+            seen[name] = true
+        }
+        dirs = append(dirs, filepath.Join(filepath.Dir(base), ProfilesDirName))
+    } else {
+        for _, candidate := range ConfigSearchPaths {
+            dirs = append(dirs, filepath.Join(filepath.Dir(candidate), ProfilesDirName))
+        }
+    }
+    for _, dir := range dirs {
+        files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+        for _, file := range files {
+            seen[strings.TrimSuffix(filepath.Base(file), ".yaml")] = true
+        }
+    }
+
+    names := make([]string, 0, len(seen))
+    for name := range seen {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+// selectProfile applies a profile to the configuration read from the
+// configuration file. A section of the file's profiles overrides the file's
+// settings; a profile file is a configuration of its own on top of the
+// defaults. It returns the backup directories the profile sets itself.
+func (c *Config) selectProfile(name string) (profileDirs, error) {
+    var own profileDirs
+    if err := ValidateProfileName(name); err != nil {
+        return own, err
+    }
+    c.Profile = name
+
+    if section, ok := c.Profiles[name]; ok {
+        if err := section.Decode(&own); err != nil {
+            return own, fmt.Errorf("unable to parse profile %s in %s: %v", name, c.Path, err)
+        }
+        if err := section.Decode(c); err != nil {
+            return own, fmt.Errorf("unable to parse profile %s in %s: %v", name, c.Path, err)
+        }
+        return own, nil
+    }
+
+    path := ProfileFile(name)
+    if path == "" {
+        return own, fmt.Errorf("profile %s not found, add it to the profiles of backup.yaml or as %s/%s.yaml", name, ProfilesDirName, name)
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return own, fmt.Errorf("profile %s not found, neither in the profiles of %s nor as %s", name, c.Path, path)
+    }
+    if err != nil {
+        return own, fmt.Errorf("unable to read profile %s: %v", name, err)
+    }
+    profile := DefaultConfig()
+    if err := yaml.Unmarshal(data, profile); err != nil {
+        return own, fmt.Errorf("unable to parse profile file %s: %v", path, err)
+    }
+    if err := yaml.Unmarshal(data, &own); err != nil {
+        return own, fmt.Errorf("unable to parse profile file %s: %v", path, err)
+    }
+    profile.Path, profile.Profile = path, name
+    *c = *profile
+    return own, nil
+}
+
+// isolateProfile gives the profile backup directories of its own, and with
+// them its own catalogs, locks, queues and run logs. A directory the profile
+// doesn't set is the one of the default configuration with -<name>
+// appended; one it sets wins over the environment.
+func (c *Config) isolateProfile(own profileDirs) {
+    for _, dir := range []struct {
+        target *string
+        own    string
+    }{
+        {&c.Local.BackupDir, own.Local.BackupDir},
+        {&c.Remote.BackupDir, own.Remote.BackupDir},
+    } {
+        if dir.own != "" {
+            *dir.target = dir.own
+        } else {
+            *dir.target = filepath.Clean(*dir.target) + "-" + c.Profile
+        }
+    }
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+    "fmt"
+)
+
+// Storages remote servers push their archives to
+const (
+    PushS3   = "s3"
+    PushSFTP = "sftp"
+)
+
+// DefaultPushRclone is the rclone binary run on the remote servers
+const DefaultPushRclone = "rclone"
+
+// PushConfig makes remote servers upload their file archives and database
+// dumps straight to off-server storage with rclone instead of sending them
+// to this machine, which only records where they went, their size and
+// their checksum. The credentials are copied to the server for the run and
+// removed after it.
+type PushConfig struct {
+    Enabled bool `yaml:"enabled"`
+    // s3, the bucket of the s3 section, or sftp
+    Target string `yaml:"target"`
+    // rclone binary on the remote servers
+    Rclone string           `yaml:"rclone"`
+    SFTP   PushSFTPSettings `yaml:"sftp"`
+}
+
+// PushSFTPSettings describes the SFTP server remote servers push archives
+// to. The password is better kept in the keyring as PUSH_SFTP_PASSWORD; a
+// key file is read on this machine and copied to the server for the run.
+type PushSFTPSettings struct {
+    Host     string `yaml:"host,omitempty"`
+    Port     string `yaml:"port,omitempty"`
+    User     string `yaml:"user,omitempty"`
+    Password string `yaml:"password,omitempty"`
+    KeyFile  string `yaml:"key_file,omitempty"`
+    // Directory the archives are stored below, relative to the login directory
+    Dir      string `yaml:"dir,omitempty"`
+}
+
+// validate checks that the target is configured and that nothing is
+// enabled that needs the archives on this machine
+func (p PushConfig) validate(c *Config) error {
+    if !p.Enabled {
+        return nil
+    }
+    switch p.Target {
+    case PushS3:
+        if c.S3.Bucket == "" {
+            return fmt.Errorf("remote push to s3 needs the s3 bucket")
+        }
+    case PushSFTP:
+        if p.SFTP.Host == "" || p.SFTP.User == "" {
+            return fmt.Errorf("remote push to sftp needs push sftp host and user")
+        }
+    default:
+        return fmt.Errorf("unknown remote push target %q, use s3 or sftp", p.Target)
+    }
+    if p.Rclone == "" {
+        return fmt.Errorf("remote push rclone must not be empty")
+    }
+    if c.Remote.Transport == TransportRsync {
+        return fmt.Errorf("remote push can't be combined with the rsync transport")
+    }
+    if c.Encryption.Enabled {
+        return fmt.Errorf("remote push can't encrypt archives, disable encryption or push")
+    }
+    return nil
+}
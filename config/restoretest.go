@@ -0,0 +1,23 @@
+package config
+
+import "fmt"
+
+// DefaultRestoreTestPHP is the PHP binary restored applications are booted with
+const DefaultRestoreTestPHP = "php"
+
+// RestoreTestConfig controls the test-restore command, which restores the
+// latest backups of sites into a scratch directory and a throwaway database
+// to prove they can be restored
+type RestoreTestConfig struct {
+    // PHP binary that runs the restored application's artisan, e.g.
+    // /opt/cpanel/ea-php82/root/usr/bin/php on panels with several versions
+    PHP string `yaml:"php"`
+}
+
+// validate checks that a PHP binary is set
+func (r RestoreTestConfig) validate() error {
+    if r.PHP == "" {
+        return fmt.Errorf("restore_tests php must not be empty")
+    }
+    return nil
+}
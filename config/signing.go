@@ -0,0 +1,30 @@
+package config
+
+import "fmt"
+
+// SigningConfig controls ed25519 signatures of the checksum files of
+// archives and of the checksum manifests, so archives altered on storage
+// off the server are detected by verify and restore. Archives are signed
+// with the private key; machines that only verify or restore need the
+// public key.
+type SigningConfig struct {
+    // PKCS#8 PEM private key, as produced by `openssl genpkey -algorithm ed25519`
+    KeyFile string `yaml:"key_file"`
+    // PKIX PEM public key, used if there is no private key
+    PublicKeyFile string `yaml:"public_key_file"`
+    // Archives without a signature fail verification
+    Required bool `yaml:"required"`
+}
+
+// Enabled reports whether signatures are made or checked
+func (s SigningConfig) Enabled() bool {
+    return s.KeyFile != "" || s.PublicKeyFile != ""
+}
+
+// validate checks that required signatures can be checked
+func (s SigningConfig) validate() error {
+    if s.Required && !s.Enabled() {
+        return fmt.Errorf("signing required needs a key_file or public_key_file")
+    }
+    return nil
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net/mail"
+    "os"
+    "path/filepath"
+    "gopkg.in/yaml.v3"
+)
+
+// DefaultSiteOverridesFile is the file in a document root site owners put
+// their backup settings in
+const DefaultSiteOverridesFile = ".backupconfig.yaml"
+
+// maxSiteOverridesSize limits how much of a site owner's file is read
+const maxSiteOverridesSize = 64 << 10
+
+// When site owners are notified of the backups of their site
+const (
+    NotifyOnFailure = "failure"
+    NotifyAlways    = "always"
+)
+
+// SiteOverridesConfig controls whether the settings site owners put in
+// their document root are merged with this configuration
+type SiteOverridesConfig struct {
+    Enabled bool `yaml:"enabled"`
+    // Name of the file in the document root
+    File string `yaml:"file"`
+}
+
+// validate checks that the file is a plain file name
+func (s SiteOverridesConfig) validate() error {
+    if s.File == "" || s.File != filepath.Base(s.File) || s.File == "." || s.File == ".." {
+        return fmt.Errorf("site_overrides file must be a file name, got %q", s.File)
+    }
+    return nil
+}
+
+// SiteOverride holds the backup settings a site owner may set in the
+// document root. They are merged with the administrator's settings by
+// Config.WithSiteOverrides.
+type SiteOverride struct {
+    // Patterns of files left out of file archives. Owners can't add
+    // includes, which could bring back what the administrator excludes.
+    Excludes []string `yaml:"excludes,omitempty"`
+    // Cron expression of the site's backups
+    Schedule  string        `yaml:"schedule,omitempty"`
+    Retention SiteRetention `yaml:"retention,omitempty"`
+    // Tables left out of the database dump, e.g. sessions
+    ExcludeTables []string `yaml:"exclude_tables,omitempty"`
+    // Addresses sent the report of the site's backups
+    Notify []string `yaml:"notify,omitempty"`
+    // NotifyOnFailure (default) or NotifyAlways
+    NotifyOn string `yaml:"notify_on,omitempty"`
+}
+
+// LoadSiteOverride reads the settings file in a document root. It returns
+// nil without error if there is none. Only a regular file is read, so a
+// site owner can't make the tool read other files through a symlink. The
+// file is checked once it is open, so it can't be swapped for a symlink
+// after the check.
+func LoadSiteOverride(documentRoot, name string) (*SiteOverride, error) {
+    path := filepath.Join(documentRoot, name)
+    f, err := openNoFollow(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    if !info.Mode().IsRegular() {
+        return nil, fmt.Errorf("%s is not a regular file", path)
+    }
+    data, err := io.ReadAll(io.LimitReader(f, maxSiteOverridesSize+1))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    if len(data) > maxSiteOverridesSize {
+        return nil, fmt.Errorf("%s is larger than %d bytes", path, maxSiteOverridesSize)
+    }
+
+    var override SiteOverride
+    decoder := yaml.NewDecoder(bytes.NewReader(data))
+    decoder.KnownFields(true)
+    if err := decoder.Decode(&override); err != nil && err != io.EOF {
+        return nil, fmt.Errorf("invalid %s: %v", path, err)
+    }
+    if err := override.validate(); err != nil {
+        return nil, fmt.Errorf("invalid %s: %v", path, err)
+    }
+    return &override, nil
+}
+
+// validate checks the excludes, schedule, retention, tables and addresses
+func (o SiteOverride) validate() error {
+    if err := (FilePatterns{Excludes: o.Excludes}).validate(); err != nil {
+        return err
+    }
+    if o.Schedule != "" {
+        if err := validateSchedule(o.Schedule); err != nil {
+            return fmt.Errorf("schedule: %v", err)
+        }
+    }
+    if err := (Retention{Sites: map[string]SiteRetention{"site": o.Retention}}).validate(); err != nil {
+        return err
+    }
+    if err := (MySQLDumpOptions{ExcludeTables: o.ExcludeTables}).validate(); err != nil {
+        return err
+    }
+    for _, address := range o.Notify {
+        if _, err := mail.ParseAddress(address); err != nil {
+            return fmt.Errorf("invalid notify address %q", address)
+        }
+    }
+    switch o.NotifyOn {
+    case "", NotifyOnFailure, NotifyAlways:
+    default:
+        return fmt.Errorf("unknown notify_on %q, use failure or always", o.NotifyOn)
+    }
+    return nil
+}
+
+// WithSiteOverrides returns a copy of the configuration with the settings
+// of site owners merged in. Their excludes and excluded tables
+// are added to the administrator's; their schedule and retention apply
+// unless backup.yaml sets them for the site. The configuration itself is
+// left unchanged.
+func (c *Config) WithSiteOverrides(overrides map[string]*SiteOverride) *Config {
+    merged := *c
+    merged.SiteFiles = make(SiteFilePatterns, len(c.SiteFiles))
+    for site, p := range c.SiteFiles {
+        merged.SiteFiles[site] = p
+    }
+    merged.SiteSchedules = make(map[string]string, len(c.SiteSchedules))
+    for site, expr := range c.SiteSchedules {
+        merged.SiteSchedules[site] = expr
+    }
+    merged.Local.Retention.Sites = make(map[string]SiteRetention, len(c.Local.Retention.Sites))
+    for site, r := range c.Local.Retention.Sites {
+        merged.Local.Retention.Sites[site] = r
+    }
+    merged.MySQLDump.Sites = make(map[string]MySQLDumpOptions, len(c.MySQLDump.Sites))
+    for site, o := range c.MySQLDump.Sites {
+        merged.MySQLDump.Sites[site] = o
+    }
+    merged.SiteNotify = make(map[string]SiteOverride, len(overrides))
+
+    for site, o := range overrides {
+        if len(o.Excludes) > 0 {
+            merged.SiteFiles[site] = c.SiteFiles[site].Merge(FilePatterns{Excludes: o.Excludes})
+        }
+        if _, ok := c.SiteSchedules[site]; !ok && o.Schedule != "" {
+            merged.SiteSchedules[site] = o.Schedule
+        }
+        if r := c.Local.Retention.Sites[site]; !r.File.Enabled() && !r.Database.Enabled() &&
+            (o.Retention.File.Enabled() || o.Retention.Database.Enabled()) {
+            merged.Local.Retention.Sites[site] = o.Retention
+        }
+        if len(o.ExcludeTables) > 0 {
+            options := c.MySQLDump.Sites[site]
+            options.ExcludeTables = append(append([]string(nil), options.ExcludeTables...), o.ExcludeTables...)
+            merged.MySQLDump.Sites[site] = options
+        }
+        if len(o.Notify) > 0 {
+            merged.SiteNotify[site] = SiteOverride{Notify: o.Notify, NotifyOn: o.NotifyOn}
+        }
+    }
+    return &merged
+}
@@ -0,0 +1,37 @@
+package config
+
+import "fmt"
+
+// Web servers whose configuration can be parsed for sites, and control
+// panels that list their sites themselves
+const (
+    WebServerApache    = "apache"
+    WebServerNginx     = "nginx"
+    WebServerLiteSpeed = "litespeed"
+    WebServerPlesk     = "plesk"
+    WebServerCPanel    = "cpanel"
+    WebServerIIS       = "iis"
+)
+
+// ParseVhosts extracts the sites from the configuration of the given web
+// server: the Apache configuration file or the Nginx or OpenLiteSpeed
+// configuration directory, or IIS's appcmd.exe, or from a control panel: the
+// plesk command or the cPanel userdata directory
+func ParseVhosts(webServer, configPath string) ([]Vhost, error) {
+    switch webServer {
+    case WebServerApache:
+        return ParseApacheVhosts(configPath)
+    case WebServerNginx:
+        return ParseNginxVhosts(configPath)
+    case WebServerPlesk:
+        return ParsePleskVhosts(configPath)
+    case WebServerCPanel:
+        return ParseCPanelVhosts(configPath)
+    case WebServerLiteSpeed:
+        return ParseLiteSpeedVhosts(configPath)
+    case WebServerIIS:
+        return ParseIISVhosts(configPath)
+    default:
+        return nil, fmt.Errorf("unknown web server %q", webServer)
+    }
+}
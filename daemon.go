@@ -0,0 +1,427 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "fmt"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "slices"
+    "sort"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "laravel-backup-tool/backuptool"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/report"
+    "laravel-backup-tool/scheduler"
+)
+
+// shutdown is closed when the daemon is asked to stop. Runs in progress then
+// start no further jobs or sites; interrupted local runs are resumed later.
+var shutdown = make(chan struct{})
+
+// abort is cancelled when running backups must end at once: their remote
+// commands are killed and partially written archives removed
+var abort, abortRuns = context.WithCancelCause(context.Background())
+
+// metricsTool is the tool whose backup directories the metrics server reads.
+// Scrapes are served while the daemon's loop reloads the configuration, so
+// they never read the tool and cfg the reload replaces.
+var metricsTool atomic.Pointer[backuptool.Tool]
+
+// runContext returns the context of a backup run, which is cancelled when
+// backups are aborted or the run exceeds the configured run timeout
+func runContext() (context.Context, context.CancelFunc) {
+    if cfg.Timeouts.Run > 0 {
+        return context.WithTimeoutCause(abort, cfg.Timeouts.Run, fmt.Errorf("run timeout of %s exceeded", cfg.Timeouts.Run))
+    }
+    return context.WithCancel(abort)
+}
+
+// abortOnSignal aborts the running backups on SIGTERM or SIGINT and exits
+// on a second signal. It is used for runs started from the command line;
+// the daemon stops gracefully first.
+func abortOnSignal() {
+    signals := make(chan os.Signal, 2)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    go func() {
+        sig := <-signals
+        slog.Warn("Aborting the running backups", "signal", sig.String())
+        abortRuns(fmt.Errorf("aborted by %s", sig))
+        <-signals
+        slog.Warn("Received second signal, exiting immediately")
+        os.Exit(1)
+    }()
+}
+
+// shuttingDown reports whether shutdown was requested
+func shuttingDown() bool {
+    select {
+    case <-shutdown:
+        return true
+    default:
+        return false
+    }
+}
+
+// configPollInterval is how often the daemon checks the configuration file
+// for changes
+const configPollInterval = 10 * time.Second
+
+// scheduledTask is a command the daemon runs on a schedule
+type scheduledTask struct {
+    name     string
+    schedule *scheduler.Schedule
+    run      func() error
+    next     time.Time
+    // resume continues a failed backup run where it failed, at resumeAt if
+    // set; nil for tasks that aren't backups
+    resume   func() error
+    resumeAt time.Time
+}
+
+// due returns when the task runs next, or is resumed
+func (task *scheduledTask) due() time.Time {
+    if !task.resumeAt.IsZero() && task.resumeAt.Before(task.next) {
+        return task.resumeAt
+    }
+    return task.next
+}
+
+// scheduleResume schedules resuming the task after it failed, unless
+// resuming is disabled or the task is due again before
+func (task *scheduledTask) scheduleResume(err error) {
+    task.resumeAt = time.Time{}
+    if err == nil || task.resume == nil || cfg.Retry.ResumeAfter <= 0 {
+        return
+    }
+    if at := time.Now().Add(cfg.Retry.ResumeAfter); at.Before(task.next) {
+        task.resumeAt = at
+        slog.Info("Resuming failed task later", "task", task.name, "resume_at", at)
+    }
+}
+
+// runDaemon runs the configured schedules until SIGTERM or SIGINT. Tasks run
+// one at a time; a task that is due while another one runs starts afterwards,
+// and runs missed meanwhile are skipped. On the first signal the running task
+// is stopped after its running jobs, a second signal aborts it and a third
+// exits immediately. Changes to the configuration file, or SIGHUP, reload the
+// configuration between tasks.
+func runDaemon() error {
+    tasks, err := scheduledTasks()
+    if err != nil {
+        return err
+    }
+    if len(tasks) == 0 {
+        return fmt.Errorf("no schedules configured, add schedules or site_schedules to backup.yaml")
+    }
+
+    signals := make(chan os.Signal, 3)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    go func() {
+        sig := <-signals
+        slog.Info("Stopping after the running jobs", "signal", sig.String())
+        close(shutdown)
+        sig = <-signals
+        slog.Warn("Received second signal, aborting the running backups")
+        abortRuns(fmt.Errorf("aborted by %s", sig))
+        <-signals
+        slog.Warn("Received third signal, exiting immediately")
+        os.Exit(1)
+    }()
+
+    var metrics *http.Server
+    metricsTool.Store(tool)
+    if cfg.Metrics.Listen != "" {
+        if metrics, err = serveMetrics(cfg.Metrics.Listen); err != nil {
+            return err
+        }
+    }
+    defer func() {
+        if metrics != nil {
+            metrics.Close()
+        }
+    }()
+
+    reloads := make(chan struct{}, 1)
+    hangups := make(chan os.Signal, 1)
+    signal.Notify(hangups, syscall.SIGHUP)
+    go func() {
+        for range hangups {
+            slog.Info("Reloading the configuration", "signal", "hangup")
+            requestReload(reloads)
+        }
+    }()
+    if cfg.Path != "" {
+        go watchConfig(cfg.Path, reloads)
+    }
+
+    slog.Info("Backup daemon started", "pid", os.Getpid())
+    now := time.Now()
+    for _, task := range tasks {
+        task.next = task.schedule.Next(now)
+        slog.Info("Scheduled task", "task", task.name, "schedule", task.schedule.String(), "next_run", task.next)
+    }
+
+    for {
+        // Sleep at most a minute at a time, so clock changes are noticed
+        next := tasks[0].due()
+        for _, task := range tasks[1:] {
+            if task.due().Before(next) {
+                next = task.due()
+            }
+        }
+        wait := time.Until(next)
+        if wait > time.Minute {
+            wait = time.Minute
+        }
+        if wait > 0 {
+            timer := time.NewTimer(wait)
+            select {
+            case <-shutdown:
+                timer.Stop()
+                slog.Info("Backup daemon stopped")
+                return nil
+            case <-reloads:
+                timer.Stop()
+                tasks = reloadConfig(tasks, &metrics)
+                continue
+            case <-timer.C:
+            }
+        }
+
+        for _, task := range tasks {
+            if time.Now().Before(task.due()) {
+                continue
+            }
+            run, resuming := task.run, time.Now().Before(task.next)
+            if resuming {
+                run = task.resume
+                slog.Info("Resuming failed task", "task", task.name)
+            } else {
+                slog.Info("Starting scheduled task", "task", task.name)
+            }
+            err := run()
+            if err != nil {
+                slog.Error("Scheduled task failed", "task", task.name, "error", err)
+            }
+            if shuttingDown() {
+                slog.Info("Backup daemon stopped")
+                return nil
+            }
+            if !resuming {
+                task.next = task.schedule.Next(time.Now())
+            }
+            task.scheduleResume(err)
+            slog.Info("Finished scheduled task", "task", task.name, "next_run", task.next)
+        }
+    }
+}
+
+// serveMetrics serves the backup metrics at /metrics on addr. The metrics are
+// read from the backup directories on every scrape, so they include runs
+// started outside the daemon.
+func serveMetrics(addr string) (*http.Server, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen for metrics on %s: %v", addr, err)
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        var buf bytes.Buffer
+        if err := report.WriteMetrics(&buf, metricsTool.Load().ReportSources()); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        w.Write(buf.Bytes())
+    })
+    server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+    go func() {
+        if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+            slog.Error("Metrics server failed", "error", err)
+        }
+    }()
+    slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+    return server, nil
+}
+
+// scheduledTasks builds the tasks of the configured schedules. The "backup"
+// schedule is a full backup run, other names are commands with arguments,
+// and site schedules back up single local sites.
+func scheduledTasks() ([]*scheduledTask, error) {
+    var tasks []*scheduledTask
+
+    var names []string
+    for name := range cfg.Schedules {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        schedule, err := scheduler.Parse(cfg.Schedules[name])
+        if err != nil {
+            return nil, fmt.Errorf("schedule %s: %v", name, err)
+        }
+        args := strings.Fields(name)
+        if len(args) == 0 || args[0] == "daemon" || args[0] == "--daemon" {
+            return nil, fmt.Errorf("schedule %q is not a command", name)
+        }
+        task := &scheduledTask{name: name, schedule: schedule}
+        switch {
+        case name == "backup":
+            task.run = func() error { return runBackup(backuptool.Scope{}, 0) }
+            task.resume = func() error { return runBackup(backuptool.Scope{Resume: true}, 0) }
+        case args[0] == "backup" && !slices.Contains(args, "--force"):
+            task.run = func() error { return runCommand(args[0], args[1:]) }
+            task.resume = func() error { return runCommand(args[0], append(args[1:len(args):len(args)], "--resume")) }
+        default:
+            task.run = func() error { return runCommand(args[0], args[1:]) }
+        }
+        tasks = append(tasks, task)
+    }
+
+    // Schedules of site owners are read when the daemon starts or reloads
+    siteSchedules := tool.SiteSchedules()
+    var sites []string
+    for site := range siteSchedules {
+        sites = append(sites, site)
+    }
+    sort.Strings(sites)
+    for _, site := range sites {
+        schedule, err := scheduler.Parse(siteSchedules[site])
+        if err != nil {
+            return nil, fmt.Errorf("site schedule %s: %v", site, err)
+        }
+        site := site
+        tasks = append(tasks, &scheduledTask{
+            name:     "backup of " + site,
+            schedule: schedule,
+            run:      func() error { return runBackup(backuptool.Scope{Sites: []string{site}}, 0) },
+            resume:   func() error { return runBackup(backuptool.Scope{Sites: []string{site}, Resume: true}, 0) },
+        })
+    }
+    return tasks, nil
+}
+
+// requestReload asks the daemon to reload its configuration once the running
+// task is done
+func requestReload(reloads chan<- struct{}) {
+    select {
+    case reloads <- struct{}{}:
+    default:
+    }
+}
+
+// watchConfig requests a reload whenever the contents of the configuration
+// file change. The file is polled rather than watched, so it is also noticed
+// when an editor or a deployment replaces the file or a symlink to it. A file
+// that can't be read is checked again at the next poll.
+func watchConfig(path string, reloads chan<- struct{}) {
+    version := func() ([sha256.Size]byte, error) {
+        data, err := os.ReadFile(path)
+        return sha256.Sum256(data), err
+    }
+    last, err := version()
+    if err != nil {
+        slog.Warn("Unable to read the configuration file for changes", "path", path, "error", err)
+    }
+    ticker := time.NewTicker(configPollInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        current, err := version()
+        if err != nil || current == last {
+            continue
+        }
+        last = current
+        slog.Info("Configuration file changed, reloading", "path", path)
+        requestReload(reloads)
+    }
+}
+
+// reloadConfig loads the configuration again and applies it: the tool,
+// schedules, logging and metrics server are rebuilt from it. Tasks whose
+// schedule didn't change keep their next run. An invalid configuration, or
+// one that can't be applied, is logged and the previous one stays in effect.
+func reloadConfig(tasks []*scheduledTask, metrics **http.Server) []*scheduledTask {
+    next, err := config.LoadConfig()
+    if err != nil {
+        slog.Error("Keeping the previous configuration", "error", err)
+        return tasks
+    }
+
+    previous, previousTool := cfg, tool
+    rollback := func(err error) []*scheduledTask {
+        cfg, tool = previous, previousTool
+        slog.Error("Keeping the previous configuration", "error", err)
+        return tasks
+    }
+    cfg, tool = next, backuptool.New(next)
+    tool.Output, tool.Stop = os.Stdout, shutdown
+    reloaded, err := scheduledTasks()
+    if err != nil {
+        return rollback(err)
+    }
+    if len(reloaded) == 0 {
+        return rollback(fmt.Errorf("no schedules configured"))
+    }
+
+    // The new metrics server starts before the old one stops, so a port
+    // that is taken leaves the old one serving
+    var server *http.Server
+    if next.Metrics.Listen != previous.Metrics.Listen && next.Metrics.Listen != "" {
+        if server, err = serveMetrics(next.Metrics.Listen); err != nil {
+            return rollback(err)
+        }
+    }
+    if err := setupLogging(next); err != nil {
+        if server != nil {
+            server.Close()
+        }
+        return rollback(err)
+    }
+    if next.Metrics.Listen != previous.Metrics.Listen {
+        if *metrics != nil {
+            (*metrics).Close()
+        }
+        *metrics = server
+    }
+    metricsTool.Store(tool)
+
+    scheduled := make(map[string]*scheduledTask)
+    for _, task := range tasks {
+        scheduled[task.name] = task
+    }
+    now := time.Now()
+    for _, task := range reloaded {
+        if old, ok := scheduled[task.name]; ok && old.schedule.String() == task.schedule.String() {
+            task.next, task.resumeAt = old.next, old.resumeAt
+            continue
+        }
+        task.next = task.schedule.Next(now)
+        slog.Info("Scheduled task", "task", task.name, "schedule", task.schedule.String(), "next_run", task.next)
+    }
+    for _, task := range tasks {
+        if !containsTask(reloaded, task.name) {
+            slog.Info("Removed scheduled task", "task", task.name)
+        }
+    }
+    slog.Info("Configuration reloaded", "path", next.Path, "tasks", len(reloaded))
+    return reloaded
+}
+
+// containsTask reports whether tasks include a task of a name
+func containsTask(tasks []*scheduledTask, name string) bool {
+    for _, task := range tasks {
+        if task.name == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,50 @@
+package dedup
+
+// Chunks are cut where a gear rolling hash over the last 64 bytes has its top
+// avgBits bits clear, so boundaries depend on the content only and an
+// insertion changes the chunks around it but not the rest of the stream.
+// Chunks are between minChunkSize and maxChunkSize long, 1 MiB on average.
+const (
+    minChunkSize = 512 << 10
+    maxChunkSize = 8 << 20
+    avgBits      = 20
+)
+
+// gear maps every byte to a random 64 bit value. The table is derived from a
+// fixed seed, as chunk boundaries must never change between versions.
+var gear = func() [256]uint64 {
+    var table [256]uint64
+    state := uint64(0x6c62742d64656475)
+    for i := range table {
+        // splitmix64
+        state += 0x9e3779b97f4a7c15
+        z := state
+        z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+        z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+        table[i] = z ^ (z >> 31)
+    }
+    return table
+}()
+
+// cut returns the length of the first chunk of data. Without final, data
+// must hold at least maxChunkSize bytes; with final, data is the end of the
+// stream and is cut into chunks no longer than maxChunkSize.
+func cut(data []byte, final bool) int {
+    if len(data) <= minChunkSize {
+        return len(data)
+    }
+    end := len(data)
+    if end > maxChunkSize {
+        end = maxChunkSize
+    }
+    // The hash only depends on the last 64 bytes, so hashing can start
+    // shortly before the minimum size
+    var h uint64
+    for i := minChunkSize - 64; i < end; i++ {
+        h = h<<1 + gear[data[i]]
+        if i >= minChunkSize && h>>(64-avgBits) == 0 {
+            return i + 1
+        }
+    }
+    return end
+}
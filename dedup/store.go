@@ -0,0 +1,479 @@
+package dedup
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+    "github.com/klauspost/compress/zstd"
+    "laravel-backup-tool/encryption"
+)
+
+// StoreDirName is the directory of the chunk store in a backup directory.
+// Archive listings skip directories starting with an underscore.
+const StoreDirName = "_chunks"
+
+// IndexExt is the extension of the index of a deduplicated archive, which
+// lists the chunks of the archive's content in order
+const IndexExt = ".dedup"
+
+// indexVersion is the format version of index files
+const indexVersion = 1
+
+// Chunks are compressed with zstd; the coders are safe for concurrent use
+var (
+    encoder, _ = zstd.NewWriter(nil)
+    decoder, _ = zstd.NewReader(nil)
+)
+
+// Index lists the chunks of a deduplicated archive. KeyID names the key the
+// IDs of its chunks are derived from, empty if they aren't encrypted.
+// ChunkKey is the key of the IDs, sealed for the keyring the chunks are
+// encrypted to, so archives can be read without KeyID's key after a rotation.
+type Index struct {
+    Version  int        `json:"version"`
+    KeyID    string     `json:"key_id,omitempty"`
+    ChunkKey []byte     `json:"chunk_key,omitempty"`
+    Size     int64      `json:"size"`
+    Chunks   []ChunkRef `json:"chunks"`
+}
+
+// ChunkRef is a chunk of an archive: its ID and its uncompressed size
+type ChunkRef struct {
+    ID   string `json:"id"`
+    Size int    `json:"size"`
+}
+
+// IsIndex reports whether path is the index of a deduplicated archive
+func IsIndex(path string) bool {
+    return strings.HasSuffix(path, IndexExt)
+}
+
+// ReadIndex reads the index of a deduplicated archive
+func ReadIndex(path string) (*Index, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read index: %v", err)
+    }
+    var index Index
+    if err := json.Unmarshal(data, &index); err != nil {
+        return nil, fmt.Errorf("failed to parse index %s: %v", filepath.Base(path), err)
+    }
+    if index.Version != indexVersion {
+        return nil, fmt.Errorf("index %s has unsupported version %d", filepath.Base(path), index.Version)
+    }
+    return &index, nil
+}
+
+// Store is a directory of content-addressed chunks shared by the archives
+// of a backup directory. A chunk is stored once however many archives
+// contain it. With a keyring, chunks are encrypted and their IDs are keyed
+// hashes, so the names of chunks don't reveal their content.
+type Store struct {
+    dir    string
+    keys   *encryption.Keyring
+    macKey []byte
+}
+
+// OpenStore returns the chunk store of a backup directory. keys encrypts new
+// chunks and may be nil; the IDs of encrypted chunks are derived from its key.
+func OpenStore(baseDir string, keys *encryption.Keyring) *Store {
+    s := &Store{dir: filepath.Join(baseDir, StoreDirName), keys: keys}
+    if keys != nil && keys.Key != nil {
+        s.macKey = chunkIDKey(keys.Key)
+    }
+    return s
+}
+
+// chunkIDKey returns the key the IDs of chunks encrypted with key are derived from
+func chunkIDKey(key *encryption.Key) []byte {
+    mac := hmac.New(sha256.New, key[:])
+    mac.Write([]byte("laravel-backup-tool chunk id"))
+    return mac.Sum(nil)
+}
+
+// findStore returns the chunk store an index belongs to, the nearest
+// StoreDirName in the directories above it
+func findStore(indexPath string, keys *encryption.Keyring, macKey []byte) (*Store, error) {
+    dir := filepath.Dir(indexPath)
+    for {
+        if info, err := os.Stat(filepath.Join(dir, StoreDirName)); err == nil && info.IsDir() {
+            return &Store{dir: filepath.Join(dir, StoreDirName), keys: keys, macKey: macKey}, nil
+        }
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return nil, fmt.Errorf("no chunk store found for %s", indexPath)
+        }
+        dir = parent
+    }
+}
+
+// id returns the ID of a chunk's content
+func (s *Store) id(data []byte) string {
+    if s.macKey == nil {
+        sum := sha256.Sum256(data)
+        return hex.EncodeToString(sum[:])
+    }
+    mac := hmac.New(sha256.New, s.macKey)
+    mac.Write(data)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkPath returns where a chunk is stored, below a directory named after
+// the first two digits of its ID
+func (s *Store) chunkPath(id string) string {
+    return filepath.Join(s.dir, id[:2], id)
+}
+
+// put stores a chunk unless it is stored already and returns its ID and
+// whether it was new
+func (s *Store) put(data []byte) (string, bool, error) {
+    id := s.id(data)
+    path := s.chunkPath(id)
+    if _, err := os.Stat(path); err == nil {
+        return id, false, nil
+    }
+
+    content := encoder.EncodeAll(data, nil)
+    if s.keys != nil {
+        var buf bytes.Buffer
+        ew, err := encryption.NewWriter(&buf, s.keys)
+        if err != nil {
+            return "", false, err
+        }
+        ew.Write(content)
+        if err := ew.Close(); err != nil {
+            return "", false, fmt.Errorf("failed to encrypt chunk: %v", err)
+        }
+        content = buf.Bytes()
+    }
+
+    // Write next to the chunk and rename, so a chunk is either complete or
+    // missing, also when several backups store it at the same time
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return "", false, fmt.Errorf("failed to create chunk directory: %v", err)
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(path), id+".tmp-*")
+    if err != nil {
+        return "", false, fmt.Errorf("failed to create chunk: %v", err)
+    }
+    if _, err := tmp.Write(content); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return "", false, fmt.Errorf("failed to write chunk: %v", err)
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return "", false, fmt.Errorf("failed to write chunk: %v", err)
+    }
+    if err := os.Rename(tmp.Name(), path); err != nil {
+        os.Remove(tmp.Name())
+        return "", false, fmt.Errorf("failed to store chunk: %v", err)
+    }
+    return id, true, nil
+}
+
+// get reads a chunk and checks that its content matches its ID
+func (s *Store) get(ref ChunkRef) ([]byte, error) {
+    data, err := os.ReadFile(s.chunkPath(ref.ID))
+    if err != nil {
+        return nil, fmt.Errorf("failed to read chunk %s: %v", ref.ID, err)
+    }
+    plain, err := encryption.NewReader(bytes.NewReader(data), s.keys)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decrypt chunk %s: %v", ref.ID, err)
+    }
+    compressed, err := io.ReadAll(plain)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decrypt chunk %s: %v", ref.ID, err)
+    }
+    content, err := decoder.DecodeAll(compressed, make([]byte, 0, ref.Size))
+    if err != nil {
+        return nil, fmt.Errorf("failed to decompress chunk %s: %v", ref.ID, err)
+    }
+    if len(content) != ref.Size || s.id(content) != ref.ID {
+        return nil, fmt.Errorf("chunk %s is corrupted", ref.ID)
+    }
+    return content, nil
+}
+
+// Writer splits what is written to it into chunks, stores the new ones and
+// writes the index of the archive on Close
+type Writer struct {
+    store     *Store
+    indexPath string
+    index     Index
+    buf       []byte
+    // Chunks and bytes stored by this archive that weren't stored before
+    NewChunks int
+    NewBytes  int64
+    err       error
+}
+
+// Create starts a deduplicated archive whose index is written to indexPath
+func (s *Store) Create(indexPath string) *Writer {
+    w := &Writer{store: s, indexPath: indexPath, index: Index{Version: indexVersion, Chunks: []ChunkRef{}}}
+    if s.keys != nil {
+        if s.keys.Key == nil {
+            w.err = fmt.Errorf("deduplicated archives can only be encrypted with a key, not only to recipients")
+            return w
+        }
+        w.index.KeyID = s.keys.Key.ID()
+        w.index.ChunkKey, w.err = encryption.Seal(s.macKey, s.keys)
+    }
+    return w
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+    if w.err != nil {
+        return 0, w.err
+    }
+    w.buf = append(w.buf, p...)
+    for len(w.buf) >= maxChunkSize {
+        if err := w.flush(cut(w.buf, false)); err != nil {
+            return 0, err
+        }
+    }
+    return len(p), nil
+}
+
+// flush stores the first n buffered bytes as a chunk
+func (w *Writer) flush(n int) error {
+    id, stored, err := w.store.put(w.buf[:n])
+    if err != nil {
+        w.err = err
+        return err
+    }
+    if stored {
+        w.NewChunks++
+        w.NewBytes += int64(n)
+    }
+    w.index.Chunks = append(w.index.Chunks, ChunkRef{ID: id, Size: n})
+    w.index.Size += int64(n)
+    w.buf = append(w.buf[:0], w.buf[n:]...)
+    return nil
+}
+
+// Close stores the remaining data and writes the index
+func (w *Writer) Close() error {
+    if w.err != nil {
+        return w.err
+    }
+    for len(w.buf) > 0 {
+        if err := w.flush(cut(w.buf, true)); err != nil {
+            return err
+        }
+    }
+    w.err = fmt.Errorf("archive is closed")
+
+    return writeIndex(w.indexPath, &w.index)
+}
+
+// writeIndex replaces the index at path
+func writeIndex(path string, index *Index) error {
+    data, err := json.Marshal(index)
+    if err != nil {
+        return fmt.Errorf("failed to encode index: %v", err)
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return fmt.Errorf("failed to write index: %v", err)
+    }
+    return os.Rename(tmp, path)
+}
+
+// reader reads the content of a deduplicated archive chunk by chunk
+type reader struct {
+    store  *Store
+    chunks []ChunkRef
+    data   []byte
+}
+
+// Open returns a reader of the content of the deduplicated archive with the
+// given index. Chunks are decrypted with keys and checked as they are read.
+func Open(indexPath string, keys *encryption.Keyring) (io.ReadCloser, error) {
+    index, err := ReadIndex(indexPath)
+    if err != nil {
+        return nil, err
+    }
+    var macKey []byte
+    if index.KeyID != "" {
+        if macKey, err = index.chunkIDKey(keys); err != nil {
+            return nil, err
+        }
+    } else {
+        // Chunks of unencrypted archives have unkeyed IDs
+        keys = nil
+    }
+    store, err := findStore(indexPath, keys, macKey)
+    if err != nil {
+        return nil, err
+    }
+    return &reader{store: store, chunks: index.Chunks}, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+    for len(r.data) == 0 {
+        if len(r.chunks) == 0 {
+            return 0, io.EOF
+        }
+        data, err := r.store.get(r.chunks[0])
+        if err != nil {
+            return 0, err
+        }
+        r.data, r.chunks = data, r.chunks[1:]
+    }
+    n := copy(p, r.data)
+    r.data = r.data[n:]
+    return n, nil
+}
+
+func (r *reader) Close() error {
+    return nil
+}
+
+// chunkIDKey returns the key the chunk IDs of an encrypted archive are
+// derived from. Indexes written before ChunkKey need KeyID's key.
+func (index *Index) chunkIDKey(keys *encryption.Keyring) ([]byte, error) {
+    if keys == nil {
+        return nil, encryption.ErrNoKey
+    }
+    if len(index.ChunkKey) > 0 {
+        macKey, err := encryption.Open(index.ChunkKey, keys)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open the chunk key: %v", err)
+        }
+        return macKey, nil
+    }
+    key := keys.KeyByID(index.KeyID)
+    if key == nil {
+        return nil, fmt.Errorf("archive was encrypted with key %s, which is not configured", index.KeyID)
+    }
+    return chunkIDKey(key), nil
+}
+
+// RekeyIndex seals the chunk key of an encrypted archive's index for the
+// keyring's key and recipients. It reports whether the index was changed.
+func RekeyIndex(path string, keys *encryption.Keyring) (bool, error) {
+    index, err := ReadIndex(path)
+    if err != nil || index.KeyID == "" {
+        return false, err
+    }
+    if len(index.ChunkKey) > 0 {
+        if current, err := encryption.Current(bytes.NewReader(index.ChunkKey), keys); err != nil || current {
+            return false, err
+        }
+    }
+    macKey, err := index.chunkIDKey(keys)
+    if err != nil {
+        return false, err
+    }
+    if index.ChunkKey, err = encryption.Seal(macKey, keys); err != nil {
+        return false, err
+    }
+    return true, writeIndex(path, index)
+}
+
+// RekeyChunks wraps the keys of the encrypted chunks of a backup directory's
+// store for the keyring's key and recipients and returns how many chunks
+// were changed. Their IDs stay derived from the key they were stored with.
+func RekeyChunks(baseDir string, keys *encryption.Keyring) (int, error) {
+    storeDir := filepath.Join(baseDir, StoreDirName)
+    changed := 0
+    err := filepath.WalkDir(storeDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+            return err
+        }
+        rekeyed, err := encryption.Rekey(path, keys)
+        if rekeyed {
+            changed++
+        }
+        return err
+    })
+    if os.IsNotExist(err) {
+        return changed, nil
+    }
+    return changed, err
+}
+
+// PruneResult describes what Prune removed and kept
+type PruneResult struct {
+    Indexes      int   `json:"indexes"`
+    Kept         int   `json:"kept"`
+    KeptBytes    int64 `json:"kept_bytes"`
+    Removed      int   `json:"removed"`
+    RemovedBytes int64 `json:"removed_bytes"`
+}
+
+// Prune removes the chunks of a backup directory's store that no index
+// below the directory refers to, such as those of rotated archives.
+// Directories and indexes for which skip returns true are left out, so
+// they don't keep chunks. With dryRun nothing is removed and the result is
+// what would be. It must not run while archives are written to the directory.
+func Prune(baseDir string, skip func(path string) bool, dryRun bool) (PruneResult, error) {
+    var result PruneResult
+    storeDir := filepath.Join(baseDir, StoreDirName)
+    if _, err := os.Stat(storeDir); os.IsNotExist(err) {
+        return result, nil
+    }
+
+    referenced := make(map[string]bool)
+    err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if d.IsDir() && (path == storeDir || skip != nil && skip(path)) {
+            return filepath.SkipDir
+        }
+        if d.IsDir() || !IsIndex(path) || skip != nil && skip(path) {
+            return nil
+        }
+        index, err := ReadIndex(path)
+        if err != nil {
+            return err
+        }
+        result.Indexes++
+        for _, chunk := range index.Chunks {
+            referenced[chunk.ID] = true
+        }
+        return nil
+    })
+    if err != nil {
+        return result, fmt.Errorf("failed to read indexes: %v", err)
+    }
+
+    err = filepath.WalkDir(storeDir, func(path string, d fs.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+            return err
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        // Leftovers of interrupted writes are removed as well
+        if referenced[d.Name()] {
+            result.Kept++
+            result.KeptBytes += info.Size()
+            return nil
+        }
+        if !dryRun {
+            if err := os.Remove(path); err != nil {
+                return err
+            }
+        }
+        result.Removed++
+        result.RemovedBytes += info.Size()
+        return nil
+    })
+    if err != nil {
+        return result, fmt.Errorf("failed to prune chunks: %v", err)
+    }
+    return result, nil
+}
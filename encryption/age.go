@@ -0,0 +1,288 @@
+package encryption
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "golang.org/x/crypto/chacha20poly1305"
+    "golang.org/x/crypto/curve25519"
+    "golang.org/x/crypto/hkdf"
+)
+
+// Recipients and identities are age X25519 keys, written as by age-keygen,
+// and file keys are wrapped for them as in age's X25519 stanzas. Archives
+// stay in the format of this package, so only keys are shared with age.
+const (
+    recipientHRP = "age"
+    identityHRP  = "age-secret-key-"
+    x25519Label  = "age-encryption.org/v1/X25519"
+)
+
+// Recipient is the public key of an age X25519 identity. Archives encrypted
+// to a recipient can be decrypted with its identity.
+type Recipient struct {
+    key []byte
+}
+
+// ParseRecipient parses an age X25519 recipient, age1...
+func ParseRecipient(s string) (*Recipient, error) {
+    hrp, data, err := bech32Decode(strings.TrimSpace(s))
+    if err != nil {
+        return nil, fmt.Errorf("invalid age recipient %q: %v", s, err)
+    }
+    if hrp != recipientHRP || len(data) != curve25519.PointSize {
+        return nil, fmt.Errorf("invalid age recipient %q: not an X25519 recipient", s)
+    }
+    return &Recipient{key: data}, nil
+}
+
+// String returns the recipient as age1...
+func (r *Recipient) String() string {
+    s, _ := bech32Encode(recipientHRP, r.key)
+    return s
+}
+
+// ID identifies the recipient in archive headers
+func (r *Recipient) ID() string {
+    return fmt.Sprintf("%x", r.id())
+}
+
+func (r *Recipient) id() []byte {
+    sum := sha256.Sum256(append([]byte("laravel-backup-tool recipient id\x00"), r.key...))
+    return sum[:keyIDSize]
+}
+
+// wrap seals a file key for the recipient, returning the ephemeral share
+// followed by the sealed file key
+func (r *Recipient) wrap(fileKey []byte) ([]byte, error) {
+    ephemeral := make([]byte, curve25519.ScalarSize)
+    if _, err := rand.Read(ephemeral); err != nil {
+        return nil, err
+    }
+    share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+    if err != nil {
+        return nil, err
+    }
+    shared, err := curve25519.X25519(ephemeral, r.key)
+    if err != nil {
+        return nil, err
+    }
+    aead, err := wrappingAEAD(shared, share, r.key)
+    if err != nil {
+        return nil, err
+    }
+    return aead.Seal(share, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// Identity is an age X25519 secret key
+type Identity struct {
+    secret    []byte
+    recipient *Recipient
+}
+
+// GenerateIdentity returns a new random identity
+func GenerateIdentity() (*Identity, error) {
+    secret := make([]byte, curve25519.ScalarSize)
+    if _, err := rand.Read(secret); err != nil {
+        return nil, fmt.Errorf("failed to generate identity: %v", err)
+    }
+    return newIdentity(secret)
+}
+
+func newIdentity(secret []byte) (*Identity, error) {
+    public, err := curve25519.X25519(secret, curve25519.Basepoint)
+    if err != nil {
+        return nil, err
+    }
+    return &Identity{secret: secret, recipient: &Recipient{key: public}}, nil
+}
+
+// ParseIdentity parses an age X25519 identity, AGE-SECRET-KEY-1...
+func ParseIdentity(s string) (*Identity, error) {
+    hrp, data, err := bech32Decode(strings.TrimSpace(s))
+    if err != nil {
+        return nil, fmt.Errorf("invalid age identity: %v", err)
+    }
+    if hrp != identityHRP || len(data) != curve25519.ScalarSize {
+        return nil, fmt.Errorf("invalid age identity: not an X25519 identity")
+    }
+    return newIdentity(data)
+}
+
+// LoadIdentityFile reads the identities of an age identity file, as written
+// by age-keygen. Empty lines and lines starting with # are skipped.
+func LoadIdentityFile(path string) ([]*Identity, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read identity file: %v", err)
+    }
+    defer f.Close()
+    var identities []*Identity
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        identity, err := ParseIdentity(line)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+        identities = append(identities, identity)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("unable to read identity file: %v", err)
+    }
+    if len(identities) == 0 {
+        return nil, fmt.Errorf("%s contains no identity", path)
+    }
+    return identities, nil
+}
+
+// String returns the identity as AGE-SECRET-KEY-1...
+func (i *Identity) String() string {
+    s, _ := bech32Encode(identityHRP, i.secret)
+    return strings.ToUpper(s)
+}
+
+// Recipient returns the recipient of the identity
+func (i *Identity) Recipient() *Recipient {
+    return i.recipient
+}
+
+// unwrap opens a file key wrapped for the identity's recipient
+func (i *Identity) unwrap(body []byte) ([]byte, error) {
+    share, sealed := body[:curve25519.PointSize], body[curve25519.PointSize:]
+    shared, err := curve25519.X25519(i.secret, share)
+    if err != nil {
+        return nil, err
+    }
+    aead, err := wrappingAEAD(shared, share, i.recipient.key)
+    if err != nil {
+        return nil, err
+    }
+    return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), sealed, nil)
+}
+
+// wrappingAEAD derives the cipher wrapping a file key from an X25519 shared
+// secret, as age does
+func wrappingAEAD(shared, share, recipient []byte) (cipher.AEAD, error) {
+    salt := append(append([]byte{}, share...), recipient...)
+    key := make([]byte, chacha20poly1305.KeySize)
+    if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(x25519Label)), key); err != nil {
+        return nil, err
+    }
+    return chacha20poly1305.New(key)
+}
+
+// bech32 as used by age for its keys, without bech32's length limit
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+var bech32Generator = []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+
+func bech32Polymod(values []byte) uint32 {
+    chk := uint32(1)
+    for _, v := range values {
+        top := chk >> 25
+        chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+        for i := 0; i < 5; i++ {
+            if (top>>uint(i))&1 == 1 {
+                chk ^= bech32Generator[i]
+            }
+        }
+    }
+    return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+    var expanded []byte
+    for i := 0; i < len(hrp); i++ {
+        expanded = append(expanded, hrp[i]>>5)
+    }
+    expanded = append(expanded, 0)
+    for i := 0; i < len(hrp); i++ {
+        expanded = append(expanded, hrp[i]&31)
+    }
+    return expanded
+}
+
+// convertBits regroups bits, padding the last group when encoding
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+    var acc uint32
+    var bits uint
+    var out []byte
+    maxv := uint32(1)<<to - 1
+    for _, b := range data {
+        if uint32(b)>>from != 0 {
+            return nil, errors.New("invalid data range")
+        }
+        acc = acc<<from | uint32(b)
+        bits += from
+        for bits >= to {
+            bits -= to
+            out = append(out, byte(acc>>bits&maxv))
+        }
+    }
+    if pad {
+        if bits > 0 {
+            out = append(out, byte(acc<<(to-bits)&maxv))
+        }
+    } else if bits >= from || acc<<(to-bits)&maxv != 0 {
+        return nil, errors.New("invalid padding")
+    }
+    return out, nil
+}
+
+func bech32Encode(hrp string, data []byte) (string, error) {
+    values, err := convertBits(data, 8, 5, true)
+    if err != nil {
+        return "", err
+    }
+    values = append(values, make([]byte, 6)...)
+    mod := bech32Polymod(append(bech32HRPExpand(hrp), values...)) ^ 1
+    for i := 0; i < 6; i++ {
+        values[len(values)-6+i] = byte(mod >> uint(5*(5-i)) & 31)
+    }
+    var sb strings.Builder
+    sb.WriteString(hrp)
+    sb.WriteByte('1')
+    for _, v := range values {
+        sb.WriteByte(bech32Charset[v])
+    }
+    return sb.String(), nil
+}
+
+func bech32Decode(s string) (string, []byte, error) {
+    if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+        return "", nil, errors.New("mixed case")
+    }
+    s = strings.ToLower(s)
+    pos := strings.LastIndexByte(s, '1')
+    if pos < 1 || pos+7 > len(s) {
+        return "", nil, errors.New("separator misplaced")
+    }
+    hrp := s[:pos]
+    var values []byte
+    for i := pos + 1; i < len(s); i++ {
+        v := strings.IndexByte(bech32Charset, s[i])
+        if v < 0 {
+            return "", nil, fmt.Errorf("invalid character %q", s[i])
+        }
+        values = append(values, byte(v))
+    }
+    if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+        return "", nil, errors.New("invalid checksum")
+    }
+    data, err := convertBits(values[:len(values)-6], 5, 8, false)
+    if err != nil {
+        return "", nil, err
+    }
+    return hrp, bytes.Clone(data), nil
+}
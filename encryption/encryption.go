@@ -0,0 +1,373 @@
+package encryption
+
+import (
+    "bufio"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// Encrypted streams start with a header, followed by chunks of at most
+// chunkSize bytes sealed with AES-256-GCM. The nonce of a chunk is a random
+// prefix from the header and the chunk's counter; the last chunk is sealed
+// with different additional data, so truncated streams are detected. Streams
+// of the first format, written by earlier versions, have a header of magic,
+// the key ID and the prefix and are sealed with the key itself; those of the
+// second format with a file key wrapped in the header (see keyring.go).
+const (
+    magic      = "LBTENC1\x00"
+    keyIDSize  = 8
+    prefixSize = 8
+    headerSize = len(magic) + keyIDSize + prefixSize
+    chunkSize  = 64 * 1024
+    tagSize    = 16
+)
+
+var (
+    moreChunks = []byte{0}
+    lastChunk  = []byte{1}
+)
+
+// ErrNoKey is returned when an encrypted stream is read without a key
+var ErrNoKey = errors.New("archive is encrypted but no encryption key is configured")
+
+// Key is an AES-256 key used to encrypt backup archives
+type Key [32]byte
+
+// GenerateKey returns a new random key
+func GenerateKey() (*Key, error) {
+    var key Key
+    if _, err := rand.Read(key[:]); err != nil {
+        return nil, fmt.Errorf("failed to generate key: %v", err)
+    }
+    return &key, nil
+}
+
+// ParseKey parses a key given as 64 hex digits or as base64 of 32 bytes
+func ParseKey(s string) (*Key, error) {
+    s = strings.TrimSpace(s)
+    var raw []byte
+    if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+        raw = b
+    } else if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+        raw = b
+    } else {
+        return nil, fmt.Errorf("encryption key must be 32 bytes, given as 64 hex digits or base64")
+    }
+    var key Key
+    copy(key[:], raw)
+    return &key, nil
+}
+
+// LoadKeyFile reads a key file holding the key in hex or base64, or as 32 raw bytes
+func LoadKeyFile(path string) (*Key, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("unable to read encryption key file: %v", err)
+    }
+    if len(data) == 32 {
+        var key Key
+        copy(key[:], data)
+        return &key, nil
+    }
+    key, err := ParseKey(string(data))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    return key, nil
+}
+
+// String returns the key in hex, as accepted by ParseKey
+func (k *Key) String() string {
+    return hex.EncodeToString(k[:])
+}
+
+// ID identifies a key without revealing it, so a wrong key can be told apart
+// from a corrupted archive
+func (k *Key) ID() string {
+    return hex.EncodeToString(k.id())
+}
+
+func (k *Key) id() []byte {
+    sum := sha256.Sum256(append([]byte("laravel-backup-tool key id\x00"), k[:]...))
+    return sum[:keyIDSize]
+}
+
+func (k *Key) aead() (cipher.AEAD, error) {
+    block, err := aes.NewCipher(k[:])
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// writer encrypts everything written to it in chunks
+type writer struct {
+    w       io.Writer
+    aead    cipher.AEAD
+    prefix  []byte
+    counter uint32
+    buf     []byte
+    out     []byte
+    err     error
+}
+
+// NewWriter returns a writer encrypting to w for the key and recipients of
+// keys. Close must be called to write the final chunk; it does not close w.
+func NewWriter(w io.Writer, keys *Keyring) (io.WriteCloser, error) {
+    if keys == nil {
+        return nil, ErrNoKey
+    }
+    fileKey, err := GenerateKey()
+    if err != nil {
+        return nil, err
+    }
+    aead, err := fileKey.aead()
+    if err != nil {
+        return nil, fmt.Errorf("failed to create cipher: %v", err)
+    }
+    prefix := make([]byte, prefixSize)
+    if _, err := rand.Read(prefix); err != nil {
+        return nil, fmt.Errorf("failed to generate nonce: %v", err)
+    }
+    if err := writeHeader(w, keys, fileKey, prefix); err != nil {
+        return nil, err
+    }
+    return &writer{
+        w:      w,
+        aead:   aead,
+        prefix: prefix,
+        buf:    make([]byte, 0, chunkSize),
+        out:    make([]byte, 0, chunkSize+tagSize),
+    }, nil
+}
+
+func (ew *writer) Write(p []byte) (int, error) {
+    if ew.err != nil {
+        return 0, ew.err
+    }
+    n := 0
+    for len(p) > 0 {
+        // A full chunk is only sealed once more data follows, so the last
+        // chunk is always sealed by Close
+        if len(ew.buf) == chunkSize {
+            if ew.err = ew.seal(false); ew.err != nil {
+                return n, ew.err
+            }
+        }
+        c := copy(ew.buf[len(ew.buf):chunkSize], p)
+        ew.buf = ew.buf[:len(ew.buf)+c]
+        p = p[c:]
+        n += c
+    }
+    return n, nil
+}
+
+func (ew *writer) Close() error {
+    if ew.err != nil {
+        return ew.err
+    }
+    ew.err = ew.seal(true)
+    if ew.err == nil {
+        ew.err = errors.New("encryption writer is closed")
+        return nil
+    }
+    return ew.err
+}
+
+func (ew *writer) seal(last bool) error {
+    ad := moreChunks
+    if last {
+        ad = lastChunk
+    }
+    ew.out = ew.aead.Seal(ew.out[:0], nonce(ew.prefix, ew.counter), ew.buf, ad)
+    ew.counter++
+    if ew.counter == 0 {
+        return errors.New("stream too long to encrypt")
+    }
+    ew.buf = ew.buf[:0]
+    _, err := ew.w.Write(ew.out)
+    return err
+}
+
+func nonce(prefix []byte, counter uint32) []byte {
+    n := make([]byte, 12)
+    copy(n, prefix)
+    binary.BigEndian.PutUint32(n[prefixSize:], counter)
+    return n
+}
+
+// reader decrypts a stream written by writer
+type reader struct {
+    r       *bufio.Reader
+    aead    cipher.AEAD
+    prefix  []byte
+    counter uint32
+    in      []byte
+    plain   []byte
+    done    bool
+}
+
+// NewReader returns a reader of the plain content of r. Streams that are not
+// encrypted are passed through unchanged, so archives written before
+// encryption was enabled stay readable. keys may be nil if no key is configured.
+func NewReader(r io.Reader, keys *Keyring) (io.Reader, error) {
+    br := bufio.NewReaderSize(r, chunkSize+tagSize+1)
+    start, err := br.Peek(len(magic))
+    if err != nil || string(start) != magic && string(start) != magicV2 {
+        return br, nil
+    }
+    if keys == nil {
+        return nil, ErrNoKey
+    }
+
+    var key *Key
+    prefix := make([]byte, prefixSize)
+    if string(start) == magicV2 {
+        h, fileKey, err := openHeader(br, keys)
+        if err != nil {
+            return nil, err
+        }
+        key = fileKey
+        copy(prefix, h.prefix)
+    } else {
+        header, err := br.Peek(headerSize)
+        if err != nil {
+            return nil, errors.New("encrypted archive header is truncated")
+        }
+        id := header[len(magic) : len(magic)+keyIDSize]
+        if key = keys.key(id); key == nil {
+            return nil, fmt.Errorf("archive was encrypted with key %x, which is not configured", id)
+        }
+        copy(prefix, header[len(magic)+keyIDSize:])
+        br.Discard(headerSize)
+    }
+    aead, err := key.aead()
+    if err != nil {
+        return nil, fmt.Errorf("failed to create cipher: %v", err)
+    }
+    return &reader{
+        r:      br,
+        aead:   aead,
+        prefix: prefix,
+        in:     make([]byte, chunkSize+tagSize),
+    }, nil
+}
+
+func (er *reader) Read(p []byte) (int, error) {
+    for len(er.plain) == 0 {
+        if er.done {
+            return 0, io.EOF
+        }
+        if err := er.open(); err != nil {
+            return 0, err
+        }
+    }
+    n := copy(p, er.plain)
+    er.plain = er.plain[n:]
+    return n, nil
+}
+
+func (er *reader) open() error {
+    n, err := io.ReadFull(er.r, er.in)
+    last := false
+    switch {
+    case err == io.ErrUnexpectedEOF || err == io.EOF:
+        last = true
+    case err != nil:
+        return err
+    default:
+        if _, err := er.r.Peek(1); err == io.EOF {
+            last = true
+        } else if err != nil {
+            return err
+        }
+    }
+    if n < tagSize {
+        return errors.New("encrypted archive is truncated")
+    }
+
+    ad := moreChunks
+    if last {
+        ad = lastChunk
+    }
+    plain, err := er.aead.Open(er.in[:0], nonce(er.prefix, er.counter), er.in[:n], ad)
+    if err != nil {
+        return errors.New("encrypted archive is corrupted or truncated")
+    }
+    er.counter++
+    er.plain = plain
+    er.done = last
+    return nil
+}
+
+// IsEncrypted reports whether the file at path is an encrypted stream
+func IsEncrypted(path string) (bool, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return false, err
+    }
+    defer f.Close()
+    header := make([]byte, len(magic))
+    if _, err := io.ReadFull(f, header); err != nil {
+        return false, nil
+    }
+    return string(header) == magic || string(header) == magicV2, nil
+}
+
+// EncryptFile replaces a file with its encrypted content. Files that are
+// already encrypted are left alone.
+func EncryptFile(path string, keys *Keyring) error {
+    if encrypted, err := IsEncrypted(path); err != nil || encrypted {
+        return err
+    }
+
+    in, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", path, err)
+    }
+    defer in.Close()
+
+    err = rewrite(path, ".encrypting", func(w io.Writer) error {
+        ew, err := NewWriter(w, keys)
+        if err != nil {
+            return err
+        }
+        if _, err := io.Copy(ew, in); err != nil {
+            return err
+        }
+        return ew.Close()
+    })
+    if err != nil {
+        return fmt.Errorf("failed to encrypt %s: %v", path, err)
+    }
+    return nil
+}
+
+// rewrite replaces a file with what write writes, through a temporary file
+// named with suffix
+func rewrite(path, suffix string, write func(w io.Writer) error) error {
+    tmp := path + suffix
+    out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+    if err != nil {
+        return fmt.Errorf("failed to create %s: %v", tmp, err)
+    }
+    err = write(out)
+    if cerr := out.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return os.Rename(tmp, path)
+}
@@ -0,0 +1,375 @@
+package encryption
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+    "golang.org/x/crypto/curve25519"
+)
+
+// Streams of the second format encrypt their chunks with a random file key,
+// which the header holds wrapped for every key and recipient the stream is
+// encrypted to. Rotating keys only rewrites headers. The header is:
+// magic, the number of stanzas, the stanzas, the nonce prefix and an HMAC of
+// all of it keyed with the file key. A stanza is its type, the ID of its key
+// or recipient and the wrapped file key.
+const (
+    magicV2       = "LBTENC2\x00"
+    stanzaKey     = 1
+    stanzaX25519  = 2
+    nonceSize     = 12
+    headerMACSize = sha256.Size
+)
+
+// wrapAD is the additional data of file keys wrapped with a key
+var wrapAD = []byte("laravel-backup-tool file key")
+
+// Keyring holds the key and recipients new archives are encrypted to and
+// everything archives can be decrypted with
+type Keyring struct {
+    // Key encrypts new archives and decrypts those encrypted with it
+    Key *Key
+    // Recipients can decrypt new archives with their identities
+    Recipients []*Recipient
+    // Previous are retired keys, which only decrypt archives
+    Previous []*Key
+    // Identities decrypt archives encrypted to their recipients
+    Identities []*Identity
+}
+
+// NewKeyring returns a keyring encrypting to and decrypting with key
+func NewKeyring(key *Key) *Keyring {
+    return &Keyring{Key: key}
+}
+
+// keys returns the keys archives can be decrypted with, the current first
+func (k *Keyring) keys() []*Key {
+    var keys []*Key
+    if k.Key != nil {
+        keys = append(keys, k.Key)
+    }
+    return append(keys, k.Previous...)
+}
+
+// key returns the key with the ID, or nil if the keyring has none
+func (k *Keyring) key(id []byte) *Key {
+    for _, key := range k.keys() {
+        if bytes.Equal(key.id(), id) {
+            return key
+        }
+    }
+    return nil
+}
+
+// KeyByID returns the key of the keyring with the ID, or nil if it has none
+func (k *Keyring) KeyByID(id string) *Key {
+    for _, key := range k.keys() {
+        if key.ID() == id {
+            return key
+        }
+    }
+    return nil
+}
+
+// stanza is a file key wrapped for a key or recipient
+type stanza struct {
+    kind byte
+    id   []byte
+    body []byte
+}
+
+// bodySize returns the size of the wrapped file key of a stanza type
+func bodySize(kind byte) (int, error) {
+    switch kind {
+    case stanzaKey:
+        return nonceSize + len(Key{}) + tagSize, nil
+    case stanzaX25519:
+        return curve25519.PointSize + len(Key{}) + tagSize, nil
+    }
+    return 0, fmt.Errorf("archive is encrypted with an unknown type of key %d", kind)
+}
+
+// wrap wraps a file key for the keyring's key and recipients
+func (k *Keyring) wrap(fileKey *Key) ([]stanza, error) {
+    var stanzas []stanza
+    if k.Key != nil {
+        aead, err := k.Key.aead()
+        if err != nil {
+            return nil, err
+        }
+        nonce := make([]byte, nonceSize)
+        if _, err := rand.Read(nonce); err != nil {
+            return nil, err
+        }
+        stanzas = append(stanzas, stanza{kind: stanzaKey, id: k.Key.id(), body: aead.Seal(nonce, nonce, fileKey[:], wrapAD)})
+    }
+    for _, r := range k.Recipients {
+        body, err := r.wrap(fileKey[:])
+        if err != nil {
+            return nil, err
+        }
+        stanzas = append(stanzas, stanza{kind: stanzaX25519, id: r.id(), body: body})
+    }
+    if len(stanzas) == 0 {
+        return nil, errors.New("no encryption key or recipient is configured")
+    }
+    return stanzas, nil
+}
+
+// unwrap opens the file key of a header with the first key or identity of
+// the keyring it was wrapped for
+func (k *Keyring) unwrap(stanzas []stanza) (*Key, error) {
+    var ids []string
+    for _, s := range stanzas {
+        var raw []byte
+        var err error
+        switch s.kind {
+        case stanzaKey:
+            key := k.key(s.id)
+            if key == nil {
+                break
+            }
+            aead, aerr := key.aead()
+            if aerr != nil {
+                return nil, aerr
+            }
+            raw, err = aead.Open(nil, s.body[:nonceSize], s.body[nonceSize:], wrapAD)
+        case stanzaX25519:
+            for _, identity := range k.Identities {
+                if bytes.Equal(identity.recipient.id(), s.id) {
+                    raw, err = identity.unwrap(s.body)
+                    break
+                }
+            }
+        }
+        if err != nil {
+            return nil, fmt.Errorf("failed to unwrap the archive key of %x: %v", s.id, err)
+        }
+        if raw != nil {
+            var fileKey Key
+            copy(fileKey[:], raw)
+            return &fileKey, nil
+        }
+        ids = append(ids, fmt.Sprintf("%x", s.id))
+    }
+    return nil, fmt.Errorf("archive was encrypted for %s, none of which is configured", strings.Join(ids, ", "))
+}
+
+// current reports whether stanzas are wrapped for exactly the keyring's key
+// and recipients
+func (k *Keyring) current(stanzas []stanza) bool {
+    want := make(map[string]bool)
+    if k.Key != nil {
+        want[string(k.Key.id())] = true
+    }
+    for _, r := range k.Recipients {
+        want[string(r.id())] = true
+    }
+    if len(stanzas) != len(want) {
+        return false
+    }
+    for _, s := range stanzas {
+        if !want[string(s.id)] {
+            return false
+        }
+    }
+    return true
+}
+
+// header is the header of a stream of the second format
+type header struct {
+    stanzas []stanza
+    prefix  []byte
+}
+
+// writeHeader writes a header wrapping fileKey for the keyring
+func writeHeader(w io.Writer, k *Keyring, fileKey *Key, prefix []byte) error {
+    stanzas, err := k.wrap(fileKey)
+    if err != nil {
+        return err
+    }
+    if len(stanzas) > 255 {
+        return errors.New("too many encryption keys and recipients")
+    }
+    buf := append([]byte(magicV2), byte(len(stanzas)))
+    for _, s := range stanzas {
+        buf = append(buf, s.kind)
+        buf = append(buf, s.id...)
+        buf = append(buf, s.body...)
+    }
+    buf = append(buf, prefix...)
+    buf = append(buf, headerMAC(fileKey, buf)...)
+    _, err = w.Write(buf)
+    return err
+}
+
+// readHeader reads the header of a stream of the second format, returning
+// it and its raw bytes without the MAC, and the MAC
+func readHeader(r io.Reader) (*header, []byte, []byte, error) {
+    raw := make([]byte, len(magicV2)+1)
+    if _, err := io.ReadFull(r, raw); err != nil {
+        return nil, nil, nil, errTruncatedHeader(err)
+    }
+    h := &header{}
+    for i := 0; i < int(raw[len(magicV2)]); i++ {
+        start := len(raw)
+        raw = append(raw, make([]byte, 1+keyIDSize)...)
+        if _, err := io.ReadFull(r, raw[start:]); err != nil {
+            return nil, nil, nil, errTruncatedHeader(err)
+        }
+        size, err := bodySize(raw[start])
+        if err != nil {
+            return nil, nil, nil, err
+        }
+        raw = append(raw, make([]byte, size)...)
+        if _, err := io.ReadFull(r, raw[start+1+keyIDSize:]); err != nil {
+            return nil, nil, nil, errTruncatedHeader(err)
+        }
+        h.stanzas = append(h.stanzas, stanza{kind: raw[start], id: raw[start+1 : start+1+keyIDSize], body: raw[start+1+keyIDSize:]})
+    }
+    start := len(raw)
+    raw = append(raw, make([]byte, prefixSize+headerMACSize)...)
+    if _, err := io.ReadFull(r, raw[start:]); err != nil {
+        return nil, nil, nil, errTruncatedHeader(err)
+    }
+    h.prefix = raw[start : start+prefixSize]
+    return h, raw[:start+prefixSize], raw[start+prefixSize:], nil
+}
+
+func errTruncatedHeader(err error) error {
+    if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return errors.New("encrypted archive header is truncated")
+    }
+    return err
+}
+
+// openHeader reads the header of a stream of the second format and returns
+// it with its file key
+func openHeader(r io.Reader, k *Keyring) (*header, *Key, error) {
+    h, raw, mac, err := readHeader(r)
+    if err != nil {
+        return nil, nil, err
+    }
+    if k == nil {
+        return nil, nil, ErrNoKey
+    }
+    fileKey, err := k.unwrap(h.stanzas)
+    if err != nil {
+        return nil, nil, err
+    }
+    if !hmac.Equal(headerMAC(fileKey, raw), mac) {
+        return nil, nil, errors.New("encrypted archive header is corrupted")
+    }
+    return h, fileKey, nil
+}
+
+// headerMAC authenticates a header with its file key, so stanzas can't be
+// altered by anyone who can't decrypt the stream
+func headerMAC(fileKey *Key, raw []byte) []byte {
+    key := hmac.New(sha256.New, fileKey[:])
+    key.Write([]byte("laravel-backup-tool header"))
+    mac := hmac.New(sha256.New, key.Sum(nil))
+    mac.Write(raw)
+    return mac.Sum(nil)
+}
+
+// Current reports whether an encrypted stream is encrypted to exactly the
+// keyring's key and recipients. Streams that aren't encrypted are current;
+// streams of the first format, encrypted with a key directly, are not.
+func Current(r io.Reader, k *Keyring) (bool, error) {
+    br := bufio.NewReader(r)
+    start, err := br.Peek(len(magic))
+    if err != nil || string(start) != magic && string(start) != magicV2 {
+        return true, nil
+    }
+    if string(start) == magic {
+        return false, nil
+    }
+    h, _, _, err := readHeader(br)
+    if err != nil {
+        return false, err
+    }
+    return k.current(h.stanzas), nil
+}
+
+// Rekey wraps the file key of an encrypted file for the keyring's key and
+// recipients, dropping those of other keys, so keys are rotated without
+// re-encrypting archives: only the header is rewritten. Files of the first
+// format are re-encrypted. It reports whether the file was changed.
+func Rekey(path string, k *Keyring) (bool, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return false, err
+    }
+    defer f.Close()
+    if current, err := Current(f, k); err != nil || current {
+        return false, err
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return false, err
+    }
+
+    br := bufio.NewReaderSize(f, chunkSize+tagSize+1)
+    start, _ := br.Peek(len(magic))
+    err = rewrite(path, ".rekeying", func(w io.Writer) error {
+        if string(start) == magic {
+            plain, err := NewReader(br, k)
+            if err != nil {
+                return err
+            }
+            ew, err := NewWriter(w, k)
+            if err != nil {
+                return err
+            }
+            if _, err := io.Copy(ew, plain); err != nil {
+                return err
+            }
+            return ew.Close()
+        }
+        h, fileKey, err := openHeader(br, k)
+        if err != nil {
+            return err
+        }
+        if err := writeHeader(w, k, fileKey, h.prefix); err != nil {
+            return err
+        }
+        _, err = io.Copy(w, br)
+        return err
+    })
+    if err != nil {
+        return false, fmt.Errorf("failed to rekey %s: %v", path, err)
+    }
+    return true, nil
+}
+
+// Seal encrypts a small piece of data to the keyring
+func Seal(data []byte, k *Keyring) ([]byte, error) {
+    var buf bytes.Buffer
+    ew, err := NewWriter(&buf, k)
+    if err != nil {
+        return nil, err
+    }
+    if _, err := ew.Write(data); err != nil {
+        return nil, err
+    }
+    if err := ew.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// Open decrypts data sealed by Seal
+func Open(data []byte, k *Keyring) ([]byte, error) {
+    plain, err := NewReader(bytes.NewReader(data), k)
+    if err != nil {
+        return nil, err
+    }
+    return io.ReadAll(plain)
+}
@@ -0,0 +1,171 @@
+// Package filelock coordinates processes through locks on files. Locks are
+// flock(2) locks, or LockFileEx locks on Windows, released by the kernel
+// when their holder exits, even if it crashes. On file systems without lock
+// support an exclusive lock falls back to a PID file, which is taken over
+// once its process is gone.
+package filelock
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Forever makes Acquire wait until the lock is free
+const Forever time.Duration = -1
+
+// pollInterval is how often a busy lock is tried again while waiting
+const pollInterval = time.Second
+
+// ErrBusy is returned by Acquire if another process holds the lock
+var ErrBusy = errors.New("lock is held by another process")
+
+// Errors of lockFile: the lock is held by another process, or the file
+// system doesn't support locks
+var (
+    errWouldBlock  = errors.New("lock would block")
+    errUnsupported = errors.New("locks are not supported")
+)
+
+// Lock is a lock held on a file
+type Lock struct {
+    file      *os.File
+    exclusive bool
+    // Path of the PID file if the file system doesn't support flock
+    pidFile string
+    // Stale is the PID of an earlier holder that exited without releasing
+    // the lock, e.g. because it crashed, or 0
+    Stale int
+}
+
+// BusyError is the error of a lock that is held by another process
+type BusyError struct {
+    Path string
+    // PID of the process holding an exclusive lock, 0 if unknown
+    PID int
+}
+
+func (e *BusyError) Error() string {
+    if e.PID != 0 {
+        return fmt.Sprintf("%s is held by process %d", e.Path, e.PID)
+    }
+    return fmt.Sprintf("%s is held by another process", e.Path)
+}
+
+func (e *BusyError) Is(target error) bool {
+    return target == ErrBusy
+}
+
+// Acquire locks the file at path, creating it if needed. Exclusive locks
+// exclude all other locks on the file, shared ones only exclusive locks.
+// A busy lock is tried again until wait has passed, forever with Forever,
+// or ctx is cancelled; the error then wraps ErrBusy.
+func Acquire(ctx context.Context, path string, exclusive bool, wait time.Duration) (*Lock, error) {
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+    if err != nil {
+        return nil, fmt.Errorf("failed to open lock file: %v", err)
+    }
+
+    deadline := time.Now().Add(wait)
+    for {
+        err = lockFile(file, exclusive)
+        if err == nil {
+            break
+        }
+        if err == errUnsupported {
+            file.Close()
+            return acquirePIDFile(ctx, path+".pid", deadline, wait)
+        }
+        if err != errWouldBlock {
+            file.Close()
+            return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+        }
+        if err := sleep(ctx, deadline, wait); err != nil {
+            file.Close()
+            return nil, &BusyError{Path: path, PID: Holder(path)}
+        }
+    }
+
+    // Record the holder of an exclusive lock for the error above. Unlock
+    // removes the record, so one left behind is from a holder that crashed.
+    lock := &Lock{file: file, exclusive: exclusive}
+    if exclusive {
+        lock.Stale = Holder(path)
+        file.Truncate(0)
+        file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+    }
+    return lock, nil
+}
+
+// acquirePIDFile takes an exclusive lock by creating a PID file. A PID file
+// whose process no longer runs is stale and removed.
+func acquirePIDFile(ctx context.Context, path string, deadline time.Time, wait time.Duration) (*Lock, error) {
+    stale := 0
+    for {
+        file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+        if err == nil {
+            file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+            file.Close()
+            return &Lock{pidFile: path, Stale: stale}, nil
+        }
+        if !os.IsExist(err) {
+            return nil, fmt.Errorf("failed to create lock file: %v", err)
+        }
+        pid := Holder(path)
+        if pid == 0 || !running(pid) {
+            // The holder exited without removing the file, or is still
+            // writing its PID; only the former stays unreadable
+            if info, err := os.Stat(path); err == nil && (pid != 0 || time.Since(info.ModTime()) > pollInterval) {
+                os.Remove(path)
+                stale = pid
+                continue
+            }
+        }
+        if err := sleep(ctx, deadline, wait); err != nil {
+            return nil, &BusyError{Path: path, PID: pid}
+        }
+    }
+}
+
+// sleep waits before a busy lock is tried again. It returns an error once
+// the deadline has passed or ctx is cancelled.
+func sleep(ctx context.Context, deadline time.Time, wait time.Duration) error {
+    if wait != Forever && !time.Now().Before(deadline) {
+        return ErrBusy
+    }
+    select {
+    case <-time.After(pollInterval):
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Holder returns the PID recorded in a lock file, or 0 if none is
+func Holder(path string) int {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return 0
+    }
+    pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+    if err != nil {
+        return 0
+    }
+    return pid
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+    if l.pidFile != "" {
+        return os.Remove(l.pidFile)
+    }
+    if l.exclusive {
+        l.file.Truncate(0)
+    }
+    unlockFile(l.file)
+    return l.file.Close()
+}
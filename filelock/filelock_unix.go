@@ -0,0 +1,37 @@
+//go:build !windows
+
+package filelock
+
+import (
+    "os"
+    "syscall"
+)
+
+// lockFile takes a flock(2) lock on a file without waiting
+func lockFile(file *os.File, exclusive bool) error {
+    how := syscall.LOCK_SH
+    if exclusive {
+        how = syscall.LOCK_EX
+    }
+    switch err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err {
+    case nil:
+        return nil
+    case syscall.EWOULDBLOCK:
+        return errWouldBlock
+    case syscall.ENOLCK, syscall.EOPNOTSUPP, syscall.ENOSYS:
+        return errUnsupported
+    default:
+        return err
+    }
+}
+
+// unlockFile releases the lock of lockFile
+func unlockFile(file *os.File) {
+    syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// running reports whether a process with the PID exists
+func running(pid int) bool {
+    err := syscall.Kill(pid, 0)
+    return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,52 @@
+package filelock
+
+import (
+    "os"
+    "golang.org/x/sys/windows"
+)
+
+// lockOffset is where the locked byte lies. Windows locks are mandatory, so
+// the byte is far beyond the PID written to the file, which other processes
+// read to report the holder.
+const lockOffset = 0x7fffffff
+
+// stillActive is the exit code of a process that hasn't exited
+const stillActive = 259
+
+// lockFile takes a LockFileEx lock on a file without waiting
+func lockFile(file *os.File, exclusive bool) error {
+    flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+    if exclusive {
+        flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+    }
+    err := windows.LockFileEx(windows.Handle(file.Fd()), flags, 0, 1, 0, &windows.Overlapped{OffsetHigh: lockOffset})
+    switch err {
+    case nil:
+        return nil
+    case windows.ERROR_LOCK_VIOLATION, windows.ERROR_IO_PENDING:
+        return errWouldBlock
+    case windows.ERROR_NOT_SUPPORTED, windows.ERROR_INVALID_FUNCTION:
+        return errUnsupported
+    default:
+        return err
+    }
+}
+
+// unlockFile releases the lock of lockFile
+func unlockFile(file *os.File) {
+    windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{OffsetHigh: lockOffset})
+}
+
+// running reports whether a process with the PID exists
+func running(pid int) bool {
+    process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+    if err != nil {
+        return err == windows.ERROR_ACCESS_DENIED
+    }
+    defer windows.CloseHandle(process)
+    var code uint32
+    if err := windows.GetExitCodeProcess(process, &code); err != nil {
+        return true
+    }
+    return code == stillActive
+}
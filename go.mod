@@ -1,10 +1,15 @@
 module laravel-backup-tool
 
-go 1.18
+go 1.22
 
 require (
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/sftp v1.13.6
 	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/term v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/sys v0.30.0 // indirect
+require github.com/kr/fs v0.1.0 // indirect
@@ -0,0 +1,75 @@
+// Package healthcheck pings health check URLs healthchecks.io style, so an
+// external monitor raises an alert when a backup fails or doesn't run at all.
+package healthcheck
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "strings"
+    "time"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/retry"
+)
+
+// Events of a backup reported to a check
+const (
+    Start   = "start"
+    Success = "success"
+    Fail    = "fail"
+)
+
+// pingTimeout limits a single ping, so an unreachable monitor doesn't hold
+// up backups
+const pingTimeout = 10 * time.Second
+
+// URL returns the URL pinged for an event: <url>/start, <url> or <url>/fail
+func URL(base, event string) string {
+    base = strings.TrimRight(base, "/")
+    if event == Success {
+        return base
+    }
+    return base + "/" + event
+}
+
+// Ping posts an event with body as the payload to a check, retrying
+// transient failures with policy. Secrets in body are redacted.
+func Ping(ctx context.Context, policy retry.Policy, base, event, body string) error {
+    target := URL(base, event)
+    return policy.Do(ctx, slog.Default(), "health check ping", func() error {
+        ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+        defer cancel()
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, strings.NewReader(logging.Redact(body)))
+        if err != nil {
+            return retry.Permanent(err)
+        }
+        req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            return err
+        }
+        defer resp.Body.Close()
+        io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+        if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+            return nil
+        }
+        err = fmt.Errorf("ping %s: %s", event, resp.Status)
+        if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+            return retry.Transient(err)
+        }
+        return retry.Permanent(err)
+    })
+}
+
+// Finish pings the success or, with failures, the fail URL of a check,
+// describing what finished, how long it took and why it failed
+func Finish(ctx context.Context, policy retry.Policy, base, what string, took time.Duration, failures []string) error {
+    took = took.Round(time.Second)
+    if len(failures) == 0 {
+        return Ping(ctx, policy, base, Success, fmt.Sprintf("%s finished in %s\n", what, took))
+    }
+    body := fmt.Sprintf("%s failed after %s:\n%s\n", what, took, strings.Join(failures, "\n"))
+    return Ping(ctx, policy, base, Fail, body)
+}
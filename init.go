@@ -0,0 +1,451 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/backuptool"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/secrets"
+    "gopkg.in/yaml.v3"
+)
+
+// Ways init offers to start the scheduled backups
+const (
+    startDaemon = "daemon"
+    startTimer  = "timer"
+    startCron   = "cron"
+)
+
+// initConfig is the part of backup.yaml init writes; everything else keeps
+// its default
+type initConfig struct {
+    Local     config.Storage         `yaml:"local"`
+    Remote    *initRemote            `yaml:"remote,omitempty"`
+    WebServer config.WebServerConfig `yaml:"web_server"`
+    S3        *config.S3Settings     `yaml:"s3,omitempty"`
+    Report    *initReport            `yaml:"report,omitempty"`
+    Schedules map[string]string      `yaml:"schedules,omitempty"`
+}
+
+// initRemote is the remote section init writes
+type initRemote struct {
+    Enabled        bool             `yaml:"enabled"`
+    config.Storage `yaml:",inline"`
+    SSH            config.SSHTarget `yaml:"ssh"`
+}
+
+// initReport is the report section init writes
+type initReport struct {
+    SMTP config.SMTPConfig `yaml:"smtp"`
+}
+
+// wizard asks the questions of init, reading the answers line by line so
+// they can also be piped in
+type wizard struct {
+    in *bufio.Reader
+    // The input ended, so every further question gets its default
+    eof bool
+}
+
+// ask prints a question with its default and returns the answer, the
+// default if the answer is empty or the input ended
+func (w *wizard) ask(question, def string) string {
+    if def != "" {
+        fmt.Printf("%s [%s]: ", question, def)
+    } else {
+        fmt.Printf("%s: ", question)
+    }
+    answer, err := w.in.ReadString('\n')
+    if err == io.EOF {
+        w.eof = true
+        if answer == "" {
+            fmt.Println()
+        }
+    }
+    if answer = strings.TrimSpace(answer); answer == "" {
+        return def
+    }
+    return answer
+}
+
+// require asks a question without default until it is answered
+func (w *wizard) require(question string) string {
+    for {
+        if answer := w.ask(question, ""); answer != "" || w.eof {
+            return answer
+        }
+    }
+}
+
+// askInt asks for a number until a valid one is given
+func (w *wizard) askInt(question string, def int) int {
+    for {
+        answer := w.ask(question, strconv.Itoa(def))
+        n, err := strconv.Atoi(answer)
+        if err == nil && n >= 0 {
+            return n
+        }
+        if w.eof {
+            return def
+        }
+        fmt.Printf("%q is not a number\n", answer)
+    }
+}
+
+// askYes asks a yes/no question
+func (w *wizard) askYes(question string, def bool) bool {
+    hint := "y/N"
+    if def {
+        hint = "Y/n"
+    }
+    answer := strings.ToLower(w.ask(question+" ("+hint+")", ""))
+    if answer == "" {
+        return def
+    }
+    return answer == "y" || answer == "yes"
+}
+
+// askChoice asks for one of the choices until a valid one is given
+func (w *wizard) askChoice(question, def string, choices ...string) string {
+    for {
+        answer := w.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, ", ")), def)
+        for _, choice := range choices {
+            if answer == choice {
+                return answer
+            }
+        }
+        if w.eof {
+            return def
+        }
+        fmt.Printf("%q is not one of %s\n", answer, strings.Join(choices, ", "))
+    }
+}
+
+// askSecret asks for a secret, without echoing it on a terminal
+func (w *wizard) askSecret(question string) (string, error) {
+    if secrets.Interactive() {
+        return secrets.Prompt(question)
+    }
+    return w.ask(question, ""), nil
+}
+
+// runInit probes the system, asks how backups should be made and writes a
+// validated backup.yaml and optionally systemd units that run the backups.
+// With --profile the profile's file is written instead. It runs before any
+// configuration is loaded.
+func runInit(args []string) error {
+    fs := flag.NewFlagSet("init", flag.ExitOnError)
+    configPath := fs.String("config", "", "configuration file to write (default: BACKUP_CONFIG, or /etc/laravel-backup-tool/backup.yaml as root and backup.yaml otherwise)")
+    systemdDir := fs.String("systemd-dir", "/etc/systemd/system", "directory the systemd units are written to")
+    fs.Parse(args)
+
+    w := &wizard{in: bufio.NewReader(os.Stdin)}
+    defaults := config.DefaultConfig()
+
+    fmt.Println("Probing this system...")
+    webServer, webConfig, webErr := backuptool.New(defaults).DetectWebServer()
+    if webErr != nil {
+        fmt.Printf("  web server:  %v\n", webErr)
+    } else {
+        fmt.Printf("  web server:  %s (%s), %s\n", webServer, webConfig, countSites(webServer, webConfig))
+    }
+    for _, tool := range []string{"mysqldump", "mysql", "pg_dump"} {
+        if path, err := exec.LookPath(tool); err == nil {
+            fmt.Printf("  %-11s  %s\n", tool+":", path)
+        } else {
+            fmt.Printf("  %-11s  not found, databases that need it can't be backed up\n", tool+":")
+        }
+    }
+    if existing := config.ConfigFile(); existing != "" {
+        fmt.Printf("  config:      %s exists\n", existing)
+    }
+    fmt.Println()
+
+    profile := os.Getenv(config.ProfileEnv)
+    path := *configPath
+    if profile != "" {
+        // The profile file must be where LoadConfig looks for it
+        if path != "" {
+            return fmt.Errorf("--config can't be combined with --profile, the profile is written to profiles/%s.yaml next to backup.yaml", profile)
+        }
+        if path = config.ProfileFile(profile); path == "" {
+            dir := filepath.Dir(config.ConfigSearchPaths[0])
+            if os.Geteuid() == 0 {
+                dir = filepath.Dir(config.ConfigSearchPaths[1])
+            }
+            path = filepath.Join(dir, config.ProfilesDirName, profile+".yaml")
+        }
+        fmt.Printf("Profile file: %s\n", path)
+    } else {
+        if path == "" {
+            path = config.ConfigFile()
+        }
+        if path == "" {
+            path = config.ConfigSearchPaths[0]
+            if os.Geteuid() == 0 {
+                path = config.ConfigSearchPaths[1]
+            }
+        }
+        path = w.ask("Configuration file", path)
+    }
+    // The units and the hint at the end need an absolute path
+    if abs, err := filepath.Abs(path); err == nil {
+        path = abs
+    }
+    if _, err := os.Stat(path); err == nil && !w.askYes(path+" exists. Overwrite it?", false) {
+        return fmt.Errorf("not overwriting %s", path)
+    }
+
+    var file initConfig
+    file.Local = defaults.Local.Storage
+    if profile != "" {
+        file.Local.BackupDir += "-" + profile
+        defaults.Remote.BackupDir += "-" + profile
+    }
+    file.Local.BackupDir = w.ask("Local backup directory", file.Local.BackupDir)
+    fmt.Printf("  %s free there\n", freeSpaceOf(file.Local.BackupDir))
+    file.Local.MaxFileBackups = w.askInt("File backups kept per site", file.Local.MaxFileBackups)
+    file.Local.MaxDBBackups = w.askInt("Database backups kept per site", file.Local.MaxDBBackups)
+
+    file.WebServer = defaults.WebServer
+    if webErr != nil {
+        webServer = config.WebServerApache
+    }
+    webServer = w.askChoice("Web server or control panel", webServer,
+        config.WebServerApache, config.WebServerNginx, config.WebServerLiteSpeed, config.WebServerIIS, config.WebServerPlesk, config.WebServerCPanel)
+    file.WebServer.Type = webServer
+    switch webServer {
+    case config.WebServerApache:
+        file.WebServer.ApacheConfig = w.ask("Apache configuration file", file.WebServer.ApacheConfig)
+        webConfig = file.WebServer.ApacheConfig
+    case config.WebServerNginx:
+        file.WebServer.NginxConfigDir = w.ask("Nginx configuration directory", file.WebServer.NginxConfigDir)
+        webConfig = file.WebServer.NginxConfigDir
+    case config.WebServerLiteSpeed:
+        file.WebServer.LiteSpeedConfigDir = w.ask("OpenLiteSpeed conf directory", file.WebServer.LiteSpeedConfigDir)
+        webConfig = file.WebServer.LiteSpeedConfigDir
+    case config.WebServerIIS:
+        file.WebServer.IISAppCmd = w.ask("IIS appcmd.exe", file.WebServer.IISAppCmd)
+        webConfig = file.WebServer.IISAppCmd
+    case config.WebServerPlesk:
+        file.WebServer.PleskBin = w.ask("plesk command", file.WebServer.PleskBin)
+        webConfig = file.WebServer.PleskBin
+    case config.WebServerCPanel:
+        file.WebServer.CPanelUserdata = w.ask("cPanel userdata directory", file.WebServer.CPanelUserdata)
+        webConfig = file.WebServer.CPanelUserdata
+    }
+    fmt.Printf("  %s\n", countSites(webServer, webConfig))
+
+    if w.askYes("Also back up the sites of a remote server over SSH?", false) {
+        remote := &initRemote{Enabled: true, Storage: defaults.Remote.Storage, SSH: defaults.Remote.SSH}
+        remote.SSH.Host = w.require("  SSH host")
+        remote.SSH.User = w.require("  SSH user")
+        remote.SSH.Port = w.ask("  SSH port", remote.SSH.Port)
+        remote.SSH.KeyPath = w.ask("  SSH private key", filepath.Join(os.Getenv("HOME"), ".ssh", "id_ed25519"))
+        remote.BackupDir = w.ask("  Directory of the remote backups on this machine", remote.BackupDir)
+        file.Remote = remote
+    }
+
+    if w.askYes("Upload every archive to an S3-compatible bucket?", false) {
+        s3 := defaults.S3
+        s3.Bucket = w.require("  Bucket")
+        s3.Region = w.ask("  Region", s3.Region)
+        s3.Endpoint = w.ask("  Endpoint (empty for AWS)", "")
+        s3.AccessKeyID = w.require("  Access key ID")
+        s3.Prefix = w.ask("  Key prefix (optional)", "")
+        file.S3 = &s3
+        if err := storeSecret(w, "S3_SECRET_ACCESS_KEY", "  Secret access key"); err != nil {
+            return err
+        }
+    }
+
+    if w.askYes("Email a report of every run?", false) {
+        smtp := defaults.Report.SMTP
+        smtp.Host = w.require("  SMTP host")
+        smtp.Port = w.ask("  SMTP port", smtp.Port)
+        smtp.Security = w.askChoice("  Security", smtp.Security, config.SMTPStartTLS, config.SMTPTLS, config.SMTPNone)
+        smtp.Username = w.ask("  SMTP user (optional)", "")
+        smtp.From = w.require("  Sender address")
+        for _, to := range strings.Split(w.ask("  Recipients, comma-separated", ""), ",") {
+            if to = strings.TrimSpace(to); to != "" {
+                smtp.To = append(smtp.To, to)
+            }
+        }
+        file.Report = &initReport{SMTP: smtp}
+        if smtp.Username != "" {
+            if err := storeSecret(w, "SMTP_PASSWORD", "  SMTP password"); err != nil {
+                return err
+            }
+        }
+    }
+
+    start := w.askChoice("Start scheduled backups with", startDaemon, startDaemon, startTimer, startCron)
+    onCalendar := ""
+    if start == startTimer {
+        onCalendar = w.ask("  systemd OnCalendar of the backup run", "*-*-* 02:00:00")
+    } else {
+        file.Schedules = map[string]string{"backup": w.ask("  Cron expression of the backup run", "0 2 * * *")}
+    }
+
+    var buf bytes.Buffer
+    buf.WriteString("# Written by laravel-backup-tool init; see backup.yaml.example for all settings\n\n")
+    encoder := yaml.NewEncoder(&buf)
+    encoder.SetIndent(2)
+    if err := encoder.Encode(file); err != nil {
+        return fmt.Errorf("failed to encode configuration: %v", err)
+    }
+    data := buf.Bytes()
+    check := config.DefaultConfig()
+    if err := yaml.Unmarshal(data, check); err != nil {
+        return fmt.Errorf("failed to check configuration: %v", err)
+    }
+    if err := check.Validate(); err != nil {
+        return fmt.Errorf("invalid configuration, nothing written: %v", err)
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("failed to create configuration directory: %v", err)
+    }
+    if err := os.WriteFile(path, data, 0600); err != nil {
+        return fmt.Errorf("failed to write configuration: %v", err)
+    }
+    fmt.Printf("\nWrote %s\n", path)
+
+    var (
+        units []string
+        err   error
+    )
+    if start != startCron && w.askYes(fmt.Sprintf("Write systemd units to %s?", *systemdDir), true) {
+        if units, err = writeUnits(*systemdDir, path, profile, start, onCalendar); err != nil {
+            return err
+        }
+    }
+
+    command := "laravel-backup-tool"
+    if profile != "" {
+        command += " --profile " + profile
+    }
+    width := len(command) + len(" config validate")
+    fmt.Println("\nNext steps:")
+    if file.Remote != nil {
+        fmt.Printf("  %-*s  # trust the remote server's host key\n", width, command+" trust-host")
+    }
+    fmt.Printf("  %-*s  # check the files the configuration refers to\n", width, command+" config validate")
+    fmt.Printf("  %-*s  # make the first backups\n", width, command+" backup")
+    switch {
+    case len(units) > 0:
+        fmt.Printf("  systemctl daemon-reload && systemctl enable --now %s\n", units[len(units)-1])
+    case start == startCron:
+        fmt.Printf("  %-*s  # print the crontab entries\n", width, command+" config schedule")
+    }
+    if profile == "" && path != config.ConfigSearchPaths[1] {
+        fmt.Printf("Set BACKUP_CONFIG=%s when running the tool from another directory.\n", path)
+    }
+    return nil
+}
+
+// countSites describes how many sites the web server configuration serves
+func countSites(webServer, configPath string) string {
+    vhosts, err := config.ParseVhosts(webServer, configPath)
+    if err != nil {
+        return fmt.Sprintf("no sites found: %v", err)
+    }
+    return fmt.Sprintf("%d sites found", len(vhosts))
+}
+
+// freeSpaceOf returns the free space of the volume a directory is or will be
+// created on
+func freeSpaceOf(dir string) string {
+    for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+        if free, err := backup.FreeSpace(dir); err == nil {
+            return free.String()
+        }
+        if dir == filepath.Dir(dir) {
+            return "unknown space"
+        }
+    }
+}
+
+// storeSecret asks for a secret and stores it in the keyring, or explains
+// how to set it if there is no keyring
+func storeSecret(w *wizard, name, question string) error {
+    value, err := w.askSecret(question)
+    if err != nil || value == "" {
+        return err
+    }
+    if !secrets.KeyringAvailable() {
+        fmt.Printf("  No keyring found; set %s in the .env file next to the configuration\n", name)
+        return nil
+    }
+    if err := secrets.Store(name, value); err != nil {
+        return fmt.Errorf("failed to store %s in the keyring: %v", name, err)
+    }
+    fmt.Printf("  Stored %s in the OS keyring\n", name)
+    return nil
+}
+
+// writeUnits writes a systemd service running the daemon, or a oneshot
+// service running a backup with a timer starting it, and returns the names
+// of the units. The units of a profile are named after it.
+func writeUnits(dir, configPath, profile, start, onCalendar string) ([]string, error) {
+    binary, err := os.Executable()
+    if err != nil {
+        return nil, fmt.Errorf("failed to locate executable: %v", err)
+    }
+    // .env is read from the working directory
+    unit, description := "laravel-backup-tool", "Laravel backup tool"
+    environment, workDir := "BACKUP_CONFIG="+configPath, filepath.Dir(configPath)
+    if profile != "" {
+        // The profile file is found next to backup.yaml, which is found in
+        // the working directory
+        unit += "-" + profile
+        description += " (" + profile + ")"
+        environment, workDir = config.ProfileEnv+"="+profile, filepath.Dir(workDir)
+        if base := config.ConfigFile(); base != "" {
+            if abs, err := filepath.Abs(base); err == nil {
+                base = abs
+            }
+            environment += "\nEnvironment=BACKUP_CONFIG=" + base
+        }
+    }
+    service := fmt.Sprintf(`[Unit]
+Description=%s
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Environment=%s
+WorkingDirectory=%s
+`, description, environment, workDir)
+    units := map[string]string{}
+    names := []string{unit + ".service"}
+    if start == startDaemon {
+        // Running archive jobs finish before the daemon exits
+        service += fmt.Sprintf("ExecStart=%s --daemon\nExecReload=/bin/kill -HUP $MAINPID\nRestart=on-failure\nTimeoutStopSec=6h\n\n[Install]\nWantedBy=multi-user.target\n", binary)
+    } else {
+        service += fmt.Sprintf("Type=oneshot\nExecStart=%s backup\n", binary)
+        units[unit+".timer"] = fmt.Sprintf("[Unit]\nDescription=%s run\n\n[Timer]\nOnCalendar=%s\nPersistent=true\n\n[Install]\nWantedBy=timers.target\n", description, onCalendar)
+        names = append(names, unit+".timer")
+    }
+    units[unit+".service"] = service
+
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+    }
+    for _, name := range names {
+        unitPath := filepath.Join(dir, name)
+        if err := os.WriteFile(unitPath, []byte(units[name]), 0644); err != nil {
+            return nil, fmt.Errorf("failed to write %s: %v", unitPath, err)
+        }
+        fmt.Printf("Wrote %s\n", unitPath)
+    }
+    return names, nil
+}
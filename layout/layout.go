@@ -0,0 +1,299 @@
+// Package layout names backup archives and places them below the backup
+// directory with a template, and recognizes archives from their paths by
+// the same template.
+package layout
+
+import (
+    "bytes"
+    "fmt"
+    "path"
+    "regexp"
+    "strings"
+    "text/template"
+    "time"
+)
+
+// Default is the layout of the backup directory: file archives in the
+// site's directory and database dumps, binary logs and physical database
+// backups in its database directory, e.g.
+// example.com/files_2025-02-10_220130.tar.gz and
+// example.com/database/db_2025-02-10_220130.sql.gz
+const Default = `{{.Site}}/{{if eq .Type "db" "binlog" "physical"}}database/{{end}}{{.Type}}_{{.Date}}_{{.Time}}{{.Incr}}.{{.Ext}}`
+
+// Formats of the date and time fields
+const (
+    DateFormat = "2006-01-02"
+    TimeFormat = "150405"
+)
+
+// Archive types, and the values of the Type field they stand for
+var (
+    archiveTypes = []string{"file", "database", "binlog", "redis", "mongo", "physical"}
+    typeNames    = map[string]string{"file": "files", "database": "db", "binlog": "binlog", "redis": "redis", "mongo": "mongo", "physical": "physical"}
+    // Types with incremental archives
+    incrementalTypes = map[string]bool{"file": true, "physical": true}
+)
+
+// Fields are the values a layout template is executed with
+type Fields struct {
+    // Site is the site's name; applications of multi-app sites are named
+    // <site>/apps/<app>
+    Site string
+    // Type is "files" for file archives, "db" for database dumps, "binlog"
+    // for archived binary logs, "physical" for physical database backups
+    // and "redis" or "mongo" for dumps of those data stores
+    Type string
+    // Date and Time are when the backup was made, as 2006-01-02 and 150405;
+    // Timestamp is both as 2006-01-02_150405
+    Date      string
+    Time      string
+    Timestamp string
+    // Incr is "_incr" for incremental file archives and physical database
+    // backups and empty otherwise
+    Incr string
+    // Ext is the extension without the leading dot, e.g. tar.gz, sql.zst,
+    // sqlite.gz or snapshot
+    Ext string
+}
+
+// Archive is what a path says about the archive it holds
+type Archive struct {
+    // Type is "file", "database", "binlog", "redis", "mongo" or "physical"
+    Type        string
+    Time        time.Time
+    Incremental bool
+    // Ext is the extension with the leading dot
+    Ext string
+    // Rel is the path below the site's directory
+    Rel string
+}
+
+// Layout renders archive paths from a template and matches paths against it
+type Layout struct {
+    text     string
+    tmpl     *template.Template
+    variants []variant
+}
+
+// variant matches the paths of one type of archive, full or incremental
+type variant struct {
+    archiveType string
+    incremental bool
+    re          *regexp.Regexp
+    // Indexes of the submatches of the fields, 0 if not in the template
+    date, time, timestamp, ext, rel int
+}
+
+// Markers stand in for the fields that vary between archives of a type
+// while the template is turned into a regular expression
+const (
+    siteMarker      = "\x00site\x00"
+    dateMarker      = "\x00date\x00"
+    timeMarker      = "\x00time\x00"
+    timestampMarker = "\x00timestamp\x00"
+    extMarker       = "\x00ext\x00"
+)
+
+// Patterns of the fields in paths
+var fieldPatterns = map[string]string{
+    siteMarker:      `[^/]+(?:/apps/[^/]+)?`,
+    dateMarker:      `\d{4}-\d{2}-\d{2}`,
+    timeMarker:      `\d{6}`,
+    timestampMarker: `\d{4}-\d{2}-\d{2}_\d{6}`,
+    extMarker:       `[A-Za-z0-9]+(?:\.[A-Za-z0-9]+)*`,
+}
+
+var markerPattern = regexp.MustCompile("\x00[a-z]+\x00")
+
+// Parse parses a layout template. The path it renders must start with the
+// site's directory and end with the extension, and name the time of the
+// backup and the type of archive.
+func Parse(text string) (*Layout, error) {
+    tmpl, err := template.New("layout").Option("missingkey=error").Parse(text)
+    if err != nil {
+        return nil, fmt.Errorf("invalid layout: %v", err)
+    }
+    l := &Layout{text: text, tmpl: tmpl}
+
+    for _, archiveType := range archiveTypes {
+        for _, incremental := range []bool{false, true} {
+            if !incrementalTypes[archiveType] && incremental {
+                continue
+            }
+            v, err := l.variant(archiveType, incremental)
+            if err != nil {
+                return nil, err
+            }
+            l.variants = append(l.variants, v)
+        }
+    }
+
+    // Every kind of archive must be told apart from the others, except
+    // incremental archives from full ones, see Incremental
+    sample := time.Date(2025, 2, 10, 22, 1, 30, 0, time.Local)
+    for _, v := range l.variants {
+        p, err := l.render("example.com", v.archiveType, sample, v.incremental, ".tar")
+        if err != nil {
+            return nil, err
+        }
+        if a, ok := l.Match(p); !ok || a.Type != v.archiveType {
+            return nil, fmt.Errorf("invalid layout %q: archives of different types get the same paths, use {{.Type}}", text)
+        }
+    }
+    return l, nil
+}
+
+// MustParse is like Parse but panics if the template is invalid
+func MustParse(text string) *Layout {
+    l, err := Parse(text)
+    if err != nil {
+        panic(err)
+    }
+    return l
+}
+
+// String returns the template
+func (l *Layout) String() string {
+    return l.text
+}
+
+// Incremental reports whether incremental archives get other paths than
+// full ones, which incremental backups require
+func (l *Layout) Incremental() bool {
+    return l.variants[0].re.String() != l.variants[1].re.String()
+}
+
+// variant turns the template into the regular expression matching the
+// paths of one kind of archive
+func (l *Layout) variant(archiveType string, incremental bool) (variant, error) {
+    fields := Fields{
+        Site:      siteMarker,
+        Type:      typeNames[archiveType],
+        Date:      dateMarker,
+        Time:      timeMarker,
+        Timestamp: timestampMarker,
+        Ext:       extMarker,
+    }
+    if incremental {
+        fields.Incr = "_incr"
+    }
+    var buf bytes.Buffer
+    if err := l.tmpl.Execute(&buf, fields); err != nil {
+        return variant{}, fmt.Errorf("invalid layout %q: %v", l.text, err)
+    }
+    rendered := buf.String()
+    if !strings.HasPrefix(rendered, siteMarker+"/") {
+        return variant{}, fmt.Errorf("invalid layout %q: it must start with {{.Site}}/", l.text)
+    }
+    if !strings.HasSuffix(rendered, "."+extMarker) {
+        return variant{}, fmt.Errorf("invalid layout %q: it must end with .{{.Ext}}", l.text)
+    }
+    hasDate, hasTime := strings.Contains(rendered, dateMarker), strings.Contains(rendered, timeMarker)
+    if !strings.Contains(rendered, timestampMarker) && !(hasDate && hasTime) {
+        return variant{}, fmt.Errorf("invalid layout %q: it needs {{.Timestamp}} or {{.Date}} and {{.Time}}", l.text)
+    }
+    for _, part := range strings.Split(rendered, "/") {
+        if part == "" || part == "." || part == ".." {
+            return variant{}, fmt.Errorf("invalid layout %q: empty or relative path element", l.text)
+        }
+    }
+
+    v := variant{archiveType: archiveType, incremental: incremental}
+    var pattern strings.Builder
+    // The site's directory is matched on its own, so Rel is what follows it
+    pattern.WriteString(`(?:^|/)(?:` + fieldPatterns[siteMarker] + `)/(`)
+    rest := strings.TrimPrefix(rendered, siteMarker+"/")
+    group := 1
+    v.rel = group
+    last := 0
+    for _, loc := range markerPattern.FindAllStringIndex(rest, -1) {
+        pattern.WriteString(regexp.QuoteMeta(rest[last:loc[0]]))
+        last = loc[1]
+        marker := rest[loc[0]:loc[1]]
+        var index *int
+        switch marker {
+        case dateMarker:
+            index = &v.date
+        case timeMarker:
+            index = &v.time
+        case timestampMarker:
+            index = &v.timestamp
+        case extMarker:
+            index = &v.ext
+        }
+        // Only the first occurrence of a field is read
+        if index != nil && *index == 0 {
+            group++
+            *index = group
+            pattern.WriteString("(" + fieldPatterns[marker] + ")")
+        } else {
+            pattern.WriteString("(?:" + fieldPatterns[marker] + ")")
+        }
+    }
+    pattern.WriteString(regexp.QuoteMeta(rest[last:]) + ")$")
+    re, err := regexp.Compile(pattern.String())
+    if err != nil {
+        return variant{}, fmt.Errorf("invalid layout %q: %v", l.text, err)
+    }
+    v.re = re
+    return v, nil
+}
+
+// render executes the template for an archive
+func (l *Layout) render(site, archiveType string, t time.Time, incremental bool, ext string) (string, error) {
+    fields := Fields{
+        Site:      site,
+        Type:      typeNames[archiveType],
+        Date:      t.Format(DateFormat),
+        Time:      t.Format(TimeFormat),
+        Timestamp: t.Format(DateFormat + "_" + TimeFormat),
+        Ext:       strings.TrimPrefix(ext, "."),
+    }
+    if incremental {
+        fields.Incr = "_incr"
+    }
+    var buf bytes.Buffer
+    if err := l.tmpl.Execute(&buf, fields); err != nil {
+        return "", fmt.Errorf("failed to render layout: %v", err)
+    }
+    return buf.String(), nil
+}
+
+// Path returns the slash-separated path of an archive below the backup
+// directory. archiveType is one of the types of Archive and ext the extension
+// with its leading dot.
+func (l *Layout) Path(site, archiveType string, t time.Time, incremental bool, ext string) string {
+    // Parse executed the template with every field, so it can't fail here
+    p, _ := l.render(site, archiveType, t, incremental, ext)
+    return path.Clean(p)
+}
+
+// Match reports what kind of archive a path holds, by its end. It doesn't
+// check the extension against the archive type.
+func (l *Layout) Match(p string) (Archive, bool) {
+    p = strings.ReplaceAll(p, "\\", "/")
+    for _, v := range l.variants {
+        m := v.re.FindStringSubmatch(p)
+        if m == nil {
+            continue
+        }
+        var stamp string
+        if v.timestamp != 0 {
+            stamp = m[v.timestamp]
+        } else {
+            stamp = m[v.date] + "_" + m[v.time]
+        }
+        t, err := time.ParseInLocation(DateFormat+"_"+TimeFormat, stamp, time.Local)
+        if err != nil {
+            continue
+        }
+        return Archive{
+            Type:        v.archiveType,
+            Time:        t,
+            Incremental: v.incremental,
+            Ext:         "." + m[v.ext],
+            Rel:         m[v.rel],
+        }, true
+    }
+    return Archive{}, false
+}
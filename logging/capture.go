@@ -0,0 +1,111 @@
+package logging
+
+import (
+    "context"
+    "io"
+    "sync"
+)
+
+// maxCaptureSize is how much log output a capture keeps; later output is dropped
+const maxCaptureSize = 8 << 20
+
+// output is the writer of the default logger. It passes the log output on to
+// the configured writer and copies it to the open captures.
+var output = &teeWriter{captures: make(map[*Capture]struct{})}
+
+// teeWriter writes to w and to every open capture. Handlers write every
+// record with a single Write, so captures receive whole records.
+type teeWriter struct {
+    mu       sync.Mutex
+    w        io.Writer
+    captures map[*Capture]struct{}
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for c := range t.captures {
+        c.append(p)
+    }
+    return t.w.Write(p)
+}
+
+// Capture collects the log output written while it is open, such as the log
+// of one run, and lets readers follow it as it grows
+type Capture struct {
+    mu      sync.Mutex
+    data    []byte
+    closed  bool
+    dropped bool
+    // changed is closed and replaced whenever output is added or the capture closed
+    changed chan struct{}
+}
+
+// StartCapture starts collecting the log output
+func StartCapture() *Capture {
+    c := &Capture{changed: make(chan struct{})}
+    output.mu.Lock()
+    output.captures[c] = struct{}{}
+    output.mu.Unlock()
+    return c
+}
+
+// Close stops collecting; followers return once they have read everything
+func (c *Capture) Close() {
+    output.mu.Lock()
+    delete(output.captures, c)
+    output.mu.Unlock()
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.closed {
+        c.closed = true
+        close(c.changed)
+    }
+}
+
+// append adds output to the capture
+func (c *Capture) append(p []byte) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if len(c.data)+len(p) > maxCaptureSize {
+        if !c.dropped {
+            c.data = append(c.data, "... log output truncated\n"...)
+            c.dropped = true
+        }
+    } else {
+        c.data = append(c.data, p...)
+    }
+    close(c.changed)
+    c.changed = make(chan struct{})
+}
+
+// Follow writes the captured output to w and then the output added later,
+// calling flush after every write, until the capture is closed or ctx is
+// cancelled
+func (c *Capture) Follow(ctx context.Context, w io.Writer, flush func()) error {
+    offset := 0
+    for {
+        c.mu.Lock()
+        pending := c.data[offset:]
+        closed, changed := c.closed, c.changed
+        c.mu.Unlock()
+
+        if len(pending) > 0 {
+            if _, err := w.Write(pending); err != nil {
+                return err
+            }
+            offset += len(pending)
+            flush()
+            continue
+        }
+        if closed {
+            return nil
+        }
+        select {
+        case <-changed:
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+    }
+}
@@ -0,0 +1,175 @@
+package logging
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "log/slog"
+    "regexp"
+    "strings"
+    "sync"
+)
+
+// Formats of the log output
+const (
+    FormatText = "text"
+    FormatJSON = "json"
+)
+
+// redacted replaces secrets in log output
+const redacted = "********"
+
+var (
+    runMu sync.RWMutex
+    runID string
+)
+
+// Setup makes the default logger write records of at least the given level
+// (debug, info, warn or error) to w as text or JSON, with credentials redacted
+func Setup(w io.Writer, format, level string) error {
+    var lvl slog.Level
+    if err := lvl.UnmarshalText([]byte(level)); err != nil {
+        return fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+    }
+    opts := &slog.HandlerOptions{Level: lvl}
+
+    var handler slog.Handler
+    switch format {
+    case FormatText:
+        handler = slog.NewTextHandler(output, opts)
+    case FormatJSON:
+        handler = slog.NewJSONHandler(output, opts)
+    default:
+        return fmt.Errorf("unknown log format %q, use text or json", format)
+    }
+    output.mu.Lock()
+    output.w = w
+    output.mu.Unlock()
+    // Run logs are JSON whatever the format of the output
+    runLog := &runLogHandler{next: slog.NewJSONHandler(runLogs, opts)}
+    slog.SetDefault(slog.New(&redactHandler{next: fanoutHandler{handler, runLog}}))
+    return nil
+}
+
+// StartRun assigns a new correlation ID to the records logged until the
+// returned function is called, so the records of one run can be found
+// together
+func StartRun() (string, func()) {
+    b := make([]byte, 4)
+    rand.Read(b)
+    id := hex.EncodeToString(b)
+
+    runMu.Lock()
+    previous := runID
+    runID = id
+    runMu.Unlock()
+    return id, func() {
+        runMu.Lock()
+        runID = previous
+        runMu.Unlock()
+    }
+}
+
+// currentRun returns the correlation ID of the running run, if any
+func currentRun() string {
+    runMu.RLock()
+    defer runMu.RUnlock()
+    return runID
+}
+
+// sensitiveKeys are parts of attribute names whose values are never logged
+var sensitiveKeys = []string{"password", "passwd", "passphrase", "secret", "token", "credential"}
+
+// sensitivePatterns match credentials inside messages and values: mysql
+// -p<password> options, NAME=value assignments and user:password@ in URLs.
+// The replacement keeps everything but the credential.
+var sensitivePatterns = []struct {
+    re          *regexp.Regexp
+    replacement string
+}{
+    {regexp.MustCompile(`(\b(?:mysql|mysqldump|mariadb|mariadb-dump)\b[^|;&]*?\s-p)('[^']*'|"[^"]*"|\S+)`), "${1}" + redacted},
+    {regexp.MustCompile(`(?i)(\b[A-Z0-9_]*(?:PASSWORD|PASSWD|PWD|SECRET|TOKEN)[A-Z0-9_]*\s*[=:]\s*)('[^']*'|"[^"]*"|[^\s,;]+)`), "${1}" + redacted},
+    {regexp.MustCompile(`(://[^/\s:@]+:)[^@\s/]+@`), "${1}" + redacted + "@"},
+}
+
+// Redact masks credentials in a string. It is applied to every log record
+// and can be used for text that is stored elsewhere, such as error messages.
+func Redact(s string) string {
+    for _, p := range sensitivePatterns {
+        s = p.re.ReplaceAllString(s, p.replacement)
+    }
+    return s
+}
+
+// sensitiveKey reports whether an attribute holds a credential
+func sensitiveKey(key string) bool {
+    key = strings.ToLower(key)
+    for _, s := range sensitiveKeys {
+        if strings.Contains(key, s) {
+            return true
+        }
+    }
+    return false
+}
+
+// redactAttr masks an attribute's value if its name is sensitive and
+// credentials inside its text otherwise
+func redactAttr(a slog.Attr) slog.Attr {
+    if sensitiveKey(a.Key) {
+        return slog.String(a.Key, redacted)
+    }
+    v := a.Value.Resolve()
+    switch v.Kind() {
+    case slog.KindString:
+        return slog.String(a.Key, Redact(v.String()))
+    case slog.KindGroup:
+        attrs := v.Group()
+        masked := make([]any, len(attrs))
+        for i, attr := range attrs {
+            masked[i] = redactAttr(attr)
+        }
+        return slog.Group(a.Key, masked...)
+    case slog.KindAny:
+        if err, ok := v.Any().(error); ok {
+            return slog.String(a.Key, Redact(err.Error()))
+        }
+        return slog.String(a.Key, Redact(fmt.Sprint(v.Any())))
+    }
+    return slog.Attr{Key: a.Key, Value: v}
+}
+
+// redactHandler masks credentials before records reach the next handler and
+// adds the correlation ID of the running run
+type redactHandler struct {
+    next slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+    masked := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+    if id := currentRun(); id != "" {
+        masked.AddAttrs(slog.String("run_id", id))
+    }
+    r.Attrs(func(a slog.Attr) bool {
+        masked.AddAttrs(redactAttr(a))
+        return true
+    })
+    return h.next.Handle(ctx, masked)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    masked := make([]slog.Attr, len(attrs))
+    for i, a := range attrs {
+        masked[i] = redactAttr(a)
+    }
+    return &redactHandler{next: h.next.WithAttrs(masked)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+    return &redactHandler{next: h.next.WithGroup(name)}
+}
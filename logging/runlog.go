@@ -0,0 +1,130 @@
+package logging
+
+import (
+    "context"
+    "fmt"
+    "log/slog"
+    "os"
+    "sync"
+)
+
+// RunLogName is the name of the file a run's log is written to in its
+// directory, one JSON object per record
+const RunLogName = "log.jsonl"
+
+// runLogs receives the records as JSON for the open run logs, whatever the
+// format of the log output
+var runLogs = &runLogWriter{logs: make(map[*RunLog]struct{})}
+
+// runLogWriter writes to every open run log. Handlers write every record
+// with a single Write, so run logs receive whole records.
+type runLogWriter struct {
+    mu   sync.Mutex
+    logs map[*RunLog]struct{}
+}
+
+func (w *runLogWriter) Write(p []byte) (int, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    for l := range w.logs {
+        // A full disk must not break the run, only its log
+        l.f.Write(p)
+    }
+    return len(p), nil
+}
+
+// open reports whether any run log is open
+func (w *runLogWriter) open() bool {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return len(w.logs) > 0
+}
+
+// RunLog writes the records logged while it is open to a file, as JSON
+// lines with credentials redacted like the log output
+type RunLog struct {
+    f *os.File
+}
+
+// OpenRunLog starts writing the records to a new run log at path
+func OpenRunLog(path string) (*RunLog, error) {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+    if err != nil {
+        return nil, fmt.Errorf("failed to create run log: %v", err)
+    }
+    l := &RunLog{f: f}
+    runLogs.mu.Lock()
+    runLogs.logs[l] = struct{}{}
+    runLogs.mu.Unlock()
+    return l, nil
+}
+
+// Close stops writing to the run log
+func (l *RunLog) Close() error {
+    runLogs.mu.Lock()
+    delete(runLogs.logs, l)
+    runLogs.mu.Unlock()
+    return l.f.Close()
+}
+
+// runLogHandler passes records on to the JSON handler of the run logs while
+// any is open
+type runLogHandler struct {
+    next slog.Handler
+}
+
+func (h *runLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return runLogs.open() && h.next.Enabled(ctx, level)
+}
+
+func (h *runLogHandler) Handle(ctx context.Context, r slog.Record) error {
+    return h.next.Handle(ctx, r)
+}
+
+func (h *runLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    return &runLogHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *runLogHandler) WithGroup(name string) slog.Handler {
+    return &runLogHandler{next: h.next.WithGroup(name)}
+}
+
+// fanoutHandler passes records to every handler enabled for their level
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    for _, next := range h {
+        if next.Enabled(ctx, level) {
+            return true
+        }
+    }
+    return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+    var first error
+    for _, next := range h {
+        if next.Enabled(ctx, r.Level) {
+            if err := next.Handle(ctx, r.Clone()); err != nil && first == nil {
+                first = err
+            }
+        }
+    }
+    return first
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    handlers := make(fanoutHandler, len(h))
+    for i, next := range h {
+        handlers[i] = next.WithAttrs(attrs)
+    }
+    return handlers
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+    handlers := make(fanoutHandler, len(h))
+    for i, next := range h {
+        handlers[i] = next.WithGroup(name)
+    }
+    return handlers
+}
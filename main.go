@@ -1,182 +1,168 @@
 package main
 
 import (
+    "errors"
     "fmt"
-    "log"
-    "sync"
+    "log/slog"
     "os"
+    "strings"
+    "time"
     "github.com/joho/godotenv"
+    "laravel-backup-tool/backuptool"
     "laravel-backup-tool/config"
-    "laravel-backup-tool/models"
-    "laravel-backup-tool/backup"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/report"
 )
 
-// BackupResult stores the result of a backup operation
-type BackupResult struct {
-    SiteName string
-    Error    error
-    Type     string // "file" or "database"
-}
+// cfg is the configuration from backup.yaml and the environment
+var cfg *config.Config
+
+// tool performs backup runs and the other operations of the commands with cfg
+var tool *backuptool.Tool
 
 func main() {
     // Load environment variables
-    if err := godotenv.Load(); err != nil {
-        log.Printf("Warning: .env file not found, using default settings")
-    }
+    envErr := godotenv.Load()
 
-    // First, perform local backups
-    fmt.Println("Starting local backups...")
-    if err := performLocalBackups(); err != nil {
-        log.Printf("Error during local backups: %v", err)
+    // --profile comes before the command and selects the profile for the
+    // configuration, for init the file it writes
+    profile, args, err := profileArg(os.Args[1:])
+    if err != nil {
+        fatal(&exitError{code: report.ExitConfig, err: err})
+    }
+    if profile != "" {
+        os.Setenv(config.ProfileEnv, profile)
     }
+    os.Args = append(os.Args[:1], args...)
 
-    // Then, if enabled, perform remote backups
-    if os.Getenv("REMOTE_BACKUP_ENABLED") == "true" {
-        fmt.Println("\nStarting remote backups...")
-        if err := performRemoteBackups(); err != nil {
-            log.Printf("Error during remote backups: %v", err)
+    // init writes the configuration, so it must not need one
+    if len(os.Args) > 1 && os.Args[1] == "init" {
+        logging.Setup(os.Stderr, "text", "info")
+        if err := runInit(os.Args[2:]); err != nil {
+            fatal(err)
         }
+        return
     }
-}
 
-func performLocalBackups() error {
-    // Parse Apache configuration file to get site information
-    sites, err := config.ParseApacheConfig("/etc/apache2/conf/httpd.conf")
-    if err != nil {
-        return fmt.Errorf("error parsing Apache config: %v", err)
+    // Read backup.yaml; environment variables override its values
+    if cfg, err = config.LoadConfig(); err != nil {
+        // config validate reports an invalid configuration on its own
+        if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "validate" {
+            err = runConfigValidate(os.Args[3:], err)
+        }
+        fatal(&exitError{code: report.ExitConfig, err: err})
     }
-
-    // Initialize backup manager with the script-specific backup directory
-    backupManager, err := backup.NewBackupManager("/laravel-backup-script")
-    if err != nil {
-        return fmt.Errorf("error initializing backup manager: %v", err)
+    tool = backuptool.New(cfg)
+    tool.Output, tool.Stop = os.Stdout, shutdown
+    // Logs go to stderr, so the output of commands can be piped
+    if err := setupLogging(cfg); err != nil {
+        fatal(&exitError{code: report.ExitConfig, err: err})
+    }
+    if envErr != nil {
+        slog.Warn(".env file not found, using default settings")
     }
 
-    // Initialize backup handlers for files and databases
-    fileBackup := backup.NewFileBackup(backupManager)
-    dbBackup := backup.NewDBBackup(backupManager)
-
-    // Store information about all sites
-    var siteInfos []models.Site
-
-    // Channel for collecting backup results
-    resultChan := make(chan BackupResult)
-    
-    // WaitGroup to track all running goroutines
-    var wg sync.WaitGroup
-
-    // Process each site: get Laravel database credentials and perform backups
-    for serverName, documentRoot := range sites {
-        site := models.Site{
-            ServerName:   serverName,
-            DocumentRoot: documentRoot,
-        }
+    // Backup runs started from the command line are aborted by a signal,
+    // so they don't leave remote processes and partial archives behind
+    if len(os.Args) == 1 || os.Args[1] == "backup" || os.Args[1] == "retry" || os.Args[1] == "standby" {
+        abortOnSignal()
+    }
 
-        // Parse Laravel .env file for database credentials
-        dbHost, dbName, dbUser, dbPass, _ := config.ParseLaravelEnv(documentRoot)
-        site.DatabaseHost = dbHost
-        site.DatabaseName = dbName
-        site.DatabaseUser = dbUser
-        site.DatabasePass = dbPass
-
-        siteInfos = append(siteInfos, site)
-
-        // Start file backup in a goroutine
-        wg.Add(1)
-        go func(site models.Site) {
-            defer wg.Done()
-            err := fileBackup.BackupFiles(site.ServerName, site.DocumentRoot)
-            resultChan <- BackupResult{
-                SiteName: site.ServerName,
-                Error:    err,
-                Type:     "file",
-            }
-        }(site)
-
-        // Start database backup in a goroutine if credentials are available
-        if dbHost != "" && dbName != "" && dbUser != "" && dbPass != "" {
-            wg.Add(1)
-            go func(site models.Site) {
-                defer wg.Done()
-                err := dbBackup.BackupDatabase(site.ServerName, site.DatabaseHost, 
-                    site.DatabaseName, site.DatabaseUser, site.DatabasePass)
-                resultChan <- BackupResult{
-                    SiteName: site.ServerName,
-                    Error:    err,
-                    Type:     "database",
-                }
-            }(site)
+    // Dispatch auxiliary commands; without arguments a backup run is performed
+    if len(os.Args) > 1 {
+        if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+            fatal(err)
         }
+        return
     }
 
-    // Start a goroutine to close result channel when all backups are done
-    go func() {
-        wg.Wait()
-        close(resultChan)
-    }()
-
-    // Collect and display backup results
-    fmt.Println("\nLocal Backup Results:")
-    fmt.Println("-------------------")
-    
-    for result := range resultChan {
-        if result.Error != nil {
-            log.Printf("Warning: Failed to backup %s (%s): %v", 
-                result.SiteName, result.Type, result.Error)
-        } else {
-            fmt.Printf("Successfully backed up %s (%s)\n", 
-                result.SiteName, result.Type)
-        }
+    if err := runBackup(backuptool.Scope{}, 0); err != nil {
+        fatal(err)
     }
+}
 
-    // Display information about all found sites
-    fmt.Println("\nFound sites:")
-    for _, site := range siteInfos {
-        fmt.Printf("\nSite: %s\n", site.ServerName)
-        fmt.Printf("Document Root: %s\n", site.DocumentRoot)
-        
-        // Display database information only if available
-        if site.DatabaseHost != "" || site.DatabaseName != "" || site.DatabaseUser != "" || site.DatabasePass != "" {
-            fmt.Printf("Database Host: %s\n", site.DatabaseHost)
-            fmt.Printf("Database Name: %s\n", site.DatabaseName)
-            fmt.Printf("Database User: %s\n", site.DatabaseUser)
-            fmt.Printf("Database Password: %s\n", site.DatabasePass)
-        } else {
-            fmt.Println("No database configuration found")
+// profileArg takes --profile NAME or --profile=NAME from the front of the
+// arguments and returns the name and the remaining arguments
+func profileArg(args []string) (string, []string, error) {
+    if len(args) == 0 {
+        return "", args, nil
+    }
+    name, value, hasValue := strings.Cut(args[0], "=")
+    if name != "--profile" && name != "-profile" {
+        return "", args, nil
+    }
+    args = args[1:]
+    if !hasValue {
+        if len(args) == 0 {
+            return "", nil, fmt.Errorf("--profile needs a profile name")
         }
-        fmt.Println("-------------------")
+        value, args = args[0], args[1:]
     }
-
-    return nil
+    if err := config.ValidateProfileName(value); err != nil {
+        return "", nil, err
+    }
+    return value, args, nil
 }
 
-func performRemoteBackups() error {
-    // Get SSH configuration from environment
-    sshConfig := &backup.SSHConfig{
-        Host:     os.Getenv("SSH_HOST"),
-        User:     os.Getenv("SSH_USER"),
-        Port:     os.Getenv("SSH_PORT"),
-        KeyPath:  os.Getenv("SSH_KEY_PATH"),
-        Password: os.Getenv("SSH_PASSWORD"),
+// setupLogging configures logging as c says; the records of a profile
+// carry its name
+func setupLogging(c *config.Config) error {
+    if err := logging.Setup(os.Stderr, c.Logging.Format, c.Logging.Level); err != nil {
+        return err
     }
-
-    // Validate SSH configuration
-    if sshConfig.Host == "" || sshConfig.User == "" || 
-       (sshConfig.KeyPath == "" && sshConfig.Password == "") {
-        return fmt.Errorf("incomplete SSH configuration")
+    if c.Profile != "" {
+        slog.SetDefault(slog.Default().With("profile", c.Profile))
     }
+    return nil
+}
 
-    // Initialize SSH backup
-    sshBackup, err := backup.NewSSHBackup(sshConfig)
+// runBackup performs a full backup run, or backs up only what scope
+// selects; see backuptool.Tool.Backup. A run holding the lock is waited for
+// up to wait. Runs in which sites failed return an error with the exit code
+// of their outcome.
+func runBackup(scope backuptool.Scope, wait time.Duration) error {
+    return runOutcome(tool.Backup(abort, scope, wait))
+}
+
+// runOutcome returns the error of a backup run with its report: the error
+// that ended it, or one with the exit code of its summary if not every site
+// succeeded
+func runOutcome(r *backuptool.Report, err error) error {
     if err != nil {
-        return fmt.Errorf("failed to initialize SSH backup: %v", err)
+        return err
     }
-    defer sshBackup.Close()
-
-    // Perform remote backups
-    if err := sshBackup.BackupRemoteSites(); err != nil {
-        return fmt.Errorf("failed to perform remote backups: %v", err)
+    summary := report.Summarize("", r, nil)
+    if summary.ExitCode == report.ExitSuccess {
+        return nil
     }
+    msg := fmt.Sprintf("backup run failed: %d of %d sites failed", summary.FailedSites, summary.TotalSites)
+    if summary.Status == report.SummaryPartial {
+        msg = fmt.Sprintf("backup run partially failed: %d of %d sites failed", summary.FailedSites, summary.TotalSites)
+    }
+    if len(summary.Failures) > 0 {
+        msg += fmt.Sprintf(", %d other steps failed", len(summary.Failures))
+    }
+    return &exitError{code: summary.ExitCode, err: errors.New(msg)}
+}
 
-    return nil
+// exitError is an error ending the program with a specific exit code
+type exitError struct {
+    code int
+    err  error
+}
+
+func (e *exitError) Error() string {
+    return e.err.Error()
+}
+
+// fatal logs the error that ended the program and exits with its exit
+// code, report.ExitFailure for errors without one
+func fatal(err error) {
+    slog.Error(err.Error())
+    code := report.ExitFailure
+    var exit *exitError
+    if errors.As(err, &exit) {
+        code = exit.code
+    }
+    os.Exit(code)
 }
@@ -1,14 +1,41 @@
 package models
 
-// Site represents a Laravel website configuration
+// Site represents a website configuration
 type Site struct {
     // ServerName from Apache configuration
-    ServerName    string
+    ServerName     string
     // DocumentRoot from Apache configuration
-    DocumentRoot  string
-    // Database connection details from Laravel .env
-    DatabaseHost  string
-    DatabaseName  string
-    DatabaseUser  string
-    DatabasePass  string
+    DocumentRoot   string
+    // Application whose configuration holds the database credentials,
+    // e.g. "laravel" or "wordpress"; empty if none was found
+    Framework      string
+    // Database connection details from the application's configuration
+    DatabaseDriver string
+    DatabaseHost   string
+    DatabasePort   string
+    DatabaseName   string
+    DatabaseUser   string
+    DatabasePass   string
+    // Further Laravel applications served by the same virtual host
+    Apps           []App
+}
+
+// App represents a Laravel application mapped into a site with an Alias,
+// backed up as a sub-component of the site
+type App struct {
+    // Name derived from the URL path, used for the backup directory
+    Name           string
+    // URL path the application is served under
+    Path           string
+    // Aliased directory from Apache configuration
+    DocumentRoot   string
+    // Laravel .env of the application
+    EnvFile        string
+    // Database connection details from the application's .env
+    DatabaseDriver string
+    DatabaseHost   string
+    DatabasePort   string
+    DatabaseName   string
+    DatabaseUser   string
+    DatabasePass   string
 }
@@ -0,0 +1,603 @@
+package queue
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Job kinds
+const (
+    KindDiscover = "discover"
+    KindArchive  = "archive"
+    KindDump     = "dump"
+    KindUpload   = "upload"
+    KindVerify   = "verify"
+    KindPrune    = "prune"
+    KindHook     = "hook"
+)
+
+// Job states
+const (
+    StatePending = "pending"
+    StateRunning = "running"
+    StateDone    = "done"
+    StateFailed  = "failed"
+    StateSkipped = "skipped" // a dependency failed or was skipped
+)
+
+const (
+    // DefaultMaxAttempts is how often a job is tried before it is marked failed
+    DefaultMaxAttempts = 3
+    // retryDelay is multiplied by the attempt number to get the backoff
+    retryDelay = 10 * time.Second
+    // currentFile holds the queue of the run in progress
+    currentFile = "current.json"
+)
+
+// Job is a single unit of work of a backup run
+type Job struct {
+    ID          string            `json:"id"`
+    Kind        string            `json:"kind"`
+    Site        string            `json:"site,omitempty"`
+    Params      map[string]string `json:"params,omitempty"`
+    DependsOn   []string          `json:"depends_on,omitempty"`
+    // Runs once its dependencies have finished, even if they failed or were skipped
+    Always      bool              `json:"always,omitempty"`
+    State       string            `json:"state"`
+    Attempts    int               `json:"attempts"`
+    MaxAttempts int               `json:"max_attempts"`
+    NotBefore   time.Time         `json:"not_before,omitempty"`
+    Error       string            `json:"error,omitempty"`
+    Result      map[string]string `json:"result,omitempty"`
+    CreatedAt   time.Time         `json:"created_at"`
+    // When the first attempt started; the job took until UpdatedAt once finished
+    StartedAt   time.Time         `json:"started_at,omitempty"`
+    UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// Handler executes a job and returns values that dependent jobs can read.
+// Handlers may enqueue further jobs and must return once ctx is cancelled.
+type Handler func(ctx context.Context, q *Queue, job *Job) (map[string]string, error)
+
+// Queue is a persisted set of jobs with dependencies belonging to one run
+type Queue struct {
+    mu      sync.Mutex
+    dir     string
+    file    string
+    stopped bool
+    maxSites int
+    RunID string `json:"run_id"`
+    Seq   int    `json:"seq"`
+    Jobs  []*Job `json:"jobs"`
+}
+
+// Open loads the unfinished run in dir, or starts a new empty run.
+// Jobs that were running when the previous process died are made pending again.
+func Open(dir string) (*Queue, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return nil, fmt.Errorf("failed to create queue directory: %v", err)
+    }
+
+    q, err := load(filepath.Join(dir, currentFile))
+    if err != nil {
+        if !os.IsNotExist(err) {
+            return nil, err
+        }
+        q = &Queue{RunID: time.Now().Format("20060102-150405")}
+    }
+    q.dir = dir
+    q.file = currentFile
+
+    for _, job := range q.Jobs {
+        if job.State == StateRunning {
+            job.State = StatePending
+        }
+    }
+    return q, nil
+}
+
+// load reads a queue file
+func load(path string) (*Queue, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    q := &Queue{}
+    if err := json.Unmarshal(data, q); err != nil {
+        return nil, fmt.Errorf("failed to parse queue file %s: %v", path, err)
+    }
+    return q, nil
+}
+
+// Empty reports whether no jobs have been enqueued in this run yet
+func (q *Queue) Empty() bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return len(q.Jobs) == 0
+}
+
+// Enqueue adds a pending job that runs once all dependencies are done
+func (q *Queue) Enqueue(kind, site string, params map[string]string, dependsOn ...string) (*Job, error) {
+    return q.enqueue(kind, site, params, false, dependsOn)
+}
+
+// EnqueueAlways adds a pending job that runs once all dependencies have
+// finished, whether they succeeded or not, e.g. to clean up after them
+func (q *Queue) EnqueueAlways(kind, site string, params map[string]string, dependsOn ...string) (*Job, error) {
+    return q.enqueue(kind, site, params, true, dependsOn)
+}
+
+// enqueue adds a pending job
+func (q *Queue) enqueue(kind, site string, params map[string]string, always bool, dependsOn []string) (*Job, error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    q.Seq++
+    now := time.Now()
+    job := &Job{
+        ID:          fmt.Sprintf("%s-%d", q.RunID, q.Seq),
+        Kind:        kind,
+        Site:        site,
+        Params:      params,
+        DependsOn:   dependsOn,
+        Always:      always,
+        State:       StatePending,
+        MaxAttempts: DefaultMaxAttempts,
+        CreatedAt:   now,
+        UpdatedAt:   now,
+    }
+    q.Jobs = append(q.Jobs, job)
+    return job, q.saveLocked()
+}
+
+// Job returns the job with the given ID, or nil
+func (q *Queue) Job(id string) *Job {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.jobLocked(id)
+}
+
+// jobLocked looks up a job; the caller must hold q.mu
+func (q *Queue) jobLocked(id string) *Job {
+    for _, job := range q.Jobs {
+        if job.ID == id {
+            return job
+        }
+    }
+    return nil
+}
+
+// DependencyResult returns the first non-empty result value for key among
+// the dependencies of job
+func (q *Queue) DependencyResult(job *Job, key string) string {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for _, id := range job.DependsOn {
+        if dep := q.jobLocked(id); dep != nil && dep.Result[key] != "" {
+            return dep.Result[key]
+        }
+    }
+    return ""
+}
+
+// Snapshot returns copies of all jobs in enqueue order
+func (q *Queue) Snapshot() []Job {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    jobs := make([]Job, len(q.Jobs))
+    for i, job := range q.Jobs {
+        jobs[i] = *job
+    }
+    return jobs
+}
+
+// ErrStopped is returned by Run when it was stopped before all jobs completed
+var ErrStopped = errors.New("job queue stopped")
+
+// Stop makes Run start no further jobs and return ErrStopped once the running
+// jobs have finished. The queue stays unfinished, so the next Open resumes it.
+func (q *Queue) Stop() {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.stopped = true
+}
+
+// LimitSites makes Run work on the jobs of at most n sites at a time; 0
+// removes the limit. A site counts from the start of its first job until all
+// its jobs have finished, so a started site is finished before another one
+// starts. Jobs without a site are not limited.
+func (q *Queue) LimitSites(n int) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.maxSites = n
+}
+
+// Run executes pending jobs with at most workers running concurrently until
+// no job can make progress. Failed jobs are retried with a linear backoff.
+// Once ctx is cancelled no further jobs are started and Run returns
+// ErrStopped like after Stop; jobs interrupted by the cancellation stay
+// pending without counting the attempt.
+func (q *Queue) Run(ctx context.Context, handlers map[string]Handler, workers int) error {
+    if workers < 1 {
+        workers = 1
+    }
+
+    type outcome struct {
+        job    *Job
+        result map[string]string
+        err    error
+    }
+    outcomes := make(chan outcome)
+    running := 0
+
+    for {
+        q.mu.Lock()
+        ready, wake := q.readyLocked(time.Now())
+        if q.stopped || ctx.Err() != nil {
+            ready, wake = nil, time.Time{}
+        }
+        progressed := false
+        active := q.activeSitesLocked()
+        for _, job := range ready {
+            if running >= workers {
+                break
+            }
+            if q.maxSites > 0 && job.Site != "" && !active[job.Site] {
+                if len(active) >= q.maxSites {
+                    continue
+                }
+                active[job.Site] = true
+            }
+            handler, ok := handlers[job.Kind]
+            if !ok {
+                job.State = StateFailed
+                job.Error = fmt.Sprintf("no handler for job kind %q", job.Kind)
+                job.UpdatedAt = time.Now()
+                progressed = true
+                continue
+            }
+            job.State = StateRunning
+            job.Attempts++
+            job.UpdatedAt = time.Now()
+            if job.Attempts == 1 {
+                job.StartedAt = job.UpdatedAt
+            }
+            running++
+            go func(job *Job, handler Handler) {
+                result, err := handler(ctx, q, job)
+                outcomes <- outcome{job: job, result: result, err: err}
+            }(job, handler)
+        }
+        if err := q.saveLocked(); err != nil {
+            slog.Warn("Failed to persist job queue", "error", err)
+        }
+        q.mu.Unlock()
+
+        if running == 0 {
+            if progressed {
+                continue
+            }
+            if wake.IsZero() {
+                break
+            }
+            // Only jobs waiting for a retry backoff are left
+            select {
+            case <-time.After(time.Until(wake)):
+            case <-ctx.Done():
+            }
+            continue
+        }
+
+        o := <-outcomes
+        running--
+
+        q.mu.Lock()
+        o.job.UpdatedAt = time.Now()
+        if o.err != nil {
+            o.job.Error = o.err.Error()
+            if ctx.Err() != nil {
+                // Interrupted, not failed; the next run tries again
+                o.job.State = StatePending
+                o.job.Attempts--
+            } else if o.job.Attempts < o.job.MaxAttempts {
+                o.job.State = StatePending
+                o.job.NotBefore = time.Now().Add(time.Duration(o.job.Attempts) * retryDelay)
+                slog.Warn("Job failed, retrying", "job", o.job.ID, "kind", o.job.Kind, "site", o.job.Site, "error", o.err)
+            } else {
+                o.job.State = StateFailed
+            }
+        } else {
+            o.job.State = StateDone
+            o.job.Error = ""
+            o.job.Result = o.result
+        }
+        q.mu.Unlock()
+    }
+
+    if err := q.save(); err != nil {
+        return err
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if q.stopped || ctx.Err() != nil {
+        for _, job := range q.Jobs {
+            if job.State == StatePending {
+                return ErrStopped
+            }
+        }
+    }
+    return nil
+}
+
+// readyLocked returns pending jobs whose dependencies are done, or finished
+// for jobs that always run, and marks other jobs with failed dependencies as
+// skipped. It also returns the earliest time a
+// job waiting for its retry backoff becomes ready. The caller must hold q.mu.
+func (q *Queue) readyLocked(now time.Time) ([]*Job, time.Time) {
+    var ready []*Job
+    var wake time.Time
+
+    // Skipping can cascade along dependency chains, so repeat until stable
+    for changed := true; changed; {
+        changed = false
+        ready = ready[:0]
+        wake = time.Time{}
+
+        for _, job := range q.Jobs {
+            if job.State != StatePending {
+                continue
+            }
+
+            blocked := false
+            skipped := false
+            for _, id := range job.DependsOn {
+                dep := q.jobLocked(id)
+                if dep == nil || dep.State == StateFailed || dep.State == StateSkipped {
+                    if job.Always {
+                        continue
+                    }
+                    skipped = true
+                    break
+                }
+                if dep.State != StateDone {
+                    blocked = true
+                }
+            }
+
+            switch {
+            case skipped:
+                job.State = StateSkipped
+                job.Error = "dependency did not complete"
+                job.UpdatedAt = now
+                changed = true
+            case blocked:
+            case job.NotBefore.After(now):
+                if wake.IsZero() || job.NotBefore.Before(wake) {
+                    wake = job.NotBefore
+                }
+            default:
+                ready = append(ready, job)
+            }
+        }
+    }
+
+    return ready, wake
+}
+
+// activeSitesLocked returns the sites of which a job has started and jobs
+// are still unfinished. The caller must hold q.mu.
+func (q *Queue) activeSitesLocked() map[string]bool {
+    started := make(map[string]bool)
+    unfinished := make(map[string]bool)
+    for _, job := range q.Jobs {
+        if job.Site == "" {
+            continue
+        }
+        if job.Attempts > 0 {
+            started[job.Site] = true
+        }
+        if job.State == StatePending || job.State == StateRunning {
+            unfinished[job.Site] = true
+        }
+    }
+    active := make(map[string]bool)
+    for site := range started {
+        if unfinished[site] {
+            active[site] = true
+        }
+    }
+    return active
+}
+
+// Finish archives the queue of a completed run so the next Open starts a new run.
+// Archived runs are kept for inspection and retries.
+func (q *Queue) Finish() error {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    if err := q.saveLocked(); err != nil {
+        return err
+    }
+    if q.file != currentFile {
+        return nil
+    }
+    archived := runFileName(q.RunID)
+    if err := os.Rename(filepath.Join(q.dir, currentFile), filepath.Join(q.dir, archived)); err != nil {
+        return err
+    }
+    q.file = archived
+    return nil
+}
+
+// runFileName returns the file name of an archived run
+func runFileName(runID string) string {
+    return fmt.Sprintf("run_%s.json", runID)
+}
+
+// OpenRun loads the run containing the job with the given ID, which may be
+// the run in progress or an archived one
+func OpenRun(dir, jobID string) (*Queue, error) {
+    candidates := []string{currentFile}
+    if i := strings.LastIndex(jobID, "-"); i > 0 {
+        candidates = append(candidates, runFileName(jobID[:i]))
+    }
+
+    for _, name := range candidates {
+        q, err := load(filepath.Join(dir, name))
+        if err != nil {
+            if os.IsNotExist(err) {
+                continue
+            }
+            return nil, err
+        }
+        q.dir = dir
+        q.file = name
+        if q.Job(jobID) != nil {
+            return q, nil
+        }
+    }
+    return nil, fmt.Errorf("job %s not found", jobID)
+}
+
+// Retry makes a failed job pending again with a fresh attempt budget, together
+// with all jobs that were skipped because of it. It returns false if the job
+// already completed, in which case nothing needs to be done.
+func (q *Queue) Retry(id string) (bool, error) {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+
+    job := q.jobLocked(id)
+    if job == nil {
+        return false, fmt.Errorf("job %s not found", id)
+    }
+
+    switch job.State {
+    case StateDone:
+        return false, nil
+    case StateSkipped:
+        for _, depID := range job.DependsOn {
+            if dep := q.jobLocked(depID); dep != nil && (dep.State == StateFailed || dep.State == StateSkipped) {
+                return false, fmt.Errorf("job %s was skipped because job %s did not complete, retry that job instead", id, depID)
+            }
+        }
+    case StatePending, StateRunning:
+        return false, fmt.Errorf("job %s is %s", id, job.State)
+    }
+
+    resetJob(job)
+
+    // Dependents skipped because of this job get another chance as well
+    for changed := true; changed; {
+        changed = false
+        for _, other := range q.Jobs {
+            if other.State != StateSkipped {
+                continue
+            }
+            for _, depID := range other.DependsOn {
+                if dep := q.jobLocked(depID); dep != nil && dep.State == StatePending {
+                    resetJob(other)
+                    changed = true
+                    break
+                }
+            }
+        }
+    }
+
+    return true, q.saveLocked()
+}
+
+// ResumeLast makes the last finished run in dir the run in progress again,
+// with its failed jobs and the jobs skipped because of them pending, so the
+// next Run continues where it failed without repeating completed jobs. It
+// returns nil if a run is in progress or the last run had no failures.
+func ResumeLast(dir string) (*Queue, error) {
+    if _, err := os.Stat(filepath.Join(dir, currentFile)); err == nil {
+        return nil, nil
+    }
+    runs, err := filepath.Glob(filepath.Join(dir, runFileName("*")))
+    if err != nil || len(runs) == 0 {
+        return nil, err
+    }
+    // Run IDs are timestamps, so the last name is the newest run
+    sort.Strings(runs)
+    q, err := load(runs[len(runs)-1])
+    if err != nil {
+        return nil, err
+    }
+    q.dir = dir
+    q.file = currentFile
+
+    resumed := false
+    for _, job := range q.Jobs {
+        if job.State == StateFailed {
+            resetJob(job)
+            resumed = true
+        }
+    }
+    if !resumed {
+        return nil, nil
+    }
+    // Skipped jobs run again once their dependencies are done
+    for _, job := range q.Jobs {
+        if job.State == StateSkipped {
+            resetJob(job)
+        }
+    }
+    if err := q.saveLocked(); err != nil {
+        return nil, err
+    }
+    if err := os.Remove(runs[len(runs)-1]); err != nil {
+        return nil, fmt.Errorf("failed to remove resumed run file: %v", err)
+    }
+    return q, nil
+}
+
+// resetJob makes a job pending with a fresh attempt budget
+func resetJob(job *Job) {
+    job.State = StatePending
+    job.Attempts = 0
+    job.NotBefore = time.Time{}
+    job.Error = ""
+    job.UpdatedAt = time.Now()
+}
+
+// save persists the queue
+func (q *Queue) save() error {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    return q.saveLocked()
+}
+
+// saveLocked writes the queue atomically; the caller must hold q.mu
+func (q *Queue) saveLocked() error {
+    data, err := json.MarshalIndent(q, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode queue: %v", err)
+    }
+    path := filepath.Join(q.dir, q.file)
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return fmt.Errorf("failed to write queue: %v", err)
+    }
+    return os.Rename(tmp, path)
+}
+
+// HasJob reports whether a job of the given kind was already enqueued for site
+func (q *Queue) HasJob(kind, site string) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    for _, job := range q.Jobs {
+        if job.Kind == kind && job.Site == site {
+            return true
+        }
+    }
+    return false
+}
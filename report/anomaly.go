@@ -0,0 +1,148 @@
+package report
+
+import (
+    "bytes"
+    "fmt"
+    "mime"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+)
+
+// Kinds of size anomalies
+const (
+    AnomalyShrank = "shrank"
+    AnomalyGrew   = "grew"
+)
+
+// SizeAnomaly is a new archive whose size differs sharply from the usual
+// size of the site's archives of its type: the median of the previous ones
+type SizeAnomaly struct {
+    Source  string    `json:"source"`
+    Site    string    `json:"site"`
+    Type    string    `json:"type"`
+    Archive string    `json:"archive"`
+    Time    time.Time `json:"time"`
+    Kind    string    `json:"kind"`
+    Size    int64     `json:"size"`
+    Usual   int64     `json:"usual"`
+    // Number of previous archives the usual size is the median of
+    Compared int `json:"compared"`
+}
+
+// Ratio returns the size of the archive relative to the usual size
+func (a SizeAnomaly) Ratio() float64 {
+    if a.Usual == 0 {
+        return 0
+    }
+    return float64(a.Size) / float64(a.Usual)
+}
+
+// String describes the anomaly with the comparison
+func (a SizeAnomaly) String() string {
+    change := fmt.Sprintf("shrank by %.0f%%", (1-a.Ratio())*100)
+    if a.Kind == AnomalyGrew {
+        change = fmt.Sprintf("grew %.1fx", a.Ratio())
+    }
+    return fmt.Sprintf("%s (%s) %s archive %s: %s, %s against the usual %s of the last %d",
+        a.Site, a.Source, a.Type, a.Time.Format("2006-01-02 15:04:05"), backup.ByteSize(a.Size), change, backup.ByteSize(a.Usual), a.Compared)
+}
+
+// DetectSizeAnomalies compares the archives of a source added since since
+// with the size history of their site and type. Incremental archives are
+// only compared with incremental ones and full archives with full ones.
+func DetectSizeAnomalies(source Source, since time.Time, settings config.SizeAnomalyConfig) ([]SizeAnomaly, error) {
+    if !settings.Enabled {
+        return nil, nil
+    }
+    var minSize backup.ByteSize
+    if settings.MinSize != "" {
+        var err error
+        if minSize, err = backup.ParseByteSize(settings.MinSize); err != nil {
+            return nil, err
+        }
+    }
+    cat, err := catalog.Open(source.BaseDir)
+    if err != nil {
+        return nil, err
+    }
+
+    // Archive times are whole seconds. The history is sorted oldest first,
+    // so the samples seen before one are older than it.
+    since = since.Truncate(time.Second)
+    var anomalies []SizeAnomaly
+    previous := make(map[string][]int64)
+    for _, sample := range cat.Sizes() {
+        key := fmt.Sprintf("%s/%s/%t", sample.Site, sample.Type, backup.IsIncremental(sample.Path))
+        history := previous[key]
+        previous[key] = append(history, sample.Size)
+        if sample.Time.Before(since) || len(history) == 0 {
+            continue
+        }
+        if len(history) > settings.History {
+            history = history[len(history)-settings.History:]
+        }
+        usual := median(history)
+        if backup.ByteSize(usual) < minSize && backup.ByteSize(sample.Size) < minSize {
+            continue
+        }
+        kind := ""
+        switch {
+        case sample.Size*100 <= usual*int64(100-settings.ShrinkPercent):
+            kind = AnomalyShrank
+        case sample.Size >= usual*int64(settings.GrowthFactor):
+            kind = AnomalyGrew
+        }
+        if kind == "" {
+            continue
+        }
+        anomalies = append(anomalies, SizeAnomaly{Source: source.Name, Site: sample.Site, Type: sample.Type, Archive: sample.Path,
+            Time: sample.Time, Kind: kind, Size: sample.Size, Usual: usual, Compared: len(history)})
+    }
+    return anomalies, nil
+}
+
+// median returns the middle of a list of sizes, the mean of the two middle
+// ones for an even number
+func median(sizes []int64) int64 {
+    sorted := append([]int64(nil), sizes...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    n := len(sorted)
+    if n%2 == 1 {
+        return sorted[n/2]
+    }
+    return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// SendSizeAnomalies emails a warning listing size anomalies as plain text
+// through the configured SMTP server
+func SendSizeAnomalies(smtpConfig config.SMTPConfig, host string, anomalies []SizeAnomaly, now time.Time) error {
+    var body strings.Builder
+    body.WriteString("These new archives differ sharply in size from the previous ones. An archive that shrank\n")
+    body.WriteString("may be a broken dump; one that grew may hold logs or caches that should be excluded.\n\n")
+    for _, a := range anomalies {
+        fmt.Fprintf(&body, "- %s\n  %s\n", a.String(), a.Archive)
+    }
+
+    subject := fmt.Sprintf("Backup size anomalies on %s: %d archives", host, len(anomalies))
+    if len(anomalies) == 1 {
+        subject = fmt.Sprintf("Backup size anomaly on %s: %s %s", host, anomalies[0].Site, anomalies[0].Kind)
+    }
+    var msg bytes.Buffer
+    fmt.Fprintf(&msg, "From: %s\r\n", smtpConfig.From)
+    fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(smtpConfig.To, ", "))
+    fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+    fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+    msg.WriteString("MIME-Version: 1.0\r\n")
+    msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+    msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+    if err := sendMail(smtpConfig, msg.Bytes()); err != nil {
+        return fmt.Errorf("failed to send size anomalies to %s: %v", strings.Join(smtpConfig.To, ", "), err)
+    }
+    return nil
+}
@@ -0,0 +1,269 @@
+package report
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/encryption"
+)
+
+// Source describes a backup base directory included in a report
+type Source struct {
+    Name    string // "local" or "remote"
+    BaseDir string
+    // Keys for decoding encrypted archives, nil if none are configured
+    Keys    *encryption.Keyring
+    // Looks up the off-server copies of archives, nil without off-server storage
+    Offsite OffsiteChecker
+}
+
+// VerificationResult holds the outcome of decoding a single archive
+type VerificationResult struct {
+    Type    string    `json:"type"`
+    Archive string    `json:"archive"`
+    Time    time.Time `json:"time"`
+    OK      bool      `json:"ok"`
+    Error   string    `json:"error,omitempty"`
+}
+
+// SiteAttestation summarizes the backup evidence for one site over the period
+type SiteAttestation struct {
+    Site            string               `json:"site"`
+    Source          string               `json:"source"`
+    FileBackups     int                  `json:"file_backups"`
+    DatabaseBackups int                  `json:"database_backups"`
+    LastBackup      *time.Time           `json:"last_backup,omitempty"`
+    FilesRPO        string               `json:"files_rpo_achieved"`
+    DatabaseRPO     string               `json:"database_rpo_achieved"`
+    Verification    []VerificationResult `json:"verification"`
+    RestoreTests    string               `json:"restore_tests"`
+}
+
+// Attestation is the auditor-facing summary of backups taken in one month
+type Attestation struct {
+    Period      string            `json:"period"`
+    PeriodStart time.Time         `json:"period_start"`
+    PeriodEnd   time.Time         `json:"period_end"`
+    GeneratedAt time.Time         `json:"generated_at"`
+    Host        string            `json:"host"`
+    Sites       []SiteAttestation `json:"sites"`
+}
+
+// BuildAttestation collects backup evidence for the month starting at periodStart.
+// The latest file and database archive of every site is fully decoded to
+// verify it is readable.
+func BuildAttestation(sources []Source, periodStart time.Time) (*Attestation, error) {
+    periodEnd := periodStart.AddDate(0, 1, 0)
+    host, _ := os.Hostname()
+
+    att := &Attestation{
+        Period:      periodStart.Format("2006-01"),
+        PeriodStart: periodStart,
+        PeriodEnd:   periodEnd,
+        GeneratedAt: time.Now(),
+        Host:        host,
+    }
+
+    for _, source := range sources {
+        archives, err := backup.ListArchives(source.BaseDir)
+        if err != nil {
+            return nil, fmt.Errorf("failed to list archives in %s: %v", source.BaseDir, err)
+        }
+        tests, err := LoadRestoreTests(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+
+        // Group archives by site, keeping them sorted oldest first
+        bySite := make(map[string][]backup.Archive)
+        for _, a := range archives {
+            if !a.Time.Before(periodEnd) {
+                continue
+            }
+            bySite[a.Site] = append(bySite[a.Site], a)
+        }
+
+        var siteNames []string
+        for site := range bySite {
+            siteNames = append(siteNames, site)
+        }
+        sort.Strings(siteNames)
+
+        for _, site := range siteNames {
+            entry := attestSite(source.Name, site, bySite[site], periodStart, periodEnd, source.Keys)
+            entry.RestoreTests = summarizeRestoreTests(tests, site, periodStart, periodEnd)
+            att.Sites = append(att.Sites, entry)
+        }
+    }
+
+    return att, nil
+}
+
+// attestSite builds the attestation entry for one site
+func attestSite(source, site string, archives []backup.Archive, periodStart, periodEnd time.Time, keys *encryption.Keyring) SiteAttestation {
+    entry := SiteAttestation{
+        Site:   site,
+        Source: source,
+    }
+
+    var fileTimes, dbTimes []time.Time
+    var latestFile, latestDB *backup.Archive
+    for i := range archives {
+        a := &archives[i]
+        inPeriod := !a.Time.Before(periodStart)
+        if a.Type == "file" {
+            fileTimes = append(fileTimes, a.Time)
+            latestFile = a
+            if inPeriod {
+                entry.FileBackups++
+            }
+        } else {
+            dbTimes = append(dbTimes, a.Time)
+            latestDB = a
+            if inPeriod {
+                entry.DatabaseBackups++
+            }
+        }
+        if inPeriod {
+            t := a.Time
+            entry.LastBackup = &t
+        }
+    }
+
+    entry.FilesRPO = describeGap(fileTimes, periodStart, periodEnd)
+    entry.DatabaseRPO = describeGap(dbTimes, periodStart, periodEnd)
+
+    for _, a := range []*backup.Archive{latestFile, latestDB} {
+        if a == nil || a.Time.Before(periodStart) {
+            continue
+        }
+        result := VerificationResult{Type: a.Type, Archive: a.Path, Time: a.Time, OK: true}
+        if err := backup.CheckArchive(*a, keys); err != nil {
+            result.OK = false
+            result.Error = err.Error()
+        }
+        entry.Verification = append(entry.Verification, result)
+    }
+
+    return entry
+}
+
+// summarizeRestoreTests describes the restore tests of a site within the period
+func summarizeRestoreTests(tests []RestoreTest, site string, periodStart, periodEnd time.Time) string {
+    var total, passed int
+    var longest time.Duration
+    for _, test := range tests {
+        if test.Site != site || test.Time.Before(periodStart) || !test.Time.Before(periodEnd) {
+            continue
+        }
+        total++
+        if test.OK {
+            passed++
+            if test.Duration > longest {
+                longest = test.Duration
+            }
+        }
+    }
+    if total == 0 {
+        return "not recorded"
+    }
+    return fmt.Sprintf("%d of %d passed, longest restore %s", passed, total, longest.Round(time.Second))
+}
+
+// WorstGap returns the longest time without a backup inside the period.
+// times must be sorted oldest first and may include backups taken before the
+// period, which are used to measure the gap at the start of the period.
+// The end of the period is capped at the current time.
+func WorstGap(times []time.Time, periodStart, periodEnd time.Time) time.Duration {
+    if now := time.Now(); now.Before(periodEnd) {
+        periodEnd = now
+    }
+
+    var worst time.Duration
+    previous := periodStart
+    for _, t := range times {
+        if !t.Before(periodEnd) {
+            break
+        }
+        if t.Before(periodStart) {
+            previous = t
+            continue
+        }
+        if gap := t.Sub(previous); gap > worst {
+            worst = gap
+        }
+        previous = t
+    }
+    if gap := periodEnd.Sub(previous); gap > worst {
+        worst = gap
+    }
+    return worst
+}
+
+// describeGap formats the worst gap for humans, rounded to minutes
+func describeGap(times []time.Time, periodStart, periodEnd time.Time) string {
+    if len(times) == 0 {
+        return "n/a"
+    }
+    return WorstGap(times, periodStart, periodEnd).Round(time.Minute).String()
+}
+
+// WriteJSON writes the attestation to path as indented JSON
+func (a *Attestation) WriteJSON(path string) error {
+    data, err := json.MarshalIndent(a, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode attestation: %v", err)
+    }
+    if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+        return fmt.Errorf("failed to write attestation: %v", err)
+    }
+    return nil
+}
+
+// WritePDF renders the attestation as a printable PDF document
+func (a *Attestation) WritePDF(path string) error {
+    lines := []string{
+        fmt.Sprintf("Backup Integrity Attestation - %s", a.Period),
+        "",
+        fmt.Sprintf("Host:      %s", a.Host),
+        fmt.Sprintf("Period:    %s - %s", a.PeriodStart.Format(time.RFC3339), a.PeriodEnd.Format(time.RFC3339)),
+        fmt.Sprintf("Generated: %s", a.GeneratedAt.Format(time.RFC3339)),
+        fmt.Sprintf("Sites:     %d", len(a.Sites)),
+        "",
+    }
+
+    for _, site := range a.Sites {
+        last := "none"
+        if site.LastBackup != nil {
+            last = site.LastBackup.Format(time.RFC3339)
+        }
+        lines = append(lines,
+            fmt.Sprintf("Site: %s (%s)", site.Site, site.Source),
+            fmt.Sprintf("  File backups: %d, database backups: %d", site.FileBackups, site.DatabaseBackups),
+            fmt.Sprintf("  Last backup: %s", last),
+            fmt.Sprintf("  RPO achieved: files %s, database %s", site.FilesRPO, site.DatabaseRPO),
+        )
+        for _, v := range site.Verification {
+            status := "OK"
+            if !v.OK {
+                status = "FAILED: " + v.Error
+            }
+            lines = append(lines, fmt.Sprintf("  Verified %s archive %s: %s", v.Type, v.Time.Format(backup.TimestampFormat), status))
+        }
+        lines = append(lines, fmt.Sprintf("  Restore tests: %s", site.RestoreTests), "")
+    }
+
+    file, err := os.Create(path)
+    if err != nil {
+        return fmt.Errorf("failed to create attestation PDF: %v", err)
+    }
+    defer file.Close()
+
+    if err := writeTextPDF(file, lines); err != nil {
+        return fmt.Errorf("failed to write attestation PDF: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,193 @@
+package report
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+)
+
+// SiteCompliance holds the evaluation of one site against its recovery objectives
+type SiteCompliance struct {
+    Site            string                       `json:"site"`
+    Source          string                       `json:"source"`
+    Group           string                       `json:"group,omitempty"`
+    Target          Target                       `json:"target"`
+    FileBackupAge   time.Duration                `json:"file_backup_age_ns"`
+    DBBackupAge     time.Duration                `json:"database_backup_age_ns,omitempty"`
+    HasDBBackups    bool                         `json:"has_database_backups"`
+    LastRestoreTest *RestoreTest                 `json:"last_restore_test,omitempty"`
+    LastRuns        map[string]catalog.RunStatus `json:"last_runs,omitempty"`
+    Partial         []string                     `json:"partial,omitempty"`
+    Violations      []string                     `json:"violations,omitempty"`
+    Warnings        []string                     `json:"warnings,omitempty"`
+}
+
+// Compliant reports whether the site meets all its objectives
+func (c SiteCompliance) Compliant() bool {
+    return len(c.Violations) == 0
+}
+
+// EvaluateCompliance compares backup ages and measured restore test durations
+// of every site against its RPO and RTO targets
+func EvaluateCompliance(sources []Source, policies *Policies, now time.Time) ([]SiteCompliance, error) {
+    var results []SiteCompliance
+
+    for _, source := range sources {
+        archives, err := backup.ListArchives(source.BaseDir)
+        if err != nil {
+            return nil, fmt.Errorf("failed to list archives in %s: %v", source.BaseDir, err)
+        }
+        tests, err := LoadRestoreTests(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+
+        // Archives are sorted oldest first, so the last one seen is the latest
+        latestFile := make(map[string]time.Time)
+        latestDB := make(map[string]time.Time)
+        for _, a := range archives {
+            if a.Type == "file" {
+                latestFile[a.Site] = a.Time
+            } else {
+                latestDB[a.Site] = a.Time
+            }
+        }
+        // Components skipped within the last day because a budget was exhausted
+        usage, err := backup.OpenUsage(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+        partial := make(map[string][]string)
+        for _, day := range []time.Time{now.Add(-24 * time.Hour), now} {
+            for site, u := range usage.Day(day) {
+                partial[site] = append(partial[site], u.Partial...)
+            }
+        }
+
+        // Outcome of each site's file and database backup in its last run
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+        lastRuns := cat.LatestRuns()
+
+        lastTest := make(map[string]RestoreTest)
+        for _, test := range tests {
+            lastTest[test.Site] = test
+        }
+
+        sites := make(map[string]bool)
+        for site := range latestFile {
+            sites[site] = true
+        }
+        for site := range latestDB {
+            sites[site] = true
+        }
+        for site := range lastRuns {
+            sites[site] = true
+        }
+        var siteNames []string
+        for site := range sites {
+            siteNames = append(siteNames, site)
+        }
+        sort.Strings(siteNames)
+
+        for _, site := range siteNames {
+            // Applications of a site share its recovery objectives
+            siteName, _ := backup.SplitAppKey(site)
+            target, group := policies.TargetFor(siteName)
+            result := SiteCompliance{
+                Site:     site,
+                Source:   source.Name,
+                Group:    group,
+                Target:   target,
+                LastRuns: lastRuns[site],
+                Partial:  partial[site],
+            }
+            for _, component := range []string{"file", "database"} {
+                if run, ok := lastRuns[site][component]; ok && run.Failed() {
+                    result.Warnings = append(result.Warnings, fmt.Sprintf(
+                        "last %s backup %s in run %s: %s", component, run.Status, run.RunID, run.Error))
+                }
+            }
+            rpo := time.Duration(target.RPO)
+
+            if t, ok := latestFile[site]; ok {
+                result.FileBackupAge = now.Sub(t)
+                if result.FileBackupAge > rpo {
+                    result.Violations = append(result.Violations, fmt.Sprintf(
+                        "latest file backup is %s old, RPO is %s", roundAge(result.FileBackupAge), rpo))
+                }
+            } else {
+                result.Violations = append(result.Violations, "no file backups found")
+            }
+
+            if t, ok := latestDB[site]; ok {
+                result.HasDBBackups = true
+                result.DBBackupAge = now.Sub(t)
+                if result.DBBackupAge > rpo {
+                    result.Violations = append(result.Violations, fmt.Sprintf(
+                        "latest database backup is %s old, RPO is %s", roundAge(result.DBBackupAge), rpo))
+                }
+            }
+
+            if target.RTO != 0 {
+                rto := time.Duration(target.RTO)
+                if test, ok := lastTest[site]; ok {
+                    result.LastRestoreTest = &test
+                    switch {
+                    case !test.OK:
+                        result.Violations = append(result.Violations, fmt.Sprintf(
+                            "last restore test on %s failed: %s", test.Time.Format(time.RFC3339), test.Error))
+                    case test.Duration > rto:
+                        result.Violations = append(result.Violations, fmt.Sprintf(
+                            "last restore test took %s, RTO is %s", roundAge(test.Duration), rto))
+                    }
+                } else {
+                    result.Warnings = append(result.Warnings, "RTO cannot be evaluated: no restore test recorded")
+                }
+            }
+
+            results = append(results, result)
+        }
+    }
+
+    return results, nil
+}
+
+// FormatCompliance renders compliance results as a human readable summary
+func FormatCompliance(results []SiteCompliance) string {
+    var b strings.Builder
+    violations := 0
+    for _, r := range results {
+        status := "OK"
+        if !r.Compliant() {
+            status = "VIOLATION"
+            violations++
+        }
+        fmt.Fprintf(&b, "%-10s %s (%s)", status, r.Site, r.Source)
+        if r.Group != "" {
+            fmt.Fprintf(&b, " [group %s]", r.Group)
+        }
+        b.WriteString("\n")
+        for _, v := range r.Violations {
+            fmt.Fprintf(&b, "           - %s\n", v)
+        }
+        for _, p := range r.Partial {
+            fmt.Fprintf(&b, "           ! partial backup, over budget: %s\n", p)
+        }
+        for _, w := range r.Warnings {
+            fmt.Fprintf(&b, "           ! %s\n", w)
+        }
+    }
+    fmt.Fprintf(&b, "%d of %d sites violate their recovery objectives\n", violations, len(results))
+    return b.String()
+}
+
+// roundAge rounds a duration to minutes for display
+func roundAge(d time.Duration) time.Duration {
+    return d.Round(time.Minute)
+}
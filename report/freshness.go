@@ -0,0 +1,167 @@
+package report
+
+import (
+    "bytes"
+    "fmt"
+    "mime"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+)
+
+// SiteFreshness holds when each component of a site was last backed up
+// successfully, compared against the site's freshness SLA
+type SiteFreshness struct {
+    Site   string        `json:"site"`
+    Source string        `json:"source"`
+    SLA    time.Duration `json:"sla_ns"`
+    // Time of the last successful backup of every component seen for the
+    // site, zero if it never succeeded
+    LastSuccess map[string]time.Time `json:"last_success"`
+    // Error of the latest run of a stale component, if it failed
+    LastErrors map[string]string `json:"last_errors,omitempty"`
+    // Components whose last success is older than the SLA, sorted
+    Stale []string `json:"stale,omitempty"`
+}
+
+// Fresh reports whether every component was backed up within the SLA
+func (f SiteFreshness) Fresh() bool {
+    return len(f.Stale) == 0
+}
+
+// Oldest returns the time of the least recent success of the site's
+// components, zero if one never succeeded
+func (f SiteFreshness) Oldest() time.Time {
+    var oldest time.Time
+    first := true
+    for _, t := range f.LastSuccess {
+        if first || t.Before(oldest) {
+            oldest, first = t, false
+        }
+    }
+    return oldest
+}
+
+// EvaluateFreshness finds the last successful backup of every component of
+// every site from the catalog of each source: the newest run that ended ok
+// or unchanged, or the newest archive if that is more recent. Partial,
+// failed and skipped runs don't count. sla returns the SLA of a site.
+func EvaluateFreshness(sources []Source, sla func(site string) time.Duration, now time.Time) ([]SiteFreshness, error) {
+    var results []SiteFreshness
+    for _, source := range sources {
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            return nil, err
+        }
+
+        last := make(map[string]map[string]time.Time)
+        record := func(site, component string, t time.Time, success bool) {
+            if last[site] == nil {
+                last[site] = make(map[string]time.Time)
+            }
+            if prev := last[site][component]; success && t.After(prev) {
+                last[site][component] = t
+            } else if _, ok := last[site][component]; !ok {
+                last[site][component] = time.Time{}
+            }
+        }
+        for _, e := range cat.Entries() {
+            // Archived binary logs and physical backups are backups of the
+            // database
+            component := e.Type
+            if component == backup.BinlogArchiveType || component == backup.PhysicalArchiveType {
+                component = "database"
+            }
+            record(e.Site, component, e.Time, true)
+        }
+        for _, r := range cat.Runs("") {
+            record(r.Site, r.Component, r.Time, r.Status == catalog.StatusOK || r.Status == catalog.StatusUnchanged)
+        }
+        latestRuns := cat.LatestRuns()
+
+        var sites []string
+        for site := range last {
+            sites = append(sites, site)
+        }
+        sort.Strings(sites)
+        for _, site := range sites {
+            result := SiteFreshness{Site: site, Source: source.Name, SLA: sla(site), LastSuccess: last[site]}
+            for component, t := range last[site] {
+                if now.Sub(t) <= result.SLA {
+                    continue
+                }
+                result.Stale = append(result.Stale, component)
+                if run, ok := latestRuns[site][component]; ok && run.Failed() && run.Error != "" {
+                    if result.LastErrors == nil {
+                        result.LastErrors = make(map[string]string)
+                    }
+                    result.LastErrors[component] = run.Error
+                }
+            }
+            sort.Strings(result.Stale)
+            results = append(results, result)
+        }
+    }
+    return results, nil
+}
+
+// FormatFreshness renders freshness results as a human readable summary
+func FormatFreshness(results []SiteFreshness, now time.Time) string {
+    var b strings.Builder
+    stale := 0
+    for _, r := range results {
+        status := "OK"
+        if !r.Fresh() {
+            status = "STALE"
+            stale++
+        }
+        fmt.Fprintf(&b, "%-10s %s (%s): last success %s, SLA %s\n", status, r.Site, r.Source, describeSuccess(r.Oldest(), now), r.SLA)
+        for _, component := range r.Stale {
+            fmt.Fprintf(&b, "           - %s: last success %s", component, describeSuccess(r.LastSuccess[component], now))
+            if err := r.LastErrors[component]; err != "" {
+                fmt.Fprintf(&b, ", last error: %s", err)
+            }
+            b.WriteString("\n")
+        }
+    }
+    fmt.Fprintf(&b, "%d of %d sites are stale\n", stale, len(results))
+    return b.String()
+}
+
+// describeSuccess tells how long ago a success was
+func describeSuccess(t time.Time, now time.Time) string {
+    if t.IsZero() {
+        return "never"
+    }
+    return roundAge(now.Sub(t)).String() + " ago"
+}
+
+// SendStaleSites emails the list of stale sites as plain text through the
+// configured SMTP server
+func SendStaleSites(smtpConfig config.SMTPConfig, stale []SiteFreshness, now time.Time) error {
+    var body strings.Builder
+    body.WriteString("These sites have not been backed up successfully within their freshness SLA:\n\n")
+    body.WriteString(FormatFreshness(stale, now))
+
+    subject := fmt.Sprintf("Backups stale: %d sites", len(stale))
+    if len(stale) == 1 {
+        subject = "Backups stale: " + stale[0].Site
+    }
+    var msg bytes.Buffer
+    fmt.Fprintf(&msg, "From: %s\r\n", smtpConfig.From)
+    fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(smtpConfig.To, ", "))
+    fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+    fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+    msg.WriteString("MIME-Version: 1.0\r\n")
+    msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+    msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+    if err := sendMail(smtpConfig, msg.Bytes()); err != nil {
+        return fmt.Errorf("failed to send stale sites to %s: %v", strings.Join(smtpConfig.To, ", "), err)
+    }
+    return nil
+}
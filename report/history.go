@@ -0,0 +1,151 @@
+package report
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/logging"
+)
+
+// RunsDirName is the directory of the local backup directory holding the log
+// and summary of every recent backup run, one directory per run
+const RunsDirName = "_runs"
+
+// RunDir returns the directory of the log and summary of a run, named after
+// its start and ID so the directories sort by time
+func RunDir(baseDir string, started time.Time, runID string) string {
+    return filepath.Join(baseDir, RunsDirName, started.Format(backup.TimestampFormat)+"_"+runID)
+}
+
+// runDirs returns the run directories below baseDir, oldest first
+func runDirs(baseDir string) ([]string, error) {
+    entries, err := os.ReadDir(filepath.Join(baseDir, RunsDirName))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("failed to list runs: %v", err)
+    }
+    var dirs []string
+    for _, entry := range entries {
+        if entry.IsDir() {
+            dirs = append(dirs, filepath.Join(baseDir, RunsDirName, entry.Name()))
+        }
+    }
+    sort.Strings(dirs)
+    return dirs, nil
+}
+
+// FindRunDir returns the directory of the run with an ID, or of the newest
+// run for "latest". A directory name is accepted as well.
+func FindRunDir(baseDir, id string) (string, error) {
+    dirs, err := runDirs(baseDir)
+    if err != nil {
+        return "", err
+    }
+    if id == "latest" {
+        if len(dirs) == 0 {
+            return "", fmt.Errorf("no run logs found in %s", filepath.Join(baseDir, RunsDirName))
+        }
+        return dirs[len(dirs)-1], nil
+    }
+    for _, dir := range dirs {
+        name := filepath.Base(dir)
+        if name == id || strings.HasSuffix(name, "_"+id) {
+            return dir, nil
+        }
+    }
+    return "", fmt.Errorf("no log of run %s found, it may have been rotated", id)
+}
+
+// RotateRuns removes the directories of all but the newest keep runs
+func RotateRuns(baseDir string, keep int) error {
+    dirs, err := runDirs(baseDir)
+    if err != nil {
+        return err
+    }
+    for len(dirs) > keep {
+        if err := os.RemoveAll(dirs[0]); err != nil {
+            return fmt.Errorf("failed to remove run log %s: %v", dirs[0], err)
+        }
+        dirs = dirs[1:]
+    }
+    return nil
+}
+
+// logFields are the fields of a run log record printed before the others
+var logFields = map[string]bool{"time": true, "level": true, "msg": true, "run_id": true}
+
+// PrintRunLog writes the log of a run directory to w, as it is with raw and
+// otherwise as text, leaving out records below level
+func PrintRunLog(w io.Writer, dir string, level slog.Level, raw bool) error {
+    f, err := os.Open(filepath.Join(dir, logging.RunLogName))
+    if err != nil {
+        return fmt.Errorf("failed to open run log: %v", err)
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 16<<20)
+    for scanner.Scan() {
+        var record map[string]interface{}
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            // A record cut short by a crash is printed as it is
+            fmt.Fprintln(w, scanner.Text())
+            continue
+        }
+        var recordLevel slog.Level
+        if s, ok := record["level"].(string); ok {
+            recordLevel.UnmarshalText([]byte(s))
+        }
+        if recordLevel < level {
+            continue
+        }
+        if raw {
+            fmt.Fprintln(w, scanner.Text())
+            continue
+        }
+
+        line := fmt.Sprintf("%v %-5v %v", record["time"], record["level"], record["msg"])
+        if t, err := time.Parse(time.RFC3339Nano, fmt.Sprint(record["time"])); err == nil {
+            line = fmt.Sprintf("%s %-5v %v", t.Local().Format("2006-01-02 15:04:05"), record["level"], record["msg"])
+        }
+        keys := make([]string, 0, len(record))
+        for key := range record {
+            if !logFields[key] {
+                keys = append(keys, key)
+            }
+        }
+        sort.Strings(keys)
+        for _, key := range keys {
+            line += " " + key + "=" + logValue(record[key])
+        }
+        fmt.Fprintln(w, line)
+    }
+    if err := scanner.Err(); err != nil {
+        return fmt.Errorf("failed to read run log: %v", err)
+    }
+    return nil
+}
+
+// logValue formats the value of a log record field like the text log output
+func logValue(v interface{}) string {
+    s, ok := v.(string)
+    if !ok {
+        data, _ := json.Marshal(v)
+        s = string(data)
+    }
+    if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+        return strconv.Quote(s)
+    }
+    return s
+}
@@ -0,0 +1,175 @@
+package report
+
+import (
+    "bytes"
+    "crypto/tls"
+    "fmt"
+    "html/template"
+    "mime"
+    "net"
+    "net/smtp"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/config"
+)
+
+// runReportTemplate renders a run report as an HTML email. Styles are
+// inline because mail clients drop style sheets.
+var runReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+    "size":     func(n int64) string { return backup.ByteSize(n).String() },
+    "delta":    formatDelta,
+    "time":     func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+    "duration": func(d time.Duration) string { return d.Round(time.Second).String() },
+    "color":    statusColor,
+}).Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif; font-size: 14px; color: #222;">
+<h2 style="margin-bottom: 4px;">Backup report for {{.Host}}</h2>
+<p style="margin-top: 0;">Run from {{time .Started}} to {{time .Finished}}:
+<strong style="color: {{color .Status}};">{{.Status}}</strong></p>
+{{if .Failures}}<ul>{{range .Failures}}<li style="color: #b00020;">{{.}}</li>{{end}}</ul>{{end}}
+
+<h3>Sites</h3>
+<table cellpadding="6" cellspacing="0" style="border-collapse: collapse;">
+<tr style="background: #eee; text-align: left;"><th>Source</th><th>Site</th><th>Backup</th><th>Status</th><th>Latest archive</th><th>Change</th><th>Duration</th></tr>
+{{range .Sites}}{{$site := .}}{{range .Components}}
+<tr style="border-top: 1px solid #ddd;">
+<td>{{$site.Source}}</td><td>{{$site.Site}}</td><td>{{.Component}}</td>
+<td style="color: {{color .Status}};">{{.Status}}{{if .Error}}<br><small>{{if .Category}}{{.Category}}: {{end}}{{.Error}}</small>{{end}}</td>
+<td>{{if .Archive}}{{size .Size}}{{else}}none{{end}}</td>
+<td>{{delta .Delta}}</td>
+<td>{{if .Duration}}{{duration .Duration}}{{end}}</td>
+</tr>{{end}}{{end}}
+</table>
+
+{{if .Anomalies}}<h3>Size anomalies</h3>
+<ul>{{range .Anomalies}}<li style="color: #b36b00;">{{.String}}<br><small>{{.Archive}}</small></li>{{end}}</ul>{{end}}
+
+{{if .Sources}}<h3>Storage</h3>
+<table cellpadding="6" cellspacing="0" style="border-collapse: collapse;">
+<tr style="background: #eee; text-align: left;"><th>Source</th><th>Directory</th><th>Size</th><th>Change</th></tr>
+{{range .Sources}}<tr style="border-top: 1px solid #ddd;"><td>{{.Name}}</td><td>{{.BaseDir}}</td><td>{{size .Size}}</td><td>{{delta .Delta}}</td></tr>
+{{end}}<tr style="border-top: 1px solid #999; font-weight: bold;"><td colspan="2">Total</td><td>{{size .TotalSize}}</td><td>{{delta .TotalDelta}}</td></tr>
+</table>{{end}}
+
+<h3>Removed by the next rotation</h3>
+{{$expiring := false}}{{range .Sites}}{{if .Expiring}}{{$expiring = true}}{{end}}{{end}}
+{{if $expiring}}<table cellpadding="6" cellspacing="0" style="border-collapse: collapse;">
+<tr style="background: #eee; text-align: left;"><th>Source</th><th>Site</th><th>Archive</th><th>Made</th><th>Size</th></tr>
+{{range .Sites}}{{$site := .}}{{range .Expiring}}<tr style="border-top: 1px solid #ddd;"><td>{{$site.Source}}</td><td>{{$site.Site}}</td><td>{{.Path}}</td><td>{{time .Time}}</td><td>{{size .Size}}</td></tr>
+{{end}}{{end}}</table>{{else}}<p>No archives.</p>{{end}}
+</body></html>
+`))
+
+// formatDelta formats a size change with its sign, or a dash if unknown
+func formatDelta(d *int64) string {
+    switch {
+    case d == nil:
+        return "-"
+    case *d < 0:
+        return "-" + backup.ByteSize(-*d).String()
+    }
+    return "+" + backup.ByteSize(*d).String()
+}
+
+// statusColor returns the color a status is shown in
+func statusColor(status string) string {
+    switch status {
+    case "success", "ok", "unchanged":
+        return "#1b7f3b"
+    case "not run":
+        return "#777"
+    }
+    return "#b00020"
+}
+
+// RenderRunReport renders a run report as an HTML document
+func RenderRunReport(r *RunReport) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := runReportTemplate.Execute(&buf, r); err != nil {
+        return nil, fmt.Errorf("failed to render run report: %v", err)
+    }
+    return buf.Bytes(), nil
+}
+
+// SendRunReport emails a run report as HTML through the configured SMTP server
+func SendRunReport(smtpConfig config.SMTPConfig, r *RunReport) error {
+    body, err := RenderRunReport(r)
+    if err != nil {
+        return err
+    }
+
+    var msg bytes.Buffer
+    fmt.Fprintf(&msg, "From: %s\r\n", smtpConfig.From)
+    fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(smtpConfig.To, ", "))
+    fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", r.Subject()))
+    fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    msg.WriteString("MIME-Version: 1.0\r\n")
+    msg.WriteString("Content-Type: text/html; charset=utf-8\r\n")
+    msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+    msg.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+
+    if err := sendMail(smtpConfig, msg.Bytes()); err != nil {
+        return fmt.Errorf("failed to send report to %s: %v", strings.Join(smtpConfig.To, ", "), err)
+    }
+    return nil
+}
+
+// sendMail delivers a message over SMTP with the configured security,
+// authenticating if a username is set
+func sendMail(c config.SMTPConfig, msg []byte) error {
+    addr := net.JoinHostPort(c.Host, c.Port)
+    tlsConfig := &tls.Config{ServerName: c.Host}
+
+    var conn net.Conn
+    var err error
+    dialer := &net.Dialer{Timeout: 30 * time.Second}
+    if c.Security == config.SMTPTLS {
+        conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+    } else {
+        conn, err = dialer.Dial("tcp", addr)
+    }
+    if err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Now().Add(5 * time.Minute))
+    client, err := smtp.NewClient(conn, c.Host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer client.Close()
+
+    if c.Security == config.SMTPStartTLS {
+        if ok, _ := client.Extension("STARTTLS"); !ok {
+            return fmt.Errorf("%s doesn't support STARTTLS, set smtp security to tls or none", c.Host)
+        }
+        if err := client.StartTLS(tlsConfig); err != nil {
+            return err
+        }
+    }
+    if c.Username != "" {
+        if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+            return err
+        }
+    }
+    if err := client.Mail(c.From); err != nil {
+        return err
+    }
+    for _, to := range c.To {
+        if err := client.Rcpt(to); err != nil {
+            return err
+        }
+    }
+    w, err := client.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(msg); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return client.Quit()
+}
@@ -0,0 +1,117 @@
+package report
+
+import (
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+)
+
+// metric is a metric family in the Prometheus text exposition format
+type metric struct {
+    name    string
+    help    string
+    kind    string
+    samples []string
+}
+
+// add appends a sample; labels are given as name and value pairs
+func (m *metric) add(value float64, labels ...string) {
+    var pairs []string
+    for i := 0; i+1 < len(labels); i += 2 {
+        pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], escapeLabel(labels[i+1])))
+    }
+    m.samples = append(m.samples, fmt.Sprintf("%s{%s} %s", m.name, strings.Join(pairs, ","),
+        strconv.FormatFloat(value, 'f', -1, 64)))
+}
+
+// labelEscaper escapes label values as required by the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+    return labelEscaper.Replace(value)
+}
+
+// WriteMetrics writes the state of the backups of every source in the
+// Prometheus text exposition format: the latest archive of every site, the
+// archives kept by retention, and the outcome and duration of the latest run
+// of every site's file and database backup together with running totals.
+func WriteMetrics(w io.Writer, sources []Source) error {
+    lastBackup := &metric{name: "laravel_backup_last_backup_timestamp_seconds", kind: "gauge",
+        help: "Time of the latest archive of a site."}
+    lastSize := &metric{name: "laravel_backup_last_archive_size_bytes", kind: "gauge",
+        help: "Size of the latest archive of a site."}
+    archives := &metric{name: "laravel_backup_archives", kind: "gauge",
+        help: "Number of archives of a site kept by retention."}
+    archiveBytes := &metric{name: "laravel_backup_archives_size_bytes", kind: "gauge",
+        help: "Total size of the archives of a site kept by retention."}
+    lastRun := &metric{name: "laravel_backup_last_run_timestamp_seconds", kind: "gauge",
+        help: "Time the latest run of a site's component finished."}
+    lastSuccess := &metric{name: "laravel_backup_last_run_success", kind: "gauge",
+        help: "Whether the latest run of a site's component produced a backup (1) or failed (0)."}
+    lastDuration := &metric{name: "laravel_backup_last_run_duration_seconds", kind: "gauge",
+        help: "Time the latest run of a site's component took."}
+    runs := &metric{name: "laravel_backup_runs_total", kind: "counter",
+        help: "Runs of a site's component by outcome."}
+
+    for _, source := range sources {
+        found, err := backup.ListArchives(source.BaseDir)
+        if err != nil {
+            return fmt.Errorf("failed to list archives in %s: %v", source.BaseDir, err)
+        }
+        // Archives are sorted oldest first, so the last one seen is the latest
+        type siteType struct{ site, archiveType string }
+        latest := make(map[siteType]backup.Archive)
+        count := make(map[siteType]int)
+        total := make(map[siteType]int64)
+        for _, a := range found {
+            key := siteType{a.Site, a.Type}
+            latest[key] = a
+            count[key]++
+            total[key] += a.Size
+        }
+        for key, a := range latest {
+            labels := []string{"source", source.Name, "site", key.site, "type", key.archiveType}
+            lastBackup.add(float64(a.Time.Unix()), labels...)
+            lastSize.add(float64(a.Size), labels...)
+            archives.add(float64(count[key]), labels...)
+            archiveBytes.add(float64(total[key]), labels...)
+        }
+
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            return err
+        }
+        for site, components := range cat.LatestRuns() {
+            for component, status := range components {
+                labels := []string{"source", source.Name, "site", site, "component", component}
+                lastRun.add(float64(status.Time.Unix()), labels...)
+                success := 1.0
+                if status.Failed() {
+                    success = 0
+                }
+                lastSuccess.add(success, labels...)
+                lastDuration.add(status.Duration.Seconds(), labels...)
+            }
+        }
+        for _, t := range cat.Totals() {
+            runs.add(float64(t.Count), "source", source.Name, "site", t.Site, "component", t.Component, "status", t.Status)
+        }
+    }
+
+    for _, m := range []*metric{lastBackup, lastSize, archives, archiveBytes, lastRun, lastSuccess, lastDuration, runs} {
+        sort.Strings(m.samples)
+        if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+            return err
+        }
+        for _, sample := range m.samples {
+            if _, err := fmt.Fprintln(w, sample); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
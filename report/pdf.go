@@ -0,0 +1,94 @@
+package report
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "strings"
+)
+
+const (
+    pdfLinesPerPage = 64
+    pdfFontSize     = 9
+    pdfLineHeight   = 12
+)
+
+// writeTextPDF renders plain text lines into a minimal multi-page PDF
+// using the built-in Courier font, so no external tooling is required
+func writeTextPDF(w io.Writer, lines []string) error {
+    var pages [][]string
+    for len(lines) > pdfLinesPerPage {
+        pages = append(pages, lines[:pdfLinesPerPage])
+        lines = lines[pdfLinesPerPage:]
+    }
+    pages = append(pages, lines)
+
+    var buf bytes.Buffer
+    var offsets []int
+    startObject := func() {
+        offsets = append(offsets, buf.Len())
+        fmt.Fprintf(&buf, "%d 0 obj\n", len(offsets))
+    }
+
+    buf.WriteString("%PDF-1.4\n")
+
+    // Objects 1-3: catalog, page tree and font; pages follow as page/content pairs
+    startObject()
+    buf.WriteString("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+    startObject()
+    var kids []string
+    for i := range pages {
+        kids = append(kids, fmt.Sprintf("%d 0 R", 4+i*2))
+    }
+    fmt.Fprintf(&buf, "<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(pages))
+
+    startObject()
+    buf.WriteString("<< /Type /Font /Subtype /Type1 /BaseFont /Courier >>\nendobj\n")
+
+    for i, pageLines := range pages {
+        startObject()
+        fmt.Fprintf(&buf, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] "+
+            "/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>\nendobj\n", 5+i*2)
+
+        var content bytes.Buffer
+        fmt.Fprintf(&content, "BT\n/F1 %d Tf\n%d TL\n40 800 Td\n", pdfFontSize, pdfLineHeight)
+        for _, line := range pageLines {
+            fmt.Fprintf(&content, "(%s) Tj T*\n", escapePDFText(line))
+        }
+        content.WriteString("ET\n")
+
+        startObject()
+        fmt.Fprintf(&buf, "<< /Length %d >>\nstream\n", content.Len())
+        buf.Write(content.Bytes())
+        buf.WriteString("endstream\nendobj\n")
+    }
+
+    xref := buf.Len()
+    fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+    for _, offset := range offsets {
+        fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+    }
+    fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+    _, err := w.Write(buf.Bytes())
+    return err
+}
+
+// escapePDFText escapes a line for use in a PDF string literal.
+// Characters outside printable ASCII are replaced since Courier has no Unicode mapping.
+func escapePDFText(s string) string {
+    var b strings.Builder
+    for _, r := range s {
+        switch {
+        case r == '(' || r == ')' || r == '\\':
+            b.WriteByte('\\')
+            b.WriteRune(r)
+        case r < 32 || r > 126:
+            b.WriteByte('?')
+        default:
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
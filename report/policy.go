@@ -0,0 +1,105 @@
+package report
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "time"
+)
+
+// DefaultRPO is the recovery point objective applied when no policy says otherwise
+const DefaultRPO = 24 * time.Hour
+
+// Duration is a time.Duration that is read from JSON as a string like "24h"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "36h" or "90m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("duration must be a string like \"24h\": %v", err)
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+// MarshalJSON writes the duration in the same format it is read
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+// Target holds recovery objectives; zero values mean "not set"
+type Target struct {
+    RPO Duration `json:"rpo,omitempty"`
+    RTO Duration `json:"rto,omitempty"`
+}
+
+// GroupPolicy applies a target to a named set of sites
+type GroupPolicy struct {
+    Target
+    Sites []string `json:"sites"`
+}
+
+// Policies holds recovery objectives for all sites, resolved as
+// site override > group > default
+type Policies struct {
+    Default Target                 `json:"default"`
+    Groups  map[string]GroupPolicy `json:"groups"`
+    Sites   map[string]Target      `json:"sites"`
+}
+
+// LoadPolicies reads the policy file. An empty path yields the default
+// policy of DefaultRPO without an RTO target.
+func LoadPolicies(path string) (*Policies, error) {
+    policies := &Policies{}
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("unable to read policy file: %v", err)
+        }
+        if err := json.Unmarshal(data, policies); err != nil {
+            return nil, fmt.Errorf("unable to parse policy file %s: %v", path, err)
+        }
+    }
+    if policies.Default.RPO == 0 {
+        policies.Default.RPO = Duration(DefaultRPO)
+    }
+    return policies, nil
+}
+
+// TargetFor returns the effective recovery objectives of a site
+// together with the name of the group it belongs to, if any
+func (p *Policies) TargetFor(site string) (Target, string) {
+    target := p.Default
+    groupName := ""
+
+    for name, group := range p.Groups {
+        for _, s := range group.Sites {
+            if s != site {
+                continue
+            }
+            groupName = name
+            if group.RPO != 0 {
+                target.RPO = group.RPO
+            }
+            if group.RTO != 0 {
+                target.RTO = group.RTO
+            }
+        }
+    }
+
+    if override, ok := p.Sites[site]; ok {
+        if override.RPO != 0 {
+            target.RPO = override.RPO
+        }
+        if override.RTO != 0 {
+            target.RTO = override.RTO
+        }
+    }
+
+    return target, groupName
+}
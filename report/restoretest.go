@@ -0,0 +1,67 @@
+package report
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+// restoreTestLog is the file in a backup base directory that records restore tests
+const restoreTestLog = "restore_tests.jsonl"
+
+// RestoreTest records the outcome of restoring a backup to prove it works
+type RestoreTest struct {
+    Site     string        `json:"site"`
+    Time     time.Time     `json:"time"`
+    Duration time.Duration `json:"duration_ns"`
+    OK       bool          `json:"ok"`
+    Error    string        `json:"error,omitempty"`
+}
+
+// RecordRestoreTest appends a restore test outcome to the log in baseDir
+func RecordRestoreTest(baseDir string, test RestoreTest) error {
+    file, err := os.OpenFile(filepath.Join(baseDir, restoreTestLog), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open restore test log: %v", err)
+    }
+    defer file.Close()
+
+    data, err := json.Marshal(test)
+    if err != nil {
+        return fmt.Errorf("failed to encode restore test: %v", err)
+    }
+    if _, err := file.Write(append(data, '\n')); err != nil {
+        return fmt.Errorf("failed to write restore test log: %v", err)
+    }
+    return nil
+}
+
+// LoadRestoreTests reads all recorded restore tests in baseDir, oldest first
+func LoadRestoreTests(baseDir string) ([]RestoreTest, error) {
+    file, err := os.Open(filepath.Join(baseDir, restoreTestLog))
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, fmt.Errorf("failed to open restore test log: %v", err)
+    }
+    defer file.Close()
+
+    var tests []RestoreTest
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        var test RestoreTest
+        if err := json.Unmarshal(scanner.Bytes(), &test); err != nil {
+            // Skip lines truncated by an interrupted write
+            continue
+        }
+        tests = append(tests, test)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("failed to read restore test log: %v", err)
+    }
+    return tests, nil
+}
@@ -0,0 +1,363 @@
+package report
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+)
+
+// keptRunReports is how many run reports are kept in the reports directory
+const keptRunReports = 90
+
+// Status of a site component that wasn't backed up in the run
+const StatusNotRun = "not run"
+
+// RunSource is a backup directory covered by a run report. Expiring returns
+// the archives of a site that rotation removes after its next backup.
+type RunSource struct {
+    Source
+    Expiring func(site string) ([]string, error)
+}
+
+// RunReport summarizes a backup run: the outcome of every site, the sizes of
+// their latest archives and how they changed since the previous run, new
+// archives of unusual size, the storage used and the archives the next
+// rotation removes
+type RunReport struct {
+    Host     string         `json:"host"`
+    Started  time.Time      `json:"started"`
+    Finished time.Time      `json:"finished"`
+    Status   string         `json:"status"`
+    Failures []string       `json:"failures,omitempty"`
+    Sources  []SourceUsage  `json:"sources"`
+    Sites    []SiteReport   `json:"sites"`
+    // Total size of all backup directories and its change since the previous run
+    TotalSize  int64  `json:"total_size"`
+    TotalDelta *int64 `json:"total_delta,omitempty"`
+    // Archives of the run whose size differs sharply from the usual
+    Anomalies []SizeAnomaly `json:"anomalies,omitempty"`
+}
+
+// SourceUsage is the space a backup directory takes
+type SourceUsage struct {
+    Name    string `json:"name"`
+    BaseDir string `json:"base_dir"`
+    Size    int64  `json:"size"`
+    Delta   *int64 `json:"delta,omitempty"`
+}
+
+// SiteReport is the outcome of the backup of one site in a run
+type SiteReport struct {
+    Source     string            `json:"source"`
+    Site       string            `json:"site"`
+    Status     string            `json:"status"`
+    Components []ComponentReport `json:"components"`
+    // Total size of the site's archives
+    Size     int64             `json:"size"`
+    Expiring []ExpiringArchive `json:"expiring,omitempty"`
+}
+
+// ComponentReport is the outcome of the file or database backup of a site,
+// with its latest archive. Delta is the change of the archive size since the
+// previous run, nil if that run didn't report the component.
+type ComponentReport struct {
+    Component string        `json:"component"`
+    Status    string        `json:"status"`
+    Error     string        `json:"error,omitempty"`
+    // Step that failed, see the catalog's Category constants
+    Category  string        `json:"category,omitempty"`
+    Duration  time.Duration `json:"duration_ns,omitempty"`
+    Archive   string        `json:"archive,omitempty"`
+    Size      int64         `json:"size"`
+    Delta     *int64        `json:"delta,omitempty"`
+}
+
+// ExpiringArchive is an archive the next rotation of a site removes
+type ExpiringArchive struct {
+    Path string    `json:"path"`
+    Time time.Time `json:"time"`
+    Size int64     `json:"size"`
+}
+
+// Failed reports whether a site or component of the run needs attention
+func (r RunReport) Failed() bool {
+    return r.Status != "success"
+}
+
+// BuildRunReport reports on the run that started at started, from the
+// catalogs and archives of the sources. Sizes are compared with the previous
+// report, which may be nil.
+func BuildRunReport(started time.Time, failures []string, sources []RunSource, previous *RunReport) (*RunReport, error) {
+    host, _ := os.Hostname()
+    r := &RunReport{
+        Host:     host,
+        Started:  started,
+        Finished: time.Now(),
+        Status:   "success",
+        Failures: failures,
+    }
+
+    for _, source := range sources {
+        if _, err := os.Stat(source.BaseDir); err != nil {
+            continue
+        }
+        size, err := backup.DirSize(source.BaseDir, &config.FileFilter{})
+        if err != nil {
+            return nil, fmt.Errorf("failed to measure %s: %v", source.BaseDir, err)
+        }
+        r.Sources = append(r.Sources, SourceUsage{Name: source.Name, BaseDir: source.BaseDir, Size: int64(size)})
+        r.TotalSize += int64(size)
+
+        sites, err := sourceSites(source, started)
+        if err != nil {
+            return nil, err
+        }
+        r.Sites = append(r.Sites, sites...)
+    }
+
+    for _, site := range r.Sites {
+        if site.Status == catalog.StatusFailed || site.Status == catalog.StatusSkipped || site.Status == catalog.StatusPartial {
+            r.Status = "failed"
+        }
+    }
+    if len(r.Failures) > 0 {
+        r.Status = "failed"
+    }
+    if previous != nil {
+        r.compare(previous)
+    }
+    return r, nil
+}
+
+// componentRank orders component statuses from best to worst; a site takes
+// the worst status of its components
+var componentRank = map[string]int{
+    catalog.StatusOK:        0,
+    catalog.StatusUnchanged: 1,
+    StatusNotRun:            2,
+    catalog.StatusPartial:   3,
+    catalog.StatusSkipped:   4,
+    catalog.StatusFailed:    5,
+}
+
+// sourceSites reports on the sites of a source that have archives or runs
+func sourceSites(source RunSource, started time.Time) ([]SiteReport, error) {
+    cat, err := catalog.Open(source.BaseDir)
+    if err != nil {
+        return nil, err
+    }
+    archives, err := backup.ListArchives(source.BaseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list archives in %s: %v", source.BaseDir, err)
+    }
+
+    // Archives are sorted oldest first, so later ones replace earlier ones
+    sizes := make(map[string]int64)
+    latest := make(map[string]map[string]backup.Archive)
+    for _, a := range archives {
+        sizes[a.Site] += a.Size
+        if latest[a.Site] == nil {
+            latest[a.Site] = make(map[string]backup.Archive)
+        }
+        latest[a.Site][a.Type] = a
+    }
+    runs := cat.LatestRuns()
+    names := make(map[string]bool)
+    for site := range latest {
+        names[site] = true
+    }
+    for site := range runs {
+        names[site] = true
+    }
+
+    var sites []SiteReport
+    for name := range names {
+        site := SiteReport{Source: source.Name, Site: name, Status: catalog.StatusOK, Size: sizes[name]}
+        for _, component := range []string{"file", "database"} {
+            c := ComponentReport{Component: component, Status: StatusNotRun}
+            status, ran := runs[name][component]
+            if ran && !status.Time.Before(started) {
+                c.Status, c.Error, c.Category, c.Duration = status.Status, status.Error, status.Category, status.Duration
+            }
+            a, archived := latest[name][component]
+            if archived {
+                c.Archive, c.Size = a.Path, a.Size
+            }
+            // Sites without a database have neither runs nor dumps
+            if !ran && !archived {
+                continue
+            }
+            if componentRank[c.Status] > componentRank[site.Status] {
+                site.Status = c.Status
+            }
+            site.Components = append(site.Components, c)
+        }
+
+        if source.Expiring != nil {
+            expiring, err := source.Expiring(name)
+            if err != nil {
+                return nil, fmt.Errorf("failed to find expiring archives of %s: %v", name, err)
+            }
+            for _, path := range expiring {
+                e := ExpiringArchive{Path: path}
+                _, e.Time, _ = backup.ParseArchivePath(path)
+                if entry, ok := cat.Find(path); ok {
+                    e.Size = entry.Size
+                } else if info, err := os.Stat(path); err == nil {
+                    e.Size = info.Size()
+                }
+                site.Expiring = append(site.Expiring, e)
+            }
+        }
+        sites = append(sites, site)
+    }
+    sort.Slice(sites, func(i, j int) bool {
+        return sites[i].Site < sites[j].Site
+    })
+    return sites, nil
+}
+
+// compare sets the changes of sizes since a previous run
+func (r *RunReport) compare(previous *RunReport) {
+    delta := func(now, before int64) *int64 {
+        d := now - before
+        return &d
+    }
+    r.TotalDelta = delta(r.TotalSize, previous.TotalSize)
+    for i, source := range r.Sources {
+        for _, p := range previous.Sources {
+            if p.Name == source.Name {
+                r.Sources[i].Delta = delta(source.Size, p.Size)
+            }
+        }
+    }
+
+    before := make(map[string]int64)
+    for _, site := range previous.Sites {
+        for _, c := range site.Components {
+            if c.Archive != "" {
+                before[site.Source+"/"+site.Site+"/"+c.Component] = c.Size
+            }
+        }
+    }
+    for i := range r.Sites {
+        site := &r.Sites[i]
+        for j := range site.Components {
+            c := &site.Components[j]
+            if size, ok := before[site.Source+"/"+site.Site+"/"+c.Component]; ok && c.Archive != "" {
+                c.Delta = delta(c.Size, size)
+            }
+        }
+    }
+}
+
+// runReportName returns the file name of the report of a run started at t
+func runReportName(t time.Time) string {
+    return "run_" + t.Format(backup.TimestampFormat) + ".json"
+}
+
+// SaveRunReport writes a run report to dir and removes the oldest reports
+// beyond the kept number. It returns the path of the report.
+func SaveRunReport(dir string, r *RunReport) (string, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", fmt.Errorf("failed to create reports directory: %v", err)
+    }
+    data, err := json.MarshalIndent(r, "", "  ")
+    if err != nil {
+        return "", fmt.Errorf("failed to encode run report: %v", err)
+    }
+    path := filepath.Join(dir, runReportName(r.Started))
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return "", fmt.Errorf("failed to write run report: %v", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return "", fmt.Errorf("failed to write run report: %v", err)
+    }
+
+    reports, err := runReports(dir)
+    if err != nil {
+        return path, err
+    }
+    for len(reports) > keptRunReports {
+        os.Remove(reports[0])
+        reports = reports[1:]
+    }
+    return path, nil
+}
+
+// LatestRunReport loads the newest run report in dir, or returns nil if
+// there is none
+func LatestRunReport(dir string) (*RunReport, error) {
+    reports, err := runReports(dir)
+    if err != nil || len(reports) == 0 {
+        return nil, err
+    }
+    path := reports[len(reports)-1]
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read run report: %v", err)
+    }
+    var r RunReport
+    if err := json.Unmarshal(data, &r); err != nil {
+        return nil, fmt.Errorf("failed to parse run report %s: %v", path, err)
+    }
+    return &r, nil
+}
+
+// runReports returns the paths of the run reports in dir, oldest first
+func runReports(dir string) ([]string, error) {
+    paths, err := filepath.Glob(filepath.Join(dir, "run_*.json"))
+    if err != nil {
+        return nil, fmt.Errorf("failed to list run reports: %v", err)
+    }
+    // The timestamp in the names sorts chronologically
+    sort.Strings(paths)
+    return paths, nil
+}
+
+// ForSite returns the part of the report covering a site of a source and
+// its applications, as sent to the site's owner. The storage of the backup
+// directories and the failures of other steps of the run are left out.
+func (r RunReport) ForSite(source, site string) *RunReport {
+    part := &RunReport{Host: r.Host, Started: r.Started, Finished: r.Finished, Status: "success"}
+    for _, s := range r.Sites {
+        if s.Source != source || (s.Site != site && !strings.HasPrefix(s.Site, site+"/")) {
+            continue
+        }
+        part.Sites = append(part.Sites, s)
+        if s.Status == catalog.StatusFailed || s.Status == catalog.StatusSkipped || s.Status == catalog.StatusPartial {
+            part.Status = "failed"
+        }
+    }
+    for _, a := range r.Anomalies {
+        if a.Source == source && (a.Site == site || strings.HasPrefix(a.Site, site+"/")) {
+            part.Anomalies = append(part.Anomalies, a)
+        }
+    }
+    return part
+}
+
+// Subject returns the subject line of a report email
+func (r RunReport) Subject() string {
+    var failed []string
+    for _, site := range r.Sites {
+        if componentRank[site.Status] > componentRank[StatusNotRun] {
+            failed = append(failed, site.Site)
+        }
+    }
+    switch {
+    case len(failed) > 0:
+        return fmt.Sprintf("Backup report %s: %d of %d sites failed (%s)", r.Host, len(failed), len(r.Sites), strings.Join(failed, ", "))
+    case r.Failed():
+        return fmt.Sprintf("Backup report %s: run failed", r.Host)
+    }
+    return fmt.Sprintf("Backup report %s: %d sites backed up", r.Host, len(r.Sites))
+}
@@ -0,0 +1,36 @@
+package report
+
+import (
+    "crypto/ed25519"
+    "crypto/x509"
+    "encoding/pem"
+    "fmt"
+    "os"
+)
+
+// SignFile writes a detached raw ed25519 signature of the file to path.sig
+func SignFile(path string, key ed25519.PrivateKey) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("failed to read %s: %v", path, err)
+    }
+    signature := ed25519.Sign(key, data)
+    if err := os.WriteFile(path+".sig", signature, 0644); err != nil {
+        return fmt.Errorf("failed to write signature: %v", err)
+    }
+    return nil
+}
+
+// WritePublicKey stores the public half of the signing key in PKIX PEM format
+// so auditors can verify signatures with standard tools
+func WritePublicKey(path string, key ed25519.PrivateKey) error {
+    der, err := x509.MarshalPKIXPublicKey(key.Public())
+    if err != nil {
+        return fmt.Errorf("failed to encode public key: %v", err)
+    }
+    data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        return fmt.Errorf("failed to write public key: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,148 @@
+package report
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "time"
+    "laravel-backup-tool/catalog"
+)
+
+// Exit codes of the command line tool. A backup run exits with the code of
+// its outcome; other commands exit with ExitFailure when they fail.
+const (
+    ExitSuccess = 0
+    ExitPartial = 1
+    ExitFailure = 2
+    ExitConfig  = 3
+)
+
+// Outcomes of a run in its summary
+const (
+    SummarySuccess = "success"
+    SummaryPartial = "partial"
+    SummaryFailed  = "failed"
+)
+
+// SummaryFileName is the name of the summary of the latest run in the
+// reports directory
+const SummaryFileName = "summary.json"
+
+// RunSummary is the machine-readable outcome of a run for wrapper scripts
+// and monitoring: the status and exit code of the run and the outcome of
+// every site backed up in it
+type RunSummary struct {
+    RunID    string        `json:"run_id,omitempty"`
+    Host     string        `json:"host"`
+    Started  time.Time     `json:"started"`
+    Finished time.Time     `json:"finished"`
+    Status   string        `json:"status"`
+    ExitCode int           `json:"exit_code"`
+    Error    string        `json:"error,omitempty"`
+    Failures []string      `json:"failures,omitempty"`
+    Sites    []SiteSummary `json:"sites"`
+    // Number of sites that failed and that were backed up in the run
+    FailedSites int `json:"failed_sites"`
+    TotalSites  int `json:"total_sites"`
+}
+
+// SiteSummary is the outcome of one site in a run: the status of each
+// component backed up, the site taking the worst, and their errors with
+// the steps that failed
+type SiteSummary struct {
+    Source     string            `json:"source"`
+    Site       string            `json:"site"`
+    Status     string            `json:"status"`
+    Components map[string]string `json:"components"`
+    Errors     map[string]string `json:"errors,omitempty"`
+    Categories map[string]string `json:"categories,omitempty"`
+}
+
+// Failed reports whether a site's backup didn't succeed completely
+func (s SiteSummary) Failed() bool {
+    return s.Status != catalog.StatusOK && s.Status != catalog.StatusUnchanged
+}
+
+// Summarize derives the summary of a run from its report, which may be nil
+// if it couldn't be built, and the error that ended the run. Sites none of
+// whose components ran are left out. The run failed if it ended with an
+// error or nothing was backed up successfully, and partially if some sites
+// or other steps failed.
+func Summarize(runID string, r *RunReport, runErr error) RunSummary {
+    s := RunSummary{RunID: runID, Finished: time.Now(), Sites: []SiteSummary{}}
+    succeeded := 0
+    if r != nil {
+        s.Host, s.Started, s.Finished, s.Failures = r.Host, r.Started, r.Finished, r.Failures
+        for _, site := range r.Sites {
+            summary := SiteSummary{Source: site.Source, Site: site.Site, Status: catalog.StatusOK, Components: map[string]string{}}
+            for _, c := range site.Components {
+                if c.Status == StatusNotRun {
+                    continue
+                }
+                summary.Components[c.Component] = c.Status
+                if c.Status == catalog.StatusOK || c.Status == catalog.StatusUnchanged {
+                    succeeded++
+                }
+                if componentRank[c.Status] > componentRank[summary.Status] {
+                    summary.Status = c.Status
+                }
+                if c.Error != "" {
+                    if summary.Errors == nil {
+                        summary.Errors = make(map[string]string)
+                    }
+                    summary.Errors[c.Component] = c.Error
+                }
+                if c.Category != "" {
+                    if summary.Categories == nil {
+                        summary.Categories = make(map[string]string)
+                    }
+                    summary.Categories[c.Component] = c.Category
+                }
+            }
+            if len(summary.Components) == 0 {
+                continue
+            }
+            if summary.Failed() {
+                s.FailedSites++
+            }
+            s.Sites = append(s.Sites, summary)
+        }
+    } else {
+        s.Host, _ = os.Hostname()
+    }
+    s.TotalSites = len(s.Sites)
+
+    switch {
+    case runErr != nil:
+        s.Status, s.ExitCode, s.Error = SummaryFailed, ExitFailure, runErr.Error()
+    case succeeded == 0 && (s.FailedSites > 0 || len(s.Failures) > 0):
+        s.Status, s.ExitCode = SummaryFailed, ExitFailure
+    case s.FailedSites > 0 || len(s.Failures) > 0:
+        s.Status, s.ExitCode = SummaryPartial, ExitPartial
+    default:
+        s.Status, s.ExitCode = SummarySuccess, ExitSuccess
+    }
+    return s
+}
+
+// SaveRunSummary writes the summary of a run as summary.json in dir,
+// replacing that of the previous run, and returns its path
+func SaveRunSummary(dir string, s RunSummary) (string, error) {
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", fmt.Errorf("failed to create reports directory: %v", err)
+    }
+    data, err := json.MarshalIndent(s, "", "  ")
+    if err != nil {
+        return "", fmt.Errorf("failed to encode run summary: %v", err)
+    }
+    path := filepath.Join(dir, SummaryFileName)
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return "", fmt.Errorf("failed to write run summary: %v", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        return "", fmt.Errorf("failed to write run summary: %v", err)
+    }
+    return path, nil
+}
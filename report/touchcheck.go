@@ -0,0 +1,128 @@
+package report
+
+import (
+    "fmt"
+    "path/filepath"
+    "sort"
+    "strings"
+    "laravel-backup-tool/backup"
+)
+
+// Touch check statuses
+const (
+    TouchOK        = "ok"
+    TouchRecorded  = "recorded"
+    TouchCorrupted = "corrupted"
+    TouchMissing   = "missing"
+)
+
+// OffsiteChecker looks up the off-server copy of an archive, returning one of
+// backup.OffsitePresent, OffsiteMissing and OffsiteNotConfigured
+type OffsiteChecker interface {
+    CheckOffsite(path string) (string, error)
+}
+
+// TouchCheckResult is the outcome of checking one archive between backup runs
+type TouchCheckResult struct {
+    Site    string `json:"site"`
+    Source  string `json:"source"`
+    Type    string `json:"type"`
+    Archive string `json:"archive"`
+    Status  string `json:"status"`
+    Offsite string `json:"offsite"`
+    Error   string `json:"error,omitempty"`
+}
+
+// Failed reports whether the result needs attention
+func (r TouchCheckResult) Failed() bool {
+    return r.Status == TouchCorrupted || r.Status == TouchMissing || r.Offsite == backup.OffsiteMissing
+}
+
+// TouchCheck verifies the checksum of the latest file and database archive of
+// every site and that its off-server copy is still stored, and reports
+// archives deleted outside of rotation. It never creates backups; archives
+// without a recorded checksum get one recorded.
+func TouchCheck(sources []Source) ([]TouchCheckResult, error) {
+    var results []TouchCheckResult
+
+    for _, source := range sources {
+        archives, err := backup.ListArchives(source.BaseDir)
+        if err != nil {
+            return nil, fmt.Errorf("failed to list archives in %s: %v", source.BaseDir, err)
+        }
+
+        // Archives are sorted oldest first, so later entries replace earlier ones
+        latest := make(map[string]backup.Archive)
+        for _, a := range archives {
+            latest[a.Site+"/"+a.Type] = a
+        }
+        var keys []string
+        for key := range latest {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+
+        for _, key := range keys {
+            a := latest[key]
+            result := TouchCheckResult{
+                Site:    a.Site,
+                Source:  source.Name,
+                Type:    a.Type,
+                Archive: a.Path,
+                Status:  TouchOK,
+            }
+            recorded, err := backup.VerifyChecksum(a.Path)
+            switch {
+            case err != nil:
+                result.Status = TouchCorrupted
+                result.Error = err.Error()
+            case !recorded:
+                if _, err := backup.WriteChecksum(a.Path); err != nil {
+                    return nil, err
+                }
+                result.Status = TouchRecorded
+            }
+            checkOffsite(source, &result)
+            results = append(results, result)
+        }
+
+        missing, err := backup.FindMissingArchives(source.BaseDir)
+        if err != nil {
+            return nil, fmt.Errorf("failed to look for missing archives: %v", err)
+        }
+        for _, path := range missing {
+            archiveType, _, _ := backup.ParseArchivePath(path)
+            rel, _ := filepath.Rel(source.BaseDir, path)
+            result := TouchCheckResult{
+                Site:    strings.Split(rel, string(filepath.Separator))[0],
+                Source:  source.Name,
+                Type:    archiveType,
+                Archive: path,
+                Status:  TouchMissing,
+                Error:   "archive was deleted outside of backup rotation",
+            }
+            checkOffsite(source, &result)
+            results = append(results, result)
+        }
+    }
+
+    return results, nil
+}
+
+// checkOffsite looks up the off-server copy of the result's archive. A copy
+// that can't be looked up is reported like a missing one.
+func checkOffsite(source Source, result *TouchCheckResult) {
+    result.Offsite = backup.OffsiteNotConfigured
+    if source.Offsite == nil {
+        return
+    }
+    status, err := source.Offsite.CheckOffsite(result.Archive)
+    if err != nil {
+        status = backup.OffsiteMissing
+        if result.Error != "" {
+            result.Error += "; "
+        }
+        result.Error += fmt.Sprintf("off-server copy could not be looked up: %v", err)
+    }
+    result.Offsite = status
+}
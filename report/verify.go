@@ -0,0 +1,131 @@
+package report
+
+import (
+    "fmt"
+    "path/filepath"
+    "strings"
+    "laravel-backup-tool/backup"
+)
+
+// Verification statuses
+const (
+    VerifyOK        = "ok"
+    VerifyCorrupted = "corrupted"
+)
+
+// VerifyResult is the outcome of fully verifying one archive
+type VerifyResult struct {
+    Site     string `json:"site"`
+    Source   string `json:"source"`
+    Type     string `json:"type"`
+    Archive  string `json:"archive"`
+    Status   string `json:"status"`
+    // Whether a checksum was recorded for the archive and compared
+    Checksum bool   `json:"checksum"`
+    // Whether the checksum is signed
+    Signed   bool   `json:"signed"`
+    Error    string `json:"error,omitempty"`
+}
+
+// Failed reports whether the archive is corrupted
+func (r VerifyResult) Failed() bool {
+    return r.Status == VerifyCorrupted
+}
+
+// Verify checks every archive, or only the latest per site and type, against
+// its recorded and signed checksum and fully decodes it. Tar archives are
+// read entry by entry and database dumps must end with the dump tool's
+// completion marker. The signed checksum manifests of the sites' archive
+// directories are checked too, with the type "manifest". An empty site checks
+// all sites, a site includes its applications.
+func Verify(sources []Source, site string, latestOnly bool) ([]VerifyResult, error) {
+    var results []VerifyResult
+
+    for _, source := range sources {
+        archives, err := backup.ListArchives(source.BaseDir)
+        if err != nil {
+            return nil, fmt.Errorf("failed to list archives in %s: %v", source.BaseDir, err)
+        }
+
+        if latestOnly {
+            // Archives are sorted oldest first, so later entries replace earlier ones
+            latest := make(map[string]int)
+            for i, a := range archives {
+                latest[a.Site+"/"+a.Type] = i
+            }
+            var kept []backup.Archive
+            for i, a := range archives {
+                if latest[a.Site+"/"+a.Type] == i {
+                    kept = append(kept, a)
+                }
+            }
+            archives = kept
+        }
+
+        for _, a := range archives {
+            if site != "" && a.Site != site && !strings.HasPrefix(a.Site, site+"/") {
+                continue
+            }
+            result := VerifyResult{
+                Site:    a.Site,
+                Source:  source.Name,
+                Type:    a.Type,
+                Archive: a.Path,
+                Status:  VerifyOK,
+            }
+            recorded, err := backup.VerifyChecksum(a.Path)
+            result.Checksum = recorded
+            result.Signed = backup.IsSigned(a.Path)
+            if err == nil {
+                err = backup.CheckArchive(a, source.Keys)
+            }
+            if err != nil {
+                result.Status = VerifyCorrupted
+                result.Error = err.Error()
+            }
+            results = append(results, result)
+        }
+        manifests, err := verifyManifests(source, site)
+        if err != nil {
+            return nil, err
+        }
+        results = append(results, manifests...)
+    }
+
+    return results, nil
+}
+
+// verifyManifests checks the checksum manifests of a source's archive
+// directories. Unsigned manifests are left out.
+func verifyManifests(source Source, site string) ([]VerifyResult, error) {
+    manifests, err := backup.ListChecksumManifests(source.BaseDir)
+    if err != nil {
+        return nil, fmt.Errorf("failed to list checksum manifests in %s: %v", source.BaseDir, err)
+    }
+
+    var results []VerifyResult
+    for _, m := range manifests {
+        if site != "" && m.Site != site && !strings.HasPrefix(m.Site, site+"/") {
+            continue
+        }
+        signed, err := backup.VerifyChecksumManifest(filepath.Dir(m.Path))
+        if !signed && err == nil {
+            continue
+        }
+        result := VerifyResult{
+            Site:     m.Site,
+            Source:   source.Name,
+            Type:     m.Type,
+            Archive:  m.Path,
+            Status:   VerifyOK,
+            Checksum: true,
+            Signed:   signed,
+        }
+        if err != nil {
+            result.Status = VerifyCorrupted
+            result.Error = err.Error()
+        }
+        results = append(results, result)
+    }
+    return results, nil
+}
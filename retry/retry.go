@@ -0,0 +1,209 @@
+// Package retry repeats operations that failed with transient errors, such
+// as a database server out of connections or a dropped network connection,
+// with an exponential backoff.
+package retry
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "strings"
+    "syscall"
+    "time"
+)
+
+// Defaults of a policy
+const (
+    DefaultAttempts   = 3
+    DefaultBackoff    = 5 * time.Second
+    DefaultMaxBackoff = 2 * time.Minute
+)
+
+// transientMessages are parts of error messages of database clients and
+// network operations that describe conditions which usually pass
+var transientMessages = []string{
+    // MySQL and MariaDB
+    "too many connections",
+    "can't connect to mysql server",
+    "can't connect to local mysql server",
+    "lost connection to mysql server",
+    "mysql server has gone away",
+    "deadlock found",
+    "lock wait timeout exceeded",
+    // PostgreSQL
+    "too many clients already",
+    "remaining connection slots are reserved",
+    "the database system is starting up",
+    "the database system is shutting down",
+    "could not connect to server",
+    "server closed the connection unexpectedly",
+    // SQLite
+    "database is locked",
+    // Network
+    "connection refused",
+    "connection reset",
+    "connection timed out",
+    "no route to host",
+    "network is unreachable",
+    "i/o timeout",
+    "broken pipe",
+    "temporary failure in name resolution",
+    "tls handshake timeout",
+}
+
+// transientErrnos are system errors of network operations that usually pass
+var transientErrnos = []syscall.Errno{
+    syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.ETIMEDOUT,
+    syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EPIPE,
+}
+
+// Policy decides whether and when a failed operation is attempted again
+type Policy struct {
+    // Attempts is how often an operation is tried, at least once
+    Attempts int
+    // Backoff is the delay before the second attempt; it doubles for every
+    // further attempt up to MaxBackoff
+    Backoff    time.Duration
+    MaxBackoff time.Duration
+    // Messages are further parts of error messages, matched regardless of
+    // case, that mark an error as transient
+    Messages []string
+}
+
+// Default returns the policy used when nothing is configured
+func Default() Policy {
+    return Policy{Attempts: DefaultAttempts, Backoff: DefaultBackoff, MaxBackoff: DefaultMaxBackoff}
+}
+
+// Validate checks that the policy's values are usable
+func (p Policy) Validate() error {
+    if p.Attempts < 1 {
+        return fmt.Errorf("retry attempts must be at least 1")
+    }
+    if p.Backoff < 0 || p.MaxBackoff < 0 {
+        return fmt.Errorf("retry backoff must not be negative")
+    }
+    if p.MaxBackoff < p.Backoff {
+        return fmt.Errorf("retry max_backoff must not be less than backoff")
+    }
+    return nil
+}
+
+// Delay returns how long to wait after the failed attempt n, counted from 1
+func (p Policy) Delay(n int) time.Duration {
+    delay := p.Backoff
+    for i := 1; i < n && delay < p.MaxBackoff; i++ {
+        delay *= 2
+    }
+    if delay > p.MaxBackoff {
+        delay = p.MaxBackoff
+    }
+    return delay
+}
+
+// permanentError marks an error that retrying doesn't fix
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string {
+    return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+    return e.err
+}
+
+// Permanent marks err as not worth retrying, whatever its message
+func Permanent(err error) error {
+    if err == nil {
+        return nil
+    }
+    return permanentError{err}
+}
+
+// transientError marks an error that retrying may fix
+type transientError struct {
+    err error
+}
+
+func (e transientError) Error() string {
+    return e.err.Error()
+}
+
+func (e transientError) Unwrap() error {
+    return e.err
+}
+
+// Transient marks err as worth retrying, whatever its message
+func Transient(err error) error {
+    if err == nil {
+        return nil
+    }
+    return transientError{err}
+}
+
+// Retryable reports whether an operation that failed with err may succeed
+// when attempted again: errors marked Transient, network timeouts and
+// dropped connections, and errors whose message describes such a condition.
+// Cancellation and errors marked Permanent are never retried.
+func (p Policy) Retryable(err error) bool {
+    if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+        return false
+    }
+    var permanent permanentError
+    if errors.As(err, &permanent) {
+        return false
+    }
+    var transient transientError
+    if errors.As(err, &transient) {
+        return true
+    }
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        return true
+    }
+    for _, errno := range transientErrnos {
+        if errors.Is(err, errno) {
+            return true
+        }
+    }
+    if errors.Is(err, io.ErrUnexpectedEOF) {
+        return true
+    }
+
+    message := strings.ToLower(err.Error())
+    for _, part := range append(transientMessages, p.Messages...) {
+        if part != "" && strings.Contains(message, strings.ToLower(part)) {
+            return true
+        }
+    }
+    return false
+}
+
+// Do runs attempt until it succeeds, fails with an error that isn't
+// retryable, the attempts are used up or ctx is cancelled, and returns the
+// last error. Every retry is logged to log with what describing the operation.
+func (p Policy) Do(ctx context.Context, log *slog.Logger, what string, attempt func() error) error {
+    attempts := p.Attempts
+    if attempts < 1 {
+        attempts = 1
+    }
+    var err error
+    for n := 1; ; n++ {
+        if err = attempt(); err == nil || n >= attempts || !p.Retryable(err) || ctx.Err() != nil {
+            return err
+        }
+        delay := p.Delay(n)
+        log.Warn("Transient failure, retrying", "operation", what, "attempt", n, "attempts", attempts,
+            "delay", delay.String(), "error", err)
+        select {
+        case <-time.After(delay):
+        case <-ctx.Done():
+            return err
+        }
+    }
+}
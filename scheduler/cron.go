@@ -0,0 +1,193 @@
+package scheduler
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Schedule is a parsed cron expression with the five standard fields
+// minute, hour, day of month, month and day of week
+type Schedule struct {
+    expr   string
+    minute uint64
+    hour   uint64
+    dom    uint64
+    month  uint64
+    dow    uint64
+    // Whether day of month or day of week is unrestricted; if both are
+    // restricted, a day matching either one matches, like in cron
+    domAny bool
+    dowAny bool
+}
+
+// field describes the valid range of a cron field
+type field struct {
+    name  string
+    min   int
+    max   int
+    names map[string]int
+}
+
+var (
+    minuteField = field{name: "minute", min: 0, max: 59}
+    hourField   = field{name: "hour", min: 0, max: 23}
+    domField    = field{name: "day of month", min: 1, max: 31}
+    monthField  = field{name: "month", min: 1, max: 12, names: map[string]int{
+        "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+        "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+    }}
+    dowField    = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+        "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+    }}
+)
+
+// shorthands are the predefined schedules of cron
+var shorthands = map[string]string{
+    "@yearly":   "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+    "@monthly":  "0 0 1 * *",
+    "@weekly":   "0 0 * * 0",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression such as "30 2 * * *", "*/15 8-18 * * mon-fri"
+// or "@daily"
+func Parse(expr string) (*Schedule, error) {
+    spec := strings.TrimSpace(expr)
+    if full, ok := shorthands[strings.ToLower(spec)]; ok {
+        spec = full
+    }
+    fields := strings.Fields(spec)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", expr, len(fields))
+    }
+
+    s := &Schedule{expr: expr}
+    var err error
+    for i, target := range []struct {
+        bits *uint64
+        f    field
+    }{
+        {&s.minute, minuteField},
+        {&s.hour, hourField},
+        {&s.dom, domField},
+        {&s.month, monthField},
+        {&s.dow, dowField},
+    } {
+        if *target.bits, err = parseField(fields[i], target.f); err != nil {
+            return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+        }
+    }
+    // Sunday may be given as 0 or 7
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domAny = strings.HasPrefix(fields[2], "*")
+    s.dowAny = strings.HasPrefix(fields[4], "*")
+    return s, nil
+}
+
+// parseField parses a comma separated list of values, ranges and steps
+func parseField(spec string, f field) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(spec, ",") {
+        rangeSpec, step := part, 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            n, err := strconv.Atoi(part[i+1:])
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step in %s field %q", f.name, part)
+            }
+            rangeSpec, step = part[:i], n
+        }
+
+        lo, hi := f.min, f.max
+        if rangeSpec != "*" {
+            bounds := strings.SplitN(rangeSpec, "-", 2)
+            var err error
+            if lo, err = f.value(bounds[0]); err != nil {
+                return 0, err
+            }
+            hi = lo
+            if len(bounds) == 2 {
+                if hi, err = f.value(bounds[1]); err != nil {
+                    return 0, err
+                }
+            } else if step > 1 {
+                // "5/15" means from 5 to the end in steps of 15
+                hi = f.max
+            }
+            if hi < lo {
+                return 0, fmt.Errorf("invalid range in %s field %q", f.name, part)
+            }
+        }
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+// value parses a single number or name of a field
+func (f field) value(s string) (int, error) {
+    if v, ok := f.names[strings.ToLower(s)]; ok {
+        return v, nil
+    }
+    v, err := strconv.Atoi(s)
+    if err != nil || v < f.min || v > f.max {
+        return 0, fmt.Errorf("invalid %s %q, must be %d-%d", f.name, s, f.min, f.max)
+    }
+    return v, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *Schedule) String() string {
+    return s.expr
+}
+
+// Next returns the first minute after t the schedule matches, in t's location
+func (s *Schedule) Next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    // Every schedule matches at least once within a few years (e.g. Feb 29)
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        if s.month&(1<<uint(t.Month())) == 0 {
+            t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if !s.matchesDay(t) {
+            t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.hour&(1<<uint(t.Hour())) == 0 {
+            t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+            continue
+        }
+        if s.minute&(1<<uint(t.Minute())) == 0 {
+            t = t.Add(time.Minute)
+            continue
+        }
+        return t
+    }
+    return time.Time{}
+}
+
+// matchesDay reports whether the day of t matches the day of month and day
+// of week fields
+func (s *Schedule) matchesDay(t time.Time) bool {
+    dom := s.dom&(1<<uint(t.Day())) != 0
+    dow := s.dow&(1<<uint(t.Weekday())) != 0
+    switch {
+    case s.domAny && s.dowAny:
+        return true
+    case s.domAny:
+        return dow
+    case s.dowAny:
+        return dom
+    default:
+        return dom || dow
+    }
+}
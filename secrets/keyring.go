@@ -0,0 +1,109 @@
+package secrets
+
+import (
+    "fmt"
+    "os/exec"
+    "runtime"
+    "strings"
+)
+
+// keyringService namespaces the entries of this tool in the OS keyring
+const keyringService = "laravel-backup-tool"
+
+// KeyringAvailable reports whether a supported keyring tool is installed:
+// keyctl (Linux kernel keyring) or security (macOS keychain)
+func KeyringAvailable() bool {
+    _, err := exec.LookPath(keyringTool())
+    return err == nil
+}
+
+// keyringTool returns the keyring command line tool of the platform
+func keyringTool() string {
+    if runtime.GOOS == "darwin" {
+        return "security"
+    }
+    return "keyctl"
+}
+
+// keyctlDescription is the key description used in the kernel keyring
+func keyctlDescription(name string) string {
+    return keyringService + ":" + name
+}
+
+// keyringGet reads a secret from the keyring
+func keyringGet(name string) (string, error) {
+    if !KeyringAvailable() {
+        return "", fmt.Errorf("no keyring available")
+    }
+
+    if runtime.GOOS == "darwin" {
+        output, err := exec.Command("security", "find-generic-password",
+            "-s", keyringService, "-a", name, "-w").Output()
+        if err != nil {
+            return "", fmt.Errorf("secret %s not found in keychain", name)
+        }
+        return strings.TrimRight(string(output), "\n"), nil
+    }
+
+    id, err := keyctlSearch(name)
+    if err != nil {
+        return "", err
+    }
+    output, err := exec.Command("keyctl", "pipe", id).Output()
+    if err != nil {
+        return "", fmt.Errorf("unable to read key %s: %v", id, err)
+    }
+    return string(output), nil
+}
+
+// keyringSet stores a secret in the keyring, replacing any previous value
+func keyringSet(name, value string) error {
+    if runtime.GOOS == "darwin" {
+        // -w must be the last option to be read interactively, so the value
+        // is passed on the command line like the security tool requires
+        output, err := exec.Command("security", "add-generic-password", "-U",
+            "-s", keyringService, "-a", name, "-w", value).CombinedOutput()
+        if err != nil {
+            return fmt.Errorf("security failed: %v - %s", err, strings.TrimSpace(string(output)))
+        }
+        return nil
+    }
+
+    // padd reads the payload from stdin, keeping it out of the process list
+    cmd := exec.Command("keyctl", "padd", "user", keyctlDescription(name), "@u")
+    cmd.Stdin = strings.NewReader(value)
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("keyctl failed: %v - %s", err, strings.TrimSpace(string(output)))
+    }
+    return nil
+}
+
+// keyringDelete removes a secret from the keyring
+func keyringDelete(name string) error {
+    if runtime.GOOS == "darwin" {
+        output, err := exec.Command("security", "delete-generic-password",
+            "-s", keyringService, "-a", name).CombinedOutput()
+        if err != nil {
+            return fmt.Errorf("security failed: %v - %s", err, strings.TrimSpace(string(output)))
+        }
+        return nil
+    }
+
+    id, err := keyctlSearch(name)
+    if err != nil {
+        return err
+    }
+    if output, err := exec.Command("keyctl", "unlink", id, "@u").CombinedOutput(); err != nil {
+        return fmt.Errorf("keyctl failed: %v - %s", err, strings.TrimSpace(string(output)))
+    }
+    return nil
+}
+
+// keyctlSearch returns the id of a secret in the user keyring
+func keyctlSearch(name string) (string, error) {
+    output, err := exec.Command("keyctl", "search", "@u", "user", keyctlDescription(name)).Output()
+    if err != nil {
+        return "", fmt.Errorf("secret %s not found in keyring", name)
+    }
+    return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,96 @@
+package secrets
+
+import (
+    "bufio"
+    "fmt"
+    "log/slog"
+    "os"
+    "strings"
+    "golang.org/x/term"
+)
+
+// Lookup returns a secret configured through the environment variable name.
+// If the variable is empty, the OS keyring is consulted, and as a last resort
+// the user is prompted when running on a terminal. Prompted secrets can be
+// stored in the keyring so later interactive runs don't ask again.
+// It returns an empty string without error if the secret is not available,
+// e.g. when running from cron without a keyring entry.
+func Lookup(name, prompt string) (string, error) {
+    if value := os.Getenv(name); value != "" {
+        return value, nil
+    }
+
+    if value, err := keyringGet(name); err == nil && value != "" {
+        return value, nil
+    }
+
+    if !Interactive() {
+        return "", nil
+    }
+
+    value, err := Prompt(prompt)
+    if err != nil || value == "" {
+        return "", err
+    }
+
+    if KeyringAvailable() && Confirm("Store it in the OS keyring for later runs?") {
+        if err := keyringSet(name, value); err != nil {
+            slog.Warn("Unable to store secret in keyring", "name", name, "error", err)
+        } else {
+            fmt.Printf("Stored %s in the OS keyring\n", name)
+        }
+    }
+    return value, nil
+}
+
+// Get returns a secret from the environment variable name or the OS
+// keyring without prompting, empty if it is in neither
+func Get(name string) string {
+    if value := os.Getenv(name); value != "" {
+        return value
+    }
+    if value, err := keyringGet(name); err == nil {
+        return value
+    }
+    return ""
+}
+
+// Interactive reports whether the user can be prompted
+func Interactive() bool {
+    return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// Prompt asks for a secret on the terminal without echoing it
+func Prompt(prompt string) (string, error) {
+    fmt.Fprintf(os.Stderr, "%s: ", prompt)
+    value, err := term.ReadPassword(int(os.Stdin.Fd()))
+    fmt.Fprintln(os.Stderr)
+    if err != nil {
+        return "", fmt.Errorf("unable to read from terminal: %v", err)
+    }
+    return strings.TrimSpace(string(value)), nil
+}
+
+// Confirm asks a yes/no question on the terminal, defaulting to no
+func Confirm(question string) bool {
+    fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+    answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+    answer = strings.ToLower(strings.TrimSpace(answer))
+    return answer == "y" || answer == "yes"
+}
+
+// Store saves a secret in the OS keyring
+func Store(name, value string) error {
+    if !KeyringAvailable() {
+        return fmt.Errorf("no supported keyring found (keyctl or security)")
+    }
+    return keyringSet(name, value)
+}
+
+// Forget removes a secret from the OS keyring
+func Forget(name string) error {
+    if !KeyringAvailable() {
+        return fmt.Errorf("no supported keyring found (keyctl or security)")
+    }
+    return keyringDelete(name)
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "embed"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/fs"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+    "laravel-backup-tool/backup"
+    "laravel-backup-tool/backuptool"
+    "laravel-backup-tool/catalog"
+    "laravel-backup-tool/config"
+    "laravel-backup-tool/dedup"
+    "laravel-backup-tool/logging"
+    "laravel-backup-tool/report"
+    "laravel-backup-tool/secrets"
+)
+
+// States of runs started through the API
+const (
+    apiRunRunning   = "running"
+    apiRunSucceeded = "succeeded"
+    apiRunFailed    = "failed"
+)
+
+// maxAPIRuns is how many finished runs the API remembers
+const maxAPIRuns = 50
+
+// uiFiles are the static files of the web dashboard, which uses the API
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// apiRun is a backup or restore run started through the API
+type apiRun struct {
+    ID       string      `json:"id"`
+    Kind     string      `json:"kind"`
+    Sites    []string    `json:"sites,omitempty"`
+    Resume   bool        `json:"resume,omitempty"`
+    Restore  *apiRestore `json:"restore,omitempty"`
+    State    string      `json:"state"`
+    Error    string      `json:"error,omitempty"`
+    Started  time.Time   `json:"started"`
+    Finished *time.Time  `json:"finished,omitempty"`
+    log      *logging.Capture
+    perform  func() error
+}
+
+// apiRestore is a restore requested through the API, with the options of
+// the restore command
+type apiRestore struct {
+    Site              string `json:"site"`
+    Timestamp         string `json:"timestamp,omitempty"`
+    Source            string `json:"source,omitempty"`
+    Server            string `json:"server,omitempty"`
+    Target            string `json:"target,omitempty"`
+    Database          bool   `json:"database,omitempty"`
+    DatabaseOnly      bool   `json:"database_only,omitempty"`
+    Force             bool   `json:"force,omitempty"`
+    PreserveOwnership bool   `json:"preserve_ownership,omitempty"`
+}
+
+// args returns the arguments of the restore command
+func (r apiRestore) args() []string {
+    args := []string{r.Site, r.Timestamp, "--source", r.Source}
+    if r.Server != "" {
+        args = append(args, "--server", r.Server)
+    }
+    if r.Target != "" {
+        args = append(args, "--target", r.Target)
+    }
+    if r.Database {
+        args = append(args, "--db")
+    }
+    if r.DatabaseOnly {
+        args = append(args, "--db-only")
+    }
+    if r.Force {
+        args = append(args, "--force")
+    }
+    if r.PreserveOwnership {
+        args = append(args, "--preserve-ownership")
+    }
+    return args
+}
+
+// apiServer serves the REST API. It runs one backup at a time and keeps the
+// recent runs with their log output in memory.
+type apiServer struct {
+    token string
+    mu    sync.Mutex
+    seq   int
+    runs  []*apiRun
+    wg    sync.WaitGroup
+}
+
+// runServe serves the REST API until SIGTERM or SIGINT. On the first signal
+// the server stops accepting requests and a running backup stops after its
+// running jobs, a second signal aborts it and a third exits immediately.
+func runServe(args []string) error {
+    if len(args) > 0 {
+        return fmt.Errorf("usage: serve")
+    }
+    token := cfg.API.Token
+    if token == "" {
+        var err error
+        if token, err = secrets.Lookup("API_TOKEN", "API token: "); err != nil {
+            return err
+        }
+    }
+    if token == "" {
+        return fmt.Errorf("an API token is required, set API_TOKEN or api.token")
+    }
+
+    listener, err := net.Listen("tcp", cfg.API.Listen)
+    if err != nil {
+        return fmt.Errorf("failed to listen for API requests on %s: %v", cfg.API.Listen, err)
+    }
+    api := &apiServer{token: token}
+    server := &http.Server{Handler: api.routes(), ReadHeaderTimeout: 10 * time.Second}
+
+    signals := make(chan os.Signal, 3)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    go func() {
+        sig := <-signals
+        slog.Info("Stopping API server after the running jobs", "signal", sig.String())
+        close(shutdown)
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        server.Shutdown(ctx)
+        cancel()
+        sig = <-signals
+        slog.Warn("Received second signal, aborting the running backups")
+        abortRuns(fmt.Errorf("aborted by %s", sig))
+        <-signals
+        slog.Warn("Received third signal, exiting immediately")
+        os.Exit(1)
+    }()
+
+    slog.Info("Serving API", "url", fmt.Sprintf("http://%s/api", listener.Addr()),
+        "dashboard", fmt.Sprintf("http://%s/ui/", listener.Addr()))
+    if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+        return fmt.Errorf("API server failed: %v", err)
+    }
+    api.wg.Wait()
+    slog.Info("API server stopped")
+    return nil
+}
+
+// routes returns the handler of the API's endpoints and the dashboard. The
+// dashboard's files are public, it asks for the token to call the API.
+func (api *apiServer) routes() http.Handler {
+    ui, err := fs.Sub(uiFiles, "ui")
+    if err != nil {
+        panic(err)
+    }
+    mux := http.NewServeMux()
+    mux.Handle("/api/", api.authorize(api.apiRoutes()))
+    mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(ui)))
+    mux.Handle("GET /{$}", http.RedirectHandler("/ui/", http.StatusFound))
+    return mux
+}
+
+// apiRoutes returns the handler of the API's endpoints
+func (api *apiServer) apiRoutes() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /api/sites", api.handleSites)
+    mux.HandleFunc("GET /api/history", api.handleHistory)
+    mux.HandleFunc("GET /api/history/runs", api.handleRunHistory)
+    mux.HandleFunc("GET /api/history/runs/{id}", api.handleRunSummary)
+    mux.HandleFunc("GET /api/history/runs/{id}/log", api.handleRunHistoryLog)
+    mux.HandleFunc("GET /api/artifacts", api.handleArtifacts)
+    mux.HandleFunc("GET /api/artifacts/download", api.handleDownload)
+    mux.HandleFunc("GET /api/runs", api.handleRuns)
+    mux.HandleFunc("POST /api/runs", api.handleStartRun)
+    mux.HandleFunc("GET /api/runs/{id}", api.handleRun)
+    mux.HandleFunc("GET /api/runs/{id}/log", api.handleRunLog)
+    mux.HandleFunc("POST /api/restores", api.handleStartRestore)
+    return mux
+}
+
+// authorize rejects requests without the API token
+func (api *apiServer) authorize(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// writeJSON sends a value as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    data, err := json.MarshalIndent(v, "", "  ")
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to encode response: %v", err))
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(append(data, '\n'))
+}
+
+// writeError sends an error as a JSON response
+func writeError(w http.ResponseWriter, status int, message string) {
+    data, _ := json.Marshal(map[string]string{"error": message})
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(append(data, '\n'))
+}
+
+// apiSite is the state of a site's backups in one backup directory
+type apiSite struct {
+    Source    string                       `json:"source"`
+    Site      string                       `json:"site"`
+    Latest    map[string]catalog.Entry     `json:"latest"`
+    Runs      map[string]catalog.RunStatus `json:"runs"`
+    Retention map[string]*apiRetention     `json:"retention"`
+}
+
+// apiRetention describes the archives of a type kept of a site
+type apiRetention struct {
+    Archives int    `json:"archives"`
+    Size     int64  `json:"size"`
+    Policy   string `json:"policy"`
+}
+
+// retentionPolicy describes how the archives of a type of a site are rotated
+func retentionPolicy(storage config.Storage, site, archiveType string) string {
+    if policy := storage.Retention.Policy(site, archiveType); policy.Enabled() {
+        return policy.String()
+    }
+    if archiveType == "database" {
+        return fmt.Sprintf("newest %d", storage.MaxDBBackups)
+    }
+    return fmt.Sprintf("newest %d", storage.MaxFileBackups)
+}
+
+// handleSites lists every site with its newest archives, the outcome of its
+// latest runs and the archives kept by its retention
+func (api *apiServer) handleSites(w http.ResponseWriter, r *http.Request) {
+    sites := []apiSite{}
+    for _, source := range tool.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        storage := tool.StorageOf(source.BaseDir)
+        bySite := make(map[string]*apiSite)
+        get := func(site string) *apiSite {
+            if bySite[site] == nil {
+                bySite[site] = &apiSite{Source: source.Name, Site: site,
+                    Latest: map[string]catalog.Entry{}, Runs: map[string]catalog.RunStatus{},
+                    Retention: map[string]*apiRetention{}}
+                for _, t := range []string{"file", "database"} {
+                    bySite[site].Retention[t] = &apiRetention{Policy: retentionPolicy(storage, site, t)}
+                }
+            }
+            return bySite[site]
+        }
+        for _, entry := range cat.Entries() {
+            s := get(entry.Site)
+            s.Latest[entry.Type] = entry
+            if retention := s.Retention[entry.Type]; retention != nil {
+                retention.Archives++
+                retention.Size += entry.Size
+            }
+        }
+        for site, runs := range cat.LatestRuns() {
+            get(site).Runs = runs
+        }
+        var names []string
+        for site := range bySite {
+            names = append(names, site)
+        }
+        sort.Strings(names)
+        for _, site := range names {
+            sites = append(sites, *bySite[site])
+        }
+    }
+    writeJSON(w, http.StatusOK, sites)
+}
+
+// handleHistory lists the recorded run statuses, newest first, optionally
+// of one site (?site=) and limited in number (?limit=)
+func (api *apiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+    site := r.URL.Query().Get("site")
+    limit, err := queryLimit(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+
+    type apiRunStatus struct {
+        Source string `json:"source"`
+        catalog.RunStatus
+    }
+    history := []apiRunStatus{}
+    for _, source := range tool.ReportSources() {
+        if _, err := os.Stat(source.BaseDir); os.IsNotExist(err) {
+            continue
+        }
+        cat, err := catalog.Open(source.BaseDir)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        for _, status := range cat.Runs(site) {
+            history = append(history, apiRunStatus{Source: source.Name, RunStatus: status})
+        }
+    }
+    sort.SliceStable(history, func(i, j int) bool {
+        return history[i].Time.After(history[j].Time)
+    })
+    if limit > 0 && len(history) > limit {
+        history = history[:limit]
+    }
+    writeJSON(w, http.StatusOK, history)
+}
+
+// handleRunHistory lists the outcomes of the recent backup runs, newest
+// first
+func (api *apiServer) handleRunHistory(w http.ResponseWriter, r *http.Request) {
+    limit, err := queryLimit(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    cat, err := catalog.Open(cfg.Local.BackupDir)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    outcomes := cat.Outcomes()
+    sort.SliceStable(outcomes, func(i, j int) bool {
+        return outcomes[i].Started.After(outcomes[j].Started)
+    })
+    if limit > 0 && len(outcomes) > limit {
+        outcomes = outcomes[:limit]
+    }
+    writeJSON(w, http.StatusOK, outcomes)
+}
+
+// handleRunSummary returns the summary of a run in the run history, or of
+// the latest run for the ID "latest"
+func (api *apiServer) handleRunSummary(w http.ResponseWriter, r *http.Request) {
+    dir, err := report.FindRunDir(cfg.Local.BackupDir, r.PathValue("id"))
+    if err != nil {
+        writeError(w, http.StatusNotFound, err.Error())
+        return
+    }
+    data, err := os.ReadFile(filepath.Join(dir, report.SummaryFileName))
+    if os.IsNotExist(err) {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("run %s has no summary, it may still be running", r.PathValue("id")))
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    var summary report.RunSummary
+    if err := json.Unmarshal(data, &summary); err != nil {
+        writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to read run summary: %v", err))
+        return
+    }
+    writeJSON(w, http.StatusOK, summary)
+}
+
+// handleRunHistoryLog sends the log of a run in the run history as JSON
+// lines, optionally only records of at least ?level=
+func (api *apiServer) handleRunHistoryLog(w http.ResponseWriter, r *http.Request) {
+    var level slog.Level
+    if value := r.URL.Query().Get("level"); value != "" {
+        if err := level.UnmarshalText([]byte(value)); err != nil {
+            writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid level %q", value))
+            return
+        }
+    } else {
+        level = slog.LevelDebug
+    }
+    dir, err := report.FindRunDir(cfg.Local.BackupDir, r.PathValue("id"))
+    if err != nil {
+        writeError(w, http.StatusNotFound, err.Error())
+        return
+    }
+    if _, err := os.Stat(filepath.Join(dir, logging.RunLogName)); err != nil {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("run %s has no log", r.PathValue("id")))
+        return
+    }
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    if err := report.PrintRunLog(w, dir, level, true); err != nil {
+        slog.Warn("Failed to send a run log", "error", err)
+    }
+}
+
+// queryLimit returns the ?limit= of a request, 0 for none
+func queryLimit(r *http.Request) (int, error) {
+    value := r.URL.Query().Get("limit")
+    if value == "" {
+        return 0, nil
+    }
+    limit, err := strconv.Atoi(value)
+    if err != nil || limit < 0 {
+        return 0, fmt.Errorf("invalid limit %q", value)
+    }
+    return limit, nil
+}
+
+// handleArtifacts lists the cataloged archives, oldest first, optionally
+// of sites matching ?site=, of one ?type= and one ?source=
+func (api *apiServer) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+    site, archiveType, source := r.URL.Query().Get("site"), r.URL.Query().Get("type"), r.URL.Query().Get("source")
+    if err := validArchiveType(archiveType); err != nil {
+        writeError(w, http.StatusBadRequest, err.Error())
+        return
+    }
+    if _, err := filepath.Match(site, ""); err != nil {
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid site pattern %q: %v", site, err))
+        return
+    }
+
+    entries, err := catalogEntries(func(e catalog.Entry) bool {
+        if site != "" {
+            if ok, _ := filepath.Match(site, e.Site); !ok {
+                return false
+            }
+        }
+        return archiveType == "" || e.Type == archiveType
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    selected := []catalogEntry{}
+    for _, e := range entries {
+        if source == "" || e.Source == source || strings.HasPrefix(e.Source, source+"/") {
+            selected = append(selected, e)
+        }
+    }
+    writeJSON(w, http.StatusOK, selected)
+}
+
+// handleDownload sends the archive at ?path=. Only cataloged archives can be
+// downloaded, so the API doesn't expose other files.
+func (api *apiServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+    path := r.URL.Query().Get("path")
+    entries, err := catalogEntries(func(e catalog.Entry) bool { return e.Path == path })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    if path == "" || len(entries) == 0 {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("no archive %q in the catalog", path))
+        return
+    }
+
+    // Deduplicated archives and snapshots are sent as complete archives,
+    // encrypted if the chunks of a deduplicated archive are
+    checksum := entries[0].Checksum
+    if backup.NeedsReassembly(path) {
+        encrypted := false
+        if dedup.IsIndex(path) {
+            index, err := dedup.ReadIndex(path)
+            if err != nil {
+                writeError(w, http.StatusNotFound, fmt.Sprintf("archive is missing on disk: %v", err))
+                return
+            }
+            encrypted = index.KeyID != ""
+        }
+        key, err := tool.Keyring()
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        tempDir, err := backup.NewTempDir("download")
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        defer os.RemoveAll(tempDir)
+        if path, err = backup.ReassembleArchive(path, tempDir, key, encrypted); err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+        if checksum, err = backup.FileChecksum(path); err != nil {
+            writeError(w, http.StatusInternalServerError, err.Error())
+            return
+        }
+    }
+
+    file, err := os.Open(path)
+    if err != nil {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("archive is missing on disk: %v", err))
+        return
+    }
+    defer file.Close()
+    info, err := file.Stat()
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, err.Error())
+        return
+    }
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)))
+    if checksum != "" {
+        w.Header().Set("X-Checksum-Sha256", checksum)
+    }
+    http.ServeContent(w, r, filepath.Base(path), info.ModTime(), file)
+}
+
+// handleRuns lists the runs started through the API, newest first
+func (api *apiServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+    api.mu.Lock()
+    runs := make([]apiRun, 0, len(api.runs))
+    for i := len(api.runs) - 1; i >= 0; i-- {
+        runs = append(runs, *api.runs[i])
+    }
+    api.mu.Unlock()
+    writeJSON(w, http.StatusOK, runs)
+}
+
+// handleRun returns the state of a run started through the API
+func (api *apiServer) handleRun(w http.ResponseWriter, r *http.Request) {
+    run, ok := api.run(r.PathValue("id"))
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("run %s not found", r.PathValue("id")))
+        return
+    }
+    writeJSON(w, http.StatusOK, run)
+}
+
+// run returns a copy of the run with the given ID
+func (api *apiServer) run(id string) (apiRun, bool) {
+    api.mu.Lock()
+    defer api.mu.Unlock()
+    for _, run := range api.runs {
+        if run.ID == id {
+            return *run, true
+        }
+    }
+    return apiRun{}, false
+}
+
+// handleStartRun starts a backup run in the background: a full run, or of
+// the local sites given as {"sites": [...]}, continuing the last run where
+// it failed with {"resume": true}
+func (api *apiServer) handleStartRun(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Sites  []string `json:"sites"`
+        Resume bool     `json:"resume"`
+    }
+    if !decodeRequest(w, r, &request) {
+        return
+    }
+    run := &apiRun{Kind: "backup", Sites: request.Sites, Resume: request.Resume}
+    run.perform = func() error {
+        return runBackup(backuptool.Scope{Sites: run.Sites, Resume: run.Resume}, 0)
+    }
+    api.start(w, run)
+}
+
+// handleStartRestore restores a site's archives in the background, like the
+// restore command with the options of the request
+func (api *apiServer) handleStartRestore(w http.ResponseWriter, r *http.Request) {
+    var request apiRestore
+    if !decodeRequest(w, r, &request) {
+        return
+    }
+    if request.Timestamp == "" {
+        request.Timestamp = "latest"
+    }
+    if request.Source == "" {
+        request.Source = "local"
+    }
+    // Values starting with a dash would be taken for options
+    if request.Site == "" || strings.HasPrefix(request.Site, "-") || strings.HasPrefix(request.Timestamp, "-") {
+        writeError(w, http.StatusBadRequest, "a site and a timestamp or latest are required")
+        return
+    }
+    if request.Source != "local" && request.Source != "remote" {
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown source %q, use local or remote", request.Source))
+        return
+    }
+    if request.Database && request.DatabaseOnly {
+        writeError(w, http.StatusBadRequest, "database and database_only exclude each other")
+        return
+    }
+    // A token must not let files be written, and chowned as root, anywhere
+    if request.Target != "" && !restoreTargetAllowed(request.Target) {
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("target %s is not the document root of a site of this server or below it", request.Target))
+        return
+    }
+    run := &apiRun{Kind: "restore", Restore: &request}
+    run.perform = func() error { return runRestore(request.args()) }
+    api.start(w, run)
+}
+
+// restoreTargetAllowed reports whether a restore requested through the API
+// may extract into target: the document root of a site of this server or a
+// directory below it, after resolving symlinks
+func restoreTargetAllowed(target string) bool {
+    if !filepath.IsAbs(target) {
+        return false
+    }
+    target = resolvedPath(target)
+    for _, root := range tool.SiteRoots() {
+        if root == "" {
+            continue
+        }
+        root = resolvedPath(root)
+        if target == root || strings.HasPrefix(target, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+            return true
+        }
+    }
+    return false
+}
+
+// resolvedPath returns a clean path with its symlinks resolved as far as it
+// exists
+func resolvedPath(path string) string {
+    path = filepath.Clean(path)
+    var rest []string
+    for dir := path; ; dir = filepath.Dir(dir) {
+        if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+            return filepath.Join(append([]string{resolved}, rest...)...)
+        }
+        if filepath.Dir(dir) == dir {
+            return path
+        }
+        rest = append([]string{filepath.Base(dir)}, rest...)
+    }
+}
+
+// decodeRequest reads the JSON body of a request into v, which keeps its
+// zero value for an empty body. It answers bad requests itself.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    if r.ContentLength == 0 {
+        return true
+    }
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil && err != io.EOF {
+        writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+        return false
+    }
+    return true
+}
+
+// start runs a backup or restore in the background. Only one run is started
+// at a time; runs from cron or the daemon are excluded by the run lock.
+func (api *apiServer) start(w http.ResponseWriter, run *apiRun) {
+    if shuttingDown() {
+        writeError(w, http.StatusServiceUnavailable, "the server is shutting down")
+        return
+    }
+
+    api.mu.Lock()
+    for _, other := range api.runs {
+        if other.State == apiRunRunning {
+            api.mu.Unlock()
+            writeError(w, http.StatusConflict, fmt.Sprintf("run %s is still running", other.ID))
+            return
+        }
+    }
+    api.seq++
+    run.ID = fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), api.seq)
+    run.State = apiRunRunning
+    run.Started = time.Now()
+    run.log = logging.StartCapture()
+    api.runs = append(api.runs, run)
+    if len(api.runs) > maxAPIRuns {
+        api.runs = api.runs[len(api.runs)-maxAPIRuns:]
+    }
+    started := *run
+    api.mu.Unlock()
+
+    api.wg.Add(1)
+    go api.execute(run)
+    w.Header().Set("Location", "/api/runs/"+run.ID)
+    writeJSON(w, http.StatusAccepted, started)
+}
+
+// execute performs a run started through the API and records its outcome
+func (api *apiServer) execute(run *apiRun) {
+    defer api.wg.Done()
+    slog.Info("Starting run requested through the API", "api_run", run.ID, "kind", run.Kind)
+    err := run.perform()
+    if err != nil {
+        slog.Error("Run requested through the API failed", "api_run", run.ID, "kind", run.Kind, "error", err)
+    }
+    run.log.Close()
+
+    api.mu.Lock()
+    defer api.mu.Unlock()
+    finished := time.Now()
+    run.Finished = &finished
+    run.State = apiRunSucceeded
+    if err != nil {
+        run.State, run.Error = apiRunFailed, logging.Redact(err.Error())
+    }
+}
+
+// handleRunLog streams the log output of a run started through the API. The
+// response follows the log until the run ends, unless ?follow=false.
+func (api *apiServer) handleRunLog(w http.ResponseWriter, r *http.Request) {
+    run, ok := api.run(r.PathValue("id"))
+    if !ok {
+        writeError(w, http.StatusNotFound, fmt.Sprintf("run %s not found", r.PathValue("id")))
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    flush := func() {}
+    if flusher, ok := w.(http.Flusher); ok {
+        flush = flusher.Flush
+    }
+    ctx := r.Context()
+    if follow, _ := strconv.ParseBool(r.URL.Query().Get("follow")); r.URL.Query().Has("follow") && !follow {
+        // Without following, only the output so far is sent
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithCancel(ctx)
+        cancel()
+    }
+    run.log.Follow(ctx, w, flush)
+}
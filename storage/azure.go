@@ -0,0 +1,327 @@
+package storage
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+const (
+    // DefaultAzureBlockSize is the size of the blocks large files are staged in
+    DefaultAzureBlockSize = 16 << 20
+    // Most blocks a blob may have
+    maxAzureBlocks = 50000
+    // Version of the Blob service REST API requests are made with
+    azureAPIVersion = "2021-08-06"
+    // Resource access tokens are requested for
+    azureStorageResource = "https://storage.azure.com/"
+    // Token endpoint of the Azure instance metadata service
+    azureIMDSTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// AzureConfig holds the settings of an Azure Blob Storage container
+type AzureConfig struct {
+    // Storage account name
+    Account   string
+    Container string
+    // Prepended to every blob name
+    Prefix    string
+    // Service principal; without a client secret the managed identity of the
+    // machine is used, ClientID selecting a user-assigned one
+    TenantID     string
+    ClientID     string
+    ClientSecret string
+    // Files larger than this are uploaded in blocks of this size
+    BlockSize int64
+    // Access tier of uploaded blobs, e.g. Archive; the account's default if not set
+    AccessTier string
+    // Blob service endpoint, https://<account>.blob.core.windows.net unless set
+    Endpoint  string
+    // How failed requests are retried, retry.Default() if not set
+    Retry     retry.Policy
+}
+
+// AzureStorage uploads artifacts to an Azure Blob Storage container as
+// block blobs, authorized with Microsoft Entra ID tokens
+type AzureStorage struct {
+    config AzureConfig
+    client *http.Client
+    tokens *tokenSource
+}
+
+// NewAzureStorage creates an uploader for the configured container
+func NewAzureStorage(config AzureConfig) (*AzureStorage, error) {
+    if config.Account == "" || config.Container == "" {
+        return nil, fmt.Errorf("Azure storage account and container are required")
+    }
+    if config.ClientSecret != "" && (config.TenantID == "" || config.ClientID == "") {
+        return nil, fmt.Errorf("Azure service principal needs a tenant ID and client ID")
+    }
+    if config.BlockSize == 0 {
+        config.BlockSize = DefaultAzureBlockSize
+    }
+    if config.Endpoint == "" {
+        config.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", config.Account)
+    }
+    config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+
+    a := &AzureStorage{
+        config: config,
+        client: &http.Client{Timeout: 30 * time.Minute},
+    }
+    a.tokens = &tokenSource{client: a.client, policy: config.Retry, fetch: a.tokenRequest}
+    return a, nil
+}
+
+// tokenRequest requests an access token for the service principal, or for
+// the managed identity from the instance metadata service
+func (a *AzureStorage) tokenRequest() (*http.Request, error) {
+    if a.config.ClientSecret != "" {
+        form := url.Values{
+            "grant_type":    {"client_credentials"},
+            "client_id":     {a.config.ClientID},
+            "client_secret": {a.config.ClientSecret},
+            "scope":         {azureStorageResource + ".default"},
+        }
+        target := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", url.PathEscape(a.config.TenantID))
+        req, err := http.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        return req, nil
+    }
+
+    query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureStorageResource}}
+    if a.config.ClientID != "" {
+        query.Set("client_id", a.config.ClientID)
+    }
+    req, err := http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+query.Encode(), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Metadata", "true")
+    return req, nil
+}
+
+// Location returns the URL of a key's blob
+func (a *AzureStorage) Location(key string) string {
+    return a.blobURL(prefixedKey(a.config.Prefix, key))
+}
+
+// blobURL returns the URL of a blob in the container
+func (a *AzureStorage) blobURL(name string) string {
+    return fmt.Sprintf("%s/%s/%s", a.config.Endpoint, url.PathEscape(a.config.Container), uriEncode(name, false))
+}
+
+// PutObject uploads a file as a block blob. Files larger than the block size
+// are staged block by block and committed at the end. Blocks already staged
+// by an earlier attempt for the same content are not sent again, so an
+// interrupted upload resumes where it stopped.
+func (a *AzureStorage) PutObject(key, localPath string, metadata map[string]string) error {
+    file, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", localPath, err)
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat %s: %v", localPath, err)
+    }
+
+    name := prefixedKey(a.config.Prefix, key)
+    headers := map[string]string{"x-ms-blob-type": "BlockBlob"}
+    for key, value := range metadata {
+        headers["x-ms-meta-"+strings.ToLower(key)] = value
+    }
+    if a.config.AccessTier != "" {
+        headers["x-ms-access-tier"] = a.config.AccessTier
+    }
+
+    if info.Size() <= a.config.BlockSize {
+        err := a.send(http.MethodPut, name, nil, io.NewSectionReader(file, 0, info.Size()), headers, nil)
+        if err != nil {
+            return fmt.Errorf("failed to upload %s: %v", name, err)
+        }
+        return nil
+    }
+    return a.putBlocks(name, file, info.Size(), metadata["sha256"], headers)
+}
+
+// GetObject downloads a blob. A blob in the archive tier can't be read; it is
+// rehydrated to the cool tier instead.
+func (a *AzureStorage) GetObject(key, localPath string) error {
+    name := prefixedKey(a.config.Prefix, key)
+    var saveErr error
+    err := a.send(http.MethodGet, name, nil, nil, nil, saveTo(localPath, &saveErr))
+    if hasStatus(err, http.StatusConflict) && strings.Contains(err.Error(), "BlobArchived") {
+        return a.rehydrate(name)
+    }
+    if err == nil {
+        err = saveErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", name, err)
+    }
+    return nil
+}
+
+// StatObject looks a blob up with a HEAD request
+func (a *AzureStorage) StatObject(key string) (bool, error) {
+    name := prefixedKey(a.config.Prefix, key)
+    err := a.send(http.MethodHead, name, nil, nil, nil, nil)
+    if hasStatus(err, http.StatusNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", name, err)
+    }
+    return true, nil
+}
+
+// rehydrate moves an archived blob to the cool tier and returns
+// ErrRestoring. A blob being rehydrated already is answered with 409.
+func (a *AzureStorage) rehydrate(name string) error {
+    headers := map[string]string{"x-ms-access-tier": "Cool", "x-ms-rehydrate-priority": "Standard"}
+    err := a.send(http.MethodPut, name, url.Values{"comp": {"tier"}}, nil, headers, nil)
+    if err != nil && !hasStatus(err, http.StatusConflict) {
+        return fmt.Errorf("failed to rehydrate %s: %v", name, err)
+    }
+    return fmt.Errorf("%s: %w", name, ErrRestoring)
+}
+
+// putBlocks stages a large file block by block and commits the block list.
+// Block IDs are derived from the file's checksum, so staged blocks of an
+// earlier attempt are only reused for the same content.
+func (a *AzureStorage) putBlocks(name string, file *os.File, size int64, checksum string, headers map[string]string) error {
+    blockSize := a.config.BlockSize
+    for size/blockSize >= maxAzureBlocks {
+        blockSize *= 2
+    }
+    if len(checksum) > 16 {
+        checksum = checksum[:16]
+    }
+    if checksum == "" {
+        checksum = strconv.FormatInt(size, 16)
+    }
+
+    staged, err := a.stagedBlocks(name)
+    if err != nil {
+        return fmt.Errorf("failed to list staged blocks of %s: %v", name, err)
+    }
+
+    var ids []string
+    for offset, number := int64(0), 0; offset < size; offset, number = offset+blockSize, number+1 {
+        length := blockSize
+        if offset+length > size {
+            length = size - offset
+        }
+        id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%06d", checksum, number)))
+        ids = append(ids, id)
+        if staged[id] == length {
+            continue
+        }
+        query := url.Values{"comp": {"block"}, "blockid": {id}}
+        if err := a.send(http.MethodPut, name, query, io.NewSectionReader(file, offset, length), nil, nil); err != nil {
+            return fmt.Errorf("failed to upload block %d of %s: %v", number+1, name, err)
+        }
+    }
+
+    var list bytes.Buffer
+    list.WriteString(xml.Header + "<BlockList>")
+    for _, id := range ids {
+        list.WriteString("<Latest>" + id + "</Latest>")
+    }
+    list.WriteString("</BlockList>")
+    delete(headers, "x-ms-blob-type")
+    if err := a.send(http.MethodPut, name, url.Values{"comp": {"blocklist"}}, bytes.NewReader(list.Bytes()), headers, nil); err != nil {
+        return fmt.Errorf("failed to commit blocks of %s: %v", name, err)
+    }
+    return nil
+}
+
+// stagedBlocks returns the sizes of the uncommitted blocks of a blob by ID
+func (a *AzureStorage) stagedBlocks(name string) (map[string]int64, error) {
+    var data []byte
+    query := url.Values{"comp": {"blocklist"}, "blocklisttype": {"uncommitted"}}
+    err := a.send(http.MethodGet, name, query, nil, nil, func(resp *http.Response) {
+        data, _ = io.ReadAll(resp.Body)
+    })
+    if err != nil {
+        // A blob that doesn't exist yet has no staged blocks
+        if hasStatus(err, http.StatusNotFound) {
+            return nil, nil
+        }
+        return nil, err
+    }
+
+    var list struct {
+        Blocks []struct {
+            Name string `xml:"Name"`
+            Size int64  `xml:"Size"`
+        } `xml:"UncommittedBlocks>Block"`
+    }
+    if err := xml.Unmarshal(data, &list); err != nil {
+        return nil, fmt.Errorf("unexpected block list: %v", err)
+    }
+    staged := make(map[string]int64)
+    for _, block := range list.Blocks {
+        staged[block.Name] = block.Size
+    }
+    return staged, nil
+}
+
+// send sends an authorized request for a blob, retrying failed attempts,
+// and passes a successful response to handle if it is set
+func (a *AzureStorage) send(method, name string, query url.Values, body io.ReadSeeker, headers map[string]string, handle func(*http.Response)) error {
+    if body == nil {
+        body = bytes.NewReader(nil)
+    }
+    target := a.blobURL(name)
+    if len(query) > 0 {
+        target += "?" + query.Encode()
+    }
+    if handle == nil {
+        handle = func(*http.Response) {}
+    }
+
+    return sendWithRetry(a.client, a.config.Retry, func() (*http.Request, error) {
+        token, err := a.tokens.Token()
+        if err != nil {
+            return nil, err
+        }
+        if _, err := body.Seek(0, io.SeekStart); err != nil {
+            return nil, err
+        }
+        req, err := http.NewRequest(method, target, body)
+        if err != nil {
+            return nil, err
+        }
+        if sized, ok := body.(interface{ Size() int64 }); ok {
+            req.ContentLength = sized.Size()
+        }
+        if req.ContentLength == 0 {
+            req.Body = http.NoBody
+        }
+        req.Header.Set("Authorization", "Bearer "+token)
+        req.Header.Set("x-ms-version", azureAPIVersion)
+        req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+        for name, value := range headers {
+            req.Header.Set(name, value)
+        }
+        return req, nil
+    }, handle)
+}
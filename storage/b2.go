@@ -0,0 +1,447 @@
+package storage
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+const (
+    // DefaultB2PartSize is the size of the parts of a large file upload
+    DefaultB2PartSize = 100 << 20
+    // Smallest part B2 accepts, except for the last one
+    b2MinPartSize = 5 << 20
+    // Most parts a large file may have
+    b2MaxParts = 10000
+)
+
+// B2Config holds the settings of a Backblaze B2 bucket
+type B2Config struct {
+    Bucket string
+    // Prepended to every file name
+    Prefix string
+    // Application key ID and key, restricted to the bucket or not
+    KeyID          string
+    ApplicationKey string
+    // Files larger than this are uploaded as large files in parts of this size
+    PartSize int64
+    // Authorization endpoint, https://api.backblazeb2.com unless testing
+    Endpoint string
+    // File lock of uploaded files for LockDays days from the upload, in
+    // governance or compliance mode; the bucket must have file lock
+    // enabled. No lock if LockDays is zero.
+    LockMode string
+    LockDays int
+    // How failed requests are retried, retry.Default() if not set
+    Retry retry.Policy
+}
+
+// B2Storage uploads artifacts to a Backblaze B2 bucket with the native API
+type B2Storage struct {
+    config B2Config
+    client *http.Client
+    // Authorization of the account, renewed when it expires
+    mu       sync.Mutex
+    auth     *b2Authorization
+    bucketID string
+}
+
+// b2Authorization is the answer of b2_authorize_account
+type b2Authorization struct {
+    AccountID          string `json:"accountId"`
+    AuthorizationToken string `json:"authorizationToken"`
+    APIURL             string `json:"apiUrl"`
+    DownloadURL        string `json:"downloadUrl"`
+    Allowed            struct {
+        BucketID   string `json:"bucketId"`
+        BucketName string `json:"bucketName"`
+    } `json:"allowed"`
+}
+
+// b2UploadURL is where a file or part is sent and the token to send it with
+type b2UploadURL struct {
+    UploadURL          string `json:"uploadUrl"`
+    AuthorizationToken string `json:"authorizationToken"`
+}
+
+// NewB2Storage creates an uploader for the configured bucket
+func NewB2Storage(config B2Config) (*B2Storage, error) {
+    if config.Bucket == "" {
+        return nil, fmt.Errorf("B2 bucket is not set")
+    }
+    if config.KeyID == "" || config.ApplicationKey == "" {
+        return nil, fmt.Errorf("B2 key ID and application key are required")
+    }
+    if config.PartSize == 0 {
+        config.PartSize = DefaultB2PartSize
+    }
+    if config.PartSize < b2MinPartSize {
+        return nil, fmt.Errorf("B2 part size must be at least %d bytes", b2MinPartSize)
+    }
+    if config.Endpoint == "" {
+        config.Endpoint = "https://api.backblazeb2.com"
+    }
+    config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+    return &B2Storage{
+        config: config,
+        client: &http.Client{Timeout: 30 * time.Minute},
+    }, nil
+}
+
+// Location returns the b2:// URL of a key
+func (b *B2Storage) Location(key string) string {
+    return fmt.Sprintf("b2://%s/%s", b.config.Bucket, prefixedKey(b.config.Prefix, key))
+}
+
+// PutObject uploads a file, as a large file in parts if it is larger than
+// the part size. The metadata is stored as file info.
+func (b *B2Storage) PutObject(key, localPath string, metadata map[string]string) error {
+    file, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", localPath, err)
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat %s: %v", localPath, err)
+    }
+
+    name := prefixedKey(b.config.Prefix, key)
+    if err := b.authorize(); err != nil {
+        return fmt.Errorf("failed to upload %s: %v", b.Location(key), err)
+    }
+    if info.Size() <= b.config.PartSize {
+        if err := b.putFile(name, io.NewSectionReader(file, 0, info.Size()), metadata); err != nil {
+            return fmt.Errorf("failed to upload %s: %v", b.Location(key), err)
+        }
+        return nil
+    }
+    return b.putLargeFile(name, file, info.Size(), metadata)
+}
+
+// GetObject downloads a file by its name
+func (b *B2Storage) GetObject(key, localPath string) error {
+    var saveErr error
+    err := b.sendFile(http.MethodGet, key, saveTo(localPath, &saveErr))
+    if err == nil {
+        err = saveErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", b.Location(key), err)
+    }
+    return nil
+}
+
+// StatObject looks a file up by its name with a HEAD request
+func (b *B2Storage) StatObject(key string) (bool, error) {
+    err := b.sendFile(http.MethodHead, key, func(*http.Response) {})
+    if hasStatus(err, http.StatusNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", b.Location(key), err)
+    }
+    return true, nil
+}
+
+// sendFile sends a request for a key's file to the download URL and passes
+// a successful response to handle. An expired authorization is renewed once.
+func (b *B2Storage) sendFile(method, key string, handle func(*http.Response)) error {
+    name := prefixedKey(b.config.Prefix, key)
+    for renewed := false; ; renewed = true {
+        if err := b.authorize(); err != nil {
+            return err
+        }
+        b.mu.Lock()
+        auth := b.auth
+        b.mu.Unlock()
+
+        err := sendWithRetry(b.client, b.config.Retry, func() (*http.Request, error) {
+            req, err := http.NewRequest(method, auth.DownloadURL+"/file/"+uriEncode(b.config.Bucket, true)+"/"+uriEncode(name, false), nil)
+            if err != nil {
+                return nil, err
+            }
+            req.Header.Set("Authorization", auth.AuthorizationToken)
+            return req, nil
+        }, handle)
+        if hasStatus(err, http.StatusUnauthorized) && !renewed {
+            b.mu.Lock()
+            if b.auth == auth {
+                b.auth = nil
+            }
+            b.mu.Unlock()
+            continue
+        }
+        return err
+    }
+}
+
+// putFile uploads a file in a single request. Every attempt gets a new
+// upload URL, as B2 asks after a failed upload.
+func (b *B2Storage) putFile(name string, body *io.SectionReader, metadata map[string]string) error {
+    sum, err := sha1Hex(body)
+    if err != nil {
+        return err
+    }
+    return sendWithRetry(b.client, b.config.Retry, func() (*http.Request, error) {
+        var upload b2UploadURL
+        if err := b.call("b2_get_upload_url", map[string]string{"bucketId": b.bucketID}, &upload); err != nil {
+            return nil, err
+        }
+        req, err := b2UploadRequest(upload, body, sum)
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("X-Bz-File-Name", uriEncode(name, false))
+        req.Header.Set("Content-Type", "b2/x-auto")
+        if b.config.LockDays > 0 {
+            req.Header.Set("X-Bz-File-Retention-Mode", b.config.LockMode)
+            req.Header.Set("X-Bz-File-Retention-Retain-Until-Timestamp", strconv.FormatInt(b.retainUntil(), 10))
+        }
+        for key, value := range metadata {
+            req.Header.Set("X-Bz-Info-"+key, uriEncode(value, true))
+        }
+        return req, nil
+    }, func(*http.Response) {})
+}
+
+// putLargeFile uploads a file part by part. A large file that fails is
+// cancelled so the bucket isn't charged for its parts.
+func (b *B2Storage) putLargeFile(name string, file *os.File, size int64, metadata map[string]string) error {
+    partSize := b.config.PartSize
+    for size/partSize >= b2MaxParts {
+        partSize *= 2
+    }
+
+    var started struct {
+        FileID string `json:"fileId"`
+    }
+    params := map[string]interface{}{
+        "bucketId":    b.bucketID,
+        "fileName":    name,
+        "contentType": "b2/x-auto",
+        "fileInfo":    metadata,
+    }
+    if b.config.LockDays > 0 {
+        params["fileRetention"] = map[string]interface{}{"mode": b.config.LockMode, "retainUntilTimestamp": b.retainUntil()}
+    }
+    err := b.call("b2_start_large_file", params, &started)
+    if err != nil {
+        return fmt.Errorf("failed to start large file %s: %v", name, err)
+    }
+    cancel := func(cause error) error {
+        if err := b.call("b2_cancel_large_file", map[string]string{"fileId": started.FileID}, nil); err != nil {
+            return fmt.Errorf("%v (cancelling the upload failed too: %v)", cause, err)
+        }
+        return cause
+    }
+
+    var sums []string
+    for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+        length := partSize
+        if offset+length > size {
+            length = size - offset
+        }
+        sum, err := b.putPart(started.FileID, number, io.NewSectionReader(file, offset, length))
+        if err != nil {
+            return cancel(fmt.Errorf("failed to upload part %d of %s: %v", number, name, err))
+        }
+        sums = append(sums, sum)
+    }
+    err = b.call("b2_finish_large_file", map[string]interface{}{"fileId": started.FileID, "partSha1Array": sums}, nil)
+    if err != nil {
+        return cancel(fmt.Errorf("failed to finish large file %s: %v", name, err))
+    }
+    return nil
+}
+
+// retainUntil returns when the file lock of a file uploaded now ends, in
+// milliseconds since the epoch
+func (b *B2Storage) retainUntil() int64 {
+    return time.Now().AddDate(0, 0, b.config.LockDays).UnixMilli()
+}
+
+// putPart uploads one part of a large file and returns its SHA-1
+func (b *B2Storage) putPart(fileID string, number int, body *io.SectionReader) (string, error) {
+    sum, err := sha1Hex(body)
+    if err != nil {
+        return "", err
+    }
+    err = sendWithRetry(b.client, b.config.Retry, func() (*http.Request, error) {
+        var upload b2UploadURL
+        if err := b.call("b2_get_upload_part_url", map[string]string{"fileId": fileID}, &upload); err != nil {
+            return nil, err
+        }
+        req, err := b2UploadRequest(upload, body, sum)
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("X-Bz-Part-Number", strconv.Itoa(number))
+        return req, nil
+    }, func(*http.Response) {})
+    return sum, err
+}
+
+// b2UploadRequest builds the request sending body to an upload URL
+func b2UploadRequest(upload b2UploadURL, body *io.SectionReader, sum string) (*http.Request, error) {
+    if _, err := body.Seek(0, io.SeekStart); err != nil {
+        return nil, err
+    }
+    req, err := http.NewRequest(http.MethodPost, upload.UploadURL, body)
+    if err != nil {
+        return nil, err
+    }
+    req.ContentLength = body.Size()
+    if req.ContentLength == 0 {
+        req.Body = http.NoBody
+    }
+    req.Header.Set("Authorization", upload.AuthorizationToken)
+    req.Header.Set("X-Bz-Content-Sha1", sum)
+    return req, nil
+}
+
+// call sends a request to an API operation and decodes its answer into
+// result unless it is nil. An expired authorization is renewed once.
+func (b *B2Storage) call(operation string, params interface{}, result interface{}) error {
+    body, err := json.Marshal(params)
+    if err != nil {
+        return err
+    }
+    for renewed := false; ; renewed = true {
+        if err := b.authorize(); err != nil {
+            return err
+        }
+        b.mu.Lock()
+        auth := b.auth
+        b.mu.Unlock()
+
+        var data []byte
+        err := sendWithRetry(b.client, b.config.Retry, func() (*http.Request, error) {
+            req, err := http.NewRequest(http.MethodPost, auth.APIURL+"/b2api/v2/"+operation, bytes.NewReader(body))
+            if err != nil {
+                return nil, err
+            }
+            req.Header.Set("Authorization", auth.AuthorizationToken)
+            return req, nil
+        }, func(resp *http.Response) {
+            data, _ = io.ReadAll(resp.Body)
+        })
+        if hasStatus(err, http.StatusUnauthorized) && !renewed {
+            b.mu.Lock()
+            if b.auth == auth {
+                b.auth = nil
+            }
+            b.mu.Unlock()
+            continue
+        }
+        if err != nil {
+            return fmt.Errorf("%s: %v", operation, err)
+        }
+        if result != nil {
+            if err := json.Unmarshal(data, result); err != nil {
+                return fmt.Errorf("%s: unexpected response: %s", operation, data)
+            }
+        }
+        return nil
+    }
+}
+
+// authorize logs in with the application key unless a valid authorization
+// is cached, and looks up the ID of the bucket
+func (b *B2Storage) authorize() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.auth != nil {
+        return nil
+    }
+
+    var data []byte
+    err := sendWithRetry(b.client, b.config.Retry, func() (*http.Request, error) {
+        req, err := http.NewRequest(http.MethodGet, b.config.Endpoint+"/b2api/v2/b2_authorize_account", nil)
+        if err != nil {
+            return nil, err
+        }
+        req.SetBasicAuth(b.config.KeyID, b.config.ApplicationKey)
+        return req, nil
+    }, func(resp *http.Response) {
+        data, _ = io.ReadAll(resp.Body)
+    })
+    if err != nil {
+        return fmt.Errorf("failed to authorize B2 key %s: %v", b.config.KeyID, err)
+    }
+    var auth b2Authorization
+    if err := json.Unmarshal(data, &auth); err != nil || auth.AuthorizationToken == "" || auth.APIURL == "" {
+        return fmt.Errorf("unexpected B2 authorization response: %s", data)
+    }
+    if auth.Allowed.BucketName != "" && auth.Allowed.BucketName != b.config.Bucket {
+        return fmt.Errorf("B2 key %s is restricted to bucket %s", b.config.KeyID, auth.Allowed.BucketName)
+    }
+
+    if b.bucketID == "" {
+        b.bucketID = auth.Allowed.BucketID
+    }
+    if b.bucketID == "" {
+        bucketID, err := b.lookupBucket(&auth)
+        if err != nil {
+            return err
+        }
+        b.bucketID = bucketID
+    }
+    b.auth = &auth
+    return nil
+}
+
+// lookupBucket finds the ID of the configured bucket, for keys not
+// restricted to it
+func (b *B2Storage) lookupBucket(auth *b2Authorization) (string, error) {
+    body, _ := json.Marshal(map[string]string{"accountId": auth.AccountID, "bucketName": b.config.Bucket})
+    var data []byte
+    err := sendWithRetry(b.client, b.config.Retry, func() (*http.Request, error) {
+        req, err := http.NewRequest(http.MethodPost, auth.APIURL+"/b2api/v2/b2_list_buckets", bytes.NewReader(body))
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Authorization", auth.AuthorizationToken)
+        return req, nil
+    }, func(resp *http.Response) {
+        data, _ = io.ReadAll(resp.Body)
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to look up B2 bucket %s: %v", b.config.Bucket, err)
+    }
+    var buckets struct {
+        Buckets []struct {
+            BucketID string `json:"bucketId"`
+        } `json:"buckets"`
+    }
+    if err := json.Unmarshal(data, &buckets); err != nil {
+        return "", fmt.Errorf("unexpected B2 bucket list: %s", data)
+    }
+    if len(buckets.Buckets) == 0 {
+        return "", fmt.Errorf("B2 bucket %s not found", b.config.Bucket)
+    }
+    return buckets.Buckets[0].BucketID, nil
+}
+
+// sha1Hex returns the hex SHA-1 of a section, which B2 checks every upload against
+func sha1Hex(body *io.SectionReader) (string, error) {
+    h := sha1.New()
+    if _, err := io.Copy(h, io.NewSectionReader(body, 0, body.Size())); err != nil {
+        return "", fmt.Errorf("failed to hash upload: %v", err)
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
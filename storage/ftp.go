@@ -0,0 +1,512 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "net"
+    "net/textproto"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+const (
+    // DefaultFTPPort is the port of FTP and explicit FTPS
+    DefaultFTPPort = "21"
+    // DefaultFTPSPort is the port of implicit FTPS
+    DefaultFTPSPort = "990"
+    // How long connecting and every reply may take
+    ftpTimeout = time.Minute
+)
+
+// FTPConfig holds the settings of an FTP server
+type FTPConfig struct {
+    Host     string
+    Port     string
+    Username string
+    Password string
+    // TLS secures the connections with AUTH TLS after connecting; with
+    // ImplicitTLS they are TLS from the start
+    TLS         bool
+    ImplicitTLS bool
+    // Directory the keys are stored below, relative to the login directory
+    // unless it starts with a slash
+    Dir   string
+    // How failed uploads are retried, retry.Default() if not set
+    Retry retry.Policy
+}
+
+// FTPStorage uploads artifacts to an FTP server, e.g. a Hetzner Storage
+// Box, keeping the layout of the keys as directories
+type FTPStorage struct {
+    config    FTPConfig
+    tlsConfig *tls.Config
+}
+
+// NewFTPStorage creates an uploader for the configured server
+func NewFTPStorage(config FTPConfig) (*FTPStorage, error) {
+    if config.Host == "" || config.Username == "" {
+        return nil, fmt.Errorf("FTP host and username are required")
+    }
+    if config.ImplicitTLS {
+        config.TLS = true
+    }
+    if config.Port == "" {
+        config.Port = DefaultFTPPort
+        if config.ImplicitTLS {
+            config.Port = DefaultFTPSPort
+        }
+    }
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+    return &FTPStorage{
+        config: config,
+        // Servers commonly require data connections to resume the TLS
+        // session of the control connection
+        tlsConfig: &tls.Config{ServerName: config.Host, ClientSessionCache: tls.NewLRUClientSessionCache(0)},
+    }, nil
+}
+
+// Location returns the URL of a key's file
+func (f *FTPStorage) Location(key string) string {
+    scheme := "ftp"
+    if f.config.TLS {
+        scheme = "ftps"
+    }
+    return fmt.Sprintf("%s://%s/%s", scheme, net.JoinHostPort(f.config.Host, f.config.Port),
+        strings.TrimPrefix(f.path(key), "/"))
+}
+
+// path returns the path of a key's file on the server
+func (f *FTPStorage) path(key string) string {
+    dir := strings.TrimRight(f.config.Dir, "/")
+    if dir == "" {
+        return key
+    }
+    return dir + "/" + key
+}
+
+// PutObject uploads a file and, if the metadata holds a checksum, its
+// checksum file and signature. The file is written under a temporary name and renamed
+// when complete, so an interrupted upload never looks like an archive.
+func (f *FTPStorage) PutObject(key, localPath string, metadata map[string]string) error {
+    file, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", localPath, err)
+    }
+    defer file.Close()
+
+    name := f.path(key)
+    err = f.config.Retry.Do(context.Background(), slog.Default(), "FTP upload", func() error {
+        if _, err := file.Seek(0, io.SeekStart); err != nil {
+            return retry.Permanent(err)
+        }
+        conn, err := f.connect()
+        if err != nil {
+            return err
+        }
+        defer conn.quit()
+
+        if err := conn.makeDirs(path.Dir(name)); err != nil {
+            return err
+        }
+        if err := conn.store(name+".part", file); err != nil {
+            return err
+        }
+        if err := conn.rename(name+".part", name); err != nil {
+            return err
+        }
+        if sum := checksumLine(key, metadata); sum != nil {
+            if err := conn.store(name+ChecksumSuffix, bytes.NewReader(sum)); err != nil {
+                return err
+            }
+        }
+        if signature := checksumSignature(metadata); signature != nil {
+            return conn.store(name+SignatureSuffix, bytes.NewReader(signature))
+        }
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to upload %s: %v", f.Location(key), err)
+    }
+    return nil
+}
+
+// DeleteObject removes a key's file, its checksum file and signature
+func (f *FTPStorage) DeleteObject(key string) error {
+    name := f.path(key)
+    err := f.config.Retry.Do(context.Background(), slog.Default(), "FTP delete", func() error {
+        conn, err := f.connect()
+        if err != nil {
+            return err
+        }
+        defer conn.quit()
+        for _, p := range []string{name, name + ChecksumSuffix, name + SignatureSuffix} {
+            if err := conn.delete(p); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to delete %s: %v", f.Location(key), err)
+    }
+    return nil
+}
+
+// GetObject downloads a key's file
+func (f *FTPStorage) GetObject(key, localPath string) error {
+    name := f.path(key)
+    err := f.config.Retry.Do(context.Background(), slog.Default(), "FTP download", func() error {
+        file, err := os.Create(localPath)
+        if err != nil {
+            return retry.Permanent(err)
+        }
+        defer file.Close()
+        conn, err := f.connect()
+        if err != nil {
+            return err
+        }
+        defer conn.quit()
+        return conn.retrieve(name, file)
+    })
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", f.Location(key), err)
+    }
+    return nil
+}
+
+// StatObject looks a key's file up by asking for its size; a file that
+// doesn't exist is refused with 550
+func (f *FTPStorage) StatObject(key string) (bool, error) {
+    name := f.path(key)
+    exists := false
+    err := f.config.Retry.Do(context.Background(), slog.Default(), "FTP lookup", func() error {
+        conn, err := f.connect()
+        if err != nil {
+            return err
+        }
+        defer conn.quit()
+        _, err = conn.cmd(213, "SIZE %s", name)
+        if replyCode(err) == 550 {
+            return nil
+        }
+        exists = err == nil
+        return err
+    })
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", f.Location(key), err)
+    }
+    return exists, nil
+}
+
+// ftpConn is a logged in control connection
+type ftpConn struct {
+    storage *FTPStorage
+    conn    net.Conn
+    text    *textproto.Conn
+    // Text of the last reply
+    message string
+}
+
+// ftpError is an unsuccessful reply
+type ftpError struct {
+    code    int
+    message string
+}
+
+func (e *ftpError) Error() string {
+    return fmt.Sprintf("%d %s", e.code, e.message)
+}
+
+// replyCode returns the code of an unsuccessful reply, or 0 if err is
+// another error
+func replyCode(err error) int {
+    var ftpErr *ftpError
+    if errors.As(err, &ftpErr) {
+        return ftpErr.code
+    }
+    return 0
+}
+
+// connect connects to the server, secures the connection as configured,
+// logs in and switches to binary transfers
+func (f *FTPStorage) connect() (*ftpConn, error) {
+    addr := net.JoinHostPort(f.config.Host, f.config.Port)
+    dialer := &net.Dialer{Timeout: ftpTimeout}
+    var conn net.Conn
+    var err error
+    if f.config.ImplicitTLS {
+        conn, err = tls.DialWithDialer(dialer, "tcp", addr, f.tlsConfig)
+    } else {
+        conn, err = dialer.Dial("tcp", addr)
+    }
+    if err != nil {
+        return nil, err
+    }
+    c := &ftpConn{storage: f, conn: conn, text: textproto.NewConn(conn)}
+    if _, err := c.reply(220); err != nil {
+        conn.Close()
+        return nil, err
+    }
+
+    if f.config.TLS && !f.config.ImplicitTLS {
+        if _, err := c.cmd(234, "AUTH TLS"); err != nil {
+            c.conn.Close()
+            return nil, fmt.Errorf("%s doesn't support AUTH TLS, set ftp tls to implicit or none: %v", f.config.Host, err)
+        }
+        c.conn = tls.Client(conn, f.tlsConfig)
+        c.text = textproto.NewConn(c.conn)
+    }
+
+    code, err := c.cmd(0, "USER %s", f.config.Username)
+    if err == nil && code == 331 {
+        _, err = c.cmd(230, "PASS %s", f.config.Password)
+    } else if err == nil && code != 230 {
+        err = fmt.Errorf("unexpected reply %d to USER", code)
+    }
+    if err != nil {
+        c.conn.Close()
+        return nil, fmt.Errorf("FTP login as %s failed: %v", f.config.Username, err)
+    }
+
+    commands := []string{"TYPE I"}
+    if f.config.TLS {
+        // Data connections are encrypted as well
+        commands = append([]string{"PBSZ 0", "PROT P"}, commands...)
+    }
+    for _, command := range commands {
+        if _, err := c.cmd(200, "%s", command); err != nil {
+            c.conn.Close()
+            return nil, err
+        }
+    }
+    return c, nil
+}
+
+// reply reads a reply, failing unless its code is expect, or any final
+// code if expect is 0. Replies in the 4xx range are transient.
+func (c *ftpConn) reply(expect int) (int, error) {
+    c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+    code, message, err := c.text.ReadResponse(0)
+    if err != nil {
+        return 0, err
+    }
+    c.message = message
+    if code >= 400 || (expect != 0 && code != expect) {
+        err := &ftpError{code: code, message: message}
+        if code >= 400 && code < 500 {
+            return code, retry.Transient(err)
+        }
+        return code, err
+    }
+    return code, nil
+}
+
+// cmd sends a command and reads its reply
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, error) {
+    c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+    if err := c.text.PrintfLine(format, args...); err != nil {
+        return 0, err
+    }
+    return c.reply(expect)
+}
+
+// makeDirs creates a directory and its parents. Directories that exist
+// are refused by the server, which is ignored; a missing one makes the
+// upload into it fail instead.
+func (c *ftpConn) makeDirs(dir string) error {
+    if dir == "." || dir == "/" {
+        return nil
+    }
+    var current string
+    for i, part := range strings.Split(dir, "/") {
+        if part == "" && i == 0 {
+            current = "/"
+            continue
+        }
+        current = path.Join(current, part)
+        if _, err := c.cmd(257, "MKD %s", current); err != nil && replyCode(err) < 500 {
+            return err
+        }
+    }
+    return nil
+}
+
+// store uploads the content of r as a file
+func (c *ftpConn) store(name string, r io.Reader) error {
+    data, err := c.dataConn()
+    if err != nil {
+        return err
+    }
+    if code, err := c.cmd(0, "STOR %s", name); err != nil {
+        data.Close()
+        return err
+    } else if code != 125 && code != 150 {
+        data.Close()
+        return fmt.Errorf("unexpected reply %d to STOR", code)
+    }
+    if tlsConn, ok := data.(*tls.Conn); ok {
+        // Without data to send, e.g. for an empty file, the handshake
+        // would not happen otherwise
+        err = tlsConn.Handshake()
+    }
+    if err == nil {
+        _, err = io.Copy(deadlineWriter{data}, r)
+    }
+    if closeErr := data.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        c.reply(0)
+        return retry.Transient(fmt.Errorf("failed to send %s: %v", name, err))
+    }
+    if code, err := c.reply(0); err != nil {
+        return err
+    } else if code != 226 && code != 250 {
+        return fmt.Errorf("unexpected reply %d after sending %s", code, name)
+    }
+    return nil
+}
+
+// retrieve downloads a file into w
+func (c *ftpConn) retrieve(name string, w io.Writer) error {
+    data, err := c.dataConn()
+    if err != nil {
+        return err
+    }
+    if code, err := c.cmd(0, "RETR %s", name); err != nil {
+        data.Close()
+        return err
+    } else if code != 125 && code != 150 {
+        data.Close()
+        return fmt.Errorf("unexpected reply %d to RETR", code)
+    }
+    _, err = io.Copy(w, deadlineReader{data})
+    if closeErr := data.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        c.reply(0)
+        return retry.Transient(fmt.Errorf("failed to receive %s: %v", name, err))
+    }
+    if code, err := c.reply(0); err != nil {
+        return err
+    } else if code != 226 && code != 250 {
+        return fmt.Errorf("unexpected reply %d after receiving %s", code, name)
+    }
+    return nil
+}
+
+// rename replaces a file with another one
+func (c *ftpConn) rename(from, to string) error {
+    if _, err := c.cmd(350, "RNFR %s", from); err != nil {
+        return err
+    }
+    _, err := c.cmd(250, "RNTO %s", to)
+    return err
+}
+
+// delete removes a file; a file that doesn't exist is ignored
+func (c *ftpConn) delete(name string) error {
+    // 550 is also the reply to a missing file
+    if _, err := c.cmd(250, "DELE %s", name); err != nil && replyCode(err) != 550 {
+        return err
+    }
+    return nil
+}
+
+// dataConn opens a passive data connection, trying EPSV before PASV. The
+// address in the PASV reply is ignored in favour of the control
+// connection's, as servers behind NAT often announce a private one.
+func (c *ftpConn) dataConn() (net.Conn, error) {
+    var port int
+    code, err := c.cmd(0, "EPSV")
+    if err == nil && code == 229 {
+        port, err = epsvPort(c.message)
+    } else {
+        if _, err = c.cmd(227, "PASV"); err == nil {
+            port, err = pasvPort(c.message)
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), ftpTimeout)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(ftpTimeout))
+    if c.storage.config.TLS {
+        return tls.Client(conn, c.storage.tlsConfig), nil
+    }
+    return conn, nil
+}
+
+// quit ends the session and closes the connection
+func (c *ftpConn) quit() {
+    c.cmd(0, "QUIT")
+    c.conn.Close()
+}
+
+// epsvPort reads the port of the data connection from an EPSV reply such
+// as "Entering Extended Passive Mode (|||6446|)"
+func epsvPort(message string) (int, error) {
+    start, end := strings.Index(message, "(|||"), strings.LastIndex(message, "|)")
+    if start < 0 || end < start+4 {
+        return 0, fmt.Errorf("unexpected EPSV reply: %s", message)
+    }
+    return strconv.Atoi(message[start+4 : end])
+}
+
+// pasvPort reads the port of the data connection from a PASV reply such
+// as "Entering Passive Mode (192,168,1,2,25,46)"
+func pasvPort(message string) (int, error) {
+    start, end := strings.Index(message, "("), strings.LastIndex(message, ")")
+    if start < 0 || end < start {
+        return 0, fmt.Errorf("unexpected PASV reply: %s", message)
+    }
+    fields := strings.Split(message[start+1:end], ",")
+    if len(fields) != 6 {
+        return 0, fmt.Errorf("unexpected PASV reply: %s", message)
+    }
+    high, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+    low, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+    if err1 != nil || err2 != nil {
+        return 0, fmt.Errorf("unexpected PASV reply: %s", message)
+    }
+    return high<<8 | low, nil
+}
+
+// deadlineWriter moves the deadline of a data connection on with every
+// write, so large files don't time out while data flows
+type deadlineWriter struct {
+    conn net.Conn
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+    w.conn.SetDeadline(time.Now().Add(ftpTimeout))
+    return w.conn.Write(p)
+}
+
+// deadlineReader moves the deadline of a data connection on with every
+// read, like deadlineWriter
+type deadlineReader struct {
+    conn net.Conn
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+    r.conn.SetDeadline(time.Now().Add(ftpTimeout))
+    return r.conn.Read(p)
+}
@@ -0,0 +1,384 @@
+package storage
+
+import (
+    "bytes"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+const (
+    // DefaultGCSChunkSize is the size of the chunks of a resumable upload
+    DefaultGCSChunkSize = 16 << 20
+    // Chunks of a resumable upload must be multiples of this, except the last one
+    gcsChunkUnit = 256 << 10
+    // Scope of the access tokens used for uploads
+    gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+    // Token endpoint of the metadata server of Compute Engine, GKE and Cloud Run
+    gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// GCSConfig holds the settings of a Google Cloud Storage bucket
+type GCSConfig struct {
+    Bucket string
+    // Prepended to every object name
+    Prefix string
+    // Service account key file (JSON). Without one, the service account of
+    // the instance is used through the metadata server.
+    CredentialsFile string
+    // Files are uploaded in chunks of this size
+    ChunkSize int64
+    // Storage class of uploaded objects, e.g. ARCHIVE; the bucket's default if not set
+    StorageClass string
+    // API endpoint, https://storage.googleapis.com unless testing
+    Endpoint string
+    // How failed requests are retried, retry.Default() if not set
+    Retry retry.Policy
+}
+
+// GCSStorage uploads artifacts to a Google Cloud Storage bucket with the
+// JSON API's resumable uploads
+type GCSStorage struct {
+    config GCSConfig
+    client *http.Client
+    tokens *tokenSource
+}
+
+// serviceAccountKey is the part of a service account key file used to sign token requests
+type serviceAccountKey struct {
+    Type        string `json:"type"`
+    ClientEmail string `json:"client_email"`
+    PrivateKey  string `json:"private_key"`
+    TokenURI    string `json:"token_uri"`
+}
+
+// NewGCSStorage creates an uploader for the configured bucket
+func NewGCSStorage(config GCSConfig) (*GCSStorage, error) {
+    if config.Bucket == "" {
+        return nil, fmt.Errorf("GCS bucket is not set")
+    }
+    if config.ChunkSize == 0 {
+        config.ChunkSize = DefaultGCSChunkSize
+    }
+    if config.ChunkSize%gcsChunkUnit != 0 {
+        return nil, fmt.Errorf("GCS chunk size must be a multiple of %d bytes", gcsChunkUnit)
+    }
+    if config.Endpoint == "" {
+        config.Endpoint = "https://storage.googleapis.com"
+    }
+    config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+
+    g := &GCSStorage{
+        config: config,
+        client: &http.Client{Timeout: 30 * time.Minute},
+    }
+    g.tokens = &tokenSource{client: g.client, policy: config.Retry, fetch: metadataToken}
+    if config.CredentialsFile != "" {
+        key, err := readServiceAccountKey(config.CredentialsFile)
+        if err != nil {
+            return nil, err
+        }
+        g.tokens.fetch = key.tokenRequest
+    }
+    return g, nil
+}
+
+// readServiceAccountKey reads and checks a service account key file
+func readServiceAccountKey(path string) (*serviceAccountKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read GCS credentials: %v", err)
+    }
+    var key serviceAccountKey
+    if err := json.Unmarshal(data, &key); err != nil {
+        return nil, fmt.Errorf("invalid GCS credentials %s: %v", path, err)
+    }
+    if key.Type != "service_account" || key.ClientEmail == "" || key.PrivateKey == "" {
+        return nil, fmt.Errorf("%s is not a service account key", path)
+    }
+    if key.TokenURI == "" {
+        key.TokenURI = "https://oauth2.googleapis.com/token"
+    }
+    return &key, nil
+}
+
+// metadataToken requests a token of the instance's service account from the metadata server
+func metadataToken() (*http.Request, error) {
+    req, err := http.NewRequest(http.MethodGet, gcsMetadataTokenURL+"?scopes="+url.QueryEscape(gcsScope), nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Metadata-Flavor", "Google")
+    return req, nil
+}
+
+// tokenRequest exchanges a JWT signed with the service account's key for an access token
+func (k *serviceAccountKey) tokenRequest() (*http.Request, error) {
+    block, _ := pem.Decode([]byte(k.PrivateKey))
+    if block == nil {
+        return nil, fmt.Errorf("invalid private key of %s", k.ClientEmail)
+    }
+    parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("invalid private key of %s: %v", k.ClientEmail, err)
+    }
+    privateKey, ok := parsed.(*rsa.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("private key of %s is not an RSA key", k.ClientEmail)
+    }
+
+    now := time.Now().Unix()
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+    claims, _ := json.Marshal(map[string]interface{}{
+        "iss":   k.ClientEmail,
+        "scope": gcsScope,
+        "aud":   k.TokenURI,
+        "iat":   now,
+        "exp":   now + 3600,
+    })
+    unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+    digest := sha256.Sum256([]byte(unsigned))
+    signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+    if err != nil {
+        return nil, fmt.Errorf("failed to sign token request: %v", err)
+    }
+
+    form := url.Values{
+        "grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+        "assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+    }
+    req, err := http.NewRequest(http.MethodPost, k.TokenURI, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    return req, nil
+}
+
+// Location returns the gs:// URL of a key
+func (g *GCSStorage) Location(key string) string {
+    return fmt.Sprintf("gs://%s/%s", g.config.Bucket, prefixedKey(g.config.Prefix, key))
+}
+
+// PutObject uploads a file in a resumable upload session. A chunk that fails
+// is retried from the offset the session confirms, so an interrupted
+// transfer doesn't start over.
+func (g *GCSStorage) PutObject(key, localPath string, metadata map[string]string) error {
+    file, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", localPath, err)
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat %s: %v", localPath, err)
+    }
+
+    name := prefixedKey(g.config.Prefix, key)
+    session, err := g.startUpload(name, info.Size(), metadata)
+    if err != nil {
+        return fmt.Errorf("failed to start upload of %s: %v", name, err)
+    }
+    if err := g.upload(session, file, info.Size()); err != nil {
+        // Cancel the session so it doesn't linger until it expires
+        if req, reqErr := http.NewRequest(http.MethodDelete, session, nil); reqErr == nil {
+            if resp, doErr := g.client.Do(req); doErr == nil {
+                resp.Body.Close()
+            }
+        }
+        return fmt.Errorf("failed to upload %s: %v", name, err)
+    }
+    return nil
+}
+
+// GetObject downloads an object. Objects of every storage class, even
+// ARCHIVE, can be read right away.
+func (g *GCSStorage) GetObject(key, localPath string) error {
+    name := prefixedKey(g.config.Prefix, key)
+    target := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media",
+        g.config.Endpoint, url.PathEscape(g.config.Bucket), url.PathEscape(name))
+    var saveErr error
+    err := sendWithRetry(g.client, g.config.Retry, func() (*http.Request, error) {
+        return g.newRequest(http.MethodGet, target, nil)
+    }, saveTo(localPath, &saveErr))
+    if err == nil {
+        err = saveErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", name, err)
+    }
+    return nil
+}
+
+// StatObject looks an object up by reading its metadata
+func (g *GCSStorage) StatObject(key string) (bool, error) {
+    name := prefixedKey(g.config.Prefix, key)
+    target := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?fields=name",
+        g.config.Endpoint, url.PathEscape(g.config.Bucket), url.PathEscape(name))
+    err := sendWithRetry(g.client, g.config.Retry, func() (*http.Request, error) {
+        return g.newRequest(http.MethodGet, target, nil)
+    }, func(*http.Response) {})
+    if hasStatus(err, http.StatusNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", name, err)
+    }
+    return true, nil
+}
+
+// startUpload opens a resumable upload session and returns its URL
+func (g *GCSStorage) startUpload(name string, size int64, metadata map[string]string) (string, error) {
+    object := map[string]interface{}{"name": name, "metadata": metadata}
+    if g.config.StorageClass != "" {
+        object["storageClass"] = g.config.StorageClass
+    }
+    body, err := json.Marshal(object)
+    if err != nil {
+        return "", err
+    }
+    target := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s",
+        g.config.Endpoint, url.PathEscape(g.config.Bucket), url.QueryEscape(name))
+
+    var session string
+    err = sendWithRetry(g.client, g.config.Retry, func() (*http.Request, error) {
+        req, err := g.newRequest(http.MethodPost, target, bytes.NewReader(body))
+        if err != nil {
+            return nil, err
+        }
+        req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+        req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+        return req, nil
+    }, func(resp *http.Response) {
+        session = resp.Header.Get("Location")
+    })
+    if err == nil && session == "" {
+        err = fmt.Errorf("no session URL in response")
+    }
+    return session, err
+}
+
+// upload sends a file to an upload session chunk by chunk. After a failed
+// chunk, the session is asked how much it received and the upload continues
+// from there; it fails after the attempts of the retry policy failed in a row.
+func (g *GCSStorage) upload(session string, file *os.File, size int64) error {
+    offset, failures := int64(0), 0
+    for {
+        end := offset + g.config.ChunkSize
+        if end > size {
+            end = size
+        }
+        next, done, err := g.putChunk(session, io.NewSectionReader(file, offset, end-offset), offset, end, size)
+        if err == nil && done {
+            return nil
+        }
+        if err == nil && next > offset {
+            offset, failures = next, 0
+            continue
+        }
+        if err == nil {
+            err = fmt.Errorf("no data received at offset %d", offset)
+        }
+
+        failures++
+        if status, ok := err.(*statusError); (ok && !retryable(status.status)) || failures >= g.config.Retry.Attempts {
+            return err
+        }
+        time.Sleep(g.config.Retry.Delay(failures))
+        if offset, done, err = g.uploadStatus(session, size); err != nil {
+            return err
+        }
+        if done {
+            return nil
+        }
+    }
+}
+
+// putChunk sends the bytes from offset to end of size. It returns the offset
+// the session has received up to and whether the upload is complete.
+func (g *GCSStorage) putChunk(session string, body io.Reader, offset, end, size int64) (int64, bool, error) {
+    req, err := g.newRequest(http.MethodPut, session, body)
+    if err != nil {
+        return 0, false, err
+    }
+    req.ContentLength = end - offset
+    if size == 0 {
+        req.Body = http.NoBody
+        req.Header.Set("Content-Range", "bytes */0")
+    } else {
+        req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, end-1, size))
+    }
+    return g.sessionResponse(req)
+}
+
+// uploadStatus asks a session how much of the file it has received
+func (g *GCSStorage) uploadStatus(session string, size int64) (int64, bool, error) {
+    req, err := g.newRequest(http.MethodPut, session, nil)
+    if err != nil {
+        return 0, false, err
+    }
+    req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+    offset, done, err := g.sessionResponse(req)
+    if err != nil {
+        return 0, false, fmt.Errorf("failed to query upload status: %v", err)
+    }
+    return offset, done, nil
+}
+
+// sessionResponse sends a request to an upload session. 308 means the
+// session expects more data, its Range header tells how much it has.
+func (g *GCSStorage) sessionResponse(req *http.Request) (int64, bool, error) {
+    resp, err := g.client.Do(req)
+    if err != nil {
+        return 0, false, err
+    }
+    defer resp.Body.Close()
+    switch {
+    case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+        return 0, true, nil
+    case resp.StatusCode == http.StatusPermanentRedirect:
+        received := resp.Header.Get("Range")
+        if received == "" {
+            return 0, false, nil
+        }
+        last, err := strconv.ParseInt(received[strings.LastIndex(received, "-")+1:], 10, 64)
+        if err != nil {
+            return 0, false, fmt.Errorf("unexpected range %q", received)
+        }
+        return last + 1, false, nil
+    default:
+        return 0, false, responseError(resp)
+    }
+}
+
+// newRequest builds a request authorized with an access token
+func (g *GCSStorage) newRequest(method, target string, body io.Reader) (*http.Request, error) {
+    token, err := g.tokens.Token()
+    if err != nil {
+        return nil, err
+    }
+    req, err := http.NewRequest(method, target, body)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    return req, nil
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+// sendWithRetry sends the request built by newRequest, retrying network
+// errors, server errors and throttling as policy says, and passes a
+// successful response to handle. newRequest is called for every attempt, so
+// it must rewind the body.
+func sendWithRetry(client *http.Client, policy retry.Policy, newRequest func() (*http.Request, error), handle func(*http.Response)) error {
+    var lastErr error
+    for attempt := 1; attempt <= policy.Attempts || attempt == 1; attempt++ {
+        if attempt > 1 {
+            time.Sleep(policy.Delay(attempt - 1))
+        }
+        req, err := newRequest()
+        if err != nil {
+            return err
+        }
+        resp, err := client.Do(req)
+        if err != nil {
+            lastErr = err
+            continue
+        }
+        if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+            handle(resp)
+            resp.Body.Close()
+            return nil
+        }
+        lastErr = responseError(resp)
+        resp.Body.Close()
+        if !retryable(resp.StatusCode) {
+            break
+        }
+    }
+    return lastErr
+}
+
+// saveTo returns a response handler writing the body to localPath. Handlers
+// can't fail, so an error writing the file is stored in failed.
+func saveTo(localPath string, failed *error) func(*http.Response) {
+    return func(resp *http.Response) {
+        file, err := os.Create(localPath)
+        if err != nil {
+            *failed = err
+            return
+        }
+        _, err = io.Copy(file, resp.Body)
+        if closeErr := file.Close(); err == nil {
+            err = closeErr
+        }
+        if err != nil {
+            *failed = fmt.Errorf("failed to write %s: %v", localPath, err)
+        }
+    }
+}
+
+// retryable reports whether a failed request may succeed when repeated.
+// Client errors such as denied access won't go away by retrying.
+func retryable(status int) bool {
+    return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+// statusError is an unsuccessful response
+type statusError struct {
+    status  int
+    message string
+}
+
+func (e *statusError) Error() string {
+    return e.message
+}
+
+// responseError describes an unsuccessful response by its status and the
+// beginning of its body
+func responseError(resp *http.Response) error {
+    message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+    return &statusError{
+        status:  resp.StatusCode,
+        message: fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(message))),
+    }
+}
+
+// hasStatus reports whether err is an unsuccessful response with the given status
+func hasStatus(err error, status int) bool {
+    se, ok := err.(*statusError)
+    return ok && se.status == status
+}
+
+// tokenSource caches an OAuth 2.0 access token until shortly before it expires
+type tokenSource struct {
+    client *http.Client
+    policy retry.Policy
+    // fetch requests a new token
+    fetch   func() (*http.Request, error)
+    mu      sync.Mutex
+    token   string
+    expires time.Time
+}
+
+// tokenResponse is the answer of a token endpoint. Azure's instance
+// metadata service sends expires_in as a string.
+type tokenResponse struct {
+    AccessToken string      `json:"access_token"`
+    ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// Token returns a valid access token, fetching a new one if needed
+func (t *tokenSource) Token() (string, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.token != "" && time.Now().Before(t.expires) {
+        return t.token, nil
+    }
+
+    var body []byte
+    err := sendWithRetry(t.client, t.policy, t.fetch, func(resp *http.Response) {
+        body, _ = io.ReadAll(resp.Body)
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to get access token: %v", err)
+    }
+    var token tokenResponse
+    if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+        return "", fmt.Errorf("unexpected token response: %s", body)
+    }
+    lifetime, _ := strconv.Atoi(token.ExpiresIn.String())
+    if lifetime <= 0 {
+        lifetime = 300
+    }
+    // Renew a minute early so a token doesn't expire during a request
+    t.token = token.AccessToken
+    t.expires = time.Now().Add(time.Duration(lifetime)*time.Second - time.Minute)
+    return t.token, nil
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os/exec"
+    "strings"
+    "laravel-backup-tool/retry"
+)
+
+// Exit codes of rclone
+const (
+    rcloneUsageError  = 1
+    rcloneDirNotFound = 3
+    rcloneNotFound    = 4
+    rcloneRetryError  = 5
+    rcloneFatalError  = 7
+)
+
+// RcloneConfig holds the settings of an rclone remote
+type RcloneConfig struct {
+    // Remote and path the keys are stored below, e.g. "gdrive:backups/web01"
+    Remote string
+    // rclone executable, "rclone" from PATH if not set
+    Binary string
+    // rclone configuration file, rclone's default if not set
+    ConfigFile string
+    // Extra options passed to every rclone command, e.g. "--bwlimit=10M"
+    Flags []string
+    // How failed commands are retried, retry.Default() if not set
+    Retry retry.Policy
+}
+
+// RcloneStorage uploads artifacts to any remote rclone supports by running
+// rclone, keeping the layout of the keys as directories
+type RcloneStorage struct {
+    config RcloneConfig
+}
+
+// NewRcloneStorage creates an uploader for the configured remote
+func NewRcloneStorage(config RcloneConfig) (*RcloneStorage, error) {
+    if !strings.Contains(config.Remote, ":") {
+        return nil, fmt.Errorf("invalid rclone remote %q, use name:path", config.Remote)
+    }
+    if config.Binary == "" {
+        config.Binary = "rclone"
+    }
+    if _, err := exec.LookPath(config.Binary); err != nil {
+        return nil, fmt.Errorf("rclone not found: %v", err)
+    }
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+    return &RcloneStorage{config: config}, nil
+}
+
+// Location returns the rclone path of a key
+func (r *RcloneStorage) Location(key string) string {
+    if strings.HasSuffix(r.config.Remote, ":") || strings.HasSuffix(r.config.Remote, "/") {
+        return r.config.Remote + key
+    }
+    return r.config.Remote + "/" + key
+}
+
+// PutObject copies a file to the remote and, if the metadata holds a
+// checksum, writes its checksum file and signature next to it
+func (r *RcloneStorage) PutObject(key, localPath string, metadata map[string]string) error {
+    target := r.Location(key)
+    err := r.config.Retry.Do(context.Background(), slog.Default(), "rclone upload", func() error {
+        if err := r.run(nil, "copyto", localPath, target); err != nil {
+            return err
+        }
+        if sum := checksumLine(key, metadata); sum != nil {
+            if err := r.run(bytes.NewReader(sum), "rcat", target+ChecksumSuffix); err != nil {
+                return err
+            }
+        }
+        if signature := checksumSignature(metadata); signature != nil {
+            return r.run(bytes.NewReader(signature), "rcat", target+SignatureSuffix)
+        }
+        return nil
+    })
+    if err != nil {
+        return fmt.Errorf("failed to upload %s: %v", target, err)
+    }
+    return nil
+}
+
+// DeleteObject removes a key's file, its checksum file and signature;
+// files that don't exist are ignored
+func (r *RcloneStorage) DeleteObject(key string) error {
+    for _, name := range []string{key, key + ChecksumSuffix, key + SignatureSuffix} {
+        target := r.Location(name)
+        err := r.config.Retry.Do(context.Background(), slog.Default(), "rclone delete", func() error {
+            return r.run(nil, "deletefile", target)
+        })
+        var exitErr *exec.ExitError
+        if errors.As(err, &exitErr) && (exitErr.ExitCode() == rcloneNotFound || exitErr.ExitCode() == rcloneDirNotFound) {
+            continue
+        }
+        if err != nil {
+            return fmt.Errorf("failed to delete %s: %v", target, err)
+        }
+    }
+    return nil
+}
+
+// GetObject copies a key's file from the remote
+func (r *RcloneStorage) GetObject(key, localPath string) error {
+    source := r.Location(key)
+    err := r.config.Retry.Do(context.Background(), slog.Default(), "rclone download", func() error {
+        return r.run(nil, "copyto", source, localPath)
+    })
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", source, err)
+    }
+    return nil
+}
+
+// StatObject looks a key's file up by listing it. A file that doesn't exist
+// lists nothing, or fails as not found on remotes with real directories.
+func (r *RcloneStorage) StatObject(key string) (bool, error) {
+    target := r.Location(key)
+    var listing []byte
+    err := r.config.Retry.Do(context.Background(), slog.Default(), "rclone lookup", func() error {
+        var err error
+        listing, err = r.output(nil, "lsf", "--files-only", target)
+        return err
+    })
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) && (exitErr.ExitCode() == rcloneNotFound || exitErr.ExitCode() == rcloneDirNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", target, err)
+    }
+    return strings.TrimSpace(string(listing)) != "", nil
+}
+
+// rcloneError is a failed rclone command with what it printed
+type rcloneError struct {
+    err    *exec.ExitError
+    output string
+}
+
+func (e *rcloneError) Error() string {
+    return fmt.Sprintf("%v: %s", e.err, e.output)
+}
+
+func (e *rcloneError) Unwrap() error {
+    return e.err
+}
+
+// run runs an rclone command with the configured options. rclone retries
+// on its own, so only failures it marks as temporary are retried again;
+// usage and fatal errors never are.
+func (r *RcloneStorage) run(stdin io.Reader, args ...string) error {
+    _, err := r.output(stdin, args...)
+    return err
+}
+
+// output runs an rclone command like run and returns its standard output
+func (r *RcloneStorage) output(stdin io.Reader, args ...string) ([]byte, error) {
+    var full []string
+    if r.config.ConfigFile != "" {
+        full = append(full, "--config", r.config.ConfigFile)
+    }
+    full = append(full, r.config.Flags...)
+    full = append(full, args...)
+    cmd := exec.Command(r.config.Binary, full...)
+    cmd.Stdin = stdin
+    // The error rclone prints goes to stderr, after what it logged
+    var stdout, combined bytes.Buffer
+    cmd.Stdout = io.MultiWriter(&stdout, &combined)
+    cmd.Stderr = &combined
+    err := cmd.Run()
+    if err == nil {
+        return stdout.Bytes(), nil
+    }
+    var exitErr *exec.ExitError
+    if !errors.As(err, &exitErr) {
+        return nil, retry.Permanent(err)
+    }
+    err = &rcloneError{err: exitErr, output: lastLine(combined.Bytes())}
+    switch exitErr.ExitCode() {
+    case rcloneRetryError:
+        return nil, retry.Transient(err)
+    case rcloneUsageError, rcloneFatalError, rcloneNotFound, rcloneDirNotFound:
+        return nil, retry.Permanent(err)
+    }
+    return nil, err
+}
+
+// lastLine returns the last non-empty line of a command's output, where
+// rclone prints the error that made it fail
+func lastLine(output []byte) string {
+    lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+    return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,442 @@
+package storage
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/md5"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+const (
+    // DefaultPartSize is the size of the parts of a multipart upload
+    DefaultPartSize = 64 << 20
+    // Smallest part S3 accepts, except for the last one
+    minPartSize = 5 << 20
+    // Most parts a multipart upload may have
+    maxParts = 10000
+)
+
+// S3Config holds the settings of an S3-compatible bucket
+type S3Config struct {
+    // Endpoint URL such as https://s3.eu-central-1.amazonaws.com or a MinIO
+    // server; defaults to the AWS endpoint of the region
+    Endpoint  string
+    Bucket    string
+    Region    string
+    AccessKey string
+    SecretKey string
+    // Address the bucket as part of the path instead of the host name, as
+    // most self-hosted S3-compatible servers require
+    PathStyle bool
+    // Prepended to every key, e.g. to separate servers sharing a bucket
+    Prefix    string
+    // Files larger than this are uploaded in parts of this size
+    PartSize  int64
+    // Storage class of uploaded objects, e.g. GLACIER; the bucket's default if not set
+    StorageClass string
+    // Object lock of uploaded objects for LockDays days from the upload, in
+    // governance or compliance mode; the bucket must have Object Lock
+    // enabled. No lock if LockDays is zero.
+    LockMode string
+    LockDays int
+    // How failed requests are retried, retry.Default() if not set
+    Retry     retry.Policy
+}
+
+// S3Storage uploads artifacts to an S3-compatible bucket. Requests are signed
+// with AWS Signature Version 4.
+type S3Storage struct {
+    config   S3Config
+    endpoint *url.URL
+    client   *http.Client
+}
+
+// NewS3Storage creates an uploader for the configured bucket
+func NewS3Storage(config S3Config) (*S3Storage, error) {
+    if config.Bucket == "" {
+        return nil, fmt.Errorf("S3 bucket is not set")
+    }
+    if config.AccessKey == "" || config.SecretKey == "" {
+        return nil, fmt.Errorf("S3 access key and secret key are required")
+    }
+    if config.Region == "" {
+        config.Region = "us-east-1"
+    }
+    if config.Endpoint == "" {
+        config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+    }
+    if config.PartSize == 0 {
+        config.PartSize = DefaultPartSize
+    }
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+    if config.PartSize < minPartSize {
+        return nil, fmt.Errorf("S3 part size must be at least %d bytes", minPartSize)
+    }
+
+    endpoint, err := url.Parse(strings.TrimRight(config.Endpoint, "/"))
+    if err != nil || endpoint.Host == "" {
+        return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+    }
+
+    return &S3Storage{
+        config:   config,
+        endpoint: endpoint,
+        client:   &http.Client{Timeout: 30 * time.Minute},
+    }, nil
+}
+
+// Location returns the s3:// URL of a key
+func (s *S3Storage) Location(key string) string {
+    return fmt.Sprintf("s3://%s/%s", s.config.Bucket, s.fullKey(key))
+}
+
+// PutObject uploads a file, in parts if it is larger than the part size
+func (s *S3Storage) PutObject(key, localPath string, metadata map[string]string) error {
+    file, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", localPath, err)
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat %s: %v", localPath, err)
+    }
+
+    key = s.fullKey(key)
+    headers := make(map[string]string)
+    for name, value := range metadata {
+        headers["x-amz-meta-"+strings.ToLower(name)] = value
+    }
+    if s.config.StorageClass != "" {
+        headers["x-amz-storage-class"] = s.config.StorageClass
+    }
+    if s.config.LockDays > 0 {
+        headers["x-amz-object-lock-mode"] = strings.ToUpper(s.config.LockMode)
+        headers["x-amz-object-lock-retain-until-date"] = time.Now().UTC().AddDate(0, 0, s.config.LockDays).Format(time.RFC3339)
+    }
+
+    if info.Size() <= s.config.PartSize {
+        _, err := s.request(http.MethodPut, key, nil, io.NewSectionReader(file, 0, info.Size()), headers)
+        if err != nil {
+            return fmt.Errorf("failed to upload %s: %v", key, err)
+        }
+        return nil
+    }
+    return s.putMultipart(key, file, info.Size(), headers)
+}
+
+// GetObject downloads an object. An object in the Glacier or Deep Archive
+// storage class can't be read; a restore of it is requested instead.
+func (s *S3Storage) GetObject(key, localPath string) error {
+    key = s.fullKey(key)
+    var saveErr error
+    err := s.send(http.MethodGet, key, nil, nil, nil, saveTo(localPath, &saveErr))
+    if hasStatus(err, http.StatusForbidden) && strings.Contains(err.Error(), "InvalidObjectState") {
+        return s.restore(key)
+    }
+    if err == nil {
+        err = saveErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", key, err)
+    }
+    return nil
+}
+
+// StatObject looks an object up with a HEAD request
+func (s *S3Storage) StatObject(key string) (bool, error) {
+    key = s.fullKey(key)
+    err := s.send(http.MethodHead, key, nil, nil, nil, func(*http.Response) {})
+    if hasStatus(err, http.StatusNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", key, err)
+    }
+    return true, nil
+}
+
+// restore requests a temporary copy of an archived object, readable for a
+// week, and returns ErrRestoring. A restore in progress is answered with 409.
+func (s *S3Storage) restore(key string) error {
+    body := []byte("<RestoreRequest><Days>7</Days><GlacierJobParameters><Tier>Standard</Tier></GlacierJobParameters></RestoreRequest>")
+    _, err := s.request(http.MethodPost, key, url.Values{"restore": {""}}, bytes.NewReader(body), nil)
+    if err != nil && !hasStatus(err, http.StatusConflict) {
+        return fmt.Errorf("failed to request restore of %s: %v", key, err)
+    }
+    return fmt.Errorf("%s: %w", key, ErrRestoring)
+}
+
+// putMultipart uploads a large file part by part. An upload that fails is
+// aborted so the bucket isn't charged for its orphaned parts.
+func (s *S3Storage) putMultipart(key string, file *os.File, size int64, headers map[string]string) error {
+    partSize := s.config.PartSize
+    for size/partSize >= maxParts {
+        partSize *= 2
+    }
+
+    resp, err := s.request(http.MethodPost, key, url.Values{"uploads": {""}}, nil, headers)
+    if err != nil {
+        return fmt.Errorf("failed to start multipart upload of %s: %v", key, err)
+    }
+    var initiated struct {
+        UploadID string `xml:"UploadId"`
+    }
+    if err := xml.Unmarshal(resp, &initiated); err != nil || initiated.UploadID == "" {
+        return fmt.Errorf("unexpected response starting multipart upload of %s: %s", key, resp)
+    }
+    uploadID := initiated.UploadID
+
+    type completedPart struct {
+        PartNumber int
+        ETag       string
+    }
+    var parts []completedPart
+    abort := func(cause error) error {
+        if _, err := s.request(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err != nil {
+            return fmt.Errorf("%v (aborting the upload failed too: %v)", cause, err)
+        }
+        return cause
+    }
+
+    for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+        length := partSize
+        if offset+length > size {
+            length = size - offset
+        }
+        query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+        etag, err := s.uploadPart(key, query, io.NewSectionReader(file, offset, length))
+        if err != nil {
+            return abort(fmt.Errorf("failed to upload part %d of %s: %v", number, key, err))
+        }
+        parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+    }
+
+    complete := struct {
+        XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+        Parts   []completedPart `xml:"Part"`
+    }{Parts: parts}
+    body, err := xml.Marshal(complete)
+    if err != nil {
+        return abort(fmt.Errorf("failed to encode part list: %v", err))
+    }
+    resp, err = s.request(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), nil)
+    if err != nil {
+        return abort(fmt.Errorf("failed to complete multipart upload of %s: %v", key, err))
+    }
+    // Completion can fail after the server has answered 200
+    if bytes.Contains(resp, []byte("<Error>")) {
+        return abort(fmt.Errorf("failed to complete multipart upload of %s: %s", key, resp))
+    }
+    return nil
+}
+
+// uploadPart uploads one part and returns its ETag
+func (s *S3Storage) uploadPart(key string, query url.Values, body io.ReadSeeker) (string, error) {
+    var etag string
+    err := s.send(http.MethodPut, key, query, body, nil, func(resp *http.Response) {
+        etag = resp.Header.Get("ETag")
+    })
+    if err == nil && etag == "" {
+        err = fmt.Errorf("no ETag in response")
+    }
+    return etag, err
+}
+
+// request sends a signed request and returns the response body
+func (s *S3Storage) request(method, key string, query url.Values, body io.ReadSeeker, headers map[string]string) ([]byte, error) {
+    var data []byte
+    err := s.send(method, key, query, body, headers, func(resp *http.Response) {
+        data, _ = io.ReadAll(resp.Body)
+    })
+    return data, err
+}
+
+// send signs and sends a request, retrying failed attempts, and passes a
+// successful response to handle
+func (s *S3Storage) send(method, key string, query url.Values, body io.ReadSeeker, headers map[string]string, handle func(*http.Response)) error {
+    if body == nil {
+        body = bytes.NewReader(nil)
+    }
+    payloadHash, err := hashPayload(body)
+    if err != nil {
+        return err
+    }
+    if s.config.LockDays > 0 && method == http.MethodPut {
+        // Objects and parts uploaded with an object lock must carry the
+        // MD5 of their content
+        sum, err := md5Payload(body)
+        if err != nil {
+            return err
+        }
+        withMD5 := map[string]string{"content-md5": sum}
+        for name, value := range headers {
+            withMD5[name] = value
+        }
+        headers = withMD5
+    }
+
+    return sendWithRetry(s.client, s.config.Retry, func() (*http.Request, error) {
+        if _, err := body.Seek(0, io.SeekStart); err != nil {
+            return nil, err
+        }
+        return s.newRequest(method, key, query, body, payloadHash, headers)
+    }, handle)
+}
+
+// newRequest builds a request signed with AWS Signature Version 4
+func (s *S3Storage) newRequest(method, key string, query url.Values, body io.Reader, payloadHash string, headers map[string]string) (*http.Request, error) {
+    host := s.endpoint.Host
+    objectPath := "/" + key
+    if s.config.PathStyle {
+        objectPath = "/" + s.config.Bucket + objectPath
+    } else {
+        host = s.config.Bucket + "." + host
+    }
+    canonicalURI := strings.TrimRight(s.endpoint.Path, "/") + uriEncode(objectPath, false)
+    canonicalQuery := canonicalQueryString(query)
+
+    target := fmt.Sprintf("%s://%s%s", s.endpoint.Scheme, host, canonicalURI)
+    if canonicalQuery != "" {
+        target += "?" + canonicalQuery
+    }
+    req, err := http.NewRequest(method, target, body)
+    if err != nil {
+        return nil, err
+    }
+    if sized, ok := body.(interface{ Size() int64 }); ok {
+        req.ContentLength = sized.Size()
+    }
+
+    now := time.Now().UTC()
+    amzDate := now.Format("20060102T150405Z")
+    date := now.Format("20060102")
+
+    signed := map[string]string{
+        "host":                 host,
+        "x-amz-content-sha256": payloadHash,
+        "x-amz-date":           amzDate,
+    }
+    for name, value := range headers {
+        signed[strings.ToLower(name)] = strings.TrimSpace(value)
+    }
+    names := make([]string, 0, len(signed))
+    for name := range signed {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+        if name != "host" {
+            req.Header.Set(name, signed[name])
+        }
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        method, canonicalURI, canonicalQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+    }, "\n")
+    scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.config.Region)
+    stringToSign := strings.Join([]string{
+        "AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest)),
+    }, "\n")
+
+    signingKey := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+    for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+        signingKey = hmacSHA256(signingKey, part)
+    }
+    signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        s.config.AccessKey, scope, signedHeaders, signature))
+    return req, nil
+}
+
+// fullKey prepends the configured prefix to a key
+func (s *S3Storage) fullKey(key string) string {
+    return prefixedKey(s.config.Prefix, key)
+}
+
+// hashPayload returns the hex SHA-256 of a body, which signed requests must include
+func hashPayload(body io.ReadSeeker) (string, error) {
+    if _, err := body.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    h := sha256.New()
+    if _, err := io.Copy(h, body); err != nil {
+        return "", fmt.Errorf("failed to hash upload: %v", err)
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// md5Payload returns the base64 MD5 of a body for the Content-MD5 header
+func md5Payload(body io.ReadSeeker) (string, error) {
+    if _, err := body.Seek(0, io.SeekStart); err != nil {
+        return "", err
+    }
+    h := md5.New()
+    if _, err := io.Copy(h, body); err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// canonicalQueryString encodes query parameters sorted by name as SigV4 requires
+func canonicalQueryString(query url.Values) string {
+    var pairs []string
+    for name, values := range query {
+        for _, value := range values {
+            pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+        }
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything except unreserved characters and,
+// unless encodeSlash is set, slashes
+func uriEncode(s string, encodeSlash bool) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        switch {
+        case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+            c == '-', c == '_', c == '.', c == '~':
+            b.WriteByte(c)
+        case c == '/' && !encodeSlash:
+            b.WriteByte(c)
+        default:
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+    sum := sha256.Sum256(data)
+    return hex.EncodeToString(sum[:])
+}
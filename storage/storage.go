@@ -0,0 +1,168 @@
+package storage
+
+import (
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// Uploader copies finished backup artifacts to storage off the server
+type Uploader interface {
+    // PutObject uploads the file at localPath under key, attaching metadata
+    // as user-defined object metadata
+    PutObject(key, localPath string, metadata map[string]string) error
+    // Location describes where keys end up, for messages
+    Location(key string) string
+}
+
+// Deleter is implemented by storages that remove the copies of archives
+// rotated out of the backup directory, so they keep the same archives.
+// Buckets leave that to their lifecycle rules instead.
+type Deleter interface {
+    // DeleteObject removes the object stored under key; a missing object
+    // is not an error
+    DeleteObject(key string) error
+}
+
+// Fetcher is implemented by storages archives can be downloaded from again,
+// such as the cold storage old archives are moved to
+type Fetcher interface {
+    // GetObject downloads the object stored under key to localPath
+    GetObject(key, localPath string) error
+}
+
+// Stater is implemented by storages that can tell whether an object exists
+// without downloading it, to catch copies deleted off-server
+type Stater interface {
+    // StatObject reports whether an object is stored under key
+    StatObject(key string) (bool, error)
+}
+
+// ErrRestoring is returned by GetObject for an object in an archive storage
+// class, such as S3 Glacier or the Azure archive tier, which can't be read
+// until it is restored. The restore has been requested; fetching the object
+// again once it finished, usually within hours, succeeds.
+var ErrRestoring = errors.New("object is in an archive storage class, a restore was requested, try again in a few hours")
+
+// ChecksumSuffix is appended to a key to get the key of its checksum file,
+// kept next to the archive on storages without object metadata
+const ChecksumSuffix = ".sha256"
+
+// SignatureSuffix is appended to a key to get the key of the signature of
+// its checksum file
+const SignatureSuffix = ChecksumSuffix + ".sig"
+
+// checksumLine returns the content of the checksum file of a key, in the
+// format of sha256sum, or nil if the metadata holds no checksum
+func checksumLine(key string, metadata map[string]string) []byte {
+    if metadata["sha256"] == "" {
+        return nil
+    }
+    return []byte(fmt.Sprintf("%s  %s\n", metadata["sha256"], path.Base(key)))
+}
+
+// checksumSignature returns the raw signature of the checksum file of a key,
+// or nil if the metadata holds none
+func checksumSignature(metadata map[string]string) []byte {
+    signature, err := base64.StdEncoding.DecodeString(metadata["signature"])
+    if err != nil || len(signature) == 0 {
+        return nil
+    }
+    return signature
+}
+
+// ObjectKey returns the key of an artifact from its path relative to the
+// backup base directory, e.g. "site/example.com/files_<ts>.tar.gz" or
+// "site/example.com/database/db_<ts>.sql.gz". Keeping every site below its
+// own prefix lets lifecycle rules expire old archives per site.
+func ObjectKey(relPath string) string {
+    return path.Join("site", strings.TrimPrefix(filepath.ToSlash(relPath), "/"))
+}
+
+// prefixedKey prepends a prefix, e.g. separating servers sharing a bucket, to a key
+func prefixedKey(prefix, key string) string {
+    prefix = strings.Trim(prefix, "/")
+    if prefix == "" {
+        return key
+    }
+    return prefix + "/" + key
+}
+
+// multiUploader copies every artifact to several storages
+type multiUploader []Uploader
+
+// Multi returns an uploader copying artifacts to all of the given storages
+func Multi(uploaders ...Uploader) Uploader {
+    if len(uploaders) == 1 {
+        return uploaders[0]
+    }
+    return multiUploader(uploaders)
+}
+
+// PutObject uploads the file to every storage. An upload failing doesn't
+// keep the file from the other storages.
+func (m multiUploader) PutObject(key, localPath string, metadata map[string]string) error {
+    var errs []error
+    for _, u := range m {
+        if err := u.PutObject(key, localPath, metadata); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// Location lists the locations of a key in all storages
+func (m multiUploader) Location(key string) string {
+    var locations []string
+    for _, u := range m {
+        locations = append(locations, u.Location(key))
+    }
+    return strings.Join(locations, " ")
+}
+
+// StatObject reports whether the object is stored in every storage that can
+// tell; an object missing from one of them is missing
+func (m multiUploader) StatObject(key string) (bool, error) {
+    for _, u := range m {
+        if s, ok := u.(Stater); ok {
+            exists, err := s.StatObject(key)
+            if err != nil || !exists {
+                return false, err
+            }
+        }
+    }
+    return true, nil
+}
+
+// Locate returns the storage of u, or of the storages it copies to, that
+// stores key at location, or nil if none does
+func Locate(u Uploader, key, location string) Uploader {
+    if m, ok := u.(multiUploader); ok {
+        for _, single := range m {
+            if single.Location(key) == location {
+                return single
+            }
+        }
+        return nil
+    }
+    if u != nil && u.Location(key) == location {
+        return u
+    }
+    return nil
+}
+
+// DeleteObject removes the object from every storage that supports deleting
+func (m multiUploader) DeleteObject(key string) error {
+    var errs []error
+    for _, u := range m {
+        if d, ok := u.(Deleter); ok {
+            if err := d.DeleteObject(key); err != nil {
+                errs = append(errs, err)
+            }
+        }
+    }
+    return errors.Join(errs...)
+}
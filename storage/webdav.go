@@ -0,0 +1,190 @@
+package storage
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "strings"
+    "sync"
+    "time"
+    "laravel-backup-tool/retry"
+)
+
+// WebDAVConfig holds the settings of a WebDAV server
+type WebDAVConfig struct {
+    // URL of the collection the keys are stored below, e.g.
+    // https://u12345.your-storagebox.de/backups
+    URL      string
+    Username string
+    Password string
+    // How failed requests are retried, retry.Default() if not set
+    Retry    retry.Policy
+}
+
+// WebDAVStorage uploads artifacts to a WebDAV server, keeping the layout
+// of the keys as collections
+type WebDAVStorage struct {
+    config WebDAVConfig
+    base   *url.URL
+    client *http.Client
+    // Collections known to exist
+    mu          sync.Mutex
+    collections map[string]bool
+}
+
+// NewWebDAVStorage creates an uploader for the configured server
+func NewWebDAVStorage(config WebDAVConfig) (*WebDAVStorage, error) {
+    base, err := url.Parse(config.URL)
+    if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+        return nil, fmt.Errorf("invalid WebDAV URL %q", config.URL)
+    }
+    base.Path = strings.TrimRight(base.Path, "/")
+    if config.Retry.Attempts == 0 {
+        config.Retry = retry.Default()
+    }
+    return &WebDAVStorage{
+        config:      config,
+        base:        base,
+        client:      &http.Client{Timeout: 30 * time.Minute},
+        collections: make(map[string]bool),
+    }, nil
+}
+
+// Location returns the URL of a key's file
+func (w *WebDAVStorage) Location(key string) string {
+    return w.url(key)
+}
+
+// url returns the URL of a path below the base collection
+func (w *WebDAVStorage) url(name string) string {
+    u := *w.base
+    u.RawPath = ""
+    return u.String() + "/" + uriEncode(name, false)
+}
+
+// PutObject creates the collections of a key and uploads the file and, if
+// the metadata holds a checksum, its checksum file and signature
+func (w *WebDAVStorage) PutObject(key, localPath string, metadata map[string]string) error {
+    file, err := os.Open(localPath)
+    if err != nil {
+        return fmt.Errorf("failed to open %s: %v", localPath, err)
+    }
+    defer file.Close()
+
+    info, err := file.Stat()
+    if err != nil {
+        return fmt.Errorf("failed to stat %s: %v", localPath, err)
+    }
+    if err := w.makeCollections(path.Dir(key)); err != nil {
+        return fmt.Errorf("failed to create collection for %s: %v", w.Location(key), err)
+    }
+    if err := w.send(http.MethodPut, key, io.NewSectionReader(file, 0, info.Size()), nil); err != nil {
+        return fmt.Errorf("failed to upload %s: %v", w.Location(key), err)
+    }
+    if sum := checksumLine(key, metadata); sum != nil {
+        if err := w.send(http.MethodPut, key+ChecksumSuffix, bytes.NewReader(sum), nil); err != nil {
+            return fmt.Errorf("failed to upload %s: %v", w.Location(key+ChecksumSuffix), err)
+        }
+    }
+    if signature := checksumSignature(metadata); signature != nil {
+        if err := w.send(http.MethodPut, key+SignatureSuffix, bytes.NewReader(signature), nil); err != nil {
+            return fmt.Errorf("failed to upload %s: %v", w.Location(key+SignatureSuffix), err)
+        }
+    }
+    return nil
+}
+
+// DeleteObject removes a key's file, its checksum file and signature
+func (w *WebDAVStorage) DeleteObject(key string) error {
+    for _, name := range []string{key, key + ChecksumSuffix, key + SignatureSuffix} {
+        if err := w.send(http.MethodDelete, name, nil, nil); err != nil && !hasStatus(err, http.StatusNotFound) {
+            return fmt.Errorf("failed to delete %s: %v", w.Location(name), err)
+        }
+    }
+    return nil
+}
+
+// GetObject downloads a key's file
+func (w *WebDAVStorage) GetObject(key, localPath string) error {
+    var saveErr error
+    err := w.send(http.MethodGet, key, nil, saveTo(localPath, &saveErr))
+    if err == nil {
+        err = saveErr
+    }
+    if err != nil {
+        return fmt.Errorf("failed to download %s: %v", w.Location(key), err)
+    }
+    return nil
+}
+
+// StatObject looks a key's file up with a HEAD request
+func (w *WebDAVStorage) StatObject(key string) (bool, error) {
+    err := w.send(http.MethodHead, key, nil, nil)
+    if hasStatus(err, http.StatusNotFound) {
+        return false, nil
+    }
+    if err != nil {
+        return false, fmt.Errorf("failed to look up %s: %v", w.Location(key), err)
+    }
+    return true, nil
+}
+
+// makeCollections creates a collection and its parents that aren't known
+// to exist. A collection that exists already is refused with 405.
+func (w *WebDAVStorage) makeCollections(dir string) error {
+    if dir == "." || dir == "" {
+        return nil
+    }
+    var current string
+    for _, part := range strings.Split(dir, "/") {
+        current = path.Join(current, part)
+        w.mu.Lock()
+        known := w.collections[current]
+        w.mu.Unlock()
+        if known {
+            continue
+        }
+        if err := w.send("MKCOL", current, nil, nil); err != nil && !hasStatus(err, http.StatusMethodNotAllowed) {
+            return err
+        }
+        w.mu.Lock()
+        w.collections[current] = true
+        w.mu.Unlock()
+    }
+    return nil
+}
+
+// send sends an authenticated request for a path, retrying failed attempts,
+// and passes a successful response to handle if it is set
+func (w *WebDAVStorage) send(method, name string, body io.ReadSeeker, handle func(*http.Response)) error {
+    if body == nil {
+        body = bytes.NewReader(nil)
+    }
+    if handle == nil {
+        handle = func(*http.Response) {}
+    }
+    target := w.url(name)
+    return sendWithRetry(w.client, w.config.Retry, func() (*http.Request, error) {
+        if _, err := body.Seek(0, io.SeekStart); err != nil {
+            return nil, err
+        }
+        req, err := http.NewRequest(method, target, body)
+        if err != nil {
+            return nil, err
+        }
+        if sized, ok := body.(interface{ Size() int64 }); ok {
+            req.ContentLength = sized.Size()
+        }
+        if req.ContentLength == 0 {
+            req.Body = http.NoBody
+        }
+        if w.config.Username != "" {
+            req.SetBasicAuth(w.config.Username, w.config.Password)
+        }
+        return req, nil
+    }, handle)
+}
@@ -0,0 +1,351 @@
+"use strict";
+
+// The API token is kept for the browser session only
+const tokenKey = "backup-api-token";
+const statusRank = { ok: 0, unchanged: 1, partial: 2, skipped: 3, failed: 4 };
+
+let selected = null;
+let restoring = null;
+
+// api sends an authorized request and returns the parsed JSON response
+async function api(path, options = {}) {
+    const headers = { Authorization: "Bearer " + sessionStorage.getItem(tokenKey) };
+    if (options.body !== undefined) {
+        headers["Content-Type"] = "application/json";
+    }
+    const response = await fetch(path, { ...options, headers });
+    if (response.status === 401) {
+        showLogin();
+        throw new Error("Not signed in");
+    }
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || response.statusText);
+    }
+    return data;
+}
+
+// el creates an element with text content and child elements
+function el(tag, text, ...children) {
+    const node = document.createElement(tag);
+    if (text !== undefined && text !== null) {
+        node.textContent = text;
+    }
+    node.append(...children);
+    return node;
+}
+
+function badge(status) {
+    const span = el("span", status || "unknown");
+    span.className = "status " + (status || "unknown");
+    return span;
+}
+
+function button(label, onClick) {
+    const b = el("button", label);
+    b.addEventListener("click", (event) => {
+        event.stopPropagation();
+        onClick();
+    });
+    return b;
+}
+
+function formatTime(value) {
+    return value ? new Date(value).toLocaleString() : "-";
+}
+
+function formatSize(bytes) {
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return bytes.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function formatDuration(nanoseconds) {
+    return nanoseconds ? (nanoseconds / 1e9).toFixed(1) + " s" : "-";
+}
+
+function message(text) {
+    document.getElementById("message").textContent = text;
+}
+
+// archiveTimestamp returns the timestamp in an archive's name, as restore expects it
+function archiveTimestamp(path) {
+    const match = path.match(/(\d{4}-\d{2}-\d{2}_\d{6})/);
+    return match ? match[1] : null;
+}
+
+// sitePattern escapes a site name for the site pattern of the artifacts endpoint
+function sitePattern(site) {
+    return site.replace(/[\\*?[]/g, "\\$&");
+}
+
+function showLogin() {
+    document.getElementById("dashboard").hidden = true;
+    document.getElementById("login").hidden = false;
+}
+
+async function loadSites() {
+    const sites = await api("/api/sites");
+    const body = document.querySelector("#sites tbody");
+    body.replaceChildren();
+    for (const site of sites) {
+        const runs = Object.values(site.runs);
+        let health = null;
+        let lastError = "";
+        for (const run of runs) {
+            if (health === null || statusRank[run.status] > statusRank[health]) {
+                health = run.status;
+            }
+            if (run.error && run.status !== "ok") {
+                lastError = run.error;
+            }
+        }
+
+        const latest = (type) => {
+            const entry = site.latest[type];
+            return entry ? formatTime(entry.time) + " (" + formatSize(entry.size) + ")" : "-";
+        };
+        const retention = ["file", "database"]
+            .map((type) => {
+                const r = site.retention[type];
+                return type + ": " + r.archives + " kept, " + formatSize(r.size) + ", " + r.policy;
+            })
+            .join("\n");
+
+        const actions = el("td");
+        if (site.source === "local") {
+            actions.append(button("Back up now", () => startBackup([site.site])));
+        }
+        actions.append(button("Restore", () => openRestore(site)));
+
+        const errorCell = el("td", lastError);
+        errorCell.className = "error";
+        const row = el("tr", null,
+            el("td", site.site), el("td", site.source), el("td", null, badge(health)),
+            el("td", latest("file")), el("td", latest("database")), el("td", retention), errorCell, actions);
+        row.classList.add("selectable");
+        if (selected && selected.site === site.site && selected.source === site.source) {
+            row.classList.add("selected");
+        }
+        row.addEventListener("click", () => selectSite(site));
+        body.append(row);
+    }
+}
+
+async function selectSite(site) {
+    selected = site;
+    document.getElementById("site-detail").hidden = false;
+    document.getElementById("site-title").textContent = site.site + " (" + site.source + ")";
+    await Promise.all([loadSites(), loadSizes(site), loadHistory(site)]);
+}
+
+// loadSizes draws the sizes of the site's archives over time
+async function loadSizes(site) {
+    const query = new URLSearchParams({ site: sitePattern(site.site), source: site.source });
+    const entries = await api("/api/artifacts?" + query);
+    const svg = document.getElementById("sizes");
+    svg.replaceChildren();
+    if (entries.length === 0) {
+        return;
+    }
+
+    const times = entries.map((e) => new Date(e.time).getTime());
+    const minTime = Math.min(...times);
+    const span = Math.max(Math.max(...times) - minTime, 1);
+    const maxSize = Math.max(...entries.map((e) => e.size), 1);
+    for (const type of ["file", "database"]) {
+        const points = entries
+            .filter((e) => e.type === type)
+            .map((e) => {
+                const x = ((new Date(e.time).getTime() - minTime) / span) * 700 + 10;
+                const y = 190 - (e.size / maxSize) * 180;
+                return x.toFixed(1) + "," + y.toFixed(1);
+            });
+        if (points.length === 1) {
+            points.push(points[0]);
+        }
+        const line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+        line.setAttribute("points", points.join(" "));
+        line.setAttribute("class", type);
+        svg.append(line);
+    }
+    const label = document.createElementNS("http://www.w3.org/2000/svg", "text");
+    label.setAttribute("x", "10");
+    label.setAttribute("y", "14");
+    label.setAttribute("font-size", "12");
+    label.textContent = "max " + formatSize(maxSize);
+    svg.append(label);
+}
+
+async function loadHistory(site) {
+    const query = new URLSearchParams({ site: site.site, limit: "30" });
+    const history = await api("/api/history?" + query);
+    const body = document.querySelector("#history tbody");
+    body.replaceChildren();
+    for (const run of history.filter((r) => r.source === site.source)) {
+        const errorCell = el("td", run.error || "");
+        errorCell.className = "error";
+        body.append(el("tr", null, el("td", formatTime(run.time)), el("td", run.component),
+            el("td", null, badge(run.status)), el("td", formatDuration(run.duration)), errorCell));
+    }
+}
+
+async function loadRuns() {
+    const runs = await api("/api/runs");
+    const body = document.querySelector("#runs tbody");
+    body.replaceChildren();
+    for (const run of runs) {
+        let sites = run.sites ? run.sites.join(", ") : "all";
+        if (run.restore) {
+            sites = run.restore.site + " at " + run.restore.timestamp;
+        }
+        const errorCell = el("td", run.error || "");
+        errorCell.className = "error";
+        body.append(el("tr", null, el("td", run.id), el("td", run.kind), el("td", sites),
+            el("td", null, badge(run.state)), el("td", formatTime(run.started)), errorCell,
+            el("td", null, button("Log", () => followLog(run.id)))));
+    }
+}
+
+// followLog shows the log of a run as it grows until the run ends
+async function followLog(id) {
+    const log = document.getElementById("log");
+    log.hidden = false;
+    log.textContent = "";
+    const response = await fetch("/api/runs/" + encodeURIComponent(id) + "/log", {
+        headers: { Authorization: "Bearer " + sessionStorage.getItem(tokenKey) },
+    });
+    if (!response.ok) {
+        log.textContent = "Failed to load the log: " + response.statusText;
+        return;
+    }
+    const reader = response.body.getReader();
+    const decoder = new TextDecoder();
+    for (;;) {
+        const { value, done } = await reader.read();
+        if (done) {
+            break;
+        }
+        log.textContent += decoder.decode(value, { stream: true });
+        log.scrollTop = log.scrollHeight;
+    }
+    refresh();
+}
+
+async function startBackup(sites) {
+    try {
+        const run = await api("/api/runs", { method: "POST", body: JSON.stringify({ sites }) });
+        message("Started run " + run.id);
+        await loadRuns();
+        followLog(run.id);
+    } catch (err) {
+        message("Backup not started: " + err.message);
+    }
+}
+
+async function openRestore(site) {
+    restoring = site;
+    document.getElementById("restore-site").textContent = site.site;
+    document.getElementById("restore-target").value = "";
+    document.getElementById("restore-force").checked = false;
+    const query = new URLSearchParams({ site: sitePattern(site.site), source: site.source });
+    restoring.entries = await api("/api/artifacts?" + query);
+    fillTimestamps();
+    document.getElementById("restore-dialog").showModal();
+}
+
+// fillTimestamps offers the backups having the archives that are restored
+function fillTimestamps() {
+    const what = document.getElementById("restore-what").value;
+    const stamps = (type) => new Set(restoring.entries
+        .filter((e) => e.type === type)
+        .map((e) => archiveTimestamp(e.path))
+        .filter((t) => t));
+    let offered = what === "database" ? stamps("database") : stamps("file");
+    if (what === "both") {
+        const dumps = stamps("database");
+        offered = new Set([...offered].filter((t) => dumps.has(t)));
+    }
+    const select = document.getElementById("restore-timestamp");
+    select.replaceChildren(el("option", "latest"));
+    for (const stamp of [...offered].sort().reverse()) {
+        select.append(el("option", stamp));
+    }
+}
+
+async function submitRestore() {
+    const what = document.getElementById("restore-what").value;
+    const request = {
+        site: restoring.site,
+        timestamp: document.getElementById("restore-timestamp").value,
+        source: restoring.source.split("/")[0],
+        server: restoring.source.split("/")[1] || "",
+        target: document.getElementById("restore-target").value,
+        database: what === "both",
+        database_only: what === "database",
+        force: document.getElementById("restore-force").checked,
+    };
+    const description = what === "files" ? "the files" : what === "database" ? "the database" : "the files and database";
+    if (!confirm("Restore " + description + " of " + request.site + " from " + request.timestamp + "?")) {
+        return;
+    }
+    try {
+        const run = await api("/api/restores", { method: "POST", body: JSON.stringify(request) });
+        message("Started restore " + run.id);
+        await loadRuns();
+        followLog(run.id);
+    } catch (err) {
+        message("Restore not started: " + err.message);
+    }
+}
+
+async function refresh() {
+    try {
+        await Promise.all([loadSites(), loadRuns()]);
+        if (selected) {
+            await Promise.all([loadSizes(selected), loadHistory(selected)]);
+        }
+    } catch (err) {
+        message(err.message);
+    }
+}
+
+document.getElementById("login-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    sessionStorage.setItem(tokenKey, document.getElementById("token").value);
+    document.getElementById("login").hidden = true;
+    document.getElementById("dashboard").hidden = false;
+    refresh();
+});
+document.getElementById("logout").addEventListener("click", () => {
+    sessionStorage.removeItem(tokenKey);
+    showLogin();
+});
+document.getElementById("refresh").addEventListener("click", refresh);
+document.getElementById("backup-all").addEventListener("click", () => {
+    if (confirm("Start a full backup run of all sites?")) {
+        startBackup([]);
+    }
+});
+document.getElementById("restore-what").addEventListener("change", fillTimestamps);
+document.getElementById("restore-dialog").addEventListener("close", () => {
+    if (document.getElementById("restore-dialog").returnValue === "restore") {
+        submitRestore();
+    }
+});
+
+if (sessionStorage.getItem(tokenKey)) {
+    document.getElementById("dashboard").hidden = false;
+    refresh();
+} else {
+    showLogin();
+}
+setInterval(() => {
+    if (!document.getElementById("dashboard").hidden) {
+        refresh();
+    }
+}, 30000);